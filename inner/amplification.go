@@ -0,0 +1,108 @@
+package inner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/utils"
+)
+
+// writeCheckpointFile 写入量计数器的检查点文件，位于DataDir下
+const writeCheckpointFile = "STATS"
+
+// writeCounters 累计写入量，用于计算写放大，在刷盘和压缩完成以及关闭时持久化
+type writeCounters struct {
+	userBytes  atomic.Int64 // 用户写入的key和value字节数
+	walBytes   atomic.Int64 // 写入WAL的字节数
+	flushBytes atomic.Int64 // 刷盘写入L0的SST字节数
+	saveMu     sync.Mutex   // 串行化检查点写入
+}
+
+// writeCheckpoint 检查点文件内容
+type writeCheckpoint struct {
+	UserBytes  int64  `json:"user_bytes"`
+	WALBytes   int64  `json:"wal_bytes"`
+	FlushBytes int64  `json:"flush_bytes"`
+	LastSeq    uint64 `json:"last_seq,omitempty"` // 开启TrackSequences时保存时的提交序列号
+
+	LevelBytesRead    []int64 `json:"level_bytes_read,omitempty"`    // 按层级累计的压缩输入字节数
+	LevelBytesWritten []int64 `json:"level_bytes_written,omitempty"` // 按层级累计的刷盘和压缩输出字节数
+}
+
+func writeCheckpointPath(dataDir string) string {
+	return filepath.Join(dataDir, writeCheckpointFile)
+}
+
+// loadWriteCounters 从检查点恢复计数器，检查点不存在时从0开始
+func (t *LsmTree) loadWriteCounters() error {
+	data, err := os.ReadFile(writeCheckpointPath(t.conf.DataDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var checkpoint writeCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	t.counters.userBytes.Store(checkpoint.UserBytes)
+	t.counters.walBytes.Store(checkpoint.WALBytes)
+	t.counters.flushBytes.Store(checkpoint.FlushBytes)
+	t.levelIO.load(checkpoint.LevelBytesRead, checkpoint.LevelBytesWritten)
+	if t.conf.TrackSequences {
+		t.commitSeq = checkpoint.LastSeq
+	}
+	return nil
+}
+
+// saveWriteCounters 持久化计数器，上次保存之后的写入在崩溃时不会计入
+func (t *LsmTree) saveWriteCounters() error {
+	t.counters.saveMu.Lock()
+	defer t.counters.saveMu.Unlock()
+	checkpoint := writeCheckpoint{
+		UserBytes:  t.counters.userBytes.Load(),
+		WALBytes:   t.counters.walBytes.Load(),
+		FlushBytes: t.counters.flushBytes.Load(),
+	}
+	checkpoint.LevelBytesRead, checkpoint.LevelBytesWritten = t.levelIO.snapshot()
+	if t.conf.TrackSequences {
+		checkpoint.LastSeq = t.LastSequence()
+	}
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(writeCheckpointPath(t.conf.DataDir), data)
+}
+
+// recordUserWrite 记录一次用户写入，walBefore为写入前当前WAL的大小，调用方需持有t.mu写锁
+func (t *LsmTree) recordUserWrite(userBytes int64, walBefore uint32) {
+	t.counters.userBytes.Add(userBytes)
+	t.counters.walBytes.Add(int64(t.curWal.Size() - walBefore))
+}
+
+// WriteAmplification 写放大：写入的SST总字节数 / 用户写入的字节数。SST字节数为各层LevelIO的写入量之和，
+// 包括刷盘以及层级压缩、Vacuum和定期重写的输出，平移不写入数据，不计入
+func (s Stats) WriteAmplification() float64 {
+	if s.UserBytesWritten == 0 {
+		return 0
+	}
+	var written int64
+	for _, level := range s.levelIO {
+		written += level.BytesWritten
+	}
+	return float64(written) / float64(s.UserBytesWritten)
+}
+
+// SpaceAmplification 空间放大：当前SST文件总大小 / 估算的逻辑数据大小
+func (s Stats) SpaceAmplification() float64 {
+	if s.LogicalBytes == 0 {
+		return 0
+	}
+	return float64(s.LiveSSTBytes) / float64(s.LogicalBytes)
+}
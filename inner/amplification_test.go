@@ -0,0 +1,129 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// waitFlushed 等待所有不可变内存表刷盘完成
+func waitFlushed(t *testing.T, tree *LsmTree) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		tree.mu.RLock()
+		pending := len(tree.immutableIndex)
+		tree.mu.RUnlock()
+		if pending == 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("immutable memtables were not flushed in time")
+}
+
+func TestLsmTree_Amplification(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 16 * 1024
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte{'v'}, 100)
+	for i := 0; i < 1000; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%04d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFlushed(t, tree)
+
+	stats := tree.Stats()
+	if want := int64(1000 * (8 + 100)); stats.UserBytesWritten != want {
+		t.Fatalf("UserBytesWritten = %d, want %d", stats.UserBytesWritten, want)
+	}
+	if stats.WALBytesWritten <= stats.UserBytesWritten {
+		t.Fatalf("WALBytesWritten %d should include record overhead over %d", stats.WALBytesWritten, stats.UserBytesWritten)
+	}
+	// 只有刷盘没有压缩，写放大接近1，未刷盘的内存表数据不超过一个WAL
+	if wa := stats.WriteAmplification(); wa < 0.7 || wa > 1.5 {
+		t.Fatalf("WriteAmplification = %.3f, want within [0.7, 1.5]", wa)
+	}
+	// 没有覆盖写和删除，空间放大只来自索引、过滤器和编码开销
+	if sa := stats.SpaceAmplification(); sa < 1.0 || sa > 1.5 {
+		t.Fatalf("SpaceAmplification = %.3f, want within [1.0, 1.5]", sa)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	resumed := tree.Stats()
+	if resumed.UserBytesWritten != stats.UserBytesWritten ||
+		resumed.WALBytesWritten != stats.WALBytesWritten ||
+		resumed.FlushBytesWritten != stats.FlushBytesWritten {
+		t.Fatalf("counters reset after reopen: before %+v, after %+v", stats, resumed)
+	}
+	if err := tree.Put([]byte("more"), value); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.Stats().UserBytesWritten; got != stats.UserBytesWritten+4+100 {
+		t.Fatalf("UserBytesWritten = %d after reopen and one put, want %d", got, stats.UserBytesWritten+104)
+	}
+}
+
+// 压缩重写的输出计入写放大：与TestLsmTree_LevelIO相同，前两个L0文件写入相同的key，第三个刷盘使最旧的文件平移到L1，
+// 第四个使次旧的文件与L1合并重写
+func TestLsmTree_WriteAmplificationCompaction(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	conf.MaxFilesPerLevel = []int{2}
+	events := make(chan CompactionEvent, 2)
+	conf.OnCompactionEvent = func(event CompactionEvent) { events <- event }
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	var event CompactionEvent
+	for file := 0; file < 4; file++ {
+		for i := 0; i < 20; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("key-%d-%02d", max(file, 1), i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushAll(t, tree)
+		if file < 2 {
+			continue
+		}
+		select {
+		case event = <-events:
+		case <-time.After(10 * time.Second):
+			t.Fatal("level 0 was not compacted")
+		}
+		waitLevelCompactions(t, tree)
+	}
+	if event.Type != config.CompactionRewrite || event.OutputBytes == 0 {
+		t.Fatalf("last compaction event %+v, want a rewrite with output", event)
+	}
+
+	stats := tree.Stats()
+	var written int64
+	for _, level := range stats.LevelIO() {
+		written += level.BytesWritten
+	}
+	if written != stats.FlushBytesWritten+event.OutputBytes {
+		t.Fatalf("level bytes written = %d, want flushed %d plus compaction output %d", written, stats.FlushBytesWritten, event.OutputBytes)
+	}
+	flushOnly := float64(stats.FlushBytesWritten) / float64(stats.UserBytesWritten)
+	if wa := stats.WriteAmplification(); wa <= flushOnly || wa != float64(written)/float64(stats.UserBytesWritten) {
+		t.Fatalf("WriteAmplification = %.3f, want %d/%d above flush-only %.3f", wa, written, stats.UserBytesWritten, flushOnly)
+	}
+}
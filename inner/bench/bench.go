@@ -0,0 +1,313 @@
+// Package bench 提供参考db_bench的标准基准负载，通过go test -bench运行。
+// 键、value和随机访问顺序都由Options.Seed派生，相同参数的两次运行执行完全相同的操作序列
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/aixiasang/lsm/inner"
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// KeySize 负载中每个key的字节数
+const KeySize = 16
+
+// valueBufferSize 预先生成的随机value数据大小，各次写入从中截取
+const valueBufferSize = 1 << 20
+
+// 负载名称，与db_bench的同名负载对应
+const (
+	FillSeq     = "fillseq"     // 按顺序写入Keys个key
+	FillRandom  = "fillrandom"  // 随机写入Keys次，key可能重复
+	Overwrite   = "overwrite"   // 写满后随机覆盖写入Keys次
+	ReadRandom  = "readrandom"  // 写满后随机读取Keys次存在的key
+	ReadMissing = "readmissing" // 写满后随机读取Keys次不存在的key
+	ReadSeq     = "readseq"     // 写满后按顺序遍历全部key
+	Mixed       = "mixed"       // 写满后随机操作Keys次，80%读取、20%覆盖写入
+)
+
+// Options 负载参数，零值字段使用默认值
+type Options struct {
+	Keys           int                       // key数量，也是每个负载的操作次数
+	ValueSize      int                       // 每个value的字节数
+	BlockSizeBytes int64                     // 数据块目标大小(字节)，0表示使用默认值
+	BloomBits      uint64                    // 每个布隆过滤器的位数，0表示使用默认过滤器
+	Sync           bool                      // 每次写入是否fsync WAL
+	WalSize        uint32                    // WAL大小，决定内存表多久刷盘一次，0表示使用默认值
+	Seed           int64                     // 随机种子
+	Clock          config.Clock              // 计时使用的时间来源，为nil时使用系统时间
+	Tune           func(conf *config.Config) // 在上述参数之后调整其余配置，可以为nil
+}
+
+// Result 一次负载的统计
+type Result struct {
+	Name    string        // 负载名称
+	Ops     int           // 操作次数，readseq为遍历到的条目数
+	Found   int           // 读取操作找到的key数量
+	Bytes   int64         // 写入和读到的key与value字节数
+	Elapsed time.Duration // 负载耗时，不包括写满数据的准备阶段
+	Latency Histogram     // 每次操作的耗时
+}
+
+// OpsPerSec 返回每秒操作次数
+func (r *Result) OpsPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// MBPerSec 返回每秒读写的MB数
+func (r *Result) MBPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / (1 << 20) / r.Elapsed.Seconds()
+}
+
+// workload 一个负载，prefill为true时运行前需要写满全部key
+type workload struct {
+	prefill bool
+	run     func(b *Bench, res *Result) error
+}
+
+var workloads = map[string]workload{
+	FillSeq:     {run: (*Bench).fillSeq},
+	FillRandom:  {run: (*Bench).fillRandom},
+	Overwrite:   {prefill: true, run: (*Bench).fillRandom},
+	ReadRandom:  {prefill: true, run: (*Bench).readRandom},
+	ReadMissing: {prefill: true, run: (*Bench).readMissing},
+	ReadSeq:     {prefill: true, run: (*Bench).readSeq},
+	Mixed:       {prefill: true, run: (*Bench).mixed},
+}
+
+// Workloads 按db_bench的默认顺序返回所有负载名称
+func Workloads() []string {
+	return []string{FillSeq, FillRandom, Overwrite, ReadRandom, ReadMissing, ReadSeq, Mixed}
+}
+
+// Bench 在一个数据库上依次运行负载，非并发安全
+type Bench struct {
+	opts   Options
+	conf   *config.Config
+	tree   *inner.LsmTree
+	clock  config.Clock
+	rnd    *rand.Rand // 负载的随机访问顺序
+	values []byte     // 预先生成的随机value数据
+	filled bool       // 是否已写入全部key
+}
+
+// Open 在空目录dir中按opts创建数据库
+func Open(dir string, opts Options) (*Bench, error) {
+	if opts.Keys <= 0 || opts.ValueSize < 0 {
+		return nil, fmt.Errorf("bench: invalid Keys %d or ValueSize %d", opts.Keys, opts.ValueSize)
+	}
+	conf := config.DefaultConfig()
+	conf.DataDir = dir
+	conf.IsDebug = false
+	conf.Logger = nil
+	conf.AutoSync = opts.Sync
+	conf.Clock = opts.Clock
+	conf.RandSource = rand.NewSource(opts.Seed)
+	if opts.BlockSizeBytes > 0 {
+		conf.BlockSizeBytes = opts.BlockSizeBytes
+	}
+	if opts.BloomBits > 0 {
+		// FilterPolicy为空时按FilterConstructor写入，读取没有记录名称的文件时也使用它
+		bloomBits := opts.BloomBits
+		conf.FilterPolicy = ""
+		conf.FilterConstructor = func(_ uint64, k uint) filter.Filter {
+			return filter.NewBloomFilter(bloomBits, k)
+		}
+	}
+	if opts.WalSize > 0 {
+		conf.WalSize = opts.WalSize
+	}
+	if opts.Tune != nil {
+		opts.Tune(conf)
+	}
+
+	// 在打开数据库之前派生随机源，使负载的随机序列不受数据库内部派生次数的影响
+	rnd := conf.NewRand()
+	values := make([]byte, max(valueBufferSize, 2*opts.ValueSize))
+	rnd.Read(values)
+	tree, err := inner.NewLsmTree(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &Bench{
+		opts:   opts,
+		conf:   conf,
+		tree:   tree,
+		clock:  conf.GetClock(),
+		rnd:    rnd,
+		values: values,
+	}, nil
+}
+
+// Close 关闭数据库
+func (b *Bench) Close() error {
+	return b.tree.Close()
+}
+
+// Tree 返回负载使用的数据库
+func (b *Bench) Tree() *inner.LsmTree {
+	return b.tree
+}
+
+// Prefill 按顺序写入全部key，不计入任何负载的统计；已写满时直接返回
+func (b *Bench) Prefill() error {
+	if b.filled {
+		return nil
+	}
+	return b.fillSeq(&Result{})
+}
+
+// Run 运行名为name的负载，需要时先调用Prefill
+func (b *Bench) Run(name string) (*Result, error) {
+	w, ok := workloads[name]
+	if !ok {
+		return nil, fmt.Errorf("bench: unknown workload %q", name)
+	}
+	if w.prefill {
+		if err := b.Prefill(); err != nil {
+			return nil, err
+		}
+	}
+	res := &Result{Name: name}
+	start := b.clock.Now()
+	err := w.run(b, res)
+	res.Elapsed = b.clock.Now().Sub(start)
+	if err != nil {
+		return nil, fmt.Errorf("bench: %s: %w", name, err)
+	}
+	return res, nil
+}
+
+// key 返回第i个key，i不小于Keys时返回不存在的key
+func key(i int) []byte {
+	return fmt.Appendf(make([]byte, 0, KeySize), "%0*d", KeySize, i)
+}
+
+// value 从预先生成的数据中截取一个value
+func (b *Bench) value() []byte {
+	off := b.rnd.Intn(len(b.values) - b.opts.ValueSize + 1)
+	return b.values[off : off+b.opts.ValueSize]
+}
+
+// timed 执行一次操作并记录耗时
+func (b *Bench) timed(res *Result, op func() error) error {
+	start := b.clock.Now()
+	err := op()
+	res.Latency.Record(b.clock.Now().Sub(start))
+	res.Ops++
+	return err
+}
+
+func (b *Bench) put(res *Result, i int) error {
+	k, v := key(i), b.value()
+	res.Bytes += int64(len(k) + len(v))
+	return b.timed(res, func() error {
+		return b.tree.Put(k, v)
+	})
+}
+
+// get 读取第i个key，want为key是否应当存在
+func (b *Bench) get(res *Result, i int, want bool) error {
+	k := key(i)
+	var v []byte
+	err := b.timed(res, func() (err error) {
+		v, err = b.tree.Get(k)
+		return err
+	})
+	switch {
+	case err == nil:
+		res.Found++
+		res.Bytes += int64(len(k) + len(v))
+	case !errors.Is(err, myerror.ErrKeyNotFound):
+		return err
+	}
+	if (err == nil) != want {
+		return fmt.Errorf("get %s: found %v, want %v", k, err == nil, want)
+	}
+	return nil
+}
+
+func (b *Bench) fillSeq(res *Result) error {
+	for i := 0; i < b.opts.Keys; i++ {
+		if err := b.put(res, i); err != nil {
+			return err
+		}
+	}
+	b.filled = true
+	return nil
+}
+
+func (b *Bench) fillRandom(res *Result) error {
+	for range b.opts.Keys {
+		if err := b.put(res, b.rnd.Intn(b.opts.Keys)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bench) readRandom(res *Result) error {
+	for range b.opts.Keys {
+		if err := b.get(res, b.rnd.Intn(b.opts.Keys), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Bench) readMissing(res *Result) error {
+	for range b.opts.Keys {
+		if err := b.get(res, b.opts.Keys+b.rnd.Intn(b.opts.Keys), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeq 遍历全部key，每个条目的耗时为距上一个条目的时间，第一个条目包括合并各层数据的时间
+func (b *Bench) readSeq(res *Result) error {
+	last := b.clock.Now()
+	err := b.tree.PrefixScan(nil, func(k, v []byte) bool {
+		now := b.clock.Now()
+		res.Latency.Record(now.Sub(last))
+		last = now
+		res.Ops++
+		res.Found++
+		res.Bytes += int64(len(k) + len(v))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if res.Found != b.opts.Keys {
+		return fmt.Errorf("scanned %d keys, want %d", res.Found, b.opts.Keys)
+	}
+	return nil
+}
+
+func (b *Bench) mixed(res *Result) error {
+	for range b.opts.Keys {
+		i := b.rnd.Intn(b.opts.Keys)
+		var err error
+		if b.rnd.Intn(5) == 0 {
+			err = b.put(res, i)
+		} else {
+			err = b.get(res, i, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package bench
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// tinyOptions 让每个负载在测试中很快完成，WAL很小以覆盖刷盘后从SST读取的路径
+func tinyOptions() Options {
+	return Options{Keys: 300, ValueSize: 32, BlockSizeBytes: 512, BloomBits: 2048, WalSize: 4096, Seed: 1}
+}
+
+func TestWorkloads(t *testing.T) {
+	for _, name := range Workloads() {
+		t.Run(name, func(t *testing.T) {
+			opts := tinyOptions()
+			b, err := Open(t.TempDir(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			res, err := b.Run(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Ops != opts.Keys || res.Latency.Count() != uint64(opts.Keys) || res.Bytes == 0 && name != ReadMissing {
+				t.Fatalf("ops %d, latency samples %d, bytes %d", res.Ops, res.Latency.Count(), res.Bytes)
+			}
+			switch name {
+			case ReadRandom, ReadSeq:
+				if res.Found != opts.Keys {
+					t.Fatalf("found %d of %d", res.Found, opts.Keys)
+				}
+			case ReadMissing:
+				if res.Found != 0 {
+					t.Fatalf("found %d missing keys", res.Found)
+				}
+			}
+		})
+	}
+	if _, err := Open(t.TempDir(), Options{}); err == nil {
+		t.Fatal("expected Keys 0 to be rejected")
+	}
+}
+
+// contents 返回数据库中的全部键值对
+func contents(t *testing.T, b *Bench) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	if err := b.Tree().PrefixScan(nil, func(k, v []byte) bool {
+		out[string(k)] = string(v)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestWorkloadsDeterministic(t *testing.T) {
+	run := func(seed int64) (map[string]string, *Result) {
+		opts := tinyOptions()
+		opts.Seed = seed
+		b, err := Open(t.TempDir(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		if _, err := b.Run(FillRandom); err != nil {
+			t.Fatal(err)
+		}
+		res, err := b.Run(Mixed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return contents(t, b), res
+	}
+	first, firstRes := run(7)
+	second, secondRes := run(7)
+	if fmt.Sprint(first) != fmt.Sprint(second) || firstRes.Found != secondRes.Found || firstRes.Bytes != secondRes.Bytes {
+		t.Fatal("runs with the same seed differ")
+	}
+	if other, _ := run(8); fmt.Sprint(first) == fmt.Sprint(other) {
+		t.Fatal("runs with different seeds are identical")
+	}
+}
+
+// stepClock 每次读取时间前进固定步长，数据库的后台任务也会读取时间
+type stepClock struct {
+	config.Clock
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func TestRunAllSummary(t *testing.T) {
+	opts := tinyOptions()
+	opts.Clock = &stepClock{Clock: config.RealClock(), now: time.Unix(0, 0), step: time.Microsecond}
+	var out bytes.Buffer
+	results, err := RunAll(&out, t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(Workloads()) {
+		t.Fatalf("got %d results", len(results))
+	}
+	// 每次操作至少读取两次时间，数据库内部也会读取时间
+	if p50 := results[0].Latency.Percentile(50); p50 < time.Microsecond {
+		t.Fatalf("fillseq p50 = %v", p50)
+	}
+	summary := out.String()
+	for _, want := range []string{"Entries:    300", "Bloom:      2048 bits", "fillseq      :", "readmissing  :", "(0 found)"} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary missing %q:\n%s", want, summary)
+		}
+	}
+	if _, err := RunAll(&out, t.TempDir(), opts, "compact"); err == nil {
+		t.Fatal("expected unknown workload to fail")
+	}
+}
+
+// benchmarkWorkload 以b.N个key运行负载，ns/op只包括负载本身，另外报告吞吐量和p50/p99延迟
+func benchmarkWorkload(b *testing.B, name string, opts Options) {
+	opts.Keys = b.N
+	bench, err := Open(b.TempDir(), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer bench.Close()
+	if workloads[name].prefill {
+		if err := bench.Prefill(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	res, err := bench.Run(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(res.MBPerSec(), "MB/s")
+	b.ReportMetric(float64(res.Latency.Percentile(50).Nanoseconds()), "p50-ns")
+	b.ReportMetric(float64(res.Latency.Percentile(99).Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkWorkloads(b *testing.B) {
+	configs := []struct {
+		name string
+		opts Options
+	}{
+		{"value100", Options{ValueSize: 100, Seed: 1}},
+		{"value1000", Options{ValueSize: 1000, Seed: 1}},
+		{"block16k-bloom8k", Options{ValueSize: 100, BlockSizeBytes: 16 << 10, BloomBits: 8 << 10, Seed: 1}},
+	}
+	for _, c := range configs {
+		for _, name := range Workloads() {
+			b.Run(c.name+"/"+name, func(b *testing.B) {
+				benchmarkWorkload(b, name, c.opts)
+			})
+		}
+	}
+}
+
+func BenchmarkFillSeqSync(b *testing.B) {
+	benchmarkWorkload(b, FillSeq, Options{ValueSize: 100, Sync: true, Seed: 1})
+}
@@ -0,0 +1,104 @@
+package bench
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits 每个2的幂区间均分的子桶数为1<<subBucketBits，记录值的相对误差不超过1/16
+const subBucketBits = 4
+
+const (
+	subBuckets = 1 << subBucketBits
+	// 小于subBuckets的值各占一个桶，之后每个2的幂区间占subBuckets个桶
+	bucketCount = (64 - subBucketBits + 1) * subBuckets
+)
+
+// Histogram 按对数分桶记录延迟(纳秒)，内存占用固定，不需要预先知道取值范围，非并发安全
+type Histogram struct {
+	counts [bucketCount]uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// bucketOf 返回值为ns的桶
+func bucketOf(ns uint64) int {
+	if ns < subBuckets {
+		return int(ns)
+	}
+	exp := bits.Len64(ns) - 1
+	sub := (ns >> (exp - subBucketBits)) & (subBuckets - 1)
+	return (exp-subBucketBits+1)*subBuckets + int(sub)
+}
+
+// bucketUpper 返回桶i中的最大值
+func bucketUpper(i int) uint64 {
+	if i < subBuckets {
+		return uint64(i)
+	}
+	exp := i/subBuckets + subBucketBits - 1
+	sub := uint64(i % subBuckets)
+	low := (subBuckets + sub) << (exp - subBucketBits)
+	return low + 1<<(exp-subBucketBits) - 1
+}
+
+// Record 记录一次耗时，负数按0记录
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.counts[bucketOf(uint64(d))]++
+	h.count++
+	h.sum += d
+}
+
+// Count 返回记录的次数
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Min 返回记录的最小值
+func (h *Histogram) Min() time.Duration {
+	return h.min
+}
+
+// Max 返回记录的最大值
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Mean 返回平均值，没有记录时返回0
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile 返回第p百分位的值，取所在桶的上界且不超过最大值，没有记录时返回0
+func (h *Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(p / 100 * float64(h.count)))
+	if target < 1 {
+		target = 1
+	}
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= target {
+			return min(time.Duration(bucketUpper(i)), h.max)
+		}
+	}
+	return h.max
+}
@@ -0,0 +1,45 @@
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	// 相邻的桶首尾相接，每个值落在上界不小于它的桶中
+	for ns := uint64(0); ns < 1<<14; ns++ {
+		i := bucketOf(ns)
+		if bucketUpper(i) < ns || i > 0 && bucketUpper(i-1) >= ns {
+			t.Fatalf("value %d in bucket %d with upper %d", ns, i, bucketUpper(i))
+		}
+	}
+	if i := bucketOf(1<<64 - 1); i != bucketCount-1 || bucketUpper(i) != 1<<64-1 {
+		t.Fatalf("max value in bucket %d of %d", i, bucketCount)
+	}
+}
+
+func TestHistogramPercentile(t *testing.T) {
+	var h Histogram
+	if h.Percentile(50) != 0 || h.Mean() != 0 {
+		t.Fatal("empty histogram should report zero")
+	}
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 1000 || h.Min() != time.Microsecond || h.Max() != time.Millisecond {
+		t.Fatalf("count %d min %v max %v", h.Count(), h.Min(), h.Max())
+	}
+	for _, tt := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 500 * time.Microsecond}, {99, 990 * time.Microsecond}, {100, time.Millisecond}} {
+		got := h.Percentile(tt.p)
+		// 取桶的上界，相对误差不超过1/16
+		if got < tt.want || got > tt.want+tt.want/subBuckets {
+			t.Errorf("p%v = %v, want about %v", tt.p, got, tt.want)
+		}
+	}
+	if mean := h.Mean(); mean != 500500*time.Nanosecond {
+		t.Errorf("mean = %v", mean)
+	}
+}
@@ -0,0 +1,82 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// micros 把耗时转换为微秒
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// PrintHeader 按db_bench的格式输出负载参数
+func PrintHeader(w io.Writer, opts Options) error {
+	bloom := "default"
+	if opts.BloomBits > 0 {
+		bloom = fmt.Sprintf("%d bits", opts.BloomBits)
+	}
+	blockSize := "default"
+	if opts.BlockSizeBytes > 0 {
+		blockSize = fmt.Sprintf("%d bytes", opts.BlockSizeBytes)
+	}
+	_, err := fmt.Fprintf(w, "Keys:       %d bytes each\nValues:     %d bytes each\nEntries:    %d\n"+
+		"BlockSize:  %s\nBloom:      %s\nSync:       %v\nSeed:       %d\n%s\n",
+		KeySize, opts.ValueSize, opts.Keys, blockSize, bloom, opts.Sync, opts.Seed, strings.Repeat("-", 48))
+	return err
+}
+
+// PrintResult 按db_bench的格式输出一行结果：每次操作的微秒数、每秒操作次数、吞吐量和p50/p99延迟
+func PrintResult(w io.Writer, res *Result) error {
+	var perOp float64
+	if res.Ops > 0 {
+		perOp = micros(res.Elapsed) / float64(res.Ops)
+	}
+	line := fmt.Sprintf("%-12s : %11.3f micros/op; %10.0f ops/sec; %7.1f MB/s; p50 %.3f p99 %.3f micros/op",
+		res.Name, perOp, res.OpsPerSec(), res.MBPerSec(),
+		micros(res.Latency.Percentile(50)), micros(res.Latency.Percentile(99)))
+	if res.Name == ReadRandom || res.Name == ReadMissing || res.Name == Mixed {
+		line += fmt.Sprintf(" (%d found)", res.Found)
+	}
+	_, err := fmt.Fprintln(w, line)
+	return err
+}
+
+// PrintSummary 输出负载参数和各负载的结果
+func PrintSummary(w io.Writer, opts Options, results []*Result) error {
+	if err := PrintHeader(w, opts); err != nil {
+		return err
+	}
+	for _, res := range results {
+		if err := PrintResult(w, res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunAll 在空目录dir中创建数据库，依次运行names中的负载(为空时运行全部负载)，结果汇总输出到w
+func RunAll(w io.Writer, dir string, opts Options, names ...string) ([]*Result, error) {
+	if len(names) == 0 {
+		names = Workloads()
+	}
+	b, err := Open(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*Result, 0, len(names))
+	for _, name := range names {
+		res, err := b.Run(name)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	if err := b.Close(); err != nil {
+		return nil, err
+	}
+	return results, PrintSummary(w, opts, results)
+}
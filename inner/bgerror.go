@@ -0,0 +1,146 @@
+package inner
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// bgErrorState 后台刷盘或压缩失败后的状态
+type bgErrorState struct {
+	mu      sync.Mutex
+	err     error         // 尚未恢复的后台错误，nil表示正常
+	backoff time.Duration // 下一次重试前的等待时间，0表示使用BackgroundRetryInterval
+	retry   chan struct{} // ContinueWithRetry时记录错误后通知compactWorker安排重试
+}
+
+// setBackgroundError 记录后台刷盘或压缩的错误，ContinueWithRetry时通知compactWorker安排重试
+func (t *LsmTree) setBackgroundError(err error) {
+	t.bgError.mu.Lock()
+	first := t.bgError.err == nil
+	t.bgError.err = err
+	t.bgError.mu.Unlock()
+	if first {
+		t.conf.Errorf("background error: %v", err)
+	}
+	if t.conf.OnBackgroundError == config.BackgroundErrorContinueWithRetry {
+		select {
+		case t.bgError.retry <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// clearBackgroundError 清除后台错误并重置重试等待时间
+func (t *LsmTree) clearBackgroundError() {
+	t.bgError.mu.Lock()
+	defer t.bgError.mu.Unlock()
+	if t.bgError.err != nil {
+		t.conf.Infof("background error cleared: %v", t.bgError.err)
+	}
+	t.bgError.err = nil
+	t.bgError.backoff = 0
+}
+
+// BackgroundError 返回尚未恢复的后台刷盘或压缩错误，正常时返回nil
+func (t *LsmTree) BackgroundError() error {
+	t.bgError.mu.Lock()
+	defer t.bgError.mu.Unlock()
+	return t.bgError.err
+}
+
+// checkWritesPaused PauseWrites时存在后台错误则返回包装了ErrWritesPaused和该错误的错误
+func (t *LsmTree) checkWritesPaused() error {
+	if t.conf.OnBackgroundError != config.BackgroundErrorPauseWrites {
+		return nil
+	}
+	if err := t.BackgroundError(); err != nil {
+		return fmt.Errorf("%w: %w", myerror.ErrWritesPaused, err)
+	}
+	return nil
+}
+
+// nextRetryDelay 返回下一次重试前的等待时间，之后的等待时间加倍，不超过MaxBackgroundRetryInterval
+func (t *LsmTree) nextRetryDelay() time.Duration {
+	interval := t.conf.BackgroundRetryInterval
+	if interval <= 0 {
+		interval = config.DefaultBackgroundRetryInterval
+	}
+	maxInterval := t.conf.MaxBackgroundRetryInterval
+	if maxInterval <= 0 {
+		maxInterval = config.DefaultMaxBackgroundRetryInterval
+	}
+	t.bgError.mu.Lock()
+	defer t.bgError.mu.Unlock()
+	delay := t.bgError.backoff
+	if delay <= 0 {
+		delay = interval
+	}
+	delay = min(delay, maxInterval)
+	t.bgError.backoff = min(2*delay, maxInterval)
+	return delay
+}
+
+// retryBackground 重试刷盘所有不可变内存表，全部成功后清除后台错误；失败时刷盘已重新记录错误并通知安排下一次重试
+func (t *LsmTree) retryBackground() {
+	if err := t.flushPending(math.MaxUint32); err != nil {
+		t.conf.Warnf("background retry: %v", err)
+		return
+	}
+	t.clearBackgroundError()
+}
+
+// flushPending 在当前goroutine上依次刷盘序列号小于before的不可变内存表，其他goroutine正在刷盘的等待其完成，
+// 任一刷盘失败时返回错误
+func (t *LsmTree) flushPending(before uint32) error {
+	for {
+		t.mu.Lock()
+		if t.closed.Load() {
+			t.mu.Unlock()
+			return myerror.ErrDBClosed
+		}
+		var target *immutable
+		var wait chan struct{}
+		for _, imm := range t.immutableIndex {
+			if imm.seq >= before || imm.installed {
+				continue
+			}
+			if imm.flushing == nil {
+				target = imm
+				break
+			}
+			if wait == nil {
+				wait = imm.flushing
+			}
+		}
+		if target != nil {
+			target.flushing = make(chan struct{})
+		}
+		t.mu.Unlock()
+
+		switch {
+		case target != nil:
+			if err := t.flushNow(target, t.compactLimiter); err != nil {
+				return err
+			}
+		case wait != nil:
+			<-wait
+		default:
+			return nil
+		}
+	}
+}
+
+// ResumeWrites 在释放磁盘空间等排除故障后调用：刷盘所有未完成的不可变内存表，全部成功后清除后台错误，
+// PauseWrites时恢复写入。刷盘失败时返回错误并保持暂停
+func (t *LsmTree) ResumeWrites() error {
+	if err := t.flushPending(math.MaxUint32); err != nil {
+		return err
+	}
+	t.clearBackgroundError()
+	return nil
+}
@@ -0,0 +1,220 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// diskFull 模拟磁盘已满：full时对路径以prefix开头的文件执行op返回ENOSPC
+type diskFull struct {
+	op     string
+	prefix string
+	full   atomic.Bool
+	hits   atomic.Int64 // 注入错误的次数
+}
+
+func (d *diskFull) hook(op, path string) error {
+	if !d.full.Load() || op != d.op || !strings.HasPrefix(path, d.prefix) {
+		return nil
+	}
+	d.hits.Add(1)
+	return syscall.ENOSPC
+}
+
+// rotateInBackground 写入n个key后轮转WAL，由后台刷盘新的不可变内存表
+func rotateInBackground(t *testing.T, tree *LsmTree, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.mu.Lock()
+	err := tree.rotateWal(RotationManual)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitBackgroundError 等待后台错误的状态变为want(是否存在错误)
+func waitBackgroundError(t *testing.T, tree *LsmTree, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if (tree.BackgroundError() != nil) == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("BackgroundError() = %v, want error %v", tree.BackgroundError(), want)
+}
+
+// checkKeys 检查rotateInBackground写入的前n个key都可以读到
+func checkKeys(t *testing.T, tree *LsmTree, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if _, err := tree.Get([]byte(fmt.Sprintf("key%03d", i))); err != nil {
+			t.Fatalf("get key%03d: %v", i, err)
+		}
+	}
+}
+
+func TestLsmTree_BackgroundErrorPauseWrites(t *testing.T) {
+	conf := newTestConfig(t)
+	fault := &diskFull{op: config.IOWrite}
+	conf.Hooks = &config.TestHooks{IOFault: fault.hook}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	fault.prefix = conf.SSTPath()
+	fault.full.Store(true)
+
+	rotateInBackground(t, tree, 10)
+	waitBackgroundError(t, tree, true)
+	if err := tree.BackgroundError(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("BackgroundError() = %v, want ENOSPC", err)
+	}
+	err = tree.Put([]byte("new"), []byte("value"))
+	if !errors.Is(err, myerror.ErrWritesPaused) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("Put while paused = %v, want ErrWritesPaused wrapping ENOSPC", err)
+	}
+	if err := tree.Delete([]byte("key000")); !errors.Is(err, myerror.ErrWritesPaused) {
+		t.Fatalf("Delete while paused = %v, want ErrWritesPaused", err)
+	}
+	// 暂停期间仍可读取不可变内存表中的数据
+	checkKeys(t, tree, 10)
+
+	// 空间未释放时恢复失败，保持暂停
+	if err := tree.ResumeWrites(); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("ResumeWrites while full = %v, want ENOSPC", err)
+	}
+	if tree.BackgroundError() == nil {
+		t.Fatal("background error cleared by a failed resume")
+	}
+
+	fault.full.Store(false)
+	if err := tree.ResumeWrites(); err != nil {
+		t.Fatalf("ResumeWrites: %v", err)
+	}
+	if err := tree.BackgroundError(); err != nil {
+		t.Fatalf("BackgroundError() after resume = %v", err)
+	}
+	tree.mu.RLock()
+	pending, flushed := len(tree.immutableIndex), len(tree.nodes[0])
+	tree.mu.RUnlock()
+	if pending != 0 || flushed != 1 {
+		t.Fatalf("after resume: %d immutables, %d L0 files, want 0 and 1", pending, flushed)
+	}
+	if err := tree.Put([]byte("new"), []byte("value")); err != nil {
+		t.Fatalf("Put after resume: %v", err)
+	}
+	checkKeys(t, tree, 10)
+}
+
+func TestLsmTree_BackgroundErrorContinueWithRetry(t *testing.T) {
+	conf := newTestConfig(t)
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.OnBackgroundError = config.BackgroundErrorContinueWithRetry
+	conf.BackgroundRetryInterval = time.Second
+	conf.MaxBackgroundRetryInterval = 4 * time.Second
+	// 清单fsync失败，SST已写入但无法记入清单
+	fault := &diskFull{op: config.IOSync, prefix: filepath.Join(conf.DataDir, "MANIFEST-")}
+	conf.Hooks = &config.TestHooks{IOFault: fault.hook}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	fault.full.Store(true)
+
+	rotateInBackground(t, tree, 10)
+	waitBackgroundError(t, tree, true)
+	if err := tree.Put([]byte("new"), []byte("value")); err != nil {
+		t.Fatalf("Put with ContinueWithRetry = %v, want nil", err)
+	}
+
+	// 重试间隔按1s、2s、4s加倍
+	waitTimers(t, clock, 1)
+	hits := fault.hits.Load()
+	clock.Advance(time.Second)
+	waitTimers(t, clock, 1)
+	if got := fault.hits.Load(); got != hits+1 {
+		t.Fatalf("first retry injected %d faults, want 1", got-hits)
+	}
+	clock.Advance(time.Second)
+	if got := fault.hits.Load(); got != hits+1 {
+		t.Fatal("second retry ran before its 2s backoff")
+	}
+	clock.Advance(time.Second)
+	waitTimers(t, clock, 1)
+	if got := fault.hits.Load(); got != hits+2 {
+		t.Fatalf("second retry injected %d faults, want 1", got-hits-1)
+	}
+
+	// 释放空间后下一次重试成功并清除错误
+	fault.full.Store(false)
+	clock.Advance(3 * time.Second)
+	if tree.BackgroundError() == nil {
+		t.Fatal("background error cleared before the 4s backoff")
+	}
+	clock.Advance(time.Second)
+	waitBackgroundError(t, tree, false)
+	tree.mu.RLock()
+	pending := len(tree.immutableIndex)
+	tree.mu.RUnlock()
+	if pending != 0 {
+		t.Fatalf("%d immutables left after successful retry", pending)
+	}
+	checkKeys(t, tree, 10)
+}
+
+func TestLsmTree_WalWriteErrorSurfaces(t *testing.T) {
+	for name, policy := range map[string]config.BackgroundErrorPolicy{
+		"PauseWrites":       config.BackgroundErrorPauseWrites,
+		"ContinueWithRetry": config.BackgroundErrorContinueWithRetry,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.OnBackgroundError = policy
+			fault := &diskFull{op: config.IOWrite}
+			conf.Hooks = &config.TestHooks{IOFault: fault.hook}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			fault.prefix = conf.WalPath()
+			fault.full.Store(true)
+
+			err = tree.Put([]byte("key"), []byte("value"))
+			if !errors.Is(err, syscall.ENOSPC) || errors.Is(err, myerror.ErrWritesPaused) {
+				t.Fatalf("Put with failing WAL = %v, want ENOSPC", err)
+			}
+			// WAL写入失败直接返回给写入方，不记录为后台错误
+			if err := tree.BackgroundError(); err != nil {
+				t.Fatalf("BackgroundError() = %v, want nil", err)
+			}
+			if _, err := tree.Get([]byte("key")); !errors.Is(err, myerror.ErrKeyNotFound) {
+				t.Fatalf("Get after failed Put = %v, want ErrKeyNotFound", err)
+			}
+
+			fault.full.Store(false)
+			if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package inner
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// 变更流由头部和若干WAL记录组成。头部为 magic(8) sinceSeq(8) maxSeq(8) count(8)，
+// 之后是count条按key排序的RecordTypeEntry记录，编码与WAL相同，每条记录带CRC
+const (
+	changeStreamMagic      = "LSMCHG01"
+	changeStreamHeaderSize = 8 + 8 + 8 + 8
+)
+
+// changeHeader 变更流的头部
+type changeHeader struct {
+	sinceSeq uint64 // 导出时的起始序列号，流中的条目序列号都大于它
+	maxSeq   uint64 // 导出时的提交序列号，不大于它的变更都包含在流中
+	count    uint64 // 记录数
+}
+
+func (h changeHeader) encode() []byte {
+	buf := []byte(changeStreamMagic)
+	buf = binary.BigEndian.AppendUint64(buf, h.sinceSeq)
+	buf = binary.BigEndian.AppendUint64(buf, h.maxSeq)
+	return binary.BigEndian.AppendUint64(buf, h.count)
+}
+
+// readChangeHeader 读取并校验变更流的头部
+func readChangeHeader(r io.Reader) (changeHeader, error) {
+	buf := make([]byte, changeStreamHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return changeHeader{}, fmt.Errorf("%w: read header: %v", myerror.ErrChangeStream, err)
+	}
+	if string(buf[:8]) != changeStreamMagic {
+		return changeHeader{}, fmt.Errorf("%w: bad magic %q", myerror.ErrChangeStream, buf[:8])
+	}
+	h := changeHeader{
+		sinceSeq: binary.BigEndian.Uint64(buf[8:16]),
+		maxSeq:   binary.BigEndian.Uint64(buf[16:24]),
+		count:    binary.BigEndian.Uint64(buf[24:32]),
+	}
+	if h.maxSeq < h.sinceSeq {
+		return changeHeader{}, fmt.Errorf("%w: max seq %d before since seq %d", myerror.ErrChangeStream, h.maxSeq, h.sinceSeq)
+	}
+	return h, nil
+}
+
+// ExportChanges 将序列号大于sinceSeq的写入和删除标记按key顺序写入w，每个key只写入最新的版本，
+// 返回的maxSeq为导出时的提交序列号，不大于它的变更都已包含在流中，可以作为下一次导出的sinceSeq。
+// 条目来自内存表和最大序列号大于sinceSeq的SST文件，更旧的文件不读取。需要开启TrackSequences，否则返回ErrSeqNotTracked。
+// 在读锁内收集变更后释放锁再写入w；被压缩丢弃的删除标记不会导出
+func (t *LsmTree) ExportChanges(sinceSeq uint64, w io.Writer) (maxSeq uint64, err error) {
+	if !t.conf.TrackSequences {
+		return 0, myerror.ErrSeqNotTracked
+	}
+	if err := t.beginRead(); err != nil {
+		return 0, err
+	}
+	maxSeq = t.LastSequence()
+	changes, err := t.captureView().changesSince(sinceSeq)
+	t.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make([]string, 0, len(changes))
+	for key := range changes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bw := bufio.NewWriter(w)
+	header := changeHeader{sinceSeq: sinceSeq, maxSeq: max(maxSeq, sinceSeq), count: uint64(len(keys))}
+	if _, err := bw.Write(header.encode()); err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		data, err := wal.NewEntryRecord(changes[key]).Encode()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := bw.Write(data); err != nil {
+			return 0, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return header.maxSeq, nil
+}
+
+// changesSince 从最旧的数据开始合并序列号大于sinceSeq的条目，新数据覆盖旧数据。
+// 序列号随写入递增，最大序列号不大于sinceSeq的文件中的条目都会被更新的版本覆盖或本身不需要导出，因此跳过
+func (v *readView) changesSince(sinceSeq uint64) (map[string]kv.Entry, error) {
+	changes := make(map[string]kv.Entry)
+	collect := func(entry kv.Entry) bool {
+		// 旧版本写入的空key无法在目标树中应用，不导出
+		if entry.Seq > sinceSeq && len(entry.Key) > 0 {
+			changes[string(entry.Key)] = entry.Clone()
+		}
+		return true
+	}
+	for level := len(v.nodes) - 1; level >= 0; level-- {
+		for _, node := range v.nodes[level] {
+			if node.Reader().Properties().MaxSeq <= sinceSeq {
+				continue
+			}
+			it, err := node.Reader().GetIterator()
+			if err != nil {
+				return nil, err
+			}
+			for it.Next() {
+				collect(it.Entry())
+			}
+			if err := it.Error(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, imm := range v.immutables {
+		imm.index.ForEachEntryUnSafe(collect)
+	}
+	v.mutable.ForEachEntryUnSafe(collect)
+	return changes, nil
+}
+
+// ApplyChanges 将ExportChanges导出的变更流写入树中，条目保留原来的序列号、写入时间和过期时间。
+// 条目按WAL大小分批通过批量写入路径提交，每批原子生效；树中已有相同或更新序列号版本的key跳过，
+// 因此重复应用同一个流或应用较旧的流不会覆盖更新的数据。流格式错误或不完整时返回ErrChangeStream，
+// 此前已提交的批次保留，重新应用完整的流即可。应用后提交序列号不小于流中的最大序列号
+func (t *LsmTree) ApplyChanges(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := readChangeHeader(br)
+	if err != nil {
+		return err
+	}
+	limit := int64(t.conf.WalSize)
+	if total := t.conf.WriteBufferTotalLimit; total > 0 && total < limit {
+		limit = total
+	}
+
+	var batch []kv.Entry
+	var batchSize int64
+	var count uint64
+	err = wal.DecodeStream(br, func(rec *wal.Record) error {
+		if rec.RecordType != wal.RecordTypeEntry || rec.Seq <= header.sinceSeq || rec.Seq > header.maxSeq {
+			return fmt.Errorf("%w: record %d has type %d seq %d outside (%d, %d]",
+				myerror.ErrChangeStream, count, rec.RecordType, rec.Seq, header.sinceSeq, header.maxSeq)
+		}
+		if len(rec.Key) == 0 {
+			return fmt.Errorf("%w: record %d: %w", myerror.ErrChangeStream, count, myerror.ErrEmptyKey)
+		}
+		if err := t.checkEntrySize(rec.Key, rec.Value); err != nil {
+			return fmt.Errorf("record %d: %w", count, err)
+		}
+		count++
+		entry := rec.Entry()
+		size := memtable.EntrySize(entry.Key, entry.Value)
+		if len(batch) > 0 && batchSize+size > limit {
+			if err := t.applyChanges(batch); err != nil {
+				return err
+			}
+			batch, batchSize = batch[:0], 0
+		}
+		batch = append(batch, entry)
+		batchSize += size
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, myerror.ErrCrcMismatch) || errors.Is(err, myerror.ErrWalCorrupted) {
+			return fmt.Errorf("%w: %w", myerror.ErrChangeStream, err)
+		}
+		return err
+	}
+	if count != header.count {
+		return fmt.Errorf("%w: got %d records, header says %d", myerror.ErrChangeStream, count, header.count)
+	}
+	if len(batch) > 0 {
+		if err := t.applyChanges(batch); err != nil {
+			return err
+		}
+	}
+	// 在写锁内提高提交序列号，与writeSeq和recordWrites不交错
+	if err := t.beginWrite(); err != nil {
+		return err
+	}
+	t.raiseCommitSeq(header.maxSeq)
+	t.mu.Unlock()
+	return nil
+}
+
+// applyChanges 原子地写入一批来自变更流的条目，跳过树中已有相同或更新版本的key。
+// 先在读锁内查找各key的最新序列号，再在写锁内只重新检查内存表：两次加锁之间的写入都在内存表中，
+// 刷盘和压缩不改变key的最新版本
+func (t *LsmTree) applyChanges(entries []kv.Entry) error {
+	if err := t.beginRead(); err != nil {
+		return err
+	}
+	pending := make([]kv.Entry, 0, len(entries))
+	for _, entry := range entries {
+		seq, err := t.latestSeq(entry.Key)
+		if err != nil {
+			t.mu.RUnlock()
+			return err
+		}
+		if seq < entry.Seq {
+			pending = append(pending, entry)
+		}
+	}
+	t.mu.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var size int64
+	for _, entry := range pending {
+		size += memtable.EntrySize(entry.Key, entry.Value)
+	}
+	commit, err := t.applyChangeBatch(pending, size)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// applyChangeBatch 在写锁内写入WAL和内存表，返回WAL提交以便在锁外等待持久化
+func (t *LsmTree) applyChangeBatch(entries []kv.Entry, size int64) (*wal.Commit, error) {
+	if err := t.beginWriteWithRoom(size); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	records := make([]*wal.Record, 0, len(entries))
+	keys := make([][]byte, 0, len(entries))
+	var maxSeq uint64
+	var userBytes int64
+	for _, entry := range entries {
+		if seq, ok := t.memTableSeq(entry.Key); ok && seq >= entry.Seq {
+			continue
+		}
+		records = append(records, wal.NewEntryRecord(entry))
+		keys = append(keys, entry.Key)
+		maxSeq = max(maxSeq, entry.Seq)
+		userBytes += int64(len(entry.Key) + len(entry.Value))
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	walBefore := t.curWal.Size()
+	commit, err := t.curWal.WriteBatchAsync(records)
+	if err != nil {
+		return nil, err
+	}
+	t.recordUserWrite(userBytes, walBefore)
+	var applied []kv.Entry
+	for _, rec := range records {
+		entry := rec.Entry()
+		if err := t.putMutable(entry); err != nil {
+			return nil, err
+		}
+		if t.watch.watching() {
+			applied = append(applied, entry)
+		}
+	}
+	// 之后本地的写入使用更大的序列号，覆盖应用的条目
+	t.watch.record(commit, t.recordWrites(keys...), applied...)
+	t.raiseCommitSeq(maxSeq)
+
+	if t.walFull() {
+		return commit, t.rotateWal(RotationWalSize)
+	}
+	return commit, nil
+}
+
+// raiseCommitSeq 使提交序列号不小于seq，调用方需持有t.mu写锁
+func (t *LsmTree) raiseCommitSeq(seq uint64) {
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	t.commitSeq = max(t.commitSeq, seq)
+}
+
+// memTableSeq 返回内存表中key最新版本的序列号，调用方需持有t.mu
+func (t *LsmTree) memTableSeq(key []byte) (uint64, bool) {
+	if entry, err := t.mutableIndex.GetEntry(key); err == nil {
+		return entry.Seq, true
+	}
+	for i := len(t.immutableIndex) - 1; i >= 0; i-- {
+		if entry, err := t.immutableIndex[i].index.GetEntry(key); err == nil {
+			return entry.Seq, true
+		}
+	}
+	return 0, false
+}
+
+// latestSeq 按查找的优先级返回key最新版本(包括删除标记)的序列号，key不存在时返回0，调用方需持有t.mu
+func (t *LsmTree) latestSeq(key []byte) (uint64, error) {
+	if seq, ok := t.memTableSeq(key); ok {
+		return seq, nil
+	}
+	opts := config.DefaultReadOptions()
+	opts.UnsafeSharedValue = true
+	for _, nodes := range t.nodes {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			node := nodes[i]
+			if bytes.Compare(key, node.GetMinKey()) < 0 || bytes.Compare(key, node.GetMaxKey()) > 0 {
+				continue
+			}
+			found, err := node.GetEntryWithOptions(key, nil, opts)
+			if err == nil {
+				return found.Seq, nil
+			}
+			if !errors.Is(err, myerror.ErrKeyNotFound) {
+				return 0, err
+			}
+		}
+	}
+	return 0, nil
+}
+
+// persistedSeq 返回内存表和SST文件中条目的最大序列号，打开时用于恢复提交序列号
+func (t *LsmTree) persistedSeq() uint64 {
+	var seq uint64
+	visit := func(entry kv.Entry) bool {
+		seq = max(seq, entry.Seq)
+		return true
+	}
+	t.mutableIndex.ForEachEntryUnSafe(visit)
+	for _, imm := range t.immutableIndex {
+		imm.index.ForEachEntryUnSafe(visit)
+	}
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			seq = max(seq, node.Reader().Properties().MaxSeq)
+		}
+	}
+	return seq
+}
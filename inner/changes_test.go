@@ -0,0 +1,210 @@
+package inner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// scanAll 返回树中所有未删除的键值对，按key顺序拼接
+func scanAll(t *testing.T, tree *LsmTree) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+		fmt.Fprintf(&buf, "%s=%s\n", key, value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func newSeqTree(t *testing.T) (*LsmTree, *config.Config) {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.TrackSequences = true
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, conf
+}
+
+// changeCount 返回变更流头部记录的条目数
+func changeCount(stream []byte) uint64 {
+	return binary.BigEndian.Uint64(stream[24:32])
+}
+
+func TestLsmTree_ExportChanges(t *testing.T) {
+	src, _ := newSeqTree(t)
+	defer src.Close()
+	dst, _ := newSeqTree(t)
+	defer dst.Close()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < 200; i++ {
+		if err := src.Put(key(i), []byte(fmt.Sprintf("v1-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, src)
+	for i := 200; i < 250; i++ {
+		if err := src.Put(key(i), []byte(fmt.Sprintf("v1-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 第一个检查点：全部数据，一部分在SST中，一部分在内存表中
+	var first bytes.Buffer
+	seq1, err := src.ExportChanges(0, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq1 != src.LastSequence() || seq1 != 250 || changeCount(first.Bytes()) != 250 {
+		t.Fatalf("first export maxSeq %d count %d, LastSequence %d", seq1, changeCount(first.Bytes()), src.LastSequence())
+	}
+	if err := dst.ApplyChanges(bytes.NewReader(first.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scanAll(t, dst), scanAll(t, src); got != want {
+		t.Fatal("scan differs after the first checkpoint")
+	}
+
+	// 第二个检查点：覆盖、删除和新增，只导出变化的key
+	flushAll(t, src)
+	for i := 0; i < 250; i += 10 {
+		if err := src.Put(key(i), []byte(fmt.Sprintf("v2-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 5; i < 250; i += 10 {
+		if err := src.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, src)
+	if err := src.Put(key(300), []byte("v2-300")); err != nil {
+		t.Fatal(err)
+	}
+	var second bytes.Buffer
+	seq2, err := src.ExportChanges(seq1, &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq2 != src.LastSequence() || changeCount(second.Bytes()) != 25+25+1 {
+		t.Fatalf("second export maxSeq %d count %d", seq2, changeCount(second.Bytes()))
+	}
+	if err := dst.ApplyChanges(bytes.NewReader(second.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	want := scanAll(t, src)
+	if got := scanAll(t, dst); got != want {
+		t.Fatalf("scan differs after the second checkpoint:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := dst.Get(key(5)); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(%s) = %v, deletion did not propagate", key(5), err)
+	}
+
+	// 重复应用以及应用较旧的流不改变数据
+	for _, stream := range [][]byte{second.Bytes(), first.Bytes()} {
+		if err := dst.ApplyChanges(bytes.NewReader(stream)); err != nil {
+			t.Fatal(err)
+		}
+		if got := scanAll(t, dst); got != want {
+			t.Fatal("scan differs after re-applying a stream")
+		}
+	}
+	if dst.LastSequence() < seq2 {
+		t.Fatalf("LastSequence %d after applying up to %d", dst.LastSequence(), seq2)
+	}
+	// 没有新变更时导出空流
+	var empty bytes.Buffer
+	if seq, err := src.ExportChanges(seq2, &empty); err != nil || seq != seq2 || changeCount(empty.Bytes()) != 0 {
+		t.Fatalf("ExportChanges(%d) = %d, %v with %d records", seq2, seq, err, changeCount(empty.Bytes()))
+	}
+}
+
+// 开启TrackSequences时重新打开后序列号继续递增，之后的写入可以增量导出
+func TestLsmTree_TrackSequencesReopen(t *testing.T) {
+	tree, conf := newSeqTree(t)
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if err := tree.Delete([]byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	last := tree.LastSequence()
+	if last != 11 {
+		t.Fatalf("LastSequence = %d, want 11", last)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if got := tree.LastSequence(); got != last {
+		t.Fatalf("LastSequence after reopen = %d, want %d", got, last)
+	}
+	if err := tree.Put([]byte("key1"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if seq, err := tree.ExportChanges(last, &buf); err != nil || seq != last+1 || changeCount(buf.Bytes()) != 1 {
+		t.Fatalf("ExportChanges(%d) = %d, %v with %d records", last, seq, err, changeCount(buf.Bytes()))
+	}
+}
+
+func TestLsmTree_ChangeStreamErrors(t *testing.T) {
+	conf := newTestConfig(t)
+	plain, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.ExportChanges(0, &bytes.Buffer{}); !errors.Is(err, ErrSeqNotTracked) {
+		t.Fatalf("ExportChanges without TrackSequences = %v", err)
+	}
+
+	src, _ := newSeqTree(t)
+	defer src.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := src.Put([]byte(key), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := src.ExportChanges(0, &buf); err != nil {
+		t.Fatal(err)
+	}
+	stream := buf.Bytes()
+	corrupt := bytes.Clone(stream)
+	corrupt[len(corrupt)-1] ^= 0xff
+	for name, data := range map[string][]byte{
+		"truncated": stream[:len(stream)-3],
+		"magic":     append([]byte("NOTCHGS!"), stream[8:]...),
+		"header":    stream[:10],
+		"crc":       corrupt,
+	} {
+		if err := plain.ApplyChanges(bytes.NewReader(data)); !errors.Is(err, ErrChangeStream) {
+			t.Errorf("%s: ApplyChanges = %v, want ErrChangeStream", name, err)
+		}
+	}
+	// 不完整的流中已提交的部分保留，重新应用完整的流后与源一致
+	if err := plain.ApplyChanges(bytes.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scanAll(t, plain), scanAll(t, src); got != want {
+		t.Fatalf("scan %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/utils"
+)
+
+// Clock 时间来源，测试中可以注入固定或手动推进的实现，使依赖时间的逻辑可复现
+type Clock interface {
+	Now() time.Time                         // 当前时间
+	After(d time.Duration) <-chan time.Time // 经过d后发送当前时间
+	NewTimer(d time.Duration) Timer         // 创建经过d后触发的定时器
+}
+
+// Timer Clock创建的定时器
+type Timer interface {
+	C() <-chan time.Time // 触发时接收时间的通道
+	Stop() bool          // 停止定时器，定时器已触发或已停止时返回false
+}
+
+// realClock 基于系统时间的默认实现
+type realClock struct{}
+
+// realTimer 包装time.Timer
+type realTimer struct {
+	t *time.Timer
+}
+
+// RealClock 返回使用系统时间的Clock
+func RealClock() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+// TestHooks 测试钩子，用于固定文件编号以生成可逐字节比较的文件，在崩溃测试关注的位置复制数据目录，以及注入I/O错误，生产环境不应设置
+type TestHooks struct {
+	SSTSeq func(level int, seq uint32) uint32 // 返回新SST文件实际使用的序列号，seq为按顺序分配的序列号
+	WalId  func(walId uint32) uint32          // 返回新WAL文件实际使用的id，walId为按顺序分配的id
+	Crash  func(point string)                 // 执行到point时调用，测试可以在此复制数据目录，得到在该位置断电后的磁盘状态
+	// 在对path执行op(IOWrite或IOSync)之前调用，返回非nil时该操作以此错误失败，用于模拟磁盘已满等I/O错误。
+	// 覆盖WAL创建、写入和同步、SST写入和清单同步
+	IOFault func(op, path string) error
+	// SyncDir成功fsync目录dir之后调用，崩溃测试据此区分已经持久化和断电后会丢失的目录项
+	DirSynced func(dir string)
+}
+
+// 注入I/O错误的操作，作为TestHooks.IOFault的参数
+const (
+	IOCreate = "create" // 创建或打开文件
+	IOWrite  = "write"  // 写入文件
+	IOSync   = "sync"   // fsync文件
+)
+
+// 崩溃测试关注的位置，作为TestHooks.Crash的参数
+const (
+	CrashAfterSSTTmpWrite    = "after-sst-tmp-write"   // 层级压缩的一个输出文件已写入临时文件并fsync，尚未重命名
+	CrashAfterSSTRename      = "after-sst-rename"      // 刷盘或层级压缩生成的SST已重命名为正式文件名，清单尚未记录
+	CrashBeforeWALDelete     = "before-wal-delete"     // 刷盘生成的SST已记入清单，对应的WAL尚未删除
+	CrashAfterWALDelete      = "after-wal-delete"      // 刷盘生成的SST已记入清单，对应的WAL已删除
+	CrashBeforeSSTDelete     = "before-sst-delete"     // 清单已记录删除SST文件，文件尚未删除
+	CrashBeforeCurrentUpdate = "before-current-update" // 重写的清单已写入，CURRENT尚未指向它
+)
+
+// SSTSeq 返回level层新SST文件使用的序列号
+func (c *Config) SSTSeq(level int, seq uint32) uint32 {
+	if c.Hooks == nil || c.Hooks.SSTSeq == nil {
+		return seq
+	}
+	return c.Hooks.SSTSeq(level, seq)
+}
+
+// WalId 返回新WAL文件使用的id
+func (c *Config) WalId(walId uint32) uint32 {
+	if c.Hooks == nil || c.Hooks.WalId == nil {
+		return walId
+	}
+	return c.Hooks.WalId(walId)
+}
+
+// Crash 在崩溃测试关注的位置调用测试钩子
+func (c *Config) Crash(point string) {
+	if c.Hooks != nil && c.Hooks.Crash != nil {
+		c.Hooks.Crash(point)
+	}
+}
+
+// SyncDir 开启SyncDirs时fsync目录dir，使其中文件的创建、重命名和删除在断电后仍然有效
+func (c *Config) SyncDir(dir string) error {
+	if !c.SyncDirs {
+		return nil
+	}
+	if err := utils.SyncDir(dir); err != nil {
+		return fmt.Errorf("sync dir %s: %w", dir, err)
+	}
+	if c.Hooks != nil && c.Hooks.DirSynced != nil {
+		c.Hooks.DirSynced(dir)
+	}
+	return nil
+}
+
+// IOFault 在对path执行op之前调用测试钩子，返回注入的错误
+func (c *Config) IOFault(op, path string) error {
+	if c.Hooks == nil || c.Hooks.IOFault == nil {
+		return nil
+	}
+	return c.Hooks.IOFault(op, path)
+}
+
+// faultWriter 每次写入前检查注入的I/O错误
+type faultWriter struct {
+	conf *Config
+	path string
+	w    io.Writer
+}
+
+func (f *faultWriter) Write(p []byte) (int, error) {
+	if err := f.conf.IOFault(IOWrite, f.path); err != nil {
+		return 0, err
+	}
+	return f.w.Write(p)
+}
+
+// FaultWriter 返回写入path的w，设置了IOFault钩子时每次写入前检查注入的错误，否则直接返回w
+func (c *Config) FaultWriter(w io.Writer, path string) io.Writer {
+	if c.Hooks == nil || c.Hooks.IOFault == nil {
+		return w
+	}
+	return &faultWriter{conf: c, path: path, w: w}
+}
+
+// randMu 保护各Config的RandSource，rand.Source本身不能并发使用
+var randMu sync.Mutex
+
+// GetClock 返回配置的Clock，未设置时返回系统时间
+func (c *Config) GetClock() Clock {
+	if c.Clock == nil {
+		return RealClock()
+	}
+	return c.Clock
+}
+
+// Now 返回配置的Clock的当前时间
+func (c *Config) Now() time.Time {
+	return c.GetClock().Now()
+}
+
+// Since 返回从start到配置的Clock当前时间经过的时长
+func (c *Config) Since(start time.Time) time.Duration {
+	return c.Now().Sub(start)
+}
+
+// NewRandSource 从RandSource派生一个新的随机源，供单个使用方独占使用。
+// RandSource为固定种子时，按相同顺序派生的随机源产生相同的序列；未设置时以当前时间为种子
+func (c *Config) NewRandSource() rand.Source {
+	randMu.Lock()
+	defer randMu.Unlock()
+	if c.RandSource == nil {
+		c.RandSource = rand.NewSource(c.Now().UnixNano())
+	}
+	return rand.NewSource(c.RandSource.Int63())
+}
+
+// NewRand 从RandSource派生一个新的随机数生成器，供单个使用方独占使用
+func (c *Config) NewRand() *rand.Rand {
+	return rand.New(c.NewRandSource())
+}
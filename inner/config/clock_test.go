@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fixedClock 始终返回同一时间的Clock
+type fixedClock struct {
+	Clock
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestConfigClockDefaults(t *testing.T) {
+	conf := &Config{}
+	if conf.GetClock() == nil {
+		t.Fatal("GetClock should fall back to the real clock")
+	}
+	if d := conf.Since(conf.Now()); d < 0 || d > time.Second {
+		t.Fatalf("Since(Now()) = %v", d)
+	}
+
+	at := time.Unix(1700000000, 0)
+	conf.Clock = fixedClock{Clock: RealClock(), now: at}
+	if !conf.Now().Equal(at) || conf.Since(at) != 0 {
+		t.Fatalf("Now = %v, want %v", conf.Now(), at)
+	}
+}
+
+func TestConfigNewRandDeterministic(t *testing.T) {
+	sequence := func() []int64 {
+		conf := DefaultConfig()
+		conf.RandSource = rand.NewSource(42)
+		var out []int64
+		for i := 0; i < 3; i++ {
+			out = append(out, conf.NewRand().Int63())
+		}
+		return out
+	}
+	first, second := sequence(), sequence()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("derived rand %d differs across runs: %d != %d", i, first[i], second[i])
+		}
+	}
+	if first[0] == first[1] {
+		t.Fatal("derived rands should not share a sequence")
+	}
+}
+
+func TestConfigTestHooks(t *testing.T) {
+	conf := DefaultConfig()
+	if conf.SSTSeq(0, 7) != 7 || conf.WalId(3) != 3 {
+		t.Fatal("hooks should be no-ops when unset")
+	}
+	conf.Hooks = &TestHooks{
+		SSTSeq: func(level int, seq uint32) uint32 { return uint32(level)*100 + seq },
+		WalId:  func(walId uint32) uint32 { return walId + 1000 },
+	}
+	if conf.SSTSeq(1, 7) != 107 || conf.WalId(3) != 1003 {
+		t.Fatalf("hooks = %d, %d", conf.SSTSeq(1, 7), conf.WalId(3))
+	}
+
+	var buf bytes.Buffer
+	if w := conf.FaultWriter(&buf, "a.sst"); w != &buf || conf.IOFault(IOSync, "a.sst") != nil {
+		t.Fatal("IOFault should be a no-op when unset")
+	}
+	conf.Hooks.IOFault = func(op, path string) error {
+		if op == IOWrite && path == "full.sst" {
+			return syscall.ENOSPC
+		}
+		return nil
+	}
+	if _, err := conf.FaultWriter(&buf, "full.sst").Write([]byte("x")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("faulted write = %v, want ENOSPC", err)
+	}
+	if _, err := conf.FaultWriter(&buf, "ok.sst").Write([]byte("x")); err != nil || buf.String() != "x" {
+		t.Fatalf("write = %v, buffer %q", err, buf.String())
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	conf := DefaultConfig()
+	dir := t.TempDir()
+	var synced []string
+	conf.Hooks = &TestHooks{DirSynced: func(dir string) { synced = append(synced, dir) }}
+	conf.SyncDirs = false
+	if err := conf.SyncDir(dir); err != nil || len(synced) != 0 {
+		t.Fatalf("SyncDir disabled = %v, synced %v", err, synced)
+	}
+	conf.SyncDirs = true
+	if err := conf.SyncDir(dir); err != nil || len(synced) != 1 || synced[0] != dir {
+		t.Fatalf("SyncDir = %v, synced %v", err, synced)
+	}
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// CompactionType 压缩的方式。整文件丢弃依赖范围删除，尚未实现，没有对应的方式
+type CompactionType int
+
+const (
+	CompactionRewrite     CompactionType = iota // 读取输入文件，合并后写入新的输出文件
+	CompactionTrivialMove                       // 输入文件与目标层不重叠，链接到目标层的文件名并修改清单，不读取也不重写数据
+)
+
+// String 返回压缩方式的名称
+func (c CompactionType) String() string {
+	switch c {
+	case CompactionRewrite:
+		return "rewrite"
+	case CompactionTrivialMove:
+		return "trivial-move"
+	default:
+		return fmt.Sprintf("CompactionType(%d)", int(c))
+	}
+}
+
+// CompactionEvent 一次压缩的读写量，每次层级压缩、Vacuum的合并或重写SST文件完成后通过OnCompactionEvent报告
+type CompactionEvent struct {
+	Time        time.Time      // 完成时间
+	Duration    time.Duration  // 耗时
+	Type        CompactionType // 压缩方式，平移时输出文件即输入文件，没有读写数据
+	Level       int            // 输入文件所在的最浅层级
+	OutputLevel int            // 输出文件写入的层级
+	InputFiles  int            // 输入文件数，包括下一层中重叠的文件
+	InputBytes  int64          // 输入文件的总大小
+	OutputFiles int            // 输出文件数，所有条目都被丢弃时为0
+	OutputBytes int64          // 输出文件的总大小
+}
@@ -1,18 +1,75 @@
 package config
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime"
+	"time"
+
 	"github.com/aixiasang/lsm/inner/filter"
 	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
 )
 
 const (
 	DefaultDataDir        = "./data"          // 默认数据目录
 	DefaultWalDir         = "./wal"           // 默认WAL目录
 	DefaultSSTDir         = "./sst"           // 默认SST目录
-	DefaultBlockSize      = 1024 * 1024       // 默认块大小
+	DefaultBlockSizeBytes = 4 * 1024          // 默认数据块大小(字节)
 	DefaultWalSize        = 1024 * 1024 * 10  // 默认WAL大小
 	DefaultMemTableDegree = 16                // 默认内存表度
 	DefaultMemTableType   = MemTableTypeBTree // 内存表类型
+
+	DefaultSlowOpThreshold      = 50 * time.Millisecond // 默认慢操作阈值
+	DefaultSlowFlushThreshold   = 2 * time.Second       // 默认慢刷盘阈值
+	DefaultWarmupConcurrency    = 4                     // 默认预热并发数
+	DefaultOpenFilesParallelism = 8                     // 默认打开SST文件的并发数
+	DefaultWALReplayParallelism = 4                     // 默认重放WAL的并发数
+	DefaultMaxManifestFileSize  = 4 * 1024 * 1024       // 默认清单文件大小上限
+	DefaultMaxSSTDataRegion     = 1 << 30               // 默认SST数据区大小上限
+	DefaultMaxValueSize         = 100 << 20             // 默认单个value的大小上限
+	DefaultBlockBufferShrink    = 1 << 20               // 默认数据块清空后保留的缓冲区容量上限
+	MaxValueSizeLimit           = 256 << 20             // MaxValueSize允许设置的最大值，WAL按此解码，保证写入的value都能恢复
+	MaxKeySize                  = 10 << 20              // key的大小上限，与WAL和SST索引的解码上限一致
+	DefaultShadowVerifyPerSec   = 100                   // 默认每秒最多校验的Get次数
+	DefaultL0SlowdownMaxDelay   = 10 * time.Millisecond // 默认L0文件数接近L0StopTrigger时每次写入的延迟
+
+	DefaultBackgroundRetryInterval    = 100 * time.Millisecond // 默认后台错误后第一次重试的等待时间
+	DefaultMaxBackgroundRetryInterval = 10 * time.Second       // 默认后台重试等待时间的上限
+)
+
+// BackgroundErrorPolicy 后台刷盘或压缩出现I/O错误(如磁盘已满)后的处理方式
+type BackgroundErrorPolicy int8
+
+const (
+	BackgroundErrorPauseWrites       BackgroundErrorPolicy = iota // 暂停写入，写入返回记录的错误，直到ResumeWrites成功
+	BackgroundErrorContinueWithRetry                              // 继续接受写入，后台按指数退避重试刷盘，成功后清除错误
+)
+
+// CorruptFilePolicy 启动时无法打开的SST文件的处理方式
+type CorruptFilePolicy int8
+
+const (
+	CorruptFileFailOpen   CorruptFilePolicy = iota // 默认，汇总所有无法打开的文件的错误后打开失败
+	CorruptFileQuarantine                          // 将文件移到隔离目录后继续打开，清单中记录的key范围内的Get和遍历返回ErrRangeUnavailable
+	CorruptFileIgnore                              // 文件留在原处，本次打开不载入，其中的数据视为不存在，下次打开时重试
+)
+
+// SSTReadMode 读取SST数据块的方式
+type SSTReadMode int8
+
+const (
+	SSTReadPread SSTReadMode = iota // 通过pread读取数据块
+	SSTReadMmap                     // 只读映射整个文件，数据块按需从映射中解析，由页缓存代替数据块缓存；不支持mmap的平台退回pread
+)
+
+// WALMode WAL文件与内存表的对应方式
+type WALMode int8
+
+const (
+	WALModePerMemtable WALMode = iota // 默认，每个内存表写入单独的WAL文件，轮转内存表时切换新文件，刷盘后删除
+	WALModeShared                     // 内存表共享当前WAL文件，轮转内存表只写入新的代数标记，文件中的代数都刷盘后删除
 )
 
 // MemTableType 内存表类型
@@ -24,41 +81,210 @@ const (
 )
 
 // FilterConstructor 过滤器构造函数
-type FilterConstructor func(m uint64, k uint) filter.Filter
+type FilterConstructor = filter.FilterConstructor
 
 // MemTableConstructor 内存表构造函数
 type MemTableConstructor func(mtType memtable.MemTableType, degree int) memtable.MemTable
 
 // Config 配置
 type Config struct {
-	DataDir             string              // 数据目录
-	WalDir              string              // WAL目录
-	SSTDir              string              // SST目录
-	AutoSync            bool                // 是否自动同步
-	BlockSize           int64               // 块大小
-	WalSize             uint32              // WAL大小
-	MemTableType        MemTableType        // 内存表类型
-	MemTableDegree      int                 // 内存表度
-	LevelSize           int                 // 层级大小
-	FilterConstructor   FilterConstructor   // 过滤器构造函数
-	MemTableConstructor MemTableConstructor // 内存表构造函数
-	IsDebug             bool                // 是否调试
+	DataDir                        string                // 数据目录
+	WalDir                         string                // WAL目录
+	SSTDir                         string                // SST目录
+	SSTLayout                      SSTLayout             // 新SST文件的目录布局，两种布局的已有文件都会被载入
+	AutoSync                       bool                  // 是否自动同步
+	SyncDirs                       bool                  // 创建、重命名和删除SST、WAL和清单文件后fsync所在目录，使这些操作在断电后仍然有效，linux上默认开启，不支持的平台上忽略
+	BlockSize                      int64                 // 已废弃：实际按条目数计算，语义不明确，请使用BlockSizeBytes或BlockEntryLimit
+	BlockSizeBytes                 int64                 // 数据块目标大小(字节)，写满后切换到新的数据块
+	BlockSizeHardLimit             int64                 // 数据块大小上限(字节)，加入下一个条目会超出时提前切换，单个超出的条目独占一个数据块；小于BlockSizeBytes时按BlockSizeBytes
+	BlockEntryLimit                int64                 // 每个数据块的最大条目数，0表示不限制
+	BlockBufferShrinkThreshold     int64                 // 数据块清空后保留的缓冲区容量上限(字节)，超出时释放底层数组，<=0表示DefaultBlockBufferShrink
+	WalSize                        uint32                // WAL大小，一个内存表写入的WAL数据超过该值后轮转内存表
+	WALMode                        WALMode               // WAL文件与内存表的对应方式，两种方式写入的WAL都能重放
+	SharedWalFileSize              uint32                // WALModeShared时当前WAL文件超过该大小后在下次轮转内存表时切换新文件，0表示4倍WalSize
+	MemTableType                   MemTableType          // 内存表类型
+	MemTableDegree                 int                   // 内存表度
+	MemtableIterBatchSize          int                   // 遍历跳表等不支持快照的内存表时每批在锁内复制的条目数，<=0时为memtable.DefaultIterBatchSize
+	MaxOpenIterators               int                   // 同时进行的PrefixScan等遍历的数量上限，超出时返回ErrTooManyIterators，0表示不限制
+	IteratorLeakTracking           bool                  // 是否在开始遍历时记录调用栈，通过OpenIterators查看，用于定位长时间未结束的遍历
+	MaxMemtablesPerFlush           int                   // 后台刷盘时最多合并的连续不可变内存表数量，合并后只生成一个L0文件，<=1表示每个内存表单独刷盘
+	MaxFlushOutputBytes            int64                 // 合并刷盘时参与合并的内存表总大小上限(字节)，第一个内存表总是参与，0表示只按数量限制
+	LevelSize                      int                   // 层级大小
+	FilterConstructor              FilterConstructor     // 过滤器构造函数，FilterPolicy为空时用于写入，也用于读取没有记录过滤器名称的旧文件
+	FilterPolicy                   string                // 写入SST时使用的过滤器名称(见filter.Register)，记录在文件元数据中，filter.NameNone表示不写入过滤器
+	MemTableConstructor            MemTableConstructor   // 内存表构造函数
+	IsDebug                        bool                  // 是否调试
+	ParanoidChecks                 bool                  // 每次层级压缩记入清单后检查L1到倒数第二层的文件key范围互不重叠，违反时返回ErrLevelOverlap，用于调试
+	Logger                         Logger                // 日志器，为nil时不输出任何日志
+	SlowOpThreshold                time.Duration         // Get/Put/Delete慢操作阈值，0表示不记录
+	SlowFlushThreshold             time.Duration         // 刷盘慢操作阈值，0表示不记录
+	WriteStageHistograms           bool                  // 是否按阶段(put.wal_encode等)统计Put和Delete的耗时分布，关闭时每次写入只多一次原子读取，运行时可用SetWriteStageHistograms修改
+	IndexMemoryBudget              int64                 // SST索引和过滤器常驻内存上限(字节)，0表示不限制
+	FilterMemoryBudget             int64                 // SST过滤器常驻内存上限(字节)，超出时卸载最久未被点查的文件的过滤器，0表示不限制
+	StrictDirectoryScan            bool                  // 数据目录中存在无法识别的文件时是否拒绝打开
+	PrefixExtractor                PrefixExtractor       // 前缀提取器，为nil时不构建前缀过滤器
+	KeySchema                      *KeySchema            // key开头的定长字段，只影响数据块边界和文件统计，为nil时不使用
+	WriteBufferTotalLimit          int64                 // 可变与不可变内存表总大小上限(字节)，超出时写入方同步刷盘，0表示不限制
+	MaxValueSize                   int64                 // 单个value的大小上限(字节)，超出时在写入WAL之前返回ErrValueTooLarge，<=0时使用默认值，不能超过MaxValueSizeLimit
+	L0SlowdownTrigger              int                   // L0文件数达到该值时减慢写入，文件越多每次写入的延迟越长，0表示不减慢
+	L0StopTrigger                  int                   // L0文件数达到该值时停止写入，直到压缩减少L0文件，0表示不停止
+	L0SlowdownMaxDelay             time.Duration         // 减慢写入时每次写入的最长延迟，<=0时使用默认值
+	OnWriteThrottleStart           func(l0Files int)     // 写入开始被减慢或停止时调用，l0Files为当时的L0文件数
+	OnWriteThrottleStop            func(l0Files int)     // 被限制后第一次不再受限的写入时调用
+	BlockCacheSize                 int64                 // 数据块缓存大小(字节)，大于0时数据块按需读取并缓存，0表示打开SST时加载全部数据块
+	RowCacheSize                   int64                 // 行缓存大小(字节)，缓存Get从SST中解析出的最终结果(包括删除和不存在)，0表示不启用
+	SSTReadMode                    SSTReadMode           // 读取SST数据块的方式，默认pread
+	WarmupConcurrency              int                   // 预热时并发读取数据块的数量
+	OpenFilesParallelism           int                   // 启动时并发打开SST文件的数量，<=0时逐个打开
+	WALReplayParallelism           int                   // 启动时每个WAL并发解码记录的worker数，也是同时重放的WAL文件数，<=0时为1
+	QuarantineUnreadableSST        bool                  // 同CorruptFilePolicy为CorruptFileQuarantine，CorruptFilePolicy不是默认值时以其为准
+	CorruptFilePolicy              CorruptFilePolicy     // 启动时无法打开的SST文件的处理方式，默认打开失败
+	MaxManifestFileSize            int64                 // 清单文件超过该大小后重写为只包含当前文件集合的新清单，<=0时使用默认值
+	MaxSSTDataRegionBytes          int64                 // 打开SST文件时允许的数据区大小上限，footer声明的更大长度视为文件损坏，<=0时使用默认值
+	GroupCommitInterval            time.Duration         // AutoSync时WAL组提交的最长等待时间，0表示每次写入单独fsync
+	GroupCommitBytes               int                   // 组提交中待写入数据达到该大小时立即提交，0表示只按时间提交
+	WalSyncInterval                time.Duration         // AutoSync关闭时后台fsync WAL的间隔，WaitForSync等待该同步，0表示不定期同步
+	MinKeysPerFilter               int64                 // 数据块条目数少于该值时不写入过滤器，读取时视为可能包含，0表示总是写入
+	MaxFilterBytesPerFile          int64                 // 单个SST文件过滤器区的字节上限，超出后剩余数据块不写入过滤器，0表示不限制
+	StrictFilters                  bool                  // 过滤器损坏时是否拒绝打开SST，关闭时跳过损坏的过滤器，对应数据块视为可能包含
+	SkipFilterOnBottomLevel        bool                  // 压缩写入最底层(LevelSize-1，不含L0)的SST文件时不写入过滤器，节省空间和点查时的过滤器计算
+	TrackTimestamps                bool                  // 是否为每次写入记录写入时间，关闭时不占用额外空间，读取时时间为0
+	TombstoneRetention             time.Duration         // Delete保留被删除的值的时长，期间删除标记不会被压缩丢弃，可以用RestoreKey恢复，需要开启TrackTimestamps，0表示不保留
+	TrackSequences                 bool                  // 是否为每次写入记录提交序列号，开启后序列号在重新打开后继续递增，ExportChanges需要开启
+	PerEntryChecksum               bool                  // 是否为SST中的每个条目写入key和value的crc32，读取时在返回前校验
+	DeterministicOutput            bool                  // 相同的条目和配置写出字节相同的SST文件，文件元数据中的写入时间记为0、不记录来源WAL(改由清单记录)，MaxFileAge改按文件修改时间计算，不能与TrackSequences同时开启
+	CompactionRateLimitBytesPerSec int64                 // 后台压缩写入SST的速率上限(字节/秒)，多个后台任务共享，0表示不限制
+	FlushRateLimitBytesPerSec      int64                 // 写入方同步刷盘写入SST的速率上限(字节/秒)，通常高于压缩限速，0表示不限制
+	PeriodicCompactionInterval     time.Duration         // 后台检查SST文件并重写过旧或删除标记过多的文件的间隔，0表示不检查
+	MaxFileAge                     time.Duration         // 定期检查时重写写入时间早于该时长的SST文件，0表示不按时间重写
+	TombstoneCompactionRatio       float64               // 定期检查时重写删除标记占比不低于该值的SST文件，0表示不按删除标记重写
+	MaxFilesPerLevel               []int                 // 各层的文件数上限，下标为层级，缺省或<=0表示不限制；超出时后台将该层最旧的文件合并到下一层，最底层在层内合并
+	CompactionFileSize             int64                 // 层级压缩输出文件的目标大小(字节)，按key和value的字节数估计，超出时拆分为多个文件，0表示不拆分
+	OnLevelCompaction              func(int, int64)      // 每次层级压缩完成后调用，参数为压缩的层级和之后剩余的压缩债务(字节)
+	AccessSampling                 int                   // 每N次Get采样一次，命中SST时累加该文件的热度；层级压缩优先把较冷的文件移到下一层。0表示不采样
+	VacuumRewriteBottomLevel       bool                  // Vacuum将各层压缩到最底层后是否再重写一次最底层的文件，丢弃其中的删除标记和过期条目
+	OnVacuumProgress               func(VacuumProgress)  // Vacuum每完成一步后在压缩goroutine中调用
+	OnCompactionEvent              func(CompactionEvent) // 每次压缩或重写SST文件完成后在压缩goroutine中调用，参数为本次的输入输出字节数和文件数
+	OnBackgroundError              BackgroundErrorPolicy // 后台刷盘或压缩失败后的处理方式，默认暂停写入
+	BackgroundRetryInterval        time.Duration         // ContinueWithRetry时第一次重试前的等待时间，之后每次失败加倍，<=0时使用默认值
+	MaxBackgroundRetryInterval     time.Duration         // 重试等待时间的上限，<=0时使用默认值
+	Clock                          Clock                 // 时间来源，为nil时使用系统时间
+	RandSource                     rand.Source           // 随机数种子来源，各使用方通过NewRand派生独立的生成器，为nil时以当前时间为种子
+	ShadowVerifyReads              bool                  // Get返回前逐条扫描内存表和SST文件重新计算结果，与正常查找不一致时上报，用于预发布环境排查读路径错误
+	ShadowVerifyPerSec             int                   // 每秒最多校验的Get次数，超出的读取不校验，<=0时使用默认值
+	OnShadowMismatch               func(ShadowMismatch)  // 校验结果不一致时在Get释放读锁后调用，为nil时输出错误日志
+	Hooks                          *TestHooks            // 测试钩子，为nil时不生效
+
+	walPath string // Resolve解析后的WAL目录
+	sstPath string // Resolve解析后的SST目录
 }
 
 // DefaultConfig 默认配置
 func DefaultConfig() *Config {
 	return &Config{
-		DataDir:             DefaultDataDir,
-		WalDir:              DefaultWalDir,
-		SSTDir:              DefaultSSTDir,
-		MemTableType:        DefaultMemTableType,
-		MemTableDegree:      DefaultMemTableDegree,
-		AutoSync:            true,
-		BlockSize:           1024 * 1024,
-		FilterConstructor:   filter.NewBloomFilter,
-		MemTableConstructor: memtable.NewMemTable,
-		LevelSize:           5,
-		WalSize:             1024 * 1,
-		IsDebug:             true,
+		DataDir:               DefaultDataDir,
+		WalDir:                DefaultWalDir,
+		SSTDir:                DefaultSSTDir,
+		MemTableType:          DefaultMemTableType,
+		MemTableDegree:        DefaultMemTableDegree,
+		MemtableIterBatchSize: memtable.DefaultIterBatchSize,
+		AutoSync:              true,
+		SyncDirs:              runtime.GOOS == "linux",
+		BlockSizeBytes:        DefaultBlockSizeBytes,
+		FilterConstructor:     filter.NewBloomFilter,
+		FilterPolicy:          filter.NameBloom,
+		MemTableConstructor:   memtable.NewMemTable,
+		LevelSize:             5,
+		WalSize:               1024 * 1,
+		IsDebug:               true,
+		Logger:                NewStdLogger(),
+		SlowOpThreshold:       DefaultSlowOpThreshold,
+		SlowFlushThreshold:    DefaultSlowFlushThreshold,
+		WarmupConcurrency:     DefaultWarmupConcurrency,
+		OpenFilesParallelism:  DefaultOpenFilesParallelism,
+		WALReplayParallelism:  DefaultWALReplayParallelism,
+		MaxManifestFileSize:   DefaultMaxManifestFileSize,
+		Clock:                 RealClock(),
+	}
+}
+
+// SharedWalFileLimit 返回WALModeShared时切换WAL文件的大小
+func (c *Config) SharedWalFileLimit() uint32 {
+	if c.SharedWalFileSize == 0 {
+		return uint32(min(4*uint64(c.WalSize), math.MaxUint32))
+	}
+	return c.SharedWalFileSize
+}
+
+// BlockBufferShrinkLimit 返回数据块清空后保留的缓冲区容量上限
+func (c *Config) BlockBufferShrinkLimit() int {
+	if c.BlockBufferShrinkThreshold <= 0 {
+		return DefaultBlockBufferShrink
+	}
+	return int(min(c.BlockBufferShrinkThreshold, math.MaxInt32))
+}
+
+// ValueSizeLimit 返回生效的单个value大小上限
+func (c *Config) ValueSizeLimit() int64 {
+	if c.MaxValueSize <= 0 {
+		return DefaultMaxValueSize
+	}
+	return min(c.MaxValueSize, MaxValueSizeLimit)
+}
+
+// UnreadableSSTPolicy 返回生效的CorruptFilePolicy，未设置时按QuarantineUnreadableSST决定
+func (c *Config) UnreadableSSTPolicy() CorruptFilePolicy {
+	if c.CorruptFilePolicy == CorruptFileFailOpen && c.QuarantineUnreadableSST {
+		return CorruptFileQuarantine
+	}
+	return c.CorruptFilePolicy
+}
+
+// Validate 校验并规范化配置，对已废弃的配置项输出警告
+func (c *Config) Validate() error {
+	if c.BlockSize > 0 {
+		c.Warnf("config: BlockSize is deprecated and counts entries, use BlockSizeBytes or BlockEntryLimit instead")
+		if c.BlockEntryLimit <= 0 {
+			c.BlockEntryLimit = c.BlockSize
+		}
+	}
+	if c.BlockSizeBytes <= 0 && c.BlockEntryLimit <= 0 {
+		c.BlockSizeBytes = DefaultBlockSizeBytes
+	}
+	if c.MaxValueSize > MaxValueSizeLimit {
+		return fmt.Errorf("config: %w: MaxValueSize %d exceeds %d", myerror.ErrValueTooLarge, c.MaxValueSize, MaxValueSizeLimit)
+	}
+	if c.MemTableConstructor == nil {
+		return fmt.Errorf("config: %w: MemTableConstructor is nil", myerror.ErrInvalidConfig)
+	}
+	if c.MemTableConstructor(memtable.MemTableType(c.MemTableType), c.MemTableDegree) == nil {
+		return fmt.Errorf("config: %w: MemTableConstructor returned nil for MemTableType %d", myerror.ErrInvalidConfig, c.MemTableType)
+	}
+	if c.WALMode != WALModePerMemtable && c.WALMode != WALModeShared {
+		return fmt.Errorf("config: %w: unknown WALMode %d", myerror.ErrInvalidConfig, c.WALMode)
+	}
+	if c.CorruptFilePolicy < CorruptFileFailOpen || c.CorruptFilePolicy > CorruptFileIgnore {
+		return fmt.Errorf("config: %w: unknown CorruptFilePolicy %d", myerror.ErrInvalidConfig, c.CorruptFilePolicy)
+	}
+	if c.TombstoneRetention > 0 && !c.TrackTimestamps {
+		return fmt.Errorf("config: %w: TombstoneRetention requires TrackTimestamps", myerror.ErrInvalidConfig)
+	}
+	// 序列号随写入历史变化，写入文件的条目序列号和MaxSeq属性无法由最终内容决定
+	if c.DeterministicOutput && c.TrackSequences {
+		return fmt.Errorf("config: %w: DeterministicOutput conflicts with TrackSequences", myerror.ErrInvalidConfig)
+	}
+	if c.FilterPolicy == "" && c.FilterConstructor == nil {
+		return fmt.Errorf("config: %w: FilterConstructor is nil and FilterPolicy is empty", myerror.ErrInvalidConfig)
+	}
+	if c.FilterPolicy != "" && c.FilterPolicy != filter.NameNone {
+		if _, ok := filter.Lookup(c.FilterPolicy); !ok {
+			return fmt.Errorf("config: %w: %q", myerror.ErrUnknownFilter, c.FilterPolicy)
+		}
+	}
+	if c.KeySchema != nil {
+		if err := c.KeySchema.Validate(); err != nil {
+			return err
+		}
 	}
+	return nil
 }
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+type warnRecorder struct {
+	Logger
+	warns []string
+}
+
+func (w *warnRecorder) Warnf(format string, args ...any) {
+	w.warns = append(w.warns, format)
+}
+
+func TestValidateDeprecatedBlockSize(t *testing.T) {
+	conf := DefaultConfig()
+	logger := &warnRecorder{Logger: NewStdLogger()}
+	conf.Logger = logger
+	conf.BlockSize = 8
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.BlockEntryLimit != 8 {
+		t.Fatalf("BlockEntryLimit = %d, want 8", conf.BlockEntryLimit)
+	}
+	if len(logger.warns) != 1 || !strings.Contains(logger.warns[0], "BlockSize is deprecated") {
+		t.Fatalf("expected deprecation warning, got %v", logger.warns)
+	}
+}
+
+func TestValidateDefaultBlockSizeBytes(t *testing.T) {
+	conf := DefaultConfig()
+	conf.BlockSizeBytes = 0
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.BlockSizeBytes != DefaultBlockSizeBytes {
+		t.Fatalf("BlockSizeBytes = %d, want %d", conf.BlockSizeBytes, DefaultBlockSizeBytes)
+	}
+
+	conf = DefaultConfig()
+	conf.BlockSizeBytes = 0
+	conf.BlockEntryLimit = 4
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.BlockSizeBytes != 0 {
+		t.Fatalf("BlockSizeBytes = %d, want 0 when only entry limit is set", conf.BlockSizeBytes)
+	}
+}
+
+func TestValidateFilterPolicy(t *testing.T) {
+	for _, policy := range []string{"", filter.NameBloom, filter.NameCuckoo, filter.NameNone} {
+		conf := DefaultConfig()
+		conf.FilterPolicy = policy
+		if err := conf.Validate(); err != nil {
+			t.Fatalf("Validate(%q) = %v", policy, err)
+		}
+	}
+	conf := DefaultConfig()
+	conf.FilterPolicy = "unregistered"
+	if err := conf.Validate(); !errors.Is(err, myerror.ErrUnknownFilter) {
+		t.Fatalf("Validate = %v, want ErrUnknownFilter", err)
+	}
+}
+
+func TestValidateConstructors(t *testing.T) {
+	for name, modify := range map[string]func(*Config){
+		"UnknownMemTableType":    func(c *Config) { c.MemTableType = 99 },
+		"NilMemTableConstructor": func(c *Config) { c.MemTableConstructor = nil },
+		"NilFilterConstructor":   func(c *Config) { c.FilterConstructor, c.FilterPolicy = nil, "" },
+		"UnknownWALMode":         func(c *Config) { c.WALMode = 9 },
+	} {
+		conf := DefaultConfig()
+		modify(conf)
+		if err := conf.Validate(); !errors.Is(err, myerror.ErrInvalidConfig) {
+			t.Fatalf("%s: Validate = %v, want ErrInvalidConfig", name, err)
+		}
+	}
+	// 指定了FilterPolicy时写入不使用FilterConstructor
+	conf := DefaultConfig()
+	conf.FilterConstructor = nil
+	conf.FilterPolicy = filter.NameBloom
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+}
+
+func TestValidateMaxValueSize(t *testing.T) {
+	for _, c := range []struct {
+		size, limit int64
+	}{{0, DefaultMaxValueSize}, {-1, DefaultMaxValueSize}, {1 << 20, 1 << 20}, {MaxValueSizeLimit, MaxValueSizeLimit}} {
+		conf := DefaultConfig()
+		conf.MaxValueSize = c.size
+		if err := conf.Validate(); err != nil {
+			t.Fatalf("MaxValueSize %d: %v", c.size, err)
+		}
+		if got := conf.ValueSizeLimit(); got != c.limit {
+			t.Fatalf("ValueSizeLimit() = %d for MaxValueSize %d, want %d", got, c.size, c.limit)
+		}
+	}
+	conf := DefaultConfig()
+	conf.MaxValueSize = MaxValueSizeLimit + 1
+	if err := conf.Validate(); !errors.Is(err, myerror.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+}
+
+func TestValidateDeterministicOutput(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DeterministicOutput = true
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("Validate = %v", err)
+	}
+	conf.TrackSequences = true
+	if err := conf.Validate(); !errors.Is(err, myerror.ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// KeySchema 描述key开头的定长字段，每个字段是1到8字节的大端无符号整数，如租户ID(4字节)+时间戳(8字节)+任意后缀。
+// 只用于布局和统计：写入SST时尽量在第一个字段变化处切换数据块，文件属性记录各级前缀的不同取值数，
+// PrefixScanFields按字段值计算遍历范围。与实际的key不符时只会使布局和统计变差，不影响读取的结果；
+// 有无schema或schema不同的文件可以混合读取
+type KeySchema struct {
+	Fields []int // 各字段的字节宽度，从key的开头依次排列
+}
+
+// NewKeySchema 按各字段的字节宽度创建KeySchema
+func NewKeySchema(widths ...int) *KeySchema {
+	return &KeySchema{Fields: append([]int(nil), widths...)}
+}
+
+// Validate 检查字段数不为0且每个字段宽度在1到8字节之间
+func (s *KeySchema) Validate() error {
+	if len(s.Fields) == 0 {
+		return fmt.Errorf("config: %w: KeySchema has no fields", myerror.ErrInvalidConfig)
+	}
+	for i, width := range s.Fields {
+		if width < 1 || width > 8 {
+			return fmt.Errorf("config: %w: KeySchema field %d has width %d, want 1 to 8", myerror.ErrInvalidConfig, i, width)
+		}
+	}
+	return nil
+}
+
+// Name 返回各字段宽度以逗号连接的名称，写入SST元数据，读取时名称一致才使用文件中的统计
+func (s *KeySchema) Name() string {
+	names := make([]string, len(s.Fields))
+	for i, width := range s.Fields {
+		names[i] = strconv.Itoa(width)
+	}
+	return strings.Join(names, ",")
+}
+
+// PrefixLen 返回前n个字段的总宽度
+func (s *KeySchema) PrefixLen(n int) int {
+	length := 0
+	for _, width := range s.Fields[:n] {
+		length += width
+	}
+	return length
+}
+
+// Prefix 返回key中前n个字段组成的前缀，key不够长时返回整个key
+func (s *KeySchema) Prefix(key []byte, n int) []byte {
+	return key[:min(len(key), s.PrefixLen(n))]
+}
+
+// SamePrefix 判断a和b的前n个字段是否相同
+func (s *KeySchema) SamePrefix(a, b []byte, n int) bool {
+	return bytes.Equal(s.Prefix(a, n), s.Prefix(b, n))
+}
+
+// Encode 按字段宽度编码前len(values)个字段，值超出字段宽度或字段数超出schema时返回ErrInvalidConfig
+func (s *KeySchema) Encode(values ...uint64) ([]byte, error) {
+	if len(values) > len(s.Fields) {
+		return nil, fmt.Errorf("config: %w: %d values for a KeySchema with %d fields", myerror.ErrInvalidConfig, len(values), len(s.Fields))
+	}
+	key := make([]byte, 0, s.PrefixLen(len(values)))
+	for i, value := range values {
+		width := s.Fields[i]
+		if width < 8 && value>>(8*width) != 0 {
+			return nil, fmt.Errorf("config: %w: value %d does not fit KeySchema field %d of %d bytes", myerror.ErrInvalidConfig, value, i, width)
+		}
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], value)
+		key = append(key, buf[8-width:]...)
+	}
+	return key, nil
+}
+
+// Range 返回前len(values)个字段依次等于values的所有key组成的区间。上界由最后一个字段加一得到，
+// 字段达到最大值时向前进位，所有字段都是最大值时没有上界
+func (s *KeySchema) Range(values ...uint64) (keyutil.Range, error) {
+	start, err := s.Encode(values...)
+	if err != nil {
+		return keyutil.Range{}, err
+	}
+	next := append([]uint64(nil), values...)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i] < s.fieldMax(i) {
+			next[i]++
+			end, err := s.Encode(next[:i+1]...)
+			if err != nil {
+				return keyutil.Range{}, err
+			}
+			return keyutil.Range{Start: start, End: end}, nil
+		}
+	}
+	return keyutil.Range{Start: start, Unbounded: true}, nil
+}
+
+// fieldMax 返回第i个字段的最大值
+func (s *KeySchema) fieldMax(i int) uint64 {
+	return ^uint64(0) >> (64 - 8*s.Fields[i])
+}
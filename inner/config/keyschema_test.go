@@ -0,0 +1,63 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestKeySchemaValidate(t *testing.T) {
+	for _, schema := range []*KeySchema{NewKeySchema(), NewKeySchema(4, 0), NewKeySchema(9)} {
+		conf := DefaultConfig()
+		conf.KeySchema = schema
+		if err := conf.Validate(); !errors.Is(err, myerror.ErrInvalidConfig) {
+			t.Fatalf("Validate with fields %v = %v, want ErrInvalidConfig", schema.Fields, err)
+		}
+	}
+	conf := DefaultConfig()
+	conf.KeySchema = NewKeySchema(4, 8)
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if name := conf.KeySchema.Name(); name != "4,8" {
+		t.Fatalf("Name() = %q", name)
+	}
+}
+
+// 按字段值计算的区间与编码后的字节前缀的区间相同，包括需要进位和没有上界的情况
+func TestKeySchemaRange(t *testing.T) {
+	schema := NewKeySchema(1, 2, 8)
+	cases := [][]uint64{
+		nil, {5}, {0xFF}, {3, 0xFFFF}, {0xFF, 0xFFFF}, {1, 2, ^uint64(0)}, {0xFF, 0xFFFF, ^uint64(0)},
+	}
+	rng := rand.New(rand.NewSource(1669))
+	for i := 0; i < 200; i++ {
+		values := []uint64{uint64(rng.Intn(3)) + 0xFD, uint64(rng.Intn(3)) + 0xFFFD, ^uint64(rng.Intn(3))}
+		cases = append(cases, values[:rng.Intn(4)])
+	}
+	for _, values := range cases {
+		got, err := schema.Range(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prefix, err := schema.Encode(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := keyutil.PrefixRange(prefix)
+		if !bytes.Equal(got.Start, want.Start) || got.Unbounded != want.Unbounded || (!want.Unbounded && !bytes.Equal(got.End, want.End)) {
+			t.Fatalf("Range(%v) = %+v, want %+v", values, got, want)
+		}
+	}
+
+	if _, err := schema.Encode(0x100); !errors.Is(err, myerror.ErrInvalidConfig) {
+		t.Fatalf("Encode with an oversized value = %v", err)
+	}
+	if _, err := schema.Range(1, 2, 3, 4); !errors.Is(err, myerror.ErrInvalidConfig) {
+		t.Fatalf("Range with too many values = %v", err)
+	}
+}
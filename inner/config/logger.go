@@ -0,0 +1,67 @@
+package config
+
+import "log"
+
+// Logger 日志接口，允许使用方注入自己的日志实现
+type Logger interface {
+	Debugf(format string, args ...any) // 调试日志
+	Infof(format string, args ...any)  // 普通日志
+	Warnf(format string, args ...any)  // 警告日志
+	Errorf(format string, args ...any) // 错误日志
+}
+
+// stdLogger 基于标准库log的默认日志实现
+type stdLogger struct{}
+
+// NewStdLogger 创建一个写入标准库log的日志器
+func NewStdLogger() Logger {
+	return stdLogger{}
+}
+
+func (stdLogger) Debugf(format string, args ...any) {
+	log.Printf("[DEBUG] "+format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...any) {
+	log.Printf("[INFO] "+format, args...)
+}
+
+func (stdLogger) Warnf(format string, args ...any) {
+	log.Printf("[WARN] "+format, args...)
+}
+
+func (stdLogger) Errorf(format string, args ...any) {
+	log.Printf("[ERROR] "+format, args...)
+}
+
+// Debugf 输出调试日志，仅在IsDebug开启且Logger不为nil时生效
+func (c *Config) Debugf(format string, args ...any) {
+	if c.Logger == nil || !c.IsDebug {
+		return
+	}
+	c.Logger.Debugf(format, args...)
+}
+
+// Infof 输出普通日志，Logger为nil时不输出
+func (c *Config) Infof(format string, args ...any) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Infof(format, args...)
+}
+
+// Warnf 输出警告日志，Logger为nil时不输出
+func (c *Config) Warnf(format string, args ...any) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Warnf(format, args...)
+}
+
+// Errorf 输出错误日志，Logger为nil时不输出
+func (c *Config) Errorf(format string, args ...any) {
+	if c.Logger == nil {
+		return
+	}
+	c.Logger.Errorf(format, args...)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Resolve 规范化数据目录并保存解析结果，WalDir和SSTDir为相对路径时视为DataDir的子目录，
+// 为绝对路径时直接使用。解析后的目录通过WalPath和SSTPath获取
+func (c *Config) Resolve() error {
+	walPath, err := resolveDir(c.DataDir, c.WalDir)
+	if err != nil {
+		return err
+	}
+	sstPath, err := resolveDir(c.DataDir, c.SSTDir)
+	if err != nil {
+		return err
+	}
+	if walPath == sstPath {
+		return fmt.Errorf("config: WalDir and SSTDir resolve to the same directory %s", walPath)
+	}
+	c.walPath, c.sstPath = walPath, sstPath
+	return nil
+}
+
+// WalPath 返回WAL目录，尚未调用Resolve时按当前配置即时解析
+func (c *Config) WalPath() string {
+	if c.walPath != "" {
+		return c.walPath
+	}
+	path, _ := resolveDir(c.DataDir, c.WalDir)
+	return path
+}
+
+// SSTPath 返回SST目录，尚未调用Resolve时按当前配置即时解析
+func (c *Config) SSTPath() string {
+	if c.sstPath != "" {
+		return c.sstPath
+	}
+	path, _ := resolveDir(c.DataDir, c.SSTDir)
+	return path
+}
+
+// SSTLayout SST文件在SST目录中的布局，只决定新文件的路径，载入时两种布局的文件都会被识别
+type SSTLayout int
+
+const (
+	SSTLayoutFlat   SSTLayout = iota // 默认，所有文件直接位于SST目录: 0_0000000012.sst
+	SSTLayoutNested                  // 每层一个子目录: L0/0000000012.sst
+)
+
+// SSTLevelDir 返回分层布局中level层的子目录
+func (c *Config) SSTLevelDir(level int) string {
+	return filepath.Join(c.SSTPath(), fmt.Sprintf("L%d", level))
+}
+
+// SSTFilePath 按SSTLayout返回level层序列号为seq的SST文件路径，序列号补零到10位，
+// 使同一层文件名的字典序与序列号顺序一致
+func (c *Config) SSTFilePath(level int, seq uint32) string {
+	if c.SSTLayout == SSTLayoutNested {
+		return filepath.Join(c.SSTLevelDir(level), fmt.Sprintf("%010d.sst", seq))
+	}
+	return filepath.Join(c.SSTPath(), fmt.Sprintf("%d_%010d.sst", level, seq))
+}
+
+// QuarantinePath 返回存放无法打开的SST文件的隔离目录，位于SST目录旁边，不会被当作SST文件载入
+func (c *Config) QuarantinePath() string {
+	return c.SSTPath() + ".quarantine"
+}
+
+// resolveDir 解析dir，相对路径基于base，结果为清理后的绝对路径
+func resolveDir(base, dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(base, dir)
+	}
+	path, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("config: resolve directory %q: %w", dir, err)
+	}
+	return path, nil
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePaths(t *testing.T) {
+	base := t.TempDir()
+	absWal := filepath.Join(base, "elsewhere", "wal")
+	tests := []struct {
+		name    string
+		dataDir string
+		walDir  string
+		sstDir  string
+		wantWal string
+		wantSST string
+	}{
+		{"relative", base, "wal", "sst", filepath.Join(base, "wal"), filepath.Join(base, "sst")},
+		{"dot relative", base, "./wal", "./sst", filepath.Join(base, "wal"), filepath.Join(base, "sst")},
+		{"nested", base, filepath.Join("a", "b", "wal"), filepath.Join("a", "..", "sst"), filepath.Join(base, "a", "b", "wal"), filepath.Join(base, "sst")},
+		{"absolute", filepath.Join(base, "data"), absWal, filepath.Join(base, "sst"), absWal, filepath.Join(base, "sst")},
+		{"mixed", filepath.Join(base, "data"), absWal, "sst", absWal, filepath.Join(base, "data", "sst")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			conf.DataDir, conf.WalDir, conf.SSTDir = tt.dataDir, tt.walDir, tt.sstDir
+			if err := conf.Resolve(); err != nil {
+				t.Fatal(err)
+			}
+			if conf.WalPath() != tt.wantWal {
+				t.Errorf("WalPath = %s, want %s", conf.WalPath(), tt.wantWal)
+			}
+			if conf.SSTPath() != tt.wantSST {
+				t.Errorf("SSTPath = %s, want %s", conf.SSTPath(), tt.wantSST)
+			}
+		})
+	}
+}
+
+func TestResolveRelativeDataDir(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DataDir = filepath.Join("db", "data")
+	if err := conf.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.Abs(filepath.Join("db", "data", "wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.WalPath() != want {
+		t.Fatalf("WalPath = %s, want %s", conf.WalPath(), want)
+	}
+	if !filepath.IsAbs(conf.SSTPath()) {
+		t.Fatalf("SSTPath %s is not absolute", conf.SSTPath())
+	}
+}
+
+func TestResolveSameDirectory(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.WalDir = "files"
+	conf.SSTDir = filepath.Join(".", "files", ".")
+	if err := conf.Resolve(); err == nil {
+		t.Fatal("expected error when WalDir and SSTDir resolve to the same directory")
+	}
+}
+
+func TestPathsWithoutResolve(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DataDir = t.TempDir()
+	if conf.WalPath() != filepath.Join(conf.DataDir, "wal") {
+		t.Fatalf("WalPath = %s", conf.WalPath())
+	}
+}
+
+func TestSSTFilePath(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DataDir = t.TempDir()
+	if err := conf.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := conf.SSTFilePath(2, 12), filepath.Join(conf.SSTPath(), "2_0000000012.sst"); got != want {
+		t.Fatalf("flat SSTFilePath = %s, want %s", got, want)
+	}
+	conf.SSTLayout = SSTLayoutNested
+	if got, want := conf.SSTFilePath(3, 458), filepath.Join(conf.SSTPath(), "L3", "0000000458.sst"); got != want {
+		t.Fatalf("nested SSTFilePath = %s, want %s", got, want)
+	}
+	if got, want := conf.SSTFilePath(0, 1<<32-1), filepath.Join(conf.SSTLevelDir(0), "4294967295.sst"); got != want {
+		t.Fatalf("nested SSTFilePath = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,54 @@
+package config
+
+import "fmt"
+
+// PrefixExtractor 前缀提取器，SST写入时会把每个key的前缀加入数据块的过滤器，前缀扫描时据此跳过数据块
+// Transform对不在作用域内的key返回nil；若Transform(p)不为nil，则所有以p开头的key必须提取出相同的前缀
+type PrefixExtractor interface {
+	Name() string                // 名称，写入SST元数据，读取时名称不一致则不使用前缀过滤
+	Transform(key []byte) []byte // 提取key的前缀
+}
+
+// fixedPrefixExtractor 固定长度前缀
+type fixedPrefixExtractor struct {
+	n int // 前缀长度
+}
+
+// NewFixedPrefixExtractor 创建固定长度的前缀提取器，长度不足n的key不在作用域内
+func NewFixedPrefixExtractor(n int) PrefixExtractor {
+	return fixedPrefixExtractor{n: n}
+}
+
+func (e fixedPrefixExtractor) Name() string {
+	return fmt.Sprintf("fixed:%d", e.n)
+}
+
+func (e fixedPrefixExtractor) Transform(key []byte) []byte {
+	if len(key) < e.n {
+		return nil
+	}
+	return key[:e.n]
+}
+
+// delimiterPrefixExtractor 截取到第一个分隔符(包含)为止的前缀
+type delimiterPrefixExtractor struct {
+	delim byte // 分隔符
+}
+
+// NewDelimiterPrefixExtractor 创建按分隔符截取的前缀提取器，不含分隔符的key不在作用域内
+func NewDelimiterPrefixExtractor(delim byte) PrefixExtractor {
+	return delimiterPrefixExtractor{delim: delim}
+}
+
+func (e delimiterPrefixExtractor) Name() string {
+	return fmt.Sprintf("delimiter:%d", e.delim)
+}
+
+func (e delimiterPrefixExtractor) Transform(key []byte) []byte {
+	for i, c := range key {
+		if c == e.delim {
+			return key[:i+1]
+		}
+	}
+	return nil
+}
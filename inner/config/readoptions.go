@@ -0,0 +1,35 @@
+package config
+
+import "time"
+
+// ReadTier 单次查找允许访问的范围
+type ReadTier int
+
+const (
+	ReadAll          ReadTier = iota // 查找内存表和所有SST文件
+	ReadMemtableOnly                 // 只查找内存表，不读取SST文件
+)
+
+// ReadOptions 单次查找的选项。零值不填充缓存也不校验条目，
+// 与Get行为一致的默认值由DefaultReadOptions返回
+type ReadOptions struct {
+	FillCache       bool     // 从文件读取的数据块是否放入数据块缓存，为false时只使用已缓存的数据块
+	VerifyChecksums bool     // 是否校验带校验和的条目，为false时从文件读取的数据块也不放入缓存
+	ReadTier        ReadTier // 查找范围，默认ReadAll
+	// UnsafeSharedValue 从SST文件读取时直接返回数据块缓存中共享的value，不复制，调用方不得修改或追加。
+	// 默认复制，调用方可以任意修改返回的value；内存表中的结果和使用映射读取时总是复制
+	UnsafeSharedValue bool
+}
+
+// DefaultReadOptions 返回Get使用的选项：填充缓存、校验条目、查找所有层
+func DefaultReadOptions() ReadOptions {
+	return ReadOptions{FillCache: true, VerifyChecksums: true, ReadTier: ReadAll}
+}
+
+// ScanOptions 遍历的选项。零值按Clock跳过已过期但尚未被压缩清除的条目
+type ScanOptions struct {
+	IncludeExpired bool // 同时返回已过期的条目，过期时间通过ScanItem.Expiry查看
+	// ExpireBefore 不为零时只返回设置了过期时间且在该时刻或之前过期的条目(包括已经过期的)，
+	// 即到该时刻会成为垃圾的条目，此时忽略IncludeExpired
+	ExpireBefore time.Time
+}
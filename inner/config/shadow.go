@@ -0,0 +1,33 @@
+package config
+
+import "fmt"
+
+// ShadowAnswer 一次读取的结果及其来源
+type ShadowAnswer struct {
+	Found  bool   // 是否读到未删除的值，删除标记和不存在都为false
+	Value  []byte // 读到的值
+	Source string // 满足读取的层级(mutable、immutable、L0等)，none表示未命中
+	File   string // 来自SST时的文件名
+}
+
+func (a ShadowAnswer) String() string {
+	where := a.Source
+	if a.File != "" {
+		where += " " + a.File
+	}
+	if !a.Found {
+		return "not found (" + where + ")"
+	}
+	return fmt.Sprintf("%q (%s)", a.Value, where)
+}
+
+// ShadowMismatch 开启ShadowVerifyReads时正常查找与逐条扫描得到的结果不一致
+type ShadowMismatch struct {
+	Key  []byte       // 读取的key
+	Fast ShadowAnswer // 正常查找的结果，即返回给调用方的结果
+	Slow ShadowAnswer // 不使用过滤器和索引，逐条扫描内存表和SST文件得到的结果
+}
+
+func (m ShadowMismatch) String() string {
+	return fmt.Sprintf("key %q: fast %s, slow %s", m.Key, m.Fast, m.Slow)
+}
@@ -0,0 +1,11 @@
+package config
+
+// VacuumProgress Vacuum的进度，每完成一步后通过OnVacuumProgress报告。
+// 每个非最底层的层级合并到下一层为一步，开启VacuumRewriteBottomLevel时重写最底层为最后一步
+type VacuumProgress struct {
+	Level       int   // 本步处理的层级
+	Done        int   // 已完成的步数
+	Total       int   // 总步数
+	BytesBefore int64 // Vacuum开始时所有SST文件的总大小
+	BytesNow    int64 // 本步完成后所有SST文件的总大小
+}
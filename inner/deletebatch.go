@@ -0,0 +1,75 @@
+package inner
+
+import (
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// DeleteBatch 删除keys中的所有key。删除标记编码为一条批量删除记录写入WAL，共用记录头部、序列号、写入时间和CRC，
+// 每个删除标记只比key多一到两个字节；之后在同一次写锁内写入内存表，重放时要么全部生效要么全部忽略。
+// 任一key不合法时返回对应的错误，不删除任何key。开启TombstoneRetention时需要保留每个key删除前的值，逐个调用Delete
+func (t *LsmTree) DeleteBatch(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	for _, key := range keys {
+		if err := checkUserKey(key); err != nil {
+			return err
+		}
+		if err := t.checkEntrySize(key, nil); err != nil {
+			return err
+		}
+	}
+	if t.conf.TombstoneRetention > 0 {
+		for _, key := range keys {
+			if err := t.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	commit, err := t.applyDeleteBatch(keys)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// applyDeleteBatch 在写锁内写入批量删除记录和内存表，返回WAL提交以便在锁外等待持久化
+func (t *LsmTree) applyDeleteBatch(keys [][]byte) (*wal.Commit, error) {
+	var size, userBytes int64
+	for _, key := range keys {
+		size += memtable.EntrySize(key, nil)
+		userBytes += int64(len(key))
+	}
+	if err := t.beginWriteWithRoom(size); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	// 与事务相同，同一批中的删除标记使用相同的写入时间和序列号
+	ts, seq := t.writeTimestamp(), t.writeSeq()
+	walBefore := t.curWal.Size()
+	commit, err := t.curWal.WriteRecordAsync(wal.NewDeleteBatchRecord(keys, seq, ts))
+	if err != nil {
+		return nil, err
+	}
+	t.recordUserWrite(userBytes, walBefore)
+	var entries []kv.Entry
+	for _, key := range keys {
+		entry := kv.Entry{Key: key, Kind: kv.KindDelete, Seq: seq, Timestamp: ts}
+		if err := t.putMutable(entry); err != nil {
+			return nil, err
+		}
+		if t.watch.watching() {
+			entries = append(entries, entry)
+		}
+	}
+	t.watch.record(commit, t.recordWrites(keys...), entries...)
+
+	if t.walFull() {
+		return commit, t.rotateWal(RotationWalSize)
+	}
+	return commit, nil
+}
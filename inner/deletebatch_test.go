@@ -0,0 +1,126 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// deleteBatchKeys 返回n个定长的key
+func deleteBatchKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%07d", i))
+	}
+	return keys
+}
+
+// checkDeleted 检查偶数下标的key已删除、奇数下标的key仍然存在
+func checkDeleted(t *testing.T, tree *LsmTree, keys [][]byte) {
+	t.Helper()
+	for i := 0; i < len(keys); i += len(keys)/100 + 1 {
+		_, err := tree.Get(keys[i])
+		if i%2 == 0 && !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("deleted %s: got %v, want ErrKeyNotFound", keys[i], err)
+		}
+		if i%2 == 1 && err != nil {
+			t.Fatalf("live %s: %v", keys[i], err)
+		}
+	}
+	var live int
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+		live++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if live != len(keys)/2 {
+		t.Fatalf("scan found %d keys, want %d", live, len(keys)/2)
+	}
+}
+
+// 批量删除写入的WAL远小于逐个删除，刷盘后的删除标记不占value长度；重放WAL和刷盘后读取结果都正确
+func TestLsmTree_DeleteBatch(t *testing.T) {
+	// 删除其中一半，共100000个删除标记
+	n := 200000
+	if testing.Short() {
+		n = 20000
+	}
+	keys := deleteBatchKeys(n)
+	var deleted [][]byte
+	for i := 0; i < n; i += 2 {
+		deleted = append(deleted, keys[i])
+	}
+	open := func(dir string) (*config.Config, *LsmTree) {
+		conf := config.DefaultConfig()
+		conf.DataDir = dir
+		conf.IsDebug = false
+		conf.AutoSync = false
+		conf.WalSize = 64 << 20
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if err := tree.Put(key, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushAll(t, tree)
+		return conf, tree
+	}
+
+	_, single := open(t.TempDir())
+	defer single.Close()
+	before := single.Stats().WALBytesWritten
+	for _, key := range deleted {
+		if err := single.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	singleWal := single.Stats().WALBytesWritten - before
+
+	conf, tree := open(t.TempDir())
+	defer func() { tree.Close() }()
+	if err := tree.DeleteBatch([][]byte{[]byte("x"), nil}); !errors.Is(err, ErrKeyNil) {
+		t.Fatalf("DeleteBatch with nil key: got %v, want ErrKeyNil", err)
+	}
+	before = tree.Stats().WALBytesWritten
+	if err := tree.DeleteBatch(deleted); err != nil {
+		t.Fatal(err)
+	}
+	batchWal := tree.Stats().WALBytesWritten - before
+	if batchWal*2 > singleWal {
+		t.Fatalf("delete batch wrote %d WAL bytes, individual deletes %d", batchWal, singleWal)
+	}
+	t.Logf("WAL bytes for %d tombstones: batch %d, individual %d", len(deleted), batchWal, singleWal)
+	checkDeleted(t, tree, keys)
+
+	// 重放WAL中的批量删除记录
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, tree, keys)
+
+	// 只有删除标记的SST中每个条目小于版本4的头部加key
+	before = tree.Stats().LiveSSTBytes
+	flushAll(t, tree)
+	sstBytes := tree.Stats().LiveSSTBytes - before
+	if v4 := int64(len(deleted) * (9 + len(deleted[0]))); sstBytes >= v4 {
+		t.Fatalf("tombstone sst takes %d bytes, format 4 entries alone took %d", sstBytes, v4)
+	}
+	checkDeleted(t, tree, keys)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, tree, keys)
+}
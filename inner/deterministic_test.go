@@ -0,0 +1,134 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// 开启DeterministicOutput时，同一个内存表刷盘两次，以及以不同顺序写入得到相同最终内容、来源WAL不同的两棵树刷盘，
+// 写出的SST文件字节相同，来源WAL记录在清单中
+func TestLsmTree_DeterministicOutput(t *testing.T) {
+	const keys = 2000
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value-%05d", i)) }
+	open := func(start time.Time) (*LsmTree, *manualClock) {
+		t.Helper()
+		conf := newTestConfig(t)
+		conf.DeterministicOutput = true
+		conf.BlockSizeBytes = 512
+		conf.WalSize = 64 << 20 // 所有写入都在一个内存表中
+		clock := &manualClock{now: start}
+		conf.Clock = clock
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree, clock
+	}
+	// newest 返回L0中最新的文件
+	newest := func(tree *LsmTree) *sst.Node {
+		t.Helper()
+		tree.mu.RLock()
+		defer tree.mu.RUnlock()
+		if len(tree.nodes[0]) == 0 {
+			t.Fatal("L0 is empty")
+		}
+		return tree.nodes[0][len(tree.nodes[0])-1]
+	}
+	sstBytes := func(tree *LsmTree) []byte {
+		t.Helper()
+		data, err := os.ReadFile(newest(tree).GetFilename())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// 按key顺序写入
+	sorted, clock := open(time.Unix(1700000000, 0))
+	defer sorted.Close()
+	for i := 0; i < keys; i++ {
+		if err := sorted.Put([]byte(fmt.Sprintf("key-%05d", i)), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 同一个内存表在不同时间刷盘两次
+	dir := t.TempDir()
+	var twice [2][]byte
+	for i := range twice {
+		path := filepath.Join(dir, fmt.Sprintf("0_%d.sst", i))
+		sorted.mu.RLock()
+		group := []*immutable{{wal: sorted.curWal, index: sorted.mutableIndex}}
+		err := sorted.writeMemTableToSST(group, path, nil)
+		sorted.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		twice[i] = data
+		clock.Advance(time.Hour)
+	}
+	if !bytes.Equal(twice[0], twice[1]) {
+		t.Fatalf("flushing the same memtable twice wrote different files (%d and %d bytes)", len(twice[0]), len(twice[1]))
+	}
+	flushAll(t, sorted)
+	want := sstBytes(sorted)
+	if !bytes.Equal(want, twice[0]) {
+		t.Fatal("background flush differs from flushing the memtable directly")
+	}
+
+	// 乱序写入，先写入其他value再覆盖，最终内容相同。先刷盘一个不相关的内存表，使之后的内存表使用不同的WAL
+	shuffled, _ := open(time.Unix(1800000000, 0))
+	defer func() { shuffled.Close() }()
+	if err := shuffled.Put([]byte("another-wal"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, shuffled)
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(keys) {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if i%3 == 0 {
+			if err := shuffled.Put(key, []byte("stale")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := shuffled.Put(key, value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, shuffled)
+	if got := sstBytes(shuffled); !bytes.Equal(got, want) {
+		t.Fatalf("different insertion histories wrote different files (%d and %d bytes)", len(got), len(want))
+	}
+	wantWals := newest(sorted).SourceWals()
+	gotWals := newest(shuffled).SourceWals()
+	if len(wantWals) != 1 || len(gotWals) != 1 || wantWals[0] == gotWals[0] {
+		t.Fatalf("source wals = %v and %v, want one different wal each", wantWals, gotWals)
+	}
+	if walIds := newest(shuffled).Reader().SourceWals(); walIds != nil {
+		t.Fatalf("file metadata records source wals %v", walIds)
+	}
+
+	// 重新打开后来源WAL从清单恢复
+	if err := shuffled.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewLsmTree(shuffled.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shuffled = reopened
+	if walIds := newest(shuffled).SourceWals(); !slices.Equal(walIds, gotWals) {
+		t.Fatalf("source wals after reopen = %v, want %v", walIds, gotWals)
+	}
+}
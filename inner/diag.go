@@ -0,0 +1,414 @@
+package inner
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Format 诊断信息的输出格式
+type Format int8
+
+const (
+	FormatText Format = iota // 每行一个字段，名称与JSON字段名相同
+	FormatJSON               // 缩进的JSON
+)
+
+// 诊断结构的JSON字段名固定为下面各json结构的tag，与Go字段名无关，内部重命名不影响下游解析。
+// 时长以纳秒输出，字段名带_ns后缀；时间为RFC3339格式，零值输出null；key同时输出十六进制和替换了非法字符的UTF-8
+
+// jsonKey 二进制key的JSON表示
+type jsonKey struct {
+	Hex  string `json:"hex"`
+	UTF8 string `json:"utf8"`
+}
+
+// newJSONKey 返回key的JSON表示，key为nil时返回nil
+func newJSONKey(key []byte) *jsonKey {
+	if key == nil {
+		return nil
+	}
+	return &jsonKey{Hex: hex.EncodeToString(key), UTF8: strings.ToValidUTF8(string(key), "\uFFFD")}
+}
+
+// jsonTime 返回t的RFC3339表示，零值返回nil
+func jsonTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	s := t.Format(time.RFC3339Nano)
+	return &s
+}
+
+type statsJSON struct {
+	Gets                   uint64                   `json:"gets"`
+	MemTableProbes         uint64                   `json:"memtable_probes"`
+	NodesConsidered        uint64                   `json:"nodes_considered"`
+	NodesSkipped           uint64                   `json:"nodes_skipped"`
+	BloomNegatives         uint64                   `json:"bloom_negatives"`
+	BlocksRead             uint64                   `json:"blocks_read"`
+	BlockBytesRead         uint64                   `json:"block_bytes_read"`
+	BlockCacheHits         uint64                   `json:"block_cache_hits"`
+	BlockCacheMisses       uint64                   `json:"block_cache_misses"`
+	RowCacheHits           uint64                   `json:"row_cache_hits"`
+	RowCacheMisses         uint64                   `json:"row_cache_misses"`
+	WriteBufferBytes       int64                    `json:"write_buffer_bytes"`
+	WriteBufferPeakBytes   int64                    `json:"write_buffer_peak_bytes"`
+	UserBytesWritten       int64                    `json:"user_bytes_written"`
+	WALBytesWritten        int64                    `json:"wal_bytes_written"`
+	FlushBytesWritten      int64                    `json:"flush_bytes_written"`
+	LiveSSTBytes           int64                    `json:"live_sst_bytes"`
+	LogicalBytes           int64                    `json:"logical_bytes"`
+	FilterMemoryBytes      int64                    `json:"filter_memory_bytes"`
+	FilterReloads          uint64                   `json:"filter_reloads"`
+	L0Files                int                      `json:"l0_files"`
+	OpenIterators          int                      `json:"open_iterators"`
+	WriteThrottleDelayNs   int64                    `json:"write_throttle_delay_ns"`
+	WriteThrottleTimeNs    int64                    `json:"write_throttle_time_ns"`
+	CompactionDebt         int64                    `json:"compaction_debt"`
+	LevelCompactions       uint64                   `json:"level_compactions"`
+	LevelCompactionBytes   int64                    `json:"level_compaction_bytes"`
+	LevelTrivialMoves      uint64                   `json:"level_trivial_moves"`
+	LevelTrivialMoveBytes  int64                    `json:"level_trivial_move_bytes"`
+	NextPeriodicCompaction *string                  `json:"next_periodic_compaction"`
+	LastPeriodicCompaction periodicJSON             `json:"last_periodic_compaction"`
+	Recovery               recoveryJSON             `json:"recovery"`
+	LevelFilters           []levelFilterJSON        `json:"level_filters"`
+	FileHeat               []fileHeatJSON           `json:"file_heat"`
+	FileFilters            []fileFilterJSON         `json:"file_filters"`
+	Latencies              map[string]histogramJSON `json:"latencies"`
+	Rotations              map[string]uint64        `json:"rotations"`
+}
+
+type periodicJSON struct {
+	Time              *string `json:"time"`
+	FilesChecked      int     `json:"files_checked"`
+	FilesCompacted    int     `json:"files_compacted"`
+	BytesBefore       int64   `json:"bytes_before"`
+	BytesAfter        int64   `json:"bytes_after"`
+	TombstonesDropped int64   `json:"tombstones_dropped"`
+	Error             *string `json:"error"`
+}
+
+type recoveryJSON struct {
+	WALFiles       int     `json:"wal_files"`
+	WALBytes       int64   `json:"wal_bytes"`
+	Records        int64   `json:"records"`
+	DurationNs     int64   `json:"duration_ns"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	Parallelism    int     `json:"parallelism"`
+}
+
+type levelFilterJSON struct {
+	Level       int    `json:"level"`
+	Probes      uint64 `json:"probes"`
+	Negatives   uint64 `json:"negatives"`
+	MemoryBytes int64  `json:"memory_bytes"`
+	Reloads     uint64 `json:"reloads"`
+}
+
+type fileFilterJSON struct {
+	Path        string `json:"path"`
+	Level       int    `json:"level"`
+	Seq         uint32 `json:"seq"`
+	MemoryBytes int64  `json:"memory_bytes"`
+	Reloads     uint64 `json:"reloads"`
+}
+
+type fileHeatJSON struct {
+	Path  string `json:"path"`
+	Level int    `json:"level"`
+	Seq   uint32 `json:"seq"`
+	Heat  uint64 `json:"heat"`
+}
+
+type histogramJSON struct {
+	Count   uint64       `json:"count"`
+	SumNs   int64        `json:"sum_ns"`
+	P50Ns   int64        `json:"p50_ns"`
+	P95Ns   int64        `json:"p95_ns"`
+	P99Ns   int64        `json:"p99_ns"`
+	Buckets []bucketJSON `json:"buckets"` // 只包含非空区间
+}
+
+type bucketJSON struct {
+	UpperBoundNs int64  `json:"upper_bound_ns"` // 0表示超出10s的最后一个区间
+	Count        uint64 `json:"count"`
+}
+
+// toJSON 复制Stats的值，各切片即使为空也输出[]
+func (s Stats) toJSON() statsJSON {
+	out := statsJSON{
+		Gets:                   s.Gets,
+		MemTableProbes:         s.MemTableProbes,
+		NodesConsidered:        s.NodesConsidered,
+		NodesSkipped:           s.NodesSkipped,
+		BloomNegatives:         s.BloomNegatives,
+		BlocksRead:             s.BlocksRead,
+		BlockBytesRead:         s.BlockBytesRead,
+		BlockCacheHits:         s.BlockCacheHits,
+		BlockCacheMisses:       s.BlockCacheMisses,
+		RowCacheHits:           s.RowCacheHits,
+		RowCacheMisses:         s.RowCacheMisses,
+		WriteBufferBytes:       s.WriteBufferBytes,
+		WriteBufferPeakBytes:   s.WriteBufferPeakBytes,
+		UserBytesWritten:       s.UserBytesWritten,
+		WALBytesWritten:        s.WALBytesWritten,
+		FlushBytesWritten:      s.FlushBytesWritten,
+		LiveSSTBytes:           s.LiveSSTBytes,
+		LogicalBytes:           s.LogicalBytes,
+		FilterMemoryBytes:      s.FilterMemoryBytes,
+		FilterReloads:          s.FilterReloads,
+		L0Files:                s.L0Files,
+		OpenIterators:          s.OpenIterators,
+		WriteThrottleDelayNs:   int64(s.WriteThrottleDelay),
+		WriteThrottleTimeNs:    int64(s.WriteThrottleTime),
+		CompactionDebt:         s.CompactionDebt,
+		LevelCompactions:       s.LevelCompactions,
+		LevelCompactionBytes:   s.LevelCompactionBytes,
+		LevelTrivialMoves:      s.LevelTrivialMoves,
+		LevelTrivialMoveBytes:  s.LevelTrivialMoveBytes,
+		NextPeriodicCompaction: jsonTime(s.NextPeriodicCompaction),
+		LevelFilters:           make([]levelFilterJSON, len(s.LevelFilters)),
+		FileHeat:               make([]fileHeatJSON, len(s.FileHeat)),
+		FileFilters:            make([]fileFilterJSON, len(s.FileFilters)),
+		Latencies:              make(map[string]histogramJSON),
+		Rotations:              make(map[string]uint64),
+	}
+	last := s.LastPeriodicCompaction
+	out.LastPeriodicCompaction = periodicJSON{
+		Time:              jsonTime(last.Time),
+		FilesChecked:      last.FilesChecked,
+		FilesCompacted:    last.FilesCompacted,
+		BytesBefore:       last.BytesBefore,
+		BytesAfter:        last.BytesAfter,
+		TombstonesDropped: last.TombstonesDropped,
+	}
+	if last.Err != nil {
+		msg := last.Err.Error()
+		out.LastPeriodicCompaction.Error = &msg
+	}
+	out.Recovery = recoveryJSON{
+		WALFiles:       s.Recovery.WALFiles,
+		WALBytes:       s.Recovery.WALBytes,
+		Records:        s.Recovery.Records,
+		DurationNs:     int64(s.Recovery.Duration),
+		BytesPerSecond: s.Recovery.BytesPerSecond(),
+		Parallelism:    s.Recovery.Parallelism,
+	}
+	for level, filter := range s.LevelFilters {
+		out.LevelFilters[level] = levelFilterJSON{
+			Level:       level,
+			Probes:      filter.Probes,
+			Negatives:   filter.Negatives,
+			MemoryBytes: filter.MemoryBytes,
+			Reloads:     filter.Reloads,
+		}
+	}
+	for i, file := range s.FileHeat {
+		out.FileHeat[i] = fileHeatJSON{Path: file.Path, Level: file.Level, Seq: file.Seq, Heat: file.Heat}
+	}
+	for i, file := range s.FileFilters {
+		out.FileFilters[i] = fileFilterJSON{Path: file.Path, Level: file.Level, Seq: file.Seq, MemoryBytes: file.MemoryBytes, Reloads: file.Reloads}
+	}
+	for _, op := range LatencyOps() {
+		hist := s.Histogram(op)
+		h := histogramJSON{
+			Count:   hist.Count,
+			SumNs:   int64(hist.Sum),
+			P50Ns:   int64(hist.P50),
+			P95Ns:   int64(hist.P95),
+			P99Ns:   int64(hist.P99),
+			Buckets: []bucketJSON{},
+		}
+		for _, bucket := range hist.Buckets {
+			if bucket.Count > 0 {
+				h.Buckets = append(h.Buckets, bucketJSON{UpperBoundNs: int64(bucket.UpperBound), Count: bucket.Count})
+			}
+		}
+		out.Latencies[op.String()] = h
+	}
+	for _, cause := range RotationCauses() {
+		out.Rotations[cause.String()] = s.Rotations(cause)
+	}
+	return out
+}
+
+// MarshalJSON 按固定的字段名输出统计，耗时分布按操作名称索引
+func (s Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toJSON())
+}
+
+// Dump 将统计按format写入w。Stats是Stats()返回的快照，输出期间不读取树的状态
+func (s Stats) Dump(w io.Writer, format Format) error {
+	switch format {
+	case FormatJSON:
+		data, err := json.MarshalIndent(s.toJSON(), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case FormatText:
+		return s.dumpText(w)
+	}
+	return fmt.Errorf("unknown format %d", format)
+}
+
+// dumpText 每行输出一个字段名和值，列表按下标展开，耗时分布每个操作一行
+func (s Stats) dumpText(w io.Writer) error {
+	out := s.toJSON()
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	line := func(name string, value any) {
+		fmt.Fprintf(tw, "%s\t%v\n", name, value)
+	}
+	optional := func(s *string) string {
+		if s == nil {
+			return "-"
+		}
+		return *s
+	}
+	line("gets", out.Gets)
+	line("memtable_probes", out.MemTableProbes)
+	line("nodes_considered", out.NodesConsidered)
+	line("nodes_skipped", out.NodesSkipped)
+	line("bloom_negatives", out.BloomNegatives)
+	line("blocks_read", out.BlocksRead)
+	line("block_bytes_read", out.BlockBytesRead)
+	line("block_cache_hits", out.BlockCacheHits)
+	line("block_cache_misses", out.BlockCacheMisses)
+	line("row_cache_hits", out.RowCacheHits)
+	line("row_cache_misses", out.RowCacheMisses)
+	line("write_buffer_bytes", out.WriteBufferBytes)
+	line("write_buffer_peak_bytes", out.WriteBufferPeakBytes)
+	line("user_bytes_written", out.UserBytesWritten)
+	line("wal_bytes_written", out.WALBytesWritten)
+	line("flush_bytes_written", out.FlushBytesWritten)
+	line("live_sst_bytes", out.LiveSSTBytes)
+	line("logical_bytes", out.LogicalBytes)
+	line("filter_memory_bytes", out.FilterMemoryBytes)
+	line("filter_reloads", out.FilterReloads)
+	line("l0_files", out.L0Files)
+	line("open_iterators", out.OpenIterators)
+	line("write_throttle_delay", s.WriteThrottleDelay)
+	line("write_throttle_time", s.WriteThrottleTime)
+	line("compaction_debt", out.CompactionDebt)
+	line("level_compactions", out.LevelCompactions)
+	line("level_compaction_bytes", out.LevelCompactionBytes)
+	line("level_trivial_moves", out.LevelTrivialMoves)
+	line("level_trivial_move_bytes", out.LevelTrivialMoveBytes)
+	line("next_periodic_compaction", optional(out.NextPeriodicCompaction))
+	last := out.LastPeriodicCompaction
+	line("last_periodic_compaction", fmt.Sprintf("time=%s files_checked=%d files_compacted=%d bytes_before=%d bytes_after=%d tombstones_dropped=%d error=%s",
+		optional(last.Time), last.FilesChecked, last.FilesCompacted, last.BytesBefore, last.BytesAfter, last.TombstonesDropped, optional(last.Error)))
+	recovery := out.Recovery
+	line("recovery", fmt.Sprintf("wal_files=%d wal_bytes=%d records=%d duration=%s bytes_per_second=%.0f parallelism=%d",
+		recovery.WALFiles, recovery.WALBytes, recovery.Records, s.Recovery.Duration, recovery.BytesPerSecond, recovery.Parallelism))
+	for _, filter := range out.LevelFilters {
+		line(fmt.Sprintf("level_filters[%d]", filter.Level), fmt.Sprintf("probes=%d negatives=%d memory_bytes=%d reloads=%d",
+			filter.Probes, filter.Negatives, filter.MemoryBytes, filter.Reloads))
+	}
+	for _, file := range out.FileHeat {
+		line(fmt.Sprintf("file_heat[%d/%d]", file.Level, file.Seq), fmt.Sprintf("heat=%d path=%s", file.Heat, file.Path))
+	}
+	for _, file := range out.FileFilters {
+		line(fmt.Sprintf("file_filters[%d/%d]", file.Level, file.Seq), fmt.Sprintf("memory_bytes=%d reloads=%d path=%s", file.MemoryBytes, file.Reloads, file.Path))
+	}
+	for _, op := range LatencyOps() {
+		hist := s.Histogram(op)
+		line("latencies."+op.String(), fmt.Sprintf("count=%d sum=%s p50=%s p95=%s p99=%s", hist.Count, hist.Sum, hist.P50, hist.P95, hist.P99))
+	}
+	for _, cause := range RotationCauses() {
+		line("rotations."+cause.String(), s.Rotations(cause))
+	}
+	return tw.Flush()
+}
+
+type getTraceJSON struct {
+	MemTablesChecked int              `json:"memtables_checked"`
+	Levels           []levelTraceJSON `json:"levels"`
+	Blocks           []blockTraceJSON `json:"blocks"`
+	CacheHits        int              `json:"cache_hits"`
+	CacheMisses      int              `json:"cache_misses"`
+	Source           string           `json:"source"`
+	DurationNs       int64            `json:"duration_ns"`
+}
+
+type levelTraceJSON struct {
+	Level           int `json:"level"`
+	NodesConsidered int `json:"nodes_considered"`
+	NodesSkipped    int `json:"nodes_skipped"`
+	BloomNegatives  int `json:"bloom_negatives"`
+}
+
+type blockTraceJSON struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// MarshalJSON 按固定的字段名输出查找过程
+func (trace GetTrace) MarshalJSON() ([]byte, error) {
+	out := getTraceJSON{
+		MemTablesChecked: trace.MemTablesChecked,
+		Levels:           make([]levelTraceJSON, len(trace.Levels)),
+		Blocks:           make([]blockTraceJSON, len(trace.Blocks)),
+		CacheHits:        trace.CacheHits,
+		CacheMisses:      trace.CacheMisses,
+		Source:           trace.Source,
+		DurationNs:       int64(trace.Duration),
+	}
+	for i, level := range trace.Levels {
+		out.Levels[i] = levelTraceJSON{
+			Level:           level.Level,
+			NodesConsidered: level.NodesConsidered,
+			NodesSkipped:    level.NodesSkipped,
+			BloomNegatives:  level.BloomNegatives,
+		}
+	}
+	for i, block := range trace.Blocks {
+		out.Blocks[i] = blockTraceJSON{File: block.File, Offset: block.Offset, Size: block.Size}
+	}
+	return json.Marshal(out)
+}
+
+type levelInfoJSON struct {
+	Level int        `json:"level"`
+	Files []FileInfo `json:"files"`
+}
+
+type fileInfoJSON struct {
+	Path       string   `json:"path"`
+	Level      int      `json:"level"`
+	Seq        uint32   `json:"seq"`
+	Size       int64    `json:"size"`
+	MinKey     *jsonKey `json:"min_key"`
+	MaxKey     *jsonKey `json:"max_key"`
+	EntryCount int64    `json:"entry_count"`
+}
+
+// MarshalJSON 按固定的字段名输出一层的文件
+func (info LevelInfo) MarshalJSON() ([]byte, error) {
+	files := info.Files
+	if files == nil {
+		files = []FileInfo{}
+	}
+	return json.Marshal(levelInfoJSON{Level: info.Level, Files: files})
+}
+
+// MarshalJSON 按固定的字段名输出文件信息，最小最大key同时输出十六进制和UTF-8
+func (info FileInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileInfoJSON{
+		Path:       info.Path,
+		Level:      info.Level,
+		Seq:        info.Seq,
+		Size:       info.Size,
+		MinKey:     newJSONKey(info.MinKey),
+		MaxKey:     newJSONKey(info.MaxKey),
+		EntryCount: info.EntryCount,
+	})
+}
@@ -0,0 +1,267 @@
+package inner
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+var updateGolden = flag.Bool("update", false, "重新生成testdata中的golden文件")
+
+// checkGolden 比较got与testdata/name的内容，-update时改为写入
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s changed, got:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// goldenStats 返回各字段都有值的统计
+func goldenStats() Stats {
+	var get, flush latencyHistogram
+	for _, d := range []time.Duration{3 * time.Microsecond, 5 * time.Microsecond, 900 * time.Microsecond} {
+		get.record(d)
+	}
+	flush.record(20 * time.Second)
+	latencies := make([]Histogram, numLatencyOps)
+	latencies[LatencyGet] = get.snapshot()
+	latencies[LatencyFlush] = flush.snapshot()
+	return Stats{
+		Gets:                   100,
+		MemTableProbes:         150,
+		NodesConsidered:        40,
+		NodesSkipped:           12,
+		BloomNegatives:         30,
+		BlocksRead:             10,
+		BlockBytesRead:         40960,
+		BlockCacheHits:         6,
+		BlockCacheMisses:       4,
+		RowCacheHits:           20,
+		RowCacheMisses:         80,
+		WriteBufferBytes:       1024,
+		WriteBufferPeakBytes:   4096,
+		UserBytesWritten:       2048,
+		WALBytesWritten:        2560,
+		FlushBytesWritten:      3000,
+		LiveSSTBytes:           3000,
+		LogicalBytes:           2000,
+		FilterMemoryBytes:      1536,
+		FilterReloads:          3,
+		LevelFilters:           []LevelFilterStats{{Probes: 25, Negatives: 20, MemoryBytes: 1024, Reloads: 2}, {Probes: 15, Negatives: 10, MemoryBytes: 512, Reloads: 1}},
+		L0Files:                2,
+		WriteThrottleDelay:     2 * time.Millisecond,
+		WriteThrottleTime:      time.Second,
+		CompactionDebt:         512,
+		LevelCompactions:       3,
+		LevelCompactionBytes:   6000,
+		LevelTrivialMoves:      2,
+		LevelTrivialMoveBytes:  4000,
+		NextPeriodicCompaction: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		LastPeriodicCompaction: PeriodicCompaction{
+			Time:              time.Date(2024, 5, 1, 11, 0, 0, 500, time.UTC),
+			FilesChecked:      4,
+			FilesCompacted:    1,
+			BytesBefore:       1000,
+			BytesAfter:        600,
+			TombstonesDropped: 7,
+			Err:               errors.New("disk full"),
+		},
+		Recovery: RecoveryStats{WALFiles: 2, WALBytes: 4 << 20, Records: 5000, Duration: 2 * time.Second, Parallelism: 4},
+		FileHeat: []FileHeat{{Path: "sst/0_1.sst", Level: 0, Seq: 1, Heat: 9}},
+		FileFilters: []FileFilterStats{
+			{Path: "sst/0_1.sst", Level: 0, Seq: 1, MemoryBytes: 1024, Reloads: 2},
+			{Path: "sst/1_2.sst", Level: 1, Seq: 2, MemoryBytes: 512, Reloads: 1},
+		},
+		latencies: latencies,
+		rotations: []uint64{RotationWalSize: 5, RotationWriteBuffer: 1, RotationManual: 2},
+	}
+}
+
+func TestStats_JSON(t *testing.T) {
+	stats := goldenStats()
+	var buf bytes.Buffer
+	if err := stats.Dump(&buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "stats.golden.json", buf.Bytes())
+	buf.Reset()
+	if err := stats.Dump(&buf, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "stats.golden.txt", buf.Bytes())
+	if err := stats.Dump(&buf, Format(9)); err == nil {
+		t.Fatal("Dump with unknown format succeeded")
+	}
+
+	// json.Marshal与Dump输出同样的字段
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, readGolden(t, "stats.golden.json")); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, compact.Bytes()) {
+		t.Fatalf("json.Marshal(stats) = %s", data)
+	}
+}
+
+// readGolden 读取testdata中的golden文件
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// jsonFields 返回JSON对象的字段名，嵌套对象的字段名带上父字段名前缀，数组只取第一个元素，
+// latencies下的操作名替换为*，用于比较两个对象的结构
+func jsonFields(prefix string, value any, fields map[string]bool) {
+	switch v := value.(type) {
+	case map[string]any:
+		for name, child := range v {
+			if prefix == ".latencies" {
+				name = "*"
+			}
+			fields[prefix+"."+name] = true
+			jsonFields(prefix+"."+name, child, fields)
+		}
+	case []any:
+		if len(v) > 0 {
+			jsonFields(prefix+"[]", v[0], fields)
+		}
+	}
+}
+
+// TestStats_JSONSchema 运行中的树输出的统计与golden文件的字段一致
+func TestStats_JSONSchema(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AccessSampling = 1
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	if _, err := tree.Get([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	fields := func(data []byte) []string {
+		var value any
+		if err := json.Unmarshal(data, &value); err != nil {
+			t.Fatal(err)
+		}
+		set := make(map[string]bool)
+		jsonFields("", value, set)
+		names := make([]string, 0, len(set))
+		for name := range set {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	data, err := json.Marshal(tree.Stats())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 运行中的树没有定期压缩的时间和错误，对应字段为null，但字段仍然存在
+	got, want := fields(data), fields(readGolden(t, "stats.golden.json"))
+	if !slices.Equal(got, want) {
+		t.Fatalf("live stats fields %v, want %v", got, want)
+	}
+}
+
+func TestGetTrace_JSON(t *testing.T) {
+	trace := &GetTrace{
+		MemTablesChecked: 2,
+		Levels: []LevelTrace{
+			{Level: 0, NodesConsidered: 2, NodesSkipped: 1, BloomNegatives: 1},
+			{Level: 1, NodesConsidered: 1},
+		},
+		Blocks:      []sst.BlockTrace{{File: "sst/1_3.sst", Offset: 4096, Size: 512}},
+		CacheHits:   2,
+		CacheMisses: 1,
+		Source:      "L1",
+		Duration:    1500 * time.Microsecond,
+	}
+	data, err := json.MarshalIndent(trace, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "get_trace.golden.json", append(data, '\n'))
+
+	// 空的查找过程输出[]而不是null
+	data, err = json.Marshal(GetTrace{Source: "memtable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"memtables_checked":0,"levels":[],"blocks":[],"cache_hits":0,"cache_misses":0,"source":"memtable","duration_ns":0}`; string(data) != want {
+		t.Fatalf("empty trace = %s, want %s", data, want)
+	}
+}
+
+func TestLevelInfo_JSON(t *testing.T) {
+	levels := []LevelInfo{
+		{Level: 0, Files: []FileInfo{{
+			Path:       "sst/0_1.sst",
+			Level:      0,
+			Seq:        1,
+			Size:       1024,
+			MinKey:     []byte("apple"),
+			MaxKey:     []byte{0xff, 'z', 0x00}, // 不是合法的UTF-8
+			EntryCount: 10,
+		}}},
+		{Level: 1},
+	}
+	data, err := json.MarshalIndent(levels, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Fatalf("invalid JSON %s", data)
+	}
+	checkGolden(t, "levels.golden.json", append(data, '\n'))
+
+	var decoded []struct {
+		Files []struct {
+			MaxKey struct {
+				Hex  string `json:"hex"`
+				UTF8 string `json:"utf8"`
+			} `json:"max_key"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if key := decoded[0].Files[0].MaxKey; key.Hex != "ff7a00" || key.UTF8 != "\uFFFDz\x00" {
+		t.Fatalf("max key = %+v", key)
+	}
+}
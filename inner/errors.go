@@ -0,0 +1,57 @@
+package inner
+
+import (
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// 对外返回的错误，与myerror中的同名错误是同一个值，调用方无需导入myerror即可用errors.Is判断。
+// 返回的错误可能经过包装，判断时使用errors.Is或errors.As，不要用==比较
+var (
+	// ErrKeyNotFound key不存在或已被删除，判断key是否存在统一使用errors.Is(err, ErrKeyNotFound)
+	ErrKeyNotFound = myerror.ErrKeyNotFound
+	// ErrValueNil key在SST中是删除标记，errors.Is(err, ErrKeyNotFound)同样成立
+	ErrValueNil = myerror.ErrValueNil
+
+	ErrKeyNil           = myerror.ErrKeyNil
+	ErrEmptyKey         = myerror.ErrEmptyKey
+	ErrDBClosed         = myerror.ErrDBClosed
+	ErrTxnConflict      = myerror.ErrTxnConflict
+	ErrTxnDone          = myerror.ErrTxnDone
+	ErrValueTooLarge    = myerror.ErrValueTooLarge
+	ErrDirLocked        = myerror.ErrDirLocked
+	ErrNamespaceDropped = myerror.ErrNamespaceDropped
+	ErrCodec            = myerror.ErrCodec
+	ErrKeyOutOfOrder    = myerror.ErrKeyOutOfOrder
+	ErrWritesPaused     = myerror.ErrWritesPaused
+	ErrSeqNotTracked    = myerror.ErrSeqNotTracked
+	ErrChangeStream     = myerror.ErrChangeStream
+	ErrLevelOverlap     = myerror.ErrLevelOverlap
+	// ErrInvalidConfig 配置无法使用，例如内存表或过滤器构造函数为nil或返回nil
+	ErrInvalidConfig = myerror.ErrInvalidConfig
+	// ErrWalRotation 写入已经完成但切换WAL失败(如磁盘已满)，之后的写入继续使用原来的WAL并重试切换，调用方可以据此退避
+	ErrWalRotation = myerror.ErrWalRotation
+	// ErrWouldBlock ReadMemtableOnly查找没有在内存表中得到结果，key可能存在于SST中，与ErrKeyNotFound不同
+	ErrWouldBlock = myerror.ErrWouldBlock
+	// ErrRangeUnavailable key落在启动时按CorruptFileQuarantine隔离的SST文件的key范围内，且没有更新的数据，
+	// 与ErrKeyNotFound不同：key可能存在于被隔离的文件中
+	ErrRangeUnavailable = myerror.ErrRangeUnavailable
+	// ErrNotRetained GetAsOf或RestoreKey需要的删除前的版本不存在，例如key没有被删除、删除时未开启TombstoneRetention或已超过保留期
+	ErrNotRetained = myerror.ErrNotRetained
+	// ErrReaderClosed SST读取器已关闭且没有进行中的读取，errors.Is(err, os.ErrClosed)同样成立
+	ErrReaderClosed = myerror.ErrReaderClosed
+	// ErrTooManyIterators 进行中的PrefixScan等遍历数已达到Config.MaxOpenIterators，等待其他遍历结束后重试
+	ErrTooManyIterators = myerror.ErrTooManyIterators
+	// ErrReservedKey key位于命名空间等内部保留前缀下，只能通过对应的接口间接读写
+	ErrReservedKey = myerror.ErrReservedKey
+
+	ErrInvalidSSTFormat = myerror.ErrInvalidSSTFormat
+	ErrSSTCorrupted     = myerror.ErrSSTCorrupted
+	ErrWalCorrupted     = myerror.ErrWalCorrupted
+)
+
+// SSTError 读取SST文件失败，用errors.As取得文件路径和偏移量
+type SSTError = sst.SSTError
+
+// EntryChecksumError 条目校验失败，errors.Is(err, ErrSSTCorrupted)成立
+type EntryChecksumError = sst.EntryChecksumError
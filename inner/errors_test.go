@@ -0,0 +1,134 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+)
+
+// TestLsmTree_ErrorMatrix 对外返回的错误都可以用errors.Is或errors.As判断
+func TestLsmTree_ErrorMatrix(t *testing.T) {
+	t.Run("MissingKey", func(t *testing.T) {
+		conf := newTestConfig(t)
+		writeLevelEntries(t, conf, 0, 1, []kv.Entry{
+			{Key: []byte("sst-deleted"), Kind: kv.KindDelete},
+			{Key: []byte("sst-live"), Value: []byte("v")},
+		})
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		if err := tree.Put([]byte("mem-deleted"), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Delete([]byte("mem-deleted")); err != nil {
+			t.Fatal(err)
+		}
+
+		// 不存在的key、内存表中的删除标记和SST中的删除标记都满足errors.Is(err, ErrKeyNotFound)
+		for _, key := range []string{"missing", "mem-deleted", "sst-deleted"} {
+			if _, err := tree.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Get(%s) = %v, want ErrKeyNotFound", key, err)
+			}
+		}
+		if _, err := tree.Get([]byte("sst-deleted")); !errors.Is(err, ErrValueNil) {
+			t.Errorf("Get(sst-deleted) = %v, want ErrValueNil", err)
+		}
+		_, errs := tree.MultiGet([][]byte{[]byte("missing"), []byte("sst-deleted"), []byte("sst-live")})
+		for i, key := range []string{"missing", "sst-deleted"} {
+			if !errors.Is(errs[i], ErrKeyNotFound) {
+				t.Errorf("MultiGet(%s) = %v, want ErrKeyNotFound", key, errs[i])
+			}
+		}
+		if errs[2] != nil {
+			t.Errorf("MultiGet(sst-live) = %v", errs[2])
+		}
+	})
+
+	t.Run("CorruptBlock", func(t *testing.T) {
+		conf := newTestConfig(t)
+		conf.PerEntryChecksum = true
+		conf.BlockCacheSize = 1 << 20 // 数据块按需读取，打开时不会发现损坏
+		writeLevelSST(t, conf, 0, 1, map[string]string{"a": "value-a", "b": "value-b"})
+		path := filepath.Join(conf.DataDir, conf.SSTDir, "0_1.sst")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos := bytes.Index(data, []byte("value-b"))
+		if pos < 0 {
+			t.Fatal("value-b not found in file")
+		}
+		data[pos] ^= 0xff
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		_, err = tree.Get([]byte("b"))
+		var ce *EntryChecksumError
+		if !errors.Is(err, ErrSSTCorrupted) || !errors.As(err, &ce) || ce.File != path {
+			t.Fatalf("Get(b) = %v, want EntryChecksumError in %s", err, path)
+		}
+		if errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("corruption reported as missing key: %v", err)
+		}
+	})
+
+	t.Run("ClosedDB", func(t *testing.T) {
+		tree, err := NewLsmTree(newTestConfig(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tree.Get([]byte("a")); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("Get = %v, want ErrDBClosed", err)
+		}
+		if err := tree.Put([]byte("a"), []byte("v")); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("Put = %v, want ErrDBClosed", err)
+		}
+		if err := tree.PrefixScan(nil, func(key, value []byte) bool { return true }); !errors.Is(err, ErrDBClosed) {
+			t.Errorf("PrefixScan = %v, want ErrDBClosed", err)
+		}
+	})
+
+	// 没有只读模式，后台错误暂停写入后的状态与只读相同：写入失败，读取正常
+	t.Run("WritesPaused", func(t *testing.T) {
+		conf := newTestConfig(t)
+		fault := &diskFull{op: config.IOWrite}
+		conf.Hooks = &config.TestHooks{IOFault: fault.hook}
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		fault.prefix = conf.SSTPath()
+		fault.full.Store(true)
+		rotateInBackground(t, tree, 10)
+		waitBackgroundError(t, tree, true)
+
+		err = tree.Put([]byte("new"), []byte("v"))
+		if !errors.Is(err, ErrWritesPaused) || !errors.Is(err, syscall.ENOSPC) {
+			t.Fatalf("Put = %v, want ErrWritesPaused wrapping ENOSPC", err)
+		}
+		if _, err := tree.Get([]byte("key000")); err != nil {
+			t.Fatalf("Get(key000) = %v", err)
+		}
+		if _, err := tree.Get([]byte("new")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(new) = %v, want ErrKeyNotFound", err)
+		}
+	})
+}
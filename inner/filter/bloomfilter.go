@@ -1,10 +1,7 @@
 package filter
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
-	"io"
 	"math"
 
 	"github.com/aixiasang/lsm/inner/myerror"
@@ -78,31 +75,18 @@ func NewBloomFilterWithParams(expectedElements uint64, falsePositiveRate float64
 	return NewBloomFilter(m, k)
 }
 
-// getHash 为一个key计算多个哈希值
-func (bf *BloomFilter) getHash(key []byte) []uint64 {
-	hashes := make([]uint64, bf.k)
-
-	for i := uint(0); i < bf.k; i++ {
-		// 使用固定的种子确保哈希函数的一致性
-		h := murmur3.New64WithSeed(bf.seeds[i])
-		h.Write(key)
-		hashes[i] = h.Sum64() % bf.m
-	}
-
-	return hashes
+// hash 返回key的第i个哈希值
+func (bf *BloomFilter) hash(key []byte, i uint) uint64 {
+	// 使用固定的种子确保哈希函数的一致性
+	return murmur3.Sum64WithSeed(key, bf.seeds[i]) % bf.m
 }
 
-// Add 将一个key添加到布隆过滤器中
+// Add 将一个key添加到布隆过滤器中，逐个计算哈希值，不分配内存
 func (bf *BloomFilter) Add(key []byte) {
-	hashes := bf.getHash(key)
-
-	for _, hash := range hashes {
+	for i := uint(0); i < bf.k; i++ {
 		// 计算位置：哪一组uint64和组内的哪一位
-		wordIndex := hash / 64
-		bitIndex := hash % 64
-
-		// 将对应位设置为1
-		bf.bits[wordIndex] |= 1 << bitIndex
+		hash := bf.hash(key, i)
+		bf.bits[hash/64] |= 1 << (hash % 64)
 	}
 
 	bf.n++
@@ -110,16 +94,11 @@ func (bf *BloomFilter) Add(key []byte) {
 
 // Contains 检查一个key是否可能存在于布隆过滤器中
 func (bf *BloomFilter) Contains(key []byte) bool {
-	hashes := bf.getHash(key)
-
-	for _, hash := range hashes {
-		// 计算位置：哪一组uint64和组内的哪一位
-		wordIndex := hash / 64
-		bitIndex := hash % 64
-
-		// 检查对应位是否为1
-		if (bf.bits[wordIndex] & (1 << bitIndex)) == 0 {
-			return false // 只要有一位不为1，就肯定不在集合中
+	for i := uint(0); i < bf.k; i++ {
+		// 只要有一位不为1，就肯定不在集合中
+		hash := bf.hash(key, i)
+		if bf.bits[hash/64]&(1<<(hash%64)) == 0 {
+			return false
 		}
 	}
 
@@ -146,29 +125,34 @@ func (bf *BloomFilter) Reset() {
 	bf.n = 0
 }
 
-// Save 将布隆过滤器序列化为字节数组
+// SizeBytes 返回位数组和种子占用的内存
+func (bf *BloomFilter) SizeBytes() int {
+	return len(bf.bits)*8 + len(bf.seeds)*4
+}
+
+// Save 将布隆过滤器序列化为字节数组，一次分配所需的全部空间
 func (bf *BloomFilter) Save() []byte {
 	// 计算需要的字节数
 	// 元数据 (m, k, n) 各8字节，加上种子(k*4字节)，加上比特位(bits长度*8字节)
 	bufSize := 24 + len(bf.seeds)*4 + len(bf.bits)*8
-	buffer := bytes.NewBuffer(make([]byte, 0, bufSize))
+	buf := make([]byte, 0, bufSize)
 
 	// 写入元数据 (m, k, n)
-	binary.Write(buffer, binary.BigEndian, bf.m)
-	binary.Write(buffer, binary.BigEndian, uint64(bf.k))
-	binary.Write(buffer, binary.BigEndian, bf.n)
+	buf = binary.BigEndian.AppendUint64(buf, bf.m)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(bf.k))
+	buf = binary.BigEndian.AppendUint64(buf, bf.n)
 
 	// 写入种子
 	for _, seed := range bf.seeds {
-		binary.Write(buffer, binary.BigEndian, seed)
+		buf = binary.BigEndian.AppendUint32(buf, seed)
 	}
 
 	// 写入bits数组数据
 	for _, bits := range bf.bits {
-		binary.Write(buffer, binary.BigEndian, bits)
+		buf = binary.BigEndian.AppendUint64(buf, bits)
 	}
 
-	return buffer.Bytes()
+	return buf
 }
 
 // Load 从字节数组加载布隆过滤器
@@ -177,43 +161,35 @@ func (bf *BloomFilter) Load(data []byte) error {
 		return myerror.ErrInvalidBloomFilter
 	}
 
-	reader := bytes.NewReader(data)
-
 	// 读取元数据 (m, k, n)
-	if err := binary.Read(reader, binary.BigEndian, &bf.m); err != nil {
-		return err
+	bf.m = binary.BigEndian.Uint64(data[0:8])
+	k := binary.BigEndian.Uint64(data[8:16])
+	bf.n = binary.BigEndian.Uint64(data[16:24])
+	data = data[24:]
+	// 种子和位数组的大小来自数据本身，分配前先校验剩余数据足够，避免损坏的数据导致超大的内存分配
+	if bf.m == 0 || k == 0 || k > uint64(len(data))/4 {
+		return myerror.ErrInvalidBloomFilter
 	}
-
-	var k uint64
-	if err := binary.Read(reader, binary.BigEndian, &k); err != nil {
-		return err
+	bitsLen := bf.m / 64
+	if bf.m%64 != 0 {
+		bitsLen++
 	}
-	bf.k = uint(k)
-
-	if err := binary.Read(reader, binary.BigEndian, &bf.n); err != nil {
-		return err
+	if bitsLen > (uint64(len(data))-k*4)/8 {
+		return myerror.ErrBloomFilterIncomplete
 	}
+	bf.k = uint(k)
 
 	// 读取种子
 	bf.seeds = make([]uint32, bf.k)
-	for i := uint(0); i < bf.k; i++ {
-		if err := binary.Read(reader, binary.BigEndian, &bf.seeds[i]); err != nil {
-			return err
-		}
+	for i := range bf.seeds {
+		bf.seeds[i] = binary.BigEndian.Uint32(data[i*4:])
 	}
-
-	// 计算bits数组的大小并分配内存
-	bitsLen := (bf.m + 63) / 64
-	bf.bits = make([]uint64, bitsLen)
+	data = data[k*4:]
 
 	// 读取bits数据
-	for i := uint64(0); i < bitsLen; i++ {
-		if err := binary.Read(reader, binary.BigEndian, &bf.bits[i]); err != nil {
-			if errors.Is(err, io.EOF) && i > 0 {
-				return myerror.ErrBloomFilterIncomplete
-			}
-			return err
-		}
+	bf.bits = make([]uint64, bitsLen)
+	for i := range bf.bits {
+		bf.bits[i] = binary.BigEndian.Uint64(data[i*8:])
 	}
 
 	return nil
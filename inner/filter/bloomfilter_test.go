@@ -99,6 +99,11 @@ func TestBloomFilterSaveLoad(t *testing.T) {
 		}
 	}
 
+	// The loaded filter occupies the same memory as the original
+	if got, want := loadedBF.SizeBytes(), bf.SizeBytes(); got != want || got != 16*8+3*4 {
+		t.Errorf("loaded SizeBytes = %d, original %d, want %d", got, want, 16*8+3*4)
+	}
+
 	// The test key shouldn't be in the loaded filter because it was added after serialization
 	if loadedBF.Contains(testKey) {
 		t.Errorf("Loaded filter should not contain test key that was added after serialization")
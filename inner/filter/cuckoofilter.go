@@ -0,0 +1,230 @@
+package filter
+
+import (
+	"encoding/binary"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/spaolacci/murmur3"
+)
+
+const (
+	cuckooBucketSize   = 4   // 每个桶的指纹数
+	cuckooMaxKicks     = 500 // 插入时最多踢出的次数
+	cuckooVersion      = 1   // 编码版本
+	cuckooHeaderSize   = 10  // version(1) flags(1) bucketCount(4) count(4)
+	cuckooFlagOverflow = 1   // 插入失败后不再可靠，Contains总是返回true
+)
+
+// CuckooFilter 布谷鸟过滤器，每个桶保存4个16位指纹，支持删除。
+// 构建时记录已添加key的哈希，桶满时容量翻倍并重新插入；从数据加载的过滤器没有这些哈希，
+// 插入失败时标记为溢出，之后Contains总是返回true
+type CuckooFilter struct {
+	buckets  [][cuckooBucketSize]uint16 // 桶，指纹0表示空位，桶数为2的幂
+	count    uint32                     // 已保存的指纹数
+	overflow bool                       // 是否有指纹因插入失败而丢失
+	loaded   bool                       // 是否由Load得到，此时hashes为空，无法扩容
+	hashes   []uint64                   // 构建时已添加key的哈希，用于扩容
+	initial  int                        // 创建时的桶数，Reset后恢复
+}
+
+// NewCuckooFilter 创建布谷鸟过滤器，m为初始大小(位)，每个桶占64位，k未使用
+func NewCuckooFilter(m uint64, k uint) Filter {
+	n := uint64(1)
+	for n*cuckooBucketSize*16 < m {
+		n <<= 1
+	}
+	return &CuckooFilter{buckets: make([][cuckooBucketSize]uint16, n), initial: int(n)}
+}
+
+// cuckooHash 计算key的指纹和第一个桶，指纹不为0
+func (c *CuckooFilter) cuckooHash(h uint64) (uint16, uint32) {
+	fp := uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, uint32(h) & c.mask()
+}
+
+func (c *CuckooFilter) mask() uint32 {
+	return uint32(len(c.buckets) - 1)
+}
+
+// altIndex 返回指纹的另一个桶，altIndex(altIndex(i, fp), fp) == i
+func (c *CuckooFilter) altIndex(i uint32, fp uint16) uint32 {
+	return (i ^ (uint32(fp) * 0x5bd1e995)) & c.mask()
+}
+
+// Add 添加key
+func (c *CuckooFilter) Add(key []byte) {
+	h := murmur3.Sum64(key)
+	if !c.loaded {
+		c.hashes = append(c.hashes, h)
+	}
+	c.count++
+	if c.insert(h) {
+		return
+	}
+	if c.loaded {
+		c.overflow = true
+		return
+	}
+	c.grow()
+}
+
+// insert 插入哈希为h的指纹，失败时有一个指纹被踢出后丢失
+func (c *CuckooFilter) insert(h uint64) bool {
+	fp, i := c.cuckooHash(h)
+	if c.place(i, fp) || c.place(c.altIndex(i, fp), fp) {
+		return true
+	}
+	for n := 0; n < cuckooMaxKicks; n++ {
+		slot := n % cuckooBucketSize
+		fp, c.buckets[i][slot] = c.buckets[i][slot], fp
+		i = c.altIndex(i, fp)
+		if c.place(i, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// place 将指纹放入桶i的空位
+func (c *CuckooFilter) place(i uint32, fp uint16) bool {
+	for slot, v := range c.buckets[i] {
+		if v == 0 {
+			c.buckets[i][slot] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// grow 将桶数翻倍后重新插入所有哈希，直到全部插入成功
+func (c *CuckooFilter) grow() {
+	for n := len(c.buckets) * 2; ; n *= 2 {
+		c.buckets = make([][cuckooBucketSize]uint16, n)
+		ok := true
+		for _, h := range c.hashes {
+			if !c.insert(h) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+// Contains 判断key是否可能存在
+func (c *CuckooFilter) Contains(key []byte) bool {
+	if c.overflow {
+		return true
+	}
+	fp, i := c.cuckooHash(murmur3.Sum64(key))
+	return c.find(i, fp) >= 0 || c.find(c.altIndex(i, fp), fp) >= 0
+}
+
+// find 返回指纹在桶i中的位置，不存在时返回-1
+func (c *CuckooFilter) find(i uint32, fp uint16) int {
+	for slot, v := range c.buckets[i] {
+		if v == fp {
+			return slot
+		}
+	}
+	return -1
+}
+
+// Delete 删除一个之前添加过的key，返回是否找到。删除未添加过的key可能误删指纹相同的其他key
+func (c *CuckooFilter) Delete(key []byte) bool {
+	h := murmur3.Sum64(key)
+	fp, i := c.cuckooHash(h)
+	slot := c.find(i, fp)
+	if slot < 0 {
+		i = c.altIndex(i, fp)
+		if slot = c.find(i, fp); slot < 0 {
+			return false
+		}
+	}
+	c.buckets[i][slot] = 0
+	c.count--
+	for j, v := range c.hashes {
+		if v == h {
+			c.hashes = append(c.hashes[:j], c.hashes[j+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// Count 返回已添加的key数
+func (c *CuckooFilter) Count() uint32 {
+	return c.count
+}
+
+// Reset 清空过滤器并恢复创建时的桶数
+func (c *CuckooFilter) Reset() {
+	if c.initial == 0 {
+		c.initial = 1
+	}
+	if len(c.buckets) != c.initial {
+		c.buckets = make([][cuckooBucketSize]uint16, c.initial)
+	} else {
+		clear(c.buckets)
+	}
+	c.count = 0
+	c.overflow = false
+	c.loaded = false
+	c.hashes = c.hashes[:0]
+}
+
+// SizeBytes 返回桶和构建时记录的哈希占用的内存
+func (c *CuckooFilter) SizeBytes() int {
+	return len(c.buckets)*cuckooBucketSize*2 + cap(c.hashes)*8
+}
+
+// Save 序列化为 version(1) flags(1) bucketCount(4) count(4) 以及按桶顺序排列的指纹(各2字节)
+func (c *CuckooFilter) Save() []byte {
+	buf := make([]byte, cuckooHeaderSize+len(c.buckets)*cuckooBucketSize*2)
+	buf[0] = cuckooVersion
+	if c.overflow {
+		buf[1] = cuckooFlagOverflow
+	}
+	binary.BigEndian.PutUint32(buf[2:], uint32(len(c.buckets)))
+	binary.BigEndian.PutUint32(buf[6:], c.count)
+	pos := cuckooHeaderSize
+	for _, bucket := range c.buckets {
+		for _, fp := range bucket {
+			binary.BigEndian.PutUint16(buf[pos:], fp)
+			pos += 2
+		}
+	}
+	return buf
+}
+
+// Load 从Save的结果加载，桶数以数据中记录的为准
+func (c *CuckooFilter) Load(data []byte) error {
+	if len(data) < cuckooHeaderSize || data[0] != cuckooVersion || data[1]&^cuckooFlagOverflow != 0 {
+		return myerror.ErrInvalidCuckooFilter
+	}
+	n := uint64(binary.BigEndian.Uint32(data[2:]))
+	count := binary.BigEndian.Uint32(data[6:])
+	if n == 0 || n&(n-1) != 0 || uint64(len(data)-cuckooHeaderSize) != n*cuckooBucketSize*2 ||
+		uint64(count) > n*cuckooBucketSize && data[1]&cuckooFlagOverflow == 0 {
+		return myerror.ErrInvalidCuckooFilter
+	}
+	buckets := make([][cuckooBucketSize]uint16, n)
+	pos := cuckooHeaderSize
+	for i := range buckets {
+		for slot := range buckets[i] {
+			buckets[i][slot] = binary.BigEndian.Uint16(data[pos:])
+			pos += 2
+		}
+	}
+	c.buckets = buckets
+	c.count = count
+	c.overflow = data[1]&cuckooFlagOverflow != 0
+	c.loaded = true
+	c.hashes = nil
+	return nil
+}
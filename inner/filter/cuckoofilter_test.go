@@ -0,0 +1,134 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestCuckooFilterInterface(t *testing.T) {
+	var _ Filter = (*CuckooFilter)(nil)
+}
+
+func TestCuckooFilterGrow(t *testing.T) {
+	cf := NewCuckooFilter(1024, 3).(*CuckooFilter)
+	initial := len(cf.buckets)
+	for i := 0; i < 10000; i++ {
+		cf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	if len(cf.buckets) <= initial || cf.Count() != 10000 {
+		t.Fatalf("buckets %d (initial %d), count %d", len(cf.buckets), initial, cf.Count())
+	}
+	for i := 0; i < 10000; i++ {
+		if key := []byte(fmt.Sprintf("key-%d", i)); !cf.Contains(key) {
+			t.Fatalf("false negative for %s", key)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if cf.Contains([]byte(fmt.Sprintf("absent-%d", i))) {
+			falsePositives++
+		}
+	}
+	// 16位指纹、每个key检查8个位置，误判率约为8/65536
+	if falsePositives > 50 {
+		t.Fatalf("%d false positives out of 10000", falsePositives)
+	}
+
+	cf.Reset()
+	if len(cf.buckets) != initial || cf.Count() != 0 || cf.Contains([]byte("key-1")) {
+		t.Fatal("Reset did not restore an empty filter of the initial size")
+	}
+}
+
+func TestCuckooFilterDelete(t *testing.T) {
+	cf := NewCuckooFilter(0, 0).(*CuckooFilter)
+	for i := 0; i < 100; i++ {
+		cf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	for i := 0; i < 100; i += 2 {
+		if !cf.Delete([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("Delete(key-%d) found nothing", i)
+		}
+	}
+	if cf.Count() != 50 {
+		t.Fatalf("count %d after deleting half, want 50", cf.Count())
+	}
+	for i := 1; i < 100; i += 2 {
+		if !cf.Contains([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("Delete removed key-%d", i)
+		}
+	}
+
+	// 重复添加的key需要删除相同次数
+	cf.Add([]byte("dup"))
+	cf.Add([]byte("dup"))
+	cf.Delete([]byte("dup"))
+	if !cf.Contains([]byte("dup")) {
+		t.Fatal("one Delete removed both copies")
+	}
+
+	// 删除后扩容不会恢复已删除的key
+	for i := 0; i < 2000; i++ {
+		cf.Add([]byte(fmt.Sprintf("more-%d", i)))
+	}
+	if cf.Contains([]byte("key-0")) && cf.Contains([]byte("key-2")) && cf.Contains([]byte("key-4")) {
+		t.Fatal("deleted keys came back after growing")
+	}
+}
+
+func TestCuckooFilterSaveLoad(t *testing.T) {
+	cf := NewCuckooFilter(1024, 3)
+	for i := 0; i < 500; i++ {
+		cf.Add([]byte(fmt.Sprintf("key-%d", i)))
+	}
+	data := cf.Save()
+
+	// 桶数记录在数据中，与构造参数无关
+	loaded := NewCuckooFilter(0, 0).(*CuckooFilter)
+	if err := loaded.Load(data); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Count() != 500 || string(loaded.Save()) != string(data) {
+		t.Fatal("Load did not restore the saved filter")
+	}
+	// 加载的过滤器只有桶，没有构建时记录的哈希
+	if got, want := loaded.SizeBytes(), len(data)-cuckooHeaderSize; got != want || cf.SizeBytes() <= got {
+		t.Fatalf("SizeBytes = %d (built %d), want %d", got, cf.SizeBytes(), want)
+	}
+	for i := 0; i < 500; i++ {
+		if !loaded.Contains([]byte(fmt.Sprintf("key-%d", i))) {
+			t.Fatalf("false negative for key-%d after Load", i)
+		}
+	}
+	if !loaded.Delete([]byte("key-0")) || loaded.Count() != 499 {
+		t.Fatal("Delete on a loaded filter failed")
+	}
+
+	// 加载的过滤器无法扩容，插入失败后总是返回可能存在
+	for i := 0; !loaded.overflow; i++ {
+		loaded.Add([]byte(fmt.Sprintf("extra-%d", i)))
+	}
+	if !loaded.Contains([]byte("never-added")) {
+		t.Fatal("overflowed filter reported a key as absent")
+	}
+	again := NewCuckooFilter(0, 0)
+	if err := again.Load(loaded.Save()); err != nil || !again.Contains([]byte("never-added")) {
+		t.Fatalf("overflow flag lost across Save/Load: %v", err)
+	}
+
+	for _, bad := range [][]byte{
+		nil,
+		data[:cuckooHeaderSize-1],
+		data[:len(data)-1],
+		append([]byte{2}, data[1:]...),
+		append([]byte{cuckooVersion, 0x80}, data[2:]...),
+		append([]byte{cuckooVersion, 0, 0, 0, 0, 3}, data[6:]...),
+	} {
+		if err := NewCuckooFilter(0, 0).Load(bad); !errors.Is(err, myerror.ErrInvalidCuckooFilter) {
+			t.Fatalf("Load(%d bytes) = %v, want ErrInvalidCuckooFilter", len(bad), err)
+		}
+	}
+}
@@ -7,4 +7,5 @@ type Filter interface {
 	Save() []byte             // 保存到文件
 	Load(data []byte) error   // 从文件加载
 	Reset()                   // 重置
+	SizeBytes() int           // 常驻内存的大小(字节)，用于过滤器内存预算
 }
@@ -0,0 +1,61 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 内置过滤器名称，写入SST元数据，读取时据此构造过滤器
+const (
+	NameBloom  = "bloom"  // 布隆过滤器
+	NameCuckoo = "cuckoo" // 布谷鸟过滤器
+	NameNone   = "none"   // 不使用过滤器，未注册的名称按该值处理
+)
+
+// FilterConstructor 过滤器构造函数，m和k为大小提示，Load时以数据中记录的参数为准
+type FilterConstructor func(m uint64, k uint) Filter
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]FilterConstructor{}
+)
+
+func init() {
+	Register(NameBloom, NewBloomFilter)
+	Register(NameCuckoo, NewCuckooFilter)
+}
+
+// Register 注册名为name的过滤器。名称会写入SST文件，注册后不应修改其编码格式；
+// name为空、为NameNone、ctor为nil或重复注册时panic
+func Register(name string, ctor FilterConstructor) {
+	if name == "" || name == NameNone || ctor == nil {
+		panic(fmt.Sprintf("filter: invalid registration %q", name))
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("filter: %q registered twice", name))
+	}
+	registry[name] = ctor
+}
+
+// Lookup 返回名为name的过滤器构造函数
+func Lookup(name string) (FilterConstructor, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	ctor, ok := registry[name]
+	return ctor, ok
+}
+
+// Names 按名称排序返回已注册的过滤器
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{NameBloom, NameCuckoo} {
+		ctor, ok := Lookup(name)
+		if !ok {
+			t.Fatalf("%s is not registered", name)
+		}
+		f := ctor(1024, 3)
+		f.Add([]byte("k"))
+		g := ctor(0, 0)
+		if err := g.Load(f.Save()); err != nil || !g.Contains([]byte("k")) {
+			t.Fatalf("%s: Save/Load round trip failed: %v", name, err)
+		}
+	}
+	if _, ok := Lookup(NameNone); ok {
+		t.Fatal("none should not be registered")
+	}
+
+	Register("test-registry", NewBloomFilter)
+	if !slices.Contains(Names(), "test-registry") || !slices.IsSorted(Names()) {
+		t.Fatalf("Names = %v", Names())
+	}
+	for _, tt := range []struct {
+		name string
+		ctor FilterConstructor
+	}{
+		{"test-registry", NewBloomFilter},
+		{"", NewBloomFilter},
+		{NameNone, NewBloomFilter},
+		{"test-nil", nil},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Register(%q) did not panic", tt.name)
+				}
+			}()
+			Register(tt.name, tt.ctor)
+		}()
+	}
+}
@@ -0,0 +1,95 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// 过滤器内存超出FilterMemoryBudget时卸载最久未被点查的文件的过滤器，Stats中的过滤器内存不超过预算，
+// 被卸载的过滤器在点查时重新加载，读取结果保持正确
+func TestLsmTree_FilterMemoryBudget(t *testing.T) {
+	const files, keysPerFile = 30, 100
+	conf := newTestConfig(t)
+	conf.BlockSizeBytes = 256
+	for seq := uint32(0); seq < files; seq++ {
+		kvs := make(map[string]string)
+		for i := 0; i < keysPerFile; i++ {
+			kvs[fmt.Sprintf("key-%02d-%03d", seq, i)] = fmt.Sprintf("value-%02d-%03d", seq, i)
+		}
+		writeLevelSST(t, conf, 1, seq, kvs)
+	}
+
+	// 不限制时所有文件的过滤器在第一次读取后都常驻内存
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := 0; seq < files; seq++ {
+		if _, err := tree.Get([]byte(fmt.Sprintf("key-%02d-000", seq))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := tree.Stats()
+	if len(stats.FileFilters) != files {
+		t.Fatalf("FileFilters has %d files, want %d", len(stats.FileFilters), files)
+	}
+	var largest, total int64
+	for _, file := range stats.FileFilters {
+		if file.MemoryBytes <= 0 {
+			t.Fatalf("file %s filter memory = %d, want > 0", file.Path, file.MemoryBytes)
+		}
+		largest = max(largest, file.MemoryBytes)
+		total += file.MemoryBytes
+	}
+	if stats.FilterMemoryBytes != total || stats.LevelFilters[1].MemoryBytes != total {
+		t.Fatalf("FilterMemoryBytes = %d, level 1 = %d, want %d", stats.FilterMemoryBytes, stats.LevelFilters[1].MemoryBytes, total)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.FilterMemoryBudget = 3 * largest
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	checkBudget := func() Stats {
+		t.Helper()
+		stats := tree.Stats()
+		var resident int64
+		for _, file := range stats.FileFilters {
+			resident += file.MemoryBytes
+		}
+		if stats.FilterMemoryBytes != resident || resident > conf.FilterMemoryBudget {
+			t.Fatalf("FilterMemoryBytes = %d, per-file sum %d, budget %d", stats.FilterMemoryBytes, resident, conf.FilterMemoryBudget)
+		}
+		return stats
+	}
+	checkBudget()
+
+	for round := 0; round < 2; round++ {
+		for seq := 0; seq < files; seq++ {
+			for _, i := range []int{0, keysPerFile / 2, keysPerFile - 1} {
+				key := fmt.Sprintf("key-%02d-%03d", seq, i)
+				value, err := tree.Get([]byte(key))
+				if want := fmt.Sprintf("value-%02d-%03d", seq, i); err != nil || string(value) != want {
+					t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+				}
+			}
+			if _, err := tree.Get([]byte(fmt.Sprintf("key-%02d-%03dx", seq, 10))); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get missing key in file %d: %v, want ErrKeyNotFound", seq, err)
+			}
+			checkBudget()
+		}
+	}
+	stats = checkBudget()
+	if stats.FilterReloads < files || stats.LevelFilters[1].Reloads != stats.FilterReloads {
+		t.Fatalf("FilterReloads = %d, level 1 = %d, want at least %d", stats.FilterReloads, stats.LevelFilters[1].Reloads, files)
+	}
+	// 过滤器仍然生效，判定不存在的key省去数据块读取
+	if stats.BloomNegatives == 0 {
+		t.Fatal("no filter negatives with a filter memory budget")
+	}
+}
@@ -0,0 +1,125 @@
+package fsio
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mode 写入句柄的类型，由调用方按写入方式明确选择
+type Mode int8
+
+const (
+	// AppendOnly 所有写入都追加到文件末尾(O_APPEND)，不能使用WriteAt，用于WAL和清单等只追加记录的文件
+	AppendOnly Mode = iota
+	// Positional 写入位置由调用方控制：Write从当前偏移量继续，或使用WriteAt，用于需要自行记录偏移量的SST文件
+	Positional
+)
+
+// flags 返回mode对应的打开标志，两种句柄都可读，WAL恢复时从同一个句柄读取已有的记录
+func (m Mode) flags() int {
+	if m == AppendOnly {
+		return os.O_RDWR | os.O_APPEND
+	}
+	return os.O_RDWR
+}
+
+// Create 创建path用于写入，文件已存在时清空
+func Create(path string, mode Mode) (*os.File, error) {
+	return os.OpenFile(path, mode.flags()|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+// CreateExclusive 创建新文件path用于写入，文件已存在时返回的错误满足errors.Is(err, fs.ErrExist)
+func CreateExclusive(path string, mode Mode) (*os.File, error) {
+	return os.OpenFile(path, mode.flags()|os.O_CREATE|os.O_EXCL, 0644)
+}
+
+// Open 打开已存在的path用于写入，不存在时返回的错误满足errors.Is(err, fs.ErrNotExist)
+func Open(path string, mode Mode) (*os.File, error) {
+	return os.OpenFile(path, mode.flags(), 0644)
+}
+
+// OpenOrCreate 打开path用于写入，不存在时创建，已有的内容保持不变
+func OpenOrCreate(path string, mode Mode) (*os.File, error) {
+	return os.OpenFile(path, mode.flags()|os.O_CREATE, 0644)
+}
+
+// AtomicRename 将oldpath重命名为newpath，newpath已存在时原子地替换它，之后打开newpath要么得到旧文件要么得到新文件。
+// Windows上使用MoveFileEx替换已存在的文件，目标文件被短暂占用时重试
+func AtomicRename(oldpath, newpath string) error {
+	return retryBusy(func() error { return rename(oldpath, newpath) })
+}
+
+// 删除被占用的文件时的重试间隔，依次加倍
+var (
+	deleteRetryBackoff  = 10 * time.Millisecond
+	deleteRetryAttempts = 5
+)
+
+// removeFile 删除文件，测试中替换以模拟文件被占用
+var removeFile = os.Remove
+
+// sleep 等待重试间隔，测试中替换以记录间隔而不实际等待
+var sleep = time.Sleep
+
+// pending 因文件仍被占用而推迟删除的路径
+var pending struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+// DeleteRetry 删除path。Windows上文件仍被其他句柄打开时删除会失败，此时按退避间隔重试几次，
+// 仍被占用时记入待删除列表并返回nil，之后每次调用DeleteRetry时再次尝试删除列表中的文件；
+// unix上打开的文件可以直接删除，不会推迟。path不存在时与os.Remove一样返回满足errors.Is(err, fs.ErrNotExist)的错误
+func DeleteRetry(path string) error {
+	retryPending()
+	err := retryBusy(func() error { return removeFile(path) })
+	if err != nil && busy(err) {
+		pending.mu.Lock()
+		if pending.paths == nil {
+			pending.paths = make(map[string]struct{})
+		}
+		pending.paths[path] = struct{}{}
+		pending.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+// PendingDeletes 返回因文件仍被占用而推迟删除的路径，按路径排序
+func PendingDeletes() []string {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	paths := make([]string, 0, len(pending.paths))
+	for path := range pending.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// retryPending 再次尝试删除推迟的文件，已删除或已不存在的文件移出列表，不等待仍被占用的文件
+func retryPending() {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+	for path := range pending.paths {
+		if err := removeFile(path); err == nil || errors.Is(err, fs.ErrNotExist) || !busy(err) {
+			delete(pending.paths, path)
+		}
+	}
+}
+
+// retryBusy 执行op，文件被占用时按退避间隔重试，返回最后一次的错误
+func retryBusy(op func() error) error {
+	backoff := deleteRetryBackoff
+	err := op()
+	for attempt := 1; attempt < deleteRetryAttempts && err != nil && busy(err); attempt++ {
+		sleep(backoff)
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
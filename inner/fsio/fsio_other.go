@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package fsio
+
+import "os"
+
+// rename 使用os.Rename，平台不支持原子替换时由其返回错误
+func rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// busy 其他平台不区分文件被占用的错误，不重试
+func busy(err error) bool {
+	return false
+}
@@ -0,0 +1,246 @@
+//go:build unix
+
+package fsio
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreateExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal-1.log")
+	fp, err := CreateExclusive(path, AppendOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if _, err := CreateExclusive(path, AppendOnly); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("CreateExclusive on existing file: got %v, want fs.ErrExist", err)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing"), AppendOnly); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Open missing file: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+// 追加句柄的写入总在末尾且不能WriteAt；可定位句柄从清空后的开头写入，可以WriteAt
+func TestModes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "append")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := Open(path, AppendOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("x"), 0); err == nil {
+		t.Fatal("WriteAt on append-only handle succeeded")
+	}
+	fp.Close()
+	if got := readFile(t, path); got != "oldnew" {
+		t.Fatalf("append-only content = %q, want %q", got, "oldnew")
+	}
+
+	fp, err = Create(path, Positional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte("X"), 1); err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if got := readFile(t, path); got != "aXc" {
+		t.Fatalf("positional content = %q, want %q", got, "aXc")
+	}
+
+	fp, err = OpenOrCreate(path, Positional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+	if got := readFile(t, path); got != "aXc" {
+		t.Fatalf("OpenOrCreate changed content to %q", got)
+	}
+}
+
+func TestAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	tmp, path := filepath.Join(dir, "CURRENT.tmp"), filepath.Join(dir, "CURRENT")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmp, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AtomicRename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "new" {
+		t.Fatalf("content after rename = %q, want %q", got, "new")
+	}
+	if _, err := os.Stat(tmp); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("source still exists after rename: %v", err)
+	}
+}
+
+// fakeRemove 将removeFile替换为fn，重试不实际等待，返回依次等待的间隔。测试结束后恢复并清空待删除列表
+func fakeRemove(t *testing.T, fn func(path string) error) *[]time.Duration {
+	var waits []time.Duration
+	removeFile = fn
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	t.Cleanup(func() {
+		removeFile = os.Remove
+		sleep = time.Sleep
+		pending.mu.Lock()
+		pending.paths = nil
+		pending.mu.Unlock()
+	})
+	return &waits
+}
+
+func TestDeleteRetry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "000001.sst")
+	fp, err := Create(path, Positional)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	// unix上仍打开的文件直接删除
+	if err := DeleteRetry(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("file still exists after DeleteRetry: %v", err)
+	}
+	if err := DeleteRetry(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("DeleteRetry of missing file: got %v, want fs.ErrNotExist", err)
+	}
+
+	// 被占用时重试，之后删除成功
+	var calls int
+	waits := fakeRemove(t, func(path string) error {
+		calls++
+		if calls < 3 {
+			return &fs.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+		}
+		return nil
+	})
+	if err := DeleteRetry("busy-briefly"); err != nil || calls != 3 {
+		t.Fatalf("DeleteRetry = %v after %d attempts, want success after 3", err, calls)
+	}
+	if want := []time.Duration{deleteRetryBackoff, 2 * deleteRetryBackoff}; !slices.Equal(*waits, want) {
+		t.Fatalf("waited %v between attempts, want %v", *waits, want)
+	}
+
+	// 一直被占用时推迟删除，之后的DeleteRetry再次尝试
+	busyPaths := map[string]bool{"held": true}
+	waits = fakeRemove(t, func(path string) error {
+		if busyPaths[path] {
+			return &fs.PathError{Op: "remove", Path: path, Err: syscall.EBUSY}
+		}
+		return nil
+	})
+	if err := DeleteRetry("held"); err != nil {
+		t.Fatalf("DeleteRetry of held file: %v, want nil", err)
+	}
+	if got := PendingDeletes(); len(got) != 1 || got[0] != "held" {
+		t.Fatalf("PendingDeletes = %v, want [held]", got)
+	}
+	// 每次重试前的间隔依次加倍，共重试deleteRetryAttempts-1次
+	if len(*waits) != deleteRetryAttempts-1 || (*waits)[len(*waits)-1] != deleteRetryBackoff<<(deleteRetryAttempts-2) {
+		t.Fatalf("waited %v for a held file, want %d doubling backoffs from %v", *waits, deleteRetryAttempts-1, deleteRetryBackoff)
+	}
+	busyPaths["held"] = false
+	if err := DeleteRetry("other"); err != nil {
+		t.Fatal(err)
+	}
+	if got := PendingDeletes(); len(got) != 0 {
+		t.Fatalf("PendingDeletes after handle closed = %v, want none", got)
+	}
+}
+
+// wal、sst和inner等包中打开写入、重命名和删除文件都通过fsio
+func TestNoDirectFileCalls(t *testing.T) {
+	banned := map[string]bool{"OpenFile": true, "Rename": true, "Remove": true}
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == "fsio" || d.Name() == "testdata" || d.Name() == "data") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+			return nil
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "os" && banned[sel.Sel.Name] {
+				t.Errorf("%s: direct call to os.%s, use fsio", fset.Position(sel.Pos()), sel.Sel.Name)
+			}
+			return true
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Windows的实现无法在这里运行，至少保证它和依赖它的包能够通过编译和vet
+func TestWindowsBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("cross-compiling for windows")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go command not found")
+	}
+	cmd := exec.Command(gobin, "vet", "./...")
+	cmd.Dir = ".."
+	cmd.Env = append(os.Environ(), "GOOS=windows", "GOARCH=amd64", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("GOOS=windows go vet: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package fsio
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// rename POSIX的rename原子地替换已存在的目标
+func rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// busy 判断错误是否由文件被占用引起。unix上打开的文件可以删除和替换，只有挂载点等返回EBUSY
+func busy(err error) bool {
+	return errors.Is(err, syscall.EBUSY)
+}
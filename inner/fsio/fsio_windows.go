@@ -0,0 +1,44 @@
+//go:build windows
+
+package fsio
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	moveFileReplaceExisting = 0x1 // MOVEFILE_REPLACE_EXISTING
+	moveFileWriteThrough    = 0x8 // MOVEFILE_WRITE_THROUGH，返回前将重命名写入磁盘
+
+	errorSharingViolation syscall.Errno = 32 // ERROR_SHARING_VIOLATION
+	errorLockViolation    syscall.Errno = 33 // ERROR_LOCK_VIOLATION
+)
+
+var procMoveFileExW = syscall.NewLazyDLL("kernel32.dll").NewProc("MoveFileExW")
+
+// rename 使用MoveFileEx替换已存在的目标，并在返回前写入磁盘
+func rename(oldpath, newpath string) error {
+	from, err := syscall.UTF16PtrFromString(oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	to, err := syscall.UTF16PtrFromString(newpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	r, _, e := procMoveFileExW.Call(uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)),
+		moveFileReplaceExisting|moveFileWriteThrough)
+	if r == 0 {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: e}
+	}
+	return nil
+}
+
+// busy 判断错误是否由文件仍被其他句柄打开引起。没有以FILE_SHARE_DELETE打开的文件在关闭前不能删除或替换
+func busy(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation) ||
+		errors.Is(err, syscall.ERROR_ACCESS_DENIED)
+}
@@ -0,0 +1,119 @@
+package inner
+
+import (
+	"io"
+	"os"
+
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// IngestSST 将外部构建的SST文件(通常来自sst.FileSetBuilder)作为最新的L0文件载入。
+// 文件先硬链接(不支持时复制)到SST目录，全部打开后一次性记入清单，成功后删除原文件。
+// 载入的条目比已有的SST文件和已轮转的不可变内存表新，这些内存表在记入清单前先刷盘，使其刷盘前后都位于载入的文件之下；
+// 可变内存表中尚未刷盘的写入在读取时仍然优先
+func (t *LsmTree) IngestSST(files []sst.FileMeta) error {
+	if len(files) == 0 {
+		return nil
+	}
+	nodes := make([]*sst.Node, 0, len(files))
+	cleanup := func() {
+		for _, node := range nodes {
+			node.Reader().Close()
+			fsio.DeleteRetry(node.GetFilename())
+		}
+	}
+	for _, file := range files {
+		node, err := t.ingestFile(file.Path)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+	// 之后轮转的内存表分配的序列号都更大，只需刷盘序列号小于载入文件的不可变内存表
+	if err := t.flushPending(uint32(nodes[0].GetSeq())); err != nil {
+		cleanup()
+		return err
+	}
+
+	if err := t.beginWrite(); err != nil {
+		cleanup()
+		return err
+	}
+	edits := make([]manifest.Edit, 0, len(nodes))
+	for _, node := range nodes {
+		edits = append(edits, manifest.AddFile(t.manifestFileMeta(node)))
+	}
+	if err := t.manifest.Apply(edits...); err != nil {
+		t.mu.Unlock()
+		cleanup()
+		return err
+	}
+	t.addNodes(0, nodes...)
+	// 导入的文件比已有的SST新，行缓存中的结果可能已被覆盖
+	t.rowCache.clear()
+	t.mu.Unlock()
+
+	for _, file := range files {
+		if err := fsio.DeleteRetry(file.Path); err != nil {
+			t.conf.Warnf("remove ingested sst %s: %v", file.Path, err)
+		}
+	}
+	return nil
+}
+
+// ingestFile 将src链接或复制为新的L0文件并打开
+func (t *LsmTree) ingestFile(src string) (*sst.Node, error) {
+	seq := t.nextSSTSeq(0)
+	path := t.getSSTFilePath(0, seq)
+	tmpPath := path + sstTmpSuffix
+	if err := linkOrCopy(src, tmpPath); err != nil {
+		fsio.DeleteRetry(tmpPath)
+		return nil, err
+	}
+	if err := t.renameSST(tmpPath, path); err != nil {
+		return nil, err
+	}
+	reader, err := sst.NewSSTReader(t.conf, path)
+	if err != nil {
+		fsio.DeleteRetry(path)
+		return nil, err
+	}
+	reader.AttachBudget(t.indexBudget)
+	reader.AttachFilterBudget(t.filterBudget)
+	reader.AttachBlockCache(t.blockCache)
+	node, err := sst.NewNode(t.conf, path, 0, int32(seq), reader)
+	if err != nil {
+		reader.Close()
+		fsio.DeleteRetry(path)
+		return nil, err
+	}
+	return node, nil
+}
+
+// linkOrCopy 将src硬链接到dst，跨文件系统等无法链接时复制并同步到磁盘
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsio.Create(dst, fsio.Positional)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,94 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func TestLsmTree_IngestSST(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key-000010"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+
+	// 100k个有序的key按大小切分为3个文件
+	const n = 100000
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value-%06d-padding", i)) }
+	dir := filepath.Join(t.TempDir(), "bulk")
+	builder, err := sst.NewFileSetBuilder(conf, dir, 1500<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := builder.Add([]byte(fmt.Sprintf("key-%06d", i)), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("built %d files, want 3", len(files))
+	}
+	var entries int64
+	for i, file := range files {
+		if i > 0 && bytes.Compare(file.MinKey, files[i-1].MaxKey) <= 0 {
+			t.Fatalf("file %d [%s, %s] overlaps previous max %s", i, file.MinKey, file.MaxKey, files[i-1].MaxKey)
+		}
+		entries += file.Entries
+	}
+	if entries != n {
+		t.Fatalf("files hold %d entries, want %d", entries, n)
+	}
+
+	if err := tree.IngestSST(files); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key-000020"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			want := value(i)
+			if i == 20 {
+				want = []byte("new") // 内存表中的写入优先
+			}
+			got, err := tree.Get([]byte(fmt.Sprintf("key-%06d", i)))
+			if err != nil || !bytes.Equal(got, want) {
+				t.Fatalf("%s: Get(key-%06d) = %q, %v, want %q", stage, i, got, err, want)
+			}
+		}
+	}
+	check("after ingest")
+	for _, file := range files {
+		if _, err := os.Stat(file.Path); !os.IsNotExist(err) {
+			t.Fatalf("source file %s was not removed: %v", file.Path, err)
+		}
+	}
+
+	// 载入的文件已记入清单，重启后仍然可见
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if n := len(tree.Levels()[0].Files); n != 4 {
+		t.Fatalf("reopened with %d nodes, want 4", n)
+	}
+	check("after reopen")
+}
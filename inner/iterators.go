@@ -0,0 +1,108 @@
+package inner
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// maxIteratorStackDepth 记录的调用栈最大层数
+const maxIteratorStackDepth = 32
+
+// IteratorInfo 一个进行中的遍历
+type IteratorInfo struct {
+	ID      uint64        // 遍历编号，按开始顺序递增
+	Created time.Time     // 开始时间，按Config.Clock
+	Age     time.Duration // 已进行的时长
+	Stack   string        // 开始遍历时的调用栈，每帧为函数名和文件行号，未开启IteratorLeakTracking时为空
+}
+
+// openIterator 进行中的遍历，pcs只在开启IteratorLeakTracking时记录，到OpenIterators时才解析为函数名
+type openIterator struct {
+	created time.Time
+	pcs     []uintptr
+}
+
+// iteratorRegistry 进行中的遍历。遍历以回调形式进行，返回时即结束，不会遗留未关闭的遍历，
+// 长时间未结束的遍历通常是回调阻塞或处理过慢
+type iteratorRegistry struct {
+	mu   sync.Mutex
+	next uint64
+	open map[uint64]openIterator
+}
+
+// trackIterator 登记一个新的遍历，进行中的遍历数已达到MaxOpenIterators时返回ErrTooManyIterators，
+// 遍历结束后调用返回的函数注销。只用于用户发起的遍历，内部的遍历不受限制
+func (t *LsmTree) trackIterator() (func(), error) {
+	it := openIterator{created: t.conf.Now()}
+	if t.conf.IteratorLeakTracking {
+		// 跳过runtime.Callers和trackIterator，从发起遍历的方法开始记录
+		pcs := make([]uintptr, maxIteratorStackDepth)
+		it.pcs = pcs[:runtime.Callers(2, pcs)]
+	}
+	r := &t.iterators
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if limit := t.conf.MaxOpenIterators; limit > 0 && len(r.open) >= limit {
+		return nil, fmt.Errorf("%w: %d open, MaxOpenIterators %d", myerror.ErrTooManyIterators, len(r.open), limit)
+	}
+	if r.open == nil {
+		r.open = make(map[uint64]openIterator)
+	}
+	r.next++
+	id := r.next
+	r.open[id] = it
+	return func() {
+		r.mu.Lock()
+		delete(r.open, id)
+		r.mu.Unlock()
+	}, nil
+}
+
+// openIteratorCount 返回进行中的遍历数
+func (t *LsmTree) openIteratorCount() int {
+	t.iterators.mu.Lock()
+	defer t.iterators.mu.Unlock()
+	return len(t.iterators.open)
+}
+
+// OpenIterators 返回所有进行中的遍历，按开始顺序排列，用于排查长时间未结束的遍历
+func (t *LsmTree) OpenIterators() []IteratorInfo {
+	now := t.conf.Now()
+	t.iterators.mu.Lock()
+	infos := make([]IteratorInfo, 0, len(t.iterators.open))
+	pcs := make([][]uintptr, 0, len(t.iterators.open))
+	for id, it := range t.iterators.open {
+		infos = append(infos, IteratorInfo{ID: id, Created: it.created, Age: now.Sub(it.created)})
+		pcs = append(pcs, it.pcs)
+	}
+	t.iterators.mu.Unlock()
+	// 在锁外解析调用栈
+	for i := range infos {
+		infos[i].Stack = formatStack(pcs[i])
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// formatStack 将runtime.Callers记录的程序计数器格式化为与panic输出相似的调用栈
+func formatStack(pcs []uintptr) string {
+	if len(pcs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
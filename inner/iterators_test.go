@@ -0,0 +1,101 @@
+package inner
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 进行中的遍历计入Stats.OpenIterators，达到MaxOpenIterators后新的遍历返回ErrTooManyIterators，
+// OpenIterators返回每个遍历的时长和开始遍历的调用栈
+func TestLsmTree_OpenIterators(t *testing.T) {
+	conf := newTestConfig(t)
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.MaxOpenIterators = 2
+	conf.IteratorLeakTracking = true
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 回调阻塞，遍历保持进行中
+	started := make(chan struct{})
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- tree.PrefixScan(nil, func(key, value []byte) bool {
+				started <- struct{}{}
+				<-block
+				return true
+			})
+		}()
+	}
+	<-started
+	<-started
+	clock.Advance(time.Minute)
+
+	if n := tree.Stats().OpenIterators; n != 2 {
+		t.Fatalf("OpenIterators gauge = %d, want 2", n)
+	}
+	err = tree.PrefixScan(nil, func(key, value []byte) bool { return true })
+	if !errors.Is(err, ErrTooManyIterators) {
+		t.Fatalf("third scan: got %v, want ErrTooManyIterators", err)
+	}
+	// 内部遍历不受限制
+	if _, _, err := tree.retainedUsage(); err != nil {
+		t.Fatalf("internal scan: %v", err)
+	}
+	infos := tree.OpenIterators()
+	if len(infos) != 2 {
+		t.Fatalf("OpenIterators returned %d, want 2", len(infos))
+	}
+	for _, info := range infos {
+		if info.Age != time.Minute {
+			t.Fatalf("iterator %d age = %v, want 1m", info.ID, info.Age)
+		}
+		if !strings.Contains(info.Stack, "TestLsmTree_OpenIterators") || !strings.Contains(info.Stack, "iterators_test.go") {
+			t.Fatalf("iterator %d stack does not point at the test:\n%s", info.ID, info.Stack)
+		}
+		if !strings.HasPrefix(info.Stack, "github.com/aixiasang/lsm/inner.(*LsmTree).PrefixScan\n") {
+			t.Fatalf("iterator %d stack does not start at PrefixScan:\n%s", info.ID, info.Stack)
+		}
+	}
+
+	close(block)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tree.Stats().OpenIterators; n != 0 {
+		t.Fatalf("OpenIterators gauge after scans returned = %d, want 0", n)
+	}
+	if infos := tree.OpenIterators(); len(infos) != 0 {
+		t.Fatalf("OpenIterators after scans returned = %d, want 0", len(infos))
+	}
+
+	// 未开启IteratorLeakTracking时不记录调用栈
+	tree.conf.IteratorLeakTracking = false
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+		infos = tree.OpenIterators()
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Stack != "" {
+		t.Fatalf("OpenIterators without tracking = %+v, want one entry without stack", infos)
+	}
+}
@@ -0,0 +1,46 @@
+// Package keyutil 按字节序比较的key的范围计算，前缀扫描、命名空间和范围删除共用
+package keyutil
+
+import "bytes"
+
+// PrefixSuccessor 返回大于所有以p开头的key的最小key，即去掉末尾连续的0xFF后将最后一个字节加一。
+// p为空或全部为0xFF时没有这样的key，返回nil和false，表示上方不设界。返回的切片不与p共享内存
+func PrefixSuccessor(p []byte) ([]byte, bool) {
+	for i := len(p) - 1; i >= 0; i-- {
+		if p[i] != 0xFF {
+			succ := bytes.Clone(p[:i+1])
+			succ[i]++
+			return succ, true
+		}
+	}
+	return nil, false
+}
+
+// Range 按字节序的半开区间[Start, End)。Start为nil表示从最小的key开始，
+// Unbounded为true表示没有上界，此时忽略End；不能用全部为0xFF的key代替没有上界
+type Range struct {
+	Start     []byte // 下界(包括)
+	End       []byte // 上界(不包括)
+	Unbounded bool   // 是否没有上界
+}
+
+// PrefixRange 返回以p开头的所有key组成的区间
+func PrefixRange(p []byte) Range {
+	end, ok := PrefixSuccessor(p)
+	return Range{Start: bytes.Clone(p), End: end, Unbounded: !ok}
+}
+
+// Contains 判断key是否在区间内
+func (r Range) Contains(key []byte) bool {
+	return bytes.Compare(key, r.Start) >= 0 && !r.Beyond(key)
+}
+
+// Beyond 判断key是否不小于上界，按key顺序遍历时遇到这样的key即可停止
+func (r Range) Beyond(key []byte) bool {
+	return !r.Unbounded && bytes.Compare(key, r.End) >= 0
+}
+
+// Overlaps 判断区间是否与[minKey, maxKey](都包括)相交，用于按文件或数据块的首尾key跳过不相关的部分
+func (r Range) Overlaps(minKey, maxKey []byte) bool {
+	return bytes.Compare(maxKey, r.Start) >= 0 && !r.Beyond(minKey)
+}
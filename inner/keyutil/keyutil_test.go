@@ -0,0 +1,115 @@
+package keyutil
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestPrefixSuccessor(t *testing.T) {
+	for _, c := range []struct {
+		prefix []byte
+		want   []byte
+		ok     bool
+	}{
+		{nil, nil, false},
+		{[]byte{}, nil, false},
+		{[]byte("abc"), []byte("abd"), true},
+		{[]byte{'a', 0xFF}, []byte("b"), true},
+		{[]byte{'a', 0xFE, 0xFF, 0xFF}, []byte{'a', 0xFF}, true},
+		{[]byte{0x00}, []byte{0x01}, true},
+		{[]byte{0xFF}, nil, false},
+		{[]byte{0xFF, 0xFF, 0xFF}, nil, false},
+	} {
+		got, ok := PrefixSuccessor(c.prefix)
+		if ok != c.ok || !bytes.Equal(got, c.want) {
+			t.Fatalf("PrefixSuccessor(%x) = %x, %v, want %x, %v", c.prefix, got, ok, c.want, c.ok)
+		}
+	}
+
+	// 不修改也不共享调用方的切片
+	prefix := []byte{'a', 'b', 0xFF}
+	succ, _ := PrefixSuccessor(prefix)
+	succ[0] = 'z'
+	if !bytes.Equal(prefix, []byte{'a', 'b', 0xFF}) {
+		t.Fatalf("prefix modified to %x", prefix)
+	}
+}
+
+// randomKey 返回长度不超过n的随机key，字节集中在0x00、0xFE、0xFF和几个字母附近，使前缀和0xFF连续出现的情况足够多
+func randomKey(rng *rand.Rand, n int) []byte {
+	alphabet := []byte{0x00, 0x01, 'a', 'b', 0xFE, 0xFF, 0xFF}
+	key := make([]byte, rng.Intn(n+1))
+	for i := range key {
+		key[i] = alphabet[rng.Intn(len(alphabet))]
+	}
+	return key
+}
+
+// TestPrefixRangeProperty 随机前缀的区间恰好包含以它开头的key：以前缀开头的key都小于后继，
+// 不以前缀开头且大于前缀的key都不小于后继，后继本身不以前缀开头
+func TestPrefixRangeProperty(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	prefixes := [][]byte{nil, {}, {0xFF}, {0xFF, 0xFF, 0xFF}, {'a', 0xFF, 0xFF}}
+	for i := 0; i < 500; i++ {
+		prefixes = append(prefixes, randomKey(rng, 4))
+	}
+	for _, prefix := range prefixes {
+		r := PrefixRange(prefix)
+		succ, ok := PrefixSuccessor(prefix)
+		if ok == r.Unbounded || !bytes.Equal(succ, r.End) {
+			t.Fatalf("PrefixRange(%x) = %+v, successor %x, %v", prefix, r, succ, ok)
+		}
+		if ok {
+			if bytes.HasPrefix(succ, prefix) || bytes.Compare(succ, prefix) <= 0 {
+				t.Fatalf("successor %x of %x", succ, prefix)
+			}
+			if !r.Beyond(succ) || r.Contains(succ) {
+				t.Fatalf("range %+v contains its end", r)
+			}
+		} else if len(bytes.TrimRight(prefix, "\xff")) > 0 {
+			t.Fatalf("%x has a successor", prefix)
+		}
+		for j := 0; j < 200; j++ {
+			key := randomKey(rng, 6)
+			if j%2 == 0 {
+				key = append(bytes.Clone(prefix), key...)
+			}
+			has := bytes.HasPrefix(key, prefix)
+			if r.Contains(key) != has {
+				t.Fatalf("range of %x: Contains(%x) = %v", prefix, key, !has)
+			}
+			if has && ok && bytes.Compare(key, succ) >= 0 {
+				t.Fatalf("%x has prefix %x but sorts at or above successor %x", key, prefix, succ)
+			}
+			if !has && bytes.Compare(key, prefix) > 0 && (!ok || bytes.Compare(key, succ) < 0) {
+				t.Fatalf("%x without prefix %x sorts below successor %x (%v)", key, prefix, succ, ok)
+			}
+			if r.Beyond(key) != (!has && bytes.Compare(key, prefix) > 0) {
+				t.Fatalf("range of %x: Beyond(%x) = %v", prefix, key, r.Beyond(key))
+			}
+		}
+	}
+}
+
+func TestRangeOverlaps(t *testing.T) {
+	r := Range{Start: []byte("b"), End: []byte("d")}
+	for _, c := range []struct {
+		min, max string
+		want     bool
+	}{
+		{"a", "a", false},
+		{"a", "b", true},
+		{"c", "c", true},
+		{"a", "z", true},
+		{"d", "e", false},
+	} {
+		if got := r.Overlaps([]byte(c.min), []byte(c.max)); got != c.want {
+			t.Fatalf("Overlaps(%s, %s) = %v", c.min, c.max, got)
+		}
+	}
+	unbounded := Range{Start: []byte("b"), Unbounded: true}
+	if !unbounded.Overlaps([]byte("y"), []byte{0xFF, 0xFF}) || unbounded.Beyond([]byte{0xFF, 0xFF, 0xFF}) {
+		t.Fatal("unbounded range has an upper end")
+	}
+}
@@ -0,0 +1,85 @@
+package kv
+
+import "fmt"
+
+// EntryKind 条目类型，各层统一使用该类型区分写入与删除标记
+type EntryKind uint8
+
+const (
+	KindPut         EntryKind = iota // 写入，value可以为空
+	KindDelete                       // 删除标记，value为nil
+	KindMerge                        // 合并操作数，value为操作数
+	KindRangeDelete                  // 范围删除，删除[Key, Value)内的key
+)
+
+// Valid 判断是否为已知的条目类型
+func (k EntryKind) Valid() bool {
+	return k <= KindRangeDelete
+}
+
+func (k EntryKind) String() string {
+	switch k {
+	case KindPut:
+		return "put"
+	case KindDelete:
+		return "delete"
+	case KindMerge:
+		return "merge"
+	case KindRangeDelete:
+		return "range-delete"
+	default:
+		return fmt.Sprintf("kind(%d)", uint8(k))
+	}
+}
+
+// Entry 内存表、WAL和SST之间传递的条目
+type Entry struct {
+	Key       []byte
+	Value     []byte    // KindDelete时为nil，与空值[]byte{}区分
+	Kind      EntryKind // 条目类型
+	Seq       uint64    // 写入序列号，0表示未分配
+	TTL       int64     // 过期时间(unix纳秒)，0表示不过期
+	Timestamp int64     // 写入时间(unix纳秒)，0表示未记录
+}
+
+// FromValue 按旧的约定由key和value构造条目：value为nil表示删除标记，其余为写入
+func FromValue(key, value []byte, ts int64) Entry {
+	if value == nil {
+		return Entry{Key: key, Kind: KindDelete, Timestamp: ts}
+	}
+	return Entry{Key: key, Value: value, Kind: KindPut, Timestamp: ts}
+}
+
+// IsDelete 判断是否为删除标记
+func (e Entry) IsDelete() bool {
+	return e.Kind == KindDelete
+}
+
+// Expired 判断条目在now(unix纳秒)时是否已过期，没有设置过期时间的条目不会过期
+func (e Entry) Expired(now int64) bool {
+	return e.TTL != 0 && e.TTL <= now
+}
+
+// Normalize 使value与类型一致：删除标记的value为nil，其余类型的nil value视为空值
+func (e Entry) Normalize() Entry {
+	if e.Kind == KindDelete {
+		e.Value = nil
+	} else if e.Value == nil {
+		e.Value = []byte{}
+	}
+	return e
+}
+
+// Clone 深拷贝key和value，nil保持为nil
+func (e Entry) Clone() Entry {
+	e.Key = cloneBytes(e.Key)
+	e.Value = cloneBytes(e.Value)
+	return e
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
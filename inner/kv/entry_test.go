@@ -0,0 +1,57 @@
+package kv
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFromValue(t *testing.T) {
+	if e := FromValue([]byte("k"), nil, 7); e.Kind != KindDelete || e.Value != nil || !e.IsDelete() || e.Timestamp != 7 {
+		t.Fatalf("nil value = %+v, want delete", e)
+	}
+	if e := FromValue([]byte("k"), []byte{}, 0); e.Kind != KindPut || e.Value == nil || e.IsDelete() {
+		t.Fatalf("empty value = %+v, want put with empty value", e)
+	}
+}
+
+func TestEntryNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		in       Entry
+		wantNil  bool
+		wantSize int
+	}{
+		{Entry{Kind: KindPut}, false, 0},
+		{Entry{Kind: KindPut, Value: []byte("v")}, false, 1},
+		{Entry{Kind: KindDelete, Value: []byte("v")}, true, 0},
+		{Entry{Kind: KindMerge}, false, 0},
+		{Entry{Kind: KindRangeDelete, Value: []byte("z")}, false, 1},
+	} {
+		got := tt.in.Normalize()
+		if (got.Value == nil) != tt.wantNil || len(got.Value) != tt.wantSize || got.Kind != tt.in.Kind {
+			t.Fatalf("Normalize(%+v) = %+v", tt.in, got)
+		}
+	}
+}
+
+func TestEntryClone(t *testing.T) {
+	e := Entry{Key: []byte("k"), Value: []byte("v"), Kind: KindMerge, Seq: 3, TTL: 4, Timestamp: 5}
+	c := e.Clone()
+	e.Key[0], e.Value[0] = 'x', 'x'
+	if !bytes.Equal(c.Key, []byte("k")) || !bytes.Equal(c.Value, []byte("v")) || c.Seq != 3 || c.TTL != 4 || c.Timestamp != 5 {
+		t.Fatalf("Clone = %+v", c)
+	}
+	if c := (Entry{Kind: KindDelete}).Clone(); c.Value != nil {
+		t.Fatal("Clone turned a nil value into an empty one")
+	}
+}
+
+func TestEntryKind(t *testing.T) {
+	for kind, name := range map[EntryKind]string{KindPut: "put", KindDelete: "delete", KindMerge: "merge", KindRangeDelete: "range-delete"} {
+		if !kind.Valid() || kind.String() != name {
+			t.Fatalf("%d: Valid = %v, String = %q", kind, kind.Valid(), kind.String())
+		}
+	}
+	if EntryKind(9).Valid() || EntryKind(9).String() != "kind(9)" {
+		t.Fatal("unknown kind reported as valid")
+	}
+}
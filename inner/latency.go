@@ -0,0 +1,192 @@
+package inner
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyOp 统计耗时分布的操作
+type LatencyOp int8
+
+const (
+	LatencyGet          LatencyOp = iota // Get及其变体的单次查找
+	LatencyPut                           // 单次写入
+	LatencyDelete                        // 单次删除
+	LatencyScanNext                      // 遍历时产生下一个键值对，第一个包含合并视图的时间，不包含回调的时间
+	LatencyFlush                         // 一次刷盘
+	LatencyCompaction                    // 一次层级压缩
+	LatencyPutWalEncode                  // 写入中编码WAL记录，仅在开启WriteStageHistograms时记录，以下同
+	LatencyPutWalWrite                   // 写入中写入WAL文件或加入提交组
+	LatencyPutWalSync                    // 写入中同步WAL，开启组提交时为等待提交的时间
+	LatencyPutMemtable                   // 写入中写入可变内存表
+	LatencyPutRotate                     // 写入中WAL写满后轮转内存表，只在发生轮转时记录
+	numLatencyOps
+)
+
+// String 返回操作名称，与慢操作日志中的op一致
+func (op LatencyOp) String() string {
+	switch op {
+	case LatencyGet:
+		return "get"
+	case LatencyPut:
+		return "put"
+	case LatencyDelete:
+		return "delete"
+	case LatencyScanNext:
+		return "scan_next"
+	case LatencyFlush:
+		return "flush"
+	case LatencyCompaction:
+		return "compaction"
+	case LatencyPutWalEncode:
+		return "put.wal_encode"
+	case LatencyPutWalWrite:
+		return "put.wal_write"
+	case LatencyPutWalSync:
+		return "put.wal_sync"
+	case LatencyPutMemtable:
+		return "put.memtable"
+	case LatencyPutRotate:
+		return "put.rotate"
+	}
+	return "unknown"
+}
+
+// LatencyOps 返回所有统计耗时分布的操作
+func LatencyOps() []LatencyOp {
+	ops := make([]LatencyOp, numLatencyOps)
+	for i := range ops {
+		ops[i] = LatencyOp(i)
+	}
+	return ops
+}
+
+const (
+	latencyUnit       = time.Microsecond
+	latencyPow2Bounds = 24               // 1µs<<0到1µs<<23(约8.4s)的区间
+	latencyMaxBound   = 10 * time.Second // 最后一个有上限的区间
+	// 2的幂区间、10s区间以及超出10s的区间
+	numLatencyBuckets = latencyPow2Bounds + 2
+)
+
+// latencyBound 返回第i个区间的上限(包括)，最后一个区间没有上限，返回0
+func latencyBound(i int) time.Duration {
+	switch {
+	case i < latencyPow2Bounds:
+		return latencyUnit << i
+	case i == latencyPow2Bounds:
+		return latencyMaxBound
+	}
+	return 0
+}
+
+// latencyBucket 返回耗时d所在的区间，即上限不小于d的第一个区间
+func latencyBucket(d time.Duration) int {
+	if d <= latencyUnit {
+		return 0
+	}
+	// 按微秒向上取整，(2^(i-1), 2^i]µs落在第i个区间
+	i := bits.Len64(uint64((d+latencyUnit-1)/latencyUnit) - 1)
+	if i < latencyPow2Bounds {
+		return i
+	}
+	if d <= latencyMaxBound {
+		return latencyPow2Bounds
+	}
+	return latencyPow2Bounds + 1
+}
+
+// latencyHistogram 固定区间的耗时分布，记录只有两次原子加法，可以一直开启
+type latencyHistogram struct {
+	counts [numLatencyBuckets]atomic.Uint64
+	sum    atomic.Int64 // 总耗时(纳秒)
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyBucket(d)].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *latencyHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+	h.sum.Store(0)
+}
+
+// snapshot 读取当前分布，与并发的记录之间不保证原子性，Count由各区间相加得到
+func (h *latencyHistogram) snapshot() Histogram {
+	hist := Histogram{
+		Buckets: make([]HistogramBucket, numLatencyBuckets),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		count := h.counts[i].Load()
+		hist.Buckets[i] = HistogramBucket{UpperBound: latencyBound(i), Count: count}
+		hist.Count += count
+	}
+	hist.P50 = hist.Percentile(50)
+	hist.P95 = hist.Percentile(95)
+	hist.P99 = hist.Percentile(99)
+	return hist
+}
+
+// HistogramBucket 耗时分布中的一个区间
+type HistogramBucket struct {
+	UpperBound time.Duration // 区间上限(包括)，为0表示超出10s的最后一个区间
+	Count      uint64        // 耗时在(上一个区间的上限, UpperBound]内的次数
+}
+
+// Histogram 一种操作的耗时分布，区间从1µs按2倍增长到10s
+type Histogram struct {
+	Buckets []HistogramBucket // 按上限从小到大排列
+	Count   uint64            // 记录次数
+	Sum     time.Duration     // 总耗时
+	P50     time.Duration     // 中位数
+	P95     time.Duration     // 95分位
+	P99     time.Duration     // 99分位
+}
+
+// Percentile 返回第p百分位所在区间的上限，是该分位耗时的上界；落在超出10s的区间时返回10s，没有记录时返回0
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p / 100 * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for _, bucket := range h.Buckets {
+		seen += bucket.Count
+		if seen >= rank {
+			if bucket.UpperBound == 0 {
+				return latencyMaxBound
+			}
+			return bucket.UpperBound
+		}
+	}
+	return latencyMaxBound
+}
+
+// Histogram 返回op的耗时分布
+func (s Stats) Histogram(op LatencyOp) Histogram {
+	if op < 0 || op >= numLatencyOps || s.latencies == nil {
+		return Histogram{}
+	}
+	return s.latencies[op]
+}
+
+// recordLatency 记录一次op的耗时
+func (t *LsmTree) recordLatency(op LatencyOp, elapsed time.Duration) {
+	t.stats.latencies[op].record(elapsed)
+}
+
+// ResetLatencyHistograms 清空所有操作的耗时分布，用于按时间段观察
+func (t *LsmTree) ResetLatencyHistograms() {
+	for i := range t.stats.latencies {
+		t.stats.latencies[i].reset()
+	}
+}
@@ -0,0 +1,296 @@
+package inner
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		d     time.Duration
+		bound time.Duration // 所在区间的上限，0表示超出10s的区间
+	}{
+		{-time.Second, time.Microsecond},
+		{0, time.Microsecond},
+		{time.Microsecond, time.Microsecond},
+		{time.Microsecond + 1, 2 * time.Microsecond},
+		{2 * time.Microsecond, 2 * time.Microsecond},
+		{3 * time.Microsecond, 4 * time.Microsecond},
+		{100 * time.Microsecond, 128 * time.Microsecond},
+		{time.Millisecond, 1024 * time.Microsecond},
+		{time.Second, 1 << 20 * time.Microsecond},
+		{8388608 * time.Microsecond, 8388608 * time.Microsecond},
+		{9 * time.Second, 10 * time.Second},
+		{10 * time.Second, 10 * time.Second},
+		{10*time.Second + 1, 0},
+		{time.Hour, 0},
+	}
+	for _, tt := range tests {
+		i := latencyBucket(tt.d)
+		if got := latencyBound(i); got != tt.bound {
+			t.Errorf("latencyBucket(%s) = %d with bound %s, want bound %s", tt.d, i, got, tt.bound)
+		}
+		// 上一个区间的上限小于d
+		if i > 0 && tt.d <= latencyBound(i-1) {
+			t.Errorf("%s fits bucket %d below %d", tt.d, i-1, i)
+		}
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var h latencyHistogram
+	if hist := h.snapshot(); hist.Count != 0 || hist.P99 != 0 || len(hist.Buckets) != numLatencyBuckets {
+		t.Fatalf("empty histogram %+v", hist)
+	}
+	// 90次3µs、9次100µs、1次20s
+	for i := 0; i < 90; i++ {
+		h.record(3 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.record(100 * time.Microsecond)
+	}
+	h.record(20 * time.Second)
+	hist := h.snapshot()
+	if hist.Count != 100 || hist.Sum != 90*3*time.Microsecond+9*100*time.Microsecond+20*time.Second {
+		t.Fatalf("count %d sum %s", hist.Count, hist.Sum)
+	}
+	if hist.P50 != 4*time.Microsecond || hist.P95 != 128*time.Microsecond || hist.P99 != 128*time.Microsecond {
+		t.Fatalf("p50 %s p95 %s p99 %s", hist.P50, hist.P95, hist.P99)
+	}
+	if p := hist.Percentile(100); p != 10*time.Second {
+		t.Fatalf("p100 = %s", p)
+	}
+	if last := hist.Buckets[len(hist.Buckets)-1]; last.UpperBound != 0 || last.Count != 1 {
+		t.Fatalf("overflow bucket %+v", last)
+	}
+
+	h.reset()
+	if hist := h.snapshot(); hist.Count != 0 || hist.Sum != 0 {
+		t.Fatalf("after reset %+v", hist)
+	}
+}
+
+func TestLatencyHistogramConcurrent(t *testing.T) {
+	var h latencyHistogram
+	const goroutines, n = 8, 1000
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				h.record(time.Duration(g*n+i) * time.Microsecond)
+				if i%100 == 0 {
+					h.snapshot()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if hist := h.snapshot(); hist.Count != goroutines*n {
+		t.Fatalf("count %d, want %d", hist.Count, goroutines*n)
+	}
+}
+
+func TestLsmTree_LatencyHistograms(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := tree.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	for _, key := range []string{"a", "b", "missing"} {
+		tree.Get([]byte(key))
+	}
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tree.Stats()
+	want := map[LatencyOp]uint64{LatencyPut: 3, LatencyDelete: 1, LatencyGet: 3, LatencyScanNext: 2}
+	for op, count := range want {
+		if hist := stats.Histogram(op); hist.Count != count {
+			t.Errorf("%s count %d, want %d", op, hist.Count, count)
+		}
+	}
+	if stats.Histogram(LatencyFlush).Count == 0 {
+		t.Error("no flush recorded")
+	}
+	if hist := stats.Histogram(LatencyOp(-1)); hist.Count != 0 {
+		t.Errorf("unknown op %+v", hist)
+	}
+
+	tree.ResetLatencyHistograms()
+	stats = tree.Stats()
+	for _, op := range LatencyOps() {
+		if hist := stats.Histogram(op); hist.Count != 0 {
+			t.Errorf("%s count %d after reset", op, hist.Count)
+		}
+	}
+}
+
+func BenchmarkLatencyRecord(b *testing.B) {
+	var h latencyHistogram
+	b.RunParallel(func(pb *testing.PB) {
+		d := 37 * time.Microsecond
+		for pb.Next() {
+			h.record(d)
+		}
+	})
+}
+
+// slowMemTable 每次写入和查找条目时推进时钟，模拟较慢的内存表
+type slowMemTable struct {
+	memtable.MemTable
+	clock *manualClock
+	delay time.Duration
+}
+
+func (m slowMemTable) PutEntry(entry kv.Entry) error {
+	m.clock.Advance(m.delay)
+	return m.MemTable.PutEntry(entry)
+}
+
+func (m slowMemTable) GetEntry(key []byte) (kv.Entry, error) {
+	m.clock.Advance(m.delay)
+	return m.MemTable.GetEntry(key)
+}
+
+// 写入各阶段的耗时按假时钟落入对应的区间：WAL写入和fsync、内存表写入和创建新WAL时各推进固定的时长
+func TestLsmTree_WriteStageHistograms(t *testing.T) {
+	const (
+		walWrite = 3 * time.Millisecond
+		walSync  = 40 * time.Millisecond
+		memWrite = 200 * time.Microsecond
+		walNew   = 100 * time.Millisecond
+	)
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	var armed atomic.Bool
+	logger := &captureLogger{}
+	conf := newTestConfig(t)
+	conf.Clock = clock
+	conf.Logger = logger
+	conf.SlowOpThreshold = 10 * time.Millisecond
+	conf.AutoSync = true
+	conf.GroupCommitInterval = 0
+	conf.WalSize = 4096
+	conf.WriteStageHistograms = true
+	conf.MemTableConstructor = func(mtType memtable.MemTableType, degree int) memtable.MemTable {
+		return slowMemTable{MemTable: memtable.NewMemTable(mtType, degree), clock: clock, delay: memWrite}
+	}
+	// 只推进WAL的I/O，后台刷盘写入SST不影响时钟
+	conf.Hooks = &config.TestHooks{IOFault: func(op, path string) error {
+		if !armed.Load() || !wal.IsFileName(filepath.Base(path)) {
+			return nil
+		}
+		switch op {
+		case config.IOWrite:
+			clock.Advance(walWrite)
+		case config.IOSync:
+			clock.Advance(walSync)
+		case config.IOCreate:
+			clock.Advance(walNew)
+		}
+		return nil
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	armed.Store(true)
+
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// 超过WalSize的写入之后轮转
+	if err := tree.Put([]byte("big"), make([]byte, conf.WalSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("c"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := tree.Stats()
+	want := []struct {
+		op    LatencyOp
+		count uint64
+		d     time.Duration
+	}{
+		{LatencyPutWalEncode, 5, 0},
+		{LatencyPutWalWrite, 5, walWrite},
+		{LatencyPutWalSync, 5, walSync},
+		{LatencyPutMemtable, 5, memWrite},
+		{LatencyPutRotate, 1, walNew},
+	}
+	for _, w := range want {
+		hist := stats.Histogram(w.op)
+		if hist.Count != w.count || hist.Sum != time.Duration(w.count)*w.d {
+			t.Errorf("%s: count %d sum %s, want %d x %s", w.op, hist.Count, hist.Sum, w.count, w.d)
+			continue
+		}
+		if got := hist.Buckets[latencyBucket(w.d)].Count; got != w.count {
+			t.Errorf("%s: %d in bucket of %s, want %d", w.op, got, w.d, w.count)
+		}
+	}
+	if hist := stats.Histogram(LatencyPut); hist.Count != 4 {
+		t.Errorf("put count %d, want 4", hist.Count)
+	}
+	for cause, count := range map[RotationCause]uint64{RotationWalSize: 1, RotationWriteBuffer: 0, RotationManual: 1} {
+		if got := stats.Rotations(cause); got != count {
+			t.Errorf("%s rotations %d, want %d", cause, got, count)
+		}
+	}
+
+	// 慢操作日志给出各阶段的耗时
+	lines := logger.find("slow op: op=put")
+	if len(lines) != 4 {
+		t.Fatalf("slow put lines %q", lines)
+	}
+	if !strings.Contains(lines[0], "wal_write=3ms wal_sync=40ms memtable=200µs rotate=0s") {
+		t.Errorf("slow put line %q", lines[0])
+	}
+	if !strings.Contains(lines[2], "rotate=100ms") {
+		t.Errorf("slow put with rotation %q", lines[2])
+	}
+
+	// 关闭后只记录整体耗时
+	tree.SetWriteStageHistograms(false)
+	if err := tree.Put([]byte("d"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	stats = tree.Stats()
+	if hist := stats.Histogram(LatencyPutWalSync); hist.Count != 5 {
+		t.Errorf("wal_sync count %d after disabling, want 5", hist.Count)
+	}
+	if hist := stats.Histogram(LatencyPut); hist.Count != 5 {
+		t.Errorf("put count %d, want 5", hist.Count)
+	}
+}
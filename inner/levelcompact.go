@@ -0,0 +1,664 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// errCompactionStale 只有L0一层时，合并期间L0加入了序列号比输出文件小的更新数据，放弃本次压缩
+var errCompactionStale = errors.New("level compaction outputs are older than new L0 data")
+
+// levelState 按MaxFilesPerLevel调度的层级压缩的状态
+type levelState struct {
+	signal      chan struct{} // 层中的文件增加时通知compactWorker检查各层文件数
+	served      []bool        // 本轮已经压缩过的层级，只在压缩goroutine中访问
+	count       atomic.Uint64 // 完成的层级压缩次数，不包括平移
+	bytes       atomic.Int64  // 层级压缩累计读取并重写的输入文件字节数
+	moves       atomic.Uint64 // 平移到下一层的文件数
+	moveBytes   atomic.Int64  // 平移到下一层的文件字节数
+	copyEntries bool          // 压缩时复制每个条目而不引用迭代器复用的缓冲区，测试中用于比较两种方式的输出
+}
+
+// signalLevelCompaction 通知compactWorker检查各层文件数，已有未处理的通知时直接返回
+func (t *LsmTree) signalLevelCompaction() {
+	select {
+	case t.levels.signal <- struct{}{}:
+	default:
+	}
+}
+
+// maxFiles 返回level层的文件数上限，0表示不限制
+func (t *LsmTree) maxFiles(level int) int {
+	if level >= len(t.conf.MaxFilesPerLevel) {
+		return 0
+	}
+	return max(t.conf.MaxFilesPerLevel[level], 0)
+}
+
+// levelScores 返回各层文件数与上限之比，大于1表示超出上限，不限制的层为0。调用方需持有t.mu
+func (t *LsmTree) levelScores() []float64 {
+	scores := make([]float64, len(t.nodes))
+	for level, nodes := range t.nodes {
+		if limit := t.maxFiles(level); limit > 0 {
+			scores[level] = float64(len(nodes)) / float64(limit)
+		}
+	}
+	return scores
+}
+
+// pickLevel 从超出上限的层级中选出下一个要压缩的层级，没有超出上限的层级时返回-1。
+// 优先选择超出比例最大的层级，比例相同时选择较浅的层级；每个层级在一轮中只被选中一次，
+// 其他超出上限的层级都压缩过后才开始新的一轮，持续超出上限的层级不会让其他层级一直等待
+func (s *levelState) pickLevel(scores []float64) int {
+	if len(s.served) != len(scores) {
+		s.served = make([]bool, len(scores))
+	}
+	pick := func() int {
+		best := -1
+		for level, score := range scores {
+			if score > 1 && !s.served[level] && (best < 0 || score > scores[best]) {
+				best = level
+			}
+		}
+		return best
+	}
+	level := pick()
+	if level < 0 {
+		clear(s.served)
+		if level = pick(); level < 0 {
+			return -1
+		}
+	}
+	s.served[level] = true
+	return level
+}
+
+// compactionInputs 返回使level层回到文件数上限以内需要重写的文件：该层最旧的超出部分，
+// 以及下一层中与它们的key范围直接或间接重叠的文件。最底层没有下一层，在层内将最旧的文件合并为一个，
+// 因此多取一个文件；只有L0一层时合并所有L0文件。level层没有超出上限时返回nil。调用方需持有t.mu
+func (t *LsmTree) compactionInputs(level int) (inputs, overlaps []*sst.Node) {
+	limit := t.maxFiles(level)
+	nodes := t.nodes[level]
+	if limit <= 0 || len(nodes) <= limit {
+		return nil, nil
+	}
+	bottom := level == len(t.nodes)-1
+	excess := len(nodes) - limit
+	if bottom {
+		excess++
+	}
+	if level == 0 {
+		nodes = t.settledL0()
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	if bottom && level == 0 {
+		// 只有L0一层时输出文件使用新的序列号留在L0，需要比之后刷盘的内存表旧，因此合并所有L0文件，
+		// 且只在没有尚未刷盘的内存表时进行
+		if t.hasUnflushed() {
+			return nil, nil
+		}
+		return slices.Clone(nodes), nil
+	}
+	if bottom {
+		// 复制一份，释放锁后addNodes对层内节点的排序不会影响结果
+		return slices.Clone(nodes[:min(excess, len(nodes))]), nil
+	}
+	if level > 0 && t.conf.AccessSampling > 0 {
+		inputs = coldestNodes(nodes, excess)
+	} else {
+		inputs = slices.Clone(nodes[:min(excess, len(nodes))])
+	}
+	return inputs, t.nextLevelOverlaps(level, inputs)
+}
+
+// coldestNodes 返回nodes中热度最低的n个文件，热度相同时取较旧的，按在层内的顺序返回。
+// L1及更深的层内文件互不重叠，选出任意文件移到下一层都不影响读取的优先级，较热的文件留在较浅的层
+func coldestNodes(nodes []*sst.Node, n int) []*sst.Node {
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	heats := make([]uint64, len(nodes))
+	for i, node := range nodes {
+		heats[i] = node.Heat()
+	}
+	sort.SliceStable(order, func(i, j int) bool { return heats[order[i]] < heats[order[j]] })
+	order = order[:min(n, len(order))]
+	slices.Sort(order)
+	picked := make([]*sst.Node, len(order))
+	for i, idx := range order {
+		picked[i] = nodes[idx]
+	}
+	return picked
+}
+
+// nextLevelOverlaps 返回level+1层中与inputs的key范围直接或间接重叠的文件，inputs不能为空。调用方需持有t.mu
+func (t *LsmTree) nextLevelOverlaps(level int, inputs []*sst.Node) (overlaps []*sst.Node) {
+	// 输出文件的key范围包含重叠文件的范围，继续扩展到与之重叠的文件，
+	// 保证留在下一层的文件与输出文件不重叠，输出文件在层内的位置不影响读取的优先级
+	minKey, maxKey := inputs[0].GetMinKey(), inputs[0].GetMaxKey()
+	for _, node := range inputs[1:] {
+		minKey, maxKey = widenRange(minKey, maxKey, node)
+	}
+	next := t.nodes[level+1]
+	picked := make([]bool, len(next))
+	for changed := true; changed; {
+		changed = false
+		for i, node := range next {
+			if picked[i] || bytes.Compare(node.GetMaxKey(), minKey) < 0 || bytes.Compare(node.GetMinKey(), maxKey) > 0 {
+				continue
+			}
+			picked[i], changed = true, true
+			minKey, maxKey = widenRange(minKey, maxKey, node)
+		}
+	}
+	for i, node := range next {
+		if picked[i] {
+			overlaps = append(overlaps, node)
+		}
+	}
+	return overlaps
+}
+
+// settledL0 返回L0中序列号小于所有尚未刷盘的不可变内存表的文件。刷盘完成的顺序可能与内存表的新旧不同，
+// 更旧的内存表尚未刷盘时，更新的L0文件移到下一层后会被之后刷盘的旧数据覆盖。调用方需持有t.mu
+func (t *LsmTree) settledL0() []*sst.Node {
+	nodes := t.nodes[0]
+	for _, imm := range t.immutableIndex {
+		if imm.installed {
+			continue
+		}
+		n := sort.Search(len(nodes), func(i int) bool { return uint32(nodes[i].GetSeq()) >= imm.seq })
+		nodes = nodes[:n]
+	}
+	return nodes
+}
+
+// hasUnflushed 判断是否有尚未刷盘的不可变内存表，调用方需持有t.mu
+func (t *LsmTree) hasUnflushed() bool {
+	return slices.ContainsFunc(t.immutableIndex, func(imm *immutable) bool { return !imm.installed })
+}
+
+// l0OrderKept 判断写入L0的outputs是否仍比removed以外的L0文件和尚未刷盘的内存表都旧。
+// 合并期间轮转的内存表或导入的文件使用了更小的序列号时，输出文件会覆盖其中更新的数据。调用方需持有t.mu
+func (t *LsmTree) l0OrderKept(removed, outputs []*sst.Node) bool {
+	var newest uint32
+	for _, output := range outputs {
+		newest = max(newest, uint32(output.GetSeq()))
+	}
+	for _, node := range t.nodes[0] {
+		if uint32(node.GetSeq()) < newest && !slices.Contains(removed, node) {
+			return false
+		}
+	}
+	for _, imm := range t.immutableIndex {
+		if !imm.installed && imm.seq < newest {
+			return false
+		}
+	}
+	return true
+}
+
+// widenRange 将[minKey, maxKey]扩展到包含node的key范围
+func widenRange(minKey, maxKey []byte, node *sst.Node) ([]byte, []byte) {
+	if bytes.Compare(node.GetMinKey(), minKey) < 0 {
+		minKey = node.GetMinKey()
+	}
+	if bytes.Compare(node.GetMaxKey(), maxKey) > 0 {
+		maxKey = node.GetMaxKey()
+	}
+	return minKey, maxKey
+}
+
+// compactionDebt 估计使各层回到文件数上限以内需要重写的字节数，即各层compactionInputs返回的文件大小之和。
+// 只按当前各层的文件估计，不包括压缩后下一层因此超出上限还需要的重写。调用方需持有t.mu
+func (t *LsmTree) compactionDebt() int64 {
+	var debt int64
+	for level := range t.nodes {
+		inputs, overlaps := t.compactionInputs(level)
+		debt += nodesSize(inputs) + nodesSize(overlaps)
+	}
+	return debt
+}
+
+// nodesSize 返回nodes的文件大小之和
+func nodesSize(nodes []*sst.Node) int64 {
+	var size int64
+	for _, node := range nodes {
+		size += node.GetSize()
+	}
+	return size
+}
+
+// runLevelCompaction 依次压缩超出文件数上限的层级，直到各层都在上限以内。在压缩goroutine中执行，
+// 与刷盘和定期压缩串行。出错时记录后台错误并停止，出错的层级保持不变，下次有文件加入时再次尝试
+func (t *LsmTree) runLevelCompaction() {
+	for !t.closed.Load() {
+		level, err := t.compactNextLevel()
+		if err != nil {
+			t.conf.Errorf("level compaction: %v", err)
+			t.setBackgroundError(err)
+			return
+		}
+		if level < 0 {
+			return
+		}
+	}
+}
+
+// compactNextLevel 按pickLevel选出一个层级并压缩，返回压缩的层级，没有超出上限的层级时返回-1。
+// 完成后调用OnLevelCompaction
+func (t *LsmTree) compactNextLevel() (int, error) {
+	// 通道已满时轮转出的不可变内存表没有交给压缩goroutine，L0超出上限时先刷盘，
+	// 否则比它们新的L0文件都不能移到下一层
+	t.mu.RLock()
+	flush := t.maxFiles(0) > 0 && len(t.nodes[0]) > t.maxFiles(0) &&
+		(len(t.settledL0()) < len(t.nodes[0]) || len(t.nodes) == 1 && t.hasUnflushed())
+	t.mu.RUnlock()
+	if flush {
+		if err := t.flushPending(math.MaxUint32); err != nil {
+			return 0, err
+		}
+	}
+
+	t.mu.RLock()
+	scores := t.levelScores()
+	for level, score := range scores {
+		// L0的文件都比尚未刷盘的内存表新时暂不压缩，内存表刷盘后addNodes会再次通知
+		if score > 1 {
+			if inputs, _ := t.compactionInputs(level); len(inputs) == 0 {
+				scores[level] = 0
+			}
+		}
+	}
+	level := t.levels.pickLevel(scores)
+	var inputs, overlaps []*sst.Node
+	var move bool
+	if level >= 0 {
+		inputs, overlaps = t.compactionInputs(level)
+		move = t.trivialMove(level, inputs, overlaps)
+	}
+	t.mu.RUnlock()
+	if level < 0 {
+		return -1, nil
+	}
+
+	if move {
+		debt, err := t.moveLevel(level, inputs)
+		if err != nil {
+			return level, fmt.Errorf("move level %d: %w", level, err)
+		}
+		t.levels.moves.Add(uint64(len(inputs)))
+		t.levels.moveBytes.Add(nodesSize(inputs))
+		if t.conf.OnLevelCompaction != nil {
+			t.conf.OnLevelCompaction(level, debt)
+		}
+		return level, nil
+	}
+	debt, err := t.compactLevel(level, inputs, overlaps, 0)
+	if errors.Is(err, errCompactionStale) {
+		// 输出文件已删除，输入文件保持不变，新的L0文件加入时会再次通知
+		return level, nil
+	}
+	if err != nil {
+		return level, fmt.Errorf("compact level %d: %w", level, err)
+	}
+	t.levels.count.Add(1)
+	t.levels.bytes.Add(nodesSize(inputs) + nodesSize(overlaps))
+	if t.conf.OnLevelCompaction != nil {
+		t.conf.OnLevelCompaction(level, debt)
+	}
+	return level, nil
+}
+
+// trivialMove 判断inputs能否直接平移到下一层而不重写：level不是最底层，下一层没有与inputs重叠的文件，
+// 且inputs之间的key范围互不重叠，平移后下一层的文件仍然互不重叠。只按节点记录的最小最大key判断，不读取数据。调用方需持有t.mu
+func (t *LsmTree) trivialMove(level int, inputs, overlaps []*sst.Node) bool {
+	if len(inputs) == 0 || len(overlaps) > 0 || level >= len(t.nodes)-1 {
+		return false
+	}
+	sorted := slices.Clone(inputs)
+	slices.SortFunc(sorted, func(a, b *sst.Node) int { return bytes.Compare(a.GetMinKey(), b.GetMinKey()) })
+	for i, node := range sorted {
+		if len(node.GetMinKey()) == 0 {
+			// 空文件没有key范围，交给合并丢弃
+			return false
+		}
+		if i > 0 && bytes.Compare(sorted[i-1].GetMaxKey(), node.GetMinKey()) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// moveLevel 将inputs平移到level+1层，返回完成后剩余的压缩债务。每个文件硬链接到目标层使用新序列号的文件名，
+// 无法链接时复制，同步目录后由一次清单修改加入新文件并移除原文件。新节点沿用原文件已打开的读取器、缓存的数据块和热度，
+// 不读取数据区域。断电时清单尚未记录的链接在重启时作为孤儿删除，清单记录后原文件的删除同样在重启时完成
+func (t *LsmTree) moveLevel(level int, inputs []*sst.Node) (int64, error) {
+	start := t.conf.Now()
+	defer func() { t.recordLatency(LatencyCompaction, t.conf.Since(start)) }()
+	target := level + 1
+	outputs := make([]*sst.Node, 0, len(inputs))
+	fail := func(err error) (int64, error) {
+		for _, output := range outputs {
+			fsio.DeleteRetry(output.GetFilename())
+		}
+		return 0, err
+	}
+	for _, node := range inputs {
+		seq := t.nextSSTSeq(target)
+		path := t.getSSTFilePath(target, seq)
+		if err := fsio.DeleteRetry(path); err != nil && !os.IsNotExist(err) {
+			return fail(err)
+		}
+		if err := linkOrCopy(node.GetFilename(), path); err != nil {
+			fsio.DeleteRetry(path)
+			return fail(err)
+		}
+		output, err := sst.NewNode(t.conf, path, target, int32(seq), node.Reader())
+		if err != nil {
+			fsio.DeleteRetry(path)
+			return fail(err)
+		}
+		output.SetSourceWals(node.SourceWals())
+		outputs = append(outputs, output)
+	}
+	if err := t.conf.SyncDir(filepath.Dir(outputs[0].GetFilename())); err != nil {
+		return fail(err)
+	}
+	t.conf.Crash(config.CrashAfterSSTRename)
+	debt, err := t.installMove(inputs, outputs)
+	if err != nil {
+		return 0, err
+	}
+	t.recordCompaction(config.CompactionTrivialMove, level, target, inputs, outputs, start)
+	if t.conf.ParanoidChecks {
+		t.mu.RLock()
+		err = t.checkLevelRanges()
+		t.mu.RUnlock()
+	}
+	return debt, err
+}
+
+// installMove 在写锁内以一次清单修改移除inputs并加入平移后的outputs，outputs[i]与inputs[i]共享读取器。
+// 读取器改用新的文件名，不关闭，之后删除原文件名，返回剩余的压缩债务。清单修改之前失败时删除outputs的文件名，
+// 之后失败时outputs已经生效，保留
+func (t *LsmTree) installMove(inputs, outputs []*sst.Node) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	discard := func(err error) (int64, error) {
+		for _, output := range outputs {
+			fsio.DeleteRetry(output.GetFilename())
+		}
+		return 0, err
+	}
+	edits := make([]manifest.Edit, 0, len(inputs)+len(outputs))
+	for _, node := range inputs {
+		if !slices.Contains(t.nodes[node.GetLevel()], node) {
+			return discard(fmt.Errorf("sst %s is no longer in level %d", node.GetFilename(), node.GetLevel()))
+		}
+		edits = append(edits, manifest.DeleteFile(node.GetLevel(), uint32(node.GetSeq())))
+	}
+	for _, output := range outputs {
+		edits = append(edits, manifest.AddFile(t.manifestFileMeta(output)))
+	}
+	if err := t.manifest.Apply(edits...); err != nil {
+		return discard(err)
+	}
+
+	for level := range t.nodes {
+		t.nodes[level] = slices.DeleteFunc(t.nodes[level], func(node *sst.Node) bool {
+			return slices.Contains(inputs, node)
+		})
+	}
+	for i, output := range outputs {
+		output.AddHeat(inputs[i].Heat())
+		output.Reader().Rename(output.GetFilename())
+	}
+	t.addNodes(outputs[0].GetLevel(), outputs...)
+	t.setL0Files()
+	for _, node := range inputs {
+		// 删除前崩溃时，清单中已记录删除的文件名会在重启时被删除，链接到新文件名的数据不受影响
+		t.conf.Crash(config.CrashBeforeSSTDelete)
+		if err := fsio.DeleteRetry(node.GetFilename()); err != nil {
+			return 0, err
+		}
+		t.manifest.Forget(node.GetLevel(), uint32(node.GetSeq()))
+	}
+	return t.compactionDebt(), nil
+}
+
+// compactLevel 将inputs和下一层的overlaps合并后按CompactionFileSize拆分写入若干个文件，返回完成后剩余的压缩债务。
+// 不是最底层时输出文件写入下一层；最底层时在层内合并，输出文件数不超过使该层回到上限以内的数量。
+// 输出文件都使用新的序列号，并丢弃输出层的其余文件和更深的层中都不存在对应key且不在TombstoneRetention保留期内的删除标记。
+// 所有输出文件写入并重命名后，由一次清单修改加入全部输出并移除全部输入，见writeCompactionOutputs。
+// now不为0时在now之前过期的条目按删除标记处理
+func (t *LsmTree) compactLevel(level int, inputs, overlaps []*sst.Node, now int64) (int64, error) {
+	start := t.conf.Now()
+	defer func() { t.recordLatency(LatencyCompaction, t.conf.Since(start)) }()
+	// overlaps位于更深的层，比inputs更旧
+	removed := slices.Concat(overlaps, inputs)
+
+	target, maxOutputs := level+1, 0
+	// 只有压缩goroutine会移除节点，合并期间输出层和更深的层只会加入更新的文件
+	t.mu.RLock()
+	if level == len(t.nodes)-1 {
+		target = level
+		maxOutputs = max(1, t.maxFiles(level)-(len(t.nodes[level])-len(inputs)))
+	}
+	others := slices.DeleteFunc(slices.Clone(t.nodes[target]), func(node *sst.Node) bool {
+		return slices.Contains(removed, node)
+	})
+	deeper := slices.Concat(append([][]*sst.Node{others}, t.nodes[target+1:]...)...)
+	t.mu.RUnlock()
+
+	merged, err := newMergeIterator(removed, t.levels.copyEntries)
+	if err != nil {
+		return 0, err
+	}
+	keep := func(entry kv.Entry) (kv.Entry, bool) {
+		// 旧版本写入的空key无法读取或删除，压缩时丢弃
+		if len(entry.Key) == 0 {
+			return entry, false
+		}
+		if now != 0 {
+			entry = expire(entry, now)
+		}
+		return entry, !entry.IsDelete() || mayContain(deeper, entry.Key) || t.tombstoneRetained(entry)
+	}
+	outputs, err := t.writeCompactionOutputs(target, merged, outputFileSize(t.conf.CompactionFileSize, removed, maxOutputs), keep)
+	if err != nil {
+		return 0, err
+	}
+	debt, err := t.installCompaction(removed, outputs)
+	if err != nil {
+		for _, output := range outputs {
+			output.Reader().Close()
+			fsio.DeleteRetry(output.GetFilename())
+		}
+		return 0, err
+	}
+	t.recordCompaction(config.CompactionRewrite, level, target, removed, outputs, start)
+	if t.conf.ParanoidChecks {
+		t.mu.RLock()
+		err = t.checkLevelRanges()
+		t.mu.RUnlock()
+	}
+	return debt, err
+}
+
+// outputFileSize 返回每个输出文件中key和value的目标字节数，size<=0时不拆分。maxOutputs大于0时增大目标，
+// 使输出文件数不超过maxOutputs：合并是流式的，事先不知道输出的总量，按输入文件属性中key和value的总字节数估计，
+// 合并丢弃的旧版本和删除标记只会使输出更少；没有记录属性的旧文件按文件大小估计
+func outputFileSize(size int64, inputs []*sst.Node, maxOutputs int) int64 {
+	if size <= 0 || maxOutputs <= 0 {
+		return size
+	}
+	var total int64
+	for _, node := range inputs {
+		props := node.Reader().Properties()
+		if raw := props.RawKeyBytes + props.RawValueBytes; raw > 0 {
+			total += raw
+		} else {
+			total += node.GetSize()
+		}
+	}
+	return max(size, (total+int64(maxOutputs)-1)/int64(maxOutputs))
+}
+
+// writeCompactionOutputs 将merged合并出的条目经keep过滤后依次写入target层使用新序列号的文件，当前文件中的key和value
+// 超过size字节时切换到下一个文件，单个超出的条目独占一个文件，size<=0时不拆分。条目比较后直接交给写入器，
+// 不经过中间的副本。先把所有文件写入临时文件并fsync，再依次重命名为正式文件名，之后由installCompaction一次记入清单。
+// 断电时临时文件和清单尚未记录的输出文件在重启时作为孤儿删除，输入文件保持不变；清单记录后输入文件的删除同样在重启时完成。
+// 任何一步失败时删除已经写入的所有文件；所有条目都被丢弃时不生成文件
+func (t *LsmTree) writeCompactionOutputs(target int, merged *mergeIterator, size int64,
+	keep func(entry kv.Entry) (kv.Entry, bool)) (outputs []*sst.Node, err error) {
+	var written []string
+	var writer *sst.SSTWriter
+	defer func() {
+		if err == nil {
+			return
+		}
+		if writer != nil {
+			writer.Close()
+		}
+		for _, output := range outputs {
+			output.Reader().Close()
+		}
+		for _, path := range written {
+			fsio.DeleteRetry(path)
+		}
+		outputs = nil
+	}()
+	var paths []string
+	var seqs []uint32
+	var filled, entries int64
+	finish := func() error {
+		err := t.finishRewriteWriter(writer)
+		writer = nil
+		if err != nil {
+			return err
+		}
+		t.conf.Crash(config.CrashAfterSSTTmpWrite)
+		return nil
+	}
+	for merged.Next() {
+		entry, ok := keep(merged.Entry())
+		if !ok {
+			continue
+		}
+		n := int64(len(entry.Key) + len(entry.Value))
+		if writer != nil && size > 0 && entries > 0 && filled+n > size {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+		if writer == nil {
+			seq := t.nextSSTSeq(target)
+			path := t.getSSTFilePath(target, seq)
+			seqs, paths = append(seqs, seq), append(paths, path)
+			written = append(written, path+sstTmpSuffix)
+			if writer, err = t.newRewriteWriter(path+sstTmpSuffix, target); err != nil {
+				return nil, err
+			}
+			filled, entries = 0, 0
+		}
+		if err := writer.AddEntry(entry); err != nil {
+			return nil, err
+		}
+		filled += n
+		entries++
+	}
+	if err := merged.Error(); err != nil {
+		return nil, err
+	}
+	if writer != nil {
+		if err := finish(); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range paths {
+		written = append(written, path)
+		if err := t.renameSST(path+sstTmpSuffix, path); err != nil {
+			return nil, err
+		}
+		t.conf.Crash(config.CrashAfterSSTRename)
+	}
+	for i, path := range paths {
+		output, err := t.openSSTNode(path, target, seqs[i])
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+// installCompaction 在写锁内以一次清单修改移除removed并加入outputs，之后关闭并删除被移除的文件，
+// 返回剩余的压缩债务。读取方在清单修改成功后才看到新的文件集合；outputs为空表示所有条目都被丢弃
+func (t *LsmTree) installCompaction(removed, outputs []*sst.Node) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	edits := make([]manifest.Edit, 0, len(removed)+len(outputs))
+	for _, node := range removed {
+		if !slices.Contains(t.nodes[node.GetLevel()], node) {
+			return 0, fmt.Errorf("sst %s is no longer in level %d", node.GetFilename(), node.GetLevel())
+		}
+		edits = append(edits, manifest.DeleteFile(node.GetLevel(), uint32(node.GetSeq())))
+	}
+	if len(outputs) > 0 && outputs[0].GetLevel() == 0 && !t.l0OrderKept(removed, outputs) {
+		return 0, errCompactionStale
+	}
+	for _, output := range outputs {
+		edits = append(edits, manifest.AddFile(t.manifestFileMeta(output)))
+	}
+	if err := t.manifest.Apply(edits...); err != nil {
+		return 0, err
+	}
+
+	for level := range t.nodes {
+		t.nodes[level] = slices.DeleteFunc(t.nodes[level], func(node *sst.Node) bool {
+			return slices.Contains(removed, node)
+		})
+	}
+	if len(outputs) > 0 {
+		// 输出文件平分输入文件的热度，读取方已释放读锁，不会再累加到被移除的文件上
+		var heat uint64
+		for _, node := range removed {
+			heat += node.Heat()
+		}
+		for _, output := range outputs {
+			output.AddHeat(heat / uint64(len(outputs)))
+		}
+		t.addNodes(outputs[0].GetLevel(), outputs...)
+	}
+	t.setL0Files()
+	// 读取方在持有读锁期间使用节点，持有写锁时已没有读取方
+	for _, node := range removed {
+		if err := node.Reader().Close(); err != nil {
+			t.conf.Warnf("close compacted sst %s: %v", node.GetFilename(), err)
+		}
+		// 删除前崩溃时，清单中已记录删除的文件会在重启时被删除
+		t.conf.Crash(config.CrashBeforeSSTDelete)
+		if err := fsio.DeleteRetry(node.GetFilename()); err != nil {
+			return 0, err
+		}
+		t.manifest.Forget(node.GetLevel(), uint32(node.GetSeq()))
+	}
+	return t.compactionDebt(), nil
+}
@@ -0,0 +1,675 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func TestLevelState_PickLevel(t *testing.T) {
+	var s levelState
+	for i, c := range []struct {
+		scores []float64
+		want   int
+	}{
+		{[]float64{3, 2, 1.5}, 0},
+		// L0仍然超出最多，但本轮已经压缩过，依次轮到L1和L2
+		{[]float64{4, 2, 1.5}, 1},
+		{[]float64{4, 3, 1.5}, 2},
+		// 所有超出上限的层级都压缩过，开始新的一轮
+		{[]float64{4, 3, 1.5}, 0},
+		{[]float64{1, 1.5, 1.5}, 1}, // 比例相同时选择较浅的层级
+		{[]float64{1, 0.5, 1}, -1},
+		// 没有超出上限的层级时本轮结束，L0可以再次被选中
+		{[]float64{2, 0, 0}, 0},
+	} {
+		if got := s.pickLevel(c.scores); got != c.want {
+			t.Fatalf("step %d: pickLevel(%v) = %d, want %d", i, c.scores, got, c.want)
+		}
+	}
+}
+
+// levelCompactionRecorder 记录OnLevelCompaction的调用
+type levelCompactionRecorder struct {
+	mu     sync.Mutex
+	levels []int
+	debts  []int64
+}
+
+func (r *levelCompactionRecorder) record(level int, debt int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.levels = append(r.levels, level)
+	r.debts = append(r.debts, debt)
+}
+
+// wait 等待OnLevelCompaction被调用n次
+func (r *levelCompactionRecorder) wait(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		r.mu.Lock()
+		got := len(r.levels)
+		r.mu.Unlock()
+		if got >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("OnLevelCompaction was not called %d times in time", n)
+}
+
+// waitLevelCompactions 等待各层都回到文件数上限以内
+func waitLevelCompactions(t *testing.T, tree *LsmTree) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		tree.mu.RLock()
+		done := tree.compactionDebt() == 0
+		tree.mu.RUnlock()
+		if done {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("levels were not compacted within their limits in time")
+}
+
+func TestLsmTree_LevelCompaction(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	conf.MaxFilesPerLevel = []int{2, 2, 2}
+	recorder := &levelCompactionRecorder{}
+	conf.OnLevelCompaction = recorder.record
+
+	span := func(prefix string, n int, value string) map[string]string {
+		kvs := make(map[string]string)
+		for i := 0; i < n; i++ {
+			kvs[fmt.Sprintf("%s%d", prefix, i)] = value
+		}
+		return kvs
+	}
+	// L2超出上限1.5倍，L1在上限内，L0超出上限2倍
+	writeLevelSST(t, conf, 2, 1, span("a", 10, "L2"))
+	writeLevelSST(t, conf, 2, 2, span("b", 10, "L2"))
+	writeLevelSST(t, conf, 2, 3, span("c", 10, "L2"))
+	writeLevelSST(t, conf, 1, 1, span("a", 5, "L1"))
+	writeLevelSST(t, conf, 1, 2, span("c", 5, "L1"))
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a0": "L0-1", "a1": "L0-1"})
+	writeLevelEntries(t, conf, 0, 2, []kv.Entry{{Key: []byte("a1"), Kind: kv.KindDelete}})
+	writeLevelSST(t, conf, 0, 3, map[string]string{"c0": "L0-3"})
+	writeLevelSST(t, conf, 0, 4, map[string]string{"b0": "L0-4"})
+
+	want := map[string]string{
+		"a0": "L0-1", "a1": "", "a2": "L1", "a5": "L2",
+		"b0": "L0-4", "b5": "L2",
+		"c0": "L0-3", "c2": "L1", "c7": "L2",
+	}
+	check := func(tree *LsmTree) {
+		t.Helper()
+		for key, value := range want {
+			got, err := tree.Get([]byte(key))
+			if value == "" {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Errorf("Get(%s) = %q, %v, want deleted", key, got, err)
+				}
+				continue
+			}
+			if err != nil || string(got) != value {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, value)
+			}
+		}
+		for _, level := range tree.Levels() {
+			if len(level.Files) > 2 {
+				t.Errorf("level %d has %d files, limit 2", level.Level, len(level.Files))
+			}
+		}
+	}
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.wait(t, 2)
+	check(tree)
+
+	// 先压缩超出比例最大的L0，其最旧的两个文件与L1中的a文件合并后写入L1，之后在层内合并L2最旧的两个文件
+	recorder.mu.Lock()
+	if fmt.Sprint(recorder.levels) != "[0 2]" {
+		t.Fatalf("compacted levels %v, want [0 2]", recorder.levels)
+	}
+	for i, debt := range recorder.debts {
+		if (i > 0 && debt >= recorder.debts[i-1]) || debt < 0 {
+			t.Fatalf("compaction debt did not decrease: %v", recorder.debts)
+		}
+	}
+	if recorder.debts[len(recorder.debts)-1] != 0 {
+		t.Fatalf("compaction debt after compactions %v, want 0", recorder.debts)
+	}
+	recorder.mu.Unlock()
+	stats := tree.Stats()
+	if stats.CompactionDebt != 0 || stats.LevelCompactions != 2 || stats.LevelCompactionBytes <= 0 {
+		t.Fatalf("stats CompactionDebt=%d LevelCompactions=%d LevelCompactionBytes=%d",
+			stats.CompactionDebt, stats.LevelCompactions, stats.LevelCompactionBytes)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 压缩结果已记入清单，重新打开后不需要再压缩
+	conf.OnLevelCompaction = func(level int, debt int64) {
+		t.Errorf("unexpected compaction of level %d after reopen", level)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check(tree)
+}
+
+// TestLsmTree_LevelCompactionL0 WAL很小、频繁刷盘时L0文件数保持在上限附近，达到L0StopTrigger的写入由层级压缩恢复
+func TestLsmTree_LevelCompactionL0(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 256
+	conf.LevelSize = 2
+	conf.MaxFilesPerLevel = []int{4}
+	conf.L0StopTrigger = 8
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for i := 0; i < 500; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%03d", i%200)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	waitLevelCompactions(t, tree)
+	if n := tree.Stats().L0Files; n > 4 {
+		t.Fatalf("L0Files = %d, limit 4", n)
+	}
+	for i := 300; i < 500; i++ {
+		key := fmt.Sprintf("key%03d", i%200)
+		if value, err := tree.Get([]byte(key)); err != nil || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+	if stats := tree.Stats(); stats.LevelCompactions+stats.LevelTrivialMoves == 0 {
+		t.Fatal("no level compaction ran")
+	}
+}
+
+// 不设置MaxFilesPerLevel时不进行层级压缩
+func TestLsmTree_LevelCompactionDisabled(t *testing.T) {
+	conf := newTestConfig(t)
+	for seq := uint32(1); seq <= 5; seq++ {
+		writeLevelSST(t, conf, 0, seq, map[string]string{"a": fmt.Sprint(seq)})
+	}
+	conf.OnLevelCompaction = func(level int, debt int64) {
+		t.Errorf("unexpected compaction of level %d", level)
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	tree.runLevelCompaction()
+	if stats := tree.Stats(); stats.L0Files != 5 || stats.CompactionDebt != 0 {
+		t.Fatalf("L0Files=%d CompactionDebt=%d", stats.L0Files, stats.CompactionDebt)
+	}
+}
+
+// TestLsmTree_TrivialMove L0最旧的文件与L1不重叠时直接平移到L1：只修改清单和文件名，不读取数据区域，
+// 平移后的节点沿用原读取器，之后的读取和重启后的读取都正确
+func TestLsmTree_TrivialMove(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	conf.MaxFilesPerLevel = []int{2, 2, 2}
+	// 启用数据块缓存时打开文件不加载数据块，读取器读到的数据区域字节数只来自查询和压缩
+	conf.BlockCacheSize = 1 << 20
+	events := make(chan CompactionEvent, 4)
+	conf.OnCompactionEvent = func(event CompactionEvent) { events <- event }
+	recorder := &levelCompactionRecorder{}
+	conf.OnLevelCompaction = recorder.record
+	writeLevelSST(t, conf, 1, 1, map[string]string{"m0": "L1", "m1": "L1"})
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a0": "L0-1", "a1": "L0-1"})
+	writeLevelSST(t, conf, 0, 2, map[string]string{"b0": "L0-2", "m0": "L0-2"})
+	writeLevelSST(t, conf, 0, 3, map[string]string{"c0": "L0-3"})
+	want := map[string]string{"a0": "L0-1", "a1": "L0-1", "b0": "L0-2", "c0": "L0-3", "m0": "L0-2", "m1": "L1"}
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event CompactionEvent
+	select {
+	case event = <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatal("level 0 was not compacted")
+	}
+	recorder.wait(t, 1)
+	if event.Type != config.CompactionTrivialMove || event.Level != 0 || event.OutputLevel != 1 ||
+		event.InputFiles != 1 || event.OutputFiles != 1 || event.InputBytes != event.OutputBytes {
+		t.Fatalf("compaction event %+v, want one L0 file moved to L1", event)
+	}
+	stats := tree.Stats()
+	if stats.LevelTrivialMoves != 1 || stats.LevelTrivialMoveBytes != event.InputBytes || stats.LevelCompactions != 0 {
+		t.Fatalf("stats LevelTrivialMoves=%d LevelTrivialMoveBytes=%d LevelCompactions=%d",
+			stats.LevelTrivialMoves, stats.LevelTrivialMoveBytes, stats.LevelCompactions)
+	}
+	if io := stats.LevelIO(); io[0].BytesRead != 0 || io[1].BytesWritten != 0 {
+		t.Fatalf("LevelIO() = %+v, want no bytes read or written by the move", io)
+	}
+
+	tree.mu.RLock()
+	var moved *sst.Node
+	for _, node := range tree.nodes[1] {
+		if string(node.GetMinKey()) == "a0" {
+			moved = node
+		}
+	}
+	l0 := len(tree.nodes[0])
+	tree.mu.RUnlock()
+	if moved == nil || l0 != 2 {
+		t.Fatalf("moved file not found in L1, %d L0 files", l0)
+	}
+	if read := moved.Reader().DataBytesRead(); read != 0 {
+		t.Fatalf("trivial move read %d bytes of the data region", read)
+	}
+	if moved.Reader().Path() != moved.GetFilename() {
+		t.Fatalf("reader path %s, want %s", moved.Reader().Path(), moved.GetFilename())
+	}
+	if _, err := os.Stat(filepath.Join(conf.DataDir, conf.SSTDir, "0_1.sst")); !os.IsNotExist(err) {
+		t.Fatalf("moved L0 file still exists: %v", err)
+	}
+
+	check := func(tree *LsmTree) {
+		t.Helper()
+		for key, value := range want {
+			if got, err := tree.Get([]byte(key)); err != nil || string(got) != value {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, value)
+			}
+		}
+	}
+	check(tree)
+	if moved.Reader().DataBytesRead() == 0 {
+		t.Fatal("Get on the moved file did not read its data region")
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 清单记录了平移后的文件名和层级
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check(tree)
+	if levels := tree.Levels(); len(levels[0].Files) != 2 || len(levels[1].Files) != 2 {
+		t.Fatalf("got %d L0 and %d L1 files after reopen, want 2 and 2", len(levels[0].Files), len(levels[1].Files))
+	}
+}
+
+// TestLsmTree_AccessSampling 并发读取少量热点key后，文件热度反映读取的倾斜，层级压缩把较冷的文件移到下一层
+func TestLsmTree_AccessSampling(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	conf.RowCacheSize = 0
+	conf.AccessSampling = 4
+	span := func(prefix string) map[string]string {
+		kvs := make(map[string]string)
+		for i := 0; i < 10; i++ {
+			kvs[fmt.Sprintf("%s%d", prefix, i)] = prefix
+		}
+		return kvs
+	}
+	// L1中的三个文件互不重叠，a最旧
+	for i, prefix := range []string{"a", "b", "c"} {
+		writeLevelSST(t, conf, 1, uint32(i+1), span(prefix))
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// a最热，c的读取次数约是b的8倍，采样的误差不会改变b和c的冷热顺序。
+			// 周期与采样间隔互质，b和c的读取不会总是落在或总是避开采样点
+			for i := 0; i < 4000; i++ {
+				key := fmt.Sprintf("a%d", i%3)
+				switch {
+				case i%201 == 0:
+					key = fmt.Sprintf("b%d", i/201%10)
+				case i%21 == 0:
+					key = fmt.Sprintf("c%d", i/21%10)
+				}
+				if _, err := tree.Get([]byte(key)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	heat := make(map[uint32]uint64)
+	var total uint64
+	stats := tree.Stats()
+	for _, file := range stats.FileHeat {
+		heat[file.Seq] = file.Heat
+		total += file.Heat
+	}
+	if len(stats.FileHeat) != 3 || total != stats.Gets/4 || heat[1] < 10*(heat[2]+heat[3]) || heat[2] >= heat[3] {
+		t.Fatalf("file heat %+v after %d gets", stats.FileHeat, stats.Gets)
+	}
+
+	// 最热的a文件最旧，但L1超出上限时先移走较冷的b文件
+	tree.mu.Lock()
+	conf.MaxFilesPerLevel = []int{0, 2}
+	inputs, overlaps := tree.compactionInputs(1)
+	tree.mu.Unlock()
+	if len(inputs) != 1 || inputs[0].GetSeq() != 2 || len(overlaps) != 0 {
+		t.Fatalf("compaction inputs %v, overlaps %v, want only the b file", inputs, overlaps)
+	}
+	coldHeat := heat[2]
+	tree.signalLevelCompaction()
+	waitLevelCompactions(t, tree)
+	levels := tree.Levels()
+	if len(levels[1].Files) != 2 || levels[1].Files[0].Seq != 1 || len(levels[2].Files) != 1 {
+		t.Fatalf("levels after compaction: %+v", levels)
+	}
+	// 压缩输出继承输入文件的热度
+	for _, file := range tree.Stats().FileHeat {
+		if file.Level == 2 && file.Heat != coldHeat {
+			t.Fatalf("compacted file heat %d, want %d", file.Heat, coldHeat)
+		}
+	}
+
+	// 不采样时不统计热度，压缩仍然先移走最旧的文件
+	conf = newTestConfig(t)
+	conf.LevelSize = 3
+	for i, prefix := range []string{"a", "b", "c"} {
+		writeLevelSST(t, conf, 1, uint32(i+1), span(prefix))
+	}
+	plain, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if _, err := plain.Get([]byte("a0")); err != nil {
+		t.Fatal(err)
+	}
+	plain.mu.Lock()
+	conf.MaxFilesPerLevel = []int{0, 2}
+	inputs, _ = plain.compactionInputs(1)
+	plain.mu.Unlock()
+	if stats := plain.Stats(); stats.FileHeat != nil || len(inputs) != 1 || inputs[0].GetSeq() != 1 {
+		t.Fatalf("without sampling: file heat %+v, inputs %v", stats.FileHeat, inputs)
+	}
+}
+
+// TestLsmTree_LevelCompactionCrash 压缩输出拆分为多个文件时，在每个写入步骤断电后重启，
+// 看到的是完整的旧文件集合或完整的新文件集合，不会混合
+func TestLsmTree_LevelCompactionCrash(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	conf.MaxFilesPerLevel = []int{2}
+	conf.CompactionFileSize = 64
+	recorder := &levelCompactionRecorder{}
+	conf.OnLevelCompaction = recorder.record
+
+	want := make(map[string]string)
+	l1 := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		l1[fmt.Sprintf("key%02d", i)] = "L1"
+		want[fmt.Sprintf("key%02d", i)] = "L1"
+	}
+	writeLevelSST(t, conf, 1, 1, l1)
+	for seq := uint32(1); seq <= 3; seq++ {
+		l0 := make(map[string]string)
+		for i := int(seq); i < 20; i += 3 {
+			l0[fmt.Sprintf("key%02d", i)] = fmt.Sprintf("L0-%d", seq)
+			want[fmt.Sprintf("key%02d", i)] = fmt.Sprintf("L0-%d", seq)
+		}
+		writeLevelSST(t, conf, 0, seq, l0)
+	}
+	before := sstNames(t, conf)
+
+	// 每次执行到崩溃位置时复制数据目录
+	var snapshots []string
+	points := make(map[string]int)
+	conf.Hooks = &config.TestHooks{Crash: func(point string) {
+		points[point]++
+		snapshot := filepath.Join(t.TempDir(), fmt.Sprintf("%s-%d", point, points[point]))
+		copyDir(t, conf.DataDir, snapshot)
+		snapshots = append(snapshots, snapshot)
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.wait(t, 1)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after := sstNames(t, conf)
+	if len(after) < 4 {
+		t.Fatalf("sst files after compaction %v, want the L1 output split into several files", after)
+	}
+	for _, point := range []string{config.CrashAfterSSTTmpWrite, config.CrashAfterSSTRename, config.CrashBeforeSSTDelete} {
+		if points[point] < 2 {
+			t.Fatalf("crash point %s reached %d times, want one per file", point, points[point])
+		}
+	}
+
+	for _, snapshot := range snapshots {
+		crashed := newTestConfig(t)
+		crashed.DataDir = snapshot
+		recovered, err := NewLsmTree(crashed)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(snapshot), err)
+		}
+		names := sstNames(t, crashed)
+		if !slices.Equal(names, before) && !slices.Equal(names, after) {
+			t.Fatalf("%s: recovered sst files %v, want %v or %v", filepath.Base(snapshot), names, before, after)
+		}
+		for key, value := range want {
+			if got, err := recovered.Get([]byte(key)); err != nil || string(got) != value {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", filepath.Base(snapshot), key, got, err, value)
+			}
+		}
+		if err := recovered.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeCompactionInputs 在conf.DataDir中写入一个L1文件和三个与之重叠的L0文件，共约n个条目，包含删除标记、
+// 跨越数据块的同一个key的多个版本以及大小不一的value，返回合并后每个key应有的值，删除的key为空串
+func writeCompactionInputs(tb testing.TB, conf *config.Config, n int) map[string]string {
+	tb.Helper()
+	key := func(i int) string { return fmt.Sprintf("key%08d", i) }
+	value := func(i int, tag string) string { return tag + strings.Repeat("v", i%37) }
+	want := make(map[string]string)
+	l1 := make([]kv.Entry, 0, n/2)
+	for i := 0; i < n; i += 2 {
+		l1 = append(l1, kv.Entry{Key: []byte(key(i)), Value: []byte(value(i, "L1")), Kind: kv.KindPut})
+		want[key(i)] = value(i, "L1")
+	}
+	writeLevelEntries(tb, conf, 1, 1, l1)
+	for seq := uint32(1); seq <= 2; seq++ {
+		l0 := make([]kv.Entry, 0, n/4)
+		for i := int(seq); i < n; i += 4 {
+			entry := kv.Entry{Key: []byte(key(i)), Value: []byte(value(i, fmt.Sprintf("L0-%d", seq))), Kind: kv.KindPut}
+			if i%5 == 0 {
+				entry = kv.Entry{Key: []byte(key(i - 1)), Kind: kv.KindDelete}
+			}
+			l0 = append(l0, entry)
+			want[string(entry.Key)] = string(entry.Value)
+		}
+		writeLevelEntries(tb, conf, 0, seq, l0)
+	}
+	// 最新的文件中每个key有多个版本，最后写入的版本生效
+	writer, err := sst.NewSSTWriter(conf, filepath.Join(conf.SSTPath(), "0_3.sst"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	writer.SetAllowDuplicateKeys(true)
+	for i := 0; i < n; i += 97 {
+		for version := 0; version < 3; version++ {
+			if err := writer.Add([]byte(key(i)), []byte(value(i, fmt.Sprintf("dup-%d", version)))); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		want[key(i)] = value(i, "dup-2")
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return want
+}
+
+// compactL0 打开conf.DataDir中的LSM树，将L0的所有文件与L1中重叠的文件合并，copyEntries指定是否复制每个条目
+func compactL0(tb testing.TB, conf *config.Config, copyEntries bool) *LsmTree {
+	tb.Helper()
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tree.levels.copyEntries = copyEntries
+	tree.mu.Lock()
+	inputs := slices.Clone(tree.nodes[0])
+	overlaps := tree.nextLevelOverlaps(0, inputs)
+	tree.mu.Unlock()
+	if _, err := tree.compactLevel(0, inputs, overlaps, 0); err != nil {
+		tb.Fatal(err)
+	}
+	return tree
+}
+
+// 合并时引用迭代器的缓冲区与复制每个条目生成的输出文件逐字节相同
+func TestLsmTree_CompactionReuseIdentical(t *testing.T) {
+	newConf := func(dir string) *config.Config {
+		conf := newTestConfig(t)
+		conf.DataDir = dir
+		conf.Clock = &manualClock{now: time.Unix(1700000000, 0)}
+		conf.LevelSize = 3
+		conf.BlockEntryLimit = 8
+		conf.CompactionFileSize = 4 << 10
+		return conf
+	}
+	template := newConf(t.TempDir())
+	want := writeCompactionInputs(t, template, 2000)
+
+	outputs := make(map[bool]map[string][]byte)
+	for _, copyEntries := range []bool{true, false} {
+		conf := newConf(t.TempDir())
+		copyDir(t, template.DataDir, conf.DataDir)
+		tree := compactL0(t, conf, copyEntries)
+		if files := tree.Levels()[0].Files; len(files) != 0 {
+			t.Fatalf("copyEntries=%v: L0 files after compaction %v", copyEntries, files)
+		}
+		for key, value := range want {
+			got, err := tree.Get([]byte(key))
+			if value == "" {
+				if !errors.Is(err, ErrKeyNotFound) {
+					t.Fatalf("copyEntries=%v: Get(%s) = %q, %v, want deleted", copyEntries, key, got, err)
+				}
+				continue
+			}
+			if err != nil || string(got) != value {
+				t.Fatalf("copyEntries=%v: Get(%s) = %q, %v, want %q", copyEntries, key, got, err, value)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files := make(map[string][]byte)
+		for _, name := range sstNames(t, conf) {
+			data, err := os.ReadFile(filepath.Join(conf.SSTPath(), name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[name] = data
+		}
+		outputs[copyEntries] = files
+	}
+	if len(outputs[true]) < 2 {
+		t.Fatalf("compaction wrote %d files, want the output split into several files", len(outputs[true]))
+	}
+	if len(outputs[true]) != len(outputs[false]) {
+		t.Fatalf("copied output %d files, reused output %d files", len(outputs[true]), len(outputs[false]))
+	}
+	for name, data := range outputs[true] {
+		if !bytes.Equal(outputs[false][name], data) {
+			t.Fatalf("%s differs between copied and reused compaction", name)
+		}
+	}
+}
+
+// BenchmarkLsmTree_LevelCompaction1M 合并约100万个条目，比较复制每个条目与引用迭代器缓冲区的分配次数
+func BenchmarkLsmTree_LevelCompaction1M(b *testing.B) {
+	template := config.DefaultConfig()
+	template.DataDir = b.TempDir()
+	template.IsDebug = false
+	template.LevelSize = 3
+	// 使用数据块缓存时打开输出文件不解码全部数据块，分配次数只反映合并和写入
+	template.BlockCacheSize = 8 << 20
+	writeCompactionInputs(b, template, 1000000)
+
+	for _, copyEntries := range []bool{true, false} {
+		b.Run(fmt.Sprintf("copyEntries=%v", copyEntries), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				conf := *template
+				conf.DataDir = b.TempDir()
+				copyDir(b, template.DataDir, conf.DataDir)
+				tree, err := NewLsmTree(&conf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				tree.levels.copyEntries = copyEntries
+				tree.mu.Lock()
+				inputs := slices.Clone(tree.nodes[0])
+				overlaps := tree.nextLevelOverlaps(0, inputs)
+				tree.mu.Unlock()
+				// 读取器在第一次访问时才加载，先加载完，只计入合并本身的分配
+				for _, node := range slices.Concat(inputs, overlaps) {
+					if _, err := node.Reader().GetIterator(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StartTimer()
+				if _, err := tree.compactLevel(0, inputs, overlaps, 0); err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				tree.Close()
+				b.StartTimer()
+			}
+		})
+	}
+}
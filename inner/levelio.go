@@ -0,0 +1,128 @@
+package inner
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// compactionHistory Stats.RecentCompactions保留的压缩事件数
+const compactionHistory = 32
+
+// CompactionEvent 一次压缩的读写量，见config.CompactionEvent
+type CompactionEvent = config.CompactionEvent
+
+// LevelIO 一层的刷盘和压缩读写量，用于估计磁盘容量和IO余量
+type LevelIO struct {
+	Level        int   // 层级
+	BytesRead    int64 // 作为压缩输入从该层读取的文件字节数，重启后继续累计
+	BytesWritten int64 // 刷盘和压缩写入该层的文件字节数，重启后继续累计
+	LiveBytes    int64 // 当前该层文件的总大小
+}
+
+// levelIOCounters 按层级累计的读写量和最近的压缩事件，计数器与writeCounters一起持久化
+type levelIOCounters struct {
+	read    []atomic.Int64 // 按层级累计的压缩输入字节数
+	written []atomic.Int64 // 按层级累计的刷盘和压缩输出字节数
+
+	mu     sync.Mutex
+	events []CompactionEvent // 最近的压缩事件，写满后从next处覆盖最旧的事件
+	next   int
+}
+
+// init 为levelSize个层级分配计数器
+func (c *levelIOCounters) init(levelSize int) {
+	c.read = make([]atomic.Int64, levelSize)
+	c.written = make([]atomic.Int64, levelSize)
+}
+
+// load 恢复检查点中保存的计数器，层数改变时只恢复仍然存在的层级
+func (c *levelIOCounters) load(read, written []int64) {
+	for level := range min(len(read), len(c.read)) {
+		c.read[level].Store(read[level])
+	}
+	for level := range min(len(written), len(c.written)) {
+		c.written[level].Store(written[level])
+	}
+}
+
+// snapshot 返回各层累计的读取和写入字节数
+func (c *levelIOCounters) snapshot() (read, written []int64) {
+	read, written = make([]int64, len(c.read)), make([]int64, len(c.written))
+	for level := range c.read {
+		read[level] = c.read[level].Load()
+		written[level] = c.written[level].Load()
+	}
+	return read, written
+}
+
+// addWritten 累计写入level层的字节数
+func (c *levelIOCounters) addWritten(level int, n int64) {
+	if level < len(c.written) {
+		c.written[level].Add(n)
+	}
+}
+
+// addEvent 记录一次压缩事件，只保留最近的compactionHistory个
+func (c *levelIOCounters) addEvent(event CompactionEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.events) < compactionHistory {
+		c.events = append(c.events, event)
+		return
+	}
+	c.events[c.next] = event
+	c.next = (c.next + 1) % compactionHistory
+}
+
+// recentEvents 按完成顺序从旧到新返回最近的压缩事件
+func (c *levelIOCounters) recentEvents() []CompactionEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.events) == 0 {
+		return nil
+	}
+	events := make([]CompactionEvent, 0, len(c.events))
+	events = append(events, c.events[c.next:]...)
+	return append(events, c.events[:c.next]...)
+}
+
+// recordCompaction 累计一次压缩从各层读取的removed和写入outputLevel的outputs，记录压缩事件并调用OnCompactionEvent，
+// 之后与写入量计数器一起持久化。level为输入文件所在的最浅层级，start为压缩开始的时间。
+// 平移没有读写数据，只记录事件，不计入各层的读写量
+func (t *LsmTree) recordCompaction(typ config.CompactionType, level, outputLevel int, removed, outputs []*sst.Node, start time.Time) {
+	event := CompactionEvent{
+		Time:        t.conf.Now(),
+		Duration:    t.conf.Since(start),
+		Type:        typ,
+		Level:       level,
+		OutputLevel: outputLevel,
+		InputFiles:  len(removed),
+		InputBytes:  nodesSize(removed),
+		OutputFiles: len(outputs),
+		OutputBytes: nodesSize(outputs),
+	}
+	if typ != config.CompactionTrivialMove {
+		for _, node := range removed {
+			if node.GetLevel() < len(t.levelIO.read) {
+				t.levelIO.read[node.GetLevel()].Add(node.GetSize())
+			}
+		}
+		t.levelIO.addWritten(outputLevel, event.OutputBytes)
+	}
+	t.levelIO.addEvent(event)
+	if t.conf.OnCompactionEvent != nil {
+		t.conf.OnCompactionEvent(event)
+	}
+	if err := t.saveWriteCounters(); err != nil {
+		t.conf.Warnf("save write counters: %v", err)
+	}
+}
+
+// LevelIO 返回各层的刷盘和压缩读写量以及当前的文件总大小，按层级排列
+func (s Stats) LevelIO() []LevelIO {
+	return append([]LevelIO(nil), s.levelIO...)
+}
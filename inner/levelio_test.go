@@ -0,0 +1,119 @@
+package inner
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// TestLsmTree_LevelIO 依次刷盘四个L0文件，第三个使L0超出上限，最旧的文件与L1不重叠，平移到L1；
+// 第四个使L0再次超出上限，次旧的文件与平移的文件key范围相同，两者合并后写入L1。平移不计入读写量，
+// 各层的读写量等于合并读取和写入的文件的实际大小，重启后继续累计，最近的压缩事件只保留在内存中
+func TestLsmTree_LevelIO(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	conf.MaxFilesPerLevel = []int{2}
+	events := make(chan CompactionEvent, 2)
+	conf.OnCompactionEvent = func(event CompactionEvent) { events <- event }
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() CompactionEvent {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(10 * time.Second):
+			t.Fatal("level 0 was not compacted")
+		}
+		return CompactionEvent{}
+	}
+	var flushed []int64
+	var moved, event CompactionEvent
+	for file := 0; file < 4; file++ {
+		for i := 0; i < 20; i++ {
+			// 前两个文件写入相同的key
+			if err := tree.Put([]byte(fmt.Sprintf("key-%d-%02d", max(file, 1), i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushAll(t, tree)
+		l0 := tree.Levels()[0].Files
+		flushed = append(flushed, l0[len(l0)-1].Size)
+		switch file {
+		case 2:
+			moved = next()
+			waitLevelCompactions(t, tree)
+		case 3:
+			event = next()
+			waitLevelCompactions(t, tree)
+		}
+	}
+
+	levels := tree.Levels()
+	if len(levels[0].Files) != 2 || len(levels[1].Files) != 1 {
+		t.Fatalf("got %d L0 and %d L1 files, want 2 and 1", len(levels[0].Files), len(levels[1].Files))
+	}
+	if moved.Type != config.CompactionTrivialMove || moved.Level != 0 || moved.OutputLevel != 1 ||
+		moved.InputFiles != 1 || moved.InputBytes != flushed[0] || moved.OutputFiles != 1 || moved.OutputBytes != flushed[0] {
+		t.Fatalf("first compaction event %+v, want L0 file of %d bytes moved to L1", moved, flushed[0])
+	}
+	output := levels[1].Files[0].Size
+	if event.Type != config.CompactionRewrite || event.Level != 0 || event.OutputLevel != 1 || event.InputFiles != 2 ||
+		event.InputBytes != flushed[0]+flushed[1] || event.OutputFiles != 1 || event.OutputBytes != output || event.Time.IsZero() {
+		t.Fatalf("compaction event %+v, want L0 and L1 files of %d bytes compacted into %d bytes",
+			event, flushed[0]+flushed[1], output)
+	}
+	want := []LevelIO{
+		{Level: 0, BytesRead: flushed[1], BytesWritten: flushed[0] + flushed[1] + flushed[2] + flushed[3], LiveBytes: flushed[2] + flushed[3]},
+		{Level: 1, BytesRead: flushed[0], BytesWritten: output, LiveBytes: output},
+	}
+	check := func(stats Stats) {
+		t.Helper()
+		got := stats.LevelIO()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("LevelIO() = %+v, want %+v", got, want)
+		}
+	}
+	stats := tree.Stats()
+	check(stats)
+	if len(stats.RecentCompactions) != 2 || stats.RecentCompactions[0] != moved || stats.RecentCompactions[1] != event {
+		t.Fatalf("RecentCompactions = %+v, want [%+v %+v]", stats.RecentCompactions, moved, event)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 计数器已持久化，最近的压缩事件不保存
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	stats = tree.Stats()
+	check(stats)
+	if len(stats.RecentCompactions) != 0 {
+		t.Fatalf("RecentCompactions after reopen = %+v", stats.RecentCompactions)
+	}
+}
+
+func TestLevelIOCounters_RecentEvents(t *testing.T) {
+	var c levelIOCounters
+	c.init(1)
+	for i := 0; i < compactionHistory+5; i++ {
+		c.addEvent(CompactionEvent{InputFiles: i})
+	}
+	events := c.recentEvents()
+	if len(events) != compactionHistory {
+		t.Fatalf("kept %d events, want %d", len(events), compactionHistory)
+	}
+	for i, event := range events {
+		if event.InputFiles != i+5 {
+			t.Fatalf("event %d has InputFiles %d, want %d", i, event.InputFiles, i+5)
+		}
+	}
+}
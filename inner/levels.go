@@ -0,0 +1,144 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// LevelInfo 一层SST文件的快照，由Levels返回
+type LevelInfo struct {
+	Level int        // 层级
+	Files []FileInfo // 层内的文件，按序列号从旧到新
+}
+
+// FileInfo 一个SST文件的快照
+type FileInfo struct {
+	Path       string // 文件路径
+	Level      int    // 层级
+	Seq        uint32 // 序列号，同一层中越大越新
+	Size       int64  // 文件大小
+	MinKey     []byte // 最小key
+	MaxKey     []byte // 最大key
+	EntryCount int64  // 条目数(包括删除标记)
+	// DistinctPrefixes 按Config.KeySchema统计的前1个、前2个……字段组成的前缀的不同取值数，
+	// 没有设置KeySchema或文件写入时使用了不同的KeySchema时为nil
+	DistinctPrefixes []uint64
+}
+
+// Levels 返回各层SST文件的快照，包括空的层。快照在读锁下复制，可以与写入、刷盘和压缩并发调用，
+// 调用方修改返回的key不影响树；返回后发生的刷盘和压缩不反映在快照中
+func (t *LsmTree) Levels() []LevelInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	levels := make([]LevelInfo, len(t.nodes))
+	for level, nodes := range t.nodes {
+		files := make([]FileInfo, len(nodes))
+		for i, node := range nodes {
+			files[i] = FileInfo{
+				Path:       node.GetFilename(),
+				Level:      level,
+				Seq:        uint32(node.GetSeq()),
+				Size:       node.GetSize(),
+				MinKey:     bytes.Clone(node.GetMinKey()),
+				MaxKey:     bytes.Clone(node.GetMaxKey()),
+				EntryCount: node.EntryCount(),
+			}
+			if schema := t.conf.KeySchema; schema != nil {
+				if stats, ok := node.Reader().PrefixStats(); ok && stats.Schema == schema.Name() {
+					files[i].DistinctPrefixes = stats.Distinct
+				}
+			}
+		}
+		levels[level] = LevelInfo{Level: level, Files: files}
+	}
+	return levels
+}
+
+// levelOverlap 同一层中key范围重叠的两个文件
+type levelOverlap struct {
+	older *sst.Node // 序列号较小的文件
+	newer *sst.Node // 序列号较大的文件
+}
+
+// findOverlaps 按最小key排序后比较相邻文件的key范围，返回使nodes互不重叠需要移出的文件，
+// 每对重叠的文件移出较旧的一个，留下的文件互不重叠。每个文件最多作为older出现一次
+func findOverlaps(nodes []*sst.Node) []levelOverlap {
+	sorted := slices.Clone(nodes)
+	slices.SortStableFunc(sorted, func(a, b *sst.Node) int {
+		return bytes.Compare(a.GetMinKey(), b.GetMinKey())
+	})
+	var overlaps []levelOverlap
+	var prev *sst.Node // 留下的文件中最小key最大的一个
+	for _, node := range sorted {
+		if prev == nil || bytes.Compare(node.GetMinKey(), prev.GetMaxKey()) > 0 {
+			prev = node
+			continue
+		}
+		if node.GetSeq() < prev.GetSeq() {
+			overlaps = append(overlaps, levelOverlap{older: node, newer: prev})
+			continue
+		}
+		overlaps = append(overlaps, levelOverlap{older: prev, newer: node})
+		prev = node
+	}
+	return overlaps
+}
+
+// checkLevelRanges 检查L1到倒数第二层的文件key范围互不重叠，重叠时返回包装了ErrLevelOverlap的错误。
+// 最底层在层内合并最旧的文件，输出的范围可能覆盖更新的文件，不检查。调用方需持有t.mu
+func (t *LsmTree) checkLevelRanges() error {
+	for level := 1; level < len(t.nodes)-1; level++ {
+		if overlaps := findOverlaps(t.nodes[level]); len(overlaps) > 0 {
+			o := overlaps[0]
+			return fmt.Errorf("%w: level %d: %s overlaps %s", myerror.ErrLevelOverlap, level, o.older.GetFilename(), o.newer.GetFilename())
+		}
+	}
+	return nil
+}
+
+// repairLevelRanges 打开时修复L1到倒数第二层中key范围重叠的文件，例如压缩的输出已经加入、输入尚未删除时崩溃留下的文件。
+// 较旧的文件以下一层最新的序列号移到下一层并记入清单：它比本层与之重叠的文件旧、比下一层的文件新，读取的优先级不变。
+// 不移到L0，L0先于其他层查找，较旧的文件会覆盖较新文件中的版本。移入的文件可能与下一层重叠，逐层向下处理
+func (t *LsmTree) repairLevelRanges() error {
+	for level := 1; level < len(t.nodes)-1; level++ {
+		overlaps := findOverlaps(t.nodes[level])
+		if len(overlaps) == 0 {
+			continue
+		}
+		older := make([]*sst.Node, 0, len(overlaps))
+		for _, o := range overlaps {
+			older = append(older, o.older)
+		}
+		// 移出的文件按从旧到新分配序列号，彼此的先后不变
+		slices.SortFunc(older, func(a, b *sst.Node) int { return int(a.GetSeq()) - int(b.GetSeq()) })
+		edits := make([]manifest.Edit, 0, 2*len(older))
+		moved := make([]*sst.Node, 0, len(older))
+		for _, node := range older {
+			seq := t.nextSSTSeq(level + 1)
+			// 文件名不变，清单记录文件所在的层级
+			demoted, err := sst.NewNode(t.conf, node.GetFilename(), level+1, int32(seq), node.Reader())
+			if err != nil {
+				return err
+			}
+			demoted.SetSourceWals(node.SourceWals())
+			edits = append(edits, manifest.DeleteFile(level, uint32(node.GetSeq())), manifest.AddFile(t.manifestFileMeta(demoted)))
+			moved = append(moved, demoted)
+		}
+		if err := t.manifest.Apply(edits...); err != nil {
+			return err
+		}
+		for _, o := range overlaps {
+			t.conf.Warnf("level %d: sst %s overlaps newer %s, moved to level %d", level, o.older.GetFilename(), o.newer.GetFilename(), level+1)
+		}
+		t.nodes[level] = slices.DeleteFunc(t.nodes[level], func(node *sst.Node) bool {
+			return slices.Contains(older, node)
+		})
+		t.addNodes(level+1, moved...)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func TestLsmTree_Levels(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	writeLevelSST(t, conf, 0, 1, map[string]string{"b": "1", "d": "1"})
+	writeLevelSST(t, conf, 0, 2, map[string]string{"a": "2"})
+	writeLevelSST(t, conf, 2, 1, map[string]string{"c": "3", "e": "3", "g": "3"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	levels := tree.Levels()
+	if len(levels) != 3 || len(levels[0].Files) != 2 || len(levels[1].Files) != 0 || len(levels[2].Files) != 1 {
+		t.Fatalf("levels = %+v", levels)
+	}
+	for i, level := range levels {
+		if level.Level != i {
+			t.Fatalf("level %d reported as %d", i, level.Level)
+		}
+	}
+	for _, c := range []struct {
+		file    FileInfo
+		level   int
+		seq     uint32
+		min     string
+		max     string
+		entries int64
+	}{
+		{levels[0].Files[0], 0, 1, "b", "d", 2},
+		{levels[0].Files[1], 0, 2, "a", "a", 1},
+		{levels[2].Files[0], 2, 1, "c", "g", 3},
+	} {
+		f := c.file
+		if f.Level != c.level || f.Seq != c.seq || string(f.MinKey) != c.min || string(f.MaxKey) != c.max || f.EntryCount != c.entries {
+			t.Errorf("file %+v, want level %d seq %d keys %s-%s entries %d", f, c.level, c.seq, c.min, c.max, c.entries)
+		}
+		if want := filepath.Join(conf.DataDir, conf.SSTDir, fmt.Sprintf("%d_%d.sst", c.level, c.seq)); f.Path != want || f.Size <= 0 {
+			t.Errorf("file path %s size %d, want %s", f.Path, f.Size, want)
+		}
+	}
+
+	// 快照中的key是复制出来的，修改后不影响树
+	levels[2].Files[0].MinKey[0] = 'z'
+	if value, err := tree.Get([]byte("c")); err != nil || string(value) != "3" {
+		t.Fatalf("Get(c) = %q, %v after modifying the snapshot", value, err)
+	}
+	if min := tree.Levels()[2].Files[0].MinKey; string(min) != "c" {
+		t.Fatalf("MinKey = %q after modifying the snapshot", min)
+	}
+}
+
+// Levels可以与写入和刷盘并发调用
+func TestLsmTree_LevelsConcurrent(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 512
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, level := range tree.Levels() {
+				for i := 1; i < len(level.Files); i++ {
+					if level.Files[i-1].Seq >= level.Files[i].Seq {
+						t.Errorf("L%d seq %d before %d", level.Level, level.Files[i-1].Seq, level.Files[i].Seq)
+						return
+					}
+				}
+			}
+		}
+	}()
+	for i := 0; i < 300; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	close(stop)
+	wg.Wait()
+	if len(tree.Levels()[0].Files) == 0 {
+		t.Fatal("no files after flush")
+	}
+}
+
+// levelLayout 返回各层文件的文件名，用于比较层级布局
+func levelLayout(tree *LsmTree) [][]string {
+	layout := make([][]string, 0)
+	for _, level := range tree.Levels() {
+		names := make([]string, 0, len(level.Files))
+		for _, file := range level.Files {
+			names = append(names, filepath.Base(file.Path))
+		}
+		layout = append(layout, names)
+	}
+	return layout
+}
+
+// 层内重叠的文件在打开时修复：较旧的文件移到下一层，移入的文件与下一层重叠时继续向下，
+// 两个文件中的key都可以读到，且仍然返回较新的版本
+func TestLsmTree_RepairLevelOverlap(t *testing.T) {
+	want := map[string]string{"a": "old", "b": "new", "c": "old", "d": "new", "x": "1", "y": "3", "z": "2"}
+	check := func(t *testing.T, tree *LsmTree) {
+		t.Helper()
+		for key, value := range want {
+			getValue(t, tree, key, value)
+		}
+		tree.mu.RLock()
+		defer tree.mu.RUnlock()
+		if err := tree.checkLevelRanges(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	layout := [][]string{{}, {"1_2.sst", "1_3.sst"}, {"1_1.sst"}, {"3_1.sst", "2_1.sst"}}
+
+	for _, withManifest := range []bool{false, true} {
+		t.Run(fmt.Sprintf("manifest=%v", withManifest), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.LevelSize = 4
+			logger := &captureLogger{}
+			conf.Logger = logger
+			writeLevelSST(t, conf, 1, 1, map[string]string{"a": "old", "b": "old", "c": "old"})
+			writeLevelSST(t, conf, 1, 3, map[string]string{"x": "1"})
+			writeLevelSST(t, conf, 2, 1, map[string]string{"a": "2", "z": "2"})
+			writeLevelSST(t, conf, 3, 1, map[string]string{"y": "3"})
+			overlapping := map[string]string{"b": "new", "d": "new"}
+			if withManifest {
+				// 清单中的层级互不重叠，之后手工加入一个重叠的文件，相当于压缩的输入尚未删除
+				tree, err := NewLsmTree(conf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := tree.Close(); err != nil {
+					t.Fatal(err)
+				}
+				writeLevelSST(t, conf, 1, 2, overlapping)
+				m, err := manifest.Open(conf, conf.DataDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = m.Apply(manifest.AddFile(manifest.FileMeta{Level: 1, Seq: 2, Path: "1_2.sst", MinKey: []byte("b"), MaxKey: []byte("d")}))
+				m.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				writeLevelSST(t, conf, 1, 2, overlapping)
+			}
+
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { tree.Close() }()
+			if got := levelLayout(tree); !slices.EqualFunc(got, layout, slices.Equal) {
+				t.Fatalf("layout %v, want %v", got, layout)
+			}
+			if moved := logger.find("moved to level"); len(moved) != 2 {
+				t.Fatalf("repair log %v", moved)
+			}
+			check(t, tree)
+
+			// 修复记入了清单，重启后布局不变，不再修复
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			logger.lines = nil
+			if tree, err = NewLsmTree(conf); err != nil {
+				t.Fatal(err)
+			}
+			if got := levelLayout(tree); !slices.EqualFunc(got, layout, slices.Equal) {
+				t.Fatalf("layout after reopen %v, want %v", got, layout)
+			}
+			if moved := logger.find("moved to level"); len(moved) != 0 {
+				t.Fatalf("repaired again after reopen: %v", moved)
+			}
+			check(t, tree)
+
+			// 移动过的文件照常参与压缩
+			if err := tree.Vacuum(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			check(t, tree)
+		})
+	}
+}
+
+func TestFindOverlaps(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	// seq: 范围
+	files := map[uint32][2]string{1: {"a", "c"}, 2: {"b", "d"}, 3: {"e", "f"}, 4: {"f", "g"}, 5: {"h", "k"}, 6: {"i", "j"}}
+	for seq, r := range files {
+		writeLevelSST(t, conf, 1, seq, map[string]string{r[0]: "v", r[1]: "v"})
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	// 最底层不修复
+	if len(tree.nodes[1]) != len(files) {
+		t.Fatalf("bottom level has %d files", len(tree.nodes[1]))
+	}
+	var older []int32
+	for _, o := range findOverlaps(tree.nodes[1]) {
+		if o.older.GetSeq() >= o.newer.GetSeq() {
+			t.Fatalf("older %d is not older than %d", o.older.GetSeq(), o.newer.GetSeq())
+		}
+		older = append(older, o.older.GetSeq())
+	}
+	slices.Sort(older)
+	if want := []int32{1, 3, 5}; !slices.Equal(older, want) {
+		t.Fatalf("older files %v, want %v", older, want)
+	}
+}
+
+// 开启ParanoidChecks时压缩记入清单后检查层内重叠，重叠时返回ErrLevelOverlap
+func TestLsmTree_ParanoidChecks(t *testing.T) {
+	for _, paranoid := range []bool{false, true} {
+		conf := newTestConfig(t)
+		conf.LevelSize = 3
+		conf.ParanoidChecks = paranoid
+		writeLevelSST(t, conf, 0, 1, map[string]string{"x": "1"})
+		writeLevelSST(t, conf, 1, 1, map[string]string{"a": "1", "c": "1"})
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 绕过打开时的修复，在L1中加入一个重叠的文件
+		writeLevelSST(t, conf, 1, 2, map[string]string{"b": "2"})
+		path := filepath.Join(conf.SSTPath(), "1_2.sst")
+		reader, err := sst.NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := sst.NewNode(conf, path, 1, 2, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.mu.Lock()
+		tree.addNodes(1, node)
+		inputs := slices.Clone(tree.nodes[0])
+		overlaps := tree.nextLevelOverlaps(0, inputs)
+		tree.mu.Unlock()
+
+		_, err = tree.compactLevel(0, inputs, overlaps, 0)
+		if paranoid && !errors.Is(err, ErrLevelOverlap) {
+			t.Fatalf("paranoid compaction = %v, want ErrLevelOverlap", err)
+		}
+		if !paranoid && err != nil {
+			t.Fatal(err)
+		}
+		// 压缩本身已经完成，数据不受影响
+		getValue(t, tree, "x", "1")
+		getValue(t, tree, "b", "2")
+		tree.Close()
+	}
+}
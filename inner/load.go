@@ -1,13 +1,22 @@
 package inner
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/manifest"
 	"github.com/aixiasang/lsm/inner/memtable"
 	"github.com/aixiasang/lsm/inner/myerror"
 	"github.com/aixiasang/lsm/inner/sst"
@@ -21,6 +30,9 @@ func (t *LsmTree) load() error {
 	if err := t.loadWAL(); err != nil {
 		return err
 	}
+	if t.conf.TrackSequences {
+		t.commitSeq = max(t.commitSeq, t.persistedSeq())
+	}
 	return nil
 }
 
@@ -28,36 +40,152 @@ type sstFile struct {
 	level    int
 	seq      uint32
 	filePath string
+	meta     *manifest.FileMeta // 清单中的记录，从目录扫描得到的文件为nil
 }
 
-// 载入sst
+// 载入sst，存在清单时按清单重建各层节点，否则扫描SST目录并根据扫描结果创建清单，最后修复层内重叠的文件
 func (t *LsmTree) loadSST() error {
-	filePath := filepath.Join(t.conf.DataDir, t.conf.SSTDir)
-	files, err := os.ReadDir(filePath)
+	if err := t.makeLevelDirs(); err != nil {
+		return err
+	}
+	if err := t.loadUnavailable(); err != nil {
+		return err
+	}
+	sstFiles, err := t.scanSSTDir()
 	if err != nil {
 		return err
 	}
-	if len(files) == 0 {
-		return nil
+	if manifest.Exists(t.conf.DataDir) {
+		if err := t.loadManifest(sstFiles); err != nil {
+			return err
+		}
+		return t.repairLevelRanges()
+	}
+	skipped, err := t.addSSTNodes(sstFiles)
+	if err != nil {
+		return err
+	}
+	// 从目录扫描迁移到清单，之后的启动只载入清单中的文件
+	files := make([]manifest.FileMeta, 0, len(sstFiles))
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			files = append(files, t.manifestFileMeta(node))
+		}
+	}
+	for _, file := range skipped {
+		// 忽略的文件留在原处，同样记入清单，下次打开时重试；没有清单时无法得知被隔离的文件的key范围，其中的数据视为不存在
+		if t.conf.UnreadableSSTPolicy() == config.CorruptFileIgnore {
+			files = append(files, manifest.FileMeta{Level: file.level, Seq: file.seq, Path: t.sstRelPath(file.filePath)})
+		} else if err := t.markUnavailable(file); err != nil {
+			return err
+		}
+	}
+	m, err := manifest.Create(t.conf, t.conf.DataDir, files)
+	if err != nil {
+		return err
+	}
+	t.manifest = m
+	return t.repairLevelRanges()
+}
+
+// scanSSTDir 列出SST目录中的SST文件，按层级和序列号排序，同时删除写入SST时崩溃遗留的临时文件。
+// 两种布局的文件都会被识别：SST目录中的level_seq.sst，以及各层子目录中的L<level>/seq.sst
+func (t *LsmTree) scanSSTDir() ([]*sstFile, error) {
+	root := t.conf.SSTPath()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
 	}
 	sstFiles := make([]*sstFile, 0)
-	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".sst") {
-			return myerror.ErrSSTCorrupted
+	add := func(dir string, entry os.DirEntry, parse func(name string) (int, uint32, error)) error {
+		file, err := t.scanSSTEntry(dir, entry, parse)
+		if file != nil {
+			sstFiles = append(sstFiles, file)
+		}
+		return err
+	}
+	for _, entry := range entries {
+		level, ok := parseLevelDir(entry)
+		if !ok {
+			if err := add(root, entry, parseSSTFileName); err != nil {
+				return nil, err
+			}
+			continue
 		}
-		fileName := strings.TrimSuffix(file.Name(), ".sst")
-		level, seq, err := parseSSTFileName(fileName)
+		dir := filepath.Join(root, entry.Name())
+		nested, err := os.ReadDir(dir)
 		if err != nil {
+			return nil, err
+		}
+		for _, entry := range nested {
+			if err := add(dir, entry, func(name string) (int, uint32, error) {
+				seq, err := strconv.ParseUint(name, 10, 32)
+				return level, uint32(seq), err
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sortSSTFiles(sstFiles)
+	return sstFiles, nil
+}
+
+// scanSSTEntry 按parse解析dir中去掉.sst后缀的文件名，返回nil表示已删除的临时文件或已跳过的未知文件
+func (t *LsmTree) scanSSTEntry(dir string, entry os.DirEntry, parse func(name string) (int, uint32, error)) (*sstFile, error) {
+	path := filepath.Join(dir, entry.Name())
+	if strings.HasSuffix(entry.Name(), ".sst"+sstTmpSuffix) && entry.Type().IsRegular() {
+		// 写入SST文件时崩溃遗留的临时文件，尚未重命名为正式文件名
+		return nil, fsio.DeleteRetry(path)
+	}
+	if !strings.HasSuffix(entry.Name(), ".sst") {
+		return nil, t.skipUnknownFile(dir, entry, myerror.ErrSSTCorrupted)
+	}
+	level, seq, err := parse(strings.TrimSuffix(entry.Name(), ".sst"))
+	if err != nil {
+		return nil, err
+	}
+	if level < 0 || level >= t.levelSize {
+		return nil, fmt.Errorf("%w: %s at level %d, LevelSize is %d", myerror.ErrSSTCorrupted, path, level, t.levelSize)
+	}
+	return &sstFile{level: level, seq: seq, filePath: path}, nil
+}
+
+// parseLevelDir 解析分层布局的子目录名L<level>
+func parseLevelDir(entry os.DirEntry) (int, bool) {
+	name, ok := strings.CutPrefix(entry.Name(), "L")
+	if !ok || !entry.IsDir() || name == "" || strings.Trim(name, "0123456789") != "" {
+		return 0, false
+	}
+	level, err := strconv.Atoi(name)
+	return level, err == nil
+}
+
+// makeLevelDirs 分层布局时创建各层的子目录
+func (t *LsmTree) makeLevelDirs() error {
+	if t.conf.SSTLayout != config.SSTLayoutNested {
+		return nil
+	}
+	for level := 0; level < t.levelSize; level++ {
+		if err := makeDir(t.conf, t.conf.SSTLevelDir(level)); err != nil {
 			return err
 		}
-		sstFilePath := filepath.Join(filePath, file.Name())
+	}
+	return nil
+}
 
-		sstFiles = append(sstFiles, &sstFile{
-			level:    level,
-			seq:      seq,
-			filePath: sstFilePath,
-		})
+// makeDir 创建目录dir，dir原本不存在时同步其父目录，使目录在断电后仍然存在
+func makeDir(conf *config.Config, dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
 	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return conf.SyncDir(filepath.Dir(dir))
+}
+
+// sortSSTFiles 按层级和序列号排序
+func sortSSTFiles(sstFiles []*sstFile) {
 	sort.Slice(sstFiles, func(i, j int) bool {
 		if sstFiles[i].level < sstFiles[j].level {
 			return true
@@ -67,22 +195,135 @@ func (t *LsmTree) loadSST() error {
 		}
 		return false
 	})
-	for _, sstFile := range sstFiles {
-		sstReader, err := sst.NewSSTReader(t.conf, sstFile.filePath)
-		if err != nil {
-			return err
+}
+
+// addSSTNodes 打开已排序的sstFiles并按顺序添加到各层，返回按CorruptFilePolicy被隔离或忽略而没有载入的文件
+func (t *LsmTree) addSSTNodes(sstFiles []*sstFile) ([]*sstFile, error) {
+	readers, err := t.openSSTFiles(sstFiles)
+	if err != nil {
+		return nil, err
+	}
+	var skipped []*sstFile
+	for i, sstFile := range sstFiles {
+		// 新生成的SST文件序列号需要大于已存在的序列号，包括被隔离或忽略的文件，避免新文件与其重名
+		if t.seq[sstFile.level].Load() <= sstFile.seq {
+			t.seq[sstFile.level].Store(sstFile.seq + 1)
+		}
+		if readers[i] == nil {
+			skipped = append(skipped, sstFile)
+			continue
 		}
-		node, err := sst.NewNode(t.conf, sstFile.filePath, sstFile.level, int32(sstFile.seq), sstReader)
+		readers[i].AttachBudget(t.indexBudget)
+		readers[i].AttachFilterBudget(t.filterBudget)
+		readers[i].AttachBlockCache(t.blockCache)
+		node, err := sst.NewNode(t.conf, sstFile.filePath, sstFile.level, int32(sstFile.seq), readers[i])
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if sstFile.meta != nil {
+			node.SetSourceWals(sstFile.meta.SourceWals)
+		}
+		t.conf.Debugf("level: %d, seq: %d, len(t.nodes[level]): %d", sstFile.level, sstFile.seq, len(t.nodes[sstFile.level]))
+		t.addNodes(sstFile.level, node)
+	}
+	return skipped, nil
+}
+
+// openSSTFiles 以OpenFilesParallelism的并发度延迟打开SST文件，只读取footer、元数据和最小最大key，
+// 返回的读取器与files一一对应。无法打开的文件按CorruptFilePolicy被移到隔离目录或留在原处忽略，
+// 对应位置为nil；默认关闭已打开的读取器，返回汇总了所有文件错误的错误
+func (t *LsmTree) openSSTFiles(files []*sstFile) ([]*sst.SSTReader, error) {
+	concurrency := t.conf.OpenFilesParallelism
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	readers := make([]*sst.SSTReader, len(files))
+	errs := make([]error, len(files))
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				readers[i], errs[i] = sst.NewLazySSTReader(t.conf, files[i].filePath)
+			}
+		}()
+	}
+	for i := range files {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var failed []error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		switch t.conf.UnreadableSSTPolicy() {
+		case config.CorruptFileQuarantine:
+			qerr := t.quarantineSST(files[i].filePath, err)
+			if qerr == nil {
+				continue
+			}
+			err = errors.Join(err, qerr)
+		case config.CorruptFileIgnore:
+			t.conf.Errorf("ignored unreadable sst %s: %v", files[i].filePath, err)
+			continue
 		}
-		if t.conf.IsDebug {
-			fmt.Printf("level: %d, seq: %d, len(t.nodes[level]): %d\n", sstFile.level, sstFile.seq, len(t.nodes[sstFile.level]))
+		failed = append(failed, fmt.Errorf("open sst %s: %w", files[i].filePath, err))
+	}
+	if len(failed) == 0 {
+		return readers, nil
+	}
+	for _, reader := range readers {
+		if reader != nil {
+			reader.Close()
 		}
-		t.nodes[sstFile.level] = append(t.nodes[sstFile.level], node)
 	}
+	return nil, errors.Join(failed...)
+}
+
+// quarantineSST 将无法打开或无法确认能否删除的SST文件移到隔离目录，保留文件供事后排查
+func (t *LsmTree) quarantineSST(path string, cause error) error {
+	dir := t.conf.QuarantinePath()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	target := quarantineTarget(dir, t.sstRelPath(path))
+	if err := fsio.AtomicRename(path, target); err != nil {
+		return err
+	}
+	t.conf.Errorf("quarantined sst %s to %s: %v", path, target, cause)
 	return nil
 }
+
+// quarantineTarget 返回相对SST目录的路径为rel的文件在隔离目录dir中的路径。
+// 分层布局中不同层的文件可能同名，隔离目录中的文件名包含相对SST目录的路径
+func quarantineTarget(dir, rel string) string {
+	return filepath.Join(dir, strings.ReplaceAll(rel, "/", "_"))
+}
+
+// skipUnknownFile 判断数据目录中无法识别的文件能否跳过
+// 目录锁文件直接跳过，普通文件和以.开头的目录会被记录日志后跳过，开启StrictDirectoryScan时返回corrupted
+func (t *LsmTree) skipUnknownFile(dir string, file os.DirEntry, corrupted error) error {
+	if file.Name() == lockFileName {
+		return nil
+	}
+	if t.conf.StrictDirectoryScan {
+		return corrupted
+	}
+	switch {
+	case file.Type().IsRegular():
+	case file.IsDir() && strings.HasPrefix(file.Name(), "."):
+	default:
+		return corrupted
+	}
+	t.conf.Warnf("skip unknown file: %s", filepath.Join(dir, file.Name()))
+	return nil
+}
+
 func parseSSTFileName(fileName string) (int, uint32, error) {
 
 	parts := strings.Split(fileName, "_")
@@ -100,10 +341,17 @@ func parseSSTFileName(fileName string) (int, uint32, error) {
 	return level, uint32(seq), nil
 }
 
-// 载入wal
+// 载入wal，之后t.walId为新WAL使用的id，大于所有已有的WAL和SST记录的来源WAL。
+// 来源WAL的id被重复使用时，重启会把新WAL当作已经刷盘的WAL删除
 func (t *LsmTree) loadWAL() error {
+	// 共享WAL的代数从清单记录的已刷盘代数之后开始，重放时再推进到大于WAL中出现过的代数
+	t.walGen = t.manifest.FlushedGeneration() + 1
+	flushed := t.flushedWals()
+	for walId := range flushed {
+		t.walId = max(t.walId, walId+1)
+	}
 	// 遍历wal目录
-	filePath := filepath.Join(t.conf.DataDir, t.conf.WalDir)
+	filePath := t.conf.WalPath()
 	files, err := os.ReadDir(filePath)
 	if err != nil {
 		return err
@@ -113,38 +361,236 @@ func (t *LsmTree) loadWAL() error {
 	}
 	walIds := make([]uint32, 0)
 	for _, file := range files {
-		// wal-*.log
-		if !strings.HasPrefix(file.Name(), "wal-") || !strings.HasSuffix(file.Name(), ".log") {
-			return myerror.ErrWalCorrupted
+		if !wal.IsFileName(file.Name()) {
+			if err := t.skipUnknownFile(filePath, file, myerror.ErrWalCorrupted); err != nil {
+				return err
+			}
+			continue
 		}
-		walName := strings.TrimSuffix(file.Name(), ".log")
-		walName = strings.TrimPrefix(walName, "wal-")
-		walId, err := strconv.ParseUint(walName, 10, 32)
+		walId, err := wal.ParseFileName(file.Name())
 		if err != nil {
 			return err
 		}
-		walIds = append(walIds, uint32(walId))
+		walIds = append(walIds, walId)
 	}
 	// 对于wal文件进行排序
 	sort.Slice(walIds, func(i, j int) bool {
 		return walIds[i] < walIds[j]
 	})
-	for i, walId := range walIds {
-		curWal, err := wal.NewWal(t.conf, walId)
-		if err != nil {
-			return err
+	for _, walId := range walIds {
+		t.walId = max(t.walId, walId+1)
+	}
+	for i := 0; i < len(walIds); i++ {
+		walId := walIds[i]
+		// 只跳过开头连续的已刷盘WAL：更旧的WAL需要重放时，之后的WAL也要重放，使其数据排在更旧的数据之后。
+		// 合并刷盘的多个WAL记录在同一个SST中，一起校验和删除
+		if node := flushed[walId]; node != nil {
+			n := 1
+			for i+n < len(walIds) && flushed[walIds[i+n]] == node {
+				n++
+			}
+			removed, err := t.removeFlushedWals(walIds[i:i+n], node)
+			if err != nil {
+				return err
+			}
+			if removed {
+				i += n - 1
+				continue
+			}
+		}
+		return t.replayWals(walIds[i:])
+	}
+	return nil
+}
+
+// replayedWal 一个WAL重放得到的内存表
+type replayedWal struct {
+	w       *wal.Wal
+	indexes map[uint64]memtable.MemTable // 按代数的内存表，已刷盘的代数不在其中
+	marked  bool                         // WAL中是否有代数标记
+	maxGen  uint64                       // WAL中出现过的最大代数
+	err     error
+}
+
+// replayWals 以WALReplayParallelism的并发度将walIds(从旧到新)重放为内存表，再按walIds的顺序加入不可变内存表。
+// 每个WAL重放到各自的内存表，可以同时进行；加入不可变内存表和分配SST序列号按顺序进行，使较新的数据排在后面
+func (t *LsmTree) replayWals(walIds []uint32) error {
+	start := t.conf.Now()
+	concurrency := max(t.conf.WALReplayParallelism, 1)
+	replayed := make([]replayedWal, len(walIds))
+	var wg sync.WaitGroup
+	work := make(chan int)
+	for i := 0; i < min(concurrency, len(walIds)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				replayed[i] = t.readWal(walIds[i])
+			}
+		}()
+	}
+	for i := range walIds {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var failed []error
+	for i := range replayed {
+		if err := replayed[i].err; err != nil {
+			failed = append(failed, fmt.Errorf("replay wal %d: %w", walIds[i], err))
 		}
-		curIndex := t.conf.MemTableConstructor(memtable.MemTableType(t.conf.MemTableType), t.conf.MemTableDegree)
-		if err := curWal.ReadAll(curIndex); err != nil {
+	}
+	if len(failed) > 0 {
+		for i := range replayed {
+			if replayed[i].w != nil {
+				replayed[i].w.Close()
+			}
+		}
+		return errors.Join(failed...)
+	}
+
+	stats := RecoveryStats{WALFiles: len(walIds), Parallelism: concurrency}
+	for i := range replayed {
+		replay := replayed[i].w.ReplayStats()
+		stats.WALBytes += replay.Bytes
+		stats.Records += replay.Records
+		if err := t.addReplayedWal(&replayed[i]); err != nil {
 			return err
 		}
+	}
+	stats.Duration = t.conf.Since(start)
+	t.recovery = stats
+	t.conf.Infof("replayed %d wal files, %d bytes, %d records in %v", stats.WALFiles, stats.WALBytes, stats.Records, stats.Duration)
+	return nil
+}
+
+// readWal 将编号为walId的WAL重放到新建的内存表，不修改树的状态，可以与其他WAL的重放同时进行。
+// 代数不大于清单记录的已刷盘代数的记录被丢弃
+func (t *LsmTree) readWal(walId uint32) replayedWal {
+	w, err := wal.NewWal(t.conf, walId)
+	if err != nil {
+		return replayedWal{err: err}
+	}
+	flushed := t.manifest.FlushedGeneration()
+	r := replayedWal{w: w, indexes: make(map[uint64]memtable.MemTable)}
+	r.err = w.ReadGenerations(func(gen uint64) (memtable.MemTable, error) {
+		r.maxGen = max(r.maxGen, gen)
+		r.marked = r.marked || gen != 0
+		if gen != 0 && gen <= flushed {
+			return nil, nil
+		}
+		if index, ok := r.indexes[gen]; ok {
+			return index, nil
+		}
+		index, err := t.newMemTable()
+		if err != nil {
+			return nil, err
+		}
+		r.indexes[gen] = index
+		return index, nil
+	})
+	if r.err == nil && !r.marked && r.indexes[0] == nil {
+		// 没有代数标记时整个WAL属于同一个内存表，为空时也保留
+		r.indexes[0], r.err = t.newMemTable()
+	}
+	return r
+}
+
+// addReplayedWal 将重放得到的内存表加入不可变内存表。没有代数标记的WAL整体作为一个内存表；共享WAL中
+// 代数大于清单记录的已刷盘代数的每个非空内存表各对应一个不可变内存表，都已刷盘时删除该WAL
+func (t *LsmTree) addReplayedWal(r *replayedWal) error {
+	t.walGen = max(t.walGen, r.maxGen+1)
+	gens := slices.Sorted(maps.Keys(r.indexes))
+	used := false
+	for _, gen := range gens {
+		index := r.indexes[gen]
+		if gen != 0 && index.Size() == 0 {
+			continue
+		}
+		used = true
+		// SST已经载入，分配的序列号大于所有已有的文件
 		t.immutableIndex = append(t.immutableIndex, &immutable{
-			wal:   curWal,
-			index: curIndex,
+			wal:   r.w,
+			index: index,
+			seq:   t.nextSSTSeq(0),
+			gen:   gen,
 		})
-		if i == len(walIds)-1 {
-			t.walId = walId
-		}
+		t.addBuffered(index.Size())
+	}
+	if !used {
+		// 共享WAL中的内存表都已刷盘
+		return r.w.Delete()
 	}
 	return nil
 }
+
+// flushedWals 返回已载入的SST在文件元数据或清单中记录的来源WAL
+func (t *LsmTree) flushedWals() map[uint32]*sst.Node {
+	flushed := make(map[uint32]*sst.Node)
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			for _, walId := range node.SourceWals() {
+				flushed[walId] = node
+			}
+		}
+	}
+	return flushed
+}
+
+// removeFlushedWals 刷盘生成的SST已记入清单、WAL尚未删除时崩溃，重启时删除这些WAL而不是重放，避免再次刷盘生成重复的SST。
+// node为记录了这些WAL的SST，walIds为其来源WAL中仍然存在的部分，按从旧到新的顺序重放到同一个内存表后，每个条目都与node中的
+// 相同时才删除；walIds包括node的所有来源WAL时条目数也必须相同。刷盘后按从旧到新的顺序删除WAL，中途崩溃时留下的是较新的WAL，
+// 其中每个key的版本仍是合并后的最新版本。node无法解析或内容不一致时(例如导入了其他树刷盘生成的文件)返回false，WAL照常重放
+func (t *LsmTree) removeFlushedWals(walIds []uint32, node *sst.Node) (bool, error) {
+	if _, _, err := node.Reader().WarmIndex(); err != nil {
+		t.conf.Warnf("replay wal %d: flushed sst %s unreadable: %v", walIds[0], node.GetFilename(), err)
+		return false, nil
+	}
+	wals := make([]*wal.Wal, 0, len(walIds))
+	closeAll := func() {
+		for _, w := range wals {
+			w.Close()
+		}
+	}
+	index, err := t.newMemTable()
+	if err != nil {
+		return false, err
+	}
+	for _, walId := range walIds {
+		w, err := wal.NewWal(t.conf, walId)
+		if err != nil {
+			closeAll()
+			return false, err
+		}
+		wals = append(wals, w)
+		if err := w.ReadAll(index); err != nil {
+			closeAll()
+			return false, err
+		}
+	}
+
+	entries := int64(0)
+	same := true
+	index.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+		entries++
+		got, err := node.GetEntry(entry.Key, nil)
+		same = err == nil && got.Kind == entry.Kind && bytes.Equal(got.Value, entry.Value)
+		return same
+	})
+	complete := len(walIds) == len(node.SourceWals())
+	if !same || entries > node.EntryCount() || complete && entries != node.EntryCount() {
+		t.conf.Warnf("replay wal %v: contents differ from %s", walIds, node.GetFilename())
+		closeAll()
+		return false, nil
+	}
+	// 数据已在SST中，删除失败时下次启动再删除
+	for _, w := range wals {
+		if err := w.Delete(); err != nil {
+			t.conf.Warnf("remove flushed wal %d: %v", w.ID(), err)
+			continue
+		}
+		t.conf.Infof("removed wal %d already flushed to %s", w.ID(), node.GetFilename())
+	}
+	return true, nil
+}
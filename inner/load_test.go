@@ -0,0 +1,1216 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// dropJunk 在数据目录中放入各种无法识别的文件
+func dropJunk(t *testing.T, dir string) []string {
+	t.Helper()
+	junk := []string{".DS_Store", "notes.txt", "0_1.sst.swp", "0_2.sst.tmp"}
+	for _, name := range junk {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".trash"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return append(junk, ".trash")
+}
+
+func TestLsmTree_LoadSkipsUnknownFiles(t *testing.T) {
+	conf := newTestConfig(t)
+	logger := &captureLogger{}
+	conf.Logger = logger
+	writeLevelSST(t, conf, 0, 0, map[string]string{"sst-key": "sst-value"})
+	writeWal(t, conf, 0, [][2][]byte{{[]byte("wal-key"), []byte("wal-value")}})
+
+	sstDir := filepath.Join(conf.DataDir, conf.SSTDir)
+	walDir := filepath.Join(conf.DataDir, conf.WalDir)
+	sstJunk := dropJunk(t, sstDir)
+	walJunk := dropJunk(t, walDir)
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for key, want := range map[string]string{"sst-key": "sst-value", "wal-key": "wal-value"} {
+		value, err := tree.Get([]byte(key))
+		if err != nil || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	for dir, junk := range map[string][]string{sstDir: sstJunk, walDir: walJunk} {
+		for _, name := range junk {
+			path := filepath.Join(dir, name)
+			if len(logger.find("skip unknown file: "+path)) != 1 {
+				t.Errorf("expected %s to be reported, got %v", path, logger.lines)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("junk %s should be left untouched: %v", path, err)
+			}
+		}
+	}
+}
+
+func TestLsmTree_LoadStrictDirectoryScan(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		want error
+	}{
+		{"SST", "sst", myerror.ErrSSTCorrupted},
+		{"WAL", "wal", myerror.ErrWalCorrupted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.SSTDir = "sst"
+			conf.WalDir = "wal"
+			conf.StrictDirectoryScan = true
+			dir := filepath.Join(conf.DataDir, tt.dir)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, ".DS_Store"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewLsmTree(conf); err != tt.want {
+				t.Fatalf("NewLsmTree err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLsmTree_LoadMalformedNames(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		file string
+	}{
+		{"SST", "sst", "abc_def.sst"},
+		{"WAL", "wal", "wal-abc.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.SSTDir = "sst"
+			conf.WalDir = "wal"
+			dir := filepath.Join(conf.DataDir, tt.dir)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, tt.file), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := NewLsmTree(conf); err == nil {
+				t.Fatalf("expected %s to fail loading", tt.file)
+			}
+		})
+	}
+}
+
+// writeStartupSSTs 在L0写入n个小SST文件，每个文件包含20个key，返回所有key及其value
+func writeStartupSSTs(tb testing.TB, conf *config.Config, n int) map[string]string {
+	tb.Helper()
+	expected := make(map[string]string)
+	for seq := 0; seq < n; seq++ {
+		kvs := make(map[string]string)
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key-%04d-%02d", seq, i)
+			kvs[key] = fmt.Sprintf("value-%d-%s", seq, strings.Repeat("v", 64))
+			expected[key] = kvs[key]
+		}
+		writeLevelSST(tb, conf, 0, uint32(seq), kvs)
+	}
+	return expected
+}
+
+func TestLsmTree_LoadSSTParallel(t *testing.T) {
+	for _, parallelism := range []int{0, 1, 8} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.OpenFilesParallelism = parallelism
+			expected := writeStartupSSTs(t, conf, 50)
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			// 文件按序列号顺序载入，新文件的序列号在已有文件之后
+			for i, file := range tree.Levels()[0].Files {
+				if file.Seq != uint32(i) {
+					t.Fatalf("node %d has seq %d", i, file.Seq)
+				}
+			}
+			if seq := tree.seq[0].Load(); seq != 50 {
+				t.Fatalf("next seq = %d, want 50", seq)
+			}
+			for key, value := range expected {
+				if got, err := tree.Get([]byte(key)); err != nil || string(got) != value {
+					t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+				}
+			}
+		})
+	}
+}
+
+func TestLsmTree_LoadSSTErrors(t *testing.T) {
+	conf := newTestConfig(t)
+	expected := writeStartupSSTs(t, conf, 5)
+	dir := filepath.Join(conf.DataDir, conf.SSTDir)
+	broken := []string{filepath.Join(dir, "0_1.sst"), filepath.Join(dir, "0_3.sst")}
+	for _, path := range broken {
+		if err := os.WriteFile(path, []byte("junk"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 默认汇总所有无法打开的文件后打开失败
+	_, err := NewLsmTree(conf)
+	if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("NewLsmTree err = %v, want ErrInvalidSSTFormat", err)
+	}
+	for _, path := range broken {
+		if !strings.Contains(err.Error(), path) {
+			t.Fatalf("error %q does not mention %s", err, path)
+		}
+	}
+
+	// 开启隔离后移走无法打开的文件，其余文件正常载入
+	conf.QuarantineUnreadableSST = true
+	conf.StrictDirectoryScan = true
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+	for _, path := range broken {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s was not moved: %v", path, err)
+		}
+		if _, err := os.Stat(filepath.Join(conf.QuarantinePath(), filepath.Base(path))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(tree.Levels()[0].Files); n != 3 {
+		t.Fatalf("loaded %d files, want 3", n)
+	}
+	if seq := tree.seq[0].Load(); seq != 5 {
+		t.Fatalf("next seq = %d, want 5", seq)
+	}
+	for key, value := range expected {
+		if strings.HasPrefix(key, "key-0001-") || strings.HasPrefix(key, "key-0003-") {
+			continue
+		}
+		if got, err := tree.Get([]byte(key)); err != nil || string(got) != value {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+
+	// 隔离目录不在SST目录中，重新打开时不会被扫描
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conf.QuarantineUnreadableSST = false
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkLsmTree_OpenSST200 比较逐个立即解析200个小SST文件与启动时并发延迟打开的耗时
+func BenchmarkLsmTree_OpenSST200(b *testing.B) {
+	conf := config.DefaultConfig()
+	conf.DataDir = b.TempDir()
+	conf.IsDebug = false
+	conf.Logger = nil
+	writeStartupSSTs(b, conf, 200)
+	entries, err := os.ReadDir(conf.SSTPath())
+	if err != nil {
+		b.Fatal(err)
+	}
+	files := make([]*sstFile, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, &sstFile{filePath: filepath.Join(conf.SSTPath(), entry.Name())})
+	}
+	closeAll := func(b *testing.B, readers []*sst.SSTReader) {
+		for _, reader := range readers {
+			if err := reader.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("SerialEager", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			readers := make([]*sst.SSTReader, 0, len(files))
+			for _, file := range files {
+				reader, err := sst.NewSSTReader(conf, file.filePath)
+				if err != nil {
+					b.Fatal(err)
+				}
+				readers = append(readers, reader)
+			}
+			closeAll(b, readers)
+		}
+	})
+	b.Run("ParallelLazy", func(b *testing.B) {
+		tree := &LsmTree{conf: conf}
+		for i := 0; i < b.N; i++ {
+			readers, err := tree.openSSTFiles(files)
+			if err != nil {
+				b.Fatal(err)
+			}
+			closeAll(b, readers)
+		}
+	})
+}
+
+// checkLayout 检查清单中的SST路径，返回各文件相对SST目录的路径
+func checkLayout(t *testing.T, tree *LsmTree) []string {
+	t.Helper()
+	paths := make([]string, 0)
+	for _, file := range tree.manifest.Files() {
+		if filepath.IsAbs(file.Path) || strings.Contains(file.Path, `\`) {
+			t.Fatalf("manifest path %q is not relative", file.Path)
+		}
+		if _, err := os.Stat(filepath.Join(tree.conf.SSTPath(), filepath.FromSlash(file.Path))); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, file.Path)
+	}
+	return paths
+}
+
+func TestLsmTree_SSTLayout(t *testing.T) {
+	checkKeys := func(t *testing.T, tree *LsmTree, want map[string]string) {
+		t.Helper()
+		for key, value := range want {
+			got, err := tree.Get([]byte(key))
+			if err != nil || string(got) != value {
+				t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+			}
+		}
+	}
+	flushKey := func(t *testing.T, tree *LsmTree, key, value string) {
+		t.Helper()
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		flushAll(t, tree)
+	}
+
+	t.Run("LegacyFlat", func(t *testing.T) {
+		conf := newTestConfig(t)
+		writeLevelSST(t, conf, 0, 0, map[string]string{"a": "1"})
+		writeLevelSST(t, conf, 1, 3, map[string]string{"b": "2"})
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2"})
+		flushKey(t, tree, "c", "3")
+		paths := checkLayout(t, tree)
+		if want := []string{"0_0.sst", "0_0000000001.sst", "1_3.sst"}; fmt.Sprint(paths) != fmt.Sprint(want) {
+			t.Fatalf("manifest paths = %v, want %v", paths, want)
+		}
+	})
+
+	t.Run("FreshNested", func(t *testing.T) {
+		conf := newTestConfig(t)
+		conf.SSTLayout = config.SSTLayoutNested
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for level := 0; level < conf.LevelSize; level++ {
+			if info, err := os.Stat(conf.SSTLevelDir(level)); err != nil || !info.IsDir() {
+				t.Fatalf("level dir L%d missing: %v", level, err)
+			}
+		}
+		flushKey(t, tree, "a", "1")
+		flushKey(t, tree, "b", "2")
+		if paths := checkLayout(t, tree); fmt.Sprint(paths) != "[L0/0000000000.sst L0/0000000001.sst]" {
+			t.Fatalf("manifest paths = %v", paths)
+		}
+		if names := sstNames(t, conf); len(names) != 0 {
+			t.Fatalf("nested layout wrote %v into the SST directory", names)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if tree, err = NewLsmTree(conf); err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2"})
+	})
+
+	t.Run("FlatToNested", func(t *testing.T) {
+		conf := newTestConfig(t)
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushKey(t, tree, "a", "1")
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// newPaths 返回新增的文件路径，要求它们都以prefix开头
+		seen := make(map[string]bool)
+		newPaths := func(t *testing.T, prefix string) {
+			t.Helper()
+			added := 0
+			for _, path := range checkLayout(t, tree) {
+				if seen[path] {
+					continue
+				}
+				if !strings.HasPrefix(path, prefix) {
+					t.Fatalf("new sst %s does not start with %q", path, prefix)
+				}
+				seen[path] = true
+				added++
+			}
+			if added == 0 {
+				t.Fatalf("no new sst with prefix %q", prefix)
+			}
+		}
+
+		// 旧布局的文件保留在原处，新文件写入层级子目录，两种布局并存
+		conf.SSTLayout = config.SSTLayoutNested
+		if tree, err = NewLsmTree(conf); err != nil {
+			t.Fatal(err)
+		}
+		newPaths(t, "0_")
+		flushKey(t, tree, "b", "2")
+		newPaths(t, "L0/")
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2"})
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 切回平铺布局仍能读取子目录中的文件
+		conf.SSTLayout = config.SSTLayoutFlat
+		if tree, err = NewLsmTree(conf); err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2"})
+		flushKey(t, tree, "c", "3")
+		newPaths(t, "0_")
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2", "c": "3"})
+	})
+
+	t.Run("QuarantineNested", func(t *testing.T) {
+		conf := newTestConfig(t)
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flushKey(t, tree, "a", "1")
+		flushKey(t, tree, "b", "2")
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// 子目录中与清单文件同序列号的副本不在清单中，无法确认来源而被隔离
+		data, err := os.ReadFile(filepath.Join(conf.SSTPath(), "0_0000000000.sst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf.SSTLayout = config.SSTLayoutNested
+		if err := os.MkdirAll(conf.SSTLevelDir(0), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(conf.SSTLevelDir(0), "0000000000.sst"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if tree, err = NewLsmTree(conf); err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		checkKeys(t, tree, map[string]string{"a": "1", "b": "2"})
+		if _, err := os.Stat(filepath.Join(conf.QuarantinePath(), "L0_0000000000.sst")); err != nil {
+			t.Fatalf("sst was not quarantined under its relative path: %v", err)
+		}
+	})
+}
+
+// walNames 返回WAL目录中的文件名
+func walNames(t *testing.T, conf *config.Config) []string {
+	t.Helper()
+	entries, err := os.ReadDir(conf.WalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+// crashBeforeWALDelete 写入keys并刷盘，返回在SST记入清单后、WAL删除前断电的数据目录配置以及已刷盘的WAL文件名
+func crashBeforeWALDelete(t *testing.T, keys int) (*config.Config, string) {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	snapshot, captured := crashAt(t, conf, config.CrashBeforeWALDelete)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < keys; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Delete([]byte("key-00")); err != nil {
+		t.Fatal(err)
+	}
+	flushed := wal.FileName(tree.curWal.ID())
+	flushAll(t, tree)
+	if !*captured {
+		t.Fatal("flush did not reach the crash point")
+	}
+	crashed := newTestConfig(t)
+	crashed.DataDir = snapshot
+	if names := sstNames(t, crashed); len(names) != 1 || !slices.Contains(walNames(t, crashed), flushed) {
+		t.Fatalf("snapshot has sst files %v and wals %v, want one sst and %s", names, walNames(t, crashed), flushed)
+	}
+	return crashed, flushed
+}
+
+// 刷盘生成的SST记入清单后、删除WAL前崩溃：重启时删除WAL而不是再次刷盘，数据只在一个SST中
+func TestLsmTree_LoadRemovesFlushedWAL(t *testing.T) {
+	crashed, flushed := crashBeforeWALDelete(t, 50)
+	check := func(tree *LsmTree) {
+		t.Helper()
+		if _, err := tree.Get([]byte("key-00")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(key-00) = %v, want deleted", err)
+		}
+		for i := 1; i < 50; i++ {
+			if value, err := tree.Get([]byte(fmt.Sprintf("key-%02d", i))); err != nil || string(value) != "v" {
+				t.Fatalf("Get(key-%02d) = %q, %v", i, value, err)
+			}
+		}
+	}
+	for reopen := 0; reopen < 2; reopen++ {
+		tree, err := NewLsmTree(crashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(tree)
+		for _, imm := range tree.immutableIndex {
+			if wal.FileName(imm.wal.ID()) == flushed {
+				t.Fatalf("flushed wal %s was replayed", flushed)
+			}
+		}
+		if names := walNames(t, crashed); slices.Contains(names, flushed) {
+			t.Fatalf("flushed wal %s was not removed: %v", flushed, names)
+		}
+		// 新WAL的id不与SST中记录的来源WAL重复
+		if id := tree.curWal.ID(); wal.FileName(id) == flushed {
+			t.Fatalf("new wal reuses flushed wal id %d", id)
+		}
+		if names := sstNames(t, crashed); len(names) != 1 {
+			t.Fatalf("sst files %v after recovery, want exactly one", names)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 合并刷盘的SST记入清单后、删除WAL前崩溃：重启时一起删除所有来源WAL；删除到一半时崩溃，
+// 剩余的较新的WAL中每个key都是合并后的最新版本，同样删除而不是重放
+func TestLsmTree_LoadRemovesCoalescedWALs(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	conf.MaxMemtablesPerFlush = 4
+	snapshot, captured := crashAt(t, conf, config.CrashBeforeWALDelete)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	// 持有写锁完成写入和轮转，后台刷盘在释放写锁后一次认领全部三个不可变内存表
+	tree.mu.Lock()
+	flushed := make([]string, 0, 3)
+	for r := 0; r < 3; r++ {
+		for _, key := range []string{fmt.Sprintf("key-%d", r), "shared"} {
+			value := []byte(fmt.Sprintf("v%d", r))
+			if err := tree.curWal.Write([]byte(key), value); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.putMutable(kv.FromValue([]byte(key), value, 0)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushed = append(flushed, wal.FileName(tree.curWal.ID()))
+		if err := tree.rotateWal(RotationManual); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.mu.Unlock()
+	waitFlushed(t, tree)
+	// 关闭时等待后台刷盘删除WAL，之后崩溃点一定已经执行
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !*captured {
+		t.Fatal("flush did not reach the crash point")
+	}
+
+	partial := filepath.Join(t.TempDir(), "partial")
+	copyDir(t, snapshot, partial)
+	crashed := newTestConfig(t)
+	crashed.DataDir = partial
+	if err := os.Remove(filepath.Join(crashed.WalPath(), flushed[0])); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{snapshot, partial} {
+		crashed.DataDir = dir
+		if names := sstNames(t, crashed); len(names) != 1 {
+			t.Fatalf("%s: sst files %v, want one merged file", dir, names)
+		}
+		tree, err := NewLsmTree(crashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imm := range tree.immutableIndex {
+			if name := wal.FileName(imm.wal.ID()); slices.Contains(flushed, name) {
+				t.Fatalf("%s: flushed wal %s was replayed", dir, name)
+			}
+		}
+		for key, want := range map[string]string{"key-0": "v0", "key-1": "v1", "key-2": "v2", "shared": "v2"} {
+			if value, err := tree.Get([]byte(key)); err != nil || string(value) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", dir, key, value, err, want)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if names := walNames(t, crashed); slices.ContainsFunc(flushed, func(name string) bool { return slices.Contains(names, name) }) {
+			t.Fatalf("%s: flushed wals %v were not removed: %v", dir, flushed, names)
+		}
+	}
+}
+
+// WAL中有SST不包含的条目时不是同一次刷盘的WAL，照常重放
+func TestLsmTree_LoadReplaysMismatchedWAL(t *testing.T) {
+	crashed, flushed := crashBeforeWALDelete(t, 10)
+	var walId uint32
+	if _, err := fmt.Sscanf(flushed, "wal-%d.log", &walId); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wal.NewWal(crashed, walId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]byte("extra"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := NewLsmTree(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if imm := tree.immutableIndex[0]; imm.wal.ID() != walId {
+		t.Fatalf("replayed wal %d first, want %d", imm.wal.ID(), walId)
+	}
+	if value, err := tree.Get([]byte("extra")); err != nil || string(value) != "x" {
+		t.Fatalf("Get(extra) = %q, %v", value, err)
+	}
+}
+
+// 更旧的WAL尚未刷盘时，之后已刷盘的WAL也重放，其数据仍然比更旧的WAL新
+func TestLsmTree_LoadReplaysFlushedWALAfterUnflushed(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	older := rotateAndHold(t, tree)
+	if err := tree.Put([]byte("key"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	newer := rotateAndHold(t, tree)
+	flushHeld(t, tree, newer)
+	// 在更旧的内存表刷盘前断电，两个WAL都还在
+	crashed := newTestConfig(t)
+	crashed.DataDir = filepath.Join(t.TempDir(), "crash")
+	copyDir(t, conf.DataDir, crashed.DataDir)
+	releaseHeld(tree, older)
+	for _, imm := range []*immutable{older, newer} {
+		if name := wal.FileName(imm.wal.ID()); !slices.Contains(walNames(t, crashed), name) {
+			t.Fatalf("wals %v, want %s", walNames(t, crashed), name)
+		}
+	}
+
+	recovered, err := NewLsmTree(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if n := len(recovered.immutableIndex); n < 2 || recovered.immutableIndex[1].wal.ID() != newer.wal.ID() {
+		t.Fatalf("replayed %d immutables, want the flushed wal replayed after the unflushed one", n)
+	}
+	if value, err := recovered.Get([]byte("key")); err != nil || string(value) != "new" {
+		t.Fatalf("Get(key) = %q, %v, want new", value, err)
+	}
+}
+
+// 重启后新WAL的id大于所有已有的WAL，包括只有wal-0的情况，写入不会追加到已有的WAL中
+func TestLsmTree_NextWalId(t *testing.T) {
+	for _, last := range []uint32{0, 3} {
+		t.Run(wal.FileName(last), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.WalSize = 1 << 20
+			sizes := make(map[string]int64)
+			for id := uint32(0); id <= last; id++ {
+				writeWal(t, conf, id, [][2][]byte{{[]byte(fmt.Sprintf("key%d", id)), []byte("old")}})
+				info, err := os.Stat(filepath.Join(conf.WalPath(), wal.FileName(id)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				sizes[info.Name()] = info.Size()
+			}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := tree.curWal.ID(); id != last+1 {
+				t.Fatalf("active wal id %d, want %d", id, last+1)
+			}
+			if want := filepath.Join(conf.WalPath(), wal.FileName(last+1)); tree.curWal.Path() != want {
+				t.Fatalf("active wal %s, want %s", tree.curWal.Path(), want)
+			}
+			if err := tree.Put([]byte("new"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			for name, size := range sizes {
+				info, err := os.Stat(filepath.Join(conf.WalPath(), name))
+				if errors.Is(err, os.ErrNotExist) {
+					continue // 已刷盘删除
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != size {
+					t.Fatalf("%s grew from %d to %d bytes", name, size, info.Size())
+				}
+			}
+
+			tree, err = NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			for id := uint32(0); id <= last; id++ {
+				getValue(t, tree, fmt.Sprintf("key%d", id), "old")
+			}
+			getValue(t, tree, "new", "value")
+		})
+	}
+}
+
+// 多个未刷盘的WAL同时重放，较新的WAL中的写入覆盖较旧的，RecoveryStats统计重放的文件、字节和记录
+func TestLsmTree_ParallelWALReplay(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	wals := make([][]walModeOp, 6)
+	for i := range wals {
+		wals[i] = randomWalModeOps(rng, 500)
+	}
+	for _, parallelism := range []int{1, 4} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.WALReplayParallelism = parallelism
+			var all []walModeOp
+			var size int64
+			for id, ops := range wals {
+				records := make([][2][]byte, len(ops))
+				for i, op := range ops {
+					records[i] = [2][]byte{op.key, op.value}
+				}
+				writeWal(t, conf, uint32(id), records)
+				info, err := os.Stat(filepath.Join(conf.WalPath(), wal.FileName(uint32(id))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				size += info.Size()
+				all = append(all, ops...)
+			}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			if got, want := scanAll(t, tree), modelAfter(all); got != want {
+				t.Fatalf("replayed contents:\n%s\nwant:\n%s", got, want)
+			}
+			stats := tree.Stats().Recovery
+			if stats.WALFiles != len(wals) || stats.WALBytes != size || stats.Records != int64(len(all)) || stats.Parallelism != parallelism {
+				t.Fatalf("Recovery = %+v, want %d files, %d bytes, %d records, parallelism %d", stats, len(wals), size, len(all), parallelism)
+			}
+			if stats.Duration <= 0 || stats.BytesPerSecond() <= 0 {
+				t.Fatalf("Recovery duration %v, throughput %f", stats.Duration, stats.BytesPerSecond())
+			}
+		})
+	}
+}
+
+// walModeOp 随机负载中的一次写入，value为nil时删除key
+type walModeOp struct {
+	key, value []byte
+}
+
+func randomWalModeOps(rng *rand.Rand, n int) []walModeOp {
+	ops := make([]walModeOp, n)
+	for i := range ops {
+		ops[i].key = []byte(fmt.Sprintf("key-%03d", rng.Intn(60)))
+		if rng.Intn(5) > 0 {
+			ops[i].value = []byte(fmt.Sprintf("v%d-%x", i, rng.Int63()))
+		}
+	}
+	return ops
+}
+
+// modelAfter 返回依次执行ops后的全部键值，格式与scanAll相同
+func modelAfter(ops []walModeOp) string {
+	model := make(map[string]string)
+	for _, op := range ops {
+		if op.value == nil {
+			delete(model, string(op.key))
+		} else {
+			model[string(op.key)] = string(op.value)
+		}
+	}
+	var buf strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(model)) {
+		fmt.Fprintf(&buf, "%s=%s\n", key, model[key])
+	}
+	return buf.String()
+}
+
+func applyWalModeOps(t *testing.T, tree *LsmTree, ops []walModeOp, acked *atomic.Int64) {
+	t.Helper()
+	for _, op := range ops {
+		var err error
+		if op.value == nil {
+			err = tree.Delete(op.key)
+		} else {
+			err = tree.Put(op.key, op.value)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acked != nil {
+			acked.Add(1)
+		}
+	}
+}
+
+// flushPending 刷盘所有不可变内存表但不轮转可变内存表，compactCh已满时后台不会刷盘多出的不可变内存表
+func flushPending(t *testing.T, tree *LsmTree) {
+	t.Helper()
+	tree.mu.RLock()
+	pending := slices.Clone(tree.immutableIndex)
+	tree.mu.RUnlock()
+	for _, imm := range pending {
+		if err := tree.doCompact(imm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFlushed(t, tree)
+}
+
+func walModeConfig(t *testing.T, mode config.WALMode) *config.Config {
+	conf := newTestConfig(t)
+	conf.WalSize = 256
+	conf.SharedWalFileSize = 1024
+	conf.WALMode = mode
+	return conf
+}
+
+// copyLiveDir 复制仍在运行的树的数据目录，复制期间消失的文件视为已删除。调用方需保证复制期间清单不变，
+// 此时消失的只有已记入清单的WAL和临时文件
+func copyLiveDir(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// recoverWalMode 以mode打开崩溃后的目录dir，检查内容等于ops[:j]的结果(lo<=j<=hi)，
+// 继续写入more并重新打开后检查内容，返回恢复后的内容
+func recoverWalMode(t *testing.T, dir string, mode config.WALMode, ops, more []walModeOp, lo, hi int) string {
+	t.Helper()
+	conf := walModeConfig(t, mode)
+	conf.DataDir = dir
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := scanAll(t, tree)
+	j := lo
+	for j <= min(hi, len(ops)) && got != modelAfter(ops[:j]) {
+		j++
+	}
+	if j > min(hi, len(ops)) {
+		tree.Close()
+		t.Fatalf("recovered contents match no prefix of ops in [%d, %d]:\n%s", lo, hi, got)
+	}
+	// 恢复后继续写入，重新打开时不会重放已刷盘的数据覆盖新写入
+	applyWalModeOps(t, tree, more, nil)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	want := modelAfter(append(slices.Clone(ops[:j]), more...))
+	if after := scanAll(t, tree); after != want {
+		t.Fatalf("after reopen got:\n%s\nwant:\n%s", after, want)
+	}
+	return got
+}
+
+func TestLsmTree_WALModeRecoveryEquivalence(t *testing.T) {
+	modes := []config.WALMode{config.WALModePerMemtable, config.WALModeShared}
+	for seed := int64(1); seed <= 4; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		ops := randomWalModeOps(rng, 400)
+		more := randomWalModeOps(rng, 50)
+
+		// 在随机的写入之后等待刷盘结束并复制目录，两种方式恢复出的内容都等于写入到该处的结果，
+		// 并且每个目录以另一种方式打开时结果相同
+		stop := rng.Intn(len(ops)) + 1
+		snapshots := make([]string, len(modes))
+		for i, mode := range modes {
+			conf := walModeConfig(t, mode)
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			applyWalModeOps(t, tree, ops[:stop], nil)
+			flushPending(t, tree)
+			snapshots[i] = filepath.Join(t.TempDir(), "crash")
+			copyLiveDir(t, conf.DataDir, snapshots[i])
+			tree.Close()
+		}
+		for i, dir := range snapshots {
+			for _, mode := range modes {
+				copied := filepath.Join(t.TempDir(), "copy")
+				copyDir(t, dir, copied)
+				got := recoverWalMode(t, copied, mode, ops, more, stop, stop)
+				if got != modelAfter(ops[:stop]) {
+					t.Fatalf("seed %d: mode %d snapshot opened as mode %d differs from model", seed, modes[i], mode)
+				}
+			}
+		}
+
+		// 在刷盘过程中的崩溃点复制目录，写入继续进行，恢复出的内容是复制期间某个写入前缀的结果
+		points := []string{config.CrashAfterSSTRename, config.CrashBeforeWALDelete, config.CrashAfterWALDelete}
+		for _, mode := range modes {
+			point, occurrence := points[rng.Intn(len(points))], rng.Intn(3)+1
+			conf := walModeConfig(t, mode)
+			snapshot := filepath.Join(t.TempDir(), "crash")
+			var acked atomic.Int64
+			var live atomic.Pointer[LsmTree]
+			var mu sync.Mutex // 后台和写入方同步刷盘都会执行到崩溃点
+			var seen int
+			lo, hi := -1, -1
+			conf.Hooks = &config.TestHooks{Crash: func(p string) {
+				if p != point {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if seen++; seen != occurrence {
+					return
+				}
+				// 持有写锁时另一个刷盘无法修改清单，写入方也无法写入，进行中的写入可能已写入WAL
+				tree := live.Load()
+				tree.mu.Lock()
+				defer tree.mu.Unlock()
+				lo = int(acked.Load())
+				copyLiveDir(t, conf.DataDir, snapshot)
+				hi = lo + 1
+			}}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			live.Store(tree)
+			for i := 0; i < len(ops); i += 50 {
+				applyWalModeOps(t, tree, ops[i:min(i+50, len(ops))], &acked)
+				flushPending(t, tree)
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if lo < 0 {
+				t.Fatalf("seed %d mode %d: crash point %s #%d never reached", seed, mode, point, occurrence)
+			}
+			recoverWalMode(t, snapshot, mode, ops, more, lo, hi)
+		}
+	}
+}
+
+func TestLsmTree_SharedWALSkipsFlushedGenerations(t *testing.T) {
+	conf := walModeConfig(t, config.WALModeShared)
+	conf.SharedWalFileSize = 1 << 20 // 所有内存表都写入同一个WAL文件
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 刷盘全部内存表后再写入少量数据，只有可变内存表的代数尚未刷盘
+	ops := randomWalModeOps(rand.New(rand.NewSource(1664)), 103)
+	applyWalModeOps(t, tree, ops[:100], nil)
+	flushAll(t, tree)
+	applyWalModeOps(t, tree, ops[100:], nil)
+	flushed := len(tree.Levels()[0].Files)
+	if flushed < 3 {
+		t.Fatalf("only %d memtables flushed", flushed)
+	}
+	wals, err := filepath.Glob(filepath.Join(conf.WalPath(), "*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wals) != 1 {
+		t.Fatalf("got wal files %v, want 1 shared file", wals)
+	}
+	snapshot := filepath.Join(t.TempDir(), "crash")
+	copyLiveDir(t, conf.DataDir, snapshot)
+	tree.Close()
+
+	// 只重放未刷盘的代数，刷盘后共享的WAL文件不再被使用而被删除
+	conf = walModeConfig(t, config.WALModeShared)
+	conf.SharedWalFileSize = 1 << 20
+	conf.DataDir = snapshot
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	waitFlushed(t, tree)
+	if got := len(tree.Levels()[0].Files); got != flushed+1 {
+		t.Fatalf("got %d L0 files after recovery, want %d", got, flushed+1)
+	}
+	if got, want := scanAll(t, tree), modelAfter(ops); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(conf.WalPath(), filepath.Base(wals[0]))); !os.IsNotExist(err) {
+		t.Fatalf("shared wal %s not deleted: %v", filepath.Base(wals[0]), err)
+	}
+}
+
+// writeCorruptSetup 刷盘三个key范围不相交的L0文件，关闭后破坏中间的文件(b00~b09)，返回该文件的路径。
+// 最新的文件中还有b03的新版本
+func writeCorruptSetup(t *testing.T, conf *config.Config) string {
+	t.Helper()
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("%s%02d", prefix, i)), []byte(prefix)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if prefix == "c" {
+			if err := tree.Put([]byte("b03"), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushAll(t, tree)
+	}
+	path := tree.Levels()[0].Files[1].Path
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("junk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLsmTree_CorruptFilePolicy(t *testing.T) {
+	available := map[string]string{"a00": "a", "a09": "a", "b03": "new", "c00": "c", "c09": "c"}
+	checkAvailable := func(t *testing.T, tree *LsmTree) {
+		t.Helper()
+		for key, value := range available {
+			if got, err := tree.Get([]byte(key)); err != nil || string(got) != value {
+				t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+			}
+		}
+		if _, err := tree.Get([]byte("b99")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(b99) outside the lost range: %v, want ErrKeyNotFound", err)
+		}
+		if got := prefixKeys(t, tree, "c"); len(got) != 10 {
+			t.Fatalf("PrefixScan(c) = %v", got)
+		}
+	}
+
+	t.Run("FailOpen", func(t *testing.T) {
+		conf := newTestConfig(t)
+		path := writeCorruptSetup(t, conf)
+		_, err := NewLsmTree(conf)
+		if !errors.Is(err, ErrInvalidSSTFormat) || !strings.Contains(err.Error(), path) {
+			t.Fatalf("NewLsmTree err = %v, want ErrInvalidSSTFormat for %s", err, path)
+		}
+	})
+
+	t.Run("Quarantine", func(t *testing.T) {
+		conf := newTestConfig(t)
+		path := writeCorruptSetup(t, conf)
+		conf.CorruptFilePolicy = config.CorruptFileQuarantine
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(conf.QuarantinePath(), filepath.Base(path))); err != nil {
+			t.Fatalf("corrupt sst was not quarantined: %v", err)
+		}
+		checkAvailable(t, tree)
+		// 被隔离的文件范围内没有更新版本的key不可用，不会被误报为不存在
+		for _, key := range []string{"b00", "b05", "b055", "b09"} {
+			if _, err := tree.Get([]byte(key)); !errors.Is(err, ErrRangeUnavailable) || errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get(%s) = %v, want ErrRangeUnavailable", key, err)
+			}
+		}
+		if _, errs := tree.MultiGet([][]byte{[]byte("a01"), []byte("b05")}); errs[0] != nil || !errors.Is(errs[1], ErrRangeUnavailable) {
+			t.Fatalf("MultiGet errs = %v", errs)
+		}
+		if err := tree.PrefixScan([]byte("b"), func(key, value []byte) bool { return true }); !errors.Is(err, ErrRangeUnavailable) {
+			t.Fatalf("PrefixScan(b) = %v, want ErrRangeUnavailable", err)
+		}
+		// 之后写入的版本比被隔离的文件新
+		if err := tree.Put([]byte("b05"), []byte("rewritten")); err != nil {
+			t.Fatal(err)
+		}
+		flushAll(t, tree)
+		if got, err := tree.Get([]byte("b05")); err != nil || string(got) != "rewritten" {
+			t.Fatalf("Get(b05) after rewrite = %q, %v", got, err)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// 文件已从清单中删除，默认策略也能打开，不可用范围记录在隔离目录中仍然有效
+		conf.CorruptFilePolicy = config.CorruptFileFailOpen
+		if tree, err = NewLsmTree(conf); err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		checkAvailable(t, tree)
+		if _, err := tree.Get([]byte("b06")); !errors.Is(err, ErrRangeUnavailable) {
+			t.Fatalf("Get(b06) after reopen = %v, want ErrRangeUnavailable", err)
+		}
+		if got, err := tree.Get([]byte("b05")); err != nil || string(got) != "rewritten" {
+			t.Fatalf("Get(b05) after reopen = %q, %v", got, err)
+		}
+	})
+
+	t.Run("Ignore", func(t *testing.T) {
+		conf := newTestConfig(t)
+		path := writeCorruptSetup(t, conf)
+		conf.CorruptFilePolicy = config.CorruptFileIgnore
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkAvailable(t, tree)
+		if _, err := tree.Get([]byte("b05")); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("Get(b05) = %v, want ErrKeyNotFound", err)
+		}
+		if got := prefixKeys(t, tree, "b"); fmt.Sprint(got) != "[b03]" {
+			t.Fatalf("PrefixScan(b) = %v, want [b03]", got)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// 文件留在原处和清单中，默认策略打开时仍然失败
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("ignored sst was moved: %v", err)
+		}
+		conf.CorruptFilePolicy = config.CorruptFileFailOpen
+		if _, err := NewLsmTree(conf); !errors.Is(err, ErrInvalidSSTFormat) {
+			t.Fatalf("NewLsmTree err = %v, want ErrInvalidSSTFormat", err)
+		}
+	})
+}
+
+// prefixKeys 返回以prefix开头的key
+func prefixKeys(t *testing.T, tree *LsmTree, prefix string) []string {
+	t.Helper()
+	var keys []string
+	if err := tree.PrefixScan([]byte(prefix), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,52 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// lockFileName 目录锁文件名
+const lockFileName = "LOCK"
+
+// dirLock 持有的一组目录锁
+type dirLock struct {
+	files []*os.File // 已加锁的锁文件
+}
+
+// lockDirs 在每个目录下创建锁文件并加排他锁，任一目录已被锁定时释放已获取的锁并返回ErrDirLocked
+func lockDirs(dirs ...string) (*dirLock, error) {
+	lock := &dirLock{}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, lockFileName)
+		fp, err := fsio.OpenOrCreate(path, fsio.Positional)
+		if err != nil {
+			lock.release()
+			return nil, err
+		}
+		if err := lockFile(fp); err != nil {
+			fp.Close()
+			lock.release()
+			return nil, fmt.Errorf("%w: %s: %v", myerror.ErrDirLocked, path, err)
+		}
+		lock.files = append(lock.files, fp)
+	}
+	return lock, nil
+}
+
+// release 释放所有目录锁，可以重复调用
+func (l *dirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	errs := make([]error, 0)
+	for _, fp := range l.files {
+		errs = append(errs, unlockFile(fp), fp.Close())
+	}
+	l.files = nil
+	return errors.Join(errs...)
+}
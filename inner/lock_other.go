@@ -0,0 +1,41 @@
+//go:build !unix
+
+package inner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 不支持flock的平台上只在进程内检测重复打开
+var (
+	lockedMu    sync.Mutex
+	lockedFiles = make(map[string]struct{})
+)
+
+func lockFile(fp *os.File) error {
+	path, err := filepath.Abs(fp.Name())
+	if err != nil {
+		return err
+	}
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	if _, ok := lockedFiles[path]; ok {
+		return errors.New("already locked in this process")
+	}
+	lockedFiles[path] = struct{}{}
+	return nil
+}
+
+func unlockFile(fp *os.File) error {
+	path, err := filepath.Abs(fp.Name())
+	if err != nil {
+		return err
+	}
+	lockedMu.Lock()
+	defer lockedMu.Unlock()
+	delete(lockedFiles, path)
+	return nil
+}
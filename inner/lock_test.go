@@ -0,0 +1,74 @@
+package inner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestLsmTree_NestedDirectories(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.DataDir = filepath.Join(conf.DataDir, "a", "b", "c")
+	conf.WalDir = filepath.Join("x", "y", "wal")
+	conf.SSTDir = filepath.Join(t.TempDir(), "deep", "sst")
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(conf.DataDir, "x", "y", "wal", "wal-0.log")); err != nil {
+		t.Fatalf("expected wal inside nested WalDir: %v", err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if value, err := tree.Get([]byte("k")); err != nil || string(value) != "v" {
+		t.Fatalf("get after reopen: %q, %v", value, err)
+	}
+}
+
+func TestLsmTree_LockSharedDirectory(t *testing.T) {
+	shared := filepath.Join(t.TempDir(), "wal")
+	first := newTestConfig(t)
+	first.WalDir = shared
+	tree, err := NewLsmTree(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 数据目录不同，但WAL目录解析到同一个物理目录
+	second := newTestConfig(t)
+	second.WalDir = shared
+	if _, err := NewLsmTree(second); !errors.Is(err, myerror.ErrDirLocked) {
+		t.Fatalf("expected ErrDirLocked, got %v", err)
+	}
+
+	// 相同目录的不同写法同样会被检测
+	third := newTestConfig(t)
+	third.DataDir = first.DataDir
+	third.WalDir = filepath.Join(shared, "..", "wal")
+	third.SSTDir = filepath.Join(".", "sst", ".")
+	if _, err := NewLsmTree(third); !errors.Is(err, myerror.ErrDirLocked) {
+		t.Fatalf("expected ErrDirLocked, got %v", err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(second)
+	if err != nil {
+		t.Fatalf("open after close: %v", err)
+	}
+	tree.Close()
+}
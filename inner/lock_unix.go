@@ -0,0 +1,17 @@
+//go:build unix
+
+package inner
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile 对文件加非阻塞排他锁，同一进程内重复打开加锁同样会失败
+func lockFile(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unlockFile(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
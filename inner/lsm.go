@@ -1,39 +1,95 @@
 package inner
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/manifest"
 	"github.com/aixiasang/lsm/inner/memtable"
 	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/ratelimit"
 	"github.com/aixiasang/lsm/inner/sst"
 	"github.com/aixiasang/lsm/inner/wal"
 )
 
 type LsmTree struct {
-	conf           *config.Config    // 配置
-	mutableIndex   memtable.MemTable // 内存表
-	walId          uint32            // 写日志文件id
-	curWal         *wal.Wal          // 当前写日志
-	immutableIndex []*immutable      // 不可变索引
-	compactCh      chan *immutable   // 压缩通道，用于异步传递不可变索引进行压缩
-	stopCh         chan struct{}     // 停止信号通道
-	nodes          [][]*sst.Node     // 节点 - array of slices of nodes for each level
-	seq            []*atomic.Uint32  // 序列号
-	levelSize      int               // 层级大小
+	conf           *config.Config     // 配置
+	mutableIndex   memtable.MemTable  // 内存表
+	walId          uint32             // 载入时计算出的第一个新WAL的id，之后的id由curWal.ID()推出
+	curWal         *wal.Wal           // 当前写日志
+	walGen         uint64             // 共享WAL模式下可变内存表的代数，受t.mu保护
+	genStart       uint32             // 可变内存表的记录在curWal中开始的偏移，受t.mu保护
+	immutableIndex []*immutable       // 不可变索引
+	compactCh      chan *immutable    // 压缩通道，用于异步传递不可变索引进行压缩
+	vacuumCh       chan vacuumRequest // Vacuum请求，由压缩goroutine执行
+	stopCh         chan struct{}      // 停止信号通道
+	nodes          [][]*sst.Node      // 各层节点，层内按序列号从小到大(从旧到新)排列，只通过addNodes添加
+	seq            []*atomic.Uint32   // 序列号
+	levelSize      int                // 层级大小
+	indexBudget    *sst.IndexBudget   // SST索引内存预算
+	filterBudget   *sst.FilterBudget  // SST过滤器内存预算
+	blockCache     *sst.BlockCache    // 数据块缓存，未启用时为nil
+	rowCache       *rowCache          // 行缓存，未启用时为nil
+	mu             sync.RWMutex       // 保护内存表、WAL和节点，读操作持有读锁，写操作和关闭持有写锁
+	closed         atomic.Bool        // 是否已关闭
+	closeOnce      sync.Once          // 保证Close只执行一次
+	closeErr       error              // 第一次Close的结果
+	workers        sync.WaitGroup     // 后台goroutine
+	txnMu          sync.Mutex         // 保护事务相关的状态
+	commitSeq      uint64             // 提交序列号，每次写入或事务提交递增
+	keyVersions    map[string]uint64  // 活跃事务期间被修改的key及其提交序列号
+	activeTxns     map[uint64]int     // 活跃事务的开始序列号及数量
+	stats          treeStats          // 读取统计
+	bufferedBytes  atomic.Int64       // 可变与不可变内存表的总大小
+	peakBuffered   atomic.Int64       // 内存表总大小的峰值
+	lock           *dirLock           // 数据目录锁
+	namespaces     *namespaceCatalog  // 命名空间目录
+	counters       writeCounters      // 累计写入量
+	compactLimiter *ratelimit.Limiter // 后台压缩的写入限速器
+	flushLimiter   *ratelimit.Limiter // 写入方同步刷盘的写入限速器
+	periodic       periodicState      // 定期压缩的调度状态
+	manifest       *manifest.Manifest // 当前SST文件集合的清单
+	walSync        walSyncState       // WAL已持久化到的提交序列号
+	bgError        bgErrorState       // 后台刷盘或压缩的错误
+	shadow         shadowLimiter      // ShadowVerifyReads的校验限速
+	throttle       throttleState      // L0文件过多时的写入限制
+	levels         levelState         // 按各层文件数上限调度的层级压缩
+	levelIO        levelIOCounters    // 按层级累计的刷盘和压缩读写量
+	unavailable    []unavailableRange // 启动时被隔离的SST文件的key范围，打开后只读
+	iterators      iteratorRegistry   // 进行中的遍历
+	watch          watchRegistry      // Watch注册的监听者
+	recovery       RecoveryStats      // 打开时重放WAL的统计，打开后不再改变
 }
 
 func NewLsmTree(conf *config.Config) (*LsmTree, error) {
-	dbDir := conf.DataDir
-
-	if err := os.MkdirAll(filepath.Join(dbDir, conf.WalDir), 0755); err != nil {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.Resolve(); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{conf.WalPath(), conf.SSTPath()} {
+		if err := makeDir(conf, dir); err != nil {
+			return nil, err
+		}
+	}
+	// 锁定WAL和SST目录，防止多个实例同时打开相同的物理目录
+	lock, err := lockDirs(conf.WalPath(), conf.SSTPath())
+	if err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(filepath.Join(dbDir, conf.SSTDir), 0755); err != nil {
+	namespaces, err := loadNamespaceCatalog(namespaceCatalogPath(conf.DataDir))
+	if err != nil {
+		lock.release()
 		return nil, err
 	}
 
@@ -59,79 +115,245 @@ func NewLsmTree(conf *config.Config) (*LsmTree, error) {
 
 	tree := &LsmTree{
 		conf:           conf,
-		mutableIndex:   memtable.NewMemTable(memtable.MemTableTypeBTree, 16),
 		immutableIndex: []*immutable{},
 		compactCh:      make(chan *immutable, 10), // 缓冲区大小为10
 		stopCh:         make(chan struct{}),
+		vacuumCh:       make(chan vacuumRequest),
 		nodes:          nodes,
 		seq:            seq,
 		levelSize:      levelSize,
+		indexBudget:    sst.NewIndexBudget(conf.IndexMemoryBudget),
+		filterBudget:   sst.NewFilterBudget(conf.FilterMemoryBudget),
+		blockCache:     newBlockCache(conf.BlockCacheSize),
+		rowCache:       newRowCache(conf.RowCacheSize),
+		keyVersions:    make(map[string]uint64),
+		activeTxns:     make(map[uint64]int),
+		lock:           lock,
+		namespaces:     namespaces,
+		compactLimiter: ratelimit.New(conf.CompactionRateLimitBytesPerSec, conf.GetClock()),
+		flushLimiter:   ratelimit.New(conf.FlushRateLimitBytesPerSec, conf.GetClock()),
+		bgError:        bgErrorState{retry: make(chan struct{}, 1)},
+		levels:         levelState{signal: make(chan struct{}, 1)},
+	}
+	if tree.mutableIndex, err = tree.newMemTable(); err != nil {
+		lock.release()
+		return nil, err
+	}
+	tree.levelIO.init(levelSize)
+	tree.stats.writeStages.Store(conf.WriteStageHistograms)
+	if err := tree.loadWriteCounters(); err != nil {
+		lock.release()
+		return nil, err
 	}
-	go tree.compactWorker()
 
 	if err := tree.load(); err != nil {
+		tree.manifest.Close()
+		lock.release()
 		return nil, err
 	}
-	// 启动后台goroutine监听compactCh通道，执行压缩操作
-	if tree.walId != 0 {
-		tree.walId++
-	}
+	tree.walId = conf.WalId(tree.walId)
 	curWal, err := wal.NewWal(conf, tree.walId)
 	if err != nil {
+		tree.manifest.Close()
+		lock.release()
 		return nil, err
 	}
 	tree.curWal = curWal
+	if conf.WALMode == config.WALModeShared {
+		// 共享WAL的记录都属于某个代数，新文件以可变内存表的代数标记开始
+		if _, err := curWal.WriteRecordAsync(wal.NewGenerationRecord(tree.walGen)); err != nil {
+			curWal.Close()
+			tree.manifest.Close()
+			lock.release()
+			return nil, err
+		}
+		tree.genStart = curWal.Size()
+	}
+	// 启动后台goroutine监听compactCh通道，执行压缩操作，开始前先刷盘从WAL重放的不可变内存表
+	recovered := append([]*immutable(nil), tree.immutableIndex...)
+	tree.workers.Add(1)
+	go tree.compactWorker(tree.newPeriodicTimer(), recovered)
+	if tree.periodicWalSync() {
+		tree.workers.Add(1)
+		go tree.walSyncWorker()
+	}
 	return tree, nil
 }
 
-// compactWorker 持续监听compactCh通道，执行压缩操作
-func (t *LsmTree) compactWorker() {
+// compactWorker 持续监听compactCh通道，执行压缩操作。timer不为nil时在其触发后定期检查SST文件。
+// ContinueWithRetry时在记录后台错误后按退避时间重试刷盘
+func (t *LsmTree) compactWorker(timer config.Timer, recovered []*immutable) {
+	defer t.workers.Done()
+	t.flushRecovered(recovered)
+	var retry config.Timer // 后台错误的重试定时器，未安排重试时为nil
 	for {
 		select {
 		case immutable := <-t.compactCh:
 			// 收到不可变索引，执行压缩
 			if err := t.doCompact(immutable); err != nil {
-				// 错误处理，实际应用中可能需要记录日志
-				// 这里简单地将错误打印出来
-				// 实际应用可能需要更复杂的错误处理机制
-				log.Printf("Compact error: %v", err)
+				t.conf.Errorf("compact error: %v", err)
 			}
+		case <-t.bgError.retry:
+			if retry == nil {
+				retry = t.conf.GetClock().NewTimer(t.nextRetryDelay())
+			}
+		case <-timerC(retry):
+			retry = nil
+			t.retryBackground()
+		case <-timerC(timer):
+			t.runPeriodicCompaction()
+			timer = t.newPeriodicTimer()
+		case <-t.levels.signal:
+			t.runLevelCompaction()
+		case req := <-t.vacuumCh:
+			req.done <- t.runVacuum(req.ctx)
 		case <-t.stopCh:
 			// 收到停止信号，结束goroutine
+			for _, pending := range []config.Timer{timer, retry} {
+				if pending != nil {
+					pending.Stop()
+				}
+			}
 			return
 		}
 	}
 }
 
-// Close 关闭LSM树，释放资源
-func (t *LsmTree) Close() error {
-	// 发送停止信号
-	close(t.stopCh)
-
-	// 关闭当前WAL
-	if err := t.curWal.Close(); err != nil {
-		return err
+// flushRecovered 按从旧到新的顺序逐个刷盘打开时从WAL重放的不可变内存表，已被写入方认领的跳过。
+// L0的顺序由重放时分配的序列号决定，与刷盘完成的顺序无关；按顺序刷盘时每次安装都能移除对应的内存表并删除WAL，
+// 中途关闭或崩溃时留下的总是较新的WAL
+func (t *LsmTree) flushRecovered(recovered []*immutable) {
+	for _, imm := range recovered {
+		if t.closed.Load() {
+			return
+		}
+		if err := t.doCompact(imm); err != nil {
+			t.conf.Errorf("flush recovered wal %d: %v", imm.wal.ID(), err)
+		}
 	}
+}
 
-	// 关闭所有不可变索引的WAL
+// Close 关闭LSM树，释放资源，可以重复调用
+// 关闭后所有读写操作返回ErrDBClosed，Close会等待进行中的操作和后台goroutine结束后再关闭文件
+func (t *LsmTree) Close() error {
+	t.closeOnce.Do(func() {
+		t.closeErr = t.close()
+	})
+	return t.closeErr
+}
+
+func (t *LsmTree) close() error {
+	t.closed.Store(true)
+	// 等待进行中的读写操作结束，之后获取锁的操作都会看到closed标记
+	t.mu.Lock()
+	flushing := make([]chan struct{}, 0)
 	for _, imm := range t.immutableIndex {
-		if err := imm.wal.Close(); err != nil {
-			return err
+		if imm.flushing != nil {
+			flushing = append(flushing, imm.flushing)
 		}
 	}
+	t.mu.Unlock()
+	// 等待写入方同步进行中的刷盘完成
+	for _, ch := range flushing {
+		<-ch
+	}
+
+	// 发送停止信号并等待后台goroutine退出，尚未压缩的WAL会在下次打开时重放
+	close(t.stopCh)
+	t.workers.Wait()
+
+	// 关闭当前WAL和所有不可变索引的WAL
+	var errs []error
+	for _, w := range t.openWals() {
+		errs = append(errs, w.Close())
+	}
+	walErr := errors.Join(errs...)
+	// WAL关闭后所有提交都已完成，发送剩余的事件并关闭监听者的通道
+	t.watch.close()
+	errs = append(errs, t.saveWriteCounters(), t.manifest.Close(), t.lock.release())
+	// 关闭WAL时已同步，唤醒所有WaitForSync
+	if walErr == nil {
+		t.walSync.finish(t.LastSequence())
+	} else {
+		t.walSync.finish(0)
+	}
+	return errors.Join(errs...)
+}
+
+// beginRead 获取读锁，数据库已关闭时返回ErrDBClosed，成功时调用方负责释放读锁
+func (t *LsmTree) beginRead() error {
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+	t.mu.RLock()
+	if t.closed.Load() {
+		t.mu.RUnlock()
+		return myerror.ErrDBClosed
+	}
+	return nil
+}
 
+// beginWrite 获取写锁，数据库已关闭时返回ErrDBClosed，成功时调用方负责释放写锁
+func (t *LsmTree) beginWrite() error {
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+	t.mu.Lock()
+	if t.closed.Load() {
+		t.mu.Unlock()
+		return myerror.ErrDBClosed
+	}
 	return nil
 }
 
 type immutable struct {
-	wal   *wal.Wal
-	index memtable.MemTable
+	wal       *wal.Wal
+	index     memtable.MemTable
+	seq       uint32        // 刷盘生成的L0文件的序列号，在轮转WAL时分配，L0的顺序与内存表的新旧一致而与刷盘完成的顺序无关
+	gen       uint64        // 共享WAL中内存表的代数，wal只属于这一个内存表时为0
+	installed bool          // 已刷盘并记入清单，更旧的不可变内存表尚未刷盘时仍保留在immutableIndex中提供读取，受t.mu保护
+	flushing  chan struct{} // 非nil表示正在刷盘，刷盘结束后关闭，受t.mu保护
 }
 
-func (t *LsmTree) rotateWal() error {
+// walFull 判断可变内存表写入WAL的大小是否超过WalSize，调用方需持有t.mu写锁
+func (t *LsmTree) walFull() bool {
+	return t.curWal.Size()-t.genStart > t.conf.WalSize
+}
+
+// rotateWal 将可变内存表转为不可变内存表，可能失败的步骤都在修改状态之前完成。按内存表划分WAL时切换到新的WAL文件；
+// 共享WAL时只在当前文件超过SharedWalFileLimit时切换文件，并写入新代数的标记，之后的记录属于新的内存表。
+// 失败时返回包装了ErrWalRotation的错误，内存表、WAL和代数保持不变，下次写满时重试。成功时按cause计数
+func (t *LsmTree) rotateWal(cause RotationCause) error {
+	index, err := t.newMemTable()
+	if err != nil {
+		return fmt.Errorf("%w: %w", myerror.ErrWalRotation, err)
+	}
+	shared := t.conf.WALMode == config.WALModeShared
+	next, gen := t.curWal, t.walGen
+	if !shared || t.curWal.Size() >= t.conf.SharedWalFileLimit() {
+		// 新WAL的id由当前WAL推出，不单独维护计数
+		if next, err = wal.NewWal(t.conf, t.conf.WalId(t.curWal.ID()+1)); err != nil {
+			return fmt.Errorf("%w: %w", myerror.ErrWalRotation, err)
+		}
+	}
+	if shared {
+		gen++
+		if _, err := next.WriteRecordAsync(wal.NewGenerationRecord(gen)); err != nil {
+			if next != t.curWal {
+				next.Close()
+				fsio.DeleteRetry(next.Path())
+			}
+			return fmt.Errorf("%w: %w", myerror.ErrWalRotation, err)
+		}
+	}
+
 	immutable := &immutable{
 		wal:   t.curWal,
 		index: t.mutableIndex,
+		seq:   t.nextSSTSeq(0),
+	}
+	if shared {
+		immutable.gen = t.walGen
 	}
 
 	// 将不可变索引添加到列表
@@ -146,180 +368,623 @@ func (t *LsmTree) rotateWal() error {
 		// 这里选择继续执行，不阻塞主流程
 	}
 
-	t.walId++
-	curWal, err := wal.NewWal(t.conf, t.walId)
-	if err != nil {
-		return err
-	}
-	t.curWal = curWal
-	t.mutableIndex = memtable.NewMemTable(memtable.MemTableTypeBTree, 16)
+	t.curWal, t.mutableIndex = next, index
+	t.walGen, t.genStart = gen, next.Size()
+	t.stats.rotations[cause].Add(1)
 	return nil
 }
 
+// Put 写入key。value为nil时等同于Delete；长度为0的value和任意字节内容的value都原样保存，
+// 之后Get返回非nil的切片，刷盘、压缩和重启后不变
 func (t *LsmTree) Put(key, value []byte) error {
-	if err := t.curWal.Write(key, value); err != nil {
+	if err := checkUserKey(key); err != nil {
 		return err
 	}
-	if err := t.mutableIndex.Put(key, value); err != nil {
+	return t.put(key, value)
+}
+
+// put 写入key，不检查内部保留前缀，供命名空间等内部调用
+func (t *LsmTree) put(key, value []byte) error {
+	start := t.conf.Now()
+	stages := t.newWriteStages()
+	defer func() { t.observeWrite(LatencyPut, key, t.conf.Since(start), stages) }()
+
+	_, err := t.writeEntry(key, value, stages)
+	return err
+}
+
+// writeEntry 写入WAL和内存表并返回提交序列号，开启组提交时释放写锁后再等待记录持久化，
+// 使并发的写入可以合并到同一次fsync中。记录在持久化之前即对读取可见
+func (t *LsmTree) writeEntry(key, value []byte, stages *writeStages) (uint64, error) {
+	seq, commit, err := t.applyEntry(key, value, stages)
+	if err != nil {
+		return 0, err
+	}
+	if stages == nil || commit == nil {
+		return seq, commit.Wait()
+	}
+	start := t.conf.Now()
+	err = commit.Wait()
+	stages.wal.Sync += t.conf.Since(start)
+	return seq, err
+}
+
+// applyEntry 在写锁内写入WAL和内存表，返回提交序列号和WAL提交以便在锁外等待。stages不为nil时记录各阶段的耗时
+func (t *LsmTree) applyEntry(key, value []byte, stages *writeStages) (uint64, *wal.Commit, error) {
+	if err := checkKey(key); err != nil {
+		return 0, nil, err
+	}
+	if err := t.checkEntrySize(key, value); err != nil {
+		return 0, nil, err
+	}
+	if err := t.beginWriteWithRoom(memtable.EntrySize(key, value)); err != nil {
+		return 0, nil, err
+	}
+	defer t.mu.Unlock()
+
+	walBefore := t.curWal.Size()
+	entry := kv.FromValue(key, value, t.writeTimestamp())
+	entry.Seq = t.writeSeq()
+	var timing *wal.WriteTiming
+	if stages != nil {
+		timing = &stages.wal
+	}
+	commit, err := t.curWal.WriteRecordTimed(wal.NewEntryRecord(entry), timing)
+	if err != nil {
+		return 0, nil, err
+	}
+	t.recordUserWrite(int64(len(key)+len(value)), walBefore)
+	var start time.Time
+	if stages != nil {
+		start = t.conf.Now()
+	}
+	if err := t.putMutable(entry); err != nil {
+		return 0, nil, err
+	}
+	if stages != nil {
+		stages.memtable = t.conf.Since(start)
+	}
+	seq := t.recordWrites(key)
+	t.watch.record(commit, seq, entry)
+
+	if !t.walFull() {
+		return seq, commit, nil
+	}
+	if stages == nil {
+		return seq, commit, t.rotateWal(RotationWalSize)
+	}
+	start = t.conf.Now()
+	err = t.rotateWal(RotationWalSize)
+	stages.rotate = t.conf.Since(start)
+	return seq, commit, err
+}
+
+// checkKey 检查key能否写入或查找：nil返回ErrKeyNil，长度为0返回ErrEmptyKey
+func checkKey(key []byte) error {
+	if key == nil {
+		return myerror.ErrKeyNil
+	}
+	if len(key) == 0 {
+		return myerror.ErrEmptyKey
+	}
+	return nil
+}
+
+// checkUserKey 检查调用方直接传入的key：在checkKey之外，内部保留前缀下的key返回ErrReservedKey
+func checkUserKey(key []byte) error {
+	if err := checkKey(key); err != nil {
 		return err
 	}
+	if isReservedKey(key) {
+		return fmt.Errorf("%w: %q", myerror.ErrReservedKey, key)
+	}
+	return nil
+}
+
+// isReservedKey 判断key是否位于命名空间或删除前版本的保留记录使用的内部前缀下。这些key只能通过命名空间
+// 或GetAsOf、RestoreKey间接读写，根命名空间的读写拒绝它们，遍历和Watch跳过它们
+func isReservedKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(namespaceMarker)) || bytes.HasPrefix(key, []byte(retainedMarker))
+}
 
-	if t.curWal.Size() > t.conf.WalSize {
-		return t.rotateWal()
+// checkEntrySize 在写入WAL之前检查key和value的大小，超出MaxKeySize或MaxValueSize时返回ErrValueTooLarge。
+// 两个上限都不超过WAL的解码上限，通过检查的条目总能从WAL恢复
+func (t *LsmTree) checkEntrySize(key, value []byte) error {
+	if len(key) > config.MaxKeySize {
+		return fmt.Errorf("%w: key of %d bytes exceeds %d", myerror.ErrValueTooLarge, len(key), config.MaxKeySize)
+	}
+	if limit := t.conf.ValueSizeLimit(); int64(len(value)) > limit {
+		return fmt.Errorf("%w: value of %d bytes exceeds MaxValueSize %d", myerror.ErrValueTooLarge, len(value), limit)
 	}
 	return nil
 }
 
+// Get 查找key。key不存在或已被删除时errors.Is(err, ErrKeyNotFound)成立，
+// SST中的删除标记返回的ErrValueNil同样满足该判断；内部保留前缀下的key返回ErrReservedKey
 func (t *LsmTree) Get(key []byte) ([]byte, error) {
-	value, err := t.mutableIndex.Get(key)
-	if err == nil {
-		return value, nil
+	return t.GetWithOptions(key, config.DefaultReadOptions())
+}
+
+// GetWithTimestamp 查找key，同时返回写入时间。未开启TrackTimestamps时写入的条目时间为0
+func (t *LsmTree) GetWithTimestamp(key []byte) ([]byte, int64, error) {
+	if err := checkUserKey(key); err != nil {
+		return nil, 0, err
 	}
-	if err == myerror.ErrKeyNotFound {
-		// 从不可变索引中查找
-		for i := len(t.immutableIndex) - 1; i >= 0; i-- {
-			value, err := t.immutableIndex[i].index.Get(key)
-			if err == nil {
-				return value, nil
-			}
-			if err == myerror.ErrKeyNotFound {
+	return t.readWithTimestamp(key)
+}
+
+// readWithTimestamp 同GetWithTimestamp，不检查内部保留前缀
+func (t *LsmTree) readWithTimestamp(key []byte) ([]byte, int64, error) {
+	start := t.conf.Now()
+	if err := t.beginRead(); err != nil {
+		return nil, 0, err
+	}
+
+	info := &readInfo{source: sourceNone, cached: true}
+	value, ts, err := t.getWithTimestamp(key, info)
+	mismatch := t.shadowVerify(key, value, err, info)
+	t.mu.RUnlock()
+	t.reportShadowMismatch(mismatch)
+	t.observeOp(LatencyGet, key, t.conf.Since(start), info)
+	return value, ts, err
+}
+
+// get 依次从可变内存表、不可变内存表和各层SST中查找key，并将命中的层级记录到info中
+func (t *LsmTree) get(key []byte, info *readInfo) ([]byte, error) {
+	value, _, err := t.getWithTimestamp(key, info)
+	return value, err
+}
+
+// getWithTimestamp 同get，同时返回命中条目的写入时间
+func (t *LsmTree) getWithTimestamp(key []byte, info *readInfo) ([]byte, int64, error) {
+	return t.getWithOptions(key, info, config.DefaultReadOptions())
+}
+
+// getWithOptions 同getWithTimestamp，按opts决定查找范围以及读取SST时是否填充缓存和校验条目
+func (t *LsmTree) getWithOptions(key []byte, info *readInfo, opts config.ReadOptions) ([]byte, int64, error) {
+	if err := checkKey(key); err != nil {
+		return nil, 0, err
+	}
+	gets := t.stats.gets.Add(1)
+	value, ts, found, err := t.getFromMemTables(key, info)
+	if found {
+		return value, ts, err
+	}
+	if opts.ReadTier == config.ReadMemtableOnly {
+		if t.mayContainInSST(key) {
+			return nil, 0, myerror.ErrWouldBlock
+		}
+		return nil, 0, myerror.ErrKeyNotFound
+	}
+	// 从节点中查找
+	for level := range t.nodes {
+		nodeSlice := t.nodes[level]
+		levelTrace := info.trace.enterLevel(level)
+		for i := len(nodeSlice) - 1; i >= 0; i-- {
+			node := nodeSlice[i]
+			// key不在文件的最小最大key范围内，无需查找
+			if bytes.Compare(key, node.GetMinKey()) < 0 || bytes.Compare(key, node.GetMaxKey()) > 0 {
+				t.stats.nodesSkipped.Add(1)
+				if levelTrace != nil {
+					levelTrace.NodesSkipped++
+				}
 				continue
 			}
-			if value != nil {
-				return value, nil
+			t.stats.nodesConsidered.Add(1)
+			if node.HasFilter() {
+				info.bloom = true
 			}
-			return nil, myerror.ErrKeyNotFound
-		}
-		// 从节点中查找
-		for level := range t.nodes {
-			nodeSlice := t.nodes[level]
-			for i := len(nodeSlice) - 1; i >= 0; i-- {
-				value, err := nodeSlice[i].Get(key)
-				if err == nil {
-					if value == nil {
-						return value, myerror.ErrValueNil
-					}
-					return value, nil
-				} else if err == myerror.ErrKeyNotFound {
-					continue
-				} else {
-					return nil, err
+			var readTrace *sst.ReadTrace
+			if levelTrace != nil {
+				levelTrace.NodesConsidered++
+				readTrace = &sst.ReadTrace{}
+			}
+			found, err := node.GetEntryWithOptions(key, readTrace, opts)
+			info.trace.addRead(levelTrace, readTrace)
+			if err == nil {
+				// 被隔离的文件中可能有更新的版本
+				if err := t.unavailableKey(key, level, uint32(node.GetSeq())); err != nil {
+					return nil, 0, err
 				}
-
+				// 按addNodes说明的优先级查找，找到的写入或删除标记就是最新版本，不再查找更深的层
+				info.source, info.file = levelSource(level), node.GetFilename()
+				if n := t.conf.AccessSampling; n > 0 && gets%uint64(n) == 0 {
+					node.RecordAccess()
+				}
+				if found.IsDelete() {
+					t.fillRowCache(key, found.Entry, myerror.ErrValueNil, info, opts)
+					return nil, found.Timestamp, myerror.ErrValueNil
+				}
+				return t.fillRowCache(key, found.Entry, nil, info, opts), found.Timestamp, nil
+			} else if errors.Is(err, myerror.ErrKeyNotFound) {
+				continue
+			} else {
+				return nil, 0, err
 			}
+
 		}
-		// 如果所有节点都找不到，返回ErrKeyNotFound
-		return nil, myerror.ErrKeyNotFound
 	}
+	// 如果所有节点都找不到，返回ErrKeyNotFound；key可能在被隔离的文件中时返回ErrRangeUnavailable
+	if err := t.unavailableKey(key, len(t.nodes), 0); err != nil {
+		return nil, 0, err
+	}
+	t.fillRowCache(key, kv.Entry{}, myerror.ErrKeyNotFound, info, opts)
+	return nil, 0, myerror.ErrKeyNotFound
+}
 
-	return nil, err
+// fillRowCache 将从SST解析出的结果放入行缓存，err不为nil时表示key已删除或不存在，返回交给调用方的value，
+// 调用方需持有t.mu读锁。有过期时间的条目和FillCache为false的读取不缓存；缓存持有value的副本，
+// UnsafeSharedValue时调用方与缓存共享同一个副本
+func (t *LsmTree) fillRowCache(key []byte, found kv.Entry, err error, info *readInfo, opts config.ReadOptions) []byte {
+	value := found.Value
+	if t.rowCache == nil || !info.cached || !opts.FillCache || found.TTL != 0 {
+		return value
+	}
+	if opts.UnsafeSharedValue {
+		value = bytes.Clone(value)
+	}
+	t.rowCache.add(key, value, found.Timestamp, err)
+	if opts.UnsafeSharedValue {
+		return value
+	}
+	return bytes.Clone(value)
 }
 
-func (t *LsmTree) Delete(key []byte) error {
-	if err := t.curWal.Write(key, nil); err != nil {
-		return err
+// getFromMemTables 依次从可变内存表和不可变内存表中查找key
+// found为true表示已经得到确定的结果(包括错误)，无需继续查找SST
+func (t *LsmTree) getFromMemTables(key []byte, info *readInfo) ([]byte, int64, bool, error) {
+	t.probeMemTable(info)
+	entry, err := t.mutableIndex.GetEntry(key)
+	if err == nil {
+		info.source = sourceMutable
+		if entry.IsDelete() {
+			// 删除标记，key已被删除
+			return nil, entry.Timestamp, true, myerror.ErrKeyNotFound
+		}
+		return entry.Value, entry.Timestamp, true, nil
+	}
+	if !errors.Is(err, myerror.ErrKeyNotFound) {
+		return nil, 0, true, err
+	}
+	// 可变内存表之后的结果没有变化时直接使用行缓存，缓存的是不可变内存表和SST合并后的结果
+	if info.cached {
+		if cached, ok := t.rowCache.get(key); ok {
+			info.source = sourceRowCache
+			if cached.err != nil {
+				return nil, cached.ts, true, cached.err
+			}
+			return bytes.Clone(cached.value), cached.ts, true, nil
+		}
 	}
-	if err := t.mutableIndex.Put(key, nil); err != nil {
+	// 从不可变索引中查找
+	for i := len(t.immutableIndex) - 1; i >= 0; i-- {
+		t.probeMemTable(info)
+		entry, err := t.immutableIndex[i].index.GetEntry(key)
+		if err == nil {
+			info.source = sourceImmutable
+			if entry.IsDelete() {
+				return nil, entry.Timestamp, true, myerror.ErrKeyNotFound
+			}
+			return entry.Value, entry.Timestamp, true, nil
+		}
+		if errors.Is(err, myerror.ErrKeyNotFound) {
+			continue
+		}
+		if entry.Value != nil {
+			info.source = sourceImmutable
+			return entry.Value, entry.Timestamp, true, nil
+		}
+		return nil, 0, true, myerror.ErrKeyNotFound
+	}
+	return nil, 0, false, nil
+}
+
+// Delete 删除key，开启TombstoneRetention时同时保留删除前的值，见RestoreKey。
+// 此时读取删除前的值之后key被并发修改会重试，多次重试仍然冲突时返回ErrTxnConflict，key保持不变
+func (t *LsmTree) Delete(key []byte) error {
+	if err := checkUserKey(key); err != nil {
 		return err
 	}
+	return t.delete(key)
+}
 
-	if t.curWal.Size() > t.conf.WalSize {
-		return t.rotateWal()
+// delete 删除key，不检查内部保留前缀
+func (t *LsmTree) delete(key []byte) error {
+	start := t.conf.Now()
+	stages := t.newWriteStages()
+	defer func() { t.observeWrite(LatencyDelete, key, t.conf.Since(start), stages) }()
+
+	if t.conf.TombstoneRetention > 0 {
+		stages = nil
+		return t.deleteRetained(key)
 	}
-	return nil
+	_, err := t.writeEntry(key, nil, stages)
+	return err
 }
 
-// doCompact 对单个不可变索引执行压缩操作
+// doCompact 对不可变索引执行压缩操作，MaxMemtablesPerFlush大于1时与之后连续的待刷盘的不可变索引合并刷盘
 func (t *LsmTree) doCompact(imm *immutable) error {
-	// 确保传入的immutable存在于immutableIndex中
-	found := false
-	var index int
-	for i, item := range t.immutableIndex {
-		if item == imm {
-			found = true
-			index = i
+	// 认领刷盘任务，已被移除或正在被写入方同步刷盘时直接返回
+	t.mu.Lock()
+	group := t.claimFlushGroup(imm)
+	t.mu.Unlock()
+	if len(group) == 0 {
+		return nil
+	}
+
+	return t.flushGroup(group, t.compactLimiter)
+}
+
+// claimFlushGroup 认领imm以及紧随其后的未在刷盘的不可变索引，数量不超过MaxMemtablesPerFlush，
+// 内存表总大小不超过MaxFlushOutputBytes。imm已被移除、已刷盘或正在刷盘时返回nil，调用方需持有t.mu写锁
+func (t *LsmTree) claimFlushGroup(imm *immutable) []*immutable {
+	i := t.immutableIndexOf(imm)
+	if i < 0 || imm.flushing != nil || imm.installed {
+		return nil
+	}
+	group := []*immutable{imm}
+	size := imm.index.Size()
+	// 只合并连续的不可变索引，合并生成的文件使用其中最新的序列号，L0的顺序仍与内存表的新旧一致
+	for _, next := range t.immutableIndex[i+1:] {
+		if len(group) >= t.conf.MaxMemtablesPerFlush || next.flushing != nil || next.installed {
 			break
 		}
+		if limit := t.conf.MaxFlushOutputBytes; limit > 0 && size+next.index.Size() > limit {
+			break
+		}
+		group = append(group, next)
+		size += next.index.Size()
 	}
-
-	if !found {
-		return nil // 该不可变索引已被处理或移除
+	for _, item := range group {
+		item.flushing = make(chan struct{})
 	}
+	return group
+}
 
+// buildSST 将已认领的一组连续的不可变索引(从旧到新)写入新的L0 SST文件并打开，无需持有t.mu
+func (t *LsmTree) buildSST(group []*immutable, limiter *ratelimit.Limiter) (*sst.Node, error) {
 	// 调用底层compact方法将memtable转为SST文件
-	if t.conf.IsDebug {
-		fmt.Println("compact")
-		fmt.Printf("levelSize: %d, seq length: %d\n", t.levelSize, len(t.seq))
-	}
+	t.conf.Debugf("compact levelSize: %d, seq length: %d", t.levelSize, len(t.seq))
 
 	// Check if t.seq has elements before accessing index 0
 	if len(t.seq) == 0 {
-		// Try to re-initialize the sequence array if it's empty
-		t.seq = make([]*atomic.Uint32, t.levelSize)
-		for i := 0; i < t.levelSize; i++ {
-			t.seq[i] = &atomic.Uint32{}
-		}
-
-		if len(t.seq) == 0 {
-			return fmt.Errorf("failed to initialize sequence array, levelSize: %d", t.levelSize)
-		}
+		return nil, fmt.Errorf("sequence array is not initialized, levelSize: %d", t.levelSize)
 	}
 
-	seq := t.seq[0].Load()
-	t.seq[0].Add(1)
+	seq := group[len(group)-1].seq
 	sstFilePath := t.getSSTFilePath(0, seq)
-	if err := t.writeMemTableToSST(imm, sstFilePath); err != nil {
-		return err
+	// 先写入临时文件再重命名，正式文件名的文件总是完整的；重命名后、记入清单前崩溃时，
+	// 重启会删除这个不在清单中的文件并重放WAL
+	tmpPath := sstFilePath + sstTmpSuffix
+	if err := t.writeMemTableToSST(group, tmpPath, limiter); err != nil {
+		fsio.DeleteRetry(tmpPath)
+		return nil, err
 	}
-
-	// // 压缩完成后，可以关闭WAL并从immutableIndex中移除该索引
-	// if err := imm.wal.Close(); err != nil {
-	// 	return err
-	// }
-
-	// 从immutableIndex中移除该索引
-	if err := t.immutableIndex[index].wal.Delete(); err != nil {
-		return err
+	if err := t.renameSST(tmpPath, sstFilePath); err != nil {
+		return nil, err
 	}
-	t.immutableIndex[index] = nil
-	// 需要加锁保护，此处简化处理
-	t.immutableIndex = append(t.immutableIndex[:index], t.immutableIndex[index+1:]...)
-	// 将SST文件添加到节点中
+	t.conf.Crash(config.CrashAfterSSTRename)
 
 	sstReader, err := sst.NewSSTReader(t.conf, sstFilePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	sstReader.AttachBudget(t.indexBudget)
+	sstReader.AttachFilterBudget(t.filterBudget)
+	sstReader.AttachBlockCache(t.blockCache)
 	node, err := sst.NewNode(t.conf, sstFilePath, 0, int32(seq), sstReader)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	t.nodes[0] = append(t.nodes[0], node)
-	return nil
+	// DeterministicOutput写出的文件不记录来源WAL，改由清单记录
+	if t.conf.DeterministicOutput {
+		node.SetSourceWals(sourceWals(group))
+	}
+	return node, nil
+}
+
+// finishFlush 结束对group的刷盘。成功时先在写锁内一步完成记入清单和节点替换，读取方在持有读锁期间
+// 要么看到group要么看到新节点，不会出现两者都不可见的时刻；之后再删除从immutableIndex中移除的不可变内存表的WAL，
+// 删除前崩溃时重启会重放这些WAL。未能替换时关闭并删除生成的SST文件
+func (t *LsmTree) finishFlush(group []*immutable, node *sst.Node, flushErr error) error {
+	installed, removed, err := t.installFlushed(group, node, flushErr)
+	if installed && len(removed) > 0 {
+		t.conf.Crash(config.CrashBeforeWALDelete)
+	}
+	if installed {
+		for _, w := range removed {
+			if deleteErr := w.Delete(); deleteErr != nil {
+				t.conf.Warnf("delete flushed wal: %v", deleteErr)
+				err = deleteErr
+			}
+		}
+		if len(removed) > 0 {
+			t.conf.Crash(config.CrashAfterWALDelete)
+		}
+	} else if node != nil {
+		node.Reader().Close()
+		if err := fsio.DeleteRetry(node.GetFilename()); err != nil {
+			t.conf.Warnf("remove unused sst %s: %v", node.GetFilename(), err)
+		}
+	}
+	// 删除WAL后才结束刷盘，Close等待刷盘结束时不会与删除并发
+	t.mu.Lock()
+	for _, imm := range group {
+		close(imm.flushing)
+		imm.flushing = nil
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// installFlushed 在写锁内将刷盘生成的节点记入清单并添加到L0，标记group已刷盘，再从immutableIndex开头移除
+// 连续的已刷盘的不可变内存表，返回是否已替换以及不再使用的WAL。更旧的不可变内存表尚未刷盘时group继续
+// 保留并优先于L0提供读取，使immutableIndex中的数据总是比L0新；重启时其WAL按顺序排在更旧的WAL之后重放
+func (t *LsmTree) installFlushed(group []*immutable, node *sst.Node, flushErr error) (bool, []*wal.Wal, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if flushErr != nil {
+		return false, nil, flushErr
+	}
+	for _, imm := range group {
+		if t.immutableIndexOf(imm) < 0 {
+			return false, nil, nil
+		}
+	}
+	// 先确定之后从开头移除的不可变内存表，其中共享WAL的最大代数与文件一起记入清单
+	n, gen := 0, uint64(0)
+	for n < len(t.immutableIndex) && (t.immutableIndex[n].installed || slices.Contains(group, t.immutableIndex[n])) {
+		gen = max(gen, t.immutableIndex[n].gen)
+		n++
+	}
+	edits := []manifest.Edit{manifest.AddFile(t.manifestFileMeta(node))}
+	if gen > 0 {
+		edits = append(edits, manifest.FlushedGeneration(gen))
+	}
+	if err := t.manifest.Apply(edits...); err != nil {
+		return false, nil, err
+	}
+	t.addNodes(0, node)
+	for _, imm := range group {
+		imm.installed = true
+	}
+	t.counters.flushBytes.Add(node.GetSize())
+	t.levelIO.addWritten(0, node.GetSize())
+
+	for _, imm := range t.immutableIndex[:n] {
+		t.addBuffered(-imm.index.Size())
+	}
+	removed := t.unusedWals(t.immutableIndex[:n], t.immutableIndex[n:])
+	rest := copy(t.immutableIndex, t.immutableIndex[n:])
+	clear(t.immutableIndex[rest:])
+	t.immutableIndex = t.immutableIndex[:rest]
+	return true, removed, nil
 }
 
-// getSSTFilePath 获取SST文件路径
+// unusedWals 返回removed使用的WAL中不再被当前WAL和rest使用的部分，共享WAL中所有内存表都刷盘后才能删除文件
+func (t *LsmTree) unusedWals(removed, rest []*immutable) []*wal.Wal {
+	var wals []*wal.Wal
+	for _, imm := range removed {
+		used := imm.wal == t.curWal || slices.Contains(wals, imm.wal)
+		for _, other := range rest {
+			used = used || other.wal == imm.wal
+		}
+		if !used {
+			wals = append(wals, imm.wal)
+		}
+	}
+	return wals
+}
+
+// openWals 返回当前WAL和不可变内存表使用的WAL，每个WAL只出现一次，调用方需持有t.mu
+func (t *LsmTree) openWals() []*wal.Wal {
+	wals := []*wal.Wal{t.curWal}
+	for _, imm := range t.immutableIndex {
+		if !slices.Contains(wals, imm.wal) {
+			wals = append(wals, imm.wal)
+		}
+	}
+	return wals
+}
+
+// nextSSTSeq 分配level层新SST文件的序列号
+func (t *LsmTree) nextSSTSeq(level int) uint32 {
+	return t.conf.SSTSeq(level, t.seq[level].Add(1)-1)
+}
+
+// addNodes 将nodes加入level层并保持层内按序列号从小到大排列，调用方需持有t.mu写锁。
+// 读取的优先级为：可变内存表、从新到旧的不可变内存表、L0中序列号从大到小的节点、L1到Ln，
+// 同一层中序列号大的节点更新，各读取路径都从层内末尾向前查找
+func (t *LsmTree) addNodes(level int, nodes ...*sst.Node) {
+	t.nodes[level] = append(t.nodes[level], nodes...)
+	sort.SliceStable(t.nodes[level], func(i, j int) bool {
+		return t.nodes[level][i].GetSeq() < t.nodes[level][j].GetSeq()
+	})
+	if level == 0 {
+		t.setL0Files()
+	}
+	// 层中的文件增加后检查是否超出MaxFilesPerLevel
+	t.signalLevelCompaction()
+}
+
+// immutableIndexOf 返回imm在immutableIndex中的位置，不存在时返回-1，调用方需持有t.mu
+func (t *LsmTree) immutableIndexOf(imm *immutable) int {
+	for i, item := range t.immutableIndex {
+		if item == imm {
+			return i
+		}
+	}
+	return -1
+}
+
+// mergeMemTables 按从旧到新的顺序读取group中的内存表，同一个key只保留最新的版本，返回按key排序的条目
+func mergeMemTables(group []*immutable) []kv.Entry {
+	latest := make(map[string]kv.Entry)
+	for _, imm := range group {
+		imm.index.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+			latest[string(entry.Key)] = entry
+			return true
+		})
+	}
+	entries := make([]kv.Entry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries
+}
+
+// getSSTFilePath 按SSTLayout获取SST文件路径
 func (t *LsmTree) getSSTFilePath(level int, seq uint32) string {
-	return filepath.Join(t.conf.DataDir, t.conf.SSTDir, fmt.Sprintf("%d_%d.sst", level, seq))
+	return t.conf.SSTFilePath(level, seq)
 }
 
-// writeMemTableToSST 将memtable内容写入SST文件
-func (t *LsmTree) writeMemTableToSST(imm *immutable, sstFilePath string) error {
+// sourceWals 返回group的来源WAL，记入清单后、删除WAL前崩溃时，重启据此删除WAL而不是再次刷盘。
+// 共享WAL中的内存表由清单记录的已刷盘代数判断，不记录来源WAL
+func sourceWals(group []*immutable) []uint32 {
+	walIds := make([]uint32, 0, len(group))
+	for _, imm := range group {
+		if imm.gen == 0 {
+			walIds = append(walIds, imm.wal.ID())
+		}
+	}
+	return walIds
+}
+
+// writeMemTableToSST 将group中的memtable内容写入SST文件，同一个key只保留最新的内存表中的版本，limiter为nil时不限速
+func (t *LsmTree) writeMemTableToSST(group []*immutable, sstFilePath string, limiter *ratelimit.Limiter) error {
 	//将memtable中的数据写入到新的SST文件中
 	sstable, err := sst.NewSSTWriter(t.conf, sstFilePath)
 	if err != nil {
 		return err
 	}
-
-	// 使用ForEachUnSafe遍历索引中的所有键值对
-	imm.index.ForEachUnSafe(func(key, value []byte) bool {
-		if err := sstable.Add(key, value); err != nil {
-			return false
+	sstable.SetRateLimiter(limiter)
+	sstable.SetSourceWal(sourceWals(group)...)
+
+	// 使用ForEachEntryUnSafe遍历索引中的所有条目，条目类型和写入时间随条目一起保存
+	var addErr error
+	add := func(entry kv.Entry) bool {
+		addErr = sstable.AddEntry(entry)
+		return addErr == nil
+	}
+	if len(group) == 1 {
+		group[0].index.ForEachEntryUnSafe(add)
+	} else {
+		for _, entry := range mergeMemTables(group) {
+			if !add(entry) {
+				break
+			}
 		}
-		return true
-	})
+	}
+	if addErr != nil {
+		sstable.Abort()
+		return addErr
+	}
 
 	if err := sstable.Flush(); err != nil {
+		sstable.Abort()
 		return err
 	}
 
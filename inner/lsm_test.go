@@ -1,10 +1,31 @@
 package inner
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
 	"github.com/aixiasang/lsm/inner/utils"
+	"github.com/aixiasang/lsm/inner/wal"
 )
 
 func TestLsmTree_Put(t *testing.T) {
@@ -19,9 +40,10 @@ func TestLsmTree_Put(t *testing.T) {
 		t.Fatal(err)
 	}
 	m := make(map[string]string)
+	rng := conf.NewRand()
 	for i := 0; i < 100; i++ {
 		key := utils.GetKey(i)
-		value := utils.GetValue(10)
+		value := utils.GetValue(rng, 10)
 		tree.Put(key, value)
 		m[string(key)] = string(value)
 	}
@@ -50,7 +72,7 @@ func TestLsmTree_Get(t *testing.T) {
 	// m := make(map[string]string)
 	// for i := 0; i < 100; i++ {
 	// 	key := utils.GetKey(i)
-	// 	value := utils.GetValue(10)
+	// 	value := utils.GetValue(rng, 10)
 	// 	tree.Put(key, value)
 	// 	m[string(key)] = string(value)
 	// }
@@ -66,3 +88,1856 @@ func TestLsmTree_Get(t *testing.T) {
 	}
 	tree.Close()
 }
+
+// captureLogger 记录所有日志输出，便于测试断言
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *captureLogger) record(level, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Debugf(format string, args ...any) { l.record("DEBUG", format, args...) }
+func (l *captureLogger) Infof(format string, args ...any)  { l.record("INFO", format, args...) }
+func (l *captureLogger) Warnf(format string, args ...any)  { l.record("WARN", format, args...) }
+func (l *captureLogger) Errorf(format string, args ...any) { l.record("ERROR", format, args...) }
+
+func (l *captureLogger) find(substr string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var matched []string
+	for _, line := range l.lines {
+		if strings.Contains(line, substr) {
+			matched = append(matched, line)
+		}
+	}
+	return matched
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	return conf
+}
+
+// useSlowMemTables 使conf按手动时钟计时，创建的内存表每次读写条目耗时delay
+func useSlowMemTables(conf *config.Config, delay time.Duration) {
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.MemTableConstructor = func(mtType memtable.MemTableType, degree int) memtable.MemTable {
+		return slowMemTable{MemTable: memtable.NewMemTable(mtType, degree), clock: clock, delay: delay}
+	}
+}
+
+func TestLsmTree_SlowOpLog(t *testing.T) {
+	conf := newTestConfig(t)
+	logger := &captureLogger{}
+	conf.Logger = logger
+	conf.SlowOpThreshold = 50 * time.Millisecond
+	useSlowMemTables(conf, 100*time.Millisecond)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("slow-key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("slow-key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("missing-key")); err == nil {
+		t.Fatal("expected missing key")
+	}
+
+	if len(logger.find("op=put key_size=8 duration=100ms")) != 1 {
+		t.Fatalf("expected one slow put line, got %v", logger.lines)
+	}
+	if len(logger.find("op=get key_size=8 duration=100ms")) != 1 || len(logger.find("level=mutable")) != 1 {
+		t.Fatalf("expected slow get line from mutable memtable, got %v", logger.lines)
+	}
+	if len(logger.find("level=none")) != 1 {
+		t.Fatalf("expected slow get line for missing key, got %v", logger.lines)
+	}
+}
+
+func TestLsmTree_SlowOpLogThreshold(t *testing.T) {
+	conf := newTestConfig(t)
+	logger := &captureLogger{}
+	conf.Logger = logger
+	conf.SlowOpThreshold = 50 * time.Millisecond
+	useSlowMemTables(conf, 10*time.Millisecond)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if lines := logger.find("slow op"); len(lines) != 0 {
+		t.Fatalf("unexpected slow op lines: %v", lines)
+	}
+}
+
+func TestLsmTree_NilLogger(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.Logger = nil
+	conf.IsDebug = true
+	conf.SlowOpThreshold = 50 * time.Millisecond
+	useSlowMemTables(conf, 100*time.Millisecond)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	rng := conf.NewRand()
+	for i := 0; i < 20; i++ {
+		if err := tree.Put(utils.GetKey(i), utils.GetValue(rng, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tree.Get(utils.GetKey(19)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeWal 直接写入一个WAL文件，value为nil表示删除记录
+func writeWal(t *testing.T, conf *config.Config, walId uint32, records [][2][]byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := wal.NewWal(conf, walId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := w.Write(rec[0], rec[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLsmTree_WalReplayRecordType(t *testing.T) {
+	key := []byte("key")
+	tests := []struct {
+		name    string
+		sst     map[string]string // 重放之前已刷盘的数据
+		wals    [][][2][]byte
+		want    []byte
+		wantErr error
+	}{
+		{
+			name: "EmptyValuePut",
+			wals: [][][2][]byte{{{key, []byte{}}}},
+			want: []byte{},
+		},
+		{
+			name:    "Delete",
+			wals:    [][][2][]byte{{{key, []byte("value")}, {key, nil}}},
+			wantErr: myerror.ErrKeyNotFound,
+		},
+		{
+			name: "DeleteThenPut",
+			wals: [][][2][]byte{{{key, nil}, {key, []byte("value2")}}},
+			want: []byte("value2"),
+		},
+		{
+			name:    "PutThenDeleteAcrossWals",
+			wals:    [][][2][]byte{{{key, []byte("value")}}, {{key, nil}}},
+			wantErr: myerror.ErrKeyNotFound,
+		},
+		{
+			// 删除后未刷盘即崩溃，重放的删除标记遮蔽SST中的旧值
+			name:    "DeleteShadowsSST",
+			sst:     map[string]string{"key": "flushed"},
+			wals:    [][][2][]byte{{{[]byte("other"), []byte("value")}, {key, nil}}},
+			wantErr: myerror.ErrKeyNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newTestConfig(t)
+			if tt.sst != nil {
+				writeLevelSST(t, conf, 0, 0, tt.sst)
+			}
+			for i, records := range tt.wals {
+				writeWal(t, conf, uint32(i), records)
+			}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+
+			value, err := tree.Get(key)
+			if err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr == nil && (value == nil || !bytes.Equal(value, tt.want)) {
+				t.Fatalf("expected value %q, got %q", tt.want, value)
+			}
+		})
+	}
+}
+
+// TestLsmTree_InvalidMemTableType 未知的内存表类型使NewLsmTree返回错误而不是在重放WAL时panic
+func TestLsmTree_InvalidMemTableType(t *testing.T) {
+	conf := newTestConfig(t)
+	writeWal(t, conf, 0, [][2][]byte{{[]byte("key"), []byte("value")}})
+	conf.MemTableType = 99
+	tree, err := NewLsmTree(conf)
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("NewLsmTree = %v, want ErrInvalidConfig", err)
+	}
+	if tree != nil {
+		tree.Close()
+	}
+
+	// 构造函数在启动之后才返回nil时，创建事务失败，事务的方法返回同一个错误
+	conf = newTestConfig(t)
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	conf.MemTableConstructor = func(memtable.MemTableType, int) memtable.MemTable { return nil }
+	txn := tree.BeginTxn()
+	defer txn.Rollback()
+	if err := txn.Put([]byte("key"), []byte("value")); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Txn.Put = %v, want ErrInvalidConfig", err)
+	}
+	if err := txn.Commit(); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("Txn.Commit = %v, want ErrInvalidConfig", err)
+	}
+}
+
+func TestLsmTree_DoubleClose(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestLsmTree_OpsAfterClose(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Put([]byte("key"), []byte("value")); err != myerror.ErrDBClosed {
+		t.Fatalf("Put after Close = %v, want ErrDBClosed", err)
+	}
+	if err := tree.Delete([]byte("key")); err != myerror.ErrDBClosed {
+		t.Fatalf("Delete after Close = %v, want ErrDBClosed", err)
+	}
+	if _, err := tree.Get([]byte("key")); err != myerror.ErrDBClosed {
+		t.Fatalf("Get after Close = %v, want ErrDBClosed", err)
+	}
+	if _, errs := tree.MultiGet([][]byte{[]byte("key")}); errs[0] != myerror.ErrDBClosed {
+		t.Fatalf("MultiGet after Close = %v, want ErrDBClosed", errs[0])
+	}
+	if err := tree.PrefixScan([]byte("k"), func(key, value []byte) bool { return true }); err != myerror.ErrDBClosed {
+		t.Fatalf("PrefixScan after Close = %v, want ErrDBClosed", err)
+	}
+}
+
+func TestLsmTree_CloseWhileWriting(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.Logger = nil
+	conf.WalSize = 256 // 频繁轮转WAL并触发后台压缩
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rng := conf.NewRand()
+			<-start
+			for i := 0; ; i++ {
+				key := []byte(fmt.Sprintf("g%d_%d", g, i))
+				err := tree.Put(key, utils.GetValue(rng, 16))
+				if err == myerror.ErrDBClosed {
+					return
+				}
+				if err != nil {
+					t.Errorf("Put: %v", err)
+					return
+				}
+				if _, err := tree.Get(key); err != nil && err != myerror.ErrDBClosed {
+					t.Errorf("Get: %v", err)
+					return
+				}
+			}
+		}(g)
+	}
+	close(start)
+	time.Sleep(50 * time.Millisecond)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	// 重新打开后能读到关闭前写入的数据
+	reopened, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if _, err := reopened.Get([]byte("g0_0")); err != nil {
+		t.Fatalf("Get after reopen: %v", err)
+	}
+}
+
+// benchmarkConcurrentPut 64个goroutine并发写入
+func benchmarkConcurrentPut(b *testing.B, groupCommit time.Duration) {
+	conf := config.DefaultConfig()
+	conf.DataDir = b.TempDir()
+	conf.IsDebug = false
+	conf.AutoSync = true
+	conf.WalSize = 64 << 20
+	conf.GroupCommitInterval = groupCommit
+	conf.SlowOpThreshold = 0
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tree.Close()
+
+	const writers = 64
+	value := []byte("value")
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < b.N; i += writers {
+				if err := tree.Put([]byte(fmt.Sprintf("key-%d", i)), value); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func BenchmarkLsmTree_PutFsyncPerWrite(b *testing.B) {
+	benchmarkConcurrentPut(b, 0)
+}
+
+func BenchmarkLsmTree_PutGroupCommit(b *testing.B) {
+	benchmarkConcurrentPut(b, time.Millisecond)
+}
+
+func TestLsmTree_GroupCommit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AutoSync = true
+	conf.GroupCommitInterval = time.Millisecond
+	conf.WalSize = 4096 // 写入过程中会切换WAL
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := tree.Put([]byte(fmt.Sprintf("key-%d-%02d", w, i)), []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for w := 0; w < 8; w++ {
+		for i := 0; i < 50; i++ {
+			if _, err := tree.Get([]byte(fmt.Sprintf("key-%d-%02d", w, i))); err != nil {
+				t.Fatalf("key-%d-%02d: %v", w, i, err)
+			}
+		}
+	}
+}
+
+func TestLsmTree_NilAndEmptyValueAfterFlush(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("one"), []byte{'x'}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("deleted"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	tree.mu.Lock()
+	err = tree.rotateWal(RotationManual)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, tree)
+
+	value, trace, err := tree.GetWithTrace([]byte("empty"))
+	if err != nil || value == nil || len(value) != 0 {
+		t.Fatalf("empty = %#v, %v", value, err)
+	}
+	if trace.Source != "L0" {
+		t.Fatalf("empty served from %s, want L0", trace.Source)
+	}
+	if value, err := tree.Get([]byte("one")); err != nil || string(value) != "x" {
+		t.Fatalf("one = %q, %v", value, err)
+	}
+	if value, err := tree.Get([]byte("deleted")); err != myerror.ErrValueNil || value != nil {
+		t.Fatalf("deleted = %#v, %v, want ErrValueNil", value, err)
+	}
+	if err := tree.PrefixScan(nil, func(key, _ []byte) bool {
+		if string(key) == "deleted" {
+			t.Fatal("deleted key visible in scan")
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLsmTree_TailWAL(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 64 * 1024 * 1024 // 避免轮转，所有记录都在同一个WAL文件中
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	reader, err := wal.NewReader(filepath.Join(conf.WalPath(), wal.FileName(tree.curWal.ID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.FollowInterval = time.Millisecond
+
+	const writers, perWriter = 4, 100
+	total := writers*perWriter + 1 // 额外一条事务批量记录
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var records []*wal.Record
+	done := make(chan error, 1)
+	go func() {
+		done <- reader.Follow(ctx, 0, func(rec *wal.Record) error {
+			records = append(records, rec)
+			if len(records) == total {
+				cancel()
+			}
+			return nil
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := []byte(fmt.Sprintf("w%d-%03d", w, i))
+				var err error
+				if i%10 == 9 {
+					err = tree.Delete(key)
+				} else {
+					err = tree.Put(key, []byte("v"))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	txn := tree.BeginTxn()
+	txn.Put([]byte("txn-a"), []byte("1"))
+	txn.Put([]byte("txn-b"), []byte("2"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Follow = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("observed %d of %d records", len(records), total)
+	}
+
+	// 每个写入方的记录恰好出现一次且保持写入顺序，事务以批量记录的形式出现
+	next := make([]int, writers)
+	batches := 0
+	for _, rec := range records {
+		if rec.RecordType == wal.RecordTypeBatch {
+			batches++
+			subs, err := wal.DecodeBatch(rec)
+			if err != nil || len(subs) != 2 {
+				t.Fatalf("batch = %+v, %v", subs, err)
+			}
+			continue
+		}
+		var w, i int
+		if _, err := fmt.Sscanf(string(rec.Key), "w%d-%03d", &w, &i); err != nil {
+			t.Fatalf("unexpected key %q", rec.Key)
+		}
+		if i != next[w] {
+			t.Fatalf("writer %d: got record %d, want %d", w, i, next[w])
+		}
+		if wantDelete := i%10 == 9; wantDelete != (rec.RecordType == wal.RecordTypeDelete) {
+			t.Fatalf("record %q has type %d", rec.Key, rec.RecordType)
+		}
+		next[w]++
+	}
+	for w, n := range next {
+		if n != perWriter {
+			t.Fatalf("writer %d: observed %d records, want %d", w, n, perWriter)
+		}
+	}
+	if batches != 1 {
+		t.Fatalf("observed %d batch records, want 1", batches)
+	}
+}
+
+// flushAll 转换当前内存表并同步刷盘所有不可变内存表，包括重新打开时从WAL恢复的内存表
+func flushAll(t *testing.T, tree *LsmTree) {
+	t.Helper()
+	tree.mu.Lock()
+	err := tree.rotateWal(RotationManual)
+	pending := append([]*immutable(nil), tree.immutableIndex...)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imm := range pending {
+		if err := tree.doCompact(imm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFlushed(t, tree)
+}
+
+func TestLsmTree_GetWithTimestamp(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 未开启时写入的条目时间为0
+	if err := tree.Put([]byte("old"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	if _, ts, err := tree.GetWithTimestamp([]byte("old")); err != nil || ts != 0 {
+		t.Fatalf("old = %d, %v, want 0", ts, err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf.TrackTimestamps = true
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+	before := time.Now().UnixNano()
+	if err := tree.Put([]byte("key"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	_, first, err := tree.GetWithTimestamp([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("key"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	value, second, err := tree.GetWithTimestamp([]byte("key"))
+	if err != nil || string(value) != "2" {
+		t.Fatalf("key = %q, %v", value, err)
+	}
+	if first < before || second < first || second > time.Now().UnixNano() {
+		t.Fatalf("timestamps %d, %d out of order or outside [%d, now]", first, second, before)
+	}
+
+	// 关闭后从WAL恢复，时间与写入时一致
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		t.Helper()
+		if value, ts, err := tree.GetWithTimestamp([]byte("key")); err != nil || string(value) != "2" || ts != second {
+			t.Fatalf("%s: key = %q@%d, %v, want 2@%d", stage, value, ts, err, second)
+		}
+		if _, ts, err := tree.GetWithTimestamp([]byte("old")); err != nil || ts != 0 {
+			t.Fatalf("%s: old = %d, %v, want 0", stage, ts, err)
+		}
+	}
+	check("after reopen")
+	// 刷盘只保留最新的条目及其时间，与未记录时间的旧文件混合读取
+	flushAll(t, tree)
+	check("after flush")
+	if _, ts, err := tree.GetWithTimestamp([]byte("gone")); err != myerror.ErrValueNil || ts < first {
+		t.Fatalf("gone = %d, %v, want ErrValueNil with timestamp", ts, err)
+	}
+}
+
+func TestLsmTree_MixedEntryChecksum(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("old-%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 开启后只有新写入的文件带条目校验和，与旧文件混合读取
+	conf.PerEntryChecksum = true
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < 100; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("new-%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Delete([]byte("old-000")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	for i := 1; i < 100; i++ {
+		for _, prefix := range []string{"old", "new"} {
+			key := []byte(fmt.Sprintf("%s-%03d", prefix, i))
+			if value, err := tree.Get(key); err != nil || string(value) != "v" {
+				t.Fatalf("Get(%s) = %q, %v", key, value, err)
+			}
+		}
+	}
+	if _, err := tree.Get([]byte("old-000")); err != myerror.ErrValueNil {
+		t.Fatalf("Get(old-000) = %v, want ErrValueNil", err)
+	}
+	count := 0
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+		count++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if count != 199 {
+		t.Fatalf("scan returned %d entries, want 199", count)
+	}
+}
+
+func TestLsmTree_MixedFilterPolicies(t *testing.T) {
+	conf := newTestConfig(t)
+	policies := []string{"", filter.NameBloom, filter.NameCuckoo, filter.NameNone}
+	// 每次用不同的过滤器写入一个文件，各文件在同一棵树中混合读取
+	for i, policy := range policies {
+		conf.FilterPolicy = policy
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 100; j++ {
+			if err := tree.Put([]byte(fmt.Sprintf("f%d-%03d", i, j*2)), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		flushAll(t, tree)
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf.FilterPolicy = filter.NameCuckoo
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	names := make(map[string]bool)
+	for _, level := range tree.nodes {
+		for _, node := range level {
+			names[node.Reader().FilterName()] = true
+		}
+	}
+	for _, policy := range policies {
+		if !names[policy] {
+			t.Fatalf("no file written with filter %q, got %v", policy, names)
+		}
+	}
+	for i := range policies {
+		for j := 0; j < 200; j++ {
+			key := []byte(fmt.Sprintf("f%d-%03d", i, j))
+			value, err := tree.Get(key)
+			if j%2 == 0 && (err != nil || string(value) != "v") {
+				t.Fatalf("Get(%s) = %q, %v", key, value, err)
+			}
+			if j%2 == 1 && err != myerror.ErrKeyNotFound {
+				t.Fatalf("Get(%s) = %v, want ErrKeyNotFound", key, err)
+			}
+		}
+	}
+
+	bad := newTestConfig(t)
+	bad.FilterPolicy = "unregistered"
+	if _, err := NewLsmTree(bad); !errors.Is(err, myerror.ErrUnknownFilter) {
+		t.Fatalf("NewLsmTree = %v, want ErrUnknownFilter", err)
+	}
+}
+
+// manualClock 只在测试调用Advance时前进的Clock，定时器在Advance越过到期时间时触发
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *manualClock) NewTimer(d time.Duration) config.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &manualTimer{clock: c, deadline: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.ch <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	return timer
+}
+
+// manualTimer manualClock创建的定时器
+type manualTimer struct {
+	clock    *manualClock
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// runDeterministic 使用固定的时间、随机源和文件编号执行写入、刷盘和重放，返回生成的SST文件内容
+func runDeterministic(t *testing.T) map[string][]byte {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.MemTableType = config.MemTableTypeSkipList
+	conf.TrackTimestamps = true
+	conf.BlockEntryLimit = 16
+	conf.WalSize = 1 << 20 // 只在flush中轮转WAL，避免后台刷盘与测试交错
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.RandSource = rand.NewSource(1608)
+	nextSeq := uint32(100)
+	conf.Hooks = &config.TestHooks{
+		SSTSeq: func(level int, seq uint32) uint32 { nextSeq++; return nextSeq },
+		WalId:  func(walId uint32) uint32 { return 10 + walId },
+	}
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush := func() {
+		t.Helper()
+		tree.mu.Lock()
+		err := tree.rotateWal(RotationManual)
+		pending := append([]*immutable(nil), tree.immutableIndex...)
+		tree.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, imm := range pending {
+			if err := tree.doCompact(imm); err != nil {
+				t.Fatal(err)
+			}
+		}
+		waitFlushed(t, tree)
+	}
+	rng := conf.NewRand()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			clock.Advance(time.Millisecond)
+			key := utils.GetKey(rng.Intn(150))
+			if i%10 == 0 {
+				err = tree.Delete(key)
+			} else {
+				err = tree.Put(key, utils.GetValue(rng, 1+rng.Intn(32)))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		flush()
+	}
+	// 未刷盘的WAL在重新打开后重放并刷盘
+	for i := 0; i < 50; i++ {
+		clock.Advance(time.Millisecond)
+		if err := tree.Put(utils.GetKey(200+i), utils.GetValue(rng, 8)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flush()
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(conf.SSTPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string][]byte)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".sst") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(conf.SSTPath(), file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out[file.Name()] = data
+	}
+	return out
+}
+
+func TestLsmTree_DeterministicFlush(t *testing.T) {
+	first, second := runDeterministic(t), runDeterministic(t)
+	if len(first) < 4 || len(first) != len(second) {
+		t.Fatalf("expected the same 4+ SST files in both runs, got %d and %d", len(first), len(second))
+	}
+	if _, ok := first["0_0000000101.sst"]; !ok {
+		t.Fatal("SST files do not use the forced sequence number")
+	}
+	for name, data := range first {
+		if !bytes.Equal(data, second[name]) {
+			t.Fatalf("SST %s differs across runs", name)
+		}
+	}
+}
+
+func TestLsmTree_GetDuringFlushInstall(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	key := []byte("hot")
+	for round := 0; round < 50; round++ {
+		want := fmt.Sprintf("v%d", round)
+		if err := tree.Put(key, []byte(want)); err != nil {
+			t.Fatal(err)
+		}
+		tree.mu.Lock()
+		err := tree.rotateWal(RotationManual)
+		imm := tree.immutableIndex[len(tree.immutableIndex)-1]
+		tree.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// key只存在于imm中，刷盘替换为SST的过程中读取不能返回ErrKeyNotFound
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					value, err := tree.Get(key)
+					if err != nil || string(value) != want {
+						t.Errorf("round %d: Get = %q, %v, want %q", round, value, err, want)
+						return
+					}
+				}
+			}()
+		}
+		if err := tree.doCompact(imm); err != nil {
+			t.Fatal(err)
+		}
+		waitFlushed(t, tree)
+		close(stop)
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
+	}
+}
+
+// TestLsmTree_WALDeleteDoesNotBlock 刷盘替换节点后在释放锁之后删除WAL，删除变慢时读写不等待。
+// 删除WAL的最后一步fsync WAL目录，钩子在文件已删除后阻塞，模拟缓慢的删除
+func TestLsmTree_WALDeleteDoesNotBlock(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	conf.SyncDirs = true
+	var deleting atomic.Pointer[string]
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	conf.Hooks = &config.TestHooks{DirSynced: func(dir string) {
+		path := deleting.Load()
+		if path == nil || dir != filepath.Dir(*path) {
+			return
+		}
+		if _, err := os.Stat(*path); errors.Is(err, os.ErrNotExist) && deleting.CompareAndSwap(path, nil) {
+			close(blocked)
+			<-release
+		}
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("flushed"), []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	tree.mu.Lock()
+	err = tree.rotateWal(RotationManual)
+	imm := tree.immutableIndex[len(tree.immutableIndex)-1]
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := imm.wal.Path()
+	deleting.Store(&path)
+	flushed := make(chan error, 1)
+	go func() { flushed <- tree.doCompact(imm) }()
+	select {
+	case <-blocked:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flushed wal was not deleted")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if err := tree.Put([]byte("during"), []byte("v2")); err != nil {
+			done <- err
+			return
+		}
+		value, err := tree.Get([]byte("flushed"))
+		if err == nil && string(value) != "v1" {
+			err = fmt.Errorf("Get(flushed) = %q, want v1", value)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("Put and Get waited for the wal delete")
+	}
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rotateAndHold 将可变内存表转为不可变内存表并认领其刷盘，使其留在内存中直到调用flushHeld
+func rotateAndHold(t *testing.T, tree *LsmTree) *immutable {
+	t.Helper()
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	if err := tree.rotateWal(RotationManual); err != nil {
+		t.Fatal(err)
+	}
+	imm := tree.immutableIndex[len(tree.immutableIndex)-1]
+	imm.flushing = make(chan struct{})
+	return imm
+}
+
+// flushHeld 刷盘rotateAndHold认领的不可变内存表
+func flushHeld(t *testing.T, tree *LsmTree, imm *immutable) {
+	t.Helper()
+	if err := tree.flushNow(imm, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// releaseHeld 放弃rotateAndHold的认领，不可变内存表保留在内存中，关闭后由WAL重放
+func releaseHeld(tree *LsmTree, imm *immutable) {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+	close(imm.flushing)
+	imm.flushing = nil
+}
+
+// TestLsmTree_ReadPrecedence 在每一对相邻的层级中写入同一个key的不同值，较新的值总是优先：
+// 可变内存表 > 从新到旧的不可变内存表 > 序列号从大到小的L0文件 > L1
+func TestLsmTree_ReadPrecedence(t *testing.T) {
+	// 从新到旧。L0文件的序列号为9和10，目录中0_10.sst排在0_9.sst之前
+	layers := []string{"mutable", "imm-new", "imm-old", "L0-new", "L0-old", "L1"}
+	sstLayers := map[string][2]uint32{"L0-new": {0, 10}, "L0-old": {0, 9}, "L1": {1, 1}}
+	key := []byte("key")
+
+	for i := 0; i+1 < len(layers); i++ {
+		newer, older := layers[i], layers[i+1]
+		t.Run(newer+">"+older, func(t *testing.T) {
+			inPair := func(layer string) bool { return layer == newer || layer == older }
+			conf := newTestConfig(t)
+			conf.LevelSize = 2
+			for layer, pos := range sstLayers {
+				kvs := map[string]string{"filler-" + layer: layer}
+				if inPair(layer) {
+					kvs[string(key)] = layer
+				}
+				writeLevelSST(t, conf, int(pos[0]), pos[1], kvs)
+			}
+
+			check := func(stage string, tree *LsmTree) {
+				t.Helper()
+				if value, err := tree.Get(key); err != nil || string(value) != newer {
+					t.Fatalf("%s: Get = %q, %v, want %q", stage, value, err, newer)
+				}
+				if values, errs := tree.MultiGet([][]byte{key}); errs[0] != nil || string(values[0]) != newer {
+					t.Fatalf("%s: MultiGet = %q, %v, want %q", stage, values[0], errs[0], newer)
+				}
+				var scanned string
+				if err := tree.PrefixScan(key, func(_, value []byte) bool {
+					scanned = string(value)
+					return false
+				}); err != nil || scanned != newer {
+					t.Fatalf("%s: PrefixScan = %q, %v, want %q", stage, scanned, err, newer)
+				}
+			}
+
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// 从旧到新写入内存中的各层
+			var held []*immutable
+			for _, layer := range []string{"imm-old", "imm-new", "mutable"} {
+				k := []byte("filler-" + layer)
+				if inPair(layer) {
+					k = key
+				}
+				if err := tree.Put(k, []byte(layer)); err != nil {
+					t.Fatal(err)
+				}
+				if layer != "mutable" {
+					held = append(held, rotateAndHold(t, tree))
+				}
+			}
+			check("in memory", tree)
+
+			// 较新的不可变内存表先完成刷盘，在更旧的刷盘之前仍保留在内存中
+			flushHeld(t, tree, held[1])
+			check("newer flushed first", tree)
+			releaseHeld(tree, held[0])
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// 重启时更旧的WAL先重放，分配的序列号更小
+			reopen := func(stage string) {
+				t.Helper()
+				if tree, err = NewLsmTree(conf); err != nil {
+					t.Fatal(err)
+				}
+				check(stage, tree)
+				if err := tree.flushPending(math.MaxUint32); err != nil {
+					t.Fatal(err)
+				}
+				check(stage+" and flush", tree)
+				if err := tree.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			reopen("restart with older unflushed")
+			reopen("restart with all flushed")
+		})
+	}
+}
+
+// TestLsmTree_FlushOrderIndependent 较新的不可变内存表先完成刷盘时，L0仍按轮转时分配的序列号排列
+func TestLsmTree_FlushOrderIndependent(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var held []*immutable
+	for _, value := range []string{"old", "new"} {
+		if err := tree.Put([]byte("key"), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, rotateAndHold(t, tree))
+	}
+	flushHeld(t, tree, held[1])
+	flushHeld(t, tree, held[0])
+
+	check := func(stage string) {
+		t.Helper()
+		if value, err := tree.Get([]byte("key")); err != nil || string(value) != "new" {
+			t.Fatalf("%s: Get = %q, %v, want new", stage, value, err)
+		}
+		files := tree.Levels()[0].Files
+		for i := 1; i < len(files); i++ {
+			if files[i-1].Seq >= files[i].Seq {
+				t.Fatalf("%s: L0 seq %d before %d", stage, files[i-1].Seq, files[i].Seq)
+			}
+		}
+	}
+	check("flushed in reverse")
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check("after restart")
+}
+
+// TestLsmTree_RecoveredFlushOrder 同一个key在两个WAL中先后写入，重启后后台按从旧到新的顺序刷盘重放的内存表；
+// 较新的内存表抢先刷盘时，刷盘之前、之中和之后都读到较新的值
+func TestLsmTree_RecoveredFlushOrder(t *testing.T) {
+	conf := newTestConfig(t)
+	key := []byte("x")
+	writeWal(t, conf, 1, [][2][]byte{{key, []byte("1")}, {[]byte("only-1"), []byte("a")}})
+	writeWal(t, conf, 2, [][2][]byte{{key, []byte("2")}})
+
+	// 阻塞后台的第一次SST写入，在此期间刷盘较新的内存表
+	entered := make(chan string, 1)
+	release := make(chan struct{})
+	var blocking atomic.Bool
+	conf.Hooks = &config.TestHooks{IOFault: func(op, path string) error {
+		if op == config.IOWrite && strings.HasSuffix(path, sstTmpSuffix) && blocking.CompareAndSwap(false, true) {
+			entered <- path
+			<-release
+		}
+		return nil
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check := func(stage string) {
+		t.Helper()
+		if value, err := tree.Get(key); err != nil || string(value) != "2" {
+			t.Fatalf("%s: Get = %q, %v, want 2", stage, value, err)
+		}
+		if value, err := tree.Get([]byte("only-1")); err != nil || string(value) != "a" {
+			t.Fatalf("%s: Get(only-1) = %q, %v, want a", stage, value, err)
+		}
+	}
+	check("before flush")
+
+	tree.mu.Lock()
+	if len(tree.immutableIndex) != 2 {
+		tree.mu.Unlock()
+		t.Fatalf("replayed %d memtables, want 2", len(tree.immutableIndex))
+	}
+	older, newer := tree.immutableIndex[0], tree.immutableIndex[1]
+	tree.mu.Unlock()
+	var blocked string
+	select {
+	case blocked = <-entered:
+	case <-time.After(10 * time.Second):
+		t.Fatal("recovered memtables were not queued for flush")
+	}
+	if want := tree.getSSTFilePath(0, older.seq) + sstTmpSuffix; blocked != want {
+		t.Fatalf("first recovered flush writes %s, want the oldest wal's %s", blocked, want)
+	}
+
+	tree.mu.Lock()
+	if newer.flushing != nil || newer.installed {
+		tree.mu.Unlock()
+		t.Fatal("newer memtable was claimed before the older one finished")
+	}
+	newer.flushing = make(chan struct{})
+	tree.mu.Unlock()
+	flushHeld(t, tree, newer)
+	check("newer flushed first")
+
+	close(release)
+	waitFlushed(t, tree)
+	check("both flushed")
+	files := tree.Levels()[0].Files
+	if len(files) != 2 || files[0].Seq != older.seq || files[1].Seq != newer.seq {
+		t.Fatalf("L0 = %+v, want seqs %d then %d", files, older.seq, newer.seq)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conf.Hooks = nil
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check("after restart")
+}
+
+// TestLsmTree_MmapReadMode 以映射方式读取SST，重写替换节点并关闭旧读取器时并发的读取仍然正确
+func TestLsmTree_MmapReadMode(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.SSTReadMode = config.SSTReadMmap
+	conf.BlockCacheSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	for i := 0; i < 100; i++ {
+		if err := tree.Put(key(i), []byte(fmt.Sprintf("value-%03d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if !tree.nodes[0][0].Reader().Mapped() {
+		t.Skip("mmap not supported on this platform")
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 100; i += 7 {
+			value, err := tree.Get(key(i))
+			if err != nil || string(value) != fmt.Sprintf("value-%03d", i) {
+				t.Fatalf("%s: Get(%s) = %q, %v", stage, key(i), value, err)
+			}
+		}
+		var scanned []string
+		if err := tree.PrefixScan([]byte("key-09"), func(key, value []byte) bool {
+			scanned = append(scanned, string(value))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(scanned) != 10 || scanned[9] != "value-099" {
+			t.Fatalf("%s: PrefixScan = %q", stage, scanned)
+		}
+	}
+
+	// 返回的数据已从映射中复制，旧节点被关闭并解除映射后仍然有效
+	value, err := tree.Get(key(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i := 0; i < 100; i += 13 {
+					if got, err := tree.Get(key(i)); err != nil || string(got) != fmt.Sprintf("value-%03d", i) {
+						t.Errorf("concurrent Get(%s) = %q, %v", key(i), got, err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		tree.mu.RLock()
+		node := tree.nodes[0][0]
+		tree.mu.RUnlock()
+		if _, _, _, err := tree.rewriteNode(node, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if string(value) != "value-042" {
+		t.Fatalf("value read before rewrites = %q", value)
+	}
+	check("after rewrites")
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	check("after restart")
+}
+
+// TestLsmTree_EarlyStopHonorsTombstones SST中找到写入或删除标记后不再查找更深的层，更新的删除标记不会被更旧的写入遮盖
+func TestLsmTree_EarlyStopHonorsTombstones(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	conf.SkipFilterOnBottomLevel = true
+	put := func(key, value string) kv.Entry { return kv.Entry{Key: []byte(key), Value: []byte(value)} }
+	del := func(key string) kv.Entry { return kv.Entry{Key: []byte(key), Kind: kv.KindDelete} }
+	writeLevelEntries(t, conf, 2, 1, []kv.Entry{put("a", "l2"), put("b", "l2"), put("c", "l2"), put("d", "l2")})
+	writeLevelEntries(t, conf, 1, 2, []kv.Entry{put("a", "l1"), del("b"), put("c", "l1"), del("d")})
+	writeLevelEntries(t, conf, 0, 3, []kv.Entry{del("a"), put("b", "l0")})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tests := []struct {
+		key    string
+		value  string
+		err    error
+		probed uint64 // 查找的SST文件数，L0文件的范围是[a, b]
+	}{
+		{"a", "", myerror.ErrValueNil, 1},
+		{"b", "l0", nil, 1},
+		{"c", "l1", nil, 1},
+		{"d", "", myerror.ErrValueNil, 1},
+		{"e", "", myerror.ErrKeyNotFound, 0},
+	}
+	check := func(stage string) {
+		t.Helper()
+		keys := make([][]byte, len(tests))
+		for i, tt := range tests {
+			keys[i] = []byte(tt.key)
+			before := tree.Stats().NodesConsidered
+			value, err := tree.Get(keys[i])
+			if err != tt.err || string(value) != tt.value {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q, %v", stage, tt.key, value, err, tt.value, tt.err)
+			}
+			if probed := tree.Stats().NodesConsidered - before; probed != tt.probed {
+				t.Fatalf("%s: Get(%s) probed %d files, want %d", stage, tt.key, probed, tt.probed)
+			}
+		}
+		values, errs := tree.MultiGet(keys)
+		for i, tt := range tests {
+			if errs[i] != tt.err || string(values[i]) != tt.value {
+				t.Fatalf("%s: MultiGet(%s) = %q, %v, want %q, %v", stage, tt.key, values[i], errs[i], tt.value, tt.err)
+			}
+		}
+	}
+	check("initial")
+	// 最底层重写后不带过滤器，结果不变
+	if _, _, _, err := tree.rewriteNode(tree.nodes[2][0], true); err != nil {
+		t.Fatal(err)
+	}
+	if tree.nodes[2][0].HasFilter() {
+		t.Fatal("bottom level file still has a filter after rewrite")
+	}
+	check("bottom level without filter")
+}
+
+// 空key在所有写入和查找路径上返回ErrEmptyKey，旧版本WAL中的空key记录在重放时跳过，
+// 刷盘、压缩、遍历和重启后都不会出现空key，其他key不受影响
+func TestLsmTree_EmptyKey(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	empty := []byte{}
+	writeWal(t, conf, 1, [][2][]byte{
+		{empty, []byte("legacy")},
+		{[]byte("a"), []byte("1")},
+	})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+
+	const want = "a=1\nb=2\n"
+	check := func(stage string) {
+		t.Helper()
+		if err := tree.Put(empty, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Put = %v, want ErrEmptyKey", stage, err)
+		}
+		if err := tree.Delete(empty); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Delete = %v, want ErrEmptyKey", stage, err)
+		}
+		if _, err := tree.PutWithSeq(empty, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: PutWithSeq = %v, want ErrEmptyKey", stage, err)
+		}
+		if _, err := tree.Get(empty); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Get = %v, want ErrEmptyKey", stage, err)
+		}
+		if _, err := tree.Get(nil); !errors.Is(err, ErrKeyNil) {
+			t.Fatalf("%s: Get(nil) = %v, want ErrKeyNil", stage, err)
+		}
+		if _, err := tree.GetWithOptions(empty, ReadOptions{ReadTier: config.ReadMemtableOnly}); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: GetWithOptions = %v, want ErrEmptyKey", stage, err)
+		}
+		values, errs := tree.MultiGet([][]byte{[]byte("a"), empty, []byte("b")})
+		if !errors.Is(errs[1], ErrEmptyKey) || errs[0] != nil || string(values[0]) != "1" || errs[2] != nil || string(values[2]) != "2" {
+			t.Fatalf("%s: MultiGet = %q, %v", stage, values, errs)
+		}
+		txn := tree.BeginTxn()
+		if err := txn.Put(empty, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Txn.Put = %v, want ErrEmptyKey", stage, err)
+		}
+		if err := txn.Delete(empty); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Txn.Delete = %v, want ErrEmptyKey", stage, err)
+		}
+		if _, err := txn.Get(empty); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Txn.Get = %v, want ErrEmptyKey", stage, err)
+		}
+		if err := txn.Commit(); err != nil {
+			t.Fatalf("%s: empty Commit = %v", stage, err)
+		}
+		if err := tree.Namespace("ns").Put(empty, []byte("value")); !errors.Is(err, ErrEmptyKey) {
+			t.Fatalf("%s: Namespace.Put = %v, want ErrEmptyKey", stage, err)
+		}
+		if got := scanAll(t, tree); got != want {
+			t.Fatalf("%s: scan %q, want %q", stage, got, want)
+		}
+	}
+
+	if err := tree.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	check("replayed")
+	flushAll(t, tree)
+	check("flushed")
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if files := tree.Levels()[2].Files; len(files) != 1 || string(files[0].MinKey) != "a" {
+		t.Fatalf("bottom level files %+v after compaction", files)
+	}
+	check("compacted")
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened")
+}
+
+// 快速连续轮转WAL时后台刷盘合并多个不可变内存表，L0文件数远少于轮转次数，跨内存表覆盖的key以最新的版本为准
+func TestLsmTree_FlushCoalescing(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	conf.MaxMemtablesPerFlush = 16
+	// 第一次写入SST时阻塞，轮转期间后台刷盘无法完成
+	release := make(chan struct{})
+	var once sync.Once
+	conf.Hooks = &config.TestHooks{IOFault: func(op, path string) error {
+		if strings.Contains(filepath.Base(path), ".sst") {
+			once.Do(func() { <-release })
+		}
+		return nil
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%02d", i)) }
+	for r := 0; r < 10; r++ {
+		for j := 0; j < 5; j++ {
+			if err := tree.Put(key(r*5+j), []byte(fmt.Sprintf("v%d", r))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if r > 0 {
+			// 覆盖之前的内存表中的key
+			for _, k := range [][]byte{key(0), key(r*5 - 1)} {
+				if err := tree.Put(k, []byte(fmt.Sprintf("new%d", r))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if r < 9 {
+			tree.mu.Lock()
+			err := tree.rotateWal(RotationManual)
+			tree.mu.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(release)
+	flushAll(t, tree)
+
+	check := func(stage string) {
+		t.Helper()
+		if files := tree.Levels()[0].Files; len(files) == 0 || len(files) > 2 {
+			t.Fatalf("%s: %d L0 files after 10 rotations, want at most 2", stage, len(files))
+		}
+		for i := 0; i < 50; i++ {
+			want := fmt.Sprintf("v%d", i/5)
+			switch {
+			case i == 0:
+				want = "new9"
+			case i%5 == 4 && i < 45:
+				want = fmt.Sprintf("new%d", i/5+1)
+			}
+			if value, err := tree.Get(key(i)); err != nil || string(value) != want {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key(i), value, err, want)
+			}
+		}
+	}
+	check("flushed")
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭时等待刷盘完成，合并刷盘的WAL都已删除
+	names := walNames(t, conf)
+	if logs := slices.DeleteFunc(slices.Clone(names), func(name string) bool { return filepath.Ext(name) != ".log" }); len(logs) != 1 {
+		t.Fatalf("wals %v after close, want only the current wal", names)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	check("reopened")
+}
+
+// allocated 返回fn执行期间分配的字节数，包括后台协程的分配，是fn额外占用内存峰值的上限
+func allocated(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// checkValue 检查key的value，大value不转换为字符串
+func checkValue(t *testing.T, tree *LsmTree, key string, want []byte) {
+	t.Helper()
+	if value, err := tree.Get([]byte(key)); err != nil || !bytes.Equal(value, want) {
+		t.Fatalf("Get(%s) = %d bytes, %v, want %d bytes", key, len(value), err, len(want))
+	}
+}
+
+// 接近上限的value可以写入、刷盘并在重启后读回，写入WAL、刷盘和读取时最多多出一份副本，
+// 超出上限的value在写入WAL之前被拒绝
+func TestLsmTree_LargeValues(t *testing.T) {
+	sizes := []int{1 << 20, 64 << 20, config.DefaultMaxValueSize - 1}
+	if testing.Short() {
+		sizes = sizes[:1]
+	}
+	for _, size := range sizes {
+		t.Run(fmt.Sprintf("%d", size), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.WalSize = math.MaxUint32 // 只在flushAll时刷盘，分别统计写入和刷盘的分配
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { tree.Close() }()
+
+			const key = "large"
+			value := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+			limit := uint64(size) + uint64(size)/2
+			if n := allocated(func() {
+				if err := tree.Put([]byte(key), value); err != nil {
+					t.Fatal(err)
+				}
+			}); n > 2*limit {
+				t.Fatalf("Put allocated %d bytes for a %d byte value", n, size)
+			}
+			checkValue(t, tree, key, value)
+
+			// 超出上限的value返回ErrValueTooLarge，WAL不变
+			walSize := tree.curWal.Size()
+			tooLarge := make([]byte, conf.ValueSizeLimit()+1)
+			if err := tree.Put([]byte("too-large"), tooLarge); !errors.Is(err, ErrValueTooLarge) {
+				t.Fatalf("Put over the cap = %v, want ErrValueTooLarge", err)
+			}
+			tooLarge = nil
+			if got := tree.curWal.Size(); got != walSize {
+				t.Fatalf("wal grew from %d to %d bytes after a rejected Put", walSize, got)
+			}
+
+			// 刷盘时大value直接写入文件，只有打开新文件时读取数据块产生一份副本
+			if n := allocated(func() { flushAll(t, tree) }); n > limit {
+				t.Fatalf("flush allocated %d bytes for a %d byte value", n, size)
+			}
+			if n := allocated(func() { checkValue(t, tree, key, value) }); n > 2*limit {
+				t.Fatalf("Get allocated %d bytes for a %d byte value", n, size)
+			}
+
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if tree, err = NewLsmTree(conf); err != nil {
+				t.Fatal(err)
+			}
+			checkValue(t, tree, key, value)
+		})
+	}
+}
+
+// 刷盘写入大value的过程中崩溃，重启后从WAL恢复完整的value
+func TestLsmTree_LargeValueCrashMidStream(t *testing.T) {
+	conf := newTestConfig(t)
+	snapshot := filepath.Join(t.TempDir(), "crash")
+	injected := errors.New("injected crash")
+	crashed := make(chan struct{})
+	var writes int
+	conf.Hooks = &config.TestHooks{IOFault: func(op, path string) error {
+		if op != config.IOWrite || !strings.HasSuffix(path, ".sst"+sstTmpSuffix) {
+			return nil
+		}
+		// 已写入小条目所在的数据块、大条目的头部、key和value的第一段
+		if writes++; writes == 5 {
+			copyDir(t, conf.DataDir, snapshot)
+			close(crashed)
+			return injected
+		}
+		return nil
+	}}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	value := bytes.Repeat([]byte("0123456789abcdef"), (5<<20)/16)
+	for key, v := range map[string][]byte{"a": []byte("small"), "b": value} {
+		if err := tree.Put([]byte(key), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.mu.Lock()
+	err = tree.rotateWal(RotationManual)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-crashed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush did not reach the large value")
+	}
+
+	recovered := config.DefaultConfig()
+	recovered.DataDir = snapshot
+	recovered.IsDebug = false
+	reopened, err := NewLsmTree(recovered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	getValue(t, reopened, "a", "small")
+	checkValue(t, reopened, "b", value)
+}
+
+// WAL创建失败时轮转不修改任何状态：写入返回ErrWalRotation但已经生效，之后的读写继续使用原来的内存表和WAL；
+// 下次轮转成功后，重启前后所有key都恰好读到一次
+func TestLsmTree_RotateWalCreateFailure(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		mode config.WALMode
+	}{{"per-memtable", config.WALModePerMemtable}, {"shared", config.WALModeShared}} {
+		t.Run(c.name, func(t *testing.T) {
+			conf := walModeConfig(t, c.mode)
+			var failing atomic.Bool
+			var hits atomic.Int64
+			conf.Hooks = &config.TestHooks{IOFault: func(op, path string) error {
+				if op == config.IOCreate && failing.CompareAndSwap(true, false) {
+					hits.Add(1)
+					return syscall.ENOSPC
+				}
+				return nil
+			}}
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]string)
+			put := func(i int) error {
+				key, value := fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i)
+				err := tree.Put([]byte(key), []byte(value))
+				if err == nil || errors.Is(err, ErrWalRotation) {
+					want[key] = value
+				}
+				return err
+			}
+
+			failing.Store(true)
+			i := 0
+			for ; hits.Load() == 0; i++ {
+				if i == 2000 {
+					t.Fatal("rotation never created a new wal")
+				}
+				tree.mu.RLock()
+				cur, mutable, gen := tree.curWal, tree.mutableIndex, tree.walGen
+				tree.mu.RUnlock()
+				err := put(i)
+				if hits.Load() == 0 {
+					if err != nil {
+						t.Fatalf("put %d: %v", i, err)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrWalRotation) || !errors.Is(err, syscall.ENOSPC) {
+					t.Fatalf("put %d with failing wal creation = %v, want ErrWalRotation wrapping ENOSPC", i, err)
+				}
+				tree.mu.RLock()
+				unchanged := tree.curWal == cur && tree.mutableIndex == mutable && tree.walGen == gen
+				queued := slices.ContainsFunc(tree.immutableIndex, func(imm *immutable) bool { return imm.index == mutable })
+				tree.mu.RUnlock()
+				if !unchanged || queued {
+					t.Fatalf("failed rotation changed state: unchanged %v, mutable queued %v", unchanged, queued)
+				}
+				if _, err := os.Stat(filepath.Join(conf.WalPath(), wal.FileName(cur.ID()+1))); !os.IsNotExist(err) {
+					t.Fatalf("failed rotation left a wal file: %v", err)
+				}
+			}
+			failedWal := tree.curWal
+			for k, v := range want {
+				if got, err := tree.Get([]byte(k)); err != nil || string(got) != v {
+					t.Fatalf("Get(%s) after failed rotation = %q, %v", k, got, err)
+				}
+			}
+			// 之后的写入继续写入原来的WAL，写满时重试轮转并成功
+			for end := i + 200; i < end; i++ {
+				if err := put(i); err != nil {
+					t.Fatalf("put %d after failed rotation: %v", i, err)
+				}
+			}
+			if tree.curWal == failedWal {
+				t.Fatal("rotation was not retried")
+			}
+
+			var sb strings.Builder
+			keys := slices.Sorted(maps.Keys(want))
+			for _, k := range keys {
+				fmt.Fprintf(&sb, "%s=%s\n", k, want[k])
+			}
+			if got := scanAll(t, tree); got != sb.String() {
+				t.Fatalf("scan after rotation retry differs from the writes")
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tree, err = NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tree.Close()
+			if got := scanAll(t, tree); got != sb.String() {
+				t.Fatalf("scan after reopen differs from the writes")
+			}
+		})
+	}
+}
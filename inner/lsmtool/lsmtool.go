@@ -0,0 +1,26 @@
+// Package lsmtool 提供离线检查数据文件的工具函数，每个函数对应lsmtool命令的一个子命令，
+// 输出写入调用方提供的io.Writer，不打开LsmTree也不获取目录锁
+package lsmtool
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// Get 对应lsmtool get <sst文件> <key>：从单个SST文件中读取key，将value和换行写入w。
+// key不存在时返回ErrKeyNotFound，key在该文件中是删除标记时返回ErrValueNil
+func Get(w io.Writer, conf *config.Config, path string, key []byte) error {
+	value, err := sst.GetFromFile(conf, path, key)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return myerror.ErrValueNil
+	}
+	_, err = fmt.Fprintf(w, "%s\n", value)
+	return err
+}
@@ -0,0 +1,45 @@
+package lsmtool
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func TestGet(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	path := filepath.Join(conf.DataDir, "0_0.sst")
+	writer, err := sst.NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kv := range []struct {
+		key   string
+		value []byte
+	}{{"a", []byte("1")}, {"b", nil}, {"c", []byte("3")}} {
+		if err := writer.Add([]byte(kv.key), kv.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := Get(&out, conf, path, []byte("c")); err != nil || out.String() != "3\n" {
+		t.Fatalf("Get(c) = %q, %v", out.String(), err)
+	}
+	out.Reset()
+	if err := Get(&out, conf, path, []byte("b")); err != myerror.ErrValueNil || out.Len() != 0 {
+		t.Fatalf("Get(b) = %q, %v, want ErrValueNil", out.String(), err)
+	}
+	if err := Get(&out, conf, path, []byte("d")); err != myerror.ErrKeyNotFound {
+		t.Fatalf("Get(d) = %v, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,117 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// errNotInManifest 隔离不在清单中且无法确认能否删除的SST文件时记录的原因
+var errNotInManifest = errors.New("not referenced by manifest")
+
+// manifestFileMeta 返回node在清单中的记录，文件元数据中没有记录来源WAL时由清单记录
+func (t *LsmTree) manifestFileMeta(node *sst.Node) manifest.FileMeta {
+	file := manifest.FileMeta{
+		Level:  node.GetLevel(),
+		Seq:    uint32(node.GetSeq()),
+		Path:   t.sstRelPath(node.GetFilename()),
+		MinKey: node.GetMinKey(),
+		MaxKey: node.GetMaxKey(),
+		Size:   node.GetSize(),
+	}
+	if len(node.Reader().SourceWals()) == 0 {
+		file.SourceWals = node.SourceWals()
+	}
+	return file
+}
+
+// sstRelPath 返回SST文件相对SST目录的路径，以/分隔，两种布局的文件都可以据此定位
+func (t *LsmTree) sstRelPath(path string) string {
+	rel, err := filepath.Rel(t.conf.SSTPath(), path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// loadManifest 重放清单并载入其中的SST文件，onDisk为扫描SST目录得到的文件。
+// 不在清单中的文件：清单完整且文件已被记录删除或尚未提交时删除；清单尾部被截断时无法判断，
+// 将文件重新加入清单以免丢失数据；其余情况移到隔离目录
+func (t *LsmTree) loadManifest(onDisk []*sstFile) error {
+	m, err := manifest.Open(t.conf, t.conf.DataDir)
+	if err != nil {
+		return err
+	}
+	t.manifest = m
+
+	live := make(map[string]bool)
+	sstFiles := make([]*sstFile, 0, len(onDisk))
+	for _, file := range m.Files() {
+		if file.Level < 0 || file.Level >= t.levelSize {
+			return fmt.Errorf("%w: manifest references %s at level %d, LevelSize is %d",
+				myerror.ErrSSTCorrupted, file.Path, file.Level, t.levelSize)
+		}
+		path := filepath.Join(t.conf.SSTPath(), filepath.FromSlash(file.Path))
+		live[path] = true
+		sstFiles = append(sstFiles, &sstFile{level: file.Level, seq: file.Seq, filePath: path, meta: &file})
+	}
+	adopted := make(map[string]bool)
+	for _, file := range onDisk {
+		switch {
+		case live[file.filePath]:
+		case m.Truncated():
+			t.conf.Warnf("adopt sst %s missing from truncated manifest", file.filePath)
+			adopted[file.filePath] = true
+			sstFiles = append(sstFiles, file)
+		case m.Obsolete(file.level, file.seq):
+			if err := fsio.DeleteRetry(file.filePath); err != nil {
+				return err
+			}
+			m.Forget(file.level, file.seq)
+			t.conf.Infof("removed orphan sst %s", file.filePath)
+		default:
+			if err := t.quarantineSST(file.filePath, errNotInManifest); err != nil {
+				return err
+			}
+		}
+	}
+	sortSSTFiles(sstFiles)
+
+	skipped, err := t.addSSTNodes(sstFiles)
+	if err != nil {
+		return err
+	}
+	for level := range t.seq {
+		if next := m.NextSeq(level); t.seq[level].Load() < next {
+			t.seq[level].Store(next)
+		}
+	}
+	edits := make([]manifest.Edit, 0)
+	if t.conf.UnreadableSSTPolicy() == config.CorruptFileQuarantine {
+		// 忽略的文件留在清单中，下次打开时重试；被隔离的文件从清单中删除，其key范围在本次打开期间不可用
+		// 先记录不可用范围再从清单中删除，两步之间崩溃时重启仍然知道该范围
+		for _, file := range skipped {
+			if err := t.markUnavailable(file); err != nil {
+				return err
+			}
+			edits = append(edits, manifest.DeleteFile(file.level, file.seq))
+		}
+	}
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			if adopted[node.GetFilename()] {
+				edits = append(edits, manifest.AddFile(t.manifestFileMeta(node)))
+			}
+		}
+	}
+	if len(edits) == 0 {
+		return nil
+	}
+	return m.Apply(edits...)
+}
@@ -0,0 +1,227 @@
+package manifest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// EditType 清单编辑的类型
+type EditType uint8
+
+const (
+	EditAddFile           EditType = iota + 1 // 添加SST文件
+	EditDeleteFile                            // 删除SST文件，只使用Level和Seq
+	EditFlushedGeneration                     // 共享WAL中代数不超过Generation的内存表均已刷盘
+)
+
+// editAddFileSource 记录了来源WAL的添加文件编辑在记录中的类型，解码后仍为EditAddFile。
+// 没有来源WAL的文件按EditAddFile编码，旧版本写入的清单无需改动
+const editAddFileSource EditType = EditFlushedGeneration + 1
+
+const (
+	recordHeaderSize = 8        // 每条记录的crc(4)和长度(4)
+	maxRecordSize    = 64 << 20 // 单条记录的长度上限，超出时视为损坏
+)
+
+// FileMeta 清单中记录的SST文件
+type FileMeta struct {
+	Level  int    // 层级
+	Seq    uint32 // 序列号
+	Path   string // 相对SST目录的路径，以/分隔
+	MinKey []byte // 最小key
+	MaxKey []byte // 最大key
+	Size   int64  // 文件大小
+	// 刷盘生成文件的来源WAL id，只在文件元数据中没有记录时(DeterministicOutput)写入清单
+	SourceWals []uint32
+}
+
+// Edit 对SST文件集合的一次修改
+type Edit struct {
+	Type       EditType
+	File       FileMeta
+	Generation uint64 // 已刷盘的内存表代数，只用于EditFlushedGeneration
+}
+
+// AddFile 返回添加文件的编辑
+func AddFile(file FileMeta) Edit {
+	return Edit{Type: EditAddFile, File: file}
+}
+
+// DeleteFile 返回删除level层序列号为seq的文件的编辑
+func DeleteFile(level int, seq uint32) Edit {
+	return Edit{Type: EditDeleteFile, File: FileMeta{Level: level, Seq: seq}}
+}
+
+// FlushedGeneration 返回记录代数不超过gen的内存表均已刷盘的编辑
+func FlushedGeneration(gen uint64) Edit {
+	return Edit{Type: EditFlushedGeneration, Generation: gen}
+}
+
+// encodeRecord 将一组编辑编码为一条记录：crc(4) length(4) payload，重放时整条记录要么全部生效要么全部忽略。
+// payload依次为编辑数(4)和各条编辑：type(1) level(4) seq(4)，添加文件时后接
+// size(8) pathLen(4) path minLen(4) minKey maxLen(4) maxKey，带来源WAL时类型记为editAddFileSource并再接
+// count(4)和各个WAL id(4)，记录刷盘代数时后接generation(8)
+func encodeRecord(edits []Edit) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(len(edits)))
+	for _, edit := range edits {
+		typ := edit.Type
+		if typ == EditAddFile && len(edit.File.SourceWals) > 0 {
+			typ = editAddFileSource
+		}
+		payload = append(payload, byte(typ))
+		payload = binary.BigEndian.AppendUint32(payload, uint32(edit.File.Level))
+		payload = binary.BigEndian.AppendUint32(payload, edit.File.Seq)
+		if edit.Type == EditFlushedGeneration {
+			payload = binary.BigEndian.AppendUint64(payload, edit.Generation)
+		}
+		if edit.Type != EditAddFile {
+			continue
+		}
+		payload = binary.BigEndian.AppendUint64(payload, uint64(edit.File.Size))
+		for _, field := range [][]byte{[]byte(edit.File.Path), edit.File.MinKey, edit.File.MaxKey} {
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(field)))
+			payload = append(payload, field...)
+		}
+		if typ == editAddFileSource {
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(edit.File.SourceWals)))
+			for _, walId := range edit.File.SourceWals {
+				payload = binary.BigEndian.AppendUint32(payload, walId)
+			}
+		}
+	}
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(payload)))
+	return append(record, payload...)
+}
+
+// decodeRecord 解码data开头的一条记录，返回其中的编辑和记录的长度。
+// data不足一条完整记录时返回ErrRecordDataIncomplete，校验失败时返回ErrCrcMismatch
+func decodeRecord(data []byte) ([]Edit, int, error) {
+	if len(data) < recordHeaderSize {
+		return nil, 0, myerror.ErrRecordDataIncomplete
+	}
+	length := binary.BigEndian.Uint32(data[4:8])
+	if length > maxRecordSize {
+		return nil, 0, fmt.Errorf("manifest record length %d too large", length)
+	}
+	if len(data) < recordHeaderSize+int(length) {
+		return nil, 0, myerror.ErrRecordDataIncomplete
+	}
+	payload := data[recordHeaderSize : recordHeaderSize+int(length)]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[0:4]) {
+		return nil, 0, myerror.ErrCrcMismatch
+	}
+	edits, err := decodeEdits(payload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return edits, recordHeaderSize + int(length), nil
+}
+
+// decodeEdits 解码记录的payload
+func decodeEdits(payload []byte) ([]Edit, error) {
+	d := decoder{data: payload}
+	count := d.uint32()
+	edits := make([]Edit, 0, min(int(count), len(payload)/9))
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		edit := Edit{Type: EditType(d.byte())}
+		edit.File.Level = int(d.uint32())
+		edit.File.Seq = d.uint32()
+		switch edit.Type {
+		case EditAddFile, editAddFileSource:
+			edit.File.Size = int64(d.uint64())
+			edit.File.Path = string(d.bytes())
+			edit.File.MinKey = d.bytes()
+			edit.File.MaxKey = d.bytes()
+			if edit.Type == editAddFileSource {
+				edit.Type = EditAddFile
+				edit.File.SourceWals = d.walIds()
+			}
+		case EditDeleteFile:
+		case EditFlushedGeneration:
+			edit.Generation = d.uint64()
+		default:
+			d.fail("unknown edit type %d", edit.Type)
+		}
+		edits = append(edits, edit)
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return edits, nil
+}
+
+// decoder 顺序读取payload中的字段，出错后的读取返回零值
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(format string, args ...any) {
+	if d.err == nil {
+		d.err = fmt.Errorf("manifest record: "+format, args...)
+	}
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.fail("truncated field")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// walIds 读取count(4)和各个WAL id，count超出剩余长度时视为截断
+func (d *decoder) walIds() []uint32 {
+	n := d.uint32()
+	if d.err == nil && uint64(n)*4 > uint64(len(d.data)) {
+		d.fail("truncated field")
+		return nil
+	}
+	ids := make([]uint32, n)
+	for i := range ids {
+		ids[i] = d.uint32()
+	}
+	return ids
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if b := d.next(int(n)); b != nil {
+		return append([]byte(nil), b...)
+	}
+	return nil
+}
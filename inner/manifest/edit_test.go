@@ -0,0 +1,45 @@
+package manifest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	edits := []Edit{
+		AddFile(FileMeta{Level: 0, Seq: 3, Path: "0_3.sst", MinKey: []byte("a"), MaxKey: []byte("z"), Size: 4096}),
+		DeleteFile(1, 7),
+		FlushedGeneration(1<<40 + 5),
+		AddFile(FileMeta{Level: 2, Seq: 1, Path: "2_1.sst", Size: 10}),
+		AddFile(FileMeta{Level: 0, Seq: 4, Path: "0_4.sst", MinKey: []byte("b"), MaxKey: []byte("c"), Size: 20, SourceWals: []uint32{5, 6}}),
+	}
+	record := encodeRecord(edits)
+	got, n, err := decodeRecord(append(record, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(record) {
+		t.Fatalf("decoded %d bytes, want %d", n, len(record))
+	}
+	if !reflect.DeepEqual(got, edits) {
+		t.Fatalf("decoded %+v, want %+v", got, edits)
+	}
+
+	// 不完整的记录
+	for size := 0; size < len(record); size++ {
+		if _, _, err := decodeRecord(record[:size]); !errors.Is(err, myerror.ErrRecordDataIncomplete) {
+			t.Fatalf("decode %d of %d bytes = %v, want ErrRecordDataIncomplete", size, len(record), err)
+		}
+	}
+	// 任意位置被修改的记录都无法通过校验
+	for i := recordHeaderSize; i < len(record); i++ {
+		flipped := append([]byte(nil), record...)
+		flipped[i] ^= 0x01
+		if _, _, err := decodeRecord(flipped); err == nil {
+			t.Fatalf("flipped byte %d decoded without error", i)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/utils"
+)
+
+// CurrentFileName 指向当前清单文件的文件名，内容为清单文件名
+const CurrentFileName = "CURRENT"
+
+// maxReadRetries ReadFiles因清单切换重新读取CURRENT的最大次数
+const maxReadRetries = 3
+
+// FileName 返回编号为num的清单文件名
+func FileName(num uint64) string {
+	return fmt.Sprintf("MANIFEST-%06d", num)
+}
+
+// fileID 在清单中标识一个SST文件
+type fileID struct {
+	level int
+	seq   uint32
+}
+
+// Manifest 记录当前SST文件集合的追加日志，每次修改作为一条带校验和的记录追加并fsync，
+// 重放所有记录即可得到当前的文件集合。文件超过MaxManifestFileSize后重写为只包含当前状态的新清单，
+// 并通过原子地更新CURRENT切换到新清单
+type Manifest struct {
+	mu        sync.Mutex
+	conf      *config.Config
+	dir       string              // 清单所在目录
+	num       uint64              // 当前清单文件编号
+	fp        *os.File            // 当前清单文件，以追加方式打开
+	size      int64               // 当前清单文件大小
+	files     map[fileID]FileMeta // 当前的SST文件
+	deleted   map[fileID]bool     // 已记录删除的文件，磁盘上的文件可能尚未删除
+	maxSeq    map[int]uint32      // 各层记录过的最大序列号
+	flushed   uint64              // 共享WAL中已刷盘的最大内存表代数
+	truncated bool                // 打开时是否丢弃了损坏的尾部记录
+}
+
+// Exists 判断dir中是否存在清单
+func Exists(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, CurrentFileName))
+	return err == nil
+}
+
+func newManifest(conf *config.Config, dir string) *Manifest {
+	return &Manifest{
+		conf:    conf,
+		dir:     dir,
+		files:   make(map[fileID]FileMeta),
+		deleted: make(map[fileID]bool),
+		maxSeq:  make(map[int]uint32),
+	}
+}
+
+// Create 在dir中创建只包含files的新清单，用于从目录扫描迁移到清单
+func Create(conf *config.Config, dir string, files []FileMeta) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	m := newManifest(conf, dir)
+	for _, file := range files {
+		m.apply(AddFile(file))
+	}
+	if err := m.rotate(1); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Open 打开dir中CURRENT指向的清单并重放所有记录。遇到不完整或校验失败的记录时在最后一条完整记录之后截断，
+// 之后的修改全部丢弃，Truncated返回true。同时删除切换清单时崩溃遗留的其他清单文件
+func Open(conf *config.Config, dir string) (*Manifest, error) {
+	num, err := readCurrent(dir)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, FileName(num))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newManifest(conf, dir)
+	m.num = num
+	if err := m.replay(data); err != nil {
+		conf.Warnf("manifest %s: truncate at offset %d of %d: %v", path, m.size, len(data), err)
+		m.truncated = true
+		if err := os.Truncate(path, m.size); err != nil {
+			return nil, err
+		}
+	}
+	if m.fp, err = fsio.Open(path, fsio.AppendOnly); err != nil {
+		return nil, err
+	}
+	m.removeStale()
+	return m, nil
+}
+
+// ReadFiles 以只读方式重放dir中的清单并返回当前的SST文件，不修改任何文件，可以在其他实例写入清单时调用。
+// 末尾不完整或校验失败的记录视为尚未提交而忽略；读取期间清单被切换、旧清单已删除时重新读取CURRENT
+func ReadFiles(conf *config.Config, dir string) ([]FileMeta, error) {
+	for attempt := 0; ; attempt++ {
+		num, err := readCurrent(dir)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(dir, FileName(num)))
+		if errors.Is(err, fs.ErrNotExist) && attempt < maxReadRetries {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m := newManifest(conf, dir)
+		m.replay(data)
+		return m.sortedFiles(), nil
+	}
+}
+
+// readCurrent 读取CURRENT，返回其指向的清单文件编号
+func readCurrent(dir string) (uint64, error) {
+	current, err := os.ReadFile(filepath.Join(dir, CurrentFileName))
+	if err != nil {
+		return 0, err
+	}
+	name := strings.TrimSpace(string(current))
+	var num uint64
+	if _, err := fmt.Sscanf(name, "MANIFEST-%d", &num); err != nil || FileName(num) != name {
+		return 0, fmt.Errorf("manifest: invalid CURRENT %q", name)
+	}
+	return num, nil
+}
+
+// replay 依次应用data中的记录，遇到不完整或校验失败的记录时停止并返回错误，
+// 之后m.size为最后一条完整记录之后的偏移量
+func (m *Manifest) replay(data []byte) error {
+	for int(m.size) < len(data) {
+		edits, n, err := decodeRecord(data[m.size:])
+		if err != nil {
+			return err
+		}
+		for _, edit := range edits {
+			m.apply(edit)
+		}
+		m.size += int64(n)
+	}
+	return nil
+}
+
+// removeStale 删除当前清单以外的清单文件以及写入CURRENT时遗留的临时文件
+func (m *Manifest) removeStale() {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		stale := strings.HasPrefix(name, "MANIFEST-") && name != FileName(m.num)
+		if !stale && name != CurrentFileName+".tmp" {
+			continue
+		}
+		if err := fsio.DeleteRetry(filepath.Join(m.dir, name)); err != nil {
+			m.conf.Warnf("remove stale manifest %s: %v", name, err)
+		}
+	}
+}
+
+// Apply 将edits作为一条记录追加到清单并fsync，返回后修改在崩溃后仍然有效。
+// 追加失败时清单保持不变；清单超过大小上限时重写，重写失败只记录日志
+func (m *Manifest) Apply(edits ...Edit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fp == nil {
+		return os.ErrClosed
+	}
+	record := encodeRecord(edits)
+	if _, err := m.fp.Write(record); err != nil {
+		m.discardTail()
+		return err
+	}
+	if err := m.conf.IOFault(config.IOSync, m.fp.Name()); err != nil {
+		m.discardTail()
+		return err
+	}
+	if err := m.fp.Sync(); err != nil {
+		m.discardTail()
+		return err
+	}
+	for _, edit := range edits {
+		m.apply(edit)
+	}
+	m.size += int64(len(record))
+
+	maxSize := m.conf.MaxManifestFileSize
+	if maxSize <= 0 {
+		maxSize = config.DefaultMaxManifestFileSize
+	}
+	if m.size > maxSize {
+		if err := m.rotate(m.num + 1); err != nil {
+			m.conf.Warnf("rewrite manifest: %v", err)
+		}
+	}
+	return nil
+}
+
+// discardTail 丢弃追加失败的记录已写入的部分，避免之后的记录追加在损坏的数据之后
+func (m *Manifest) discardTail() {
+	if err := m.fp.Truncate(m.size); err != nil {
+		m.conf.Warnf("truncate manifest after failed append: %v", err)
+	}
+}
+
+// apply 将一条编辑应用到内存中的状态
+func (m *Manifest) apply(edit Edit) {
+	if edit.Type == EditFlushedGeneration {
+		m.flushed = max(m.flushed, edit.Generation)
+		return
+	}
+	id := fileID{level: edit.File.Level, seq: edit.File.Seq}
+	switch edit.Type {
+	case EditAddFile:
+		m.files[id] = edit.File
+		delete(m.deleted, id)
+	case EditDeleteFile:
+		delete(m.files, id)
+		m.deleted[id] = true
+	}
+	if max, ok := m.maxSeq[id.level]; !ok || id.seq > max {
+		m.maxSeq[id.level] = id.seq
+	}
+}
+
+// rotate 将当前状态写入编号为num的新清单，fsync后更新CURRENT指向它，再删除旧清单
+func (m *Manifest) rotate(num uint64) error {
+	edits := make([]Edit, 0, len(m.files)+len(m.deleted)+1)
+	if m.flushed > 0 {
+		edits = append(edits, FlushedGeneration(m.flushed))
+	}
+	for id := range m.deleted {
+		edits = append(edits, DeleteFile(id.level, id.seq))
+	}
+	for _, file := range m.sortedFiles() {
+		edits = append(edits, AddFile(file))
+	}
+	record := encodeRecord(edits)
+
+	path := filepath.Join(m.dir, FileName(num))
+	fp, err := fsio.Create(path, fsio.AppendOnly)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(record); err != nil {
+		fp.Close()
+		fsio.DeleteRetry(path)
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		fsio.DeleteRetry(path)
+		return err
+	}
+	// CURRENT指向新清单之前，新清单的目录项必须已经持久化
+	if err := m.conf.SyncDir(m.dir); err != nil {
+		fp.Close()
+		fsio.DeleteRetry(path)
+		return err
+	}
+	m.conf.Crash(config.CrashBeforeCurrentUpdate)
+	if err := utils.WriteFileAtomic(filepath.Join(m.dir, CurrentFileName), []byte(FileName(num)+"\n")); err != nil {
+		fp.Close()
+		fsio.DeleteRetry(path)
+		return err
+	}
+	// 更新CURRENT未能持久化时断电后CURRENT仍指向旧清单，保留旧清单，下次打开时由removeStale删除
+	synced := m.conf.SyncDir(m.dir)
+	if synced != nil {
+		m.conf.Warnf("keep old manifest: %v", synced)
+	}
+
+	if m.fp != nil {
+		if err := m.fp.Close(); err != nil {
+			m.conf.Warnf("close old manifest: %v", err)
+		}
+		if synced == nil {
+			if err := fsio.DeleteRetry(filepath.Join(m.dir, FileName(m.num))); err != nil {
+				m.conf.Warnf("remove old manifest: %v", err)
+			}
+		}
+	}
+	m.fp, m.num, m.size = fp, num, int64(len(record))
+	return nil
+}
+
+// sortedFiles 按层级和序列号返回当前的文件，调用方需持有m.mu或独占m
+func (m *Manifest) sortedFiles() []FileMeta {
+	files := make([]FileMeta, 0, len(m.files))
+	for _, file := range m.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Level != files[j].Level {
+			return files[i].Level < files[j].Level
+		}
+		return files[i].Seq < files[j].Seq
+	})
+	return files
+}
+
+// Files 按层级和序列号返回当前的SST文件
+func (m *Manifest) Files() []FileMeta {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedFiles()
+}
+
+// NextSeq 返回level层大于清单中所有记录过的序列号的最小序列号
+func (m *Manifest) NextSeq(level int) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if max, ok := m.maxSeq[level]; ok {
+		return max + 1
+	}
+	return 0
+}
+
+// Obsolete 判断不在清单中的文件能否安全删除：清单记录过删除该文件，
+// 或者其序列号大于该层记录过的所有序列号，即尚未提交到清单的输出文件
+func (m *Manifest) Obsolete(level int, seq uint32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.deleted[fileID{level: level, seq: seq}] {
+		return true
+	}
+	max, ok := m.maxSeq[level]
+	return !ok || seq > max
+}
+
+// FlushedGeneration 返回清单记录的共享WAL中已刷盘的最大内存表代数，未记录时返回0
+func (m *Manifest) FlushedGeneration() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.flushed
+}
+
+// Forget 在已记录删除的文件从磁盘删除后调用，下次重写清单时不再保留该删除记录
+func (m *Manifest) Forget(level int, seq uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deleted, fileID{level: level, seq: seq})
+}
+
+// Truncated 判断打开时是否因记录损坏丢弃了清单的尾部
+func (m *Manifest) Truncated() bool {
+	return m.truncated
+}
+
+// Size 返回当前清单文件的大小
+func (m *Manifest) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+// Close 关闭清单文件，可以重复调用，m为nil时直接返回
+func (m *Manifest) Close() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fp == nil {
+		return nil
+	}
+	err := m.fp.Close()
+	m.fp = nil
+	return err
+}
@@ -0,0 +1,344 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.Logger = nil
+	return conf
+}
+
+func testFile(level int, seq uint32) FileMeta {
+	return FileMeta{
+		Level:  level,
+		Seq:    seq,
+		Path:   fmt.Sprintf("%d_%d.sst", level, seq),
+		MinKey: []byte(fmt.Sprintf("min-%d", seq)),
+		MaxKey: []byte(fmt.Sprintf("max-%d", seq)),
+		Size:   int64(seq) * 100,
+	}
+}
+
+func reopen(t *testing.T, m *Manifest) *Manifest {
+	t.Helper()
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Open(m.conf, m.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestManifestReplay(t *testing.T) {
+	conf := testConfig(t)
+	if Exists(conf.DataDir) {
+		t.Fatal("empty dir has a manifest")
+	}
+	m, err := Create(conf, conf.DataDir, []FileMeta{testFile(1, 0), testFile(0, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Exists(conf.DataDir) {
+		t.Fatal("CURRENT was not written")
+	}
+	if err := m.Apply(AddFile(testFile(0, 3)), AddFile(testFile(0, 4))); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(DeleteFile(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	want := []FileMeta{testFile(0, 2), testFile(0, 4), testFile(1, 0)}
+	if got := m.Files(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files = %+v, want %+v", got, want)
+	}
+
+	m = reopen(t, m)
+	defer m.Close()
+	if got := m.Files(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replayed Files = %+v, want %+v", got, want)
+	}
+	if m.Truncated() {
+		t.Fatal("intact manifest reported as truncated")
+	}
+	if next := m.NextSeq(0); next != 5 {
+		t.Fatalf("NextSeq(0) = %d, want 5", next)
+	}
+	if next := m.NextSeq(3); next != 0 {
+		t.Fatalf("NextSeq(3) = %d, want 0", next)
+	}
+	// 已记录删除的文件和尚未提交的文件可以删除，其余不在清单中的文件不能删除
+	for _, tt := range []struct {
+		level    int
+		seq      uint32
+		obsolete bool
+	}{{0, 3, true}, {0, 5, true}, {0, 1, false}, {1, 1, true}, {2, 0, true}} {
+		if got := m.Obsolete(tt.level, tt.seq); got != tt.obsolete {
+			t.Fatalf("Obsolete(%d, %d) = %v, want %v", tt.level, tt.seq, got, tt.obsolete)
+		}
+	}
+}
+
+func TestManifestTruncate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		corrupt func(data []byte, last int) []byte
+	}{
+		{"torn tail", func(data []byte, last int) []byte { return data[:len(data)-3] }},
+		{"flipped byte", func(data []byte, last int) []byte {
+			data[last+recordHeaderSize] ^= 0xff
+			return data
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig(t)
+			m, err := Create(conf, conf.DataDir, []FileMeta{testFile(0, 0)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Apply(AddFile(testFile(0, 1))); err != nil {
+				t.Fatal(err)
+			}
+			good := m.Size()
+			if err := m.Apply(AddFile(testFile(0, 2)), DeleteFile(0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			m.Close()
+
+			path := filepath.Join(conf.DataDir, FileName(1))
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(data, int(good)), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// 损坏的记录整条丢弃，之前的记录保留
+			m, err = Open(conf, conf.DataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !m.Truncated() || m.Size() != good {
+				t.Fatalf("Truncated = %v, Size = %d, want true, %d", m.Truncated(), m.Size(), good)
+			}
+			want := []FileMeta{testFile(0, 0), testFile(0, 1)}
+			if got := m.Files(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Files = %+v, want %+v", got, want)
+			}
+			if stat, err := os.Stat(path); err != nil || stat.Size() != good {
+				t.Fatalf("manifest file not truncated to %d: %v, %v", good, stat.Size(), err)
+			}
+
+			// 截断后追加的记录可以正常重放
+			if err := m.Apply(AddFile(testFile(0, 3))); err != nil {
+				t.Fatal(err)
+			}
+			m = reopen(t, m)
+			defer m.Close()
+			want = append(want, testFile(0, 3))
+			if got := m.Files(); !reflect.DeepEqual(got, want) || m.Truncated() {
+				t.Fatalf("Files = %+v (truncated %v), want %+v", got, m.Truncated(), want)
+			}
+		})
+	}
+}
+
+func TestManifestRotate(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxManifestFileSize = 512
+	m, err := Create(conf, conf.DataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]FileMeta, 0)
+	for seq := uint32(0); seq < 40; seq++ {
+		if err := m.Apply(AddFile(testFile(0, seq))); err != nil {
+			t.Fatal(err)
+		}
+		if seq%4 == 0 {
+			if err := m.Apply(DeleteFile(0, seq)); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want = append(want, testFile(0, seq))
+	}
+	// 清单重写为只包含当前状态的新文件，旧文件被删除
+	if m.num == 1 {
+		t.Fatal("manifest was never rewritten")
+	}
+	entries, err := os.ReadDir(conf.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name != CurrentFileName && name != FileName(m.num) {
+			t.Fatalf("unexpected file %s after rewrite", name)
+		}
+	}
+
+	m = reopen(t, m)
+	if got := m.Files(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files = %+v, want %+v", got, want)
+	}
+	// 删除记录在重写后仍然保留，Forget之后不再保留
+	if !m.Obsolete(0, 36) {
+		t.Fatal("delete record lost by rewrite")
+	}
+	m.Forget(0, 36)
+	if err := m.rotate(m.num + 1); err != nil {
+		t.Fatal(err)
+	}
+	m = reopen(t, m)
+	defer m.Close()
+	if m.Obsolete(0, 36) || !m.Obsolete(0, 32) {
+		t.Fatal("Forget did not drop exactly one delete record")
+	}
+}
+
+func TestManifestFlushedGeneration(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxManifestFileSize = 512
+	m, err := Create(conf, conf.DataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := uint32(0); seq < 20; seq++ {
+		if err := m.Apply(AddFile(testFile(0, seq)), FlushedGeneration(uint64(seq)+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 较小的代数不会回退已记录的代数
+	if err := m.Apply(FlushedGeneration(3)); err != nil {
+		t.Fatal(err)
+	}
+	if m.num == 1 {
+		t.Fatal("manifest was never rewritten")
+	}
+	m = reopen(t, m)
+	defer m.Close()
+	if got := m.FlushedGeneration(); got != 20 {
+		t.Fatalf("FlushedGeneration = %d, want 20", got)
+	}
+	// 代数记录不影响SST序列号
+	if got := m.NextSeq(0); got != 20 {
+		t.Fatalf("NextSeq(0) = %d, want 20", got)
+	}
+	if len(m.Files()) != 20 {
+		t.Fatalf("got %d files, want 20", len(m.Files()))
+	}
+}
+
+func TestManifestCrashBeforeCurrentUpdate(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxManifestFileSize = 256
+	snapshot := t.TempDir()
+	armed, captured := false, false
+	conf.Hooks = &config.TestHooks{Crash: func(point string) {
+		if point != config.CrashBeforeCurrentUpdate || !armed || captured {
+			return
+		}
+		captured = true
+		// 在CURRENT更新前断电：复制此时的目录
+		entries, err := os.ReadDir(conf.DataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			data, err := os.ReadFile(filepath.Join(conf.DataDir, entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(snapshot, entry.Name()), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}}
+	m, err := Create(conf, conf.DataDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	armed = true
+	var want []FileMeta
+	for seq := uint32(0); !captured; seq++ {
+		want = m.Files()
+		if err := m.Apply(AddFile(testFile(0, seq))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want = append(want, testFile(0, uint32(len(want))))
+
+	// 旧清单已包含触发重写的记录，新清单文件被删除
+	recovered, err := Open(conf, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if got := recovered.Files(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Files = %+v, want %+v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(snapshot, FileName(2))); !os.IsNotExist(err) {
+		t.Fatalf("new manifest left behind: %v", err)
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxManifestFileSize = 512
+	if _, err := ReadFiles(conf, conf.DataDir); !os.IsNotExist(err) {
+		t.Fatalf("ReadFiles without manifest = %v, want not exist", err)
+	}
+	m, err := Create(conf, conf.DataDir, []FileMeta{testFile(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	// 清单打开期间可以读取，包括切换清单之后
+	for seq := uint32(1); seq < 20; seq++ {
+		if err := m.Apply(AddFile(testFile(0, seq)), DeleteFile(0, seq-1)); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadFiles(conf, conf.DataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := m.Files(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("ReadFiles = %+v, want %+v", got, want)
+		}
+	}
+	if m.num == 1 {
+		t.Fatal("manifest was never rotated")
+	}
+
+	// 末尾未写完的记录视为尚未提交，文件保持不变
+	want := m.Files()
+	path := filepath.Join(conf.DataDir, FileName(m.num))
+	size := m.Size()
+	record := encodeRecord([]Edit{AddFile(testFile(1, 0))})
+	if _, err := m.fp.Write(record[:len(record)-2]); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFiles(conf, conf.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadFiles with torn tail = %+v, want %+v", got, want)
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != size+int64(len(record))-2 {
+		t.Fatalf("ReadFiles modified the manifest: %v", err)
+	}
+}
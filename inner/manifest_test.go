@@ -0,0 +1,416 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// copyDir 将src目录复制到dst，用于得到在某个位置断电后的磁盘状态
+func copyDir(tb testing.TB, src, dst string) {
+	tb.Helper()
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// crashAt 在第一次执行到point时复制数据目录，返回复制的目录以及是否已复制
+func crashAt(t *testing.T, conf *config.Config, point string) (string, *bool) {
+	snapshot := filepath.Join(t.TempDir(), "crash")
+	captured := new(bool)
+	conf.Hooks = &config.TestHooks{Crash: func(p string) {
+		if p == point && !*captured {
+			*captured = true
+			copyDir(t, conf.DataDir, snapshot)
+		}
+	}}
+	return snapshot, captured
+}
+
+// dirSyncs 记录各目录最近一次fsync时的目录项，断电后只有这些目录项仍然存在：
+// 之后新建或重命名得到的文件丢失，删除则视为已经生效
+type dirSyncs struct {
+	t      *testing.T
+	mu     sync.Mutex
+	synced map[string]map[string]bool
+}
+
+// newDirSyncs 以root下当前的所有目录项为已持久化的初始状态，相当于上次正常关闭后的磁盘
+func newDirSyncs(t *testing.T, root string) *dirSyncs {
+	d := &dirSyncs{t: t, synced: make(map[string]map[string]bool)}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			d.record(path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// record 作为TestHooks.DirSynced记录dir当前的目录项
+func (d *dirSyncs) record(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		d.t.Error(err)
+		return
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.synced[filepath.Clean(dir)] = names
+}
+
+// copyDurable 将src复制到dst，丢弃尚未通过目录fsync持久化的目录项，复制期间被删除的文件视为删除已经生效
+func (d *dirSyncs) copyDurable(src, dst string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if path != src && !d.synced[filepath.Dir(path)][entry.Name()] {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0644)
+	})
+	if err != nil {
+		d.t.Error(err)
+	}
+}
+
+// sstNames 返回SST目录中的文件名
+func sstNames(t *testing.T, conf *config.Config) []string {
+	t.Helper()
+	entries, err := os.ReadDir(conf.SSTPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) == ".sst" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestLsmTree_ManifestCrashAfterSSTRename(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	snapshot, captured := crashAt(t, conf, config.CrashAfterSSTRename)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < 50; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if !*captured {
+		t.Fatal("flush did not reach the crash point")
+	}
+
+	// SST已重命名但未记入清单：重启时删除该文件，数据从WAL恢复
+	crashed := newTestConfig(t)
+	crashed.DataDir = snapshot
+	if names := sstNames(t, crashed); len(names) != 1 {
+		t.Fatalf("snapshot has sst files %v, want the renamed one", names)
+	}
+	recovered, err := NewLsmTree(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if names := sstNames(t, crashed); len(names) != 0 {
+		t.Fatalf("orphan sst files %v were not removed", names)
+	}
+	if n := len(recovered.Levels()[0].Files); n != 0 {
+		t.Fatalf("recovered %d nodes, want 0", n)
+	}
+	for i := 0; i < 50; i++ {
+		if value, err := recovered.Get([]byte(fmt.Sprintf("key-%02d", i))); err != nil || string(value) != "v" {
+			t.Fatalf("Get(key-%02d) = %q, %v", i, value, err)
+		}
+	}
+}
+
+func TestLsmTree_ManifestCrashBeforeSSTDelete(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.PeriodicCompactionInterval = time.Hour
+	conf.TombstoneCompactionRatio = 0.5
+	snapshot, captured := crashAt(t, conf, config.CrashBeforeSSTDelete)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("keep"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	// 只包含可丢弃的删除标记的文件，定期压缩时整个删除
+	for i := 0; i < 10; i++ {
+		if err := tree.Delete([]byte(fmt.Sprintf("gone-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	deleted := tree.Levels()[0].Files[1].Path
+	clock.Advance(time.Hour)
+	if run := waitPeriodicRun(t, tree, time.Unix(1700000000, 0)); run.Err != nil || run.FilesCompacted != 1 {
+		t.Fatalf("periodic run = %+v, want 1 file removed", run)
+	}
+	if !*captured {
+		t.Fatal("periodic compaction did not reach the crash point")
+	}
+
+	// 清单已记录删除但文件仍在：重启时删除该文件，不再载入
+	crashed := newTestConfig(t)
+	crashed.DataDir = snapshot
+	leftover := filepath.Join(crashed.SSTPath(), filepath.Base(deleted))
+	if _, err := os.Stat(leftover); err != nil {
+		t.Fatalf("snapshot lost the deleted file: %v", err)
+	}
+	recovered, err := NewLsmTree(crashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recovered.Close()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("deleted sst was not removed: %v", err)
+	}
+	if n := len(recovered.Levels()[0].Files); n != 1 {
+		t.Fatalf("recovered %d nodes, want 1", n)
+	}
+	if value, err := recovered.Get([]byte("keep")); err != nil || string(value) != "v" {
+		t.Fatalf("Get(keep) = %q, %v", value, err)
+	}
+}
+
+func TestLsmTree_ManifestOrphans(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	// 没有清单时按目录扫描载入并创建清单
+	writeLevelSST(t, conf, 0, 0, map[string]string{"a": "1"})
+	conf.Hooks = &config.TestHooks{SSTSeq: func(level int, seq uint32) uint32 { return seq + 4 }}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Exists(conf.DataDir) {
+		t.Fatal("manifest was not created from the directory scan")
+	}
+	if err := tree.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree) // 0_5.sst
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 序列号大于清单中所有文件的未提交文件被删除，无法确认来源的文件被隔离
+	writeLevelSST(t, conf, 0, 9, map[string]string{"c": "uncommitted"})
+	writeLevelSST(t, conf, 0, 2, map[string]string{"d": "unknown"})
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	checkOrphans := func(stage string, want map[string]string) {
+		t.Helper()
+		for key, value := range want {
+			got, err := tree.Get([]byte(key))
+			if value == "" && err != myerror.ErrKeyNotFound || value != "" && string(got) != value {
+				t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key, got, err, value)
+			}
+		}
+	}
+	checkOrphans("orphans", map[string]string{"a": "1", "b": "2", "c": "", "d": ""})
+	if _, err := os.Stat(filepath.Join(conf.SSTPath(), "0_9.sst")); !os.IsNotExist(err) {
+		t.Fatalf("uncommitted sst was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(conf.QuarantinePath(), "0_2.sst")); err != nil {
+		t.Fatalf("unknown sst was not quarantined: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 清单尾部损坏时不在清单中的文件可能已提交，重新加入清单
+	writeLevelSST(t, conf, 0, 7, map[string]string{"e": "adopted"})
+	current, err := os.ReadFile(filepath.Join(conf.DataDir, manifest.CurrentFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := os.OpenFile(filepath.Join(conf.DataDir, string(current[:len(current)-1])), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Write([]byte{0, 0, 0, 1, 0, 0})
+	fp.Close()
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	checkOrphans("truncated manifest", map[string]string{"a": "1", "b": "2", "e": "adopted"})
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	checkOrphans("after adoption", map[string]string{"a": "1", "b": "2", "e": "adopted"})
+	if n := len(tree.Levels()[0].Files); tree.manifest.Truncated() || n != 3 {
+		t.Fatalf("truncated = %v with %d nodes after adoption", tree.manifest.Truncated(), n)
+	}
+}
+
+func TestLsmTree_ManifestRewrite(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	conf.MaxManifestFileSize = 256 // 每次刷盘后都会重写清单
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		flushAll(t, tree)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if n := len(tree.Levels()[0].Files); n != 10 {
+		t.Fatalf("loaded %d nodes, want 10", n)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := tree.Get([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatalf("Get(key-%d) = %v", i, err)
+		}
+	}
+}
+
+// TestLsmTree_SyncDirs 刷盘后删除WAL时断电：不同步目录时新SST的目录项可能丢失而WAL已经删除，数据随之丢失；
+// 开启SyncDirs后重启仍能读到数据
+func TestLsmTree_SyncDirs(t *testing.T) {
+	for _, syncDirs := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SyncDirs=%v", syncDirs), func(t *testing.T) {
+			conf := newTestConfig(t)
+			conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+			conf.SyncDirs = syncDirs
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			syncs := newDirSyncs(t, conf.DataDir)
+			snapshot := filepath.Join(t.TempDir(), "crash")
+			captured := false
+			conf.Hooks = &config.TestHooks{
+				DirSynced: syncs.record,
+				Crash: func(point string) {
+					if point == config.CrashAfterWALDelete && !captured {
+						captured = true
+						syncs.copyDurable(conf.DataDir, snapshot)
+					}
+				},
+			}
+			if tree, err = NewLsmTree(conf); err != nil {
+				t.Fatal(err)
+			}
+			if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+			flushAll(t, tree)
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !captured {
+				t.Fatal("flush did not delete a wal")
+			}
+
+			recovered := newTestConfig(t)
+			recovered.DataDir = snapshot
+			tree, err = NewLsmTree(recovered)
+			var value []byte
+			if err == nil {
+				value, err = tree.Get([]byte("key"))
+				tree.Close()
+			}
+			if syncDirs {
+				if err != nil || string(value) != "value" {
+					t.Fatalf("after power loss: Get = %q, %v, want value", value, err)
+				}
+			} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("after power loss without SyncDirs: Get = %q, %v, want the unsynced sst to be lost", value, err)
+			}
+		})
+	}
+}
@@ -4,24 +4,25 @@ import (
 	"bytes"
 	"sync"
 
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 	"github.com/google/btree"
 )
 
-// KVItem 用于存储在B树中的键值对
+// KVItem 用于存储在B树中的条目
 type KVItem struct {
-	key   []byte
-	value []byte
+	entry kv.Entry
 }
 
 // Less 实现btree.Item接口的Less方法
 func (i *KVItem) Less(than btree.Item) bool {
-	return bytes.Compare(i.key, than.(*KVItem).key) < 0
+	return bytes.Compare(i.entry.Key, than.(*KVItem).entry.Key) < 0
 }
 
 // BTreeMemTable B树内存表实现
 type BTreeMemTable struct {
 	tree  *btree.BTree
+	size  int64        // 估算占用的内存
 	mutex sync.RWMutex // 读写锁，用于并发控制
 }
 
@@ -37,40 +38,51 @@ func NewBTreeMemTable(degree int) *BTreeMemTable {
 
 // Put 向B树中插入键值对
 func (bt *BTreeMemTable) Put(key, value []byte) error {
-	if key == nil {
+	return bt.PutEntry(kv.FromValue(key, value, 0))
+}
+
+// PutEntry 向B树中插入条目
+func (bt *BTreeMemTable) PutEntry(entry kv.Entry) error {
+	if entry.Key == nil {
 		return myerror.ErrKeyNil
 	}
 
-	item := &KVItem{
-		key:   append([]byte{}, key...),   // 深拷贝，避免外部修改
-		value: append([]byte{}, value...), // 深拷贝，避免外部修改
-	}
+	item := &KVItem{entry: newEntry(entry)} // 深拷贝，避免外部修改
 
 	bt.mutex.Lock()         // 写操作加锁
 	defer bt.mutex.Unlock() // 确保操作完成后解锁
 
-	bt.tree.ReplaceOrInsert(item)
+	if old := bt.tree.ReplaceOrInsert(item); old != nil {
+		oldItem := old.(*KVItem)
+		bt.size -= EntrySize(oldItem.entry.Key, oldItem.entry.Value)
+	}
+	bt.size += EntrySize(item.entry.Key, item.entry.Value)
 	return nil
 }
 
 // Get 从B树中获取值
 func (bt *BTreeMemTable) Get(key []byte) ([]byte, error) {
+	entry, err := bt.GetEntry(key)
+	return entry.Value, err
+}
+
+// GetEntry 从B树中获取条目
+func (bt *BTreeMemTable) GetEntry(key []byte) (kv.Entry, error) {
 	if key == nil {
-		return nil, myerror.ErrKeyNil
+		return kv.Entry{}, myerror.ErrKeyNil
 	}
 
-	searchItem := &KVItem{key: key}
+	searchItem := &KVItem{entry: kv.Entry{Key: key}}
 
 	bt.mutex.RLock()         // 读操作加读锁
 	defer bt.mutex.RUnlock() // 确保操作完成后解锁
 
 	item := bt.tree.Get(searchItem)
 	if item == nil {
-		return nil, myerror.ErrKeyNotFound
+		return kv.Entry{}, myerror.ErrKeyNotFound
 	}
 
-	kvItem := item.(*KVItem)
-	return append([]byte{}, kvItem.value...), nil // 返回拷贝，避免外部修改
+	return item.(*KVItem).entry.Clone(), nil // 返回拷贝，避免外部修改
 }
 
 // Delete 从B树中删除一个键值对
@@ -79,7 +91,7 @@ func (bt *BTreeMemTable) Delete(key []byte) error {
 		return myerror.ErrKeyNil
 	}
 
-	searchItem := &KVItem{key: key}
+	searchItem := &KVItem{entry: kv.Entry{Key: key}}
 
 	bt.mutex.Lock()         // 写操作加锁
 	defer bt.mutex.Unlock() // 确保操作完成后解锁
@@ -88,6 +100,8 @@ func (bt *BTreeMemTable) Delete(key []byte) error {
 	if item == nil {
 		return myerror.ErrKeyNotFound
 	}
+	kvItem := item.(*KVItem)
+	bt.size -= EntrySize(kvItem.entry.Key, kvItem.entry.Value)
 
 	return nil
 }
@@ -98,11 +112,9 @@ func (bt *BTreeMemTable) ForEach(visitor func(key, value []byte) bool) {
 	defer bt.mutex.RUnlock() // 确保操作完成后解锁
 
 	bt.tree.Ascend(func(i btree.Item) bool {
-		kvItem := i.(*KVItem)
 		// 传递拷贝，避免外部修改
-		keyCopy := append([]byte{}, kvItem.key...)
-		valueCopy := append([]byte{}, kvItem.value...)
-		return visitor(keyCopy, valueCopy)
+		entry := i.(*KVItem).entry.Clone()
+		return visitor(entry.Key, entry.Value)
 	})
 }
 
@@ -111,7 +123,52 @@ func (bt *BTreeMemTable) ForEach(visitor func(key, value []byte) bool) {
 // 注意：调用方负责处理锁定，确保在调用该方法前已获取适当的锁
 func (bt *BTreeMemTable) ForEachUnSafe(visitor func(key, value []byte) bool) {
 	bt.tree.Ascend(func(i btree.Item) bool {
-		kvItem := i.(*KVItem)
-		return visitor(kvItem.key, kvItem.value)
+		entry := i.(*KVItem).entry
+		return visitor(entry.Key, entry.Value)
 	})
 }
+
+// ForEachEntryUnSafe 与ForEachUnSafe相同，传递完整的条目
+func (bt *BTreeMemTable) ForEachEntryUnSafe(visitor func(entry kv.Entry) bool) {
+	bt.tree.Ascend(func(i btree.Item) bool {
+		return visitor(i.(*KVItem).entry)
+	})
+}
+
+// Size 估算B树占用的内存
+func (bt *BTreeMemTable) Size() int64 {
+	bt.mutex.RLock()
+	defer bt.mutex.RUnlock()
+	return bt.size
+}
+
+// btreeSnapshot B树的写时复制快照，只由一个迭代器使用，不需要加锁
+type btreeSnapshot struct {
+	tree *btree.BTree
+}
+
+// snapshot 返回当前内容的快照。Clone不复制节点，之后原树的写入按需复制被修改的节点，快照保持不变
+func (bt *BTreeMemTable) snapshot() btreeSnapshot {
+	// Clone会修改原树的写时复制状态，需要与写入和其他Clone互斥
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	return btreeSnapshot{tree: bt.tree.Clone()}
+}
+
+func (s btreeSnapshot) entriesAfter(after []byte, first bool, n int) []kv.Entry {
+	entries := make([]kv.Entry, 0, n)
+	visit := func(i btree.Item) bool {
+		entry := i.(*KVItem).entry
+		if !first && bytes.Equal(entry.Key, after) {
+			return true
+		}
+		entries = append(entries, entry)
+		return len(entries) < n
+	}
+	if first {
+		s.tree.Ascend(visit)
+	} else {
+		s.tree.AscendGreaterOrEqual(&KVItem{entry: kv.Entry{Key: after}}, visit)
+	}
+	return entries
+}
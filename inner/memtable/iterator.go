@@ -0,0 +1,109 @@
+package memtable
+
+import (
+	"bytes"
+
+	"github.com/aixiasang/lsm/inner/kv"
+)
+
+// DefaultIterBatchSize 迭代器每批复制的默认条目数
+const DefaultIterBatchSize = 256
+
+// entryBatcher 按key顺序返回after之后(first为true时从头开始)最多n个条目。
+// 内存表中的条目写入后不再修改，返回的条目可以在释放锁之后继续使用
+type entryBatcher interface {
+	entriesAfter(after []byte, first bool, n int) []kv.Entry
+}
+
+// Iterator 按key顺序遍历内存表的游标，两次Next之间不持有内存表的锁，调用方处理条目时写入不被阻塞。
+// B树内存表遍历创建时的写时复制快照，结果与创建时的内容一致；跳表每批在读锁内复制最多batchSize个条目，
+// 之后的写入在尚未遍历到的部分可能可见。迭代器不能并发使用
+type Iterator struct {
+	source     entryBatcher // 条目来源，Close后为nil
+	batchSize  int          // 每批复制的条目数
+	consistent bool         // 是否遍历创建时的快照
+	batch      []kv.Entry   // 当前批次
+	pos        int          // 当前条目在批次中的下标，Next之前为-1
+	last       []byte       // 已遍历的最后一个key
+	first      bool         // 是否还没有取过批次
+}
+
+// NewIterator 创建遍历m的迭代器，batchSize<=0时使用DefaultIterBatchSize。
+// 不是本包实现的内存表没有分批接口，在ForEach内一次复制全部条目
+func NewIterator(m MemTable, batchSize int) *Iterator {
+	if batchSize <= 0 {
+		batchSize = DefaultIterBatchSize
+	}
+	it := &Iterator{batchSize: batchSize, pos: -1, first: true}
+	switch table := m.(type) {
+	case *BTreeMemTable:
+		it.source, it.consistent = table.snapshot(), true
+	case *SkipListMemTable:
+		it.source = table
+	default:
+		var entries []kv.Entry
+		m.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+			entries = append(entries, entry)
+			return true
+		})
+		it.source, it.consistent = sliceBatcher(entries), true
+	}
+	return it
+}
+
+// Consistent 返回迭代器是否遍历创建时的快照。为false时调用方需要一致视图就要在遍历期间阻止写入
+func (it *Iterator) Consistent() bool {
+	return it.consistent
+}
+
+// Next 移到下一个条目，没有更多条目或已经Close时返回false
+func (it *Iterator) Next() bool {
+	if it.source == nil {
+		return false
+	}
+	if it.pos+1 < len(it.batch) {
+		it.pos++
+		return true
+	}
+	// 上一批不满说明已经遍历完
+	if !it.first && len(it.batch) < it.batchSize {
+		it.Close()
+		return false
+	}
+	if len(it.batch) > 0 {
+		it.last = it.batch[len(it.batch)-1].Key
+	}
+	it.batch = it.source.entriesAfter(it.last, it.first, it.batchSize)
+	it.first = false
+	it.pos = 0
+	if len(it.batch) == 0 {
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// Entry 返回当前条目的副本，调用方可以修改
+func (it *Iterator) Entry() kv.Entry {
+	return it.batch[it.pos].Clone()
+}
+
+// Close 释放快照和缓冲的条目，可以重复调用
+func (it *Iterator) Close() {
+	it.source = nil
+	it.batch = nil
+	it.pos = -1
+}
+
+// sliceBatcher 已复制出的有序条目
+type sliceBatcher []kv.Entry
+
+func (s sliceBatcher) entriesAfter(after []byte, first bool, n int) []kv.Entry {
+	start := 0
+	if !first {
+		for start < len(s) && bytes.Compare(s[start].Key, after) <= 0 {
+			start++
+		}
+	}
+	return s[start:min(start+n, len(s))]
+}
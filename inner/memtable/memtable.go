@@ -1,12 +1,28 @@
 package memtable
 
+import "github.com/aixiasang/lsm/inner/kv"
+
 // MemTable 内存表接口
+// 以key和value访问时value为nil表示删除标记(tombstone)，与空值[]byte{}区分
 type MemTable interface {
 	Put(key, value []byte) error                        // 插入
 	Get(key []byte) ([]byte, error)                     // 查询
 	Delete(key []byte) error                            // 删除
 	ForEach(visitor func(key, value []byte) bool)       // 遍历
 	ForEachUnSafe(visitor func(key, value []byte) bool) // 遍历
+	Size() int64                                        // 估算占用的内存，包括删除标记和每个条目的额外开销
+
+	PutEntry(entry kv.Entry) error                        // 插入条目，保留类型、序列号、过期时间和写入时间
+	GetEntry(key []byte) (kv.Entry, error)                // 查询条目，删除标记以KindDelete返回
+	ForEachEntryUnSafe(visitor func(entry kv.Entry) bool) // 非安全地遍历条目
+}
+
+// EntryOverhead 每个条目除key和value外的内存开销估算(树节点、切片头等)
+const EntryOverhead = 64
+
+// EntrySize 估算一个条目占用的内存
+func EntrySize(key, value []byte) int64 {
+	return int64(len(key)+len(value)) + EntryOverhead
 }
 
 type MemTableType int8
@@ -30,3 +46,8 @@ func NewMemTable(mtType MemTableType, degree int) MemTable {
 func NewMemTableWithDefaultDegree(mtType MemTableType) MemTable {
 	return NewMemTable(mtType, 32)
 }
+
+// newEntry 拷贝entry作为内存表中保存的条目，value与类型保持一致
+func newEntry(entry kv.Entry) kv.Entry {
+	return entry.Normalize().Clone()
+}
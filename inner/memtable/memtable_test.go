@@ -3,8 +3,12 @@ package memtable
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 	"sync"
 	"testing"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
 )
 
 // 通用测试函数，用于测试 MemTable 接口的基本功能
@@ -259,3 +263,248 @@ func TestSkipListMemTable(t *testing.T) {
 	testMemTableBasicOperations(t, mt, "SkipList")
 	testMemTableConcurrentOperations(t, mt, "SkipList")
 }
+
+// 测试删除标记(nil)与空值的区别在内存表中得以保留
+func TestMemTableTombstone(t *testing.T) {
+	for name, mt := range map[string]MemTable{
+		"BTree":    NewBTreeMemTable(2),
+		"SkipList": NewSkipListMemTable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := mt.Put([]byte("tombstone"), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := mt.Put([]byte("empty"), []byte{}); err != nil {
+				t.Fatal(err)
+			}
+			value, err := mt.Get([]byte("tombstone"))
+			if err != nil || value != nil {
+				t.Errorf("expected nil tombstone value, got %v, %v", value, err)
+			}
+			value, err = mt.Get([]byte("empty"))
+			if err != nil || value == nil || len(value) != 0 {
+				t.Errorf("expected non-nil empty value, got %v, %v", value, err)
+			}
+			mt.ForEach(func(key, value []byte) bool {
+				if string(key) == "tombstone" && value != nil {
+					t.Errorf("ForEach should keep tombstone value nil")
+				}
+				if string(key) == "empty" && value == nil {
+					t.Errorf("ForEach should keep empty value non-nil")
+				}
+				return true
+			})
+		})
+	}
+}
+
+func TestMemTableSize(t *testing.T) {
+	for name, mt := range map[string]MemTable{
+		"BTree":    NewBTreeMemTable(2),
+		"SkipList": NewSkipListMemTable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if mt.Size() != 0 {
+				t.Fatalf("empty size = %d", mt.Size())
+			}
+			mt.Put([]byte("key"), []byte("value"))
+			want := EntrySize([]byte("key"), []byte("value"))
+			if mt.Size() != want {
+				t.Fatalf("size after put = %d, want %d", mt.Size(), want)
+			}
+			// 覆盖写入只计算最新的值
+			mt.Put([]byte("key"), []byte("v"))
+			want = EntrySize([]byte("key"), []byte("v"))
+			if mt.Size() != want {
+				t.Fatalf("size after overwrite = %d, want %d", mt.Size(), want)
+			}
+			// 删除标记同样占用内存
+			mt.Put([]byte("gone"), nil)
+			want += EntrySize([]byte("gone"), nil)
+			if mt.Size() != want {
+				t.Fatalf("size after tombstone = %d, want %d", mt.Size(), want)
+			}
+			if err := mt.Delete([]byte("key")); err != nil {
+				t.Fatal(err)
+			}
+			want -= EntrySize([]byte("key"), []byte("v"))
+			if mt.Size() != want {
+				t.Fatalf("size after delete = %d, want %d", mt.Size(), want)
+			}
+		})
+	}
+}
+
+// 测试写入时间随条目保存，覆盖写入保留最新的时间，未记录时间的条目返回0
+func TestMemTableTimestamp(t *testing.T) {
+	for name, mt := range map[string]MemTable{
+		"BTree":    NewBTreeMemTable(2),
+		"SkipList": NewSkipListMemTable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			mt.PutEntry(kv.FromValue([]byte("a"), []byte("1"), 100))
+			mt.PutEntry(kv.FromValue([]byte("a"), []byte("2"), 200))
+			mt.PutEntry(kv.FromValue([]byte("b"), nil, 300))
+			mt.Put([]byte("c"), []byte("3"))
+
+			want := map[string]int64{"a": 200, "b": 300, "c": 0}
+			for key, wantTs := range want {
+				entry, err := mt.GetEntry([]byte(key))
+				if err != nil || entry.Timestamp != wantTs {
+					t.Errorf("GetEntry(%s) = %d, %v, want %d", key, entry.Timestamp, err, wantTs)
+				}
+			}
+			if entry, _ := mt.GetEntry([]byte("a")); string(entry.Value) != "2" {
+				t.Errorf("GetEntry(a) value = %s, want 2", entry.Value)
+			}
+			if value, _ := mt.Get([]byte("b")); value != nil {
+				t.Errorf("tombstone value = %v, want nil", value)
+			}
+			if mt.Size() != EntrySize([]byte("a"), []byte("2"))+EntrySize([]byte("b"), nil)+EntrySize([]byte("c"), []byte("3")) {
+				t.Errorf("timestamps should not change Size, got %d", mt.Size())
+			}
+			visited := 0
+			mt.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+				visited++
+				if entry.Timestamp != want[string(entry.Key)] {
+					t.Errorf("ForEachEntryUnSafe %s ts = %d, want %d", entry.Key, entry.Timestamp, want[string(entry.Key)])
+				}
+				return true
+			})
+			if visited != len(want) {
+				t.Errorf("visited %d entries, want %d", visited, len(want))
+			}
+		})
+	}
+}
+
+// 测试条目的类型、序列号和过期时间随条目保存，以key和value访问时与旧的删除标记约定一致
+func TestMemTableEntry(t *testing.T) {
+	for name, mt := range map[string]MemTable{
+		"BTree":    NewBTreeMemTable(2),
+		"SkipList": NewSkipListMemTable(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			entries := []kv.Entry{
+				{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut, Seq: 1, TTL: 1000, Timestamp: 10},
+				{Key: []byte("b"), Value: []byte("stale"), Kind: kv.KindDelete, Seq: 2},
+				{Key: []byte("c"), Value: []byte("+1"), Kind: kv.KindMerge, Seq: 3},
+				{Key: []byte("d"), Value: []byte("f"), Kind: kv.KindRangeDelete, Seq: 4},
+				{Key: []byte("e"), Kind: kv.KindPut, Seq: 5},
+			}
+			for _, entry := range entries {
+				if err := mt.PutEntry(entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := mt.PutEntry(kv.Entry{Kind: kv.KindPut}); err != myerror.ErrKeyNil {
+				t.Fatalf("PutEntry without key = %v, want ErrKeyNil", err)
+			}
+			for _, want := range entries {
+				want = want.Normalize()
+				got, err := mt.GetEntry(want.Key)
+				if err != nil || !reflect.DeepEqual(got, want) {
+					t.Fatalf("GetEntry(%s) = %+v, %v, want %+v", want.Key, got, err, want)
+				}
+			}
+			// 删除标记的value为nil，没有value的写入为空值
+			if value, err := mt.Get([]byte("b")); err != nil || value != nil {
+				t.Fatalf("Get(b) = %v, %v, want tombstone", value, err)
+			}
+			if value, err := mt.Get([]byte("e")); err != nil || value == nil {
+				t.Fatalf("Get(e) = %v, %v, want empty value", value, err)
+			}
+
+			// 返回的条目是拷贝
+			got, _ := mt.GetEntry([]byte("a"))
+			got.Value[0] = 'x'
+			if again, _ := mt.GetEntry([]byte("a")); string(again.Value) != "1" {
+				t.Fatalf("GetEntry returned a shared value")
+			}
+			var kinds []kv.EntryKind
+			mt.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+				kinds = append(kinds, entry.Kind)
+				return true
+			})
+			want := []kv.EntryKind{kv.KindPut, kv.KindDelete, kv.KindMerge, kv.KindRangeDelete, kv.KindPut}
+			if !reflect.DeepEqual(kinds, want) {
+				t.Fatalf("ForEachEntryUnSafe kinds = %v, want %v", kinds, want)
+			}
+		})
+	}
+}
+
+// customMemTable 不是本包实现的内存表，迭代器退回一次复制全部条目
+type customMemTable struct {
+	MemTable
+}
+
+func TestIterator(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		table      MemTable
+		consistent bool
+	}{
+		{"btree", NewBTreeMemTable(2), true},
+		{"skiplist", NewSkipListMemTable(), false},
+		{"custom", customMemTable{NewBTreeMemTable(2)}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			for i := 0; i < 10; i += 2 {
+				if err := c.table.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("v1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.table.Delete([]byte("key04")); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.table.PutEntry(kv.Entry{Key: []byte("key06"), Kind: kv.KindDelete}); err != nil {
+				t.Fatal(err)
+			}
+			it := NewIterator(c.table, 2)
+			if it.Consistent() != c.consistent {
+				t.Fatalf("Consistent() = %v", it.Consistent())
+			}
+			var keys []string
+			for it.Next() {
+				entry := it.Entry()
+				keys = append(keys, string(entry.Key))
+				if string(entry.Key) == "key06" && !entry.IsDelete() {
+					t.Fatal("tombstone lost")
+				}
+				// 修改返回的副本不影响内存表
+				entry.Value = append(entry.Value[:0], 'x')
+				// 两次Next之间不持有锁，写入不会阻塞；新key在已遍历的key之后
+				if err := c.table.Put([]byte(string(entry.Key)+"a"), []byte("v2")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := "[key00 key02 key06 key08]"
+			if !c.consistent {
+				// 分批复制时，在尚未复制的范围内的写入在之后的批次中可见，已复制的范围内的写入不可见
+				want = "[key00 key02 key02a key06 key06a key08 key08a]"
+			}
+			if fmt.Sprint(keys) != want {
+				t.Fatalf("keys %v, want %v", keys, want)
+			}
+			if value, err := c.table.Get([]byte("key00")); err != nil || string(value) != "v1" {
+				t.Fatalf("Get(key00) = %q, %v", value, err)
+			}
+			it.Close()
+			if it.Next() {
+				t.Fatal("Next after Close returned true")
+			}
+
+			// Close之后不再遍历，可以重复调用
+			it = NewIterator(c.table, 0)
+			if !it.Next() {
+				t.Fatal("empty iterator")
+			}
+			it.Close()
+			it.Close()
+			if it.Next() {
+				t.Fatal("Next after Close returned true")
+			}
+		})
+	}
+}
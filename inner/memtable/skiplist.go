@@ -2,8 +2,10 @@ package memtable
 
 import (
 	"bytes"
+	"math/rand"
 	"sync"
 
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 	"github.com/huandu/skiplist"
 )
@@ -19,6 +21,7 @@ func BytesCompare(k1, k2 interface{}) int {
 // SkipListMemTable 跳表内存表实现
 type SkipListMemTable struct {
 	list  *skiplist.SkipList
+	size  int64        // 估算占用的内存
 	mutex sync.RWMutex // 读写锁，用于并发控制
 }
 
@@ -30,27 +33,48 @@ func NewSkipListMemTable() *SkipListMemTable {
 	}
 }
 
+// SetRandSource 设置生成节点层数使用的随机源，需在写入前调用
+func (sl *SkipListMemTable) SetRandSource(source rand.Source) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+	sl.list.SetRandSource(source)
+}
+
 // Put 向跳表中插入键值对
 func (sl *SkipListMemTable) Put(key, value []byte) error {
-	if key == nil {
+	return sl.PutEntry(kv.FromValue(key, value, 0))
+}
+
+// PutEntry 向跳表中插入条目，跳表的值为条目本身
+func (sl *SkipListMemTable) PutEntry(entry kv.Entry) error {
+	if entry.Key == nil {
 		return myerror.ErrKeyNil
 	}
 
 	// 深拷贝键和值，避免外部修改
-	keyCopy := append([]byte{}, key...)
-	valueCopy := append([]byte{}, value...)
+	entry = newEntry(entry)
 
 	sl.mutex.Lock()         // 写操作加锁
 	defer sl.mutex.Unlock() // 确保操作完成后解锁
 
-	sl.list.Set(keyCopy, valueCopy)
+	if old := sl.list.Get(entry.Key); old != nil {
+		sl.size -= EntrySize(entry.Key, old.Value.(kv.Entry).Value)
+	}
+	sl.list.Set(entry.Key, entry)
+	sl.size += EntrySize(entry.Key, entry.Value)
 	return nil
 }
 
 // Get 从跳表中获取值
 func (sl *SkipListMemTable) Get(key []byte) ([]byte, error) {
+	entry, err := sl.GetEntry(key)
+	return entry.Value, err
+}
+
+// GetEntry 从跳表中获取条目
+func (sl *SkipListMemTable) GetEntry(key []byte) (kv.Entry, error) {
 	if key == nil {
-		return nil, myerror.ErrKeyNil
+		return kv.Entry{}, myerror.ErrKeyNil
 	}
 
 	sl.mutex.RLock()         // 读操作加读锁
@@ -58,12 +82,11 @@ func (sl *SkipListMemTable) Get(key []byte) ([]byte, error) {
 
 	element := sl.list.Get(key)
 	if element == nil {
-		return nil, myerror.ErrKeyNotFound
+		return kv.Entry{}, myerror.ErrKeyNotFound
 	}
 
-	// 返回值的深拷贝，避免外部修改
-	value := element.Value.([]byte)
-	return append([]byte{}, value...), nil
+	// 返回条目的深拷贝，避免外部修改
+	return element.Value.(kv.Entry).Clone(), nil
 }
 
 // Delete 从跳表中删除一个键值对
@@ -75,9 +98,11 @@ func (sl *SkipListMemTable) Delete(key []byte) error {
 	sl.mutex.Lock()         // 写操作加锁
 	defer sl.mutex.Unlock() // 确保操作完成后解锁
 
-	if sl.list.Remove(key) == nil {
+	element := sl.list.Remove(key)
+	if element == nil {
 		return myerror.ErrKeyNotFound
 	}
+	sl.size -= EntrySize(key, element.Value.(kv.Entry).Value)
 
 	return nil
 }
@@ -90,13 +115,9 @@ func (sl *SkipListMemTable) ForEach(visitor func(key, value []byte) bool) {
 	// 从第一个元素开始遍历
 	for element := sl.list.Front(); element != nil; element = element.Next() {
 		// 创建键值的深拷贝
-		key := element.Key().([]byte)
-		value := element.Value.([]byte)
+		entry := element.Value.(kv.Entry).Clone()
 
-		keyCopy := append([]byte{}, key...)
-		valueCopy := append([]byte{}, value...)
-
-		if !visitor(keyCopy, valueCopy) {
+		if !visitor(entry.Key, entry.Value) {
 			break
 		}
 	}
@@ -107,11 +128,45 @@ func (sl *SkipListMemTable) ForEach(visitor func(key, value []byte) bool) {
 // 注意：调用方负责处理锁定，确保在调用该方法前已获取适当的锁
 func (sl *SkipListMemTable) ForEachUnSafe(visitor func(key, value []byte) bool) {
 	for element := sl.list.Front(); element != nil; element = element.Next() {
-		key := element.Key().([]byte)
-		value := element.Value.([]byte)
+		entry := element.Value.(kv.Entry)
 
-		if !visitor(key, value) {
+		if !visitor(entry.Key, entry.Value) {
 			break
 		}
 	}
 }
+
+// ForEachEntryUnSafe 与ForEachUnSafe相同，传递完整的条目
+func (sl *SkipListMemTable) ForEachEntryUnSafe(visitor func(entry kv.Entry) bool) {
+	for element := sl.list.Front(); element != nil; element = element.Next() {
+		if !visitor(element.Value.(kv.Entry)) {
+			break
+		}
+	}
+}
+
+// Size 估算跳表占用的内存
+func (sl *SkipListMemTable) Size() int64 {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+	return sl.size
+}
+
+// entriesAfter 在读锁内复制after之后最多n个条目，两批之间不持有锁
+func (sl *SkipListMemTable) entriesAfter(after []byte, first bool, n int) []kv.Entry {
+	sl.mutex.RLock()
+	defer sl.mutex.RUnlock()
+	entries := make([]kv.Entry, 0, n)
+	element := sl.list.Front()
+	if !first {
+		element = sl.list.Find(after)
+	}
+	for ; element != nil && len(entries) < n; element = element.Next() {
+		entry := element.Value.(kv.Entry)
+		if !first && bytes.Equal(entry.Key, after) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
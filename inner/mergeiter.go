@@ -0,0 +1,138 @@
+package inner
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// mergeSource 合并迭代器的一个输入文件，cur为该文件中当前key的最后一个版本
+type mergeSource struct {
+	it    *sst.SSTIterator
+	order int      // 在输入中的位置，越大越新
+	cur   kv.Entry // 当前条目
+	ahead bool     // it已经位于cur之后的条目上
+	copy  bool     // 是否复制每个条目
+}
+
+// entry 返回迭代器的当前条目，不复制时引用迭代器复用的数据块缓冲区
+func (s *mergeSource) entry() kv.Entry {
+	if s.copy {
+		return s.it.Entry()
+	}
+	return s.it.EntryUnsafe()
+}
+
+// advance 移动到下一个key，同一个文件中连续的重复key取最后写入的版本。
+// 为此迭代器会向前多读一个条目，cur是上一个条目，复用缓冲区的迭代器保证它在下一次Next之前不被覆盖
+func (s *mergeSource) advance() bool {
+	if !s.ahead {
+		return false
+	}
+	s.cur = s.entry()
+	for s.ahead = s.it.Next(); s.ahead && bytes.Equal(s.it.KeyUnsafe(), s.cur.Key); s.ahead = s.it.Next() {
+		s.cur = s.entry()
+	}
+	return true
+}
+
+// mergeHeap 按当前key排序的输入文件，key相同时较新的文件在前
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].cur.Key, h[j].cur.Key); c != 0 {
+		return c < 0
+	}
+	return h[i].order > h[j].order
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x any) { *h = append(*h, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// mergeIterator 按key顺序合并多个SST文件，同一个key只返回最新的版本，用于层级压缩。
+// 不复制时Entry引用输入文件的数据块缓冲区，只在下一次调用Next之前有效：压缩比较key后立即交给写入器，
+// 写入器将条目复制到自己的数据块中，不保留返回的切片。为此Next先前进其他位于同一个key的更旧文件，
+// 最后才前进返回条目所在的文件
+type mergeIterator struct {
+	sources []*mergeSource // 所有输入文件，第一次调用Next时定位到各自的第一个key
+	heap    mergeHeap
+	started bool
+	err     error
+}
+
+// newMergeIterator 返回合并nodes(从旧到新)的迭代器，copy为true时复制每个条目，返回的条目可以保留
+func newMergeIterator(nodes []*sst.Node, copy bool) (*mergeIterator, error) {
+	m := &mergeIterator{heap: make(mergeHeap, 0, len(nodes))}
+	for order, node := range nodes {
+		it, err := node.Reader().GetReusingIterator()
+		if err != nil {
+			return nil, err
+		}
+		m.sources = append(m.sources, &mergeSource{it: it, order: order, copy: copy})
+	}
+	return m, nil
+}
+
+// Next 移动到下一个key，没有更多条目或出错时返回false
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for _, s := range m.sources {
+			s.ahead = s.it.Next()
+			m.push(s)
+		}
+		heap.Init(&m.heap)
+		return m.err == nil && len(m.heap) > 0
+	}
+	if len(m.heap) == 0 {
+		return false
+	}
+	top := heap.Pop(&m.heap).(*mergeSource)
+	for len(m.heap) > 0 && bytes.Equal(m.heap[0].cur.Key, top.cur.Key) {
+		older := heap.Pop(&m.heap).(*mergeSource)
+		if m.push(older) {
+			heap.Fix(&m.heap, len(m.heap)-1)
+		}
+	}
+	if m.push(top) {
+		heap.Fix(&m.heap, len(m.heap)-1)
+	}
+	return m.err == nil && len(m.heap) > 0
+}
+
+// push 前进s，还有条目时加入heap末尾并返回true，由调用方调整位置
+func (m *mergeIterator) push(s *mergeSource) bool {
+	if !s.advance() {
+		if err := s.it.Error(); err != nil && m.err == nil {
+			m.err = err
+		}
+		return false
+	}
+	m.heap = append(m.heap, s)
+	return true
+}
+
+// Entry 返回当前key的最新版本
+func (m *mergeIterator) Entry() kv.Entry {
+	return m.heap[0].cur
+}
+
+// Error 返回读取输入文件时的错误
+func (m *mergeIterator) Error() error {
+	return m.err
+}
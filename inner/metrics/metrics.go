@@ -0,0 +1,121 @@
+// Package metrics 将LsmTree的耗时分布导出为expvar变量和Prometheus文本格式，不包含HTTP服务
+package metrics
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aixiasang/lsm/inner"
+)
+
+// Source 提供运行统计，通常为*inner.LsmTree
+type Source interface {
+	Stats() inner.Stats
+}
+
+// Exporter 导出一个Source的耗时分布
+type Exporter struct {
+	name   string // expvar变量名，也是Prometheus指标名的前缀
+	source Source
+}
+
+// New 创建Exporter，name中不能用于Prometheus指标名的字符替换为'_'
+func New(name string, source Source) *Exporter {
+	return &Exporter{name: sanitize(name), source: source}
+}
+
+// sanitize 将name转换为合法的Prometheus指标名
+func sanitize(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			c = '_'
+		}
+		b.WriteRune(c)
+	}
+	if b.Len() == 0 {
+		return "lsm"
+	}
+	return b.String()
+}
+
+// OpSnapshot 一种操作的耗时分布，时间单位为纳秒
+type OpSnapshot struct {
+	Count   uint64            `json:"count"`
+	SumNs   int64             `json:"sum_ns"`
+	P50Ns   int64             `json:"p50_ns"`
+	P95Ns   int64             `json:"p95_ns"`
+	P99Ns   int64             `json:"p99_ns"`
+	Buckets map[string]uint64 `json:"buckets"` // key为区间上限(纳秒)，超出10s的区间为"+Inf"，只包含非空区间
+}
+
+// Snapshot 返回按操作名称索引的耗时分布
+func (e *Exporter) Snapshot() map[string]OpSnapshot {
+	stats := e.source.Stats()
+	ops := make(map[string]OpSnapshot)
+	for _, op := range inner.LatencyOps() {
+		hist := stats.Histogram(op)
+		snap := OpSnapshot{
+			Count:   hist.Count,
+			SumNs:   int64(hist.Sum),
+			P50Ns:   int64(hist.P50),
+			P95Ns:   int64(hist.P95),
+			P99Ns:   int64(hist.P99),
+			Buckets: make(map[string]uint64),
+		}
+		for _, bucket := range hist.Buckets {
+			if bucket.Count > 0 {
+				snap.Buckets[boundLabel(bucket.UpperBound, strconv.FormatInt(int64(bucket.UpperBound), 10))] = bucket.Count
+			}
+		}
+		ops[op.String()] = snap
+	}
+	return ops
+}
+
+// Publish 以name发布expvar变量，每次读取时重新计算。同一个name只能发布一次，重复发布时expvar会panic
+func (e *Exporter) Publish() {
+	expvar.Publish(e.name, expvar.Func(func() any { return e.Snapshot() }))
+}
+
+// WriteMetrics 以Prometheus文本格式写出耗时分布，指标名为<name>_op_duration_seconds，op标签为操作名称
+func (e *Exporter) WriteMetrics(w io.Writer) error {
+	stats := e.source.Stats()
+	metric := e.name + "_op_duration_seconds"
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# HELP %s Latency of LSM tree operations.\n", metric)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", metric)
+	for _, op := range inner.LatencyOps() {
+		hist := stats.Histogram(op)
+		// Prometheus的区间计数是累计的
+		var cumulative uint64
+		for _, bucket := range hist.Buckets {
+			cumulative += bucket.Count
+			le := boundLabel(bucket.UpperBound, formatSeconds(bucket.UpperBound))
+			fmt.Fprintf(bw, "%s_bucket{op=%q,le=%q} %d\n", metric, op.String(), le, cumulative)
+		}
+		fmt.Fprintf(bw, "%s_sum{op=%q} %s\n", metric, op.String(), formatSeconds(hist.Sum))
+		fmt.Fprintf(bw, "%s_count{op=%q} %d\n", metric, op.String(), hist.Count)
+	}
+	return bw.Flush()
+}
+
+// boundLabel 返回区间上限的标签，没有上限的最后一个区间为"+Inf"
+func boundLabel(bound time.Duration, label string) string {
+	if bound == 0 {
+		return "+Inf"
+	}
+	return label
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner"
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+func newTree(t *testing.T) *inner.LsmTree {
+	t.Helper()
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	tree, err := inner.NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Put([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tree.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestWriteMetrics(t *testing.T) {
+	tree := newTree(t)
+	var buf bytes.Buffer
+	if err := New("my-db", tree).WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE my_db_op_duration_seconds histogram\n",
+		`my_db_op_duration_seconds_bucket{op="put",le="+Inf"} 2` + "\n",
+		`my_db_op_duration_seconds_count{op="put"} 2` + "\n",
+		`my_db_op_duration_seconds_bucket{op="get",le="+Inf"} 1` + "\n",
+		`my_db_op_duration_seconds_bucket{op="get",le="1e-06"} `,
+		`my_db_op_duration_seconds_bucket{op="get",le="10"} 1` + "\n",
+		`my_db_op_duration_seconds_count{op="compaction"} 0` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	// 区间计数是累计的
+	var last uint64
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, `my_db_op_duration_seconds_bucket{op="put"`) {
+			continue
+		}
+		count, err := strconv.ParseUint(line[strings.LastIndexByte(line, ' ')+1:], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count < last {
+			t.Fatalf("bucket counts decrease at %s", line)
+		}
+		last = count
+	}
+}
+
+func TestPublish(t *testing.T) {
+	tree := newTree(t)
+	New("lsm_metrics_test", tree).Publish()
+	v := expvar.Get("lsm_metrics_test")
+	if v == nil {
+		t.Fatal("not published")
+	}
+	var ops map[string]OpSnapshot
+	if err := json.Unmarshal([]byte(v.String()), &ops); err != nil {
+		t.Fatal(err)
+	}
+	if put := ops["put"]; put.Count != 2 || put.P99Ns <= 0 || len(put.Buckets) == 0 {
+		t.Fatalf("put %+v", put)
+	}
+	if _, ok := ops["scan_next"]; !ok {
+		t.Fatalf("missing scan_next in %v", ops)
+	}
+
+	// 每次读取时重新计算
+	tree.ResetLatencyHistograms()
+	if err := json.Unmarshal([]byte(v.String()), &ops); err != nil {
+		t.Fatal(err)
+	}
+	if ops["put"].Count != 0 {
+		t.Fatalf("put after reset %+v", ops["put"])
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for name, want := range map[string]string{"lsm": "lsm", "my-db.1": "my_db_1", "1db": "_db", "": "lsm"} {
+		if got := sanitize(name); got != want {
+			t.Errorf("sanitize(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
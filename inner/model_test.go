@@ -0,0 +1,265 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// modelSeedEnv 设置时只运行该种子的模型测试，用于重现失败
+const modelSeedEnv = "LSM_MODEL_SEED"
+
+// modelOpKind 模型测试中的操作类型
+type modelOpKind int
+
+const (
+	modelPut modelOpKind = iota
+	modelDelete
+	modelGet
+	modelScan
+	modelFlush
+	modelCompact
+	modelReopen
+	modelCrash
+)
+
+var modelOpNames = [...]string{"put", "delete", "get", "scan", "flush", "compact", "reopen", "crash"}
+
+// modelOp 一个操作，key在Put、Delete和Get中使用，Scan时为扫描的前缀
+type modelOp struct {
+	kind  modelOpKind
+	key   string
+	value string
+}
+
+func (op modelOp) String() string {
+	switch op.kind {
+	case modelPut:
+		return fmt.Sprintf("put(%s=%s)", op.key, op.value)
+	case modelDelete, modelGet:
+		return fmt.Sprintf("%s(%s)", modelOpNames[op.kind], op.key)
+	case modelScan:
+		return fmt.Sprintf("scan(%q)", op.key)
+	}
+	return modelOpNames[op.kind]
+}
+
+// randomModelOps 生成n个随机操作，key只有几十个取值，写入、删除和读取频繁落在同一个key上
+func randomModelOps(rng *rand.Rand, n int) []modelOp {
+	ops := make([]modelOp, n)
+	for i := range ops {
+		key := fmt.Sprintf("k%02d", rng.Intn(40))
+		switch r := rng.Intn(100); {
+		case r < 45:
+			// 偶尔写入较长的value，使内存表更快写满并轮转
+			value := fmt.Sprintf("v%d", i)
+			if rng.Intn(10) == 0 {
+				value += strings.Repeat("x", rng.Intn(200))
+			}
+			ops[i] = modelOp{kind: modelPut, key: key, value: value}
+		case r < 60:
+			ops[i] = modelOp{kind: modelDelete, key: key}
+		case r < 80:
+			ops[i] = modelOp{kind: modelGet, key: key}
+		case r < 88:
+			// 前缀为空、一位或完整的key
+			ops[i] = modelOp{kind: modelScan, key: key[:rng.Intn(len(key)+1)]}
+		case r < 93:
+			ops[i] = modelOp{kind: modelFlush}
+		case r < 96:
+			ops[i] = modelOp{kind: modelCompact}
+		case r < 98:
+			ops[i] = modelOp{kind: modelReopen}
+		default:
+			ops[i] = modelOp{kind: modelCrash}
+		}
+	}
+	return ops
+}
+
+// modelConfig 返回WAL很小、按层级压缩并拆分输出文件的配置，少量操作即可覆盖轮转、刷盘和压缩
+func modelConfig(dir string, syncs *dirSyncs) *config.Config {
+	conf := config.DefaultConfig()
+	conf.DataDir = dir
+	conf.IsDebug = false
+	conf.WalSize = 512
+	conf.LevelSize = 3
+	conf.MaxFilesPerLevel = []int{3, 3}
+	conf.CompactionFileSize = 256
+	conf.Hooks = &config.TestHooks{DirSynced: syncs.record}
+	return conf
+}
+
+// modelRun 在同一个数据目录上依次执行的操作和参照模型
+type modelRun struct {
+	t     *testing.T
+	dir   string
+	syncs *dirSyncs
+	tree  *LsmTree
+	model map[string]string
+}
+
+// runModel 在新目录中对LsmTree和map依次执行ops，返回第一个结果不一致或失败的操作的下标和原因，全部一致时返回-1
+func runModel(t *testing.T, ops []modelOp) (int, error) {
+	dir, err := os.MkdirTemp(t.TempDir(), "model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &modelRun{t: t, dir: dir, syncs: newDirSyncs(t, dir), model: make(map[string]string)}
+	if r.tree, err = NewLsmTree(modelConfig(dir, r.syncs)); err != nil {
+		return 0, err
+	}
+	defer func() { r.tree.Close() }()
+	for i, op := range ops {
+		if err := r.apply(op); err != nil {
+			return i, err
+		}
+	}
+	// 最后重新打开一次，确认所有写入都已持久化
+	if err := r.apply(modelOp{kind: modelReopen}); err != nil {
+		return len(ops), err
+	}
+	if err := r.apply(modelOp{kind: modelScan}); err != nil {
+		return len(ops), err
+	}
+	return -1, nil
+}
+
+// apply 执行一个操作，读取操作的结果与模型不一致时返回错误
+func (r *modelRun) apply(op modelOp) error {
+	switch op.kind {
+	case modelPut:
+		r.model[op.key] = op.value
+		return r.tree.Put([]byte(op.key), []byte(op.value))
+	case modelDelete:
+		delete(r.model, op.key)
+		return r.tree.Delete([]byte(op.key))
+	case modelGet:
+		value, err := r.tree.Get([]byte(op.key))
+		want, ok := r.model[op.key]
+		if !ok {
+			if !errors.Is(err, ErrKeyNotFound) {
+				return fmt.Errorf("got %q, %v, want ErrKeyNotFound", value, err)
+			}
+			return nil
+		}
+		if err != nil || string(value) != want {
+			return fmt.Errorf("got %q, %v, want %q", value, err, want)
+		}
+		return nil
+	case modelScan:
+		var got, want []string
+		if err := r.tree.PrefixScan([]byte(op.key), func(key, value []byte) bool {
+			got = append(got, fmt.Sprintf("%s=%s", key, value))
+			return true
+		}); err != nil {
+			return err
+		}
+		for _, key := range slices.Sorted(maps.Keys(r.model)) {
+			if strings.HasPrefix(key, op.key) {
+				want = append(want, fmt.Sprintf("%s=%s", key, r.model[key]))
+			}
+		}
+		if !slices.Equal(got, want) {
+			return fmt.Errorf("got %v, want %v", got, want)
+		}
+		return nil
+	case modelFlush:
+		r.tree.mu.Lock()
+		err := r.tree.rotateWal(RotationManual)
+		r.tree.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return r.tree.flushPending(math.MaxUint32)
+	case modelCompact:
+		return r.tree.Vacuum(context.Background())
+	case modelReopen:
+		if err := r.tree.Close(); err != nil {
+			return err
+		}
+		var err error
+		r.tree, err = NewLsmTree(modelConfig(r.dir, r.syncs))
+		return err
+	case modelCrash:
+		// 持有写锁时没有写入和清单修改，复制的是断电时已持久化的目录项，后台的刷盘和压缩可能执行到一半
+		snapshot, err := os.MkdirTemp(r.t.TempDir(), "crash")
+		if err != nil {
+			return err
+		}
+		r.tree.mu.Lock()
+		r.syncs.copyDurable(r.dir, snapshot)
+		r.tree.mu.Unlock()
+		r.tree.Close()
+		r.dir, r.syncs = snapshot, newDirSyncs(r.t, snapshot)
+		r.tree, err = NewLsmTree(modelConfig(r.dir, r.syncs))
+		return err
+	}
+	return fmt.Errorf("unknown op %d", op.kind)
+}
+
+// shrinkModelOps 反复去掉ops中的连续片段，片段长度从一半减到1，只要剩余的操作仍然失败就保留去掉后的结果，
+// 返回仍然失败的较短操作序列
+func shrinkModelOps(t *testing.T, ops []modelOp) []modelOp {
+	for size := len(ops) / 2; size >= 1; size /= 2 {
+		for start := 0; start+size <= len(ops); {
+			candidate := slices.Concat(ops[:start], ops[start+size:])
+			if i, _ := runModel(t, candidate); i >= 0 {
+				ops = candidate
+				continue
+			}
+			start += size
+		}
+	}
+	return ops
+}
+
+// TestLsmTree_Model 以随机的操作序列比较LsmTree和map的结果，覆盖轮转、刷盘、压缩、重新打开和断电之间的交互。
+// 失败时输出种子和缩减后的操作序列，设置LSM_MODEL_SEED可以只重现该种子
+func TestLsmTree_Model(t *testing.T) {
+	seeds := []int64{1, 2, 3, 4, 5, 6}
+	if env := os.Getenv(modelSeedEnv); env != "" {
+		seed, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			t.Fatalf("%s=%q: %v", modelSeedEnv, env, err)
+		}
+		seeds = []int64{seed}
+	}
+	n := 600
+	if testing.Short() {
+		n = 150
+	}
+	for _, seed := range seeds {
+		ops := randomModelOps(rand.New(rand.NewSource(seed)), n)
+		i, err := runModel(t, ops)
+		if i < 0 {
+			continue
+		}
+		if i < len(ops) {
+			t.Errorf("seed %d: op %d %v: %v", seed, i, ops[i], err)
+		} else {
+			t.Errorf("seed %d: after all ops: %v", seed, err)
+		}
+		shrunk := shrinkModelOps(t, ops[:min(i+1, len(ops))])
+		t.Fatalf("seed %d (rerun with %s=%d) fails with %d ops:\n%s",
+			seed, modelSeedEnv, seed, len(shrunk), modelOpsString(shrunk))
+	}
+}
+
+func modelOpsString(ops []modelOp) string {
+	var buf strings.Builder
+	for _, op := range ops {
+		fmt.Fprintf(&buf, "  %v\n", op)
+	}
+	return buf.String()
+}
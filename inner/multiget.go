@@ -0,0 +1,110 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// MultiGet 批量获取多个key的值，返回结果与keys的原始顺序一一对应
+// 每个key单独返回错误，不存在的key用errors.Is(err, ErrKeyNotFound)判断，单个key失败不会影响整个批次
+// keys会先排序去重，先由内存表解析，剩余的key再按SST节点批量查找，
+// 同一数据块内的key只会读取该数据块一次
+func (t *LsmTree) MultiGet(keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	if err := t.beginRead(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return values, errs
+	}
+	defer t.mu.RUnlock()
+
+	// 按key排序，相同的key合并，positions记录每个key在原始输入中的位置
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return bytes.Compare(keys[order[a]], keys[order[b]]) < 0
+	})
+	unique := make([][]byte, 0, len(keys))
+	positions := make([][]int, 0, len(keys))
+	for _, i := range order {
+		if n := len(unique); n > 0 && bytes.Equal(unique[n-1], keys[i]) && (unique[n-1] == nil) == (keys[i] == nil) {
+			positions[n-1] = append(positions[n-1], i)
+			continue
+		}
+		unique = append(unique, keys[i])
+		positions = append(positions, []int{i})
+	}
+
+	uniqueValues := make([][]byte, len(unique))
+	uniqueErrs := make([]error, len(unique))
+
+	// 先从内存表中查找，pending记录仍需查找SST的key
+	pending := make([]int, 0, len(unique))
+	for i, key := range unique {
+		if err := checkUserKey(key); err != nil {
+			uniqueErrs[i] = err
+			continue
+		}
+		value, _, found, err := t.getFromMemTables(key, &readInfo{})
+		if found {
+			uniqueValues[i], uniqueErrs[i] = value, err
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	// 按层级从新到旧查找SST节点，每个节点一次处理所有剩余的key
+	for level := range t.nodes {
+		nodeSlice := t.nodes[level]
+		for n := len(nodeSlice) - 1; n >= 0 && len(pending) > 0; n-- {
+			batch := make([][]byte, len(pending))
+			for j, i := range pending {
+				batch[j] = unique[i]
+			}
+			nodeValues, nodeErrs := nodeSlice[n].MultiGet(batch)
+			remain := pending[:0]
+			for j, i := range pending {
+				switch err := nodeErrs[j]; {
+				case err == nil:
+					if err := t.unavailableKey(unique[i], level, uint32(nodeSlice[n].GetSeq())); err != nil {
+						uniqueErrs[i] = err
+					} else if nodeValues[j] == nil {
+						uniqueErrs[i] = myerror.ErrValueNil
+					} else {
+						uniqueValues[i] = nodeValues[j]
+					}
+				case errors.Is(err, myerror.ErrKeyNotFound):
+					remain = append(remain, i)
+				default:
+					uniqueErrs[i] = err
+				}
+			}
+			pending = remain
+		}
+	}
+	for _, i := range pending {
+		uniqueErrs[i] = myerror.ErrKeyNotFound
+		if err := t.unavailableKey(unique[i], len(t.nodes), 0); err != nil {
+			uniqueErrs[i] = err
+		}
+	}
+
+	// 按原始顺序填充结果，重复的key各自持有一份value的副本，修改其中一个不影响其他位置
+	for i, pos := range positions {
+		for j, p := range pos {
+			values[p] = uniqueValues[i]
+			if j > 0 {
+				values[p] = bytes.Clone(uniqueValues[i])
+			}
+			errs[p] = uniqueErrs[i]
+		}
+	}
+	return values, errs
+}
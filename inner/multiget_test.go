@@ -0,0 +1,210 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// writeLevelSST 在指定层级写入一个SST文件，kvs会按key排序后写入
+func writeLevelSST(tb testing.TB, conf *config.Config, level int, seq uint32, kvs map[string]string) {
+	tb.Helper()
+	dir := filepath.Join(conf.DataDir, conf.SSTDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	writer, err := sst.NewSSTWriter(conf, filepath.Join(dir, fmt.Sprintf("%d_%d.sst", level, seq)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, k := range keys {
+		if err := writer.Add([]byte(k), []byte(kvs[k])); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// writeLevelEntries 与writeLevelSST相同，按顺序写入entries，可以包含删除标记
+func writeLevelEntries(tb testing.TB, conf *config.Config, level int, seq uint32, entries []kv.Entry) {
+	tb.Helper()
+	dir := filepath.Join(conf.DataDir, conf.SSTDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		tb.Fatal(err)
+	}
+	writer, err := sst.NewSSTWriter(conf, filepath.Join(dir, fmt.Sprintf("%d_%d.sst", level, seq)))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := writer.AddEntry(entry); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// newMultiLevelTree 构造一个包含多层SST文件的LSM树，每层覆盖一部分key
+func newMultiLevelTree(tb testing.TB, levels, keysPerLevel int) (*LsmTree, map[string]string) {
+	tb.Helper()
+	conf := config.DefaultConfig()
+	conf.DataDir = tb.TempDir()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 16
+	conf.LevelSize = levels
+
+	expected := make(map[string]string)
+	// 层级越小数据越新，同一个key在较小层级中的值应当覆盖较大层级中的值
+	for level := levels - 1; level >= 0; level-- {
+		kvs := make(map[string]string)
+		for i := level * keysPerLevel / 2; i < level*keysPerLevel/2+keysPerLevel; i++ {
+			key := fmt.Sprintf("key-%06d", i)
+			kvs[key] = fmt.Sprintf("value-%d-%d", level, i)
+			expected[key] = kvs[key]
+		}
+		writeLevelSST(tb, conf, level, 0, kvs)
+	}
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return tree, expected
+}
+
+func TestLsmTree_MultiGet(t *testing.T) {
+	tree, expected := newMultiLevelTree(t, 3, 200)
+	defer tree.Close()
+
+	// 内存表中的值覆盖SST中的值
+	if err := tree.Put([]byte("key-000010"), []byte("memtable")); err != nil {
+		t.Fatal(err)
+	}
+	expected["key-000010"] = "memtable"
+
+	keys := [][]byte{
+		[]byte("key-000350"),
+		[]byte("missing"),
+		[]byte("key-000010"),
+		[]byte("key-000150"),
+		[]byte("key-000350"), // 重复的key
+		[]byte("key-000000"),
+		[]byte("key-000399"),
+	}
+	values, errs := tree.MultiGet(keys)
+	if len(values) != len(keys) || len(errs) != len(keys) {
+		t.Fatalf("result length mismatch: values=%d errs=%d", len(values), len(errs))
+	}
+	for i, key := range keys {
+		want, ok := expected[string(key)]
+		if !ok {
+			if errs[i] != myerror.ErrKeyNotFound {
+				t.Errorf("key %s: expected ErrKeyNotFound, got %v", key, errs[i])
+			}
+			continue
+		}
+		if errs[i] != nil {
+			t.Errorf("key %s: unexpected error %v", key, errs[i])
+			continue
+		}
+		if !bytes.Equal(values[i], []byte(want)) {
+			t.Errorf("key %s: expected %s, got %s", key, want, values[i])
+		}
+		// MultiGet的结果必须与Get一致
+		value, err := tree.Get(key)
+		if err != nil || !bytes.Equal(value, values[i]) {
+			t.Errorf("key %s: MultiGet=%s Get=%s err=%v", key, values[i], value, err)
+		}
+	}
+}
+
+func TestLsmTree_MultiGetAllKeys(t *testing.T) {
+	tree, expected := newMultiLevelTree(t, 3, 100)
+	defer tree.Close()
+
+	keys := make([][]byte, 0, len(expected))
+	for k := range expected {
+		keys = append(keys, []byte(k))
+	}
+	values, errs := tree.MultiGet(keys)
+	for i, key := range keys {
+		if errs[i] != nil {
+			t.Fatalf("key %s: unexpected error %v", key, errs[i])
+		}
+		if string(values[i]) != expected[string(key)] {
+			t.Fatalf("key %s: expected %s, got %s", key, expected[string(key)], values[i])
+		}
+	}
+
+	values, errs = tree.MultiGet(nil)
+	if len(values) != 0 || len(errs) != 0 {
+		t.Fatalf("expected empty result for empty input")
+	}
+}
+
+func BenchmarkLsmTree_Get1000(b *testing.B) {
+	tree, expected := newMultiLevelTree(b, 4, 1000)
+	defer tree.Close()
+	keys := benchmarkKeys(expected, 1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			if _, err := tree.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLsmTree_MultiGet1000(b *testing.B) {
+	tree, expected := newMultiLevelTree(b, 4, 1000)
+	defer tree.Close()
+	keys := benchmarkKeys(expected, 1000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, errs := tree.MultiGet(keys)
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchmarkKeys 从已写入的数据中选取n个key
+func benchmarkKeys(expected map[string]string, n int) [][]byte {
+	keys := make([][]byte, 0, n)
+	for k := range expected {
+		if len(keys) == n {
+			break
+		}
+		keys = append(keys, []byte(k))
+	}
+	return keys
+}
@@ -1,18 +1,54 @@
 package myerror
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"os"
+)
 
 var (
-	ErrKeyNotFound      = errors.New("key not found")
-	ErrValueNil         = errors.New("value has been deleted")
+	ErrKeyNotFound = errors.New("key not found")
+	// ErrValueNil key在SST中是删除标记，errors.Is(err, ErrKeyNotFound)同样成立
+	ErrValueNil = fmt.Errorf("value has been deleted: %w", ErrKeyNotFound)
+
 	ErrKeyNil           = errors.New("key is nil")
+	ErrEmptyKey         = errors.New("key is empty")
 	ErrInvalidSSTFormat = errors.New("invalid SST format")
+	ErrDBClosed         = errors.New("db is closed")
+	ErrTxnConflict      = errors.New("transaction conflict")
+	ErrTxnDone          = errors.New("transaction has been committed or rolled back")
+	ErrValueTooLarge    = errors.New("entry too large")
+	ErrBlockCacheFull   = errors.New("block cache is full")
+	ErrDirLocked        = errors.New("directory is locked by another instance")
+	ErrNamespaceDropped = errors.New("namespace has been dropped")
+	ErrReservedKey      = errors.New("key uses a reserved internal prefix")
+	ErrCodec            = errors.New("codec error")
+	ErrKeyOutOfOrder    = errors.New("key out of order")
+	ErrWritesPaused     = errors.New("writes paused after background error")
+	ErrSeqNotTracked    = errors.New("sequences are not tracked")
+	ErrChangeStream     = errors.New("invalid change stream")
+	ErrLevelOverlap     = errors.New("sst key ranges overlap within level")
+	ErrInvalidConfig    = errors.New("invalid config")
+	// ErrWalRotation 写入已经完成，但之后切换到新的内存表和WAL失败，树仍使用原来的内存表和WAL
+	ErrWalRotation = errors.New("wal rotation failed")
+	// ErrWouldBlock 只查找内存表时没有得到结果，但key可能存在于未读取的SST文件中
+	ErrWouldBlock = errors.New("key may exist in sst files that were not read")
+	// ErrRangeUnavailable key所在的范围属于启动时被隔离的SST文件，无法确定其最新版本
+	ErrRangeUnavailable = errors.New("key range unavailable")
+	// ErrNotRetained 没有保留所需的删除前的版本，或保留期已过
+	ErrNotRetained = errors.New("deleted value not retained")
+	// ErrReaderClosed SST读取器已关闭，errors.Is(err, os.ErrClosed)同样成立
+	ErrReaderClosed = fmt.Errorf("sst reader closed: %w", os.ErrClosed)
+	// ErrTooManyIterators 进行中的遍历数已达到MaxOpenIterators
+	ErrTooManyIterators = errors.New("too many open iterators")
 
 	ErrWalCorrupted = errors.New("wal corrupted")
 	ErrSSTCorrupted = errors.New("sst corrupted")
 
 	ErrInvalidBloomFilter    = errors.New("invalid bloom filter")
 	ErrBloomFilterIncomplete = errors.New("unexpected end of data, bloom filter data incomplete")
+	ErrInvalidCuckooFilter   = errors.New("invalid cuckoo filter")
+	ErrUnknownFilter         = errors.New("unknown filter")
 
 	ErrEncodeRecordType     = errors.New("failed to write record type")
 	ErrEncodeKeyLength      = errors.New("failed to write key length")
@@ -28,6 +64,13 @@ var (
 	ErrDecodeCrc            = errors.New("failed to read crc")
 	ErrRecordDataIncomplete = errors.New("record data incomplete")
 	ErrCrcMismatch          = errors.New("crc mismatch")
+	ErrUnknownEntryKind     = errors.New("unknown entry kind")
+
+	ErrEntryHeaderTruncated   = errors.New("sst entry header truncated")
+	ErrEntryKeyTruncated      = errors.New("sst entry key truncated")
+	ErrEntryValueTruncated    = errors.New("sst entry value truncated")
+	ErrEntryChecksumTruncated = errors.New("sst entry checksum truncated")
 
 	ErrSSTReaderFilter = errors.New("invalid filter length")
+	ErrInvalidIndex    = errors.New("invalid index entry")
 )
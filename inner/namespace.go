@@ -0,0 +1,300 @@
+package inner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/utils"
+)
+
+const (
+	namespaceCatalogFile = "NAMESPACES" // 命名空间目录文件，位于DataDir下
+	namespaceMarker      = "\x00ns"     // 命名空间key的保留前缀，后接4字节大端的命名空间id
+	namespaceDropBatch   = 1024         // 删除命名空间时每条批量删除记录中的key数
+)
+
+// namespaceCatalog 持久化的命名空间名称到id的映射
+// id从1开始单调递增且不会复用，删除后重新创建的同名命名空间会分配新的id，旧数据不会再被看到
+type namespaceCatalog struct {
+	mu       sync.Mutex
+	path     string
+	NextID   uint32            `json:"next_id"`            // 下一个分配的id
+	IDs      map[string]uint32 `json:"namespaces"`         // 名称到id的映射
+	Dropping []uint32          `json:"dropping,omitempty"` // 已删除但数据尚未清理完的id
+}
+
+// loadNamespaceCatalog 读取命名空间目录，文件不存在时返回空目录
+func loadNamespaceCatalog(path string) (*namespaceCatalog, error) {
+	catalog := &namespaceCatalog{path: path, NextID: 1, IDs: make(map[string]uint32)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, catalog); err != nil {
+		return nil, fmt.Errorf("namespace catalog %s: %w", path, err)
+	}
+	if catalog.IDs == nil {
+		catalog.IDs = make(map[string]uint32)
+	}
+	return catalog, nil
+}
+
+// save 原子地写入目录文件，调用方需持有c.mu
+func (c *namespaceCatalog) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(c.path, data)
+}
+
+// lookup 返回名称对应的id，不存在时分配新的id并持久化
+func (c *namespaceCatalog) lookup(name string) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if id, ok := c.IDs[name]; ok {
+		return id, nil
+	}
+	if c.NextID == 0 {
+		return 0, fmt.Errorf("namespace ids exhausted")
+	}
+	id := c.NextID
+	c.IDs[name] = id
+	if id == math.MaxUint32 {
+		c.NextID = 0
+	} else {
+		c.NextID++
+	}
+	if err := c.save(); err != nil {
+		delete(c.IDs, name)
+		c.NextID = id
+		return 0, err
+	}
+	return id, nil
+}
+
+// current 判断id是否仍是name当前的id
+func (c *namespaceCatalog) current(name string, id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.IDs[name] == id
+}
+
+// drop 从目录中移除命名空间并将其id加入待清理列表，返回被移除的id
+func (c *namespaceCatalog) drop(name string) (uint32, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.IDs[name]
+	if !ok {
+		return 0, false, nil
+	}
+	delete(c.IDs, name)
+	c.Dropping = append(c.Dropping, id)
+	if err := c.save(); err != nil {
+		c.IDs[name] = id
+		c.Dropping = c.Dropping[:len(c.Dropping)-1]
+		return 0, false, err
+	}
+	return id, true, nil
+}
+
+// dropping 返回待清理的id
+func (c *namespaceCatalog) dropping() []uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]uint32(nil), c.Dropping...)
+}
+
+// cleared 将数据已清理完的id移出待清理列表
+func (c *namespaceCatalog) cleared(id uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.Index(c.Dropping, id)
+	if i < 0 {
+		return nil
+	}
+	c.Dropping = slices.Delete(c.Dropping, i, i+1)
+	if err := c.save(); err != nil {
+		c.Dropping = slices.Insert(c.Dropping, i, id)
+		return err
+	}
+	return nil
+}
+
+// namespacePrefix 返回命名空间id对应的key前缀，id为定长编码，不同命名空间的前缀互不为前缀
+func namespacePrefix(id uint32) []byte {
+	prefix := make([]byte, len(namespaceMarker)+4)
+	copy(prefix, namespaceMarker)
+	binary.BigEndian.PutUint32(prefix[len(namespaceMarker):], id)
+	return prefix
+}
+
+// Namespace 共享WAL、内存表和SST层级的逻辑命名空间，key在内部加上命名空间前缀存储
+type Namespace struct {
+	tree   *LsmTree
+	name   string
+	id     uint32
+	prefix []byte
+	err    error // 创建命名空间时的错误，所有操作都会返回该错误
+}
+
+// Namespace 返回名为name的命名空间，不存在时创建，命名空间id在重启后保持不变
+func (t *LsmTree) Namespace(name string) *Namespace {
+	ns := &Namespace{tree: t, name: name}
+	if t.closed.Load() {
+		ns.err = myerror.ErrDBClosed
+		return ns
+	}
+	ns.id, ns.err = t.namespaces.lookup(name)
+	ns.prefix = namespacePrefix(ns.id)
+	return ns
+}
+
+// DropNamespace 删除命名空间：从目录中移除使其id失效，再为其中所有key写入删除标记以便回收空间。
+// 删除标记每namespaceDropBatch个key写入一条批量删除记录，内存和WAL记录的大小不随命名空间中的key数增长；
+// 开启TombstoneRetention时也不保留删除前的值。清理完成前id记录在目录的待清理列表中，中途出错时返回错误，
+// 之后再次调用DropNamespace(名称不存在也可以)会继续清理之前未完成的命名空间
+func (t *LsmTree) DropNamespace(name string) error {
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+	if _, _, err := t.namespaces.drop(name); err != nil {
+		return err
+	}
+	ids := t.namespaces.dropping()
+	if len(ids) == 0 {
+		return nil
+	}
+	// 删除标记已使各个key的行缓存失效，命名空间中的key通常很多，整体清空以释放缓存空间
+	defer t.rowCache.clear()
+	for _, id := range ids {
+		if err := t.clearNamespace(id); err != nil {
+			return fmt.Errorf("drop namespace %d: %w", id, err)
+		}
+		if err := t.namespaces.cleared(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearNamespace 为id下的所有key分批写入删除标记，直到遍历不到任何key。
+// id已从目录中移除，不会再有新的写入，移除前进行中的写入由之后的遍历删除
+func (t *LsmTree) clearNamespace(id uint32) error {
+	rng := keyutil.PrefixRange(namespacePrefix(id))
+	for {
+		var batch [][]byte
+		var deleted int
+		var writeErr error
+		// 遍历在回调之前已释放读锁，回调中可以写入；批量删除记录引用batch中的key，每批使用新的切片
+		flush := func() bool {
+			commit, err := t.applyDeleteBatch(batch)
+			if err == nil {
+				err = commit.Wait()
+			}
+			deleted += len(batch)
+			batch, writeErr = nil, err
+			return err == nil
+		}
+		err := t.scanRange(rng, func(key, _ []byte) bool {
+			batch = append(batch, key)
+			return len(batch) < namespaceDropBatch || flush()
+		})
+		if err == nil && writeErr == nil && len(batch) > 0 {
+			flush()
+		}
+		if err != nil {
+			return err
+		}
+		if writeErr != nil || deleted == 0 {
+			return writeErr
+		}
+	}
+}
+
+// Name 返回命名空间名称
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// check 校验命名空间可用
+func (ns *Namespace) check() error {
+	if ns.err != nil {
+		return ns.err
+	}
+	if !ns.tree.namespaces.current(ns.name, ns.id) {
+		return myerror.ErrNamespaceDropped
+	}
+	return nil
+}
+
+func (ns *Namespace) key(key []byte) []byte {
+	return append(append(make([]byte, 0, len(ns.prefix)+len(key)), ns.prefix...), key...)
+}
+
+func (ns *Namespace) Get(key []byte) ([]byte, error) {
+	if err := ns.check(); err != nil {
+		return nil, err
+	}
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	return ns.tree.read(ns.key(key), config.DefaultReadOptions())
+}
+
+func (ns *Namespace) Put(key, value []byte) error {
+	if err := ns.check(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return ns.tree.put(ns.key(key), value)
+}
+
+func (ns *Namespace) Delete(key []byte) error {
+	if err := ns.check(); err != nil {
+		return err
+	}
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return ns.tree.delete(ns.key(key))
+}
+
+// Scan 按key顺序遍历命名空间中以prefix开头的键值对，回调中的key不包含命名空间前缀
+func (ns *Namespace) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	if err := ns.check(); err != nil {
+		return err
+	}
+	release, err := ns.tree.trackIterator()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return ns.tree.scanRange(keyutil.PrefixRange(ns.key(prefix)), func(key, value []byte) bool {
+		// 前缀范围已保证key以命名空间前缀开头，这里再次校验防止越界
+		if !bytes.HasPrefix(key, ns.prefix) {
+			return false
+		}
+		return fn(key[len(ns.prefix):], value)
+	})
+}
+
+// namespaceCatalogPath 返回命名空间目录文件路径
+func namespaceCatalogPath(dataDir string) string {
+	return filepath.Join(dataDir, namespaceCatalogFile)
+}
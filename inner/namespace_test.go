@@ -0,0 +1,285 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// scanNamespace 返回命名空间中的全部键值对
+func scanNamespace(t *testing.T, ns *Namespace) map[string]string {
+	t.Helper()
+	got := make(map[string]string)
+	if err := ns.Scan(nil, func(key, value []byte) bool {
+		got[string(key)] = string(value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestNamespace_IsolationAndRestart(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, orders := tree.Namespace("users"), tree.Namespace("orders")
+	for _, kv := range [][3]string{{"k1", "u1", "o1"}, {"k2", "u2", "o2"}} {
+		if err := users.Put([]byte(kv[0]), []byte(kv[1])); err != nil {
+			t.Fatal(err)
+		}
+		if err := orders.Put([]byte(kv[0]), []byte(kv[2])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Put([]byte("k1"), []byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	if err := orders.Delete([]byte("k2")); err != nil {
+		t.Fatal(err)
+	}
+	usersID := users.id
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	users, orders = tree.Namespace("users"), tree.Namespace("orders")
+	if users.id != usersID {
+		t.Fatalf("namespace id changed across restart: %d -> %d", usersID, users.id)
+	}
+	if value, err := users.Get([]byte("k1")); err != nil || string(value) != "u1" {
+		t.Fatalf("users k1 = %q, %v", value, err)
+	}
+	if value, err := orders.Get([]byte("k1")); err != nil || string(value) != "o1" {
+		t.Fatalf("orders k1 = %q, %v", value, err)
+	}
+	if value, err := tree.Get([]byte("k1")); err != nil || string(value) != "raw" {
+		t.Fatalf("raw k1 = %q, %v", value, err)
+	}
+	if got := scanNamespace(t, users); len(got) != 2 || got["k1"] != "u1" || got["k2"] != "u2" {
+		t.Fatalf("users scan = %v", got)
+	}
+	if got := scanNamespace(t, orders); len(got) != 1 || got["k1"] != "o1" {
+		t.Fatalf("orders scan = %v", got)
+	}
+}
+
+func TestNamespace_MaxIDScanBoundary(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	tree.namespaces.NextID = math.MaxUint32 - 1
+	below, last := tree.Namespace("below"), tree.Namespace("last")
+	if last.id != math.MaxUint32 {
+		t.Fatalf("expected max id, got %d", last.id)
+	}
+	if err := below.Put([]byte("a"), []byte("below")); err != nil {
+		t.Fatal(err)
+	}
+	if err := last.Put([]byte("a"), []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	// 紧跟在最大id前缀之后的原始key不能出现在命名空间的扫描结果中，保留前缀下的key只能在内部写入
+	if err := tree.put([]byte(namespaceMarker+"\xff\xff\xff\xff\xff"), []byte("same-prefix")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("\x00nt"), []byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	got := scanNamespace(t, last)
+	if len(got) != 2 || got["a"] != "last" || got["\xff"] != "same-prefix" {
+		t.Fatalf("last scan = %v", got)
+	}
+	if got := scanNamespace(t, below); len(got) != 1 || got["a"] != "below" {
+		t.Fatalf("below scan = %v", got)
+	}
+	if ns := tree.Namespace("overflow"); ns.err == nil {
+		t.Fatal("expected error when namespace ids are exhausted")
+	}
+}
+
+func TestNamespace_DropAndRecreate(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := tree.Namespace("tmp")
+	other := tree.Namespace("keep")
+	for _, key := range []string{"a", "b", "c"} {
+		if err := ns.Put([]byte(key), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Put([]byte("a"), []byte("kept")); err != nil {
+		t.Fatal(err)
+	}
+	oldID := ns.id
+	if err := tree.DropNamespace("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ns.Get([]byte("a")); !errors.Is(err, myerror.ErrNamespaceDropped) {
+		t.Fatalf("expected ErrNamespaceDropped from stale handle, got %v", err)
+	}
+	if err := tree.scanRange(keyutil.PrefixRange(namespacePrefix(oldID)), func(key, _ []byte) bool {
+		t.Fatalf("dropped key %q still visible", key)
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	recreated := tree.Namespace("tmp")
+	if recreated.id == oldID {
+		t.Fatal("recreated namespace reused the dropped id")
+	}
+	if got := scanNamespace(t, recreated); len(got) != 0 {
+		t.Fatalf("recreated namespace not empty: %v", got)
+	}
+	if err := recreated.Put([]byte("a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if got := scanNamespace(t, tree.Namespace("tmp")); len(got) != 1 || got["a"] != "new" {
+		t.Fatalf("recreated namespace after restart = %v", got)
+	}
+	if value, err := tree.Namespace("keep").Get([]byte("a")); err != nil || string(value) != "kept" {
+		t.Fatalf("keep a = %q, %v", value, err)
+	}
+}
+
+// 根命名空间的读写拒绝命名空间的保留前缀，遍历和Watch看不到命名空间中的key
+func TestNamespace_RootIsolation(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	changes, cancel := tree.Watch(nil, 16)
+	defer cancel()
+
+	users := tree.Namespace("users")
+	if err := users.Put([]byte("k"), []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("b"), []byte("root")); err != nil {
+		t.Fatal(err)
+	}
+	raw := users.key([]byte("k"))
+	if _, err := tree.Get(raw); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("Get(%q) = %v, want ErrReservedKey", raw, err)
+	}
+	if err := tree.Put(raw, []byte("overwrite")); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("Put(%q) = %v, want ErrReservedKey", raw, err)
+	}
+	if err := tree.Delete(raw); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("Delete(%q) = %v, want ErrReservedKey", raw, err)
+	}
+	if err := tree.DeleteBatch([][]byte{[]byte("b"), raw}); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("DeleteBatch = %v, want ErrReservedKey", err)
+	}
+	if _, errs := tree.MultiGet([][]byte{raw, []byte("b")}); !errors.Is(errs[0], myerror.ErrReservedKey) || errs[1] != nil {
+		t.Fatalf("MultiGet errors = %v, want ErrReservedKey and nil", errs)
+	}
+	txn := tree.BeginTxn()
+	if _, err := txn.Get(raw); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("txn.Get(%q) = %v, want ErrReservedKey", raw, err)
+	}
+	if err := txn.Put(raw, []byte("overwrite")); !errors.Is(err, myerror.ErrReservedKey) {
+		t.Fatalf("txn.Put(%q) = %v, want ErrReservedKey", raw, err)
+	}
+	txn.Rollback()
+
+	var keys []string
+	if err := tree.PrefixScan(nil, func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("root scan = %q, want only b", keys)
+	}
+	if value, err := users.Get([]byte("k")); err != nil || string(value) != "secret" {
+		t.Fatalf("users k = %q, %v", value, err)
+	}
+	if event := <-changes; string(event.Key) != "b" {
+		t.Fatalf("first root event key = %q, want b", event.Key)
+	}
+}
+
+// 删除命名空间分批写入删除标记；清理中断后id留在待清理列表中，重启后再次调用DropNamespace继续清理
+func TestNamespace_DropInBatchesAndResume(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big, stale := tree.Namespace("big"), tree.Namespace("stale")
+	n := 2*namespaceDropBatch + 5
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%05d", i))
+		if err := big.Put(key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := stale.Put(key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 模拟清理前中断：只从目录中移除
+	if _, _, err := tree.namespaces.drop("stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if got := tree.namespaces.dropping(); len(got) != 1 || got[0] != stale.id {
+		t.Fatalf("dropping = %v, want [%d]", got, stale.id)
+	}
+	before := tree.LastSequence()
+	if err := tree.DropNamespace("big"); err != nil {
+		t.Fatal(err)
+	}
+	// 每个命名空间写入三条批量删除记录：两批满的和剩余的5个key
+	if got := tree.LastSequence() - before; got != 6 {
+		t.Fatalf("DropNamespace committed %d writes, want 6 delete batches", got)
+	}
+	for _, id := range []uint32{big.id, stale.id} {
+		if err := tree.scanRange(keyutil.PrefixRange(namespacePrefix(id)), func(key, _ []byte) bool {
+			t.Fatalf("dropped key %q still visible", key)
+			return false
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := tree.namespaces.dropping(); len(got) != 0 {
+		t.Fatalf("dropping = %v after cleanup, want none", got)
+	}
+}
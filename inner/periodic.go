@@ -0,0 +1,344 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// sstTmpSuffix 刷盘和重写SST文件时临时文件的后缀，写完后重命名为正式文件名，打开时删除遗留的临时文件
+const sstTmpSuffix = ".rewrite"
+
+// PeriodicCompaction 一次定期压缩的结果
+type PeriodicCompaction struct {
+	Time              time.Time // 开始时间，零值表示尚未运行
+	FilesChecked      int       // 检查的SST文件数
+	FilesCompacted    int       // 重写或删除的SST文件数
+	BytesBefore       int64     // 被重写的文件重写前的总大小
+	BytesAfter        int64     // 被重写的文件重写后的总大小
+	TombstonesDropped int64     // 丢弃的删除标记数
+	Err               error     // 遇到的第一个错误，出错的文件保持不变
+}
+
+// periodicState 定期压缩的调度状态
+type periodicState struct {
+	mu   sync.Mutex
+	next time.Time          // 下一次运行的时间，未启用时为零值
+	last PeriodicCompaction // 最近一次运行的结果
+}
+
+// newPeriodicTimer 安排下一次定期压缩，未启用时返回nil
+func (t *LsmTree) newPeriodicTimer() config.Timer {
+	interval := t.conf.PeriodicCompactionInterval
+	if interval <= 0 {
+		return nil
+	}
+	t.periodic.mu.Lock()
+	t.periodic.next = t.conf.Now().Add(interval)
+	t.periodic.mu.Unlock()
+	return t.conf.GetClock().NewTimer(interval)
+}
+
+// timerC 返回定时器的通道，timer为nil时返回nil通道，select时永远不会就绪
+func timerC(timer config.Timer) <-chan time.Time {
+	if timer == nil {
+		return nil
+	}
+	return timer.C()
+}
+
+// periodicCandidate 需要重写的SST文件
+type periodicCandidate struct {
+	node  *sst.Node
+	force bool // 因文件过旧而重写，没有可丢弃的删除标记时也重写
+}
+
+// runPeriodicCompaction 检查所有SST文件，重写写入时间早于MaxFileAge或删除标记占比不低于
+// TombstoneCompactionRatio的文件。在压缩goroutine中执行，与后台刷盘串行，同一时刻每个文件最多只有一个重写任务
+func (t *LsmTree) runPeriodicCompaction() {
+	run := PeriodicCompaction{Time: t.conf.Now()}
+	var candidates []periodicCandidate
+	t.mu.RLock()
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			run.FilesChecked++
+			if candidate, ok := t.periodicCandidate(node, run.Time); ok {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	for _, candidate := range candidates {
+		if t.closed.Load() {
+			break
+		}
+		before := candidate.node.GetSize()
+		after, dropped, rewritten, err := t.rewriteNode(candidate.node, candidate.force)
+		if err != nil {
+			t.conf.Errorf("periodic compaction %s: %v", candidate.node.GetFilename(), err)
+			t.setBackgroundError(err)
+			if run.Err == nil {
+				run.Err = err
+			}
+			continue
+		}
+		if rewritten {
+			run.FilesCompacted++
+			run.BytesBefore += before
+			run.BytesAfter += after
+			run.TombstonesDropped += dropped
+		}
+	}
+
+	t.periodic.mu.Lock()
+	t.periodic.last = run
+	t.periodic.mu.Unlock()
+}
+
+// periodicCandidate 判断node是否需要重写，调用方需持有t.mu
+func (t *LsmTree) periodicCandidate(node *sst.Node, now time.Time) (periodicCandidate, bool) {
+	props := node.Reader().Properties()
+	if maxAge := t.conf.MaxFileAge; maxAge > 0 {
+		created := time.Unix(0, props.CreatedAt)
+		if props.CreatedAt == 0 {
+			// 没有写入时间的旧文件按修改时间计算
+			stat, err := os.Stat(node.GetFilename())
+			if err != nil {
+				return periodicCandidate{}, false
+			}
+			created = stat.ModTime()
+		}
+		if now.Sub(created) >= maxAge {
+			return periodicCandidate{node: node, force: true}, true
+		}
+	}
+	if ratio := t.conf.TombstoneCompactionRatio; ratio > 0 && props.Entries > 0 {
+		if float64(props.Tombstones)/float64(props.Entries) >= ratio {
+			return periodicCandidate{node: node}, true
+		}
+	}
+	return periodicCandidate{}, false
+}
+
+// rewriteNode 重写node，丢弃更旧的文件中不存在对应key且不在保留期内的删除标记，文件名和在层级中的位置保持不变。
+// 没有可丢弃的删除标记且force为false时不重写；所有条目都被丢弃时删除文件。
+// 返回重写后的文件大小、丢弃的删除标记数以及是否已重写
+func (t *LsmTree) rewriteNode(node *sst.Node, force bool) (int64, int64, bool, error) {
+	return t.rewriteNodeAt(node, force, 0)
+}
+
+// rewriteNodeAt 同rewriteNode，now不为0时在now之前过期的条目按删除标记处理
+func (t *LsmTree) rewriteNodeAt(node *sst.Node, force bool, now int64) (int64, int64, bool, error) {
+	start := t.conf.Now()
+	// 只有压缩goroutine会移除节点，刷盘只在末尾追加更新的节点，因此更旧的节点在重写期间保持不变
+	t.mu.RLock()
+	older := t.olderNodes(node)
+	t.mu.RUnlock()
+
+	it, err := node.Reader().GetIterator()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	var kept []kv.Entry
+	var dropped int64
+	for it.Next() {
+		entry := expire(it.Entry(), now)
+		// 旧版本写入的空key无法读取或删除，与可以丢弃的删除标记一样不再写入
+		if len(entry.Key) == 0 || entry.IsDelete() && !mayContain(older, entry.Key) && !t.tombstoneRetained(entry) {
+			dropped++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if err := it.Error(); err != nil {
+		return 0, 0, false, err
+	}
+	if dropped == 0 && !force {
+		return 0, 0, false, nil
+	}
+	if len(kept) == 0 {
+		if err := t.replaceNode(node, nil); err != nil {
+			return 0, 0, false, err
+		}
+		t.recordCompaction(config.CompactionRewrite, node.GetLevel(), node.GetLevel(), []*sst.Node{node}, nil, start)
+		return 0, dropped, true, nil
+	}
+
+	// 重命名后已打开的读取器仍然读取原文件的内容，重写后的文件与原文件等价，安装前崩溃也不影响数据
+	rewritten, err := t.writeSSTNode(node.GetFilename(), node.GetLevel(), uint32(node.GetSeq()), kept)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if err := t.replaceNode(node, rewritten); err != nil {
+		rewritten.Reader().Close()
+		return 0, 0, false, err
+	}
+	t.recordCompaction(config.CompactionRewrite, node.GetLevel(), node.GetLevel(), []*sst.Node{node}, []*sst.Node{rewritten}, start)
+	return rewritten.GetSize(), dropped, true, nil
+}
+
+// writeSSTNode 将有序的条目写入临时文件后重命名为path，返回level层序列号为seq的新节点
+func (t *LsmTree) writeSSTNode(path string, level int, seq uint32, entries []kv.Entry) (*sst.Node, error) {
+	tmpPath := path + sstTmpSuffix
+	if err := t.writeRewrittenSST(tmpPath, level, entries); err != nil {
+		fsio.DeleteRetry(tmpPath)
+		return nil, err
+	}
+	if err := t.renameSST(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return t.openSSTNode(path, level, seq)
+}
+
+// openSSTNode 打开path处写好的SST文件，返回level层序列号为seq的节点
+func (t *LsmTree) openSSTNode(path string, level int, seq uint32) (*sst.Node, error) {
+	reader, err := sst.NewSSTReader(t.conf, path)
+	if err != nil {
+		return nil, err
+	}
+	reader.AttachBudget(t.indexBudget)
+	reader.AttachFilterBudget(t.filterBudget)
+	reader.AttachBlockCache(t.blockCache)
+	node, err := sst.NewNode(t.conf, path, level, int32(seq), reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return node, nil
+}
+
+// renameSST 将写完的临时文件重命名为正式文件名path并同步所在目录，失败时删除两者
+func (t *LsmTree) renameSST(tmpPath, path string) error {
+	if err := fsio.AtomicRename(tmpPath, path); err != nil {
+		fsio.DeleteRetry(tmpPath)
+		return err
+	}
+	if err := t.conf.SyncDir(filepath.Dir(path)); err != nil {
+		fsio.DeleteRetry(path)
+		return err
+	}
+	return nil
+}
+
+// writeRewrittenSST 将有序的条目写入path处的新SST文件并fsync，文件位于level层
+func (t *LsmTree) writeRewrittenSST(path string, level int, entries []kv.Entry) error {
+	writer, err := t.newRewriteWriter(path, level)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	for _, entry := range entries {
+		if err := writer.AddEntry(entry); err != nil {
+			return err
+		}
+	}
+	return t.finishRewriteWriter(writer)
+}
+
+// newRewriteWriter 创建写入path处level层新SST文件的写入器，使用压缩限速器
+func (t *LsmTree) newRewriteWriter(path string, level int) (*sst.SSTWriter, error) {
+	if err := fsio.DeleteRetry(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	writer, err := sst.NewSSTWriter(t.conf, path)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetRateLimiter(t.compactLimiter)
+	writer.SetTargetLevel(level)
+	return writer, nil
+}
+
+// finishRewriteWriter 写入剩余的数据块和元数据，fsync后关闭文件，失败时同样关闭
+func (t *LsmTree) finishRewriteWriter(writer *sst.SSTWriter) error {
+	if err := writer.Flush(); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Sync(); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+// replaceNode 在写锁内将替换记入清单并用rewritten替换node，rewritten为nil时移除node并删除文件，之后关闭node的读取器
+func (t *LsmTree) replaceNode(node, rewritten *sst.Node) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	level := node.GetLevel()
+	for i, item := range t.nodes[level] {
+		if item != node {
+			continue
+		}
+		edits := []manifest.Edit{manifest.DeleteFile(level, uint32(node.GetSeq()))}
+		if rewritten != nil {
+			edits = append(edits, manifest.AddFile(t.manifestFileMeta(rewritten)))
+		}
+		if err := t.manifest.Apply(edits...); err != nil {
+			return err
+		}
+		if rewritten != nil {
+			rewritten.AddHeat(node.Heat())
+			t.nodes[level][i] = rewritten
+		} else {
+			t.nodes[level] = append(t.nodes[level][:i], t.nodes[level][i+1:]...)
+			if level == 0 {
+				t.setL0Files()
+			}
+		}
+		// 读取方在持有读锁期间使用节点，持有写锁时已没有读取方
+		if err := node.Reader().Close(); err != nil {
+			t.conf.Warnf("close rewritten sst %s: %v", node.GetFilename(), err)
+		}
+		if rewritten == nil {
+			// 删除前崩溃时，清单中已记录删除的文件会在重启时被删除
+			t.conf.Crash(config.CrashBeforeSSTDelete)
+			if err := fsio.DeleteRetry(node.GetFilename()); err != nil {
+				return err
+			}
+			t.manifest.Forget(level, uint32(node.GetSeq()))
+		}
+		return nil
+	}
+	return fmt.Errorf("sst %s is no longer in level %d", node.GetFilename(), level)
+}
+
+// olderNodes 返回比node更旧的节点：同一层级中位于node之前的节点以及更深层级的所有节点，调用方需持有t.mu
+func (t *LsmTree) olderNodes(node *sst.Node) []*sst.Node {
+	var older []*sst.Node
+	for level := node.GetLevel(); level < len(t.nodes); level++ {
+		for _, item := range t.nodes[level] {
+			if item == node {
+				break
+			}
+			older = append(older, item)
+		}
+	}
+	return older
+}
+
+// mayContain 判断nodes中是否可能存在key的条目，查找出错时视为存在
+func mayContain(nodes []*sst.Node, key []byte) bool {
+	for _, node := range nodes {
+		if bytes.Compare(key, node.GetMinKey()) < 0 || bytes.Compare(key, node.GetMaxKey()) > 0 {
+			continue
+		}
+		if _, err := node.GetEntry(key, nil); !errors.Is(err, myerror.ErrKeyNotFound) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package inner
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// waitPeriodicRun 等待在after之后开始的定期压缩结束，返回其结果
+func waitPeriodicRun(t *testing.T, tree *LsmTree, after time.Time) PeriodicCompaction {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if last := tree.Stats().LastPeriodicCompaction; last.Time.After(after) {
+			return last
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("periodic compaction did not run")
+	return PeriodicCompaction{}
+}
+
+func TestLsmTree_PeriodicCompaction(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	start := time.Unix(1700000000, 0)
+	clock := &manualClock{now: start}
+	conf.Clock = clock
+	conf.PeriodicCompactionInterval = time.Hour
+	conf.MaxFileAge = 48 * time.Hour
+	conf.TombstoneCompactionRatio = 0.5
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+	if next := tree.Stats().NextPeriodicCompaction; !next.Equal(start.Add(time.Hour)) {
+		t.Fatalf("next periodic compaction = %v, want %v", next, start.Add(time.Hour))
+	}
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	value := make([]byte, 100)
+	// 最旧的文件：50个key以及150个没有更旧版本的删除标记
+	for i := 0; i < 200; i++ {
+		if err := tree.Put(key(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 150; i++ {
+		if err := tree.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	// 较新的文件：删除标记覆盖旧文件中的key，不能丢弃
+	for i := 150; i < 200; i++ {
+		if err := tree.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	files := tree.Levels()[0].Files
+	if len(files) != 2 {
+		t.Fatalf("expected 2 SST files, got %d", len(files))
+	}
+	oldest := files[0].Path
+	stat, err := os.Stat(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := stat.Size()
+
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 200; i++ {
+			if _, err := tree.Get(key(i)); err != myerror.ErrKeyNotFound && err != myerror.ErrValueNil {
+				t.Fatalf("%s: Get(%s) = %v, want deleted", stage, key(i), err)
+			}
+		}
+	}
+
+	// 空闲的数据库在到期时按删除标记占比重写最旧的文件
+	clock.Advance(time.Hour)
+	run := waitPeriodicRun(t, tree, start)
+	if run.Err != nil || run.FilesChecked != 2 || run.FilesCompacted != 1 || run.TombstonesDropped != 150 {
+		t.Fatalf("first run = %+v, want 1 of 2 files compacted dropping 150 tombstones", run)
+	}
+	if run.BytesAfter >= run.BytesBefore {
+		t.Fatalf("rewritten file did not shrink: %d -> %d", run.BytesBefore, run.BytesAfter)
+	}
+	stat, err = os.Stat(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() >= sizeBefore || stat.Size() != run.BytesAfter {
+		t.Fatalf("file size %d -> %d, run reported %d", sizeBefore, stat.Size(), run.BytesAfter)
+	}
+	if tree.Levels()[0].Files[0].Path != oldest {
+		t.Fatal("rewritten file changed its position")
+	}
+	check("after tombstone compaction")
+	if next := tree.Stats().NextPeriodicCompaction; !next.Equal(start.Add(2 * time.Hour)) {
+		t.Fatalf("next periodic compaction = %v, want %v", next, start.Add(2*time.Hour))
+	}
+
+	// 没有可丢弃的删除标记时不会反复重写
+	clock.Advance(time.Hour)
+	run = waitPeriodicRun(t, tree, start.Add(time.Hour))
+	if run.Err != nil || run.FilesCompacted != 0 {
+		t.Fatalf("second run = %+v, want nothing compacted", run)
+	}
+
+	// 超过MaxFileAge的文件即使删除标记不多也会重写
+	clock.Advance(48 * time.Hour)
+	run = waitPeriodicRun(t, tree, start.Add(2*time.Hour))
+	if run.Err != nil || run.FilesCompacted != 2 || run.TombstonesDropped != 0 {
+		t.Fatalf("age run = %+v, want 2 files compacted", run)
+	}
+	check("after age compaction")
+
+	// 重写后的文件在重新打开后保持原来的顺序
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	conf.PeriodicCompactionInterval = 0
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after reopen")
+	if next := tree.Stats().NextPeriodicCompaction; !next.IsZero() {
+		t.Fatalf("next periodic compaction = %v with scheduling disabled", next)
+	}
+}
+
+func TestLsmTree_PeriodicCompactionRemovesTmpFile(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.StrictDirectoryScan = true
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 重写过程中崩溃遗留的临时文件在打开时被删除
+	tmp := tree.getSSTFilePath(0, 7) + sstTmpSuffix
+	if err := os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("tmp file still exists: %v", err)
+	}
+}
+
+func TestLsmTree_SkipFilterOnBottomLevel(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	conf.SkipFilterOnBottomLevel = true
+	key := func(i int) string { return fmt.Sprintf("key-%03d", i) }
+	// 最底层是偶数key，L1是4的倍数，奇数key不存在
+	bottom, mid := map[string]string{}, map[string]string{}
+	for i := 0; i < 400; i += 2 {
+		bottom[key(i)] = fmt.Sprintf("bottom-%d", i)
+		if i%4 == 0 {
+			mid[key(i)] = fmt.Sprintf("mid-%d", i)
+		}
+	}
+	writeLevelSST(t, conf, 2, 1, bottom)
+	writeLevelSST(t, conf, 1, 2, mid)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tree.Close() }()
+
+	// 旧文件在重写之前仍带过滤器
+	sizes := make(map[int]int64)
+	for level := 1; level <= 2; level++ {
+		node := tree.nodes[level][0]
+		if !node.HasFilter() {
+			t.Fatalf("L%d file written without level has no filter", level)
+		}
+		sizes[level] = node.GetSize()
+		if _, _, _, err := tree.rewriteNode(node, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if node := tree.nodes[2][0]; node.HasFilter() || node.GetSize() >= sizes[2] {
+		t.Fatalf("bottom level after rewrite: filter %v, size %d, want no filter and < %d", node.HasFilter(), node.GetSize(), sizes[2])
+	}
+	if node := tree.nodes[1][0]; !node.HasFilter() || node.GetSize() != sizes[1] {
+		t.Fatalf("L1 after rewrite: filter %v, size %d, want filter and %d", node.HasFilter(), node.GetSize(), sizes[1])
+	}
+
+	check := func(stage string) {
+		t.Helper()
+		for i := 0; i < 400; i++ {
+			value, err := tree.Get([]byte(key(i)))
+			switch {
+			case i%4 == 0:
+				if err != nil || string(value) != mid[key(i)] {
+					t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key(i), value, err, mid[key(i)])
+				}
+			case i%2 == 0:
+				if err != nil || string(value) != bottom[key(i)] {
+					t.Fatalf("%s: Get(%s) = %q, %v, want %q", stage, key(i), value, err, bottom[key(i)])
+				}
+			default:
+				if err != myerror.ErrKeyNotFound {
+					t.Fatalf("%s: Get(%s) = %v, want ErrKeyNotFound", stage, key(i), err)
+				}
+			}
+		}
+	}
+	check("after rewrite")
+	stats := tree.Stats().LevelFilters
+	if len(stats) != 3 || stats[1].Probes == 0 || stats[1].Negatives == 0 || stats[2].Probes != 0 {
+		t.Fatalf("LevelFilters = %+v, want probes and negatives on L1 only", stats)
+	}
+	// L1只有4的倍数，其余300个key中的大部分被过滤器排除
+	if rate := stats[1].NegativeRate(); rate < 0.5 {
+		t.Fatalf("L1 filter negative rate = %.2f, want >= 0.5", rate)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = NewLsmTree(conf); err != nil {
+		t.Fatal(err)
+	}
+	check("after restart")
+}
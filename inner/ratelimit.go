@@ -0,0 +1,11 @@
+package inner
+
+// SetCompactionRateLimit 在运行时调整后台压缩写入SST的速率上限(字节/秒)，0表示不限制
+func (t *LsmTree) SetCompactionRateLimit(bytesPerSec int64) {
+	t.compactLimiter.SetRate(bytesPerSec)
+}
+
+// SetFlushRateLimit 在运行时调整写入方同步刷盘写入SST的速率上限(字节/秒)，0表示不限制
+func (t *LsmTree) SetFlushRateLimit(bytesPerSec int64) {
+	t.flushLimiter.SetRate(bytesPerSec)
+}
@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// burstDuration 令牌桶容量对应的时长，空闲后最多允许突发该时长的流量
+const burstDuration = 100 * time.Millisecond
+
+// Limiter 按字节限速的令牌桶，可被多个goroutine共享，速率可在运行时调整。
+// nil或速率<=0的Limiter不限速
+type Limiter struct {
+	mu     sync.Mutex
+	clock  config.Clock // 时间来源
+	rate   int64        // 每秒允许的字节数，<=0表示不限速
+	tokens float64      // 当前可用的令牌数，为负表示已预支的字节数
+	last   time.Time    // 上次补充令牌的时间
+}
+
+// New 创建每秒允许bytesPerSec字节的限速器，bytesPerSec<=0表示不限速，clock为nil时使用系统时间
+func New(bytesPerSec int64, clock config.Clock) *Limiter {
+	if clock == nil {
+		clock = config.RealClock()
+	}
+	l := &Limiter{clock: clock, last: clock.Now()}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate 调整速率，已在等待中的调用按调整前的速率计算等待时间
+func (l *Limiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(l.clock.Now())
+	l.rate = bytesPerSec
+	if burst := l.burst(); l.tokens > burst || bytesPerSec <= 0 {
+		l.tokens = burst
+	}
+}
+
+// Rate 返回当前速率，<=0表示不限速
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait 申请n字节的额度，额度不足时阻塞到令牌补足为止。
+// n可以大于桶容量，超出部分预支后由之后的调用一并等待
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := l.clock.Now()
+	l.refill(now)
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		<-l.clock.After(wait)
+	}
+}
+
+// refill 按经过的时间补充令牌，调用方需持有l.mu
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if burst := l.burst(); l.tokens > burst {
+			l.tokens = burst
+		}
+	}
+	l.last = now
+}
+
+// burst 返回桶容量，调用方需持有l.mu
+func (l *Limiter) burst() float64 {
+	return float64(l.rate) * burstDuration.Seconds()
+}
+
+// Writer 写入前按chunk大小分段申请额度的io.Writer
+type Writer struct {
+	w       io.Writer
+	limiter *Limiter
+	chunk   int
+}
+
+// NewWriter 包装w，每次最多写入chunk字节，写入前向limiter申请额度，limiter为nil时直接写入
+func NewWriter(w io.Writer, limiter *Limiter, chunk int) *Writer {
+	if chunk <= 0 {
+		chunk = 4 * 1024
+	}
+	return &Writer{w: w, limiter: limiter, chunk: chunk}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.chunk)
+		w.limiter.Wait(n)
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
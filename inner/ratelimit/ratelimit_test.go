@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	start := time.Now()
+	nilLimiter.Wait(1 << 30)
+	New(0, nil).Wait(1 << 30)
+	New(-1, nil).Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("unlimited Wait took %v", elapsed)
+	}
+	if nilLimiter.Rate() != 0 {
+		t.Fatalf("nil limiter rate = %d", nilLimiter.Rate())
+	}
+}
+
+func TestLimiterSharedRate(t *testing.T) {
+	const rate = 400 * 1024
+	l := New(rate, nil)
+	// 4个goroutine共享限速器，共申请0.5秒的额度，桶容量只能抵消其中0.1秒
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l.Wait(rate / 80)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("shared Wait took %v, want about 400ms", elapsed)
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	// 按1KB/s需要等待约1024秒，调整为不限速后立即返回
+	l := New(1024, nil)
+	l.SetRate(0)
+	start := time.Now()
+	l.Wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Wait after SetRate(0) took %v", elapsed)
+	}
+	if l.Rate() != 0 {
+		t.Fatalf("Rate = %d, want 0", l.Rate())
+	}
+}
+
+func TestWriterChunks(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, New(64*1024, nil), 1024)
+	data := bytes.Repeat([]byte("0123456789"), 3000)
+	start := time.Now()
+	n, err := w.Write(data)
+	if err != nil || n != len(data) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	// 30000字节减去6.4KB的桶容量，约0.37秒
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("Write took %v, want about 370ms", elapsed)
+	}
+}
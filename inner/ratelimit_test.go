@@ -0,0 +1,92 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLsmTree_CompactionRateLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 64 * 1024 * 1024 // 5MB数据留在同一个内存表中，由一次后台压缩写出
+	conf.CompactionRateLimitBytesPerSec = 1024 * 1024
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	value := bytes.Repeat([]byte{'v'}, 1024)
+	const n = 5 * 1024
+	for i := 0; i < n; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%05d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 后台压缩期间前台读取不受限速影响
+	var gets, slowGets atomic.Int64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			start := time.Now()
+			if _, err := tree.Get([]byte(fmt.Sprintf("key-%05d", i%n))); err != nil {
+				t.Error(err)
+				return
+			}
+			if time.Since(start) > 500*time.Millisecond {
+				slowGets.Add(1)
+			}
+			gets.Add(1)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	tree.mu.Lock()
+	err = tree.rotateWal(RotationManual)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, tree)
+	elapsed := time.Since(start)
+	close(stop)
+	<-done
+
+	// 约5MB的SST按1MB/s写入，预期约5秒
+	if elapsed < 4*time.Second || elapsed > 10*time.Second {
+		t.Fatalf("compaction took %v, want about 5s", elapsed)
+	}
+	if gets.Load() < 100 || slowGets.Load() > 0 {
+		t.Fatalf("foreground gets during compaction: %d, slow: %d", gets.Load(), slowGets.Load())
+	}
+
+	// 运行时取消限速后压缩不再等待
+	tree.SetCompactionRateLimit(0)
+	for i := 0; i < n; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("more-%05d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start = time.Now()
+	tree.mu.Lock()
+	err = tree.rotateWal(RotationManual)
+	tree.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFlushed(t, tree)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("unlimited compaction took %v", elapsed)
+	}
+}
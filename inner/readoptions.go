@@ -0,0 +1,67 @@
+package inner
+
+import (
+	"bytes"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// ReadOptions 单次查找的选项，见config.ReadOptions
+type ReadOptions = config.ReadOptions
+
+// ScanOptions 遍历的选项，见config.ScanOptions
+type ScanOptions = config.ScanOptions
+
+// ReadTier 单次查找允许访问的范围
+type ReadTier = config.ReadTier
+
+const (
+	ReadAll          = config.ReadAll          // 查找内存表和所有SST文件
+	ReadMemtableOnly = config.ReadMemtableOnly // 只查找内存表
+)
+
+// DefaultReadOptions 返回Get使用的选项
+func DefaultReadOptions() ReadOptions {
+	return config.DefaultReadOptions()
+}
+
+// GetWithOptions 按opts查找key，使用DefaultReadOptions时与Get相同。
+// FillCache为false时从文件读取的数据块不放入缓存，适合不希望挤占缓存的一次性读取；
+// VerifyChecksums为false时不校验条目的校验和；
+// UnsafeSharedValue为true时从SST文件读取的value不复制，调用方不得修改；默认返回的value归调用方所有；
+// ReadTier为ReadMemtableOnly时不读取SST文件，内存表中没有结果而key落在某个SST文件的范围内时返回ErrWouldBlock，
+// 否则返回ErrKeyNotFound
+func (t *LsmTree) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	return t.read(key, opts)
+}
+
+// read 同GetWithOptions，不检查内部保留前缀，供命名空间等内部调用
+func (t *LsmTree) read(key []byte, opts ReadOptions) ([]byte, error) {
+	start := t.conf.Now()
+	if err := t.beginRead(); err != nil {
+		return nil, err
+	}
+
+	info := &readInfo{source: sourceNone, cached: true}
+	value, _, err := t.getWithOptions(key, info, opts)
+	mismatch := t.shadowVerify(key, value, err, info)
+	t.mu.RUnlock()
+	t.reportShadowMismatch(mismatch)
+	t.observeOp(LatencyGet, key, t.conf.Since(start), info)
+	return value, err
+}
+
+// mayContainInSST 判断key是否落在某个SST文件的最小最大key范围内，调用方持有读锁
+func (t *LsmTree) mayContainInSST(key []byte) bool {
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			if bytes.Compare(key, node.GetMinKey()) >= 0 && bytes.Compare(key, node.GetMaxKey()) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
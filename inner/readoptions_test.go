@@ -0,0 +1,170 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLsmTree_GetWithOptionsFillCache(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.BlockCacheSize = 1 << 20 // 数据块按需读取并缓存
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a": "1", "b": "2"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	opts := DefaultReadOptions()
+	opts.FillCache = false
+	for i := 0; i < 3; i++ {
+		if value, err := tree.GetWithOptions([]byte("a"), opts); err != nil || string(value) != "1" {
+			t.Fatalf("GetWithOptions(a) = %q, %v", value, err)
+		}
+	}
+	if used := tree.blockCache.Used(); used != 0 {
+		t.Fatalf("cache used %d after reads with FillCache=false", used)
+	}
+	// 默认选项与Get相同，读取后数据块被缓存
+	if value, err := tree.GetWithOptions([]byte("b"), DefaultReadOptions()); err != nil || string(value) != "2" {
+		t.Fatalf("GetWithOptions(b) = %q, %v", value, err)
+	}
+	used := tree.blockCache.Used()
+	if used == 0 {
+		t.Fatal("default options did not fill the cache")
+	}
+	if _, err := tree.GetWithOptions([]byte("a"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if tree.blockCache.Used() != used {
+		t.Fatalf("cache used changed from %d to %d", used, tree.blockCache.Used())
+	}
+}
+
+func TestLsmTree_GetWithOptionsVerifyChecksums(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.PerEntryChecksum = true
+	conf.BlockCacheSize = 1 << 20
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a": "value-a"})
+	path := filepath.Join(conf.DataDir, conf.SSTDir, "0_1.sst")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(data, []byte("value-a"))
+	if pos < 0 {
+		t.Fatal("value-a not found in file")
+	}
+	data[pos] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	opts := DefaultReadOptions()
+	opts.VerifyChecksums = false
+	value, err := tree.GetWithOptions([]byte("a"), opts)
+	if err != nil || len(value) != len("value-a") || string(value) == "value-a" {
+		t.Fatalf("GetWithOptions(a) = %q, %v, want the corrupted value", value, err)
+	}
+	// 未校验的数据块没有放入缓存，默认读取仍然发现损坏
+	var ce *EntryChecksumError
+	if _, err := tree.Get([]byte("a")); !errors.As(err, &ce) {
+		t.Fatalf("Get(a) = %v, want EntryChecksumError", err)
+	}
+}
+
+func TestLsmTree_GetWithOptionsMemtableOnly(t *testing.T) {
+	conf := newTestConfig(t)
+	writeLevelSST(t, conf, 1, 1, map[string]string{"b": "sst", "d": "sst", "f": "sst"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("a"), []byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("e"), []byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("f")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultReadOptions()
+	opts.ReadTier = ReadMemtableOnly
+	for _, c := range []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"a", "mem", nil},
+		{"e", "mem", nil},
+		{"f", "", ErrKeyNotFound}, // 内存表中的删除标记是确定的结果
+		{"d", "", ErrWouldBlock},  // 只在SST中
+		{"c", "", ErrWouldBlock},  // 不在SST中，但落在SST的key范围内
+		{"z", "", ErrKeyNotFound}, // 不在任何SST的key范围内
+	} {
+		value, err := tree.GetWithOptions([]byte(c.key), opts)
+		if string(value) != c.value || !errors.Is(err, c.err) {
+			t.Errorf("GetWithOptions(%s) = %q, %v, want %q, %v", c.key, value, err, c.value, c.err)
+		}
+		if errors.Is(err, ErrWouldBlock) && errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("ErrWouldBlock for %s matches ErrKeyNotFound", c.key)
+		}
+	}
+	// 查找所有层时读到SST中的值
+	if value, err := tree.GetWithOptions([]byte("d"), DefaultReadOptions()); err != nil || string(value) != "sst" {
+		t.Fatalf("GetWithOptions(d) = %q, %v", value, err)
+	}
+}
+
+// Get返回的value归调用方所有，修改后再次读取不受影响；UnsafeSharedValue时返回共享的value
+func TestLsmTree_GetWithOptionsUnsafeSharedValue(t *testing.T) {
+	conf := newTestConfig(t)
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a": "value"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	value, err := tree.Get([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(value, "XXXXX")
+	_ = append(value[:1], "YYYYYYYYYYYYYYYY"...)
+	if value, err := tree.Get([]byte("a")); err != nil || string(value) != "value" {
+		t.Fatalf("Get(a) = %q, %v after modifying the returned value", value, err)
+	}
+	// 重复的key各自返回一份副本
+	values, errs := tree.MultiGet([][]byte{[]byte("a"), []byte("a"), []byte("a")})
+	copy(values[0], "XXXXX")
+	copy(values[2], "ZZZZZ")
+	if errs[1] != nil || string(values[1]) != "value" {
+		t.Fatalf("MultiGet duplicate = %q, %v after modifying another position", values[1], errs[1])
+	}
+	if value, err := tree.Get([]byte("a")); err != nil || string(value) != "value" {
+		t.Fatalf("Get(a) = %q, %v after modifying MultiGet values", value, err)
+	}
+
+	opts := DefaultReadOptions()
+	opts.UnsafeSharedValue = true
+	first, err := tree.GetWithOptions([]byte("a"), opts)
+	if err != nil || string(first) != "value" {
+		t.Fatalf("GetWithOptions(a) = %q, %v", first, err)
+	}
+	second, _ := tree.GetWithOptions([]byte("a"), opts)
+	if &first[0] != &second[0] {
+		t.Fatal("UnsafeSharedValue returned a copy")
+	}
+}
@@ -0,0 +1,165 @@
+package inner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// retainedMarker 保留的删除前版本的key前缀，后接被删除的key。
+// 与命名空间一样是普通的key，value为8字节大端的原写入时间和原value，记录的写入时间即删除时间
+const retainedMarker = "\x00rt"
+
+// maxRetainedDeleteAttempts 保留删除前版本的Delete与并发写入冲突时最多尝试的次数
+const maxRetainedDeleteAttempts = 16
+
+// retainedValue Delete时保留的删除前版本
+type retainedValue struct {
+	value     []byte
+	writtenAt int64 // 原value的写入时间
+	deletedAt int64 // 删除时间
+}
+
+// retainedKey 返回key的保留记录使用的key
+func retainedKey(key []byte) []byte {
+	return append([]byte(retainedMarker), key...)
+}
+
+// tombstoneRetained 判断开启TombstoneRetention时删除标记是否仍在保留期内，保留期内压缩不能丢弃它
+func (t *LsmTree) tombstoneRetained(entry kv.Entry) bool {
+	retention := t.conf.TombstoneRetention
+	return retention > 0 && entry.IsDelete() && entry.Timestamp != 0 &&
+		t.conf.Since(time.Unix(0, entry.Timestamp)) < retention
+}
+
+// deleteRetained 删除key，同时把删除前的值写入保留记录，两者作为一条批量记录原子写入。
+// 保留记录的过期时间为保留期结束时，之后扫描不再返回，Vacuum将其丢弃。与其他写入冲突时重试，
+// 尝试maxRetainedDeleteAttempts次仍然冲突时返回ErrTxnConflict，key保持不变
+func (t *LsmTree) deleteRetained(key []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	for range maxRetainedDeleteAttempts {
+		err := t.tryDeleteRetained(key)
+		if !errors.Is(err, myerror.ErrTxnConflict) {
+			return err
+		}
+	}
+	return fmt.Errorf("delete %q: %w with concurrent writes after %d attempts", key, myerror.ErrTxnConflict, maxRetainedDeleteAttempts)
+}
+
+// tryDeleteRetained 执行一次deleteRetained，读取之后key被修改时返回ErrTxnConflict
+func (t *LsmTree) tryDeleteRetained(key []byte) error {
+	txn := t.BeginTxn()
+	defer txn.Rollback()
+	if err := txn.check(); err != nil {
+		return err
+	}
+	value, ts, err := t.readWithTimestamp(key)
+	if err != nil && !errors.Is(err, myerror.ErrKeyNotFound) {
+		return err
+	}
+	records := []*wal.Record{wal.NewEntryRecord(kv.FromValue(key, nil, 0))}
+	keys := [][]byte{key}
+	size := memtable.EntrySize(key, nil)
+	if err == nil {
+		rkey := retainedKey(key)
+		entry := kv.FromValue(rkey, binary.BigEndian.AppendUint64(nil, uint64(ts)), 0)
+		entry.Value = append(entry.Value, value...)
+		entry.TTL = t.conf.Now().Add(t.conf.TombstoneRetention).UnixNano()
+		records = append(records, wal.NewEntryRecord(entry))
+		keys = append(keys, rkey)
+		size += memtable.EntrySize(rkey, entry.Value)
+	}
+	commit, err := txn.apply(records, keys, size)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// retained 返回key仍在保留期内的删除前版本
+func (t *LsmTree) retained(key []byte) (retainedValue, error) {
+	data, deletedAt, err := t.readWithTimestamp(retainedKey(key))
+	if errors.Is(err, myerror.ErrKeyNotFound) {
+		return retainedValue{}, fmt.Errorf("%w: key %q has no retained value", myerror.ErrNotRetained, key)
+	}
+	if err != nil {
+		return retainedValue{}, err
+	}
+	if len(data) < 8 {
+		return retainedValue{}, fmt.Errorf("%w: retained value of key %q is truncated", myerror.ErrNotRetained, key)
+	}
+	if deleted := time.Unix(0, deletedAt); t.conf.Since(deleted) >= t.conf.TombstoneRetention {
+		return retainedValue{}, fmt.Errorf("%w: key %q was deleted at %v, retention %v has passed",
+			myerror.ErrNotRetained, key, deleted, t.conf.TombstoneRetention)
+	}
+	return retainedValue{
+		value:     bytes.Clone(data[8:]),
+		writtenAt: int64(binary.BigEndian.Uint64(data)),
+		deletedAt: deletedAt,
+	}, nil
+}
+
+// GetAsOf 返回key在at时的值。key在at之后没有被修改时返回当前结果；在at之后被删除时返回保留的删除前的值，
+// 该值需要在at之前写入且仍在保留期内，否则返回ErrNotRetained。只保留Delete删除前的版本，被Put覆盖的版本不保留
+func (t *LsmTree) GetAsOf(key []byte, at time.Time) ([]byte, error) {
+	value, ts, err := t.GetWithTimestamp(key)
+	if err != nil && !errors.Is(err, myerror.ErrKeyNotFound) {
+		return nil, err
+	}
+	if ts <= at.UnixNano() {
+		if err != nil {
+			return nil, myerror.ErrKeyNotFound
+		}
+		return value, nil
+	}
+	r, err := t.retained(key)
+	if err != nil {
+		return nil, err
+	}
+	if r.deletedAt <= at.UnixNano() || r.writtenAt > at.UnixNano() {
+		return nil, fmt.Errorf("%w: key %q has no retained version at %v", myerror.ErrNotRetained, key, at)
+	}
+	return r.value, nil
+}
+
+// RestoreKey 恢复被删除的key，将保留期内删除前的值重新写入，相当于一次新的Put。
+// key当前存在或没有保留的值时返回ErrNotRetained，恢复前key被并发修改时返回ErrTxnConflict
+func (t *LsmTree) RestoreKey(key []byte) error {
+	txn := t.BeginTxn()
+	defer txn.Rollback()
+	if _, err := txn.Get(key); err == nil {
+		return fmt.Errorf("%w: key %q is not deleted", myerror.ErrNotRetained, key)
+	} else if !errors.Is(err, myerror.ErrKeyNotFound) {
+		return err
+	}
+	r, err := t.retained(key)
+	if err != nil {
+		return err
+	}
+	if err := txn.Put(key, r.value); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// retainedUsage 返回仍在保留期内的删除前版本的数量和key与value的总字节数
+func (t *LsmTree) retainedUsage() (int64, int64, error) {
+	var entries, size int64
+	// 内部统计不占用MaxOpenIterators
+	err := t.scanRange(keyutil.PrefixRange([]byte(retainedMarker)), func(key, value []byte) bool {
+		entries++
+		size += int64(len(key) + len(value))
+		return true
+	})
+	return entries, size, err
+}
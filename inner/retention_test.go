@@ -0,0 +1,198 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func retainedTombstones(tree *LsmTree) int64 {
+	var n int64
+	for _, level := range tree.GarbageReport().Levels {
+		n += level.Tombstones
+	}
+	return n
+}
+
+// 保留期内删除标记和删除前的值在压缩后仍然保留，可以按时间读取和恢复；保留期结束后压缩将其丢弃，恢复返回ErrNotRetained
+func TestLsmTree_TombstoneRetention(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.TombstoneRetention = time.Hour
+	if _, err := NewLsmTree(conf); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("TombstoneRetention without TrackTimestamps: got %v, want ErrInvalidConfig", err)
+	}
+
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.TrackTimestamps = true
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	key := []byte("user:1")
+
+	written := clock.Now()
+	if err := tree.Put(key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	if err := tree.RestoreKey(key); !errors.Is(err, ErrNotRetained) {
+		t.Fatalf("RestoreKey of live key: got %v, want ErrNotRetained", err)
+	}
+	deleted := clock.Now()
+	if err := tree.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+
+	if value, err := tree.GetAsOf(key, written.Add(time.Second)); err != nil || string(value) != "v1" {
+		t.Fatalf("GetAsOf before delete = %q, %v", value, err)
+	}
+	if _, err := tree.GetAsOf(key, deleted.Add(time.Second)); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetAsOf after delete: got %v, want ErrKeyNotFound", err)
+	}
+	if _, err := tree.GetAsOf(key, written.Add(-time.Second)); !errors.Is(err, ErrNotRetained) {
+		t.Fatalf("GetAsOf before write: got %v, want ErrNotRetained", err)
+	}
+
+	// 保留期内压缩不丢弃删除标记
+	flushAll(t, tree)
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	report := tree.GarbageReport()
+	if report.RetainedEntries != 1 || report.RetainedBytes == 0 {
+		t.Fatalf("retained %d entries, %d bytes, want 1 entry", report.RetainedEntries, report.RetainedBytes)
+	}
+	if n := retainedTombstones(tree); n != 1 {
+		t.Fatalf("%d tombstones after vacuum within retention, want 1", n)
+	}
+	if err := tree.RestoreKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tree.Get(key); err != nil || string(value) != "v1" {
+		t.Fatalf("Get after restore = %q, %v", value, err)
+	}
+
+	// 再次删除并超过保留期后压缩丢弃删除标记和保留的值
+	if err := tree.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	flushAll(t, tree)
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := retainedTombstones(tree); n != 0 {
+		t.Fatalf("%d tombstones after retention, want 0", n)
+	}
+	if report := tree.GarbageReport(); report.RetainedEntries != 0 {
+		t.Fatalf("retained %d entries after retention, want 0", report.RetainedEntries)
+	}
+	if err := tree.RestoreKey(key); !errors.Is(err, ErrNotRetained) {
+		t.Fatalf("RestoreKey after retention: got %v, want ErrNotRetained", err)
+	}
+	if _, err := tree.Get(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get after retention: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+// 保留的删除前版本位于内部保留前缀下：根命名空间的读写拒绝这些key，遍历跳过它们，只能通过GetAsOf和RestoreKey读取
+func TestLsmTree_RetentionReservedPrefix(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.TrackTimestamps = true
+	conf.TombstoneRetention = time.Hour
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	for _, key := range []string{"a", "b"} {
+		if err := tree.Put([]byte(key), []byte("v-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	// 命名空间中的删除同样保留删除前的值
+	ns := tree.Namespace("users")
+	if err := ns.Put([]byte("a"), []byte("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ns.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	rkey := retainedKey([]byte("a"))
+	if _, err := tree.Get(rkey); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("Get(retained key): got %v, want ErrReservedKey", err)
+	}
+	values, errs := tree.MultiGet([][]byte{rkey, []byte("b")})
+	if !errors.Is(errs[0], ErrReservedKey) || errs[1] != nil || string(values[1]) != "v-b" {
+		t.Fatalf("MultiGet = %q, %v", values, errs)
+	}
+	if err := tree.Put(rkey, []byte("forged")); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("Put(retained key): got %v, want ErrReservedKey", err)
+	}
+	if err := tree.Delete(rkey); !errors.Is(err, ErrReservedKey) {
+		t.Fatalf("Delete(retained key): got %v, want ErrReservedKey", err)
+	}
+	var keys []string
+	if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("PrefixScan returned %q, want only b", keys)
+	}
+
+	if err := tree.RestoreKey([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := tree.Get([]byte("a")); err != nil || string(value) != "v-a" {
+		t.Fatalf("Get after restore = %q, %v", value, err)
+	}
+}
+
+// 与持续的并发写入冲突时Delete有限次重试后返回ErrTxnConflict，不会一直重试
+func TestLsmTree_RetentionDeleteConflict(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.TrackTimestamps = true
+	conf.TombstoneRetention = time.Hour
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	key := []byte("hot")
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := tree.Put(key, []byte("value")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := tree.Delete(key); err != nil && !errors.Is(err, ErrTxnConflict) {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,127 @@
+package inner
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/memtable"
+)
+
+// rowEntry 行缓存中一个key的最终结果
+type rowEntry struct {
+	key   string // key
+	value []byte // 值，err不为nil时为nil
+	ts    int64  // 写入时间
+	err   error  // 不为nil时表示key已删除或不存在，Get原样返回
+	size  int64  // 占用的内存估算
+}
+
+// rowCache 缓存Get从SST中解析出的最终结果，超出容量时按LRU顺序淘汰。
+// 插入在读取方持有t.mu读锁时进行，失效在写入方持有t.mu写锁时进行，因此缓存中的结果总是与当前的内存表和SST一致
+type rowCache struct {
+	mu      sync.Mutex               // 互斥锁
+	limit   int64                    // 容量上限(字节)
+	used    int64                    // 已使用的大小
+	lru     *list.List               // 最近访问的条目在前
+	entries map[string]*list.Element // key到LRU节点的映射
+	hits    atomic.Uint64            // 命中次数
+	misses  atomic.Uint64            // 未命中次数
+}
+
+// newRowCache 创建行缓存，size<=0时不启用
+func newRowCache(size int64) *rowCache {
+	if size <= 0 {
+		return nil
+	}
+	return &rowCache{
+		limit:   size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get 查找key的缓存结果并统计命中情况
+func (c *rowCache) get(key []byte) (*rowEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[string(key)]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*rowEntry), true
+}
+
+// add 缓存key的结果，value由缓存持有，调用方不得再修改。超过容量的单个条目不缓存
+func (c *rowCache) add(key, value []byte, ts int64, err error) {
+	if c == nil {
+		return
+	}
+	size := memtable.EntrySize(key, value)
+	if size > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[string(key)]; ok {
+		c.removeElement(elem)
+	}
+	entry := &rowEntry{key: string(key), value: value, ts: ts, err: err, size: size}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.used += size
+	for c.used > c.limit {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove 使key的缓存结果失效
+func (c *rowCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[string(key)]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// clear 清空缓存，用于导入SST文件等一次改变大量key的操作
+func (c *rowCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.entries)
+	c.used = 0
+}
+
+// Hits 返回命中次数
+func (c *rowCache) Hits() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hits.Load()
+}
+
+// Misses 返回未命中次数
+func (c *rowCache) Misses() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.misses.Load()
+}
+
+func (c *rowCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*rowEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
@@ -0,0 +1,217 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func newRowCacheTree(t *testing.T) *LsmTree {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	conf.RowCacheSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+// getValue 读取key并检查结果
+func getValue(t *testing.T, tree *LsmTree, key, want string) {
+	t.Helper()
+	if value, err := tree.Get([]byte(key)); err != nil || string(value) != want {
+		t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+	}
+}
+
+// 热点key的重复读取命中行缓存，写入该key后缓存失效，删除和不存在的结果同样被缓存
+func TestLsmTree_RowCache(t *testing.T) {
+	tree := newRowCacheTree(t)
+	defer tree.Close()
+	for _, key := range []string{"hot", "cold", "deleted"} {
+		if err := tree.Put([]byte(key), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if err := tree.Delete([]byte("deleted")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+
+	before := tree.Stats()
+	for i := 0; i < 100; i++ {
+		getValue(t, tree, "hot", "v1")
+	}
+	after := tree.Stats()
+	if hits, misses := after.RowCacheHits-before.RowCacheHits, after.RowCacheMisses-before.RowCacheMisses; hits != 99 || misses != 1 {
+		t.Fatalf("row cache hits %d misses %d, want 99 and 1", hits, misses)
+	}
+	if rate := after.RowCacheHitRate(); rate < 0.9 {
+		t.Fatalf("hit rate %.2f", rate)
+	}
+	// 命中时不再查找SST文件
+	if after.NodesConsidered-before.NodesConsidered != 1 {
+		t.Fatalf("probed %d files for 100 reads", after.NodesConsidered-before.NodesConsidered)
+	}
+
+	// 返回的value归调用方所有，修改后不影响缓存
+	value, err := tree.Get([]byte("hot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'x'
+	getValue(t, tree, "hot", "v1")
+
+	// 写入后缓存失效，刷盘后重新从SST填充
+	if err := tree.Put([]byte("hot"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	getValue(t, tree, "hot", "v2")
+	flushAll(t, tree)
+	getValue(t, tree, "hot", "v2")
+	getValue(t, tree, "hot", "v2")
+	getValue(t, tree, "cold", "v1")
+
+	for _, key := range []string{"deleted", "missing"} {
+		for i := 0; i < 2; i++ {
+			hits := tree.Stats().RowCacheHits
+			if _, err := tree.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get(%s) = %v, want not found", key, err)
+			}
+			if hit := tree.Stats().RowCacheHits > hits; hit != (i == 1) {
+				t.Fatalf("Get(%s) #%d hit = %v", key, i, hit)
+			}
+		}
+	}
+	if err := tree.Put([]byte("missing"), []byte("now")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	getValue(t, tree, "missing", "now")
+
+	// 事务读取不使用行缓存
+	stats := tree.Stats()
+	txn := tree.BeginTxn()
+	if value, err := txn.Get([]byte("cold")); err != nil || string(value) != "v1" {
+		t.Fatalf("Txn.Get(cold) = %q, %v", value, err)
+	}
+	txn.Rollback()
+	if got := tree.Stats(); got.RowCacheHits != stats.RowCacheHits || got.RowCacheMisses != stats.RowCacheMisses {
+		t.Fatal("transaction read used the row cache")
+	}
+}
+
+// 导入SST文件后清空行缓存，读取导入的新值
+func TestLsmTree_RowCacheIngest(t *testing.T) {
+	tree := newRowCacheTree(t)
+	defer tree.Close()
+	if err := tree.Put([]byte("key"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	getValue(t, tree, "key", "old")
+	if _, err := tree.Get([]byte("other")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(other) = %v", err)
+	}
+
+	builder, err := sst.NewFileSetBuilder(tree.conf, filepath.Join(t.TempDir(), "bulk"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key", "other"} {
+		if err := builder.Add([]byte(key), []byte("ingested")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.IngestSST(files); err != nil {
+		t.Fatal(err)
+	}
+	getValue(t, tree, "key", "ingested")
+	getValue(t, tree, "other", "ingested")
+}
+
+// 并发写入和读取，写入完成后开始的读取不会从行缓存中得到被覆盖的旧值
+func TestLsmTree_RowCacheConcurrent(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 2048
+	conf.RowCacheSize = 1 << 20
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const keys, versions = 8, 300
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%d", i)) }
+	var completed [keys]atomic.Int64 // 每个key已完成写入的最新版本
+	for i := 0; i < keys; i++ {
+		if err := tree.Put(key(i), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 不再更新的key留在SST中，读取时命中行缓存
+	if err := tree.Put([]byte("static"), []byte("static")); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if n%2 == 1 {
+					if value, err := tree.Get([]byte("static")); err != nil || string(value) != "static" {
+						t.Errorf("Get(static) = %q, %v", value, err)
+						return
+					}
+					continue
+				}
+				i := n / 2 % keys
+				want := completed[i].Load()
+				value, err := tree.Get(key(i))
+				if err != nil {
+					t.Errorf("Get(%s) = %v", key(i), err)
+					return
+				}
+				if got, _ := strconv.ParseInt(string(value), 10, 64); got < want {
+					t.Errorf("Get(%s) = %d after version %d was written", key(i), got, want)
+					return
+				}
+			}
+		}()
+	}
+	for v := 1; v <= versions; v++ {
+		for i := 0; i < keys; i++ {
+			if err := tree.Put(key(i), []byte(strconv.Itoa(v))); err != nil {
+				t.Fatal(err)
+			}
+			completed[i].Store(int64(v))
+		}
+	}
+	close(stop)
+	readers.Wait()
+	if tree.Stats().RowCacheHits == 0 {
+		t.Fatal("no row cache hits during the stress")
+	}
+}
@@ -0,0 +1,269 @@
+package inner
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// readView 某一时刻的可变内存表、不可变内存表和各层节点，由captureView在读锁内一次性获取。
+// 轮转WAL、安装刷盘结果和替换节点都需要写锁，因此视图只在获取它的读锁释放之前有效：
+// 之后可变内存表会继续写入，被替换的节点会被关闭
+type readView struct {
+	mutable    memtable.MemTable
+	immutables []*immutable  // 从旧到新
+	nodes      [][]*sst.Node // 按层级，同一层中靠前的节点更旧
+}
+
+// captureView 获取当前的读取视图，调用方需持有t.mu
+func (t *LsmTree) captureView() *readView {
+	nodes := make([][]*sst.Node, len(t.nodes))
+	for level := range t.nodes {
+		nodes[level] = append([]*sst.Node(nil), t.nodes[level]...)
+	}
+	return &readView{
+		mutable:    t.mutableIndex,
+		immutables: append([]*immutable(nil), t.immutableIndex...),
+		nodes:      nodes,
+	}
+}
+
+// scan 从最旧的数据开始合并rng范围内的条目，新数据覆盖旧数据，value为nil表示删除标记。
+// skip不为nil且对节点返回true时，如果已合并的更旧节点与它的key范围不重叠则不读取该节点：
+// 节点中的条目都不需要返回，也不会覆盖更旧的数据。
+// 不包括可变内存表，由调用方通过scanMutable合并
+func (v *readView) scan(rng keyutil.Range, merged map[string]kv.Entry, skip func(node *sst.Node) bool) error {
+	collect := func(entry kv.Entry) bool {
+		collectRange(merged, rng, entry)
+		return true
+	}
+	var scanned []*sst.Node
+	for level := len(v.nodes) - 1; level >= 0; level-- {
+		for _, node := range v.nodes[level] {
+			if !rng.Overlaps(node.GetMinKey(), node.GetMaxKey()) {
+				continue
+			}
+			if skip != nil && skip(node) && !overlapsAny(node, scanned) {
+				continue
+			}
+			if err := node.ScanRangeEntries(rng, collect); err != nil {
+				return err
+			}
+			scanned = append(scanned, node)
+		}
+	}
+	for _, imm := range v.immutables {
+		imm.index.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+			return collect(entry.Clone())
+		})
+	}
+	return nil
+}
+
+// overlapsAny 判断node的key范围是否与nodes中的某个节点重叠
+func overlapsAny(node *sst.Node, nodes []*sst.Node) bool {
+	for _, other := range nodes {
+		if bytes.Compare(node.GetMinKey(), other.GetMaxKey()) <= 0 &&
+			bytes.Compare(other.GetMinKey(), node.GetMaxKey()) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// collectRange key在rng范围内时记入merged，覆盖更旧的数据
+func collectRange(merged map[string]kv.Entry, rng keyutil.Range, entry kv.Entry) {
+	// 旧版本写入的空key无法读取或删除，遍历时同样跳过
+	if len(entry.Key) > 0 && rng.Contains(entry.Key) {
+		merged[string(entry.Key)] = entry
+	}
+}
+
+// scanMutable 将可变内存表迭代器中rng范围内的条目合并到merged，可变内存表最新，覆盖其余数据
+func scanMutable(it *memtable.Iterator, rng keyutil.Range, merged map[string]kv.Entry) {
+	defer it.Close()
+	for it.Next() {
+		collectRange(merged, rng, it.Entry())
+	}
+}
+
+// ScanItem 遍历返回的一个条目，key和value归调用方所有
+type ScanItem struct {
+	key   []byte
+	value []byte
+	ttl   int64 // 过期时间(unix纳秒)，0表示不过期
+}
+
+// Key 返回条目的key
+func (i ScanItem) Key() []byte {
+	return i.key
+}
+
+// Value 返回条目的value
+func (i ScanItem) Value() []byte {
+	return i.value
+}
+
+// Expiry 返回条目的过期时间，没有设置过期时间时第二个返回值为false
+func (i ScanItem) Expiry() (time.Time, bool) {
+	if i.ttl == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, i.ttl), true
+}
+
+// scanFilter 按ScanOptions判断条目是否返回以及SST文件能否整体跳过
+type scanFilter struct {
+	now    int64 // 调用时刻(unix纳秒)
+	before int64 // ExpireBefore(unix纳秒)，0表示未设置
+	opts   ScanOptions
+}
+
+func newScanFilter(now time.Time, opts ScanOptions) scanFilter {
+	f := scanFilter{now: now.UnixNano(), opts: opts}
+	if !opts.ExpireBefore.IsZero() {
+		f.before = opts.ExpireBefore.UnixNano()
+	}
+	return f
+}
+
+// visible 判断合并后的最新条目是否返回，value为nil表示删除标记
+func (f scanFilter) visible(entry kv.Entry) bool {
+	switch {
+	case entry.Value == nil:
+		return false
+	case f.before != 0:
+		return entry.TTL != 0 && entry.TTL <= f.before
+	case f.opts.IncludeExpired:
+		return true
+	default:
+		return !entry.Expired(f.now)
+	}
+}
+
+// skip 判断节点中的条目是否都不会返回，返回nil表示每个节点都需要读取
+func (f scanFilter) skip() func(node *sst.Node) bool {
+	switch {
+	case f.before != 0:
+		return func(node *sst.Node) bool {
+			return !node.Reader().Properties().AnyExpireBy(f.before)
+		}
+	case f.opts.IncludeExpired:
+		return nil
+	default:
+		return func(node *sst.Node) bool {
+			return node.Reader().Properties().AllExpired(f.now)
+		}
+	}
+}
+
+// PrefixScan 按key顺序遍历所有以prefix开头且未被删除、未过期的键值对，fn返回false时停止遍历。
+// 遍历的是调用时刻的一致视图：与Get相同，调用之前完成的写入全部可见，调用之后的写入全部不可见，
+// 并发的WAL轮转和刷盘不会使数据重复或缺失。进行中的遍历数已达到Config.MaxOpenIterators时返回ErrTooManyIterators。
+// 命名空间等内部保留前缀下的key不会返回
+func (t *LsmTree) PrefixScan(prefix []byte, fn func(key, value []byte) bool) error {
+	release, err := t.trackIterator()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return t.scanRange(keyutil.PrefixRange(prefix), func(key, value []byte) bool {
+		return isReservedKey(key) || fn(key, value)
+	})
+}
+
+// PrefixScanWithOptions 与PrefixScan相同，按opts决定是否返回已过期的条目。
+// 是否过期按Config.Clock的当前时间判断；默认跳过所有条目都已过期的SST文件，
+// 设置ExpireBefore时只读取有条目在该时刻之前过期的SST文件
+func (t *LsmTree) PrefixScanWithOptions(prefix []byte, opts ScanOptions, fn func(item ScanItem) bool) error {
+	release, err := t.trackIterator()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return t.scanRangeWithOptions(keyutil.PrefixRange(prefix), opts, func(item ScanItem) bool {
+		return isReservedKey(item.key) || fn(item)
+	})
+}
+
+// PrefixScanFields 按Config.KeySchema遍历前len(values)个字段依次等于values的键值对，可见性与PrefixScan相同。
+// 范围由字段值直接计算，与PrefixScan相应的字节前缀等价；没有设置KeySchema、值超出字段宽度
+// 或字段数超出schema时返回ErrInvalidConfig
+func (t *LsmTree) PrefixScanFields(values []uint64, fn func(key, value []byte) bool) error {
+	schema := t.conf.KeySchema
+	if schema == nil {
+		return fmt.Errorf("%w: PrefixScanFields without KeySchema", myerror.ErrInvalidConfig)
+	}
+	rng, err := schema.Range(values...)
+	if err != nil {
+		return err
+	}
+	release, err := t.trackIterator()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return t.scanRange(rng, func(key, value []byte) bool {
+		return isReservedKey(key) || fn(key, value)
+	})
+}
+
+// scanRange 按key顺序遍历rng范围内且未被删除、未过期的键值对，可见性与PrefixScan相同
+func (t *LsmTree) scanRange(rng keyutil.Range, fn func(key, value []byte) bool) error {
+	return t.scanRangeWithOptions(rng, ScanOptions{}, func(item ScanItem) bool {
+		return fn(item.key, item.value)
+	})
+}
+
+// scanRangeWithOptions 按key顺序遍历rng范围内按opts应返回的条目
+func (t *LsmTree) scanRangeWithOptions(rng keyutil.Range, opts ScanOptions, fn func(item ScanItem) bool) error {
+	start := t.conf.Now()
+	filter := newScanFilter(start, opts)
+	if err := t.unavailableScan(rng); err != nil {
+		return err
+	}
+	if err := t.beginRead(); err != nil {
+		return err
+	}
+	view := t.captureView()
+	// 在读锁内创建可变内存表的迭代器，B树内存表的快照固定了调用时刻的内容，释放读锁后再遍历，
+	// 遍历期间的写入不需要等待；不支持快照的内存表在读锁内遍历，写入等待遍历完成
+	mutable := memtable.NewIterator(view.mutable, t.conf.MemtableIterBatchSize)
+	merged := make(map[string]kv.Entry)
+	err := view.scan(rng, merged, filter.skip())
+	if err == nil && !mutable.Consistent() {
+		scanMutable(mutable, rng, merged)
+	}
+	// 合并完成后释放读锁，回调中可以继续读写
+	t.mu.RUnlock()
+	if err != nil {
+		mutable.Close()
+		return err
+	}
+	scanMutable(mutable, rng, merged)
+
+	keys := make([]string, 0, len(merged))
+	for key, entry := range merged {
+		if filter.visible(entry) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// 每个键值对的耗时从上一次回调返回开始计算
+		t.recordLatency(LatencyScanNext, t.conf.Since(start))
+		entry := merged[key]
+		if !fn(ScanItem{key: []byte(key), value: entry.Value, ttl: entry.TTL}) {
+			break
+		}
+		start = t.conf.Now()
+	}
+	return nil
+}
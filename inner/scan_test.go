@@ -0,0 +1,539 @@
+package inner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+func TestLsmTree_PrefixScan(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	conf.PrefixExtractor = config.NewDelimiterPrefixExtractor(':')
+	writeLevelSST(t, conf, 1, 0, map[string]string{"a:1": "old", "a:2": "old", "b:1": "old"})
+	writeLevelSST(t, conf, 0, 0, map[string]string{"a:1": "sst", "a:3": "sst"})
+	writeWal(t, conf, 0, [][2][]byte{
+		{[]byte("a:2"), nil},
+		{[]byte("a:4"), []byte("wal")},
+	})
+
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("a:5"), []byte("mem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("a:3")); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	err = tree.PrefixScan([]byte("a:"), func(key, value []byte) bool {
+		got = append(got, fmt.Sprintf("%s=%s", key, value))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a:1=sst", "a:4=wal", "a:5=mem"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("PrefixScan = %v, want %v", got, want)
+	}
+
+	got = got[:0]
+	tree.PrefixScan([]byte("a:"), func(key, value []byte) bool {
+		got = append(got, string(key))
+		return false
+	})
+	if len(got) != 1 {
+		t.Fatalf("expected scan to stop after first key, got %v", got)
+	}
+}
+
+// TestLsmTree_PrefixScanFFKeys 以0xFF结尾和全部为0xFF的前缀在SST和内存表中都不会漏掉或多出key
+func TestLsmTree_PrefixScanFFKeys(t *testing.T) {
+	conf := newTestConfig(t)
+	writeLevelSST(t, conf, 1, 0, map[string]string{"a\xff": "sst", "a\xff\xff\x01": "sst", "b": "sst", "\xff\xff": "sst"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for _, key := range []string{"a", "a\xff\xff", "a\xfe", "\xff", "\xff\xff\xff"} {
+		if err := tree.Put([]byte(key), []byte("mem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for prefix, want := range map[string]string{
+		"a\xff":     `["a\xff" "a\xff\xff" "a\xff\xff\x01"]`,
+		"a\xff\xff": `["a\xff\xff" "a\xff\xff\x01"]`,
+		"\xff":      `["\xff" "\xff\xff" "\xff\xff\xff"]`,
+		"\xff\xff":  `["\xff\xff" "\xff\xff\xff"]`,
+	} {
+		var got []string
+		if err := tree.PrefixScan([]byte(prefix), func(key, _ []byte) bool {
+			got = append(got, string(key))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%q", got) != want {
+			t.Fatalf("PrefixScan(%q) = %q, want %s", prefix, got, want)
+		}
+	}
+}
+
+// TestLsmTree_PrefixScanConsistentCut 并发写入递增的key并轮转WAL，每次扫描的结果必须是写入历史的一个前缀：
+// 扫描开始前已返回的写入全部可见，且key连续没有缺失
+func TestLsmTree_PrefixScanConsistentCut(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 4 << 10 // 频繁轮转，使扫描与轮转和后台刷盘交错
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const total = 5000
+	var written atomic.Int64 // 已返回的写入数
+	stop := make(chan struct{})
+	errCh := make(chan error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(stop)
+		for i := 0; i < total; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("k%08d", i)), []byte("v")); err != nil {
+				errCh <- err
+				return
+			}
+			written.Add(1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			tree.mu.Lock()
+			err := tree.rotateWal(RotationManual)
+			tree.mu.Unlock()
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	scans := 0
+	for done := false; !done; scans++ {
+		select {
+		case <-stop:
+			done = true // 写入结束后再扫描一次
+		default:
+		}
+		before := written.Load()
+		n := int64(0)
+		var gap error
+		err := tree.PrefixScan([]byte("k"), func(key, _ []byte) bool {
+			if want := fmt.Sprintf("k%08d", n); string(key) != want {
+				gap = fmt.Errorf("scan %d: key #%d is %s, want %s", scans, n, key, want)
+				return false
+			}
+			n++
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gap != nil {
+			t.Fatal(gap)
+		}
+		// 扫描期间最多还有一个写入已进入内存表但尚未返回
+		if after := written.Load(); n < before || n > after+1 {
+			t.Fatalf("scan %d saw %d keys, want between %d and %d", scans, n, before, after+1)
+		}
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+	if written.Load() != total {
+		t.Fatalf("wrote %d keys, want %d", written.Load(), total)
+	}
+}
+
+// TestLsmTree_PrefixScanSlowConsumer 回调在每个键值对之间等待时，并发的写入不被阻塞，扫描仍然只看到调用时刻的数据
+func TestLsmTree_PrefixScanSlowConsumer(t *testing.T) {
+	for _, mtType := range []config.MemTableType{config.MemTableTypeBTree, config.MemTableTypeSkipList} {
+		conf := newTestConfig(t)
+		conf.MemTableType = mtType
+		conf.MemtableIterBatchSize = 4
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tree.Close()
+		const keys = 20
+		for i := 0; i < keys; i++ {
+			if err := tree.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("v1")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		const pause = 25 * time.Millisecond
+		started := make(chan struct{})
+		var once sync.Once
+		var maxPut atomic.Int64
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-started
+			for i := 0; i < 2*keys; i++ {
+				// 覆盖已有的key、删除和写入新key
+				key := []byte(fmt.Sprintf("key%02d", i))
+				begin := time.Now()
+				var err error
+				if i%3 == 0 {
+					err = tree.Delete(key)
+				} else {
+					err = tree.Put(key, []byte("v2"))
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if elapsed := int64(time.Since(begin)); elapsed > maxPut.Load() {
+					maxPut.Store(elapsed)
+				}
+			}
+		}()
+
+		var seen []string
+		err = tree.PrefixScan([]byte("key"), func(key, value []byte) bool {
+			once.Do(func() { close(started) })
+			if string(value) != "v1" {
+				t.Errorf("type %d: scan saw %s=%s written after it started", mtType, key, value)
+			}
+			seen = append(seen, string(key))
+			time.Sleep(pause)
+			return true
+		})
+		wg.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != keys {
+			t.Fatalf("type %d: scan saw %d keys, want %d", mtType, len(seen), keys)
+		}
+		// 写入不等待回调，单次耗时远小于整个扫描的时长
+		if elapsed := time.Duration(maxPut.Load()); elapsed > keys*pause/4 {
+			t.Fatalf("type %d: slowest Put took %v during a %v scan", mtType, elapsed, keys*pause)
+		}
+	}
+}
+
+// TestLsmTree_PrefixScanMergeDoesNotBlockWrites B树可变内存表很大时，合并可变内存表在释放读锁之后进行，
+// 并发的写入在合并期间继续完成。只有一个key以前缀开头，扫描的耗时几乎全部在遍历内存表上
+func TestLsmTree_PrefixScanMergeDoesNotBlockWrites(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.MemTableType = config.MemTableTypeBTree
+	conf.WalSize = 1 << 30 // 扫描期间的写入不轮转内存表
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	// 直接写入可变内存表，省去逐条写WAL的时间
+	for i := 0; i < 200000; i++ {
+		if err := tree.mutableIndex.Put([]byte(fmt.Sprintf("fill%06d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.Put([]byte("scan"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	var puts atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := tree.Put([]byte(fmt.Sprintf("write%08d", i)), []byte("value")); err != nil {
+				t.Error(err)
+				return
+			}
+			puts.Add(1)
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+
+	<-started
+	before := puts.Load()
+	var seen int
+	err = tree.PrefixScan([]byte("scan"), func(key, value []byte) bool {
+		seen++
+		return true
+	})
+	during := puts.Load() - before
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != 1 {
+		t.Fatalf("scan saw %d keys, want 1", seen)
+	}
+	// 在读锁内合并时写入等待到合并结束，扫描期间最多完成扫描加锁之前发起的一两次写入
+	if during < 10 {
+		t.Fatalf("only %d Puts completed during the scan", during)
+	}
+}
+
+// scanWithOptions 按opts遍历全部key，返回"key=value"，设置了过期时间的条目附带"@时:分"
+func scanWithOptions(t *testing.T, tree *LsmTree, opts ScanOptions) []string {
+	t.Helper()
+	var got []string
+	err := tree.PrefixScanWithOptions(nil, opts, func(item ScanItem) bool {
+		s := fmt.Sprintf("%s=%s", item.Key(), item.Value())
+		if expiry, ok := item.Expiry(); ok {
+			s += "@" + expiry.UTC().Format("15:04")
+		}
+		got = append(got, s)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// 默认跳过已过期的条目，过期的新版本同样覆盖未过期的旧版本；IncludeExpired返回已过期的条目，
+// ExpireBefore返回到该时刻会过期的条目；时间按Config.Clock判断，内存表和SST文件中的条目相同处理
+func TestLsmTree_PrefixScanExpired(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	now := clock.Now()
+	past, soon, late := now.Add(-time.Hour).UnixNano(), now.Add(time.Hour).UnixNano(), now.Add(10*time.Hour).UnixNano()
+
+	conf := newTestConfig(t)
+	conf.Clock = clock
+	conf.LevelSize = 2
+	conf.TrackSequences = true
+	writeLevelSST(t, conf, 1, 0, map[string]string{"a:live": "old", "a:shadow": "old"})
+	writeLevelEntries(t, conf, 0, 0, []kv.Entry{
+		{Key: []byte("a:shadow"), Value: []byte("new"), TTL: past},
+		{Key: []byte("a:soon"), Value: []byte("sst"), TTL: soon},
+	})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	// 第一批刷入SST文件，第二批留在可变内存表中
+	if err := tree.applyChanges([]kv.Entry{
+		{Key: []byte("m:dead"), Value: []byte("flushed"), Seq: 1, TTL: past},
+		{Key: []byte("m:late"), Value: []byte("flushed"), Seq: 1, TTL: late},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+	if err := tree.applyChanges([]kv.Entry{
+		{Key: []byte("m:none"), Value: []byte("mem"), Seq: 1},
+		{Key: []byte("m:soon"), Value: []byte("mem"), Seq: 1, TTL: soon},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name string
+		opts ScanOptions
+		want []string
+	}{
+		{"default", ScanOptions{}, []string{
+			"a:live=old", "a:soon=sst@13:00", "m:late=flushed@22:00", "m:none=mem", "m:soon=mem@13:00"}},
+		{"include expired", ScanOptions{IncludeExpired: true}, []string{
+			"a:live=old", "a:shadow=new@11:00", "a:soon=sst@13:00", "m:dead=flushed@11:00",
+			"m:late=flushed@22:00", "m:none=mem", "m:soon=mem@13:00"}},
+		{"expire before", ScanOptions{ExpireBefore: now.Add(2 * time.Hour)}, []string{
+			"a:shadow=new@11:00", "a:soon=sst@13:00", "m:dead=flushed@11:00", "m:soon=mem@13:00"}},
+	} {
+		if got := scanWithOptions(t, tree, c.opts); fmt.Sprint(got) != fmt.Sprint(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	clock.Advance(2 * time.Hour)
+	want := []string{"a:live=old", "m:late=flushed@22:00", "m:none=mem"}
+	if got := scanWithOptions(t, tree, ScanOptions{}); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("after advance: got %v, want %v", got, want)
+	}
+	if got := scanAll(t, tree); got != "a:live=old\nm:late=flushed\nm:none=mem\n" {
+		t.Fatalf("PrefixScan after advance = %q", got)
+	}
+}
+
+// findNode 返回level层中编号为seq的节点
+func findNode(t *testing.T, tree *LsmTree, level int, seq int32) *sst.Node {
+	t.Helper()
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	for _, node := range tree.nodes[level] {
+		if node.GetSeq() == seq {
+			return node
+		}
+	}
+	t.Fatalf("no node %d_%d", level, seq)
+	return nil
+}
+
+// 所有条目都已过期的SST文件在默认遍历中整体跳过，除非它覆盖了已读取的更旧文件中的key；
+// ExpireBefore跳过没有条目在该时刻之前过期的文件
+func TestLsmTree_PrefixScanSkipsExpiredFiles(t *testing.T) {
+	clock := &manualClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	past, late := clock.Now().Add(-time.Hour).UnixNano(), clock.Now().Add(10*time.Hour).UnixNano()
+
+	conf := newTestConfig(t)
+	conf.Clock = clock
+	conf.LevelSize = 2
+	writeLevelSST(t, conf, 1, 0, map[string]string{"a": "old", "b": "old"})
+	// 与下层重叠，需要读取以覆盖b的旧版本
+	writeLevelEntries(t, conf, 0, 1, []kv.Entry{{Key: []byte("b"), Value: []byte("new"), TTL: past}})
+	// 与其他文件不重叠，默认遍历时跳过
+	writeLevelEntries(t, conf, 0, 2, []kv.Entry{
+		{Key: []byte("x"), Value: []byte("dead"), TTL: past},
+		{Key: []byte("y"), Value: []byte("dead"), TTL: past},
+	})
+	// 没有条目在一小时内过期
+	writeLevelEntries(t, conf, 0, 3, []kv.Entry{{Key: []byte("c"), Value: []byte("later"), TTL: late}})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	shadowing, expired, live := findNode(t, tree, 0, 1), findNode(t, tree, 0, 2), findNode(t, tree, 0, 3)
+
+	if got := fmt.Sprint(scanWithOptions(t, tree, ScanOptions{})); got != "[a=old c=later@22:00]" {
+		t.Fatalf("default scan = %s", got)
+	}
+	if shadowing.Reader().BlockReads() == 0 || expired.Reader().BlockReads() != 0 {
+		t.Fatalf("block reads: shadowing %d, expired %d", shadowing.Reader().BlockReads(), expired.Reader().BlockReads())
+	}
+
+	liveReads := live.Reader().BlockReads()
+	got := fmt.Sprint(scanWithOptions(t, tree, ScanOptions{ExpireBefore: clock.Now().Add(time.Hour)}))
+	if got != "[b=new@11:00 x=dead@11:00 y=dead@11:00]" {
+		t.Fatalf("ExpireBefore scan = %s", got)
+	}
+	if live.Reader().BlockReads() != liveReads {
+		t.Fatalf("ExpireBefore read a file without entries expiring in time")
+	}
+
+	got = fmt.Sprint(scanWithOptions(t, tree, ScanOptions{IncludeExpired: true}))
+	if got != "[a=old b=new@11:00 c=later@22:00 x=dead@11:00 y=dead@11:00]" || expired.Reader().BlockReads() == 0 {
+		t.Fatalf("IncludeExpired scan = %s", got)
+	}
+}
+
+// 没有KeySchema写入的旧文件与设置KeySchema后刷盘的新文件混合读取：PrefixScanFields与按字节前缀的PrefixScan结果相同，
+// Levels只返回按当前schema写入的文件的前缀统计
+func TestLsmTree_PrefixScanFieldsMixedFiles(t *testing.T) {
+	key := func(tenant uint32, ts uint64) string {
+		return string(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint32(nil, tenant), ts))
+	}
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	old := map[string]string{}
+	for tenant := uint32(1); tenant <= 3; tenant++ {
+		for ts := uint64(0); ts < 10; ts++ {
+			old[key(tenant, ts)] = "old"
+		}
+	}
+	writeLevelSST(t, conf, 1, 0, old)
+
+	conf.KeySchema = config.NewKeySchema(4, 8)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for tenant := uint32(2); tenant <= 4; tenant++ {
+		for ts := uint64(5); ts < 15; ts++ {
+			if err := tree.Put([]byte(key(tenant, ts)), []byte("new")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tree.Delete([]byte(key(2, 0))); err != nil {
+		t.Fatal(err)
+	}
+	flushAll(t, tree)
+
+	collect := func(scan func(fn func(key, value []byte) bool) error) []string {
+		t.Helper()
+		var got []string
+		if err := scan(func(k, v []byte) bool {
+			got = append(got, fmt.Sprintf("%x=%s", k, v))
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	for _, values := range [][]uint64{{1}, {2}, {4}, {2, 7}, {5}, nil} {
+		got := collect(func(fn func(key, value []byte) bool) error { return tree.PrefixScanFields(values, fn) })
+		prefix, err := conf.KeySchema.Encode(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := collect(func(fn func(key, value []byte) bool) error { return tree.PrefixScan(prefix, fn) })
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("PrefixScanFields(%v) = %v, want %v", values, got, want)
+		}
+	}
+	if got := collect(func(fn func(key, value []byte) bool) error { return tree.PrefixScanFields([]uint64{2}, fn) }); len(got) != 14 {
+		t.Fatalf("tenant 2 has %d keys, want 14: %v", len(got), got)
+	}
+
+	levels := tree.Levels()
+	if files := levels[0].Files; len(files) != 1 || fmt.Sprint(files[0].DistinctPrefixes) != "[3 31]" {
+		t.Fatalf("L0 files %+v, want prefix stats [3 31]", files)
+	}
+	if files := levels[1].Files; len(files) != 1 || files[0].DistinctPrefixes != nil {
+		t.Fatalf("file written without a schema reports prefix stats: %+v", files)
+	}
+
+	plain, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.PrefixScanFields([]uint64{1}, func(key, value []byte) bool { return true }); !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("PrefixScanFields without a schema = %v, want ErrInvalidConfig", err)
+	}
+}
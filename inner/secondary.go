@@ -0,0 +1,377 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/manifest"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// maxCatchupRetries Catchup打开清单中的文件时文件已被删除，重新读取清单的最大次数
+const maxCatchupRetries = 3
+
+// SecondaryDB 只读地跟随另一个实例(主实例)正在写入的数据目录，可以在同一进程或其他进程中打开任意多个。
+// 不获取目录锁，也不修改目录中的任何文件。查找看到的是最近一次Catchup时的数据，
+// 两次Catchup之间的查找结果保持一致，每次Catchup之后看到的数据只会更新而不会回退
+type SecondaryDB struct {
+	tree      *LsmTree                 // 只使用读路径，没有当前WAL、清单和后台goroutine
+	catchupMu sync.Mutex               // 串行化Catchup和Close，同时保护wals
+	wals      map[uint32]*secondaryWal // 正在跟踪的WAL，内存表按id从旧到新排列在tree.immutableIndex中
+}
+
+// secondaryWal 跟踪的一个WAL文件及其记录重放到的内存表
+type secondaryWal struct {
+	id      uint32
+	reader  *wal.WalReader
+	imm     *immutable
+	applied int64 // 已重放到内存表的记录之后的偏移量，Catchup失败时从这里重新读取
+}
+
+// OpenSecondary 以只读方式打开conf.DataDir中主实例的数据并执行一次Catchup。
+// 目录中必须已有清单，即主实例至少打开过一次；主实例运行时或已关闭时都可以打开
+func OpenSecondary(conf *config.Config) (*SecondaryDB, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.Resolve(); err != nil {
+		return nil, err
+	}
+	if conf.LevelSize <= 0 {
+		conf.LevelSize = 1
+	}
+	nodes := make([][]*sst.Node, conf.LevelSize)
+	seq := make([]*atomic.Uint32, conf.LevelSize)
+	for i := range nodes {
+		nodes[i] = make([]*sst.Node, 0)
+		seq[i] = &atomic.Uint32{}
+	}
+	tree := &LsmTree{
+		conf:           conf,
+		immutableIndex: []*immutable{},
+		nodes:          nodes,
+		seq:            seq,
+		levelSize:      conf.LevelSize,
+		indexBudget:    sst.NewIndexBudget(conf.IndexMemoryBudget),
+		filterBudget:   sst.NewFilterBudget(conf.FilterMemoryBudget),
+		blockCache:     newBlockCache(conf.BlockCacheSize),
+		rowCache:       newRowCache(conf.RowCacheSize),
+	}
+	var err error
+	if tree.mutableIndex, err = tree.newMemTable(); err != nil {
+		return nil, err
+	}
+	db := &SecondaryDB{tree: tree, wals: make(map[uint32]*secondaryWal)}
+	if err := db.Catchup(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Catchup 跟上主实例：将各WAL中新追加的记录重放到内存表，重新读取清单以载入新安装的SST文件、
+// 移除已被压缩删除的文件，并丢弃已刷盘的WAL对应的内存表。新的视图在写锁内一次替换，
+// 被替换的文件在进行中的查找结束后关闭，主实例在此期间删除文件不影响这些查找。
+// 先读取WAL再读取清单：主实例在安装刷盘结果之后才删除WAL，读取WAL时已不存在的WAL的数据总在之后读到的清单中
+func (s *SecondaryDB) Catchup() error {
+	s.catchupMu.Lock()
+	defer s.catchupMu.Unlock()
+	t := s.tree
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+
+	pending, added, dropped, err := s.tailWals()
+	if err != nil {
+		return err
+	}
+	nodes, opened, err := s.readNodes()
+	if err != nil {
+		for _, sw := range added {
+			sw.reader.Close()
+		}
+		return err
+	}
+	// 与主实例移除不可变内存表的顺序一致，只丢弃开头连续的刷盘生成的文件已在新视图中的WAL。
+	// 更旧的WAL尚未刷盘时，已刷盘的较新WAL的内存表继续保留，使内存表中的数据总是比L0新
+	flushed := make(map[uint32]bool)
+	for _, level := range nodes {
+		for _, node := range level {
+			for _, walId := range node.SourceWals() {
+				flushed[walId] = true
+			}
+		}
+	}
+	for _, sw := range added {
+		s.wals[sw.id] = sw
+	}
+	for sw := range dropped {
+		delete(s.wals, sw.id)
+	}
+	ids := make([]uint32, 0, len(s.wals))
+	for id := range s.wals {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for len(ids) > 0 && flushed[ids[0]] {
+		sw := s.wals[ids[0]]
+		dropped[sw] = true
+		delete(pending, sw)
+		delete(s.wals, sw.id)
+		ids = ids[1:]
+	}
+	immutables := make([]*immutable, len(ids))
+	for i, id := range ids {
+		immutables[i] = s.wals[id].imm
+	}
+
+	t.mu.Lock()
+	var applyErr error
+	for sw, records := range pending {
+		for _, rec := range records {
+			if err := wal.Replay(sw.imm.index, rec); err != nil {
+				applyErr = errors.Join(applyErr, fmt.Errorf("replay %s: %w", wal.FileName(sw.id), err))
+				break
+			}
+		}
+	}
+	for _, sw := range s.wals {
+		sw.applied = sw.reader.Offset()
+	}
+	removed := make([]*sst.Node, 0)
+	for _, level := range t.nodes {
+		for _, node := range level {
+			if !opened[node] {
+				removed = append(removed, node)
+			}
+		}
+	}
+	t.nodes = nodes
+	t.immutableIndex = immutables
+	t.rowCache.clear()
+	t.mu.Unlock()
+
+	// 没有查找持有写锁之前的视图，可以关闭被移除的文件和WAL
+	for _, node := range removed {
+		if err := node.Reader().Close(); err != nil {
+			t.conf.Warnf("close secondary sst %s: %v", node.GetFilename(), err)
+		}
+	}
+	for sw := range dropped {
+		sw.reader.Close()
+	}
+	return applyErr
+}
+
+// tailWals 读取WAL目录中各WAL新追加的完整记录。已跟踪的WAL返回待重放的记录，在写锁内写入正在使用的内存表；
+// 新出现的WAL直接重放到新建的内存表中，替换视图时加入。主实例按从旧到新的顺序删除已刷盘的WAL，
+// 某个已跟踪的WAL不存在时，它和更旧的WAL都已刷盘，在dropped中返回
+func (s *SecondaryDB) tailWals() (map[*secondaryWal][]*wal.Record, []*secondaryWal, map[*secondaryWal]bool, error) {
+	t := s.tree
+	dir := t.conf.WalPath()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	present := make(map[uint32]bool)
+	for _, entry := range entries {
+		if !wal.IsFileName(entry.Name()) {
+			continue
+		}
+		walId, err := wal.ParseFileName(entry.Name())
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		present[walId] = true
+	}
+	var flushedBelow uint32 // 小于该id的WAL都已刷盘
+	for id := range s.wals {
+		if !present[id] && id+1 > flushedBelow {
+			flushedBelow = id + 1
+		}
+	}
+
+	pending := make(map[*secondaryWal][]*wal.Record)
+	var added []*secondaryWal
+	dropped := make(map[*secondaryWal]bool)
+	closeAdded := func() {
+		for _, sw := range added {
+			sw.reader.Close()
+		}
+	}
+	for id, sw := range s.wals {
+		if id < flushedBelow {
+			dropped[sw] = true
+			continue
+		}
+		sw.reader.SetOffset(sw.applied)
+		for {
+			rec, _, err := sw.reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closeAdded()
+				return nil, nil, nil, fmt.Errorf("tail %s: %w", wal.FileName(id), err)
+			}
+			pending[sw] = append(pending[sw], rec)
+		}
+	}
+	for id := range present {
+		if s.wals[id] != nil || id < flushedBelow {
+			continue
+		}
+		reader, err := wal.NewReader(filepath.Join(dir, wal.FileName(id)))
+		if errors.Is(err, fs.ErrNotExist) {
+			// 列出目录之后被删除，数据已在清单中
+			continue
+		}
+		if err != nil {
+			closeAdded()
+			return nil, nil, nil, err
+		}
+		index, err := t.newMemTable()
+		if err != nil {
+			reader.Close()
+			closeAdded()
+			return nil, nil, nil, err
+		}
+		sw := &secondaryWal{id: id, reader: reader, imm: &immutable{index: index}}
+		added = append(added, sw)
+		for {
+			rec, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = wal.Replay(sw.imm.index, rec)
+			}
+			if err != nil {
+				closeAdded()
+				return nil, nil, nil, fmt.Errorf("tail %s: %w", wal.FileName(id), err)
+			}
+		}
+		sw.applied = reader.Offset()
+	}
+	return pending, added, dropped, nil
+}
+
+// readNodes 读取清单并返回各层节点，仍然指向同一个文件的节点沿用当前的读取器，opened记录其中所有的节点。
+// 清单中的文件在打开前被主实例删除时重新读取清单
+func (s *SecondaryDB) readNodes() ([][]*sst.Node, map[*sst.Node]bool, error) {
+	t := s.tree
+	current := make(map[sstFile]*sst.Node)
+	for _, level := range t.nodes {
+		for _, node := range level {
+			current[sstFile{level: node.GetLevel(), seq: uint32(node.GetSeq()), filePath: node.GetFilename()}] = node
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		nodes, opened, err := s.openManifestFiles(current)
+		if errors.Is(err, fs.ErrNotExist) && attempt < maxCatchupRetries {
+			continue
+		}
+		return nodes, opened, err
+	}
+}
+
+// openManifestFiles 按清单打开各层节点，出错时关闭本次新打开的读取器
+func (s *SecondaryDB) openManifestFiles(current map[sstFile]*sst.Node) ([][]*sst.Node, map[*sst.Node]bool, error) {
+	t := s.tree
+	files, err := manifest.ReadFiles(t.conf, t.conf.DataDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make([][]*sst.Node, t.levelSize)
+	for i := range nodes {
+		nodes[i] = make([]*sst.Node, 0)
+	}
+	opened := make(map[*sst.Node]bool)
+	var created []*sst.Node
+	fail := func(err error) ([][]*sst.Node, map[*sst.Node]bool, error) {
+		for _, node := range created {
+			node.Reader().Close()
+		}
+		return nil, nil, err
+	}
+	// 清单按层级和序列号排列，层内节点从旧到新
+	for _, file := range files {
+		if file.Level < 0 || file.Level >= t.levelSize {
+			return fail(fmt.Errorf("%w: manifest references %s at level %d, LevelSize is %d",
+				myerror.ErrSSTCorrupted, file.Path, file.Level, t.levelSize))
+		}
+		path := filepath.Join(t.conf.SSTPath(), filepath.FromSlash(file.Path))
+		// 压缩可能重写文件并替换同名的文件，只有仍是同一个文件时才沿用读取器
+		node := current[sstFile{level: file.Level, seq: file.Seq, filePath: path}]
+		if node == nil || !node.Reader().SameFile(path) {
+			reader, err := sst.NewLazySSTReader(t.conf, path)
+			if err != nil {
+				return fail(err)
+			}
+			reader.AttachBudget(t.indexBudget)
+			reader.AttachFilterBudget(t.filterBudget)
+			reader.AttachBlockCache(t.blockCache)
+			if node, err = sst.NewNode(t.conf, path, file.Level, int32(file.Seq), reader); err != nil {
+				reader.Close()
+				return fail(err)
+			}
+			node.SetSourceWals(file.SourceWals)
+			created = append(created, node)
+		}
+		opened[node] = true
+		nodes[file.Level] = append(nodes[file.Level], node)
+	}
+	return nodes, opened, nil
+}
+
+// Get 查找key，语义与LsmTree.Get相同，结果为最近一次Catchup时的数据
+func (s *SecondaryDB) Get(key []byte) ([]byte, error) {
+	return s.tree.Get(key)
+}
+
+// GetWithOptions 按opts查找key，见LsmTree.GetWithOptions
+func (s *SecondaryDB) GetWithOptions(key []byte, opts ReadOptions) ([]byte, error) {
+	return s.tree.GetWithOptions(key, opts)
+}
+
+// GetWithTimestamp 查找key，同时返回写入时间
+func (s *SecondaryDB) GetWithTimestamp(key []byte) ([]byte, int64, error) {
+	return s.tree.GetWithTimestamp(key)
+}
+
+// PrefixScan 按key顺序遍历所有以prefix开头且未被删除的键值对，见LsmTree.PrefixScan
+func (s *SecondaryDB) PrefixScan(prefix []byte, fn func(key, value []byte) bool) error {
+	return s.tree.PrefixScan(prefix, fn)
+}
+
+// Close 关闭所有文件，可以重复调用。关闭后查找和Catchup返回ErrDBClosed，Close会等待进行中的查找结束
+func (s *SecondaryDB) Close() error {
+	s.catchupMu.Lock()
+	defer s.catchupMu.Unlock()
+	t := s.tree
+	if t.closed.Swap(true) {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for _, level := range t.nodes {
+		for _, node := range level {
+			errs = append(errs, node.Reader().Close())
+		}
+	}
+	for _, sw := range s.wals {
+		errs = append(errs, sw.reader.Close())
+	}
+	return errors.Join(errs...)
+}
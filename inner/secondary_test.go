@@ -0,0 +1,229 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// newSecondaryConfig 返回读取conf所在目录的只读实例使用的配置
+func newSecondaryConfig(conf *config.Config) *config.Config {
+	sconf := config.DefaultConfig()
+	sconf.DataDir = conf.DataDir
+	sconf.IsDebug = false
+	sconf.LevelSize = conf.LevelSize
+	return sconf
+}
+
+func TestSecondaryDB_Catchup(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20 // 只在测试中轮转WAL
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for i := 0; i < 10; i++ {
+		if err := tree.Put([]byte(fmt.Sprintf("key-%d", i)), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	if err := tree.Put([]byte("key-0"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 主实例持有目录锁时也可以打开，SST和WAL中的数据都可见
+	secondary, err := OpenSecondary(newSecondaryConfig(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	getSecondary := func(key, want string) {
+		t.Helper()
+		value, err := secondary.Get([]byte(key))
+		if want == "" {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get(%s) = %q, %v, want not found", key, value, err)
+			}
+			return
+		}
+		if err != nil || string(value) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+	getSecondary("key-0", "v2")
+	getSecondary("key-9", "v1")
+
+	// Catchup之前看到的是打开时的数据
+	if err := tree.Put([]byte("key-1"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("key-2")); err != nil {
+		t.Fatal(err)
+	}
+	getSecondary("key-1", "v1")
+	getSecondary("key-2", "v1")
+	if err := secondary.Catchup(); err != nil {
+		t.Fatal(err)
+	}
+	getSecondary("key-1", "v2")
+	getSecondary("key-2", "")
+
+	// 刷盘并压缩后，被删除的WAL和SST文件对应的数据仍然可见，旧的读取器被关闭
+	flushAll(t, tree)
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondary.Catchup(); err != nil {
+		t.Fatal(err)
+	}
+	// 只跟踪主实例当前的WAL
+	if len(secondary.wals) != 1 || secondary.wals[tree.curWal.ID()] == nil {
+		t.Fatalf("secondary tracks %d wals, want only the current wal %d", len(secondary.wals), tree.curWal.ID())
+	}
+	getSecondary("key-0", "v2")
+	getSecondary("key-1", "v2")
+	getSecondary("key-2", "")
+	getSecondary("key-9", "v1")
+	var keys []string
+	if err := secondary.PrefixScan([]byte("key-"), func(key, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 9 {
+		t.Fatalf("PrefixScan = %v, want 9 keys", keys)
+	}
+
+	if err := secondary.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secondary.Get([]byte("key-0")); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Get after Close = %v, want ErrDBClosed", err)
+	}
+	if err := secondary.Catchup(); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Catchup after Close = %v, want ErrDBClosed", err)
+	}
+}
+
+func TestSecondaryDB_RequiresManifest(t *testing.T) {
+	conf := newTestConfig(t)
+	if _, err := OpenSecondary(conf); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenSecondary on empty dir = %v, want not exist", err)
+	}
+	entries, err := os.ReadDir(conf.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("OpenSecondary created %d entries in the data dir", len(entries))
+	}
+}
+
+// TestSecondaryDB_FollowsPrimary 主实例不断写入并在后台刷盘和压缩，多个只读实例循环Catchup，
+// 每个key的值只增不减，且Catchup之前已完成的写入全部可见
+func TestSecondaryDB_FollowsPrimary(t *testing.T) {
+	const (
+		keys   = 50
+		rounds = 60
+	)
+	conf := newTestConfig(t)
+	conf.WalSize = 2 << 10
+	conf.LevelSize = 3
+	conf.MaxFilesPerLevel = []int{1, 2}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%03d", i)) }
+	for i := 0; i < keys; i++ {
+		if err := tree.Put(key(i), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var done atomic.Int64 // 已完成的轮数
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		defer close(stop)
+		for round := 1; round <= rounds; round++ {
+			for i := 0; i < keys; i++ {
+				if err := tree.Put(key(i), []byte(strconv.Itoa(round))); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+			done.Store(int64(round))
+			if round%20 == 0 {
+				if err := tree.Vacuum(context.Background()); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			secondary, err := OpenSecondary(newSecondaryConfig(conf))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer secondary.Close()
+			seen := make([]int, keys)
+			for catchups := 0; ; catchups++ {
+				finished := false
+				select {
+				case <-stop:
+					finished = true
+				default:
+				}
+				fresh := int(done.Load())
+				if err := secondary.Catchup(); err != nil {
+					t.Errorf("catchup %d: %v", catchups, err)
+					return
+				}
+				for i := 0; i < keys; i++ {
+					value, err := secondary.Get(key(i))
+					if err != nil {
+						t.Errorf("catchup %d: Get(%s): %v", catchups, key(i), err)
+						return
+					}
+					got, err := strconv.Atoi(string(value))
+					if err != nil {
+						t.Errorf("catchup %d: Get(%s) = %q", catchups, key(i), value)
+						return
+					}
+					if got < seen[i] || got < fresh {
+						t.Errorf("catchup %d: Get(%s) = %d, previously %d, %d rounds done before catchup",
+							catchups, key(i), got, seen[i], fresh)
+						return
+					}
+					seen[i] = got
+				}
+				if finished {
+					return
+				}
+			}
+		}()
+	}
+	writer.Wait()
+	readers.Wait()
+}
@@ -0,0 +1,133 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// shadowLimiter 限制每秒校验的Get次数
+type shadowLimiter struct {
+	mu     sync.Mutex
+	window time.Time // 当前一秒计数窗口的开始时间
+	count  int       // 窗口内已校验的次数
+}
+
+// allow 判断now时刻是否还可以校验一次读取，允许时计入当前窗口
+func (l *shadowLimiter) allow(now time.Time, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= time.Second || now.Before(l.window) {
+		l.window, l.count = now, 0
+	}
+	if l.count >= limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// shadowVerify 开启ShadowVerifyReads时逐条扫描重新计算key的结果，与正常查找得到的value和err比较，
+// 不一致时返回待上报的结果。在Get持有的读锁内调用，不获取其他锁，两次查找看到的是同一状态
+func (t *LsmTree) shadowVerify(key, value []byte, err error, info *readInfo) *config.ShadowMismatch {
+	if !t.conf.ShadowVerifyReads {
+		return nil
+	}
+	// 正常查找出错时没有可比较的结果
+	if err != nil && !errors.Is(err, myerror.ErrKeyNotFound) {
+		return nil
+	}
+	limit := t.conf.ShadowVerifyPerSec
+	if limit <= 0 {
+		limit = config.DefaultShadowVerifyPerSec
+	}
+	if !t.shadow.allow(t.conf.Now(), limit) {
+		return nil
+	}
+
+	fast := config.ShadowAnswer{Found: err == nil, Source: info.source, File: info.file}
+	if fast.Found {
+		fast.Value = value
+	}
+	slow, err := t.scanAnswer(key)
+	if err != nil {
+		t.conf.Warnf("shadow verify: key %q: %v", key, err)
+		return nil
+	}
+	if fast.Found == slow.Found && bytes.Equal(fast.Value, slow.Value) {
+		return nil
+	}
+	return &config.ShadowMismatch{Key: bytes.Clone(key), Fast: fast, Slow: slow}
+}
+
+// reportShadowMismatch 上报shadowVerify发现的不一致，m为nil时不做任何事。
+// 在释放读锁后调用，回调中可以继续读写
+func (t *LsmTree) reportShadowMismatch(m *config.ShadowMismatch) {
+	if m == nil {
+		return
+	}
+	if t.conf.OnShadowMismatch != nil {
+		t.conf.OnShadowMismatch(*m)
+		return
+	}
+	t.conf.Errorf("shadow verify mismatch: %s", m)
+}
+
+// scanAnswer 按与Get相同的优先级查找key，但逐条遍历内存表，并逐个解码key范围覆盖key的SST文件的全部数据块，
+// 不使用过滤器和数据块索引。调用方持有读锁
+func (t *LsmTree) scanAnswer(key []byte) (config.ShadowAnswer, error) {
+	if entry, ok := scanMemTable(t.mutableIndex, key); ok {
+		return entryAnswer(entry, sourceMutable, ""), nil
+	}
+	for i := len(t.immutableIndex) - 1; i >= 0; i-- {
+		if entry, ok := scanMemTable(t.immutableIndex[i].index, key); ok {
+			return entryAnswer(entry, sourceImmutable, ""), nil
+		}
+	}
+	for level, nodes := range t.nodes {
+		for i := len(nodes) - 1; i >= 0; i-- {
+			node := nodes[i]
+			if bytes.Compare(key, node.GetMinKey()) < 0 || bytes.Compare(key, node.GetMaxKey()) > 0 {
+				continue
+			}
+			found, err := node.Reader().ScanEntry(key)
+			if errors.Is(err, myerror.ErrKeyNotFound) {
+				continue
+			}
+			if err != nil {
+				return config.ShadowAnswer{}, err
+			}
+			return entryAnswer(found.Entry, levelSource(level), node.GetFilename()), nil
+		}
+	}
+	return config.ShadowAnswer{Source: sourceNone}, nil
+}
+
+// scanMemTable 逐条遍历内存表查找key的条目
+func scanMemTable(table memtable.MemTable, key []byte) (kv.Entry, bool) {
+	var found kv.Entry
+	var ok bool
+	table.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+		if bytes.Equal(entry.Key, key) {
+			found, ok = entry, true
+			return false
+		}
+		return true
+	})
+	return found, ok
+}
+
+// entryAnswer 将查找到的条目转换为校验结果，删除标记视为未找到
+func entryAnswer(entry kv.Entry, source, file string) config.ShadowAnswer {
+	answer := config.ShadowAnswer{Source: source, File: file}
+	if !entry.IsDelete() {
+		answer.Found, answer.Value = true, entry.Value
+	}
+	return answer
+}
@@ -0,0 +1,191 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+)
+
+// rejectFilter 判定所有key都不存在的过滤器，用于模拟过滤器错误
+type rejectFilter struct{}
+
+func (rejectFilter) Add(key []byte)           {}
+func (rejectFilter) Contains(key []byte) bool { return false }
+func (rejectFilter) Save() []byte             { return nil }
+func (rejectFilter) Load(data []byte) error   { return nil }
+func (rejectFilter) Reset()                   {}
+func (rejectFilter) SizeBytes() int           { return 0 }
+
+// mismatchRecorder 记录OnShadowMismatch上报的不一致
+type mismatchRecorder struct {
+	mu         sync.Mutex
+	mismatches []config.ShadowMismatch
+}
+
+func (r *mismatchRecorder) record(m config.ShadowMismatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mismatches = append(r.mismatches, m)
+}
+
+func (r *mismatchRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.mismatches)
+}
+
+// openPoisonedTree 在L0写入key000-key009，打开后将该文件的过滤器替换为rejectFilter
+func openPoisonedTree(t *testing.T, conf *config.Config) *LsmTree {
+	t.Helper()
+	kvs := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		kvs[fmt.Sprintf("key%03d", i)] = fmt.Sprintf("value%03d", i)
+	}
+	writeLevelSST(t, conf, 0, 1, kvs)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := tree.nodes[0][0].Reader().Filter()
+	if len(filters) == 0 {
+		t.Fatal("sst has no filter to poison")
+	}
+	for offset := range filters {
+		filters[offset] = rejectFilter{}
+	}
+	return tree
+}
+
+func TestLsmTree_ShadowVerifyPoisonedFilter(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.ShadowVerifyReads = true
+	recorder := &mismatchRecorder{}
+	var tree *LsmTree
+	conf.OnShadowMismatch = func(m config.ShadowMismatch) {
+		recorder.record(m)
+		// 回调在释放读锁后调用，可以继续写入
+		if err := tree.Put([]byte("reported"), []byte("1")); err != nil {
+			t.Errorf("Put in callback: %v", err)
+		}
+	}
+	tree = openPoisonedTree(t, conf)
+	defer tree.Close()
+
+	// 仍然返回正常查找的结果
+	if _, err := tree.Get([]byte("key005")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(key005) = %v, want the poisoned fast answer ErrKeyNotFound", err)
+	}
+	if recorder.count() != 1 {
+		t.Fatalf("got %d mismatches, want 1", recorder.count())
+	}
+	m := recorder.mismatches[0]
+	file := tree.nodes[0][0].GetFilename()
+	if string(m.Key) != "key005" || m.Fast.Found || m.Fast.Source != sourceNone {
+		t.Fatalf("fast answer = %s for %q", m.Fast, m.Key)
+	}
+	if !m.Slow.Found || string(m.Slow.Value) != "value005" || m.Slow.Source != "L0" || m.Slow.File != file {
+		t.Fatalf("slow answer = %s, want value005 from L0 %s", m.Slow, file)
+	}
+
+	// 其他读取接口同样校验，两条路径一致时不上报
+	if _, _, err := tree.GetWithTimestamp([]byte("key001")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetWithTimestamp(key001) = %v", err)
+	}
+	if _, _, err := tree.GetWithTrace([]byte("key002")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("GetWithTrace(key002) = %v", err)
+	}
+	if _, err := tree.Get([]byte("reported")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatal(err)
+	}
+	if recorder.count() != 3 {
+		t.Fatalf("got %d mismatches, want 3", recorder.count())
+	}
+}
+
+func TestLsmTree_ShadowVerifyRateLimit(t *testing.T) {
+	conf := newTestConfig(t)
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.ShadowVerifyReads = true
+	conf.ShadowVerifyPerSec = 3
+	recorder := &mismatchRecorder{}
+	conf.OnShadowMismatch = recorder.record
+	tree := openPoisonedTree(t, conf)
+	defer tree.Close()
+
+	for i := 0; i < 10; i++ {
+		tree.Get([]byte("key007"))
+	}
+	if recorder.count() != 3 {
+		t.Fatalf("got %d mismatches in one second, want 3", recorder.count())
+	}
+	clock.Advance(time.Second)
+	for i := 0; i < 10; i++ {
+		tree.Get([]byte("key007"))
+	}
+	if recorder.count() != 6 {
+		t.Fatalf("got %d mismatches after one more second, want 6", recorder.count())
+	}
+}
+
+// TestLsmTree_ShadowVerifyConsistent 覆盖、删除分布在内存表和多层SST中时两条路径的结果一致
+func TestLsmTree_ShadowVerifyConsistent(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.ShadowVerifyReads = true
+	conf.ShadowVerifyPerSec = 1 << 30
+	recorder := &mismatchRecorder{}
+	conf.OnShadowMismatch = recorder.record
+
+	rng := rand.New(rand.NewSource(1))
+	key := func(i int) string { return fmt.Sprintf("key%03d", i) }
+	for level := 2; level >= 0; level-- {
+		var entries []kv.Entry
+		for i := 0; i < 100; i++ {
+			switch rng.Intn(3) {
+			case 0:
+				entries = append(entries, kv.Entry{Key: []byte(key(i)), Value: []byte(fmt.Sprintf("L%d-%d", level, i))})
+			case 1:
+				entries = append(entries, kv.Entry{Key: []byte(key(i)), Kind: kv.KindDelete})
+			}
+		}
+		writeLevelEntries(t, conf, level, uint32(3-level), entries)
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i += 1 + rng.Intn(3) {
+			if rng.Intn(2) == 0 {
+				err = tree.Put([]byte(key(i)), []byte(fmt.Sprintf("mem%d-%d", round, i)))
+			} else {
+				err = tree.Delete([]byte(key(i)))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 前两轮的写入留在不可变内存表中，最后一轮留在可变内存表中
+		if round < 2 {
+			imm := rotateAndHold(t, tree)
+			defer releaseHeld(tree, imm)
+		}
+	}
+
+	for i := 0; i < 110; i++ {
+		tree.Get([]byte(key(i)))
+	}
+	if recorder.count() != 0 {
+		t.Fatalf("unexpected mismatches: %v", recorder.mismatches)
+	}
+}
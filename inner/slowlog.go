@@ -0,0 +1,56 @@
+package inner
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	sourceNone      = "none"      // 未命中任何层级
+	sourceMutable   = "mutable"   // 可变内存表
+	sourceImmutable = "immutable" // 不可变内存表
+	sourceRowCache  = "rowcache"  // 行缓存
+)
+
+// readInfo 记录一次读取的来源，用于慢操作日志
+type readInfo struct {
+	source string    // 满足读取的层级
+	file   string    // 来自SST时的文件名
+	bloom  bool      // 是否查询过布隆过滤器
+	trace  *GetTrace // 查找过程，为nil时不记录
+	cached bool      // 是否查找和填充行缓存，事务读取和GetWithTrace不使用行缓存
+}
+
+// levelSource 返回SST层级对应的来源名称
+func levelSource(level int) string {
+	return fmt.Sprintf("L%d", level)
+}
+
+// observeOp 记录一次点操作的耗时分布，超过SlowOpThreshold时输出慢操作日志
+func (t *LsmTree) observeOp(op LatencyOp, key []byte, elapsed time.Duration, info *readInfo) {
+	t.recordLatency(op, elapsed)
+	t.logSlowOp(op.String(), key, elapsed, info)
+}
+
+// logSlowOp 当操作耗时超过SlowOpThreshold时输出一条慢操作日志
+func (t *LsmTree) logSlowOp(op string, key []byte, elapsed time.Duration, info *readInfo) {
+	threshold := t.conf.SlowOpThreshold
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	if info == nil {
+		t.conf.Warnf("slow op: op=%s key_size=%d duration=%s", op, len(key), elapsed)
+		return
+	}
+	t.conf.Warnf("slow op: op=%s key_size=%d duration=%s level=%s bloom=%t",
+		op, len(key), elapsed, info.source, info.bloom)
+}
+
+// logSlowFlush 当刷盘耗时超过SlowFlushThreshold时输出一条慢操作日志
+func (t *LsmTree) logSlowFlush(elapsed time.Duration) {
+	threshold := t.conf.SlowFlushThreshold
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	t.conf.Warnf("slow op: op=flush duration=%s", elapsed)
+}
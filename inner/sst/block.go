@@ -3,18 +3,72 @@ package sst
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"sync"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
 )
 
+// 数据块条目编码版本，记录在元数据MetaBlockFormat中，没有该项的旧文件为旧版本
+const (
+	BlockFormatLegacy uint8 = 0 // 旧版本: keyLen(4) valueLen(4) key value，nil与空value无法区分
+	BlockFormat1      uint8 = 1 // 增加标志位: keyLen(4) valueLen(4) flags(1) key value
+	BlockFormat2      uint8 = 2 // 标志位可带时间戳: keyLen(4) valueLen(4) flags(1) [timestamp(8)] key value
+	BlockFormat3      uint8 = 3 // 标志位可带校验和: keyLen(4) valueLen(4) flags(1) [timestamp(8)] key value [crc(4)]
+	BlockFormat4      uint8 = 4 // 标志位可带条目类型、序列号和过期时间: ... flags(1) [timestamp(8)] [kind(1)] [seq(8)] [ttl(8)] key value [crc(4)]
+	BlockFormat5      uint8 = 5 // 删除标记不写value长度: keyLen(4) flags(1) [valueLen(4)] [timestamp(8)] ... key value [crc(4)]
+	BlockFormat             = BlockFormat5
+)
+
+// 过滤器区编码版本，记录在元数据MetaFilterFormat中，没有该项的旧文件为旧版本
+const (
+	FilterFormatLegacy uint8 = 0 // 旧版本: blockLength(8) filterLen(4) filter，第i个过滤器对应第i个数据块
+	FilterFormat1      uint8 = 1 // blockOffset(8) filterLen(4) filter，没有过滤器的数据块不写入
+	FilterFormat             = FilterFormat1
+)
+
+// 条目标志位
+const (
+	entryFlagValue     uint8 = 1 << 0 // value存在，未设置时value为nil(删除标记)
+	entryFlagTimestamp uint8 = 1 << 1 // 标志位之后有8字节写入时间，未设置时时间为0且不占用字节
+	entryFlagChecksum  uint8 = 1 << 2 // value之后有4字节key和value的crc32
+	entryFlagKind      uint8 = 1 << 3 // 之后有1字节条目类型，未设置时由entryFlagValue决定为写入或删除标记
+	entryFlagSeq       uint8 = 1 << 4 // 之后有8字节序列号，未设置时为0
+	entryFlagTTL       uint8 = 1 << 5 // 之后有8字节过期时间，未设置时为0
+)
+
+// EntryChecksumError 条目的key和value与写入时记录的校验和不一致
+type EntryChecksumError struct {
+	Key    []byte // 条目的key
+	File   string // SST文件路径
+	Offset int64  // 条目在文件中的偏移量
+}
+
+func (e *EntryChecksumError) Error() string {
+	return fmt.Sprintf("entry checksum mismatch: key %q in %s at offset %d", e.Key, e.File, e.Offset)
+}
+
+// Is 使errors.Is(err, myerror.ErrSSTCorrupted)成立
+func (e *EntryChecksumError) Is(target error) bool {
+	return target == myerror.ErrSSTCorrupted
+}
+
+// entryChecksum 计算key和value的crc32
+func entryChecksum(key, value []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(key), crc32.IEEETable, value)
+}
+
 type Block struct {
 	conf       *config.Config // 配置
 	dataBuf    *bytes.Buffer  // 数据缓冲区
-	entriesCnt int64          // 条目数量
-	firstKey   []byte         // 第一个写入的key
-	lastKey    []byte         // 最后写一个写入的key
+	entriesCnt uint32         // 条目数量，与索引中的EntryCount一致
+	firstKey   []byte         // 第一个写入的key的副本
+	lastKey    []byte         // 最后写一个写入的key的副本
+	header     []byte         // 编码条目头部的缓冲区，每次Add复用
 	mu         sync.RWMutex   // 互斥锁
 }
 
@@ -28,20 +82,22 @@ func NewBlock(conf *config.Config) *Block {
 	}
 }
 
-func (b *Block) Add(key, value []byte) error {
+// Add 添加条目，写入时间、序列号、过期时间以及写入和删除标记之外的条目类型只在需要时占用额外的字节
+func (b *Block) Add(entry kv.Entry) error {
+	entry = entry.Normalize()
+	key, value := entry.Key, entry.Value
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	// 首尾key在切换数据块时才写入索引，复制一份，调用方之后修改或复用key的内存不影响索引
 	if b.entriesCnt == 0 {
-		b.firstKey = key
+		b.firstKey = bytes.Clone(key)
 	}
-
-	b.lastKey = key
+	b.lastKey = append(b.lastKey[:0], key...)
 	b.entriesCnt++
-	if err := binary.Write(b.dataBuf, binary.BigEndian, uint32(len(key))); err != nil {
-		return err
-	}
-	if err := binary.Write(b.dataBuf, binary.BigEndian, uint32(len(value))); err != nil {
+	b.header = appendEntryHeader(b.header[:0], entry, b.conf.PerEntryChecksum)
+	if _, err := b.dataBuf.Write(b.header); err != nil {
 		return err
 	}
 	if _, err := b.dataBuf.Write(key); err != nil {
@@ -50,16 +106,252 @@ func (b *Block) Add(key, value []byte) error {
 	if _, err := b.dataBuf.Write(value); err != nil {
 		return err
 	}
+	if b.conf.PerEntryChecksum {
+		b.header = binary.BigEndian.AppendUint32(b.header[:0], entryChecksum(key, value))
+		if _, err := b.dataBuf.Write(b.header); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// FilterAdd 添加过滤器数据
-func (b *Block) FilterAdd(length int64, value []byte) error {
+// appendEntryHeader 将条目在key之前的部分追加到buf：key长度、标志位、value存在时的value长度以及标志位对应的可选字段，
+// 之后依次是key、value和开启校验时的crc32
+func appendEntryHeader(buf []byte, entry kv.Entry, checksum bool) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.Key)))
+	flags := entryFlags(entry, checksum)
+	buf = append(buf, flags)
+	if flags&entryFlagValue != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.Value)))
+	}
+	if flags&entryFlagTimestamp != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.Timestamp))
+	}
+	if flags&entryFlagKind != 0 {
+		buf = append(buf, byte(entry.Kind))
+	}
+	if flags&entryFlagSeq != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, entry.Seq)
+	}
+	if flags&entryFlagTTL != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(entry.TTL))
+	}
+	return buf
+}
+
+// entryFlags 返回按当前格式编码entry使用的标志位
+func entryFlags(entry kv.Entry, checksum bool) uint8 {
+	var flags uint8
+	if entry.Kind != kv.KindDelete {
+		flags |= entryFlagValue
+	}
+	if entry.Timestamp != 0 {
+		flags |= entryFlagTimestamp
+	}
+	if entry.Kind != kv.KindPut && entry.Kind != kv.KindDelete {
+		flags |= entryFlagKind
+	}
+	if entry.Seq != 0 {
+		flags |= entryFlagSeq
+	}
+	if entry.TTL != 0 {
+		flags |= entryFlagTTL
+	}
+	if checksum {
+		flags |= entryFlagChecksum
+	}
+	return flags
+}
+
+// flagsSize 返回标志位对应的可选字段占用的字节数
+func flagsSize(flags uint8) int64 {
+	var size int64
+	if flags&entryFlagTimestamp != 0 {
+		size += 8
+	}
+	if flags&entryFlagKind != 0 {
+		size++
+	}
+	if flags&entryFlagSeq != 0 {
+		size += 8
+	}
+	if flags&entryFlagTTL != 0 {
+		size += 8
+	}
+	if flags&entryFlagChecksum != 0 {
+		size += 4
+	}
+	return size
+}
+
+// entryHeaderSize 返回按format编码、标志位为flags的条目不带可选字段的头部字节数。
+// BlockFormat5起删除标记没有value长度，flags为0时返回该格式下最短的头部
+func entryHeaderSize(format, flags uint8) int64 {
+	switch {
+	case format == BlockFormatLegacy:
+		return 8
+	case format >= BlockFormat5 && flags&entryFlagValue == 0:
+		return 5
+	}
+	return 9
+}
+
+// entrySize 返回按当前格式编码一个条目占用的字节数
+func entrySize(entry kv.Entry, checksum bool) int64 {
+	flags := entryFlags(entry, checksum)
+	return entryHeaderSize(BlockFormat, flags) + int64(len(entry.Key)+len(entry.Value)) + flagsSize(flags)
+}
+
+// encodedSize 返回已解析的条目按format编码时占用的字节数
+func encodedSize(kv *KeyValue, format uint8) int64 {
+	size := int64(len(kv.Key) + len(kv.Value))
+	if format == BlockFormatLegacy {
+		return entryHeaderSize(format, 0) + size
+	}
+	flags := entryFlags(kv.Entry, kv.hasCrc)
+	return entryHeaderSize(format, flags) + size + flagsSize(flags)
+}
+
+// 条目被截断时decodeEntry返回的错误，都可以通过errors.Is判断为ErrInvalidSSTFormat
+var (
+	errEntryHeaderTruncated   = fmt.Errorf("%w: %w", myerror.ErrInvalidSSTFormat, myerror.ErrEntryHeaderTruncated)
+	errEntryKeyTruncated      = fmt.Errorf("%w: %w", myerror.ErrInvalidSSTFormat, myerror.ErrEntryKeyTruncated)
+	errEntryValueTruncated    = fmt.Errorf("%w: %w", myerror.ErrInvalidSSTFormat, myerror.ErrEntryValueTruncated)
+	errEntryChecksumTruncated = fmt.Errorf("%w: %w", myerror.ErrInvalidSSTFormat, myerror.ErrEntryChecksumTruncated)
+)
+
+// decodeEntry 按format解析data开头的一个条目并校验校验和，见decodeEntryWith
+func decodeEntry(data []byte, format uint8) (*KeyValue, int64, error) {
+	return decodeEntryWith(data, format, true)
+}
+
+// decodeEntryWith 同decodeEntryInto，返回新分配的条目及其占用的字节数，出错时不返回条目
+func decodeEntryWith(data []byte, format uint8, verify bool) (*KeyValue, int64, error) {
+	kv := new(KeyValue)
+	n, err := decodeEntryInto(kv, data, format, verify)
+	if err != nil {
+		return nil, 0, err
+	}
+	return kv, n, nil
+}
+
+// decodeEntryInto 按format将data开头的一个条目解析到dst中，返回条目占用的字节数，是解析数据块条目的唯一入口，
+// 本身不分配内存，逐条遍历的迭代器用它复用同一个dst。
+// 所有长度都先与len(data)比较再切片，不会出现短读：data为空时返回io.EOF，表示恰好在条目边界结束；
+// 头部(含可选字段)、key、value或校验和不完整时分别返回包装了ErrEntryHeaderTruncated、ErrEntryKeyTruncated、
+// ErrEntryValueTruncated或ErrEntryChecksumTruncated的错误，其他格式错误返回ErrInvalidSSTFormat，出错时dst的内容未定义。
+// 返回的key和value引用data，旧版本文件中的条目一律解析为写入，长度为0的value解析为空value；
+// 没有类型字段的条目按value是否存在解析为写入或删除标记，没有时间戳、序列号和过期时间的条目这些字段为0。
+// 条目带校验和且verify为true时先校验，不一致时返回Offset为0、未设置File的*EntryChecksumError，由调用方补全位置；
+// verify为false时只记录校验和，之后可以用verify方法校验
+func decodeEntryInto(dst *KeyValue, data []byte, format uint8, verify bool) (int64, error) {
+	if len(data) == 0 {
+		return 0, io.EOF
+	}
+	header := entryHeaderSize(format, 0)
+	if int64(len(data)) < header {
+		return 0, errEntryHeaderTruncated
+	}
+	keyLen := int64(binary.BigEndian.Uint32(data[0:4]))
+	var valueLen int64
+	var flags uint8
+	switch {
+	case format == BlockFormatLegacy:
+		valueLen = int64(binary.BigEndian.Uint32(data[4:8]))
+	case format < BlockFormat5:
+		valueLen = int64(binary.BigEndian.Uint32(data[4:8]))
+		flags = data[8]
+	default:
+		flags = data[4]
+		if header = entryHeaderSize(format, flags); int64(len(data)) < header {
+			return 0, errEntryHeaderTruncated
+		}
+		if flags&entryFlagValue != 0 {
+			valueLen = int64(binary.BigEndian.Uint32(data[5:9]))
+		}
+	}
+	entry := kv.Entry{Kind: kv.KindPut}
+	if format != BlockFormatLegacy {
+		known := entryFlagValue
+		if format >= BlockFormat2 {
+			known |= entryFlagTimestamp
+		}
+		if format >= BlockFormat3 {
+			known |= entryFlagChecksum
+		}
+		if format >= BlockFormat4 {
+			known |= entryFlagKind | entryFlagSeq | entryFlagTTL
+		}
+		if flags&^known != 0 {
+			return 0, myerror.ErrInvalidSSTFormat
+		}
+		present := flags&entryFlagValue != 0
+		if !present {
+			entry.Kind = kv.KindDelete
+			if valueLen != 0 {
+				return 0, myerror.ErrInvalidSSTFormat
+			}
+		}
+		optional := flagsSize(flags &^ entryFlagChecksum)
+		if int64(len(data)) < header+optional {
+			return 0, errEntryHeaderTruncated
+		}
+		fields := data[header : header+optional]
+		if flags&entryFlagTimestamp != 0 {
+			entry.Timestamp = int64(binary.BigEndian.Uint64(fields))
+			fields = fields[8:]
+		}
+		if flags&entryFlagKind != 0 {
+			entry.Kind = kv.EntryKind(fields[0])
+			// 类型字段只用于写入和删除标记之外的类型，并且必须与value是否存在一致
+			if !entry.Kind.Valid() || entry.Kind == kv.KindPut || entry.Kind == kv.KindDelete || !present {
+				return 0, myerror.ErrInvalidSSTFormat
+			}
+			fields = fields[1:]
+		}
+		if flags&entryFlagSeq != 0 {
+			entry.Seq = binary.BigEndian.Uint64(fields)
+			fields = fields[8:]
+		}
+		if flags&entryFlagTTL != 0 {
+			entry.TTL = int64(binary.BigEndian.Uint64(fields))
+		}
+		header += optional
+	}
+	size := header + keyLen + valueLen
+	switch {
+	case int64(len(data)) < header+keyLen:
+		return 0, errEntryKeyTruncated
+	case int64(len(data)) < size:
+		return 0, errEntryValueTruncated
+	}
+	if flags&entryFlagChecksum != 0 {
+		size += 4
+		if int64(len(data)) < size {
+			return 0, errEntryChecksumTruncated
+		}
+	}
+	entry.Key = data[header : header+keyLen]
+	if entry.Kind != kv.KindDelete {
+		entry.Value = data[header+keyLen : header+keyLen+valueLen]
+	}
+	*dst = KeyValue{Entry: entry}
+	if flags&entryFlagChecksum != 0 {
+		dst.crc, dst.hasCrc = binary.BigEndian.Uint32(data[size-4:size]), true
+		if verify && !dst.verify() {
+			return 0, &EntryChecksumError{Key: append([]byte(nil), dst.Key...)}
+		}
+	}
+	return size, nil
+}
+
+// FilterAdd 添加数据块offset对应的过滤器数据
+func (b *Block) FilterAdd(offset int64, value []byte) error {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	// 写入blockLength
-	if err := binary.Write(b.dataBuf, binary.BigEndian, length); err != nil {
+	// 写入blockOffset
+	if err := binary.Write(b.dataBuf, binary.BigEndian, offset); err != nil {
 		return err
 	}
 
@@ -124,16 +416,33 @@ func (b *Block) LastKey() []byte {
 	return keyCopy
 }
 
-func (b *Block) EntriesCnt() int64 {
+// EntriesCnt 返回数据块中的条目数
+func (b *Block) EntriesCnt() uint32 {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 	return b.entriesCnt
 }
 
+// Clear 清空数据块的数据、条目数和首尾key，Flush后数据块可以重新写入。
+// 缓冲区容量超过BlockBufferShrinkThreshold时释放底层数组，写入过大条目后不会一直占用峰值内存
 func (b *Block) Clear() {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.dataBuf.Reset()
+	if b.dataBuf.Cap() > b.conf.BlockBufferShrinkLimit() {
+		b.dataBuf = bytes.NewBuffer(nil)
+	} else {
+		b.dataBuf.Reset()
+	}
+	b.entriesCnt = 0
+	b.firstKey = nil
+	b.lastKey = nil
+}
+
+// release 释放缓冲区和首尾key，之后数据块为空，仍可以重新写入
+func (b *Block) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dataBuf = bytes.NewBuffer(nil)
 	b.entriesCnt = 0
 	b.firstKey = nil
 	b.lastKey = nil
@@ -0,0 +1,153 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// blockKey 数据块在缓存中的标识
+type blockKey struct {
+	reader *SSTReader // 所属读取器
+	offset int64      // 数据块在数据区中的偏移量
+}
+
+// blockEntry 缓存中的数据块
+type blockEntry struct {
+	key  blockKey    // 数据块标识
+	kvs  []*KeyValue // 解析后的键值对
+	size int64       // 数据块大小
+}
+
+// BlockCache 所有SST读取器共享的数据块缓存，超出容量时按LRU顺序淘汰
+type BlockCache struct {
+	mu      sync.Mutex                 // 互斥锁
+	limit   int64                      // 容量上限(字节)
+	used    int64                      // 已使用的大小
+	lru     *list.List                 // 最近访问的数据块在前
+	entries map[blockKey]*list.Element // 数据块到LRU节点的映射
+	hits    atomic.Uint64              // 命中次数
+	misses  atomic.Uint64              // 未命中次数
+}
+
+// NewBlockCache 创建容量为limit字节的数据块缓存
+func NewBlockCache(limit int64) *BlockCache {
+	return &BlockCache{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[blockKey]*list.Element),
+	}
+}
+
+// Used 返回已缓存的数据块大小
+func (c *BlockCache) Used() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
+
+// Limit 返回缓存容量
+func (c *BlockCache) Limit() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.limit
+}
+
+// Hits 返回命中次数
+func (c *BlockCache) Hits() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.hits.Load()
+}
+
+// Misses 返回未命中次数
+func (c *BlockCache) Misses() uint64 {
+	if c == nil {
+		return 0
+	}
+	return c.misses.Load()
+}
+
+// get 查找数据块并统计命中情况
+func (c *BlockCache) get(r *SSTReader, offset int64) ([]*KeyValue, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[blockKey{r, offset}]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*blockEntry).kvs, true
+}
+
+// contains 判断数据块是否已缓存，不影响命中统计和LRU顺序
+func (c *BlockCache) contains(r *SSTReader, offset int64) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[blockKey{r, offset}]
+	return ok
+}
+
+// fits 判断在不淘汰其他数据块的情况下能否再放入size字节
+func (c *BlockCache) fits(size int64) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used+size <= c.limit
+}
+
+// add 缓存数据块，超出容量时淘汰最久未访问的数据块，超过容量的单个数据块不缓存
+func (c *BlockCache) add(r *SSTReader, offset int64, kvs []*KeyValue, size int64) {
+	if c == nil || size > c.limit {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := blockKey{r, offset}
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&blockEntry{key: key, kvs: kvs, size: size})
+	c.used += size
+	for c.used > c.limit {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// Remove 移除读取器的所有数据块，读取器关闭时调用
+func (c *BlockCache) Remove(r *SSTReader) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*blockEntry).key.reader == r {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *BlockCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*blockEntry)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
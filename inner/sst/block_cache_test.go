@@ -0,0 +1,238 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// writeCacheSST 写入n个键值对，每个数据块约256字节
+func writeCacheSST(t *testing.T, conf *config.Config, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "0_0.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := writer.Add(cacheKey(i), bytes.Repeat([]byte{'v'}, 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func cacheKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%05d", i))
+}
+
+// 使用映射时不使用数据块缓存，本文件的测试都以pread方式读取
+func TestBlockCacheReadThrough(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 256
+	conf.BlockCacheSize = 1 << 20
+	path := writeCacheSST(t, conf, 200)
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	cache := NewBlockCache(conf.BlockCacheSize)
+	reader.AttachBlockCache(cache)
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 200; i++ {
+			value, err := reader.Get(cacheKey(i))
+			if err != nil {
+				t.Fatalf("get %s: %v", cacheKey(i), err)
+			}
+			if len(value) != 40 {
+				t.Fatalf("unexpected value length %d", len(value))
+			}
+		}
+	}
+	blocks := uint64(len(reader.Index()))
+	if cache.Misses() != blocks {
+		t.Fatalf("expected %d misses, one per block, got %d", blocks, cache.Misses())
+	}
+	if cache.Hits() != 400-blocks {
+		t.Fatalf("expected %d hits, got %d", 400-blocks, cache.Hits())
+	}
+	if len(reader.KvList()) != 200 {
+		t.Fatalf("expected 200 entries, got %d", len(reader.KvList()))
+	}
+
+	reader.Close()
+	if cache.Used() != 0 {
+		t.Fatalf("expected cache to be empty after close, used %d", cache.Used())
+	}
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 256
+	conf.BlockCacheSize = 1024
+	path := writeCacheSST(t, conf, 200)
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	cache := NewBlockCache(conf.BlockCacheSize)
+	reader.AttachBlockCache(cache)
+
+	for i := 0; i < 200; i++ {
+		if _, err := reader.Get(cacheKey(i)); err != nil {
+			t.Fatal(err)
+		}
+		if cache.Used() > cache.Limit() {
+			t.Fatalf("cache used %d exceeds limit %d", cache.Used(), cache.Limit())
+		}
+	}
+
+	// 最早访问的数据块已被淘汰
+	misses := cache.Misses()
+	if _, err := reader.Get(cacheKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Misses() != misses+1 {
+		t.Fatal("expected evicted block to miss")
+	}
+}
+
+func TestBlockCacheEntryChecksum(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 256
+	conf.BlockCacheSize = 1 << 20
+	conf.PerEntryChecksum = true
+	path := writeCacheSST(t, conf, 200)
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+
+	key := cacheKey(100)
+	if _, err := reader.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	// 改写缓存中已校验过的数据块里的一个value字节
+	var idx *Index
+	for _, i := range reader.Index() {
+		if bytes.Compare(key, i.StartKey) >= 0 && bytes.Compare(key, i.EndKey) <= 0 {
+			idx = i
+		}
+	}
+	kvs, ok := reader.cache.get(reader, idx.Offset)
+	if !ok {
+		t.Fatal("block not cached")
+	}
+	var kv *KeyValue
+	for _, e := range kvs {
+		if bytes.Equal(e.Key, key) {
+			kv = e
+		}
+	}
+	kv.Value[0] ^= 0xff
+
+	check := func(where string, err error) {
+		t.Helper()
+		var ce *EntryChecksumError
+		if !errors.As(err, &ce) || !bytes.Equal(ce.Key, key) || ce.File != path {
+			t.Fatalf("%s: expected EntryChecksumError for %s in %s, got %v", where, key, path, err)
+		}
+		// 偏移量指向文件中该条目的位置
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _, err := decodeEntry(data[ce.Offset:], BlockFormat); err != nil || !bytes.Equal(got.Key, key) {
+			t.Fatalf("%s: entry at offset %d = %v, %v", where, ce.Offset, got, err)
+		}
+	}
+	value, err := reader.Get(key)
+	if value != nil {
+		t.Fatalf("corrupted value returned: %q", value)
+	}
+	check("Get", err)
+	_, errs := reader.MultiGet([][]byte{key})
+	check("MultiGet", errs[0])
+	check("PrefixScan", reader.PrefixScan([]byte("key-001"), func(key, value []byte) bool { return true }))
+
+	// 同一数据块中的其他条目不受影响
+	other := kvs[0]
+	if other == kv {
+		other = kvs[len(kvs)-1]
+	}
+	if _, err := reader.Get(other.Key); err != nil {
+		t.Fatalf("Get(%s): %v", other.Key, err)
+	}
+}
+
+func TestBlockCacheReadOptions(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 256
+	conf.BlockCacheSize = 1 << 20
+	conf.PerEntryChecksum = true
+	path := writeCacheSST(t, conf, 200)
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	cache := NewBlockCache(conf.BlockCacheSize)
+	reader.AttachBlockCache(cache)
+
+	// 不填充缓存或不校验条目时，从文件读取的数据块都不放入缓存
+	for _, opts := range []config.ReadOptions{
+		{VerifyChecksums: true},
+		{FillCache: true},
+		{},
+	} {
+		for i := 0; i < 200; i++ {
+			value, err := reader.GetWithOptions(cacheKey(i), opts)
+			if err != nil || len(value) != 40 {
+				t.Fatalf("%+v: get %s = %q, %v", opts, cacheKey(i), value, err)
+			}
+		}
+		if cache.Used() != 0 || cache.Hits() != 0 {
+			t.Fatalf("%+v: cache used %d hits %d, want an empty cache", opts, cache.Used(), cache.Hits())
+		}
+	}
+
+	// 已缓存的数据块仍然使用，不填充缓存的读取不改变缓存内容
+	if _, err := reader.Get(cacheKey(0)); err != nil {
+		t.Fatal(err)
+	}
+	used := cache.Used()
+	for i := 0; i < 200; i++ {
+		if _, err := reader.GetWithOptions(cacheKey(i), config.ReadOptions{VerifyChecksums: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.Used() != used || cache.Hits() == 0 {
+		t.Fatalf("cache used %d (was %d), hits %d", cache.Used(), used, cache.Hits())
+	}
+	for i, idx := range reader.Index() {
+		if cache.contains(reader, idx.Offset) != (i == 0) {
+			t.Fatalf("block %d cached = %v", i, !(i == 0))
+		}
+	}
+}
@@ -0,0 +1,659 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// presenceCases nil、空value和1字节value，按key排序
+var presenceCases = []struct {
+	key   string
+	value []byte
+}{
+	{"empty", []byte{}},
+	{"nil", nil},
+	{"one", []byte{'x'}},
+}
+
+// checkPresence 校验value的内容以及nil与空value的区别
+func checkPresence(t *testing.T, where string, key string, got, want []byte) {
+	t.Helper()
+	if (got == nil) != (want == nil) || !bytes.Equal(got, want) {
+		t.Fatalf("%s %q = %#v, want %#v", where, key, got, want)
+	}
+}
+
+func TestBlockEntryRoundTrip(t *testing.T) {
+	block := NewBlock(testConfig())
+	for _, c := range presenceCases {
+		if err := block.Add(kv.FromValue([]byte(c.key), c.value, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	kvs, err := decodeBlock(block.Bytes(), BlockFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != len(presenceCases) {
+		t.Fatalf("decoded %d entries, want %d", len(kvs), len(presenceCases))
+	}
+	for i, c := range presenceCases {
+		if string(kvs[i].Key) != c.key {
+			t.Fatalf("entry %d key = %q, want %q", i, kvs[i].Key, c.key)
+		}
+		checkPresence(t, "decodeBlock", c.key, kvs[i].Value, c.value)
+	}
+}
+
+func TestBlockEntryLegacyFormat(t *testing.T) {
+	// 旧版本条目没有标志位，长度为0的value解析为空value
+	var data []byte
+	for _, kv := range [][2]string{{"a", ""}, {"b", "v"}} {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(kv[0])))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(kv[1])))
+		data = append(data, kv[0]...)
+		data = append(data, kv[1]...)
+	}
+	kvs, err := decodeBlock(data, BlockFormatLegacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 {
+		t.Fatalf("decoded %d entries, want 2", len(kvs))
+	}
+	checkPresence(t, "legacy", "a", kvs[0].Value, []byte{})
+	checkPresence(t, "legacy", "b", kvs[1].Value, []byte("v"))
+}
+
+func TestBlockEntryMalformed(t *testing.T) {
+	entry := func(valueLen uint32, flags uint8) []byte {
+		data := binary.BigEndian.AppendUint32(nil, 1)
+		data = binary.BigEndian.AppendUint32(data, valueLen)
+		data = append(data, flags, 'k')
+		return append(data, make([]byte, valueLen)...)
+	}
+	cases := map[string]struct {
+		data []byte
+		want error // 除ErrInvalidSSTFormat之外还应包装的错误，为nil时不检查
+	}{
+		"unknown flag":         {data: entry(0, 0x80)},
+		"nil with length":      {data: entry(1, 0)},
+		"truncated header":     {entry(0, entryFlagValue)[:8], myerror.ErrEntryHeaderTruncated},
+		"truncated value":      {entry(4, entryFlagValue)[:12], myerror.ErrEntryValueTruncated},
+		"value length overrun": {entry(0, entryFlagValue)[:9], myerror.ErrEntryKeyTruncated},
+		"truncated timestamp":  {entry(0, entryFlagValue|entryFlagTimestamp), myerror.ErrEntryHeaderTruncated},
+		"truncated checksum":   {entry(0, entryFlagValue|entryFlagChecksum), myerror.ErrEntryChecksumTruncated},
+	}
+	for name, tt := range cases {
+		_, err := decodeBlock(tt.data, BlockFormat4)
+		if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Errorf("%s: expected ErrInvalidSSTFormat, got %v", name, err)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", name, tt.want, err)
+		}
+	}
+	// 版本5中删除标记没有value长度，头部更短
+	tombstone := append(binary.BigEndian.AppendUint32(nil, 1), 0, 'k')
+	if kvs, err := decodeBlock(tombstone, BlockFormat); err != nil || len(kvs) != 1 || kvs[0].Kind != kv.KindDelete {
+		t.Errorf("format 5 tombstone = %+v, %v", kvs, err)
+	}
+	for name, data := range map[string][]byte{
+		"truncated tombstone header": tombstone[:4],
+		"truncated value length":     append(binary.BigEndian.AppendUint32(nil, 1), entryFlagValue, 0, 0),
+	} {
+		if _, err := decodeBlock(data, BlockFormat); !errors.Is(err, myerror.ErrEntryHeaderTruncated) {
+			t.Errorf("%s: expected ErrEntryHeaderTruncated, got %v", name, err)
+		}
+	}
+	// 恰好在条目边界结束
+	if _, _, err := decodeEntry(nil, BlockFormat); err != io.EOF {
+		t.Errorf("empty data: expected io.EOF, got %v", err)
+	}
+}
+
+func TestSSTValuePresenceRoundTrip(t *testing.T) {
+	for _, cacheSize := range []int64{0, 1 << 20} {
+		conf := testConfig()
+		conf.DataDir = t.TempDir()
+		conf.BlockCacheSize = cacheSize
+		path := filepath.Join(conf.DataDir, "presence.sst")
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range presenceCases {
+			if err := writer.Add([]byte(c.key), c.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.AttachBlockCache(NewBlockCache(cacheSize))
+		if got := reader.Meta()[MetaBlockFormat]; got != strconv.Itoa(int(BlockFormat)) {
+			t.Fatalf("block format meta = %q, want %d", got, BlockFormat)
+		}
+		node, err := NewNode(conf, path, 0, 0, reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([][]byte, len(presenceCases))
+		for i, c := range presenceCases {
+			keys[i] = []byte(c.key)
+			value, err := node.Get(keys[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPresence(t, "Node.Get", c.key, value, c.value)
+			found, err := reader.ScanEntry(keys[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkPresence(t, "ScanEntry", c.key, found.Value, c.value)
+		}
+		values, errs := reader.MultiGet(keys)
+		for i, c := range presenceCases {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			checkPresence(t, "MultiGet", c.key, values[i], c.value)
+		}
+
+		it, err := reader.GetIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; it.Next(); i++ {
+			checkPresence(t, "iterator", presenceCases[i].key, it.Value(), presenceCases[i].value)
+		}
+		if it.Error() != nil {
+			t.Fatal(it.Error())
+		}
+		for i, kv := range reader.KvList() {
+			checkPresence(t, "KvList", presenceCases[i].key, kv.Value, presenceCases[i].value)
+		}
+		if props := reader.Properties(); props.Tombstones != 1 {
+			t.Fatalf("Tombstones = %d, want 1", props.Tombstones)
+		}
+		reader.Close()
+	}
+}
+
+func TestBlockEntryTimestamp(t *testing.T) {
+	block := NewBlock(testConfig())
+	entries := []struct {
+		key   string
+		value []byte
+		ts    int64
+	}{
+		{"a", []byte("1"), 0},
+		{"b", []byte("2"), 1700000000123456789},
+		{"c", nil, 42},
+	}
+	var size int64
+	for _, e := range entries {
+		if err := block.Add(kv.FromValue([]byte(e.key), e.value, e.ts)); err != nil {
+			t.Fatal(err)
+		}
+		size += entrySize(kv.FromValue([]byte(e.key), e.value, e.ts), false)
+	}
+	// 没有记录时间的条目不占用额外的字节，删除标记没有value长度
+	if want := int64(9+1+1) + int64(9+8+1+1) + int64(5+8+1); size != want || int64(len(block.Bytes())) != want {
+		t.Fatalf("block size = %d (entrySize %d), want %d", len(block.Bytes()), size, want)
+	}
+	kvs, err := decodeBlock(block.Bytes(), BlockFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		if string(kvs[i].Key) != e.key || kvs[i].Timestamp != e.ts {
+			t.Fatalf("entry %d = %s@%d, want %s@%d", i, kvs[i].Key, kvs[i].Timestamp, e.key, e.ts)
+		}
+		checkPresence(t, "decodeBlock", e.key, kvs[i].Value, e.value)
+	}
+
+	// 版本1的文件不认识时间戳标志位
+	if _, err := decodeBlock(block.Bytes(), BlockFormat1); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("expected ErrInvalidSSTFormat for timestamp flag in format 1, got %v", err)
+	}
+}
+
+func TestSSTTimestampRoundTrip(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	path := filepath.Join(conf.DataDir, "timestamp.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"a": 0, "b": 200, "c": 300}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := writer.AddWithTimestamp([]byte(key), []byte(key), want[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for key, wantTs := range want {
+		value, ts, err := reader.GetWithTimestamp([]byte(key))
+		if err != nil || string(value) != key || ts != wantTs {
+			t.Fatalf("GetWithTimestamp(%s) = %s@%d, %v, want %s@%d", key, value, ts, err, key, wantTs)
+		}
+	}
+	it, err := reader.GetIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for it.Next() {
+		if it.Timestamp() != want[string(it.Key())] {
+			t.Fatalf("iterator %s ts = %d, want %d", it.Key(), it.Timestamp(), want[string(it.Key())])
+		}
+	}
+	if it.Error() != nil {
+		t.Fatal(it.Error())
+	}
+}
+
+func TestBlockEntryChecksum(t *testing.T) {
+	conf := testConfig()
+	conf.PerEntryChecksum = true
+	block := NewBlock(conf)
+	entries := []struct {
+		key   string
+		value []byte
+		ts    int64
+	}{
+		{"a", []byte("1"), 0},
+		{"b", []byte("22"), 42},
+		{"c", nil, 0},
+	}
+	var size int64
+	for _, e := range entries {
+		if err := block.Add(kv.FromValue([]byte(e.key), e.value, e.ts)); err != nil {
+			t.Fatal(err)
+		}
+		size += entrySize(kv.FromValue([]byte(e.key), e.value, e.ts), true)
+	}
+	data := append([]byte(nil), block.Bytes()...)
+	if int64(len(data)) != size {
+		t.Fatalf("block size = %d, entrySize %d", len(data), size)
+	}
+	kvs, err := decodeBlock(data, BlockFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		if string(kvs[i].Key) != e.key || kvs[i].Timestamp != e.ts || !kvs[i].hasCrc {
+			t.Fatalf("entry %d = %+v, want %s@%d with checksum", i, kvs[i], e.key, e.ts)
+		}
+		checkPresence(t, "decodeBlock", e.key, kvs[i].Value, e.value)
+		if encodedSize(kvs[i], BlockFormat) != entrySize(kv.FromValue([]byte(e.key), e.value, e.ts), true) {
+			t.Fatalf("entry %d encodedSize = %d", i, encodedSize(kvs[i], BlockFormat))
+		}
+	}
+
+	// 版本2的文件不认识校验和标志位
+	if _, err := decodeBlock(data, BlockFormat2); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("expected ErrInvalidSSTFormat for checksum flag in format 2, got %v", err)
+	}
+
+	// 改写第二个条目的value，错误中的偏移量为该条目在数据块中的位置
+	second := entrySize(kv.FromValue([]byte("a"), []byte("1"), 0), true)
+	data[second+9+8+1] ^= 0xff
+	_, err = decodeBlock(data, BlockFormat)
+	var ce *EntryChecksumError
+	if !errors.As(err, &ce) || string(ce.Key) != "b" || ce.Offset != second {
+		t.Fatalf("expected EntryChecksumError for b at %d, got %v", second, err)
+	}
+	if !errors.Is(err, myerror.ErrSSTCorrupted) {
+		t.Fatalf("expected EntryChecksumError to match ErrSSTCorrupted")
+	}
+	if _, err := searchBlock(data, []byte("b"), BlockFormat); !errors.As(err, &ce) || ce.Offset != second {
+		t.Fatalf("searchBlock: expected EntryChecksumError at %d, got %v", second, err)
+	}
+
+	// 未开启时不写入校验和，与开启时写入的条目可以混合读取
+	plain := NewBlock(testConfig())
+	if err := plain.Add(kv.FromValue([]byte("a"), []byte("1"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	kvs, err = decodeBlock(plain.Bytes(), BlockFormat)
+	if err != nil || kvs[0].hasCrc || !kvs[0].verify() {
+		t.Fatalf("plain entry = %+v, %v", kvs, err)
+	}
+}
+
+// formatEntry 按版本1至4的格式手工编码一个条目
+func formatEntry(key string, value []byte, flags uint8, ts int64) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(len(key)))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+	data = append(data, flags)
+	if flags&entryFlagTimestamp != 0 {
+		data = binary.BigEndian.AppendUint64(data, uint64(ts))
+	}
+	data = append(data, key...)
+	data = append(data, value...)
+	if flags&entryFlagChecksum != 0 {
+		data = binary.BigEndian.AppendUint32(data, entryChecksum([]byte(key), value))
+	}
+	return data
+}
+
+func TestBlockEntryOldFormatKinds(t *testing.T) {
+	cases := []struct {
+		name   string
+		format uint8
+		data   []byte
+		want   kv.Entry
+	}{
+		{"format1 put", BlockFormat1, formatEntry("a", []byte("1"), entryFlagValue, 0),
+			kv.Entry{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut}},
+		{"format1 empty put", BlockFormat1, formatEntry("b", nil, entryFlagValue, 0),
+			kv.Entry{Key: []byte("b"), Value: []byte{}, Kind: kv.KindPut}},
+		{"format1 tombstone", BlockFormat1, formatEntry("c", nil, 0, 0),
+			kv.Entry{Key: []byte("c"), Kind: kv.KindDelete}},
+		{"format2 tombstone with timestamp", BlockFormat2, formatEntry("d", nil, entryFlagTimestamp, 7),
+			kv.Entry{Key: []byte("d"), Kind: kv.KindDelete, Timestamp: 7}},
+		{"format3 put with checksum", BlockFormat3, formatEntry("e", []byte("5"), entryFlagValue|entryFlagChecksum, 0),
+			kv.Entry{Key: []byte("e"), Value: []byte("5"), Kind: kv.KindPut}},
+	}
+	for _, c := range cases {
+		// 旧版本的条目在版本4中编码相同
+		for _, format := range []uint8{c.format, BlockFormat4} {
+			kvs, err := decodeBlock(c.data, format)
+			if err != nil {
+				t.Fatalf("%s in format %d: %v", c.name, format, err)
+			}
+			if !reflect.DeepEqual(kvs[0].Entry, c.want) {
+				t.Fatalf("%s in format %d = %+v, want %+v", c.name, format, kvs[0].Entry, c.want)
+			}
+		}
+	}
+	// 旧版本文件中没有删除标记
+	legacy := binary.BigEndian.AppendUint32(nil, 1)
+	legacy = binary.BigEndian.AppendUint32(legacy, 0)
+	legacy = append(legacy, 'k')
+	kvs, err := decodeBlock(legacy, BlockFormatLegacy)
+	if err != nil || kvs[0].Kind != kv.KindPut || kvs[0].Value == nil {
+		t.Fatalf("legacy entry = %+v, %v, want an empty put", kvs, err)
+	}
+}
+
+func TestBlockEntryKinds(t *testing.T) {
+	conf := testConfig()
+	conf.PerEntryChecksum = true
+	block := NewBlock(conf)
+	entries := []kv.Entry{
+		{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut},
+		{Key: []byte("b"), Value: []byte("2"), Kind: kv.KindPut, Seq: 9, TTL: 1700000000000000000, Timestamp: 3},
+		{Key: []byte("c"), Kind: kv.KindDelete, Seq: 10},
+		{Key: []byte("d"), Value: []byte("+1"), Kind: kv.KindMerge},
+		{Key: []byte("e"), Value: []byte("g"), Kind: kv.KindRangeDelete, Seq: 11},
+	}
+	var size int64
+	for _, entry := range entries {
+		if err := block.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+		size += entrySize(entry, true)
+	}
+	data := append([]byte(nil), block.Bytes()...)
+	if int64(len(data)) != size {
+		t.Fatalf("block size = %d, entrySize %d", len(data), size)
+	}
+	kvs, err := decodeBlock(data, BlockFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if !reflect.DeepEqual(kvs[i].Entry, entry) {
+			t.Fatalf("entry %d = %+v, want %+v", i, kvs[i].Entry, entry)
+		}
+		if encodedSize(kvs[i], BlockFormat) != entrySize(entry, true) {
+			t.Fatalf("entry %d encodedSize = %d", i, encodedSize(kvs[i], BlockFormat))
+		}
+	}
+	// 没有序列号和过期时间的写入在版本5中的大小与版本3相同，删除标记少4字节的value长度
+	if entrySize(entries[0], true) != 9+1+1+4 {
+		t.Fatalf("plain put takes %d bytes", entrySize(entries[0], true))
+	}
+	if size := entrySize(kv.Entry{Key: []byte("c"), Kind: kv.KindDelete}, true); size != 5+1+4 {
+		t.Fatalf("plain tombstone takes %d bytes", size)
+	}
+
+	// 版本3的文件不认识类型、序列号和过期时间标志位
+	for _, flag := range []uint8{entryFlagKind, entryFlagSeq, entryFlagTTL} {
+		if _, err := decodeBlock(formatEntry("k", []byte("v"), entryFlagValue|flag, 0), BlockFormat3); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Fatalf("flag %#x in format 3: expected ErrInvalidSSTFormat, got %v", flag, err)
+		}
+	}
+	// 类型字段必须是已知的、写入和删除标记之外的类型，并与value是否存在一致
+	kindEntry := func(flags uint8, kind kv.EntryKind) []byte {
+		data := binary.BigEndian.AppendUint32(nil, 1)
+		data = binary.BigEndian.AppendUint32(data, 0)
+		return append(data, flags, byte(kind), 'k')
+	}
+	for name, data := range map[string][]byte{
+		"unknown kind":        kindEntry(entryFlagValue|entryFlagKind, 9),
+		"explicit put":        kindEntry(entryFlagValue|entryFlagKind, kv.KindPut),
+		"merge without value": kindEntry(entryFlagKind, kv.KindMerge),
+		"truncated seq":       append(formatEntry("", nil, entryFlagValue|entryFlagSeq, 0), 0, 0),
+	} {
+		if _, err := decodeBlock(data, BlockFormat4); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Errorf("%s: expected ErrInvalidSSTFormat, got %v", name, err)
+		}
+	}
+}
+
+func TestSSTEntryRoundTrip(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	path := filepath.Join(conf.DataDir, "entry.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []kv.Entry{
+		{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut, Seq: 1},
+		{Key: []byte("b"), Kind: kv.KindDelete, Seq: 2},
+		{Key: []byte("c"), Value: []byte("+1"), Kind: kv.KindMerge, TTL: 5},
+	}
+	for _, entry := range entries {
+		if err := writer.AddEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if got := reader.Meta()[MetaBlockFormat]; got != strconv.Itoa(int(BlockFormat)) {
+		t.Fatalf("block format meta = %q, want %d", got, BlockFormat)
+	}
+	if props := reader.Properties(); props.Entries != 3 || props.Tombstones != 1 {
+		t.Fatalf("Properties = %+v, want 3 entries with 1 tombstone", props)
+	}
+	for _, want := range entries {
+		got, err := reader.GetEntry(want.Key, nil)
+		if err != nil || !reflect.DeepEqual(got.Entry, want.Normalize()) {
+			t.Fatalf("GetEntry(%s) = %+v, %v, want %+v", want.Key, got, err, want)
+		}
+	}
+	it, err := reader.GetIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; it.Next(); i++ {
+		if !reflect.DeepEqual(it.Entry(), entries[i].Normalize()) {
+			t.Fatalf("iterator entry %d = %+v, want %+v", i, it.Entry(), entries[i])
+		}
+	}
+	if it.Error() != nil {
+		t.Fatal(it.Error())
+	}
+}
+
+func TestBlockClear(t *testing.T) {
+	conf := testConfig()
+	b := NewBlock(conf)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := b.Add(kv.FromValue([]byte(key), []byte("v"), 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if b.EntriesCnt() != 3 {
+		t.Fatalf("EntriesCnt = %d, want 3", b.EntriesCnt())
+	}
+	var buf bytes.Buffer
+	if _, err := b.Flush(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Flush后清空数据块，下一个数据块的首尾key和条目数不受之前的数据影响
+	if b.EntriesCnt() != 0 || b.Length() != 0 || b.FirstKey() != nil || b.LastKey() != nil {
+		t.Fatalf("after Flush: %d entries, %d bytes, keys %q-%q", b.EntriesCnt(), b.Length(), b.FirstKey(), b.LastKey())
+	}
+	if err := b.Add(kv.FromValue([]byte("d"), []byte("v"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if b.EntriesCnt() != 1 || string(b.FirstKey()) != "d" || string(b.LastKey()) != "d" {
+		t.Fatalf("after reuse: %d entries, keys %q-%q", b.EntriesCnt(), b.FirstKey(), b.LastKey())
+	}
+}
+
+func TestBlockAddCopiesKeys(t *testing.T) {
+	conf := testConfig()
+	b := NewBlock(conf)
+	key := []byte("a")
+	for _, next := range []string{"b", "c"} {
+		if err := b.Add(kv.FromValue(key, []byte("v"), 0)); err != nil {
+			t.Fatal(err)
+		}
+		// 调用方复用key的内存写入下一个key
+		copy(key, next)
+	}
+	if string(b.FirstKey()) != "a" || string(b.LastKey()) != "b" {
+		t.Fatalf("keys = %q-%q after the caller reused the key, want a-b", b.FirstKey(), b.LastKey())
+	}
+}
+
+// 清空后缓冲区容量超过BlockBufferShrinkThreshold时释放底层数组，未超过时保留以便复用
+func TestBlockClearShrinksBuffer(t *testing.T) {
+	conf := testConfig()
+	conf.BlockBufferShrinkThreshold = 4096
+	b := NewBlock(conf)
+	if err := b.Add(kv.FromValue([]byte("small"), []byte("v"), 0)); err != nil {
+		t.Fatal(err)
+	}
+	b.Clear()
+	if kept := b.dataBuf.Cap(); kept == 0 || kept > 4096 {
+		t.Fatalf("capacity after clearing a small block = %d, want kept and within the threshold", kept)
+	}
+	if err := b.Add(kv.FromValue([]byte("large"), bytes.Repeat([]byte("v"), 64<<10), 0)); err != nil {
+		t.Fatal(err)
+	}
+	b.Clear()
+	if kept := b.dataBuf.Cap(); kept > 4096 {
+		t.Fatalf("capacity after clearing a large block = %d, want at most 4096", kept)
+	}
+	if b.Length() != 0 || b.EntriesCnt() != 0 || b.FirstKey() != nil {
+		t.Fatalf("block not empty after Clear")
+	}
+}
+
+// FuzzDecodeEntry 编码随机条目后截断或改写其中一个字节：解析不会panic，出错时不返回条目，
+// 成功时key和value的长度与头部一致且不越界，未改写的输入总是完整往返
+func FuzzDecodeEntry(f *testing.F) {
+	f.Add([]byte("key"), []byte("value"), uint8(kv.KindPut), int64(0), uint64(0), int64(0), false, uint16(0), uint16(0), uint8(0))
+	f.Add([]byte("k"), []byte(nil), uint8(kv.KindDelete), int64(7), uint64(3), int64(0), true, uint16(5), uint16(2), uint8(0xff))
+	f.Add([]byte(""), []byte("operand"), uint8(kv.KindMerge), int64(-1), uint64(1<<40), int64(99), true, uint16(12), uint16(30), uint8(1))
+	f.Fuzz(func(t *testing.T, key, value []byte, kind uint8, ts int64, seq uint64, ttl int64, checksum bool, cut, pos uint16, mask uint8) {
+		entry := kv.Entry{
+			Key:       key,
+			Value:     value,
+			Kind:      kv.EntryKind(kind % uint8(kv.KindRangeDelete+1)),
+			Timestamp: ts,
+			Seq:       seq,
+			TTL:       ttl,
+		}.Normalize()
+		conf := testConfig()
+		conf.PerEntryChecksum = checksum
+		block := NewBlock(conf)
+		if err := block.Add(entry); err != nil {
+			t.Fatal(err)
+		}
+		data := block.Bytes()
+
+		decoded, n, err := decodeEntry(data, BlockFormat)
+		if err != nil {
+			t.Fatalf("round trip: %v", err)
+		}
+		got := decoded.Entry
+		if n != int64(len(data)) || !bytes.Equal(got.Key, entry.Key) || !bytes.Equal(got.Value, entry.Value) ||
+			(got.Value == nil) != (entry.Value == nil) || got.Kind != entry.Kind || got.Timestamp != entry.Timestamp ||
+			got.Seq != entry.Seq || got.TTL != entry.TTL || decoded.hasCrc != checksum {
+			t.Fatalf("round trip: got %+v (%d bytes), want %+v (%d bytes)", got, n, entry, len(data))
+		}
+
+		// 截断的条目总是报错，恰好为空时为io.EOF
+		truncated := data[:int(cut)%len(data)]
+		decoded, n, err = decodeEntry(truncated, BlockFormat)
+		if decoded != nil || n != 0 {
+			t.Fatalf("truncated to %d of %d bytes: returned entry %+v", len(truncated), len(data), decoded)
+		}
+		if len(truncated) == 0 && err != io.EOF {
+			t.Fatalf("empty input: got %v, want io.EOF", err)
+		}
+		if len(truncated) > 0 && !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Fatalf("truncated to %d of %d bytes: got %v, want ErrInvalidSSTFormat", len(truncated), len(data), err)
+		}
+
+		mutated := bytes.Clone(data)
+		mutated[int(pos)%len(mutated)] ^= mask
+		decoded, n, err = decodeEntry(mutated, BlockFormat)
+		if err != nil {
+			if decoded != nil || n != 0 {
+				t.Fatalf("mutated: error %v returned entry %+v", err, decoded)
+			}
+			return
+		}
+		keyLen := int(binary.BigEndian.Uint32(mutated[0:4]))
+		var valueLen int
+		if mutated[4]&entryFlagValue != 0 {
+			valueLen = int(binary.BigEndian.Uint32(mutated[5:9]))
+		}
+		if n <= 0 || n > int64(len(mutated)) || len(decoded.Key) != keyLen ||
+			(decoded.Kind != kv.KindDelete && len(decoded.Value) != valueLen) {
+			t.Fatalf("mutated: partial entry %+v (%d bytes) from header key=%d value=%d", decoded.Entry, n, keyLen, valueLen)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// FileMeta 批量构建生成的SST文件
+type FileMeta struct {
+	Path    string // 文件路径
+	MinKey  []byte // 最小key
+	MaxKey  []byte // 最大key
+	Entries int64  // 条目数，包括删除标记
+	Size    int64  // 文件大小
+}
+
+// FileSetBuilder 将全局有序的键值对写入dir中的一组SST文件，当前文件已写满的数据块达到
+// targetFileSize后，从下一个key开始写入新文件，文件只在数据块边界切分，各文件的key范围互不重叠
+type FileSetBuilder struct {
+	conf           *config.Config
+	dir            string     // 输出目录
+	targetFileSize int64      // 单个文件的目标大小，<=0时所有条目写入一个文件
+	writer         *SSTWriter // 当前文件的写入器，尚未写入条目时为nil
+	current        FileMeta   // 当前文件的信息
+	lastKey        []byte     // 上一个写入的key
+	files          []FileMeta // 已完成的文件
+	finished       bool       // 是否已调用Finish
+}
+
+// NewFileSetBuilder 创建在dir中生成SST文件的构建器，dir不存在时创建
+func NewFileSetBuilder(conf *config.Config, dir string, targetFileSize int64) (*FileSetBuilder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSetBuilder{conf: conf, dir: dir, targetFileSize: targetFileSize}, nil
+}
+
+// Add 写入键值对，value为nil表示删除标记。key必须在所有文件中严格递增，否则返回ErrKeyOutOfOrder，空key返回ErrEmptyKey
+func (b *FileSetBuilder) Add(key, value []byte) error {
+	if b.finished {
+		return errors.New("sst: file set builder already finished")
+	}
+	if len(key) == 0 {
+		return myerror.ErrEmptyKey
+	}
+	if b.lastKey != nil && bytes.Compare(key, b.lastKey) <= 0 {
+		return fmt.Errorf("%w: %q after %q", myerror.ErrKeyOutOfOrder, key, b.lastKey)
+	}
+	if b.writer != nil && b.targetFileSize > 0 && b.writer.dataSize() >= b.targetFileSize {
+		if err := b.finishFile(); err != nil {
+			return err
+		}
+	}
+	if b.writer == nil {
+		path := filepath.Join(b.dir, fmt.Sprintf("%06d.sst", len(b.files)))
+		writer, err := NewSSTWriter(b.conf, path)
+		if err != nil {
+			return err
+		}
+		b.writer = writer
+		b.current = FileMeta{Path: path, MinKey: append([]byte(nil), key...)}
+	}
+	if err := b.writer.Add(key, value); err != nil {
+		return err
+	}
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.current.Entries++
+	return nil
+}
+
+// finishFile 写完当前文件并记录其信息
+func (b *FileSetBuilder) finishFile() error {
+	writer := b.writer
+	b.writer = nil
+	if err := writer.Flush(); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Sync(); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	stat, err := os.Stat(b.current.Path)
+	if err != nil {
+		return err
+	}
+	b.current.MaxKey = append([]byte(nil), b.lastKey...)
+	b.current.Size = stat.Size()
+	b.files = append(b.files, b.current)
+	return nil
+}
+
+// Finish 写完最后一个文件，按key顺序返回所有生成的文件，没有写入任何条目时不生成文件
+func (b *FileSetBuilder) Finish() ([]FileMeta, error) {
+	if b.finished {
+		return b.files, nil
+	}
+	b.finished = true
+	if b.writer != nil {
+		if err := b.finishFile(); err != nil {
+			return nil, err
+		}
+	}
+	return b.files, nil
+}
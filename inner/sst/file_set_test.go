@@ -0,0 +1,128 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func fileSetConfig() *config.Config {
+	conf := testConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 256
+	return conf
+}
+
+func TestFileSetBuilderSplit(t *testing.T) {
+	conf := fileSetConfig()
+	dir := t.TempDir()
+	builder, err := NewFileSetBuilder(conf, dir, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := builder.Add(cacheKey(i), bytes.Repeat([]byte{'v'}, 40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("built %d files, want a split", len(files))
+	}
+
+	next := 0
+	for i, file := range files {
+		if i > 0 && bytes.Compare(file.MinKey, files[i-1].MaxKey) <= 0 {
+			t.Fatalf("file %d starts at %s, overlapping previous max %s", i, file.MinKey, files[i-1].MaxKey)
+		}
+		reader, err := NewSSTReader(conf, file.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reader.MinKey(), file.MinKey) || !bytes.Equal(reader.MaxKey(), file.MaxKey) ||
+			reader.Properties().Entries != file.Entries || reader.FileSize() != file.Size {
+			t.Fatalf("file %d meta %+v does not match reader", i, file)
+		}
+		// 只在数据块边界切分：除最后一个文件外，数据块总大小在达到目标后的第一个块边界
+		var dataSize int64
+		for _, idx := range reader.Index() {
+			dataSize += idx.Length
+		}
+		if i < len(files)-1 && (dataSize < 2048 || dataSize >= 2048+int64(conf.BlockSizeBytes)*2) {
+			t.Fatalf("file %d has %d data bytes for target 2048", i, dataSize)
+		}
+		for _, kv := range reader.KvList() {
+			if !bytes.Equal(kv.Key, cacheKey(next)) {
+				t.Fatalf("file %d has key %s, want %s", i, kv.Key, cacheKey(next))
+			}
+			next++
+		}
+		reader.Close()
+	}
+	if next != 500 {
+		t.Fatalf("read %d keys back, want 500", next)
+	}
+}
+
+func TestFileSetBuilderEdgeCases(t *testing.T) {
+	conf := fileSetConfig()
+
+	// 没有条目时不生成文件
+	dir := t.TempDir()
+	builder, err := NewFileSetBuilder(conf, dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, err := builder.Finish(); err != nil || len(files) != 0 {
+		t.Fatalf("empty Finish = %v, %v", files, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("empty builder left %d files", len(entries))
+	}
+
+	// 单个超过目标大小的值只生成一个文件
+	builder, err = NewFileSetBuilder(conf, t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Add([]byte("big"), bytes.Repeat([]byte{'x'}, 64<<10)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := builder.Finish()
+	if err != nil || len(files) != 1 || files[0].Entries != 1 || files[0].Size < 64<<10 {
+		t.Fatalf("giant value Finish = %+v, %v", files, err)
+	}
+	if err := builder.Add([]byte("late"), []byte("v")); err == nil {
+		t.Fatal("Add after Finish succeeded")
+	}
+
+	// 跨文件也必须保持key递增
+	builder, err = NewFileSetBuilder(conf, t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Add([]byte{}, []byte("v")); !errors.Is(err, myerror.ErrEmptyKey) {
+		t.Fatalf("Add(empty) = %v, want ErrEmptyKey", err)
+	}
+	if err := builder.Add([]byte("b"), bytes.Repeat([]byte{'v'}, 512)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := builder.Add([]byte(key), []byte("v")); !errors.Is(err, myerror.ErrKeyOutOfOrder) {
+			t.Fatalf("Add(%s) = %v, want ErrKeyOutOfOrder", key, err)
+		}
+	}
+	if err := builder.Add([]byte("c"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := builder.Finish(); err != nil || len(files) != 2 {
+		t.Fatalf("Finish = %+v, %v, want 2 files", files, err)
+	}
+}
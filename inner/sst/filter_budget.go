@@ -0,0 +1,122 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+)
+
+// FilterBudget 统计所有SST读取器常驻内存的过滤器大小，并限制其总和
+// 超出预算时按点查的LRU顺序卸载最久未使用的读取器的过滤器，索引保持不变，
+// 卸载后的读取器不经过滤器直接查找数据块，下次点查时再从文件中加载过滤器
+type FilterBudget struct {
+	mu      sync.Mutex                   // 互斥锁
+	limit   int64                        // 预算上限，<=0表示只统计不限制
+	used    int64                        // 已加载的过滤器大小之和
+	lru     *list.List                   // 最近点查的读取器在前，元素为*filterBudgetEntry
+	entries map[*SSTReader]*list.Element // 读取器到LRU节点的映射
+}
+
+// filterBudgetEntry 预算中的一个读取器及计入预算时的过滤器大小
+type filterBudgetEntry struct {
+	reader *SSTReader
+	bytes  int64
+}
+
+// NewFilterBudget 创建过滤器内存预算，limit<=0表示只统计不限制
+func NewFilterBudget(limit int64) *FilterBudget {
+	return &FilterBudget{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[*SSTReader]*list.Element),
+	}
+}
+
+// Used 返回当前常驻内存的过滤器大小
+func (b *FilterBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Limit 返回预算上限
+func (b *FilterBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// add 将刚加载过滤器的读取器计入预算，已在预算中时按当前大小更新，必要时卸载其他读取器的过滤器
+func (b *FilterBudget) add(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	size := r.FilterMemory()
+	if elem, ok := b.entries[r]; ok {
+		entry := elem.Value.(*filterBudgetEntry)
+		b.used += size - entry.bytes
+		entry.bytes = size
+		b.lru.MoveToFront(elem)
+	} else {
+		b.entries[r] = b.lru.PushFront(&filterBudgetEntry{reader: r, bytes: size})
+		b.used += size
+	}
+	victims := b.shrink(r)
+	b.mu.Unlock()
+
+	// 在预算锁之外卸载过滤器，卸载时需要取得读取器的锁
+	for _, victim := range victims {
+		victim.evictFilters()
+	}
+}
+
+// touch 标记读取器的过滤器最近被点查使用
+func (b *FilterBudget) touch(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.entries[r]; ok {
+		b.lru.MoveToFront(elem)
+	}
+}
+
+// Remove 将读取器移出预算，在读取器关闭或过滤器随索引被释放时调用
+func (b *FilterBudget) Remove(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.entries[r]; ok {
+		b.lru.Remove(elem)
+		delete(b.entries, r)
+		b.used -= elem.Value.(*filterBudgetEntry).bytes
+	}
+}
+
+// shrink 从LRU尾部挑选需要卸载过滤器的读取器直到满足预算，keep不会被卸载
+// 调用方需持有b.mu
+func (b *FilterBudget) shrink(keep *SSTReader) []*SSTReader {
+	if b.limit <= 0 {
+		return nil
+	}
+	var victims []*SSTReader
+	for elem := b.lru.Back(); b.used > b.limit && elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*filterBudgetEntry)
+		if entry.reader != keep {
+			b.lru.Remove(elem)
+			delete(b.entries, entry.reader)
+			b.used -= entry.bytes
+			victims = append(victims, entry.reader)
+		}
+		elem = prev
+	}
+	return victims
+}
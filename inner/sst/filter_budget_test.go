@@ -0,0 +1,132 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// TestFilterBudget 过滤器预算只卸载过滤器，预算统计的大小等于各读取器已加载的过滤器之和且不超过上限，
+// 被卸载的读取器在点查时重新加载过滤器，查找结果保持正确
+func TestFilterBudget(t *testing.T) {
+	const files, keysPerFile = 20, 50
+	conf := newBudgetConfig(t)
+	paths := writeBudgetSSTs(t, conf, files, keysPerFile)
+
+	first, _ := openReaders(t, conf, paths[:1], nil)
+	perFile := first[0].Reader().FilterMemory()
+	closeNodes(first)
+	if perFile <= 0 {
+		t.Fatalf("FilterMemory = %d, want > 0", perFile)
+	}
+
+	budget := NewFilterBudget(perFile * 3)
+	nodes, _ := openReaders(t, conf, paths, nil)
+	defer closeNodes(nodes)
+	for _, node := range nodes {
+		node.Reader().AttachFilterBudget(budget)
+	}
+	checkAccounting := func() {
+		t.Helper()
+		var loaded int64
+		var resident int
+		for _, node := range nodes {
+			if size := node.Reader().FilterMemory(); size > 0 {
+				loaded += size
+				resident++
+			}
+		}
+		if used := budget.Used(); used != loaded || used > budget.Limit() {
+			t.Fatalf("budget used %d, loaded filters %d, limit %d", used, loaded, budget.Limit())
+		}
+		if resident > 3 {
+			t.Fatalf("%d readers keep their filters, want at most 3", resident)
+		}
+	}
+	checkAccounting()
+
+	for round := 0; round < 2; round++ {
+		for f, node := range nodes {
+			// 过滤器在查找时重新加载，每次查找都经过过滤器
+			before := node.Reader().FilterProbes()
+			for _, i := range []int{0, keysPerFile / 2, keysPerFile - 1} {
+				value, err := node.Get(budgetKey(f, i))
+				if want := fmt.Sprintf("v%d_%d", f, i); err != nil || string(value) != want {
+					t.Fatalf("Get file %d key %d = %q, %v, want %q", f, i, value, err, want)
+				}
+			}
+			if probes := node.Reader().FilterProbes() - before; probes != 3 {
+				t.Fatalf("file %d: %d filter probes for 3 lookups, want 3", f, probes)
+			}
+			if _, err := node.Get(append(budgetKey(f, 0), 'x')); !errors.Is(err, myerror.ErrKeyNotFound) {
+				t.Fatalf("Get missing key in file %d: %v, want ErrKeyNotFound", f, err)
+			}
+			checkAccounting()
+		}
+	}
+	var reloads uint64
+	for _, node := range nodes {
+		reloads += node.Reader().FilterReloads()
+	}
+	if reloads < files {
+		t.Fatalf("FilterReloads = %d, want at least %d", reloads, files)
+	}
+
+	// 并发点查等待同一次重新加载，结束后统计仍然一致
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for f := g % 2; f < files; f += 2 {
+				if value, err := nodes[f].Get(budgetKey(f, g)); err != nil || string(value) != fmt.Sprintf("v%d_%d", f, g) {
+					t.Errorf("concurrent Get file %d key %d = %q, %v", f, g, value, err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkAccounting()
+
+	// 关闭后移出预算
+	for _, node := range nodes {
+		node.Reader().Close()
+	}
+	nodes = nil
+	if used := budget.Used(); used != 0 {
+		t.Fatalf("budget used %d after closing all readers, want 0", used)
+	}
+}
+
+// TestFilterBudgetIndexEviction 索引被淘汰时过滤器一并移出过滤器预算，重新解析索引后再计入
+func TestFilterBudgetIndexEviction(t *testing.T) {
+	conf := newBudgetConfig(t)
+	paths := writeBudgetSSTs(t, conf, 4, 20)
+	nodes, _ := openReaders(t, conf, paths, nil)
+	defer closeNodes(nodes)
+	indexes := NewIndexBudget(nodes[0].Reader().IndexMemory())
+	filters := NewFilterBudget(0)
+	for _, node := range nodes {
+		node.Reader().AttachFilterBudget(filters)
+		node.Reader().AttachBudget(indexes)
+	}
+	// 索引预算只能容纳一个文件，其余文件的索引和过滤器都已释放
+	last := nodes[len(nodes)-1].Reader()
+	if used := filters.Used(); used != last.FilterMemory() || used == 0 {
+		t.Fatalf("filter budget used %d, want only the last reader's %d", used, last.FilterMemory())
+	}
+	for f, node := range nodes {
+		if value, err := node.Get(budgetKey(f, 1)); err != nil || string(value) != fmt.Sprintf("v%d_1", f) {
+			t.Fatalf("Get file %d = %q, %v", f, value, err)
+		}
+		if used, want := filters.Used(), node.Reader().FilterMemory(); used != want {
+			t.Fatalf("filter budget used %d after reading file %d, want %d", used, f, want)
+		}
+		if reloads := node.Reader().FilterReloads(); reloads != 0 {
+			t.Fatalf("file %d FilterReloads = %d, want 0 when filters were reparsed with the index", f, reloads)
+		}
+	}
+}
@@ -4,39 +4,159 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// 索引编码版本。旧版本的索引条目没有版本字节，第一个字节是startKey长度的最高字节，
+// 由于key长度远小于16MB该字节恒为0，因此以0表示旧版本，新版本从1开始
+const (
+	IndexVersionLegacy uint8 = 0 // 旧版本: startKeyLen endKeyLen startKey endKey offset length
+	IndexVersion1      uint8 = 1 // 增加EntryCount、CRC和Compression
+	IndexVersion             = IndexVersion1
+)
+
+// 索引中单个key的最大长度，超过时视为数据损坏，与WAL的限制一致
+const maxIndexKeyLength = 10 * 1024 * 1024
+
+// CompressionType 数据块压缩类型
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = iota // 不压缩
 )
 
 // Index
 type Index struct {
-	StartKey []byte //最小的key
-	EndKey   []byte //最大的key
-	Offset   int64  //偏移量
-	Length   int64  //长度
+	StartKey    []byte          //最小的key
+	EndKey      []byte          //最大的key
+	Offset      int64           //偏移量
+	Length      int64           //长度
+	EntryCount  uint32          //数据块中的条目数，旧版本文件为0
+	CRC         uint32          //数据块的crc32校验和，旧版本文件为0
+	Compression CompressionType //数据块的压缩类型
+}
+
+// BlockHandle 数据块在文件中的位置和key范围，由SSTReader.BlockHandles返回
+type BlockHandle struct {
+	Offset    int64  // 数据块在文件中的偏移量
+	Length    int64  // 数据块的长度
+	FirstKey  []byte // 数据块中的第一个key
+	LastKey   []byte // 数据块中的最后一个key
+	HasFilter bool   // 数据块是否有过滤器，条目过少或过滤器区超出上限时没有
 }
 
 func (i *Index) String() string {
-	return fmt.Sprintf("StartKey: %s, EndKey: %s, Offset: %d, Length: %d", i.StartKey, i.EndKey, i.Offset, i.Length)
+	return fmt.Sprintf("StartKey: %s, EndKey: %s, Offset: %d, Length: %d, EntryCount: %d", i.StartKey, i.EndKey, i.Offset, i.Length, i.EntryCount)
 }
 
+// Encode 按当前版本编码索引条目
 func (i *Index) Encode() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(i.StartKey))); err != nil {
-		return nil, err
+	if len(i.StartKey) > maxIndexKeyLength || len(i.EndKey) > maxIndexKeyLength {
+		return nil, fmt.Errorf("index key too large: startKey=%d, endKey=%d", len(i.StartKey), len(i.EndKey))
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(i.EndKey))); err != nil {
+	// 版本、两个key长度、两个key、Offset、Length、EntryCount、CRC和Compression，一次分配
+	buf := make([]byte, 0, 1+4+4+len(i.StartKey)+len(i.EndKey)+8+8+4+4+1)
+	buf = append(buf, IndexVersion)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(i.StartKey)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(i.EndKey)))
+	buf = append(buf, i.StartKey...)
+	buf = append(buf, i.EndKey...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(i.Offset))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(i.Length))
+	buf = binary.BigEndian.AppendUint32(buf, i.EntryCount)
+	buf = binary.BigEndian.AppendUint32(buf, i.CRC)
+	buf = append(buf, byte(i.Compression))
+	return buf, nil
+}
+
+// DecodeIndex 从r中解码一个索引条目，兼容旧版本编码。
+// r在条目开始处为空时返回io.EOF，条目不完整或格式错误时返回ErrInvalidSSTFormat
+func DecodeIndex(r io.Reader) (*Index, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:1]); err != nil {
 		return nil, err
 	}
-	if _, err := buf.Write(i.StartKey); err != nil {
-		return nil, err
+	version := header[0]
+	switch version {
+	case IndexVersionLegacy:
+		// 版本字节即startKey长度的最高字节
+		if _, err := io.ReadFull(r, header[1:]); err != nil {
+			return nil, indexFormatError(err)
+		}
+	case IndexVersion1:
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, indexFormatError(err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown index version %d", myerror.ErrInvalidSSTFormat, version)
 	}
-	if _, err := buf.Write(i.EndKey); err != nil {
-		return nil, err
+	startKeyLen := binary.BigEndian.Uint32(header[:])
+
+	var endKeyLen uint32
+	if err := binary.Read(r, binary.BigEndian, &endKeyLen); err != nil {
+		return nil, indexFormatError(err)
 	}
-	if err := binary.Write(buf, binary.BigEndian, i.Offset); err != nil {
-		return nil, err
+	if startKeyLen > maxIndexKeyLength || endKeyLen > maxIndexKeyLength {
+		return nil, fmt.Errorf("%w: index key too large: startKey=%d, endKey=%d", myerror.ErrInvalidSSTFormat, startKeyLen, endKeyLen)
 	}
-	if err := binary.Write(buf, binary.BigEndian, i.Length); err != nil {
-		return nil, err
+
+	// 已知剩余长度时在分配前校验，避免损坏的长度导致超大的内存分配
+	if remaining, ok := r.(interface{ Len() int }); ok && int64(startKeyLen)+int64(endKeyLen) > int64(remaining.Len()) {
+		return nil, fmt.Errorf("%w: truncated index entry", myerror.ErrInvalidSSTFormat)
+	}
+	index := &Index{}
+	index.StartKey = make([]byte, startKeyLen)
+	if _, err := io.ReadFull(r, index.StartKey); err != nil {
+		return nil, indexFormatError(err)
+	}
+	index.EndKey = make([]byte, endKeyLen)
+	if _, err := io.ReadFull(r, index.EndKey); err != nil {
+		return nil, indexFormatError(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &index.Offset); err != nil {
+		return nil, indexFormatError(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &index.Length); err != nil {
+		return nil, indexFormatError(err)
+	}
+	if version == IndexVersionLegacy {
+		return index, nil
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &index.EntryCount); err != nil {
+		return nil, indexFormatError(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &index.CRC); err != nil {
+		return nil, indexFormatError(err)
+	}
+	var compression [1]byte
+	if _, err := io.ReadFull(r, compression[:]); err != nil {
+		return nil, indexFormatError(err)
+	}
+	index.Compression = CompressionType(compression[0])
+	return index, nil
+}
+
+// DecodeIndexes 解码索引区域中的全部索引条目
+func DecodeIndexes(data []byte) ([]*Index, error) {
+	indexes := make([]*Index, 0)
+	buf := bytes.NewReader(data)
+	for buf.Len() > 0 {
+		index, err := DecodeIndex(buf)
+		if err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+// indexFormatError 将条目中途的读取结束转换为格式错误
+func indexFormatError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated index entry", myerror.ErrInvalidSSTFormat)
 	}
-	return buf.Bytes(), nil
+	return err
 }
@@ -0,0 +1,112 @@
+package sst
+
+import (
+	"container/list"
+	"sync"
+)
+
+// IndexBudget 限制所有SST读取器常驻内存的索引和过滤器总大小
+// 超出预算时按LRU顺序淘汰最久未访问的读取器的索引，下次访问时再从文件中解析
+type IndexBudget struct {
+	mu      sync.Mutex                   // 互斥锁
+	limit   int64                        // 预算上限，<=0表示不限制
+	used    int64                        // 已使用的内存估算
+	lru     *list.List                   // 最近访问的读取器在前
+	entries map[*SSTReader]*list.Element // 读取器到LRU节点的映射
+}
+
+// NewIndexBudget 创建索引内存预算，limit<=0表示不限制
+func NewIndexBudget(limit int64) *IndexBudget {
+	return &IndexBudget{
+		limit:   limit,
+		lru:     list.New(),
+		entries: make(map[*SSTReader]*list.Element),
+	}
+}
+
+// Used 返回当前常驻内存的索引和过滤器大小
+func (b *IndexBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Limit 返回预算上限
+func (b *IndexBudget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// add 将刚解析完索引的读取器计入预算，必要时淘汰其他读取器
+func (b *IndexBudget) add(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if elem, ok := b.entries[r]; ok {
+		b.lru.MoveToFront(elem)
+		b.mu.Unlock()
+		return
+	}
+	b.entries[r] = b.lru.PushFront(r)
+	b.used += r.IndexMemory()
+	victims := b.shrink(r)
+	b.mu.Unlock()
+
+	// 在预算锁之外释放索引，避免与读取器的锁互相等待
+	for _, victim := range victims {
+		victim.evictIndex()
+	}
+}
+
+// touch 标记读取器最近被访问
+func (b *IndexBudget) touch(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.entries[r]; ok {
+		b.lru.MoveToFront(elem)
+	}
+}
+
+// Remove 将读取器移出预算，通常在读取器关闭时调用
+func (b *IndexBudget) Remove(r *SSTReader) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elem, ok := b.entries[r]; ok {
+		b.lru.Remove(elem)
+		delete(b.entries, r)
+		b.used -= r.IndexMemory()
+	}
+}
+
+// shrink 从LRU尾部挑选需要淘汰的读取器直到满足预算，keep不会被淘汰
+// 调用方需持有b.mu
+func (b *IndexBudget) shrink(keep *SSTReader) []*SSTReader {
+	if b.limit <= 0 {
+		return nil
+	}
+	var victims []*SSTReader
+	for elem := b.lru.Back(); b.used > b.limit && elem != nil; {
+		prev := elem.Prev()
+		r := elem.Value.(*SSTReader)
+		if r != keep {
+			b.lru.Remove(elem)
+			delete(b.entries, r)
+			b.used -= r.IndexMemory()
+			victims = append(victims, r)
+		}
+		elem = prev
+	}
+	return victims
+}
@@ -0,0 +1,157 @@
+package sst
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// writeBudgetSSTs 写入count个SST文件，每个数据块只有一个长key，使索引和过滤器占据主要内存
+func writeBudgetSSTs(tb testing.TB, conf *config.Config, count, keysPerFile int) []string {
+	tb.Helper()
+	files := make([]string, 0, count)
+	for f := 0; f < count; f++ {
+		path := filepath.Join(conf.DataDir, fmt.Sprintf("0_%d.sst", f))
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			tb.Fatalf("NewSSTWriter: %v", err)
+		}
+		for i := 0; i < keysPerFile; i++ {
+			if err := writer.Add(budgetKey(f, i), []byte(fmt.Sprintf("v%d_%d", f, i))); err != nil {
+				tb.Fatalf("Add: %v", err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			tb.Fatalf("Flush: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			tb.Fatalf("Close: %v", err)
+		}
+		files = append(files, path)
+	}
+	return files
+}
+
+func budgetKey(file, i int) []byte {
+	return []byte(fmt.Sprintf("%s_%04d_%04d", bytes.Repeat([]byte("k"), 200), file, i))
+}
+
+func newBudgetConfig(tb testing.TB) *config.Config {
+	conf := testConfig()
+	conf.DataDir = tb.TempDir()
+	conf.BlockEntryLimit = 1
+	conf.IsDebug = false
+	conf.Logger = nil
+	return conf
+}
+
+// openReaders 打开所有文件并返回打开后的堆内存占用
+func openReaders(tb testing.TB, conf *config.Config, files []string, budget *IndexBudget) ([]*Node, uint64) {
+	tb.Helper()
+	nodes := make([]*Node, 0, len(files))
+	for i, file := range files {
+		reader, err := NewSSTReader(conf, file)
+		if err != nil {
+			tb.Fatalf("NewSSTReader: %v", err)
+		}
+		reader.AttachBudget(budget)
+		node, err := NewNode(conf, file, 0, int32(i), reader)
+		if err != nil {
+			tb.Fatalf("NewNode: %v", err)
+		}
+		nodes = append(nodes, node)
+	}
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return nodes, stats.HeapAlloc
+}
+
+func closeNodes(nodes []*Node) {
+	for _, node := range nodes {
+		node.Reader().Close()
+	}
+}
+
+func TestIndexBudgetMemory(t *testing.T) {
+	const files, keysPerFile = 100, 50
+	conf := newBudgetConfig(t)
+	paths := writeBudgetSSTs(t, conf, files, keysPerFile)
+
+	unlimited, unlimitedHeap := openReaders(t, conf, paths, nil)
+	perFile := unlimited[0].Reader().IndexMemory()
+	closeNodes(unlimited)
+
+	budget := NewIndexBudget(perFile * 10)
+	budgeted, budgetedHeap := openReaders(t, conf, paths, budget)
+	defer closeNodes(budgeted)
+
+	if used := budget.Used(); used > budget.Limit() {
+		t.Fatalf("budget used %d exceeds limit %d", used, budget.Limit())
+	}
+	if budgetedHeap >= unlimitedHeap {
+		t.Fatalf("budgeted heap %d should be lower than unlimited heap %d", budgetedHeap, unlimitedHeap)
+	}
+	t.Logf("heap unlimited=%d budgeted=%d index per file=%d", unlimitedHeap, budgetedHeap, perFile)
+
+	// 被淘汰的读取器在访问时重新解析索引，结果保持正确
+	for f, node := range budgeted {
+		for _, i := range []int{0, keysPerFile / 2, keysPerFile - 1} {
+			value, err := node.Get(budgetKey(f, i))
+			if err != nil {
+				t.Fatalf("Get file %d key %d: %v", f, i, err)
+			}
+			if want := fmt.Sprintf("v%d_%d", f, i); string(value) != want {
+				t.Fatalf("Get file %d key %d = %q, want %q", f, i, value, want)
+			}
+		}
+		if len(node.GetIndex()) == 0 {
+			t.Fatalf("file %d index is empty after reload", f)
+		}
+		if used := budget.Used(); used > budget.Limit() {
+			t.Fatalf("budget used %d exceeds limit %d", used, budget.Limit())
+		}
+	}
+}
+
+func TestIndexBudgetEvictAndReload(t *testing.T) {
+	conf := newBudgetConfig(t)
+	paths := writeBudgetSSTs(t, conf, 3, 10)
+
+	budget := NewIndexBudget(1)
+	nodes, _ := openReaders(t, conf, paths, budget)
+	defer closeNodes(nodes)
+
+	// 预算不足时仅保留最近访问的读取器
+	if nodes[0].Reader().index != nil || nodes[1].Reader().index != nil {
+		t.Fatal("expected older readers to be evicted")
+	}
+	if nodes[2].Reader().index == nil {
+		t.Fatal("expected most recent reader to stay resident")
+	}
+	if !bytes.Equal(nodes[0].GetMinKey(), budgetKey(0, 0)) || !bytes.Equal(nodes[0].GetMaxKey(), budgetKey(0, 9)) {
+		t.Fatal("min/max key must survive eviction")
+	}
+	if !nodes[0].HasFilter() {
+		t.Fatal("HasFilter must survive eviction")
+	}
+
+	if _, err := nodes[0].Get(budgetKey(0, 5)); err != nil {
+		t.Fatalf("Get after eviction: %v", err)
+	}
+	if nodes[0].Reader().index == nil || nodes[2].Reader().index != nil {
+		t.Fatal("expected reload to evict the least recently used reader")
+	}
+	if got := budget.Used(); got != nodes[0].Reader().IndexMemory() {
+		t.Fatalf("budget used %d, want %d", got, nodes[0].Reader().IndexMemory())
+	}
+
+	nodes[0].Reader().Close()
+	if got := budget.Used(); got != 0 {
+		t.Fatalf("budget used after close = %d, want 0", got)
+	}
+}
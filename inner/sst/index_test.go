@@ -0,0 +1,142 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// randomIndex 生成随机索引，key长度覆盖空key和64KB的大key
+func randomIndex(rng *rand.Rand) *Index {
+	keyLen := func() int {
+		switch rng.Intn(4) {
+		case 0:
+			return 0
+		case 1:
+			return 64 * 1024
+		default:
+			return rng.Intn(256)
+		}
+	}
+	randomKey := func() []byte {
+		key := make([]byte, keyLen())
+		rng.Read(key)
+		return key
+	}
+	offset := rng.Int63()
+	if rng.Intn(4) == 0 {
+		offset = math.MaxInt64
+	}
+	return &Index{
+		StartKey:    randomKey(),
+		EndKey:      randomKey(),
+		Offset:      offset,
+		Length:      rng.Int63(),
+		EntryCount:  rng.Uint32(),
+		CRC:         rng.Uint32(),
+		Compression: CompressionType(rng.Intn(2)),
+	}
+}
+
+func TestIndexEncodeDecodeRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1596))
+	for i := 0; i < 200; i++ {
+		want := randomIndex(rng)
+		encoded, err := want.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := DecodeIndex(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("decode %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("round trip mismatch:\nwant %v\ngot  %v", want, got)
+		}
+	}
+}
+
+func TestDecodeIndexes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	want := make([]*Index, 0)
+	buf := bytes.NewBuffer(nil)
+	for i := 0; i < 10; i++ {
+		index := randomIndex(rng)
+		encoded, err := index.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(encoded)
+		want = append(want, index)
+	}
+	got, err := DecodeIndexes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("decoded indexes mismatch")
+	}
+
+	empty, err := DecodeIndexes(nil)
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("expected no indexes, got %d, %v", len(empty), err)
+	}
+}
+
+func TestDecodeIndexLegacy(t *testing.T) {
+	// 旧版本编码: startKeyLen endKeyLen startKey endKey offset length
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, uint32(3))
+	binary.Write(buf, binary.BigEndian, uint32(4))
+	buf.WriteString("abc")
+	buf.WriteString("wxyz")
+	binary.Write(buf, binary.BigEndian, int64(128))
+	binary.Write(buf, binary.BigEndian, int64(64))
+
+	got, err := DecodeIndexes(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Index{{StartKey: []byte("abc"), EndKey: []byte("wxyz"), Offset: 128, Length: 64}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("legacy decode mismatch: %v", got)
+	}
+}
+
+func TestDecodeIndexMalformed(t *testing.T) {
+	index := &Index{
+		StartKey:   []byte("start"),
+		EndKey:     []byte("end"),
+		Offset:     math.MaxInt64,
+		Length:     4096,
+		EntryCount: 7,
+		CRC:        0xdeadbeef,
+	}
+	encoded, err := index.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 在每个字节处截断都必须返回错误而不是panic
+	for n := 1; n < len(encoded); n++ {
+		if _, err := DecodeIndexes(encoded[:n]); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Fatalf("truncated at %d: expected ErrInvalidSSTFormat, got %v", n, err)
+		}
+	}
+
+	unknown := append([]byte{0x7f}, encoded[1:]...)
+	if _, err := DecodeIndexes(unknown); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("expected ErrInvalidSSTFormat for unknown version, got %v", err)
+	}
+
+	huge := append([]byte(nil), encoded...)
+	binary.BigEndian.PutUint32(huge[1:5], math.MaxUint32)
+	if _, err := DecodeIndexes(huge); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("expected ErrInvalidSSTFormat for huge key length, got %v", err)
+	}
+}
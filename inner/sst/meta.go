@@ -0,0 +1,247 @@
+package sst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// 元数据区位于过滤器区与footer之间，由若干 keyLen(4) valueLen(4) key value 组成
+// 没有元数据的文件不写入该区域，与旧格式保持一致
+const (
+	MetaPrefixExtractor = "prefix.extractor" // 构建前缀过滤器时使用的前缀提取器名称
+	MetaEntries         = "entries"          // 条目数，包括删除标记
+	MetaTombstones      = "tombstones"       // 删除标记数
+	MetaRawKeyBytes     = "raw.key.bytes"    // 所有key的总字节数
+	MetaRawValueBytes   = "raw.value.bytes"  // 所有value的总字节数
+	MetaBlockFormat     = "block.format"     // 数据块条目编码版本
+	MetaFilterFormat    = "filter.format"    // 过滤器区编码版本
+	MetaFilterName      = "filter.name"      // 过滤器名称(见filter.Register)，没有该项的旧文件使用FilterConstructor
+	MetaFilterSkipped   = "filter.skipped"   // 条目数少于MinKeysPerFilter而未写入过滤器的数据块数
+	MetaFilterCapped    = "filter.capped"    // 超出MaxFilterBytesPerFile而未写入过滤器的数据块数
+	MetaCreatedAt       = "created.at"       // 文件写入时间(unix纳秒)，DeterministicOutput时为0
+	MetaMinKey          = "min.key"          // 文件中的最小key，没有条目时不写入
+	MetaMaxKey          = "max.key"          // 文件中的最大key，没有条目时不写入
+	MetaSourceWal       = "source.wal"       // 刷盘生成的文件对应的WAL id，合并刷盘时为逗号分隔的多个id，其他方式生成的文件不写入
+	MetaMaxSeq          = "max.seq"          // 文件中条目的最大写入序列号，所有条目都没有序列号时不写入
+	MetaMinExpiry       = "expiry.min"       // 设置了过期时间的条目中最早的过期时间(unix纳秒)，没有这样的条目时不写入
+	MetaMaxExpiry       = "expiry.max"       // 所有条目都设置了过期时间时最晚的过期时间(unix纳秒)，否则不写入
+	MetaBlockSizes      = "block.sizes"      // 数据块大小分布，格式为 上限:块数,上限:块数，没有数据块时不写入
+	MetaKeySchema       = "key.schema"       // 写入时KeySchema的名称，没有设置时不写入
+	MetaKeyPrefixes     = "key.prefixes"     // 按KeySchema统计的前1个、前2个……字段组成的前缀的不同取值数，逗号分隔
+)
+
+// Properties 写入SST时统计的文件属性，旧文件没有属性时各项为0
+type Properties struct {
+	Entries       int64  // 条目数，包括删除标记
+	Tombstones    int64  // 删除标记数
+	RawKeyBytes   int64  // 所有key的总字节数
+	RawValueBytes int64  // 所有value的总字节数
+	FilterSkipped int64  // 条目数少于MinKeysPerFilter而未写入过滤器的数据块数
+	FilterCapped  int64  // 超出MaxFilterBytesPerFile而未写入过滤器的数据块数
+	CreatedAt     int64  // 文件写入时间(unix纳秒)，重写文件时更新，旧文件和DeterministicOutput写入的文件为0
+	MaxSeq        uint64 // 条目的最大写入序列号，没有记录序列号时为0
+	MinExpiry     int64  // 设置了过期时间的条目中最早的过期时间(unix纳秒)，没有这样的条目时为0
+	MaxExpiry     int64  // 所有条目都设置了过期时间时最晚的过期时间(unix纳秒)，有条目不会过期(包括删除标记)时为0
+}
+
+// AllExpired 判断文件中的所有条目在now(unix纳秒)时是否都已过期，旧文件没有记录过期时间时返回false
+func (p Properties) AllExpired(now int64) bool {
+	return p.MaxExpiry != 0 && p.MaxExpiry <= now
+}
+
+// AnyExpireBy 判断文件中是否可能有条目在before(unix纳秒)或之前过期，旧文件没有记录过期时间时返回false
+func (p Properties) AnyExpireBy(before int64) bool {
+	return p.MinExpiry != 0 && p.MinExpiry <= before
+}
+
+// LogicalBytes 估算文件中未被删除的数据的逻辑大小
+func (p Properties) LogicalBytes() int64 {
+	if p.Entries == 0 {
+		return 0
+	}
+	live := p.Entries - p.Tombstones
+	return (p.RawKeyBytes + p.RawValueBytes) * live / p.Entries
+}
+
+// encode 将属性写入元数据
+func (p Properties) encode(meta map[string]string) {
+	meta[MetaEntries] = strconv.FormatInt(p.Entries, 10)
+	meta[MetaTombstones] = strconv.FormatInt(p.Tombstones, 10)
+	meta[MetaRawKeyBytes] = strconv.FormatInt(p.RawKeyBytes, 10)
+	meta[MetaRawValueBytes] = strconv.FormatInt(p.RawValueBytes, 10)
+	meta[MetaFilterSkipped] = strconv.FormatInt(p.FilterSkipped, 10)
+	meta[MetaFilterCapped] = strconv.FormatInt(p.FilterCapped, 10)
+	meta[MetaCreatedAt] = strconv.FormatInt(p.CreatedAt, 10)
+	if p.MaxSeq > 0 {
+		meta[MetaMaxSeq] = strconv.FormatUint(p.MaxSeq, 10)
+	}
+	if p.MinExpiry != 0 {
+		meta[MetaMinExpiry] = strconv.FormatInt(p.MinExpiry, 10)
+	}
+	if p.MaxExpiry != 0 {
+		meta[MetaMaxExpiry] = strconv.FormatInt(p.MaxExpiry, 10)
+	}
+}
+
+// decodeProperties 从元数据中解析属性，缺失或格式错误的项为0
+func decodeProperties(meta map[string]string) Properties {
+	parse := func(key string) int64 {
+		n, _ := strconv.ParseInt(meta[key], 10, 64)
+		return n
+	}
+	maxSeq, _ := strconv.ParseUint(meta[MetaMaxSeq], 10, 64)
+	return Properties{
+		Entries:       parse(MetaEntries),
+		Tombstones:    parse(MetaTombstones),
+		RawKeyBytes:   parse(MetaRawKeyBytes),
+		RawValueBytes: parse(MetaRawValueBytes),
+		FilterSkipped: parse(MetaFilterSkipped),
+		FilterCapped:  parse(MetaFilterCapped),
+		CreatedAt:     parse(MetaCreatedAt),
+		MaxSeq:        maxSeq,
+		MinExpiry:     parse(MetaMinExpiry),
+		MaxExpiry:     parse(MetaMaxExpiry),
+	}
+}
+
+// BlockSizeBucket 数据块大小分布中的一个区间，由SSTReader.BlockSizeHistogram返回
+type BlockSizeBucket struct {
+	UpperBound int64 // 区间上限(包括)，为2的幂
+	Count      int64 // 大小在(UpperBound/2, UpperBound]内的数据块数
+}
+
+// blockSizeHistogram 写入时统计的数据块大小分布，key为区间上限
+type blockSizeHistogram map[int64]int64
+
+// add 记录一个size字节的数据块
+func (h blockSizeHistogram) add(size int64) {
+	h[int64(1)<<bits.Len64(uint64(size-1))]++
+}
+
+// encode 按区间上限从小到大编码
+func (h blockSizeHistogram) encode() string {
+	bounds := make([]int64, 0, len(h))
+	for bound := range h {
+		bounds = append(bounds, bound)
+	}
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	parts := make([]string, len(bounds))
+	for i, bound := range bounds {
+		parts[i] = strconv.FormatInt(bound, 10) + ":" + strconv.FormatInt(h[bound], 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// PrefixStats 写入时按KeySchema统计的前缀的不同取值数
+type PrefixStats struct {
+	Schema   string   // 写入时KeySchema的名称
+	Distinct []uint64 // Distinct[i]为前i+1个字段组成的前缀的不同取值数，key不够长时以整个key计
+}
+
+// encodePrefixCounts 编码各级前缀的不同取值数
+func encodePrefixCounts(counts []uint64) string {
+	parts := make([]string, len(counts))
+	for i, count := range counts {
+		parts[i] = strconv.FormatUint(count, 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// decodePrefixStats 解析元数据中的前缀统计，没有记录或格式错误时返回false
+func decodePrefixStats(meta map[string]string) (PrefixStats, bool) {
+	schema, value := meta[MetaKeySchema], meta[MetaKeyPrefixes]
+	if schema == "" || value == "" {
+		return PrefixStats{}, false
+	}
+	stats := PrefixStats{Schema: schema}
+	for _, part := range strings.Split(value, ",") {
+		count, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return PrefixStats{}, false
+		}
+		stats.Distinct = append(stats.Distinct, count)
+	}
+	return stats, true
+}
+
+// decodeBlockSizes 解析元数据中的数据块大小分布，缺失或格式错误时返回nil
+func decodeBlockSizes(value string) []BlockSizeBucket {
+	if value == "" {
+		return nil
+	}
+	var buckets []BlockSizeBucket
+	for _, part := range strings.Split(value, ",") {
+		bound, count, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil
+		}
+		b, err1 := strconv.ParseInt(bound, 10, 64)
+		c, err2 := strconv.ParseInt(count, 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil
+		}
+		buckets = append(buckets, BlockSizeBucket{UpperBound: b, Count: c})
+	}
+	return buckets
+}
+
+// encodeMeta 按key排序编码元数据，保证相同内容得到相同的字节
+func encodeMeta(meta map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(meta))
+	for k := range meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := bytes.NewBuffer(nil)
+	for _, k := range keys {
+		v := meta[k]
+		if err := binary.Write(buf, binary.BigEndian, uint32(len(k))); err != nil {
+			return nil, err
+		}
+		if err := binary.Write(buf, binary.BigEndian, uint32(len(v))); err != nil {
+			return nil, err
+		}
+		buf.WriteString(k)
+		buf.WriteString(v)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMeta 解码元数据区
+func decodeMeta(data []byte) (map[string]string, error) {
+	return decodeMetaFrom(bytes.NewReader(data))
+}
+
+// decodeMetaFrom 从buf流式解码元数据区，按buf中剩余的字节数在分配前校验长度
+func decodeMetaFrom(buf interface {
+	io.Reader
+	Len() int
+}) (map[string]string, error) {
+	meta := make(map[string]string)
+	for buf.Len() > 0 {
+		var keyLen, valueLen uint32
+		if err := binary.Read(buf, binary.BigEndian, &keyLen); err != nil {
+			return nil, myerror.ErrInvalidSSTFormat
+		}
+		if err := binary.Read(buf, binary.BigEndian, &valueLen); err != nil {
+			return nil, myerror.ErrInvalidSSTFormat
+		}
+		if int64(keyLen)+int64(valueLen) > int64(buf.Len()) {
+			return nil, myerror.ErrInvalidSSTFormat
+		}
+		kv := make([]byte, keyLen+valueLen)
+		if _, err := io.ReadFull(buf, kv); err != nil {
+			return nil, myerror.ErrInvalidSSTFormat
+		}
+		meta[string(kv[:keyLen])] = string(kv[keyLen:])
+	}
+	return meta, nil
+}
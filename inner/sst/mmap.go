@@ -0,0 +1,82 @@
+package sst
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// mmapFile 只读映射的SST文件。打开时持有一个引用，Close释放该引用，
+// 每次从映射中解析数据块前通过acquire增加引用，最后一个引用释放时才解除映射并关闭文件，
+// 因此节点被替换或删除时正在进行的读取仍然安全
+type mmapFile struct {
+	fp     *os.File
+	data   []byte
+	refs   atomic.Int64 // 引用数，为0时映射已解除
+	closed atomic.Bool  // 打开时持有的引用是否已释放
+}
+
+// openMmapFile 映射fp的前size字节，失败时不关闭fp
+func openMmapFile(fp *os.File, size int64) (*mmapFile, error) {
+	data, err := mmapRegion(fp, size)
+	if err != nil {
+		return nil, err
+	}
+	m := &mmapFile{fp: fp, data: data}
+	m.refs.Store(1)
+	return m, nil
+}
+
+// ReadAt 从映射中复制数据，用于解析footer、元数据、索引和过滤器等需要保留的区域
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if !m.acquire() {
+		return 0, os.ErrClosed
+	}
+	defer m.release()
+	if off < 0 || off > int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice 返回映射中[off, off+n)的切片，调用方需持有引用，且在释放引用前不再使用该切片
+func (m *mmapFile) slice(off, n int64) ([]byte, error) {
+	if off < 0 || n < 0 || off+n > int64(len(m.data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return m.data[off : off+n], nil
+}
+
+// acquire 增加引用，映射已解除时返回false
+func (m *mmapFile) acquire() bool {
+	for {
+		refs := m.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if m.refs.CompareAndSwap(refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release 释放引用，最后一个引用释放时解除映射并关闭文件
+func (m *mmapFile) release() error {
+	if m.refs.Add(-1) != 0 {
+		return nil
+	}
+	return errors.Join(munmapRegion(m.data), m.fp.Close())
+}
+
+// Close 释放打开时持有的引用，重复调用返回os.ErrClosed
+func (m *mmapFile) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return os.ErrClosed
+	}
+	return m.release()
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package sst
+
+import (
+	"errors"
+	"os"
+)
+
+// 不支持mmap的平台上SSTReadMmap退回pread
+var errMmapUnsupported = errors.New("mmap not supported on this platform")
+
+func mmapRegion(fp *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapRegion(data []byte) error {
+	return nil
+}
@@ -0,0 +1,205 @@
+package sst
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// testReadMode 本包测试创建的读取器使用的读取方式，TestMain依次以两种方式运行全部测试
+var testReadMode = config.SSTReadPread
+
+// testConfig 返回默认配置，读取方式为testReadMode
+func testConfig() *config.Config {
+	conf := config.DefaultConfig()
+	conf.SSTReadMode = testReadMode
+	return conf
+}
+
+func TestMain(m *testing.M) {
+	if code := m.Run(); code != 0 {
+		os.Exit(code)
+	}
+	testReadMode = config.SSTReadMmap
+	os.Exit(m.Run())
+}
+
+// writeMmapTestSST 写入n个key%05d -> value%05d，返回文件路径
+func writeMmapTestSST(tb testing.TB, n int) string {
+	tb.Helper()
+	conf := testConfig()
+	conf.BlockEntryLimit = 16
+	path := filepath.Join(tb.TempDir(), "mmap.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i))); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func openMmapReader(t *testing.T, path string) *SSTReader {
+	t.Helper()
+	conf := testConfig()
+	conf.SSTReadMode = config.SSTReadMmap
+	conf.BlockCacheSize = 1 << 20
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reader.Mapped() {
+		t.Skip("mmap not supported on this platform")
+	}
+	return reader
+}
+
+func TestMmapReaderBypassesBlockCache(t *testing.T) {
+	reader := openMmapReader(t, writeMmapTestSST(t, 100))
+	defer reader.Close()
+	cache := NewBlockCache(reader.conf.BlockCacheSize)
+	reader.AttachBlockCache(cache)
+	if reader.kvLists != nil {
+		t.Fatal("mmap reader loaded all data blocks at open")
+	}
+	for i := 0; i < 100; i++ {
+		value, err := reader.Get([]byte(fmt.Sprintf("key%05d", i)))
+		if err != nil || string(value) != fmt.Sprintf("value%05d", i) {
+			t.Fatalf("Get key%05d = %q, %v", i, value, err)
+		}
+	}
+	if n := cache.Used(); n != 0 {
+		t.Fatalf("block cache holds %d bytes, want 0", n)
+	}
+}
+
+func TestMmapReaderDataOutlivesClose(t *testing.T) {
+	reader := openMmapReader(t, writeMmapTestSST(t, 100))
+	value, err := reader.Get([]byte("key00042"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, errs := reader.MultiGet([][]byte{[]byte("key00001"), []byte("key00099")})
+	var scanned [][]byte
+	if err := reader.PrefixScan([]byte("key0005"), func(key, value []byte) bool {
+		scanned = append(scanned, key, value)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	entries := reader.KvList()
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 返回的数据都是复制的，解除映射后读取不会崩溃
+	if string(value) != "value00042" {
+		t.Fatalf("Get value after Close = %q", value)
+	}
+	for i, want := range []string{"value00001", "value00099"} {
+		if errs[i] != nil || string(values[i]) != want {
+			t.Fatalf("MultiGet[%d] after Close = %q, %v", i, values[i], errs[i])
+		}
+	}
+	if len(scanned) != 20 || string(scanned[0]) != "key00050" || string(scanned[19]) != "value00059" {
+		t.Fatalf("PrefixScan after Close = %q", scanned)
+	}
+	if len(entries) != 100 || string(entries[99].Value) != "value00099" {
+		t.Fatalf("KvList after Close has %d entries", len(entries))
+	}
+
+	if _, err := reader.Get([]byte("key00042")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Get after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestMmapReaderUnmapWaitsForReferences(t *testing.T) {
+	path := writeMmapTestSST(t, 100)
+	reader := openMmapReader(t, path)
+	node, err := NewNode(reader.conf, path, 0, 1, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.Acquire() {
+		t.Fatal("Acquire on open reader failed")
+	}
+	// 压缩替换节点时关闭读取器并删除文件，持有引用期间映射仍然有效
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("second Close = %v, want nil", err)
+	}
+	value, err := node.Get([]byte("key00007"))
+	if err != nil || string(value) != "value00007" {
+		t.Fatalf("Get while referenced = %q, %v", value, err)
+	}
+	if _, err := node.Get([]byte("missing")); !errors.Is(err, myerror.ErrKeyNotFound) {
+		t.Fatalf("Get missing = %v, want ErrKeyNotFound", err)
+	}
+
+	node.Release()
+	if reader.mapped.refs.Load() != 0 {
+		t.Fatalf("%d references left after release", reader.mapped.refs.Load())
+	}
+	if node.Acquire() {
+		t.Fatal("Acquire after unmap succeeded")
+	}
+	if _, err := node.Get([]byte("key00007")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Get after unmap = %v, want os.ErrClosed", err)
+	}
+}
+
+// BenchmarkReadRandom 比较pread(按需读取并缓存数据块)与mmap的随机点查
+func BenchmarkReadRandom(b *testing.B) {
+	const n = 100000
+	path := writeMmapTestSST(b, n)
+	for _, mode := range []struct {
+		name string
+		mode config.SSTReadMode
+	}{
+		{"Pread", config.SSTReadPread},
+		{"Mmap", config.SSTReadMmap},
+	} {
+		b.Run(mode.name, func(b *testing.B) {
+			conf := testConfig()
+			conf.SSTReadMode = mode.mode
+			conf.BlockCacheSize = 1 << 20
+			reader, err := NewSSTReader(conf, path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer reader.Close()
+			reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+			rng := rand.New(rand.NewSource(1))
+			keys := make([][]byte, 1024)
+			for i := range keys {
+				keys[i] = []byte(fmt.Sprintf("key%05d", rng.Intn(n)))
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := reader.Get(keys[i%len(keys)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
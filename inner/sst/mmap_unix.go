@@ -0,0 +1,17 @@
+//go:build unix
+
+package sst
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapRegion 只读映射文件的前size字节
+func mmapRegion(fp *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(fp.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapRegion(data []byte) error {
+	return syscall.Munmap(data)
+}
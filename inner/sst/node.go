@@ -1,39 +1,51 @@
+// Package sst 读写SST文件。查找方法(Get、GetEntry、MultiGet、PrefixScan、KvList等)返回的key和value归调用方所有，
+// 修改或追加不影响之后的读取；读取选项开启UnsafeSharedValue时返回共享的数据，调用方不得修改。
+// 迭代器的Key、Value和Entry引用迭代器读取的数据块，只在下一次调用Next之前有效，需要保留时由调用方复制
 package sst
 
 import (
-	"bytes"
+	"errors"
+	"sync/atomic"
 
 	"github.com/aixiasang/lsm/inner/config"
-	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 )
 
+// Node SST文件在内存中的描述，索引和过滤器由读取器统一持有
 type Node struct {
-	conf     *config.Config          // 配置
-	filename string                  // 文件名
-	level    int                     // 层级
-	seq      int32                   // 序列号
-	size     int64                   // 大小
-	minKey   []byte                  // 最小键
-	maxKey   []byte                  // 最大键
-	index    []*Index                // 索引
-	filter   map[int64]filter.Filter // 过滤器
-	reader   *SSTReader              // 读取器
-	kvList   []*KeyValue             // 数据块
+	conf     *config.Config            // 配置
+	filename string                    // 文件名
+	level    int                       // 层级
+	seq      int32                     // 序列号
+	size     int64                     // 大小
+	minKey   []byte                    // 最小键
+	maxKey   []byte                    // 最大键
+	reader   atomic.Pointer[SSTReader] // 读取器，Reopen时替换
+	heat     atomic.Uint64             // 采样到的读取次数，见RecordAccess
+	// 文件元数据中没有记录时由清单提供的来源WAL，打开节点后、发布前设置
+	sourceWals []uint32
 }
+
+// KeyValue 从SST文件中解析出的条目
 type KeyValue struct {
-	Key   []byte
-	Value []byte
+	kv.Entry
+
+	crc    uint32 // 写入时记录的key和value的crc32
+	hasCrc bool   // 条目是否带校验和
+}
+
+// verify 校验key和value是否与写入时记录的校验和一致，不带校验和的条目总是通过
+func (kv *KeyValue) verify() bool {
+	return !kv.hasCrc || entryChecksum(kv.Key, kv.Value) == kv.crc
 }
 
 func NewNode(conf *config.Config, filename string, level int, seq int32, reader *SSTReader) (*Node, error) {
 	size := reader.FileSize()
 	minKey := reader.MinKey()
 	maxKey := reader.MaxKey()
-	index := reader.Index()
-	bloomFilter := reader.Filter()
-	kvList := reader.KvList()
-	return &Node{
+	node := &Node{
 		conf:     conf,
 		filename: filename,
 		level:    level,
@@ -41,23 +53,113 @@ func NewNode(conf *config.Config, filename string, level int, seq int32, reader
 		size:     size,
 		minKey:   minKey,
 		maxKey:   maxKey,
-		index:    index,
-		filter:   bloomFilter,
-		reader:   reader,
-		kvList:   kvList,
-	}, nil
+	}
+	node.reader.Store(reader)
+	return node, nil
+}
+
+// withReader 使用当前的读取器调用fn，读取器在调用前已被Reopen替换并关闭时改用新的读取器重试。
+// 读取方法在取得引用之后才会调用回调，返回ErrReaderClosed时回调尚未被调用，重试不会重复回调
+func withReader[T any](n *Node, fn func(r *SSTReader) (T, error)) (T, error) {
+	for {
+		r := n.reader.Load()
+		result, err := fn(r)
+		if !errors.Is(err, myerror.ErrReaderClosed) || n.reader.Load() == r {
+			return result, err
+		}
+	}
+}
+
+// Reopen 重新打开文件并替换读取器，然后关闭原读取器。进行中的读取继续使用原读取器，
+// 原读取器关闭后开始的读取自动改用新的读取器，调用方看不到ErrReaderClosed。
+// 并发的Reopen只有一个生效，其余关闭各自打开的读取器后返回nil
+func (n *Node) Reopen() error {
+	old := n.reader.Load()
+	reader, err := old.reopen()
+	if err != nil {
+		return err
+	}
+	if !n.reader.CompareAndSwap(old, reader) {
+		return reader.Close()
+	}
+	return old.Close()
 }
 
+// Get 查找key，返回的value归调用方所有
 func (n *Node) Get(key []byte) ([]byte, error) {
-	// 查看bloomFilter中是否存在key
+	// 由读取器根据索引和布隆过滤器定位数据块
+	return withReader(n, func(r *SSTReader) ([]byte, error) { return r.Get(key) })
+}
 
-	// 查看kvlist中是否存在key
-	for _, kv := range n.kvList {
-		if bytes.Equal(kv.Key, key) {
-			return kv.Value, nil
-		}
+// GetWithOptions 按opts查找key，见SSTReader.GetWithOptions
+func (n *Node) GetWithOptions(key []byte, opts config.ReadOptions) ([]byte, error) {
+	return withReader(n, func(r *SSTReader) ([]byte, error) { return r.GetWithOptions(key, opts) })
+}
+
+// GetWithTrace 查找key，并将查找过程记录到trace中，trace为nil时不记录
+func (n *Node) GetWithTrace(key []byte, trace *ReadTrace) ([]byte, error) {
+	return withReader(n, func(r *SSTReader) ([]byte, error) { return r.GetWithTrace(key, trace) })
+}
+
+// GetEntry 查找key对应的条目，条目中包含写入时间
+func (n *Node) GetEntry(key []byte, trace *ReadTrace) (*KeyValue, error) {
+	return withReader(n, func(r *SSTReader) (*KeyValue, error) { return r.GetEntry(key, trace) })
+}
+
+// GetEntryWithOptions 同GetEntry，按opts决定是否填充缓存、校验条目以及是否返回共享的数据
+func (n *Node) GetEntryWithOptions(key []byte, trace *ReadTrace, opts config.ReadOptions) (*KeyValue, error) {
+	return withReader(n, func(r *SSTReader) (*KeyValue, error) { return r.GetEntryWithOptions(key, trace, opts) })
+}
+
+// Reader 返回节点当前的读取器
+func (n *Node) Reader() *SSTReader {
+	return n.reader.Load()
+}
+
+// SetSourceWals 设置文件的来源WAL，用于DeterministicOutput写出的不记录来源WAL的文件，需在节点发布前调用
+func (n *Node) SetSourceWals(walIds []uint32) {
+	n.sourceWals = walIds
+}
+
+// SourceWals 返回文件由哪些WAL的内存表刷盘生成，优先使用文件元数据中的记录，没有时使用SetSourceWals设置的值
+func (n *Node) SourceWals() []uint32 {
+	if walIds := n.Reader().SourceWals(); len(walIds) > 0 {
+		return walIds
 	}
-	return nil, myerror.ErrKeyNotFound
+	return n.sourceWals
+}
+
+// MultiGet 批量查找已排序的keys，返回的结果与keys一一对应
+func (n *Node) MultiGet(keys [][]byte) ([][]byte, []error) {
+	var errs []error
+	values, _ := withReader(n, func(r *SSTReader) ([][]byte, error) {
+		var values [][]byte
+		values, errs = r.MultiGet(keys)
+		// 读取器已关闭时所有key都返回同一个错误
+		if len(errs) > 0 {
+			return values, errs[0]
+		}
+		return values, nil
+	})
+	return values, errs
+}
+
+// PrefixScan 按key顺序遍历所有以prefix开头的键值对，fn返回false时停止遍历
+func (n *Node) PrefixScan(prefix []byte, fn func(key, value []byte) bool) error {
+	_, err := withReader(n, func(r *SSTReader) (struct{}, error) { return struct{}{}, r.PrefixScan(prefix, fn) })
+	return err
+}
+
+// ScanRange 按key顺序遍历rng范围内的键值对，fn返回false时停止遍历
+func (n *Node) ScanRange(rng keyutil.Range, fn func(key, value []byte) bool) error {
+	_, err := withReader(n, func(r *SSTReader) (struct{}, error) { return struct{}{}, r.ScanRange(rng, fn) })
+	return err
+}
+
+// ScanRangeEntries 按key顺序遍历rng范围内的完整条目，见SSTReader.ScanRangeEntries
+func (n *Node) ScanRangeEntries(rng keyutil.Range, fn func(entry kv.Entry) bool) error {
+	_, err := withReader(n, func(r *SSTReader) (struct{}, error) { return struct{}{}, r.ScanRangeEntries(rng, fn) })
+	return err
 }
 func (n *Node) GetFilename() string {
 	return n.filename
@@ -78,5 +180,39 @@ func (n *Node) GetMaxKey() []byte {
 	return n.maxKey
 }
 func (n *Node) GetIndex() []*Index {
-	return n.index
+	return n.Reader().Index()
+}
+
+// Acquire 增加读取器的引用，持有期间替换或删除节点不会关闭文件或解除映射，见SSTReader.Acquire。
+// 持有引用期间不能调用Reopen，否则Release释放的是新读取器的引用
+func (n *Node) Acquire() bool {
+	return n.Reader().Acquire()
+}
+
+// Release 释放Acquire增加的引用
+func (n *Node) Release() {
+	n.Reader().Release()
+}
+
+// RecordAccess 记录一次采样到的命中本文件的读取
+func (n *Node) RecordAccess() {
+	n.heat.Add(1)
+}
+
+// AddHeat 将heat累加到本文件的热度上，压缩输出继承输入文件的热度
+func (n *Node) AddHeat(heat uint64) {
+	n.heat.Add(heat)
+}
+
+// Heat 返回本文件采样到的读取次数
+func (n *Node) Heat() uint64 {
+	return n.heat.Load()
+}
+
+// EntryCount 返回文件中的条目数，见SSTReader.EntryCount
+func (n *Node) EntryCount() int64 {
+	return n.Reader().EntryCount()
+}
+func (n *Node) HasFilter() bool {
+	return n.Reader().HasFilter()
 }
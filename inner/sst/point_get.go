@@ -0,0 +1,85 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// GetFromFile 不构造SSTReader，直接从path处的SST文件中查找key，适用于只查询一次的工具。
+// 只读取footer、元数据、索引中覆盖key及之前的条目和对应的一个数据块，不解析其余索引、过滤器和数据块。
+// 返回值与SSTReader.Get一致，删除标记返回nil value
+func GetFromFile(conf *config.Config, path string, key []byte) ([]byte, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	stat, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < 12 { // 至少需要footer大小
+		return nil, formatError("file too small: %d bytes", stat.Size())
+	}
+
+	// 复用SSTReader解析footer和元数据，确定各区域位置和数据块编码版本
+	r := &SSTReader{conf: conf, fileSize: stat.Size(), fp: fp}
+	r.filePath.Store(&path)
+	r.refs.Store(1)
+	if err := r.loadFooter(); err != nil {
+		return nil, err
+	}
+	if err := r.loadMeta(); err != nil {
+		return nil, err
+	}
+
+	// 索引按key有序，逐条解码到第一个EndKey不小于key的条目为止。
+	// 过滤器与数据块按顺序存放，定位单个过滤器需要扫描过滤器区，其代价不低于直接读取数据块，因此不使用。
+	// 允许重复key的文件中同一个key可能跨越多个数据块，key等于数据块的EndKey时继续查看下一个数据块，返回最后一个版本
+	var found *KeyValue
+	indexReader := newRegionReader(fp, r.indexOffset, int64(r.indexLength))
+	var prevEnd int64
+	for i := 0; ; i++ {
+		idx, err := DecodeIndex(indexReader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkBlockBounds(i, idx, prevEnd); err != nil {
+			return nil, err
+		}
+		prevEnd = idx.Offset + idx.Length
+		if bytes.Compare(key, idx.EndKey) > 0 {
+			continue
+		}
+		if bytes.Compare(key, idx.StartKey) < 0 {
+			break
+		}
+		block := make([]byte, idx.Length)
+		if _, err := fp.ReadAt(block, r.dataOffset+idx.Offset); err != nil {
+			return nil, &SSTError{Path: path, Op: "read block", Offset: r.dataOffset + idx.Offset, Err: err}
+		}
+		kv, err := searchBlock(block, key, r.blockFormat)
+		if errors.Is(err, myerror.ErrKeyNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, locateEntryError(err, path, r.dataOffset+idx.Offset)
+		}
+		found = kv
+		if !bytes.Equal(key, idx.EndKey) {
+			break
+		}
+	}
+	if found == nil {
+		return nil, myerror.ErrKeyNotFound
+	}
+	return found.Value, nil
+}
@@ -0,0 +1,178 @@
+package sst
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// writePointGetSST 写入n个key为key-%08d的条目，i%10==9的条目为删除标记，返回文件路径
+func writePointGetSST(tb testing.TB, conf *config.Config, n int, valueSize int) string {
+	tb.Helper()
+	path := filepath.Join(conf.DataDir, fmt.Sprintf("point_get_%d_%d.sst", n, valueSize))
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	value := bytes.Repeat([]byte{'v'}, valueSize)
+	for i := 0; i < n; i++ {
+		var v []byte
+		if i%10 != 9 {
+			v = value
+		}
+		if err := writer.Add([]byte(fmt.Sprintf("key-%08d", i)), v); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+func TestGetFromFile(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	path := writePointGetSST(t, conf, 1000, 32)
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%08d", i))
+		want, err := reader.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := GetFromFile(conf, path, key)
+		if err != nil {
+			t.Fatalf("GetFromFile(%s): %v", key, err)
+		}
+		checkPresence(t, "GetFromFile", string(key), got, want)
+	}
+	// 第一个数据块之前、数据块之间和最后一个数据块之后的key
+	for _, key := range []string{"a", "key-00000000x", "key-00000500x", "z"} {
+		if _, err := GetFromFile(conf, path, []byte(key)); err != myerror.ErrKeyNotFound {
+			t.Fatalf("GetFromFile(%s) = %v, want ErrKeyNotFound", key, err)
+		}
+	}
+}
+
+func TestGetFromFileCorrupt(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	path := writePointGetSST(t, conf, 100, 32)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(conf.DataDir, "corrupt.sst")
+	for _, size := range []int{0, 11, len(data) / 2, len(data) - 1} {
+		if err := os.WriteFile(corrupt, data[:size], 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetFromFile(conf, corrupt, []byte("key-00000050")); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Fatalf("size %d: expected ErrInvalidSSTFormat, got %v", size, err)
+		}
+	}
+	if _, err := GetFromFile(conf, filepath.Join(conf.DataDir, "missing.sst"), []byte("k")); !os.IsNotExist(err) {
+		t.Fatalf("missing file: %v", err)
+	}
+}
+
+func BenchmarkPointGet(b *testing.B) {
+	conf := testConfig()
+	conf.DataDir = b.TempDir()
+	conf.IsDebug = false
+	const n = 100 * 1024 // 每条约1KB，文件共约100MB
+	path := writePointGetSST(b, conf, n, 1000)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%08d", (i*7919)%n)) }
+
+	b.Run("GetFromFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := GetFromFile(conf, path, key(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("SSTReaderWithBlockCache", func(b *testing.B) {
+		cacheConf := *conf
+		cacheConf.BlockCacheSize = 1 << 20 // 按需读取数据块，只解析索引和过滤器
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader, err := NewSSTReader(&cacheConf, path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := reader.Get(key(i)); err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	})
+	b.Run("SSTReader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader, err := NewSSTReader(conf, path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := reader.Get(key(i)); err != nil {
+				b.Fatal(err)
+			}
+			reader.Close()
+		}
+	})
+}
+
+func BenchmarkEntryChecksum(b *testing.B) {
+	const n = 10 * 1024
+	for _, checksum := range []bool{false, true} {
+		conf := testConfig()
+		conf.DataDir = b.TempDir()
+		conf.IsDebug = false
+		conf.PerEntryChecksum = checksum
+		path := writePointGetSST(b, conf, n, 100)
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer reader.Close()
+
+		b.Run(fmt.Sprintf("Get/checksum=%v", checksum), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				key := []byte(fmt.Sprintf("key-%08d", (i*7919)%n))
+				if _, err := reader.Get(key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Scan/checksum=%v", checksum), func(b *testing.B) {
+			b.SetBytes(reader.FileSize())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				it, err := reader.GetIterator()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for it.Next() {
+				}
+				if it.Error() != nil {
+					b.Fatal(it.Error())
+				}
+			}
+		})
+	}
+}
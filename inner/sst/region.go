@@ -0,0 +1,82 @@
+package sst
+
+import (
+	"bufio"
+	"io"
+)
+
+// maxReadChunk 读取文件区域时单次分配的缓冲区上限，区域按该大小分块流式读取，不按footer声明的长度整体分配
+const maxReadChunk = 4 << 20
+
+// 索引、过滤器和元数据区的大小上限，footer声明的长度超过时视为文件损坏，不尝试读取
+const (
+	// 每个索引项包含数据块的首尾key和34字节的定长字段，数据块中至少包含同样的key和5字节的删除标记头部，
+	// 只有一个1字节key的删除标记时索引项为数据块的6倍，索引区不超过数据区的8倍
+	indexRegionRatio = 8
+	// 过滤器区的上限，每个数据块的过滤器通常只有几百字节
+	maxFilterRegionBytes = 256 << 20
+	// 元数据区包含最小最大key和若干属性
+	maxMetaRegionBytes = 2*maxIndexKeyLength + 1<<20
+)
+
+// regionReader 以不超过maxReadChunk的缓冲流式读取文件中的一个区域，Len返回尚未读取的字节数，
+// 解码时据此在分配前校验长度
+type regionReader struct {
+	r         *bufio.Reader
+	remaining int64
+}
+
+// newRegionReader 返回读取fp中[offset, offset+length)的regionReader
+func newRegionReader(fp io.ReaderAt, offset, length int64) *regionReader {
+	size := maxReadChunk
+	if length < maxReadChunk {
+		size = int(length)
+	}
+	return &regionReader{
+		r:         bufio.NewReaderSize(io.NewSectionReader(fp, offset, length), size),
+		remaining: length,
+	}
+}
+
+func (rr *regionReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.remaining -= int64(n)
+	return n, err
+}
+
+// Len 返回区域中尚未读取的字节数
+func (rr *regionReader) Len() int {
+	return int(rr.remaining)
+}
+
+// Discard 跳过n个字节，不分配内存
+func (rr *regionReader) Discard(n int) (int, error) {
+	discarded, err := rr.r.Discard(n)
+	rr.remaining -= int64(discarded)
+	return discarded, err
+}
+
+// readBlocks 按索引顺序读取数据块并调用fn。文件中相邻的数据块合并为一次不超过maxReadChunk的读取，
+// 超过maxReadChunk的数据块单独读取，其长度已由数据区的上限约束
+func (r *SSTReader) readBlocks(index []*Index, fn func(i int, idx *Index, data []byte) error) error {
+	for i := 0; i < len(index); {
+		first := index[i]
+		end, j := first.Offset+first.Length, i+1
+		for j < len(index) && index[j].Offset == end && end+index[j].Length-first.Offset <= maxReadChunk {
+			end += index[j].Length
+			j++
+		}
+		chunk := make([]byte, end-first.Offset)
+		if _, err := r.file().ReadAt(chunk, r.dataOffset+first.Offset); err != nil {
+			return r.ioError("read blocks", r.dataOffset+first.Offset, err)
+		}
+		for k := i; k < j; k++ {
+			start := index[k].Offset - first.Offset
+			if err := fn(k, index[k], chunk[start:start+index[k].Length]); err != nil {
+				return err
+			}
+		}
+		i = j
+	}
+	return nil
+}
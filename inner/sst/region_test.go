@@ -0,0 +1,166 @@
+package sst
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// trackingFile 记录ReadAt使用的最大缓冲区，读取器按需为每次读取分配缓冲区
+type trackingFile struct {
+	sstFile
+	maxRead atomic.Int64
+}
+
+func (f *trackingFile) ReadAt(p []byte, off int64) (int, error) {
+	for {
+		cur := f.maxRead.Load()
+		if int64(len(p)) <= cur || f.maxRead.CompareAndSwap(cur, int64(len(p))) {
+			break
+		}
+	}
+	return f.sstFile.ReadAt(p, off)
+}
+
+// writeSparseSST 构造各区域长度分别为data、index、filter、meta的稀疏文件，regions按偏移量写入实际内容
+func writeSparseSST(t *testing.T, data, index, filter uint32, meta int64, regions map[int64][]byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sparse.sst")
+	fp, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	size := int64(data) + int64(index) + int64(filter) + meta + 12
+	if err := fp.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	for off, content := range regions {
+		if _, err := fp.WriteAt(content, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	footer := make([]byte, 12)
+	binary.BigEndian.PutUint32(footer[0:4], data)
+	binary.BigEndian.PutUint32(footer[4:8], index)
+	binary.BigEndian.PutUint32(footer[8:12], filter)
+	if _, err := fp.WriteAt(footer, size-12); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// openTracked 打开path并解析，返回解析结果、读取时使用的最大缓冲区以及解析期间分配的总字节数
+func openTracked(t *testing.T, conf *config.Config, path string) (*SSTReader, int64, uint64, error) {
+	t.Helper()
+	reader, err := openSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	tracked := &trackingFile{sstFile: reader.fp}
+	reader.fp = tracked
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	err = reader.load()
+	runtime.ReadMemStats(&after)
+	return reader, tracked.maxRead.Load(), after.TotalAlloc - before.TotalAlloc, err
+}
+
+func TestSSTReaderRegionLimits(t *testing.T) {
+	tests := []struct {
+		name                string
+		maxData             int64
+		data, index, filter uint32
+		meta                int64
+		want                string
+	}{
+		{"DefaultDataLimit", 0, 3 << 30, 0, 0, 0, "MaxSSTDataRegionBytes"},
+		{"ConfiguredDataLimit", 1 << 20, 2 << 20, 0, 0, 0, "MaxSSTDataRegionBytes 1048576"},
+		{"IndexRatio", 0, 1 << 20, 9 << 20, 0, 0, "index section"},
+		{"FilterLimit", 0, 1 << 20, 0, 300 << 20, 0, "filter section"},
+		{"MetaLimit", 0, 0, 0, 0, 30 << 20, "meta section"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := testConfig()
+			conf.IsDebug = false
+			conf.MaxSSTDataRegionBytes = tt.maxData
+			path := writeSparseSST(t, tt.data, tt.index, tt.filter, tt.meta, nil)
+			_, maxRead, allocated, err := openTracked(t, conf, path)
+			if !errors.Is(err, myerror.ErrInvalidSSTFormat) || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("load = %v, want ErrInvalidSSTFormat mentioning %q", err, tt.want)
+			}
+			// 只读取了footer
+			if maxRead > 12 || allocated > 1<<20 {
+				t.Fatalf("read up to %d bytes at once and allocated %d bytes before rejecting", maxRead, allocated)
+			}
+		})
+	}
+}
+
+func TestSSTReaderStreamsLargeRegions(t *testing.T) {
+	conf := testConfig()
+	conf.IsDebug = false
+	conf.Logger = nil
+
+	// 数据区和索引区都在上限之内但全为0：第一个索引项描述空数据块，解析在此停止，不读取整个索引区
+	path := writeSparseSST(t, 64<<20, 200<<20, 0, 0, nil)
+	_, maxRead, allocated, err := openTracked(t, conf, path)
+	if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("load = %v, want ErrInvalidSSTFormat", err)
+	}
+	if maxRead > maxReadChunk || allocated > 16<<20 {
+		t.Fatalf("zeroed index: read up to %d bytes at once, allocated %d bytes", maxRead, allocated)
+	}
+
+	// 一个有效的索引项和200MB全为0的过滤器区：过滤器区流式读取，无法使用的过滤器被跳过
+	idx := &Index{StartKey: []byte("a"), EndKey: []byte("z"), Offset: 0, Length: 1 << 20, EntryCount: 1}
+	encoded, err := idx.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = writeSparseSST(t, 1<<20, uint32(len(encoded)), 200<<20, 0, map[int64][]byte{1 << 20: encoded})
+	conf.BlockCacheSize = 1 << 20 // 数据块按需读取
+	reader, maxRead, allocated, err := openTracked(t, conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.DegradedFilters() != 1 || len(reader.Index()) != 1 {
+		t.Fatalf("degraded filters %d, index entries %d", reader.DegradedFilters(), len(reader.Index()))
+	}
+	if maxRead > maxReadChunk || allocated > 16<<20 {
+		t.Fatalf("zeroed filters: read up to %d bytes at once, allocated %d bytes", maxRead, allocated)
+	}
+}
+
+func TestSSTReaderBlockOrder(t *testing.T) {
+	conf := testConfig()
+	conf.IsDebug = false
+	var index []byte
+	for _, idx := range []*Index{
+		{StartKey: []byte("m"), EndKey: []byte("z"), Offset: 512, Length: 512},
+		{StartKey: []byte("a"), EndKey: []byte("l"), Offset: 0, Length: 512},
+	} {
+		encoded, err := idx.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		index = append(index, encoded...)
+	}
+	path := writeSparseSST(t, 1024, uint32(len(index)), 0, 0, map[int64][]byte{1024: index})
+	conf.BlockCacheSize = 1 << 20
+	if _, _, _, err := openTracked(t, conf, path); !errors.Is(err, myerror.ErrInvalidSSTFormat) || !strings.Contains(err.Error(), "index entry 1") {
+		t.Fatalf("load = %v, want overlapping blocks to be rejected", err)
+	}
+}
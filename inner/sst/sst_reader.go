@@ -3,37 +3,109 @@ package sst
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/aixiasang/lsm/inner/config"
 	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 )
 
+// sstFile 读取器使用的文件，测试中可以替换为统计读取次数的包装
+type sstFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
 // SSTReader 用于读取SST文件
 type SSTReader struct {
-	conf         *config.Config          // 配置
-	filePath     string                  // 文件路径
-	fileSize     int64                   // 文件大小
-	dataOffset   int64                   // 数据区域偏移量
-	dataLength   uint32                  // 数据区域长度
-	indexOffset  int64                   // 索引区域偏移量
-	indexLength  uint32                  // 索引区域长度
-	filterOffset int64                   // 过滤器区域偏移量
-	filterLength uint32                  // 过滤器区域长度
-	index        []*Index                // 索引
-	filterMap    map[int64]filter.Filter // 过滤器映射表 key=blockOffset
-	fp           *os.File                // 文件指针
-	mu           sync.RWMutex            // 互斥锁
-	kvList       []*KeyValue             // 数据块
-	kvLists      map[int64][]*KeyValue   // 数据块映射表 key=blockOffset
+	conf            *config.Config           // 配置
+	filePath        atomic.Pointer[string]   // 文件路径，文件被平移到其他层级后由Rename更新
+	fileSize        int64                    // 文件大小
+	fileInfo        os.FileInfo              // 打开时的文件信息，用于判断路径是否已指向另一个文件
+	dataOffset      int64                    // 数据区域偏移量
+	dataLength      uint32                   // 数据区域长度
+	indexOffset     int64                    // 索引区域偏移量
+	indexLength     uint32                   // 索引区域长度
+	filterOffset    int64                    // 过滤器区域偏移量
+	filterLength    uint32                   // 过滤器区域长度
+	metaLength      uint32                   // 元数据区域长度
+	meta            map[string]string        // 元数据
+	blockFormat     uint8                    // 数据块条目编码版本
+	filterFormat    uint8                    // 过滤器区编码版本
+	prefixFilter    bool                     // 过滤器中是否包含当前前缀提取器提取的前缀
+	blockReads      atomic.Uint64            // 查询时访问的数据块次数
+	blockBytes      atomic.Uint64            // 查询时访问的数据块字节数
+	dataBytes       atomic.Uint64            // 从文件数据区域读取的字节数，包括打开时加载、查询和遍历
+	bloomMisses     atomic.Uint64            // 布隆过滤器判定key不存在的次数
+	filterProbes    atomic.Uint64            // 点查时查询过滤器的次数
+	degradedFilters atomic.Int64             // 最近一次解析时跳过的无法使用的过滤器数
+	filterBytes     atomic.Int64             // 已加载的过滤器常驻内存的大小，未加载或已卸载时为0
+	filterReloads   atomic.Uint64            // 过滤器被过滤器内存预算卸载后重新加载的次数
+	entryCount      atomic.Int64             // 索引中各数据块条目数之和，解码索引区后记录，索引被淘汰后仍然保留
+	entryCounted    atomic.Bool              // entryCount是否已记录
+	index           []*Index                 // 索引，被内存预算淘汰后为nil
+	filterMap       map[int64]filter.Filter  // 过滤器映射表 key=blockOffset
+	filterCtor      filter.FilterConstructor // 按元数据中的过滤器名称选择的构造函数，为nil时不使用过滤器
+	indexBytes      int64                    // 索引和过滤器占用的内存估算
+	minKey          []byte                   // 最小键
+	maxKey          []byte                   // 最大键
+	empty           bool                     // 文件是否不包含任何条目，此时minKey和maxKey为nil
+	budget          *IndexBudget             // 索引内存预算
+	filterBudget    *FilterBudget            // 过滤器内存预算
+	cache           *BlockCache              // 数据块缓存，启用时数据块按需读取
+	fp              sstFile                  // 文件指针
+	mapped          *mmapFile                // SSTReadMmap时的文件映射，与fp相同，为nil时通过pread读取
+	mu              sync.RWMutex             // 互斥锁
+	kvLists         map[int64][]*KeyValue    // 数据块映射表 key=blockOffset
+	lazy            bool                     // 是否延迟到第一次访问时解析索引、过滤器和数据块
+	lazyOnce        sync.Once                // 保证延迟解析只执行一次，并发的第一次访问都等待同一次解析
+	lazyErr         error                    // 延迟解析的结果
+	indexErr        error                    // 索引被淘汰后重新解析失败的错误，之后的访问直接返回，由mu保护
+	refs            atomic.Int64             // 引用计数，打开时为1，读取期间各加1，最后一个引用释放时关闭文件
+	closed          atomic.Bool              // 是否已调用Close
 }
 
 // NewSSTReader 创建一个新的SST读取器
 func NewSSTReader(conf *config.Config, filePath string) (*SSTReader, error) {
+	reader, err := openSSTReader(conf, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if err := reader.load(); err != nil {
+		reader.fp.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// NewLazySSTReader 创建只解析footer、元数据和最小最大key的SST读取器，用于快速打开大量文件。
+// 索引、过滤器和数据块在第一次访问时解析，文件结构损坏的错误由第一次访问返回
+func NewLazySSTReader(conf *config.Config, filePath string) (*SSTReader, error) {
+	reader, err := openSSTReader(conf, filePath)
+	if err != nil {
+		return nil, err
+	}
+	reader.lazy = true
+	if err := reader.loadSummary(); err != nil {
+		reader.fp.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// openSSTReader 打开文件并检查文件大小
+func openSSTReader(conf *config.Config, filePath string) (*SSTReader, error) {
 	fp, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
@@ -48,143 +120,725 @@ func NewSSTReader(conf *config.Config, filePath string) (*SSTReader, error) {
 	fileSize := stat.Size()
 	if fileSize < 12 { // 至少需要footer大小
 		fp.Close()
-		fmt.Println("???")
-		return nil, myerror.ErrInvalidSSTFormat
+		conf.Debugf("sst file too small: %s, size=%d", filePath, fileSize)
+		return nil, formatError("file too small: %d bytes", fileSize)
 	}
 
 	reader := &SSTReader{
-		conf:      conf,
-		filePath:  filePath,
-		fileSize:  fileSize,
-		fp:        fp,
-		filterMap: make(map[int64]filter.Filter),
-		index:     make([]*Index, 0),
-		kvList:    make([]*KeyValue, 0),
+		conf:     conf,
+		fileSize: fileSize,
+		fileInfo: stat,
+		fp:       fp,
+	}
+	reader.filePath.Store(&filePath)
+	reader.refs.Store(1)
+	if conf.SSTReadMode == config.SSTReadMmap {
+		mapped, err := openMmapFile(fp, fileSize)
+		if err != nil {
+			// 映射失败时退回pread
+			conf.Debugf("mmap %s: %v, falling back to pread", filePath, err)
+		} else {
+			reader.fp, reader.mapped = mapped, mapped
+		}
+	}
+	return reader, nil
+}
+
+// load 依次解析footer、元数据、索引和过滤器，未启用数据块缓存时加载全部数据块。
+// 文件结构损坏时返回的错误均可通过errors.Is判断为ErrInvalidSSTFormat
+func (r *SSTReader) load() error {
+	if err := r.loadHead(); err != nil {
+		return err
+	}
+	if err := r.loadBody(); err != nil {
+		return err
+	}
+	r.empty = len(r.index) == 0
+	if !r.empty {
+		r.minKey = r.index[0].StartKey
+		r.maxKey = r.index[len(r.index)-1].EndKey
 	}
+	return nil
+}
 
+// loadHead 解析footer和元数据
+func (r *SSTReader) loadHead() error {
 	// 读取文件footer
-	if err := reader.loadFooter(); err != nil {
-		return nil, err
+	if err := r.loadFooter(); err != nil {
+		return err
 	}
+	// 加载元数据
+	if err := r.loadMeta(); err != nil {
+		return err
+	}
+	// 解析后的索引和过滤器大小与磁盘上的区域大小基本一致
+	r.indexBytes = int64(r.indexLength) + int64(r.filterLength)
+	return nil
+}
 
+// loadBody 解析索引和过滤器，未启用数据块缓存时加载全部数据块
+func (r *SSTReader) loadBody() error {
 	// 加载索引和过滤器
-	if err := reader.loadIndex(); err != nil {
-		return nil, err
+	if err := r.parseIndex(); err != nil {
+		return err
 	}
 
-	// 加载过滤器
-	if err := reader.loadFilter(); err != nil {
-		return nil, err
+	// 启用数据块缓存或使用映射时按需读取数据块，否则在打开时加载全部数据块
+	if r.conf.BlockCacheSize > 0 || r.mapped != nil {
+		return nil
 	}
-	// 加载数据块
-	if err := reader.loadDataBlock(); err != nil {
-		fmt.Println("loadDataBlock", err)
-		return nil, err
+	if err := r.loadDataBlock(); err != nil {
+		r.conf.Debugf("loadDataBlock %s: %v", r.Path(), err)
+		return err
 	}
-	return reader, nil
+	return nil
 }
+
+// loadSummary 解析footer、元数据以及最小最大key。新文件的最小最大key记录在元数据中，
+// 旧文件需要解码索引区，解码结果不保留
+func (r *SSTReader) loadSummary() error {
+	if err := r.loadHead(); err != nil {
+		return err
+	}
+	minKey, hasMin := r.meta[MetaMinKey]
+	maxKey, hasMax := r.meta[MetaMaxKey]
+	if hasMin && hasMax {
+		r.minKey, r.maxKey = []byte(minKey), []byte(maxKey)
+		return nil
+	}
+	index, err := r.decodeIndexRegion()
+	if err != nil {
+		return err
+	}
+	r.empty = len(index) == 0
+	if !r.empty {
+		r.minKey = index[0].StartKey
+		r.maxKey = index[len(index)-1].EndKey
+	}
+	return nil
+}
+
+// ensureLoaded 延迟打开的读取器在第一次访问时解析索引和过滤器，未启用数据块缓存时同时加载全部数据块，
+// parsed表示本次调用是否执行了解析
+func (r *SSTReader) ensureLoaded() (parsed bool, err error) {
+	if !r.lazy {
+		return false, nil
+	}
+	r.lazyOnce.Do(func() {
+		parsed = true
+		r.mu.Lock()
+		r.lazyErr = r.loadBody()
+		if r.lazyErr != nil {
+			r.index, r.filterMap = nil, nil
+		}
+		r.mu.Unlock()
+		if r.lazyErr == nil {
+			r.budget.add(r)
+			r.filterBudget.add(r)
+		}
+	})
+	return parsed, r.lazyErr
+}
+
+// formatError 返回包装了ErrInvalidSSTFormat的错误，附带具体的损坏信息
+func formatError(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", myerror.ErrInvalidSSTFormat, fmt.Sprintf(format, args...))
+}
+
+// SSTError 读取SST文件失败，记录文件路径、操作和偏移量，Unwrap返回底层错误
+type SSTError struct {
+	Path   string // SST文件路径
+	Op     string // 失败的操作，如"read block"
+	Offset int64  // 读取位置在文件中的偏移量
+	Err    error  // 底层错误
+}
+
+func (e *SSTError) Error() string {
+	return fmt.Sprintf("sst %s: %s at offset %d: %v", e.Path, e.Op, e.Offset, e.Err)
+}
+
+func (e *SSTError) Unwrap() error {
+	return e.Err
+}
+
+// ioError 将读取文件的错误包装为SSTError，err为nil时返回nil
+func (r *SSTReader) ioError(op string, offset int64, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SSTError{Path: r.Path(), Op: op, Offset: offset, Err: err}
+}
+
+// MinKey 返回文件中的最小key，空文件返回nil
 func (r *SSTReader) MinKey() []byte {
-	return r.index[0].StartKey
+	return r.minKey
 }
+
+// MaxKey 返回文件中的最大key，空文件返回nil
 func (r *SSTReader) MaxKey() []byte {
-	return r.index[len(r.index)-1].EndKey
+	return r.maxKey
 }
+
+// Empty 判断文件是否不包含任何条目
+func (r *SSTReader) Empty() bool {
+	return r.empty
+}
+
+// outOfRange 判断key是否在文件的最小最大key范围之外，空文件不包含任何key
+func (r *SSTReader) outOfRange(key []byte) bool {
+	return r.empty || bytes.Compare(key, r.minKey) < 0 || bytes.Compare(key, r.maxKey) > 0
+}
+
+// Index 返回已解析的索引，若索引已被内存预算淘汰则重新解析
 func (r *SSTReader) Index() []*Index {
-	return r.index
+	index, _, err := r.loadedIndex()
+	if err != nil {
+		r.conf.Errorf("reload index %s: %v", r.Path(), err)
+		return nil
+	}
+	return index
 }
+
+// EntryCount 返回文件中的条目数(包括删除标记)，即索引中各数据块条目数之和。第一次解码索引区后记录，
+// 之后为常数时间；延迟打开的读取器只流式解码索引区，不加载数据块。旧版本的索引没有记录条目数，
+// 其数据块计为0，索引无法解码时返回0
+func (r *SSTReader) EntryCount() int64 {
+	if !r.entryCounted.Load() {
+		if _, err := r.decodeIndexRegion(); err != nil {
+			r.conf.Errorf("reload index %s: %v", r.Path(), err)
+			return 0
+		}
+	}
+	return r.entryCount.Load()
+}
+
+// Filter 返回已解析的过滤器，若已被内存预算淘汰或卸载则重新解析
 func (r *SSTReader) Filter() map[int64]filter.Filter {
-	return r.filterMap
+	_, filters, err := r.loadedIndex()
+	if err != nil {
+		r.conf.Errorf("reload filter %s: %v", r.Path(), err)
+		return nil
+	}
+	return r.useFilters(filters)
 }
-func (r *SSTReader) KvList() []*KeyValue {
-	return r.kvList
+
+// HasFilter 判断文件是否包含可用的过滤器
+func (r *SSTReader) HasFilter() bool {
+	return r.filterLength > 0 && r.filterCtor != nil
 }
 
-// FileSize 获取文件大小
-func (r *SSTReader) FileSize() int64 {
-	return r.fileSize
+// BlockHandles 返回各数据块的位置和key范围，按偏移量递增。返回值是复制出的快照，可以与读取、
+// 索引淘汰并发调用，调用方修改返回的key不影响读取器；索引无法解析时返回nil
+func (r *SSTReader) BlockHandles() []BlockHandle {
+	index, filters, err := r.loadedIndex()
+	if err != nil {
+		r.conf.Errorf("reload index %s: %v", r.Path(), err)
+		return nil
+	}
+	filters = r.useFilters(filters)
+	handles := make([]BlockHandle, len(index))
+	for i, idx := range index {
+		_, hasFilter := filters[idx.Offset]
+		handles[i] = BlockHandle{
+			Offset:    idx.Offset,
+			Length:    idx.Length,
+			FirstKey:  bytes.Clone(idx.StartKey),
+			LastKey:   bytes.Clone(idx.EndKey),
+			HasFilter: hasFilter,
+		}
+	}
+	return handles
 }
 
-// loadDataBlock 加载数据区域
-func (r *SSTReader) loadDataBlock() error {
-	// 1. 先完全读取数据区域
-	dataBytes := make([]byte, r.dataLength)
-	if _, err := r.fp.ReadAt(dataBytes, r.dataOffset); err != nil {
-		return err
+// SourceWal 返回文件由哪个WAL的内存表刷盘生成，不是刷盘生成的文件、旧文件和合并多个WAL刷盘生成的文件返回false
+func (r *SSTReader) SourceWal() (uint32, bool) {
+	walIds := r.SourceWals()
+	if len(walIds) != 1 {
+		return 0, false
 	}
-	fmt.Println("index", r.index, len(r.index))
-	// 2. 初始化数据结构
-	r.kvList = make([]*KeyValue, 0)
-	kvLists := make(map[int64][]*KeyValue)
+	return walIds[0], true
+}
 
-	blockReader := bytes.NewReader(dataBytes)
-
-	// 创建当前块的KV列表
-	indexLength := len(r.index)
-	for i := 0; i < indexLength; i++ {
-		fmt.Println("index", r.index[i])
-	}
-	currIndex := 0
-	currOffset := int64(0)
-	currIndexOffset := r.index[currIndex].Offset
-	currIndexLength := r.index[currIndex].Length
-	fmt.Println("currIndexOffset", currIndexOffset, "currIndexLength", currIndexLength)
-	currKeyVals := make([]*KeyValue, 0)
-	// 解析KV对
-	for blockReader.Len() > 0 {
-		// 读取key长度
-		var keyLen uint32
-		if err := binary.Read(blockReader, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// SourceWals 返回文件由哪些WAL的内存表刷盘生成，从旧到新排列，不是刷盘生成的文件和旧文件返回nil
+func (r *SSTReader) SourceWals() []uint32 {
+	value := r.meta[MetaSourceWal]
+	if value == "" {
+		return nil
+	}
+	fields := strings.Split(value, ",")
+	walIds := make([]uint32, len(fields))
+	for i, field := range fields {
+		walId, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil
 		}
+		walIds[i] = uint32(walId)
+	}
+	return walIds
+}
 
-		// 读取value长度
-		var valueLen uint32
-		if err := binary.Read(blockReader, binary.BigEndian, &valueLen); err != nil {
-			return err
+// Path 返回读取器打开的文件路径
+func (r *SSTReader) Path() string {
+	return *r.filePath.Load()
+}
+
+// Rename 在文件被链接或重命名到path后更新记录的路径，之后重新打开和错误信息都使用path。
+// 读取器继续使用已打开的文件
+func (r *SSTReader) Rename(path string) {
+	r.filePath.Store(&path)
+}
+
+// SameFile 判断path当前是否仍指向读取器打开的文件，文件被删除或被重写后替换时返回false
+func (r *SSTReader) SameFile(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && os.SameFile(r.fileInfo, stat)
+}
+
+// FilterName 返回文件元数据中记录的过滤器名称，旧文件返回空字符串
+func (r *SSTReader) FilterName() string {
+	return r.meta[MetaFilterName]
+}
+
+// KvList 按索引顺序返回文件中的所有键值对
+func (r *SSTReader) KvList() []*KeyValue {
+	kvList := make([]*KeyValue, 0)
+	if err := r.pin(); err != nil {
+		r.conf.Warnf("load blocks %s: %v", r.Path(), err)
+		return kvList
+	}
+	defer r.Release()
+	for _, idx := range r.Index() {
+		kvs, err := r.loadBlock(idx)
+		if err != nil {
+			r.conf.Warnf("load block %s@%d: %v", r.Path(), idx.Offset, err)
+			continue
 		}
+		for _, kv := range kvs {
+			kvList = append(kvList, r.detachEntry(kv))
+		}
+	}
+	return kvList
+}
 
-		// 读取key
-		key := make([]byte, keyLen)
-		if n, err := blockReader.Read(key); err != nil || n != int(keyLen) {
-			return err
+// AttachBlockCache 设置数据块缓存，仅在启用BlockCacheSize时生效，使用映射时由页缓存代替，不设置
+func (r *SSTReader) AttachBlockCache(cache *BlockCache) {
+	if r.mapped != nil {
+		return
+	}
+	r.cache = cache
+}
+
+// Mapped 返回是否通过映射读取数据块，SSTReadMmap且映射成功时为true
+func (r *SSTReader) Mapped() bool {
+	return r.mapped != nil
+}
+
+// Acquire 增加读取器的引用，持有期间Close不会关闭文件或解除映射，读取器已关闭时返回false。
+// 读取方法内部已自行持有引用，只有在Close可能并发发生时继续使用读取器返回的映射数据才需要调用
+func (r *SSTReader) Acquire() bool {
+	for {
+		refs := r.refs.Load()
+		if refs <= 0 {
+			return false
+		}
+		if r.refs.CompareAndSwap(refs, refs+1) {
+			return true
 		}
+	}
+}
 
-		// 读取value
-		value := make([]byte, valueLen)
-		if n, err := blockReader.Read(value); err != nil || n != int(valueLen) {
-			return err
+// Release 释放Acquire增加的引用，Close之后的最后一个引用释放时关闭文件
+func (r *SSTReader) Release() {
+	if err := r.release(); err != nil {
+		r.conf.Warnf("close %s: %v", r.Path(), err)
+	}
+}
+
+// release 释放一个引用，最后一个引用释放时将读取器移出索引内存预算和数据块缓存并关闭文件。
+// 此时没有进行中的读取，之后的读取也无法再取得引用，不会重新计入预算或缓存
+func (r *SSTReader) release() error {
+	if r.refs.Add(-1) != 0 {
+		return nil
+	}
+	r.budget.Remove(r)
+	r.filterBudget.Remove(r)
+	r.cache.Remove(r)
+	return r.fp.Close()
+}
+
+// pin 在读取文件或从映射中解析数据块之前调用Acquire，读取器已关闭时返回ErrReaderClosed
+func (r *SSTReader) pin() error {
+	if !r.Acquire() {
+		return myerror.ErrReaderClosed
+	}
+	return nil
+}
+
+// pinnedFile 每次读取都持有读取器引用的文件，读取器关闭后返回ErrReaderClosed，不会读取已关闭的文件
+type pinnedFile struct {
+	r *SSTReader
+}
+
+func (f pinnedFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.r.pin(); err != nil {
+		return 0, err
+	}
+	defer f.r.Release()
+	n, err := f.r.fp.ReadAt(p, off)
+	f.r.countDataBytes(off, int64(n))
+	return n, err
+}
+
+// countDataBytes 累计[off, off+n)中落在数据区域内的字节数
+func (r *SSTReader) countDataBytes(off, n int64) {
+	start, end := off, off+n
+	if start < r.dataOffset {
+		start = r.dataOffset
+	}
+	if dataEnd := r.dataOffset + int64(r.dataLength); end > dataEnd {
+		end = dataEnd
+	}
+	if end > start {
+		r.dataBytes.Add(uint64(end - start))
+	}
+}
+
+// file 返回读取文件时使用的ReaderAt
+func (r *SSTReader) file() io.ReaderAt {
+	return pinnedFile{r: r}
+}
+
+// detachEntry 返回key和value都已复制的条目，调用方可以任意修改，不影响缓存中其他读取共享的数据块
+func (r *SSTReader) detachEntry(kv *KeyValue) *KeyValue {
+	detached := *kv
+	detached.Key, detached.Value = bytes.Clone(kv.Key), bytes.Clone(kv.Value)
+	return &detached
+}
+
+// shareEntry 不使用映射时直接返回数据块中共享的条目，使用映射时仍然复制，返回的数据在解除映射后仍然有效
+func (r *SSTReader) shareEntry(kv *KeyValue) *KeyValue {
+	if r.mapped == nil {
+		return kv
+	}
+	return r.detachEntry(kv)
+}
+
+// loadBlock 返回数据块中的键值对，按需读取的数据块优先从缓存中获取
+func (r *SSTReader) loadBlock(idx *Index) ([]*KeyValue, error) {
+	return r.loadBlockWith(idx, config.DefaultReadOptions())
+}
+
+// loadBlockWith 同loadBlock，opts.FillCache为false时从文件读取的数据块不放入缓存；
+// opts.VerifyChecksums为false时解析数据块不校验条目，未校验的数据块同样不放入缓存，
+// 之后使用缓存的读取方不会拿到未校验的条目
+func (r *SSTReader) loadBlockWith(idx *Index, opts config.ReadOptions) ([]*KeyValue, error) {
+	if r.kvLists != nil {
+		return r.kvLists[idx.Offset], nil
+	}
+	if kvs, ok := r.cache.get(r, idx.Offset); ok {
+		return kvs, nil
+	}
+	kvs, err := r.readBlockWith(idx, opts.VerifyChecksums)
+	if err != nil {
+		return nil, err
+	}
+	if opts.FillCache && opts.VerifyChecksums {
+		r.cache.add(r, idx.Offset, kvs, idx.Length)
+	}
+	return kvs, nil
+}
+
+// WarmIndex 确保索引和过滤器已解析，返回索引以及本次解析的字节数
+func (r *SSTReader) WarmIndex() ([]*Index, int64, error) {
+	index, _, reloaded, err := r.loadIndexSnapshot()
+	if err != nil || !reloaded {
+		return index, 0, err
+	}
+	return index, r.IndexMemory(), nil
+}
+
+// WarmBlock 将数据块读入缓存，返回读取的字节数，缓存已满时返回ErrBlockCacheFull
+func (r *SSTReader) WarmBlock(idx *Index) (int64, error) {
+	if r.kvLists != nil || r.cache == nil || r.cache.contains(r, idx.Offset) {
+		return 0, nil
+	}
+	if err := r.pin(); err != nil {
+		return 0, err
+	}
+	defer r.Release()
+	if !r.cache.fits(idx.Length) {
+		return 0, myerror.ErrBlockCacheFull
+	}
+	kvs, err := r.readBlock(idx)
+	if err != nil {
+		return 0, err
+	}
+	r.cache.add(r, idx.Offset, kvs, idx.Length)
+	return idx.Length, nil
+}
+
+// readBlock 从文件中读取并解析单个数据块，使用映射时直接解析映射中的数据
+func (r *SSTReader) readBlock(idx *Index) ([]*KeyValue, error) {
+	return r.readBlockWith(idx, true)
+}
+
+// readBlockWith 同readBlock，verify为false时不校验条目的校验和
+func (r *SSTReader) readBlockWith(idx *Index, verify bool) ([]*KeyValue, error) {
+	var data []byte
+	if r.mapped != nil {
+		// 解析出的key和value引用映射，调用方持有引用期间有效
+		block, err := r.mapped.slice(r.dataOffset+idx.Offset, idx.Length)
+		if err != nil {
+			return nil, r.ioError("read block", r.dataOffset+idx.Offset, err)
+		}
+		data = block
+		r.countDataBytes(r.dataOffset+idx.Offset, int64(idx.Length))
+	} else {
+		data = make([]byte, idx.Length)
+		if _, err := r.file().ReadAt(data, r.dataOffset+idx.Offset); err != nil {
+			return nil, r.ioError("read block", r.dataOffset+idx.Offset, err)
 		}
+	}
+	kvs, err := decodeBlockWith(data, r.blockFormat, verify, idx.EntryCount)
+	return kvs, locateEntryError(err, r.Path(), r.dataOffset+idx.Offset)
+}
 
-		// 创建KV对
-		kv := &KeyValue{
-			Key:   key,
-			Value: value,
+// decodeBlock 按format解析数据块中的键值对，条目校验错误的偏移量为相对数据块起始位置的偏移量
+func decodeBlock(data []byte, format uint8) ([]*KeyValue, error) {
+	return decodeBlockWith(data, format, true, 0)
+}
+
+// decodeBlockWith 同decodeBlock，verify为false时不校验条目的校验和。entryCount为索引中记录的条目数，
+// 用于预先分配结果的容量，旧版本文件为0；损坏的条目数不会导致超出数据块大小的分配
+func decodeBlockWith(data []byte, format uint8, verify bool, entryCount uint32) ([]*KeyValue, error) {
+	capacity := int64(len(data)) / entryHeaderSize(format, 0)
+	if int64(entryCount) < capacity {
+		capacity = int64(entryCount)
+	}
+	kvs := make([]*KeyValue, 0, capacity)
+	for pos := int64(0); len(data) > 0; {
+		kv, n, err := decodeEntryWith(data, format, verify)
+		if err != nil {
+			return nil, locateEntryError(err, "", pos)
 		}
-		currOffset += int64(keyLen) + int64(valueLen) + 4 + 4
-		currKeyVals = append(currKeyVals, kv)
-		if currOffset >= currIndexOffset+currIndexLength {
-			kvLists[currIndexOffset] = currKeyVals
-			fmt.Println("currIndexOffset", currIndexOffset, "currIndexLength", currIndexLength, "currOffset", currOffset)
-			currIndex++
-			if currIndex >= indexLength {
-				break
-			}
-			fmt.Println("currIndex", currIndex, r.index[currIndex])
-			currIndexOffset = r.index[currIndex].Offset
-			currIndexLength = r.index[currIndex].Length
-			fmt.Println(">?", "currIndexOffset", currIndexOffset, "currIndexLength", currIndexLength)
-			currKeyVals = make([]*KeyValue, 0)
+		kvs = append(kvs, kv)
+		data = data[n:]
+		pos += n
+	}
+	return kvs, nil
+}
+
+// locateEntryError 为条目校验错误补全位置：offset加到条目的偏移量上，file不为空时设置文件路径。
+// 其他错误原样返回
+func locateEntryError(err error, file string, offset int64) error {
+	var ce *EntryChecksumError
+	if errors.As(err, &ce) {
+		ce.Offset += offset
+		if file != "" {
+			ce.File = file
 		}
+	}
+	return err
+}
+
+// checkEntry 校验已解析的数据块中第i个条目，用于发现缓存中被改写的条目
+func (r *SSTReader) checkEntry(kvs []*KeyValue, i int, idx *Index) error {
+	if kvs[i].verify() {
+		return nil
+	}
+	offset := r.dataOffset + idx.Offset
+	for _, kv := range kvs[:i] {
+		offset += encodedSize(kv, r.blockFormat)
+	}
+	return &EntryChecksumError{Key: append([]byte(nil), kvs[i].Key...), File: r.Path(), Offset: offset}
+}
+
+// IndexMemory 返回索引和过滤器解析后占用的内存估算
+func (r *SSTReader) IndexMemory() int64 {
+	return r.indexBytes
+}
+
+// AttachBudget 将读取器纳入索引内存预算管理，延迟打开的读取器在解析索引后才计入预算
+func (r *SSTReader) AttachBudget(budget *IndexBudget) {
+	r.budget = budget
+	r.mu.RLock()
+	loaded := r.index != nil
+	r.mu.RUnlock()
+	if loaded {
+		budget.add(r)
+	}
+}
+
+// FilterMemory 返回已加载的过滤器常驻内存的大小，按各过滤器的SizeBytes累加，未加载或已卸载时为0
+func (r *SSTReader) FilterMemory() int64 {
+	return r.filterBytes.Load()
+}
+
+// FilterReloads 返回过滤器被过滤器内存预算卸载后重新加载的次数
+func (r *SSTReader) FilterReloads() uint64 {
+	return r.filterReloads.Load()
+}
+
+// AttachFilterBudget 将读取器纳入过滤器内存预算管理，延迟打开的读取器在解析过滤器后才计入预算
+func (r *SSTReader) AttachFilterBudget(budget *FilterBudget) {
+	r.filterBudget = budget
+	r.mu.RLock()
+	loaded := r.filterMap != nil
+	r.mu.RUnlock()
+	if loaded {
+		budget.add(r)
+	}
+}
+
+// loadedIndex 返回当前的索引和过滤器快照，若已被淘汰则重新从文件中解析
+// 返回的切片和映射在解析后不再修改，调用方无需持有锁即可使用
+func (r *SSTReader) loadedIndex() ([]*Index, map[int64]filter.Filter, error) {
+	index, filters, _, err := r.loadIndexSnapshot()
+	return index, filters, err
+}
+
+// loadIndexSnapshot 同loadedIndex，reloaded表示索引是否因延迟打开或被淘汰而从文件中解析
+func (r *SSTReader) loadIndexSnapshot() ([]*Index, map[int64]filter.Filter, bool, error) {
+	// 持有引用期间解析，关闭后不会再解析或重新计入预算
+	if err := r.pin(); err != nil {
+		return nil, nil, false, err
+	}
+	defer r.Release()
+	parsed, err := r.ensureLoaded()
+	if err != nil {
+		return nil, nil, parsed, err
+	}
+	r.mu.RLock()
+	index, filters := r.index, r.filterMap
+	r.mu.RUnlock()
+	if index != nil {
+		r.budget.touch(r)
+		return index, filters, parsed, nil
+	}
+
+	r.mu.Lock()
+	if r.indexErr != nil {
+		err := r.indexErr
+		r.mu.Unlock()
+		return nil, nil, false, err
+	}
+	if r.index == nil {
+		if err := r.parseIndex(); err != nil {
+			// 等待同一次解析的其他读取返回相同的错误，不再重复解析损坏的文件
+			r.index, r.filterMap, r.indexErr = nil, nil, err
+			r.mu.Unlock()
+			return nil, nil, true, err
+		}
+		r.conf.Debugf("reloaded index %s", r.Path())
+	}
+	index, filters = r.index, r.filterMap
+	r.mu.Unlock()
+
+	// 重新计入预算，必须在释放读取器锁之后进行，避免与淘汰逻辑互相等待
+	r.budget.add(r)
+	r.filterBudget.add(r)
+	return index, filters, true, nil
+}
+
+// evictIndex 释放已解析的索引和过滤器，下次访问时重新解析
+func (r *SSTReader) evictIndex() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.index = nil
+	r.filterMap = nil
+	r.filterBytes.Store(0)
+	// 过滤器预算持有自己的锁时不会等待读取器的锁，这里可以在持有读取器锁时移出
+	r.filterBudget.Remove(r)
+}
+
+// useFilters 返回点查使用的过滤器：filters已加载时标记最近使用，已被过滤器内存预算卸载(索引仍在)时重新加载
+func (r *SSTReader) useFilters(filters map[int64]filter.Filter) map[int64]filter.Filter {
+	if filters != nil {
+		r.filterBudget.touch(r)
+		return filters
+	}
+	return r.reloadFilters()
+}
+
+// reloadFilters 重新加载被卸载的过滤器，并发的点查等待同一次加载。加载失败时输出警告并使用空的过滤器映射，
+// 之后的查找不经过滤器直接读取数据块；索引同时被淘汰时返回nil，同样视为没有过滤器
+func (r *SSTReader) reloadFilters() map[int64]filter.Filter {
+	// 持有引用期间加载，关闭后不会再计入预算
+	if err := r.pin(); err != nil {
+		return nil
+	}
+	defer r.Release()
+	r.mu.Lock()
+	if r.index == nil || r.filterMap != nil {
+		filters := r.filterMap
+		r.mu.Unlock()
+		return filters
+	}
+	r.filterMap = make(map[int64]filter.Filter)
+	if err := r.loadFilter(); err != nil {
+		r.conf.Warnf("reload filter %s: %v, reading without filters", r.Path(), err)
+		r.filterMap = make(map[int64]filter.Filter)
+		r.filterBytes.Store(0)
+	}
+	r.filterReloads.Add(1)
+	filters := r.filterMap
+	r.mu.Unlock()
+
+	// 与索引预算相同，在释放读取器锁之后计入预算
+	r.filterBudget.add(r)
+	r.conf.Debugf("reloaded filters %s", r.Path())
+	return filters
+}
+
+// evictFilters 卸载过滤器并保留索引，过滤器已随索引被释放时不做任何事
+func (r *SSTReader) evictFilters() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.index == nil || r.filterMap == nil {
+		return
+	}
+	r.filterMap = nil
+	r.filterBytes.Store(0)
+	// 卸载前过滤器可能已重新计入预算，一并移出
+	r.filterBudget.Remove(r)
+}
+
+// parseIndex 从文件中解析索引和过滤器区域
+func (r *SSTReader) parseIndex() error {
+	r.index = make([]*Index, 0)
+	r.filterMap = make(map[int64]filter.Filter)
+	if err := r.loadIndex(); err != nil {
+		return err
+	}
+	return r.loadFilter()
+}
+
+// FileSize 获取文件大小
+func (r *SSTReader) FileSize() int64 {
+	return r.fileSize
+}
 
+// loadDataBlock 按索引分块读取并解析全部数据块，不一次性读取整个数据区
+func (r *SSTReader) loadDataBlock() error {
+	kvLists := make(map[int64][]*KeyValue)
+	err := r.readBlocks(r.index, func(i int, idx *Index, data []byte) error {
+		r.conf.Debugf("index %d: %s", i, idx)
+		// 索引已在loadIndex中校验过范围
+		kvs, err := decodeBlockWith(data, r.blockFormat, true, idx.EntryCount)
+		if err != nil {
+			err = locateEntryError(err, r.Path(), r.dataOffset+idx.Offset)
+			return fmt.Errorf("data block %d at offset %d: %w", i, idx.Offset, err)
+		}
+		kvLists[idx.Offset] = kvs
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	// 所有检查通过，设置最终的KV列表映射
 	r.kvLists = kvLists
-	fmt.Println("kvLists", len(r.kvLists), kvLists)
-	fmt.Printf("成功加载了%d个数据块，共有%d个KV对\n", len(r.kvLists), len(r.kvList))
+	r.conf.Debugf("成功加载了%d个数据块", len(r.kvLists))
 	return nil
 }
 
@@ -192,17 +846,23 @@ func (r *SSTReader) loadDataBlock() error {
 func (r *SSTReader) loadFooter() error {
 	// 读取文件末尾的12字节footer
 	footer := make([]byte, 12)
-	if _, err := r.fp.ReadAt(footer, r.fileSize-12); err != nil {
-		return err
+	if _, err := r.file().ReadAt(footer, r.fileSize-12); err != nil {
+		return r.ioError("read footer", r.fileSize-12, err)
 	}
 
 	r.dataLength = binary.BigEndian.Uint32(footer[0:4])
 	r.indexLength = binary.BigEndian.Uint32(footer[4:8])
 	r.filterLength = binary.BigEndian.Uint32(footer[8:12])
 
-	// 验证长度值的有效性
-	if int64(r.dataLength+r.indexLength+r.filterLength+12) != r.fileSize {
-		return myerror.ErrInvalidSSTFormat
+	// 验证长度值的有效性，剩余部分为元数据区
+	metaLength := r.fileSize - 12 - int64(r.dataLength) - int64(r.indexLength) - int64(r.filterLength)
+	if metaLength < 0 {
+		return formatError("footer sections (data=%d, index=%d, filter=%d) exceed file size %d",
+			r.dataLength, r.indexLength, r.filterLength, r.fileSize)
+	}
+	r.metaLength = uint32(metaLength)
+	if err := r.checkRegionLimits(); err != nil {
+		return err
 	}
 
 	// 计算各区域偏移量
@@ -213,315 +873,680 @@ func (r *SSTReader) loadFooter() error {
 	return nil
 }
 
-// loadIndex 加载索引数据
-func (r *SSTReader) loadIndex() error {
-	// 读取索引区域数据
-	indexData := make([]byte, r.indexLength)
-	if _, err := r.fp.ReadAt(indexData, r.indexOffset); err != nil {
-		return err
+// checkRegionLimits 在读取之前检查footer声明的各区域大小，超过上限的文件视为损坏
+func (r *SSTReader) checkRegionLimits() error {
+	maxData := r.conf.MaxSSTDataRegionBytes
+	if maxData <= 0 {
+		maxData = config.DefaultMaxSSTDataRegion
+	}
+	switch {
+	case int64(r.dataLength) > maxData:
+		return formatError("data section of %d bytes exceeds MaxSSTDataRegionBytes %d", r.dataLength, maxData)
+	case int64(r.indexLength) > indexRegionRatio*int64(r.dataLength):
+		return formatError("index section of %d bytes exceeds %d times the data section of %d bytes", r.indexLength, indexRegionRatio, r.dataLength)
+	case int64(r.filterLength) > maxFilterRegionBytes:
+		return formatError("filter section of %d bytes exceeds %d bytes", r.filterLength, maxFilterRegionBytes)
+	case int64(r.metaLength) > maxMetaRegionBytes:
+		return formatError("meta section of %d bytes exceeds %d bytes", r.metaLength, maxMetaRegionBytes)
 	}
+	return nil
+}
 
-	// 解析索引数据
-	buf := bytes.NewReader(indexData)
-	for buf.Len() > 0 {
-		// 读取startKey长度
-		var startKeyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &startKeyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return err
+// loadMeta 加载元数据，并判断能否使用过滤器中的前缀
+func (r *SSTReader) loadMeta() error {
+	r.meta = make(map[string]string)
+	if r.metaLength > 0 {
+		meta, err := decodeMetaFrom(newRegionReader(r.file(), r.filterOffset+int64(r.filterLength), int64(r.metaLength)))
+		if err != nil {
+			return fmt.Errorf("meta section: %w", err)
 		}
+		r.meta = meta
+	}
+	var err error
+	if r.blockFormat, err = r.metaVersion(MetaBlockFormat, BlockFormat); err != nil {
+		return err
+	}
+	if r.filterFormat, err = r.metaVersion(MetaFilterFormat, FilterFormat); err != nil {
+		return err
+	}
+	r.filterCtor = r.filterConstructor()
+	// 前缀提取器不一致时，过滤器中的前缀不可用，扫描时退化为不使用过滤器
+	extractor := r.conf.PrefixExtractor
+	r.prefixFilter = extractor != nil && r.meta[MetaPrefixExtractor] == extractor.Name()
+	return nil
+}
 
-		// 读取endKey长度
-		var endKeyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &endKeyLen); err != nil {
-			return err
+// filterConstructor 按元数据中记录的过滤器名称选择构造函数，没有记录名称的旧文件使用FilterConstructor，
+// 名称未注册或FilterConstructor为nil时输出警告并按不使用过滤器处理
+func (r *SSTReader) filterConstructor() filter.FilterConstructor {
+	name, ok := r.meta[MetaFilterName]
+	if !ok {
+		if r.conf.FilterConstructor == nil {
+			r.conf.Warnf("sst %s: FilterConstructor is nil, reading without filter", r.Path())
 		}
+		return r.conf.FilterConstructor
+	}
+	if name == filter.NameNone {
+		return nil
+	}
+	ctor, ok := filter.Lookup(name)
+	if !ok {
+		r.conf.Warnf("sst %s: unknown filter %q, reading without filter", r.Path(), name)
+		return nil
+	}
+	return ctor
+}
 
-		// 读取startKey
-		startKey := make([]byte, startKeyLen)
-		if _, err := buf.Read(startKey); err != nil {
-			return err
-		}
+// metaVersion 解析元数据中的编码版本，缺失时为旧版本，高于当前支持的版本时视为无效文件
+func (r *SSTReader) metaVersion(key string, latest uint8) (uint8, error) {
+	value, ok := r.meta[key]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || uint8(n) > latest {
+		return 0, formatError("unsupported %s %q", key, value)
+	}
+	return uint8(n), nil
+}
 
-		// 读取endKey
-		endKey := make([]byte, endKeyLen)
-		if _, err := buf.Read(endKey); err != nil {
-			return err
-		}
+// Meta 返回文件的元数据
+func (r *SSTReader) Meta() map[string]string {
+	return r.meta
+}
 
-		// 读取偏移量和长度
-		var offset, length int64
-		if err := binary.Read(buf, binary.BigEndian, &offset); err != nil {
-			return err
+// Properties 返回写入时统计的文件属性
+func (r *SSTReader) Properties() Properties {
+	return decodeProperties(r.meta)
+}
+
+// PrefixStats 返回写入时按KeySchema统计的前缀的不同取值数，写入时没有设置KeySchema的文件返回false
+func (r *SSTReader) PrefixStats() (PrefixStats, bool) {
+	return decodePrefixStats(r.meta)
+}
+
+// BlockSizeHistogram 返回写入时记录的数据块大小分布，按区间上限从小到大排列，旧文件返回nil
+func (r *SSTReader) BlockSizeHistogram() []BlockSizeBucket {
+	return decodeBlockSizes(r.meta[MetaBlockSizes])
+}
+
+// BlockReads 返回查询时访问数据块的次数
+func (r *SSTReader) BlockReads() uint64 {
+	return r.blockReads.Load()
+}
+
+// BlockBytesRead 返回查询时访问的数据块字节数
+func (r *SSTReader) BlockBytesRead() uint64 {
+	return r.blockBytes.Load()
+}
+
+// DataBytesRead 返回从文件数据区域读取的字节数，包括打开时加载数据块以及查询、遍历和压缩的读取。
+// 使用映射时只统计解析的数据块，不统计操作系统的预读
+func (r *SSTReader) DataBytesRead() uint64 {
+	return r.dataBytes.Load()
+}
+
+// DegradedFilters 返回最近一次解析过滤器区时因损坏而跳过的过滤器数，尚未解析时为0
+func (r *SSTReader) DegradedFilters() int64 {
+	return r.degradedFilters.Load()
+}
+
+// BloomNegatives 返回Get和MultiGet时布隆过滤器判定key不存在的次数
+func (r *SSTReader) BloomNegatives() uint64 {
+	return r.bloomMisses.Load()
+}
+
+// FilterProbes 返回Get和MultiGet时查询过滤器的次数，与BloomNegatives之比反映过滤器省去数据块读取的比例
+func (r *SSTReader) FilterProbes() uint64 {
+	return r.filterProbes.Load()
+}
+
+// loadIndex 加载索引数据
+func (r *SSTReader) loadIndex() error {
+	index, err := r.decodeIndexRegion()
+	if err != nil {
+		return err
+	}
+	r.index = index
+	return nil
+}
+
+// decodeIndexRegion 流式解码索引区，每解码一个索引项即校验其数据块范围，损坏的索引区在第一个错误的索引项处停止
+func (r *SSTReader) decodeIndexRegion() ([]*Index, error) {
+	index := make([]*Index, 0)
+	buf := newRegionReader(r.file(), r.indexOffset, int64(r.indexLength))
+	for i := 0; buf.Len() > 0; i++ {
+		idx, err := DecodeIndex(buf)
+		if err != nil {
+			return nil, indexFormatError(err)
 		}
-		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
-			return err
+		var prevEnd int64
+		if i > 0 {
+			prevEnd = index[i-1].Offset + index[i-1].Length
 		}
-
-		// 创建索引对象
-		index := &Index{
-			StartKey: startKey,
-			EndKey:   endKey,
-			Offset:   offset,
-			Length:   length,
+		if err := r.checkBlockBounds(i, idx, prevEnd); err != nil {
+			return nil, err
 		}
-
-		r.index = append(r.index, index)
+		index = append(index, idx)
 	}
+	var count int64
+	for _, idx := range index {
+		count += int64(idx.EntryCount)
+	}
+	r.entryCount.Store(count)
+	r.entryCounted.Store(true)
+	return index, nil
+}
 
+// checkBlockBounds 数据块必须非空、位于数据区内且在上一个数据块(结束于prevEnd)之后，
+// 读取数据块时按索引中的长度分配内存
+func (r *SSTReader) checkBlockBounds(i int, idx *Index, prevEnd int64) error {
+	if idx.Offset < prevEnd || idx.Length <= 0 || idx.Offset > int64(r.dataLength) || idx.Length > int64(r.dataLength)-idx.Offset {
+		return formatError("index entry %d: block [%d, +%d) outside data section of %d bytes or before offset %d",
+			i, idx.Offset, idx.Length, r.dataLength, prevEnd)
+	}
 	return nil
 }
 
-// loadFilter 加载过滤器数据
+// loadFilter 加载过滤器数据，不使用过滤器时跳过过滤器区。过滤器只用于加速查找，单个过滤器无法解析
+// 或过滤器区末尾有无法解析的数据时跳过并输出警告，对应数据块视为可能包含；开启StrictFilters时返回错误
 func (r *SSTReader) loadFilter() error {
-	// 读取过滤器区域数据
-	filterData := make([]byte, r.filterLength)
-	if _, err := r.fp.ReadAt(filterData, r.filterOffset); err != nil {
-		return err
+	if r.filterCtor == nil {
+		r.degradedFilters.Store(0)
+		r.filterBytes.Store(0)
+		return nil
 	}
-
-	// 解析过滤器数据
-	buf := bytes.NewReader(filterData)
-	for buf.Len() > 0 {
-		// 读取blockLength
-		var blockLength int64
-		if err := binary.Read(buf, binary.BigEndian, &blockLength); err != nil {
-			if err == io.EOF {
-				break
-			}
+	degraded, size := int64(0), int64(0)
+	degrade := func(err error) error {
+		if r.conf.StrictFilters {
 			return err
 		}
+		degraded++
+		r.conf.Warnf("sst %s: skip unusable filter: %v", r.Path(), err)
+		return nil
+	}
 
-		// 读取过滤器数据长度
+	// 旧版本的过滤器按数据块顺序写入，第i个过滤器对应第i个索引，头部为数据块长度；
+	// 新版本的头部为数据块偏移量，没有过滤器的数据块不写入
+	offsets := make(map[int64]bool, len(r.index))
+	for _, idx := range r.index {
+		offsets[idx.Offset] = true
+	}
+	// 流式读取过滤器区，只为单个过滤器分配内存
+	buf := newRegionReader(r.file(), r.filterOffset, int64(r.filterLength))
+	for i := 0; buf.Len() > 0; i++ {
+		// 读取blockLength或blockOffset以及过滤器数据长度，头部不完整或长度不合理时无法继续解析之后的数据
+		var blockKey int64
 		var filterLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &filterLen); err != nil {
-			if err == io.EOF {
-				break
+		if binary.Read(buf, binary.BigEndian, &blockKey) != nil || binary.Read(buf, binary.BigEndian, &filterLen) != nil {
+			if err := degrade(filterError("truncated header of filter %d", i)); err != nil {
+				return err
 			}
-			return err
+			break
 		}
-
-		// 检查数据长度是否合理
-		if filterLen == 0 || filterLen > uint32(buf.Len()) {
-			return myerror.ErrSSTReaderFilter
+		if filterLen == 0 || int64(filterLen) > int64(buf.Len()) {
+			if err := degrade(filterError("filter %d length %d with %d bytes remaining", i, filterLen, buf.Len())); err != nil {
+				return err
+			}
+			break
+		}
+		if filterLen > maxReadChunk {
+			if err := degrade(filterError("filter %d length %d exceeds %d bytes", i, filterLen, maxReadChunk)); err != nil {
+				return err
+			}
+			if _, err := buf.Discard(int(filterLen)); err != nil {
+				return filterError("truncated filter %d", i)
+			}
+			continue
 		}
 
 		// 读取过滤器数据
 		filterBytes := make([]byte, filterLen)
-		if _, err := buf.Read(filterBytes); err != nil {
-			return err
+		if _, err := io.ReadFull(buf, filterBytes); err != nil {
+			return filterError("truncated filter %d", i)
 		}
 
-		// 创建并加载过滤器
-		bloomFilter := r.conf.FilterConstructor(1024, 3)
-		if err := bloomFilter.Load(filterBytes); err != nil {
-			return err
+		// 确定过滤器对应的数据块
+		var blockOffset int64
+		if r.filterFormat == FilterFormatLegacy {
+			if i >= len(r.index) || r.index[i].Length != blockKey {
+				if err := degrade(filterError("filter %d does not match block length %d", i, blockKey)); err != nil {
+					return err
+				}
+				continue
+			}
+			blockOffset = r.index[i].Offset
+		} else {
+			if !offsets[blockKey] {
+				if err := degrade(filterError("filter %d refers to unknown block offset %d", i, blockKey)); err != nil {
+					return err
+				}
+				continue
+			}
+			blockOffset = blockKey
 		}
 
-		// 存储过滤器 - 使用blockLength作为映射键
-		r.filterMap[blockLength] = bloomFilter
-	}
+		// 创建并加载过滤器，大小参数以数据中记录的为准
+		blockFilter := r.filterCtor(1024, 3)
+		if blockFilter == nil {
+			return fmt.Errorf("sst %s: %w: filter constructor returned nil", r.Path(), myerror.ErrInvalidConfig)
+		}
+		if err := blockFilter.Load(filterBytes); err != nil {
+			if err := degrade(fmt.Errorf("%w: filter %d: %w", myerror.ErrInvalidSSTFormat, i, err)); err != nil {
+				return err
+			}
+			continue
+		}
 
+		// 存储过滤器 - 使用数据块偏移量作为映射键，没有过滤器的数据块不在映射中
+		r.filterMap[blockOffset] = blockFilter
+		size += int64(blockFilter.SizeBytes())
+	}
+	r.degradedFilters.Store(degraded)
+	r.filterBytes.Store(size)
 	return nil
 }
 
-// 快速查找
+// filterError 返回同时包装ErrInvalidSSTFormat和ErrSSTReaderFilter的过滤器区错误
+func filterError(format string, args ...any) error {
+	return fmt.Errorf("%w: %w: %s", myerror.ErrInvalidSSTFormat, myerror.ErrSSTReaderFilter, fmt.Sprintf(format, args...))
+}
+
+// Get 点查key，返回文件中该key的最后一个版本的value，删除标记返回nil value，不存在时返回ErrKeyNotFound。
+// 点查只读取索引中key范围覆盖key且未被过滤器排除的数据块，GetWithTrace、GetWithOptions和GetEntry等都是同一路径；
+// 不依赖索引和过滤器的逐条扫描见ScanEntry
 func (r *SSTReader) Get(key []byte) ([]byte, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	return r.GetWithTrace(key, nil)
+}
 
-	// 遍历所有索引块查找
-	// 检查key是否在当前索引的范围内
-	for _, idx := range r.index {
-		if bytes.Compare(key, idx.StartKey) >= 0 && bytes.Compare(key, idx.EndKey) <= 0 {
-			// 检查bloom filter，快速过滤不存在的key
-			filter, exists := r.filterMap[idx.Length]
-			if exists && !filter.Contains(key) {
-				continue // 根据bloom filter判断key不在这个块中
-			}
-			kvList, exists := r.kvLists[idx.Offset]
-			if exists {
-				for _, kv := range kvList {
-					if bytes.Equal(kv.Key, key) {
-						return kv.Value, nil
-					}
-				}
-			}
-		}
+// GetWithTrace 查找key，并将查找过程记录到trace中，trace为nil时不记录
+func (r *SSTReader) GetWithTrace(key []byte, trace *ReadTrace) ([]byte, error) {
+	kv, err := r.GetEntry(key, trace)
+	if err != nil {
+		return nil, err
 	}
-	return nil, myerror.ErrKeyNotFound
+	return kv.Value, nil
 }
 
-// Get 通过key获取value [比较慢速的查找 后期进行优化修改]
-func (r *SSTReader) SlowGet(key []byte) ([]byte, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// GetWithTimestamp 查找key，同时返回写入时间，没有记录时间的条目返回0
+func (r *SSTReader) GetWithTimestamp(key []byte) ([]byte, int64, error) {
+	kv, err := r.GetEntry(key, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return kv.Value, kv.Timestamp, nil
+}
+
+// GetWithOptions 按opts查找key，opts的说明见config.ReadOptions
+func (r *SSTReader) GetWithOptions(key []byte, opts config.ReadOptions) ([]byte, error) {
+	kv, err := r.GetEntryWithOptions(key, nil, opts)
+	if err != nil {
+		return nil, err
+	}
+	return kv.Value, nil
+}
+
+// GetEntry 查找key对应的条目，并将查找过程记录到trace中，trace为nil时不记录
+func (r *SSTReader) GetEntry(key []byte, trace *ReadTrace) (*KeyValue, error) {
+	return r.GetEntryWithOptions(key, trace, config.DefaultReadOptions())
+}
+
+// GetEntryWithOptions 同GetEntry，按opts决定是否填充缓存和校验条目。返回的条目默认是复制出来的，
+// opts.UnsafeSharedValue为true且不使用映射时返回数据块缓存中共享的条目，调用方不得修改
+func (r *SSTReader) GetEntryWithOptions(key []byte, trace *ReadTrace, opts config.ReadOptions) (*KeyValue, error) {
+	// 范围之外的key无需解析索引或读取数据块
+	if r.outOfRange(key) {
+		return nil, myerror.ErrKeyNotFound
+	}
+	if err := r.pin(); err != nil {
+		return nil, err
+	}
+	defer r.Release()
+	index, filters, reloaded, err := r.loadIndexSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	filters = r.useFilters(filters)
+	if trace != nil {
+		if reloaded {
+			trace.IndexMisses++
+		} else {
+			trace.IndexHits++
+		}
+	}
 
 	// 遍历所有索引块查找
-	for _, idx := range r.index {
-		// 检查key是否在当前索引的范围内
-		// 注意：索引的范围判断是包括边界的
-		if bytes.Compare(key, idx.StartKey) >= 0 && bytes.Compare(key, idx.EndKey) <= 0 {
+	// 检查key是否在当前索引的范围内，允许重复key的文件中同一个key可能跨越多个数据块，返回最后一个版本
+	var foundList []*KeyValue
+	var foundPos int
+	var foundIdx *Index
+	for _, idx := range index {
+		if bytes.Compare(key, idx.StartKey) < 0 {
+			break
+		}
+		if bytes.Compare(key, idx.EndKey) <= 0 {
 			// 检查bloom filter，快速过滤不存在的key
-			filter, exists := r.filterMap[idx.Length]
+			filter, exists := filters[idx.Offset]
+			if exists {
+				r.filterProbes.Add(1)
+			}
 			if exists && !filter.Contains(key) {
+				r.bloomMisses.Add(1)
+				if trace != nil {
+					trace.BloomNegatives++
+				}
 				continue // 根据bloom filter判断key不在这个块中
 			}
-
-			// 读取对应数据块
-			block := make([]byte, idx.Length)
-			if _, err := r.fp.ReadAt(block, r.dataOffset+idx.Offset); err != nil {
-				return nil, err
+			r.blockReads.Add(1)
+			r.blockBytes.Add(uint64(idx.Length))
+			if trace != nil {
+				trace.Blocks = append(trace.Blocks, BlockTrace{File: r.Path(), Offset: idx.Offset, Size: idx.Length})
 			}
-
-			// 在数据块中查找key
-			value, err := r.searchInBlock(block, key)
-			if err == nil {
-				return value, nil
-			} else if err != myerror.ErrKeyNotFound {
+			kvList, err := r.loadBlockWith(idx, opts)
+			if err != nil {
 				return nil, err
 			}
-			// 如果在当前块中没找到，继续查找下一个块
+			for i, kv := range kvList {
+				cmp := bytes.Compare(kv.Key, key)
+				if cmp > 0 {
+					break
+				}
+				if cmp == 0 {
+					foundList, foundPos, foundIdx = kvList, i, idx
+				}
+			}
 		}
 	}
-
-	// 如果所有索引块都没找到，尝试全面搜索所有数据区
-	// 这是为了确保我们不会遗漏任何数据
-	dataBytes := make([]byte, r.dataLength)
-	if _, err := r.fp.ReadAt(dataBytes, r.dataOffset); err != nil {
-		return nil, err
+	if foundList == nil {
+		return nil, myerror.ErrKeyNotFound
 	}
-
-	// 通过完整读取数据区来查找key
-	buf := bytes.NewReader(dataBytes)
-	for buf.Len() > 0 {
-		// 读取key长度
-		var keyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
+	if opts.VerifyChecksums {
+		if err := r.checkEntry(foundList, foundPos, foundIdx); err != nil {
 			return nil, err
 		}
+	}
+	if opts.UnsafeSharedValue {
+		return r.shareEntry(foundList[foundPos]), nil
+	}
+	return r.detachEntry(foundList[foundPos]), nil
+}
 
-		// 读取value长度
-		var valueLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &valueLen); err != nil {
-			return nil, err
+// MultiGet 批量查找已排序的keys，返回的结果与keys一一对应
+// 先通过索引将keys按数据块分组，每个数据块最多读取一次，并在一次遍历中解析该块内的所有key
+func (r *SSTReader) MultiGet(keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+	index, filters, err := r.loadedIndex()
+	if err == nil {
+		if err = r.pin(); err == nil {
+			defer r.Release()
+			filters = r.useFilters(filters)
+		} else {
+			index = nil
 		}
+	}
+	for i := range errs {
+		if err != nil {
+			errs[i] = err
+		} else {
+			errs[i] = myerror.ErrKeyNotFound
+		}
+	}
 
-		// 读取key
-		currentKey := make([]byte, keyLen)
-		if _, err := buf.Read(currentKey); err != nil {
-			return nil, err
+	for _, idx := range index {
+		// keys已排序，二分查找落在当前数据块范围内的区间
+		lo := sort.Search(len(keys), func(i int) bool {
+			return bytes.Compare(keys[i], idx.StartKey) >= 0
+		})
+		hi := sort.Search(len(keys), func(i int) bool {
+			return bytes.Compare(keys[i], idx.EndKey) > 0
+		})
+		if lo >= hi {
+			continue
 		}
 
-		// 如果找到匹配的key，返回对应的value
-		if bytes.Equal(currentKey, key) {
-			value := make([]byte, valueLen)
-			if _, err := buf.Read(value); err != nil {
-				return nil, err
+		// 过滤掉布隆过滤器判定不存在的key。已找到的key仍需检查，
+		// 允许重复key的文件中同一个key可能跨越多个数据块，后面数据块中的版本覆盖前面的
+		filter, hasFilter := filters[idx.Offset]
+		pending := make([]int, 0, hi-lo)
+		for i := lo; i < hi; i++ {
+			if hasFilter {
+				r.filterProbes.Add(1)
+				if !filter.Contains(keys[i]) {
+					r.bloomMisses.Add(1)
+					continue
+				}
 			}
-			return value, nil
+			pending = append(pending, i)
+		}
+		if len(pending) == 0 {
+			continue
 		}
 
-		// 如果不匹配，跳过value部分
-		if _, err := buf.Seek(int64(valueLen), io.SeekCurrent); err != nil {
-			return nil, err
+		r.blockReads.Add(1)
+		r.blockBytes.Add(uint64(idx.Length))
+		kvList, err := r.loadBlock(idx)
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+			continue
+		}
+		for k, kv := range kvList {
+			j := sort.Search(len(pending), func(j int) bool {
+				return bytes.Compare(keys[pending[j]], kv.Key) >= 0
+			})
+			if j < len(pending) && bytes.Equal(keys[pending[j]], kv.Key) {
+				values[pending[j]] = bytes.Clone(kv.Value)
+				errs[pending[j]] = nil
+				if err := r.checkEntry(kvList, k, idx); err != nil {
+					values[pending[j]], errs[pending[j]] = nil, err
+				}
+			}
 		}
 	}
+	return values, errs
+}
+
+// PrefixScan 按key顺序遍历所有以prefix开头的键值对，fn返回false时停止遍历
+// 若过滤器中包含当前前缀提取器提取的前缀，则跳过过滤器判定不包含该前缀的数据块
+func (r *SSTReader) PrefixScan(prefix []byte, fn func(key, value []byte) bool) error {
+	var filterKey []byte
+	if r.prefixFilter {
+		filterKey = r.conf.PrefixExtractor.Transform(prefix)
+	}
+	return r.scanRange(keyutil.PrefixRange(prefix), filterKey, scanKeyValues(fn))
+}
 
-	return nil, myerror.ErrKeyNotFound
+// ScanRange 按key顺序遍历rng范围内的键值对，fn返回false时停止遍历
+func (r *SSTReader) ScanRange(rng keyutil.Range, fn func(key, value []byte) bool) error {
+	return r.scanRange(rng, nil, scanKeyValues(fn))
 }
 
-// searchInBlock 在数据块中搜索指定的key
-func (r *SSTReader) searchInBlock(block []byte, searchKey []byte) ([]byte, error) {
-	buf := bytes.NewReader(block)
+// ScanRangeEntries 与ScanRange相同，传递包括类型、序列号、过期时间和写入时间的完整条目，条目归fn所有
+func (r *SSTReader) ScanRangeEntries(rng keyutil.Range, fn func(entry kv.Entry) bool) error {
+	return r.scanRange(rng, nil, fn)
+}
+
+// scanKeyValues 将键值对的回调转换为条目的回调
+func scanKeyValues(fn func(key, value []byte) bool) func(entry kv.Entry) bool {
+	return func(entry kv.Entry) bool {
+		return fn(entry.Key, entry.Value)
+	}
+}
 
-	for buf.Len() > 0 {
-		// 读取key长度
-		var keyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				break
+// scanRange 遍历rng范围内的条目，filterKey不为nil时跳过过滤器判定不包含它的数据块
+func (r *SSTReader) scanRange(rng keyutil.Range, filterKey []byte, fn func(entry kv.Entry) bool) error {
+	if err := r.pin(); err != nil {
+		return err
+	}
+	defer r.Release()
+	index, filters, err := r.loadedIndex()
+	if err != nil {
+		return err
+	}
+	if filterKey != nil {
+		filters = r.useFilters(filters)
+	}
+
+	for _, idx := range index {
+		// 数据块中的最大key小于下界，不可能包含范围内的key
+		if bytes.Compare(idx.EndKey, rng.Start) < 0 {
+			continue
+		}
+		// 数据块中的最小key已越过上界，后续数据块也不会匹配
+		if rng.Beyond(idx.StartKey) {
+			break
+		}
+		if filterKey != nil {
+			if filter, exists := filters[idx.Offset]; exists && !filter.Contains(filterKey) {
+				continue
 			}
-			return nil, err
 		}
 
-		// 读取value长度
-		var valueLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &valueLen); err != nil {
-			return nil, err
+		r.blockReads.Add(1)
+		r.blockBytes.Add(uint64(idx.Length))
+		kvList, err := r.loadBlock(idx)
+		if err != nil {
+			return err
 		}
-
-		// 读取key
-		key := make([]byte, keyLen)
-		if _, err := buf.Read(key); err != nil {
-			return nil, err
+		for i, kv := range kvList {
+			if rng.Beyond(kv.Key) {
+				return nil
+			}
+			if bytes.Compare(kv.Key, rng.Start) < 0 {
+				continue
+			}
+			if err := r.checkEntry(kvList, i, idx); err != nil {
+				return err
+			}
+			if !fn(kv.Entry.Clone()) {
+				return nil
+			}
 		}
+	}
+	return nil
+}
 
-		// 如果找到匹配的key，返回对应的value
-		if bytes.Equal(key, searchKey) {
-			value := make([]byte, valueLen)
-			if _, err := buf.Read(value); err != nil {
-				return nil, err
+// ScanEntry 逐条解码所有数据块查找key，不使用过滤器和索引中的key范围，返回文件中该key的最后一个版本。
+// 这是有意穷举的查找路径，供ShadowVerifyReads等校验点查的结果使用，代价与文件大小成正比，不用于正常读取。
+// 与点查使用同一个条目解码实现，任一数据块无法解析时返回错误，key不存在时返回ErrKeyNotFound
+func (r *SSTReader) ScanEntry(key []byte) (*KeyValue, error) {
+	index, _, err := r.loadedIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.pin(); err != nil {
+		return nil, err
+	}
+	defer r.Release()
+	var found *KeyValue
+	err = r.readBlocks(index, func(_ int, idx *Index, block []byte) error {
+		for pos := int64(0); pos < int64(len(block)); {
+			kv, n, err := decodeEntry(block[pos:], r.blockFormat)
+			if err != nil {
+				return locateEntryError(err, r.Path(), r.dataOffset+idx.Offset+pos)
 			}
-			return value, nil
+			if bytes.Equal(kv.Key, key) {
+				found = kv
+			}
+			pos += n
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, myerror.ErrKeyNotFound
+	}
+	return found, nil
+}
 
-		// 跳过value
-		if _, err := buf.Seek(int64(valueLen), io.SeekCurrent); err != nil {
-			return nil, err
+// searchBlock 按format逐条解析未解码的数据块，返回key对应的条目，不构造整个数据块的键值对列表。
+// 数据块中有重复key时返回最后一个，条目校验错误的偏移量为相对数据块起始位置的偏移量
+func searchBlock(block []byte, searchKey []byte, format uint8) (*KeyValue, error) {
+	var found *KeyValue
+	for pos := int64(0); len(block) > 0; {
+		kv, n, err := decodeEntry(block, format)
+		if err != nil {
+			return nil, locateEntryError(err, "", pos)
+		}
+		cmp := bytes.Compare(kv.Key, searchKey)
+		if cmp > 0 {
+			break
 		}
+		if cmp == 0 {
+			found = kv
+		}
+		block = block[n:]
+		pos += n
 	}
-
-	return nil, myerror.ErrKeyNotFound
+	if found == nil {
+		return nil, myerror.ErrKeyNotFound
+	}
+	return found, nil
 }
 
-// Close 关闭SST读取器
+// Close 关闭SST读取器，之后的读取返回ErrReaderClosed。进行中的读取持有引用，文件在它们结束后才关闭，
+// 此时关闭文件的错误只记录日志。重复调用直接返回nil
 func (r *SSTReader) Close() error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	if !r.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	return r.release()
+}
 
-	if r.fp != nil {
-		return r.fp.Close()
+// reopen 以相同的方式重新打开读取器的文件，新读取器使用相同的数据块缓存、索引和过滤器内存预算
+func (r *SSTReader) reopen() (*SSTReader, error) {
+	open := NewSSTReader
+	if r.lazy {
+		open = NewLazySSTReader
 	}
-	return nil
+	reader, err := open(r.conf, r.Path())
+	if err != nil {
+		return nil, err
+	}
+	reader.AttachBlockCache(r.cache)
+	reader.AttachBudget(r.budget)
+	reader.AttachFilterBudget(r.filterBudget)
+	return reader, nil
 }
 
-// GetIterator 返回一个迭代器，用于遍历所有的key-value对
+// GetIterator 返回一个迭代器，用于遍历所有的key-value对，数据块在遍历到时才逐个读取。
+// 每个数据块读入新分配的缓冲区，Entry、Key和Value返回的切片引用该缓冲区，之后不会被覆盖，保留时不需要复制
 func (r *SSTReader) GetIterator() (*SSTIterator, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	// 读取整个数据区
-	data := make([]byte, r.dataLength)
-	if _, err := r.fp.ReadAt(data, r.dataOffset); err != nil {
+	index, _, err := r.loadedIndex()
+	if err != nil {
 		return nil, err
 	}
+	return &SSTIterator{reader: r, index: index}, nil
+}
 
-	// 创建迭代器
-	it := &SSTIterator{
-		reader:    r,
-		dataBuf:   bytes.NewReader(data),
-		currKey:   nil,
-		currValue: nil,
-		err:       nil,
+// GetReusingIterator 返回复用数据块缓冲区的迭代器，用于压缩等依次处理每个条目、不保留条目的内部遍历。
+// EntryUnsafe、KeyUnsafe和ValueUnsafe不复制，只保证在下一次调用Next之前有效；Entry、Key和Value返回副本，可以保留
+func (r *SSTReader) GetReusingIterator() (*SSTIterator, error) {
+	it, err := r.GetIterator()
+	if err != nil {
+		return nil, err
 	}
-
+	it.reuse = true
 	return it, nil
 }
 
 // todo:后续补充使用
 // SSTIterator SST迭代器
 type SSTIterator struct {
-	reader    *SSTReader
-	dataBuf   *bytes.Reader // 整个数据区的读取器
-	currKey   []byte        // 当前key
-	currValue []byte        // 当前value
-	err       error         // 迭代过程中的错误
+	reader  *SSTReader
+	index   []*Index  // 尚未读取的数据块
+	block   *Index    // 当前数据块
+	data    []byte    // 当前数据块中尚未读取的部分
+	curr    kv.Entry  // 当前条目
+	decoded KeyValue  // 解析条目使用的缓冲，避免每个条目分配一次
+	err     error     // 迭代过程中的错误
+	reuse   bool      // 是否复用数据块缓冲区
+	bufs    [2][]byte // 复用时交替使用的数据块缓冲区
+	turn    int       // 下一个数据块使用的缓冲区
 }
 
 // Next 移动到下一个key-value对
@@ -535,55 +1560,93 @@ func (it *SSTIterator) Next() bool {
 	return it.readNextKeyValue()
 }
 
-// readNextKeyValue 读取下一对key-value
-func (it *SSTIterator) readNextKeyValue() bool {
-	// 如果buffer已经读完，则结束
-	if it.dataBuf.Len() == 0 {
-		return false
+// blockBuffer 返回读取长度为n的数据块的缓冲区。复用时在两个缓冲区之间交替，读入新的数据块后
+// 上一个数据块中的条目仍然有效：合并迭代器向前多读一个条目以合并同一文件中的重复key，期间上一个条目不能被覆盖
+func (it *SSTIterator) blockBuffer(n int64) []byte {
+	if !it.reuse {
+		return make([]byte, n)
+	}
+	buf := it.bufs[it.turn]
+	if int64(cap(buf)) < n {
+		buf = make([]byte, n)
+		it.bufs[it.turn] = buf
 	}
+	it.turn ^= 1
+	return buf[:n]
+}
 
-	// 读取key长度
-	var keyLen uint32
-	if err := binary.Read(it.dataBuf, binary.BigEndian, &keyLen); err != nil {
-		if err == io.EOF {
+// readNextKeyValue 读取下一对key-value
+func (it *SSTIterator) readNextKeyValue() bool {
+	// 当前数据块读完后读取下一个数据块，所有数据块都读完则结束
+	for len(it.data) == 0 {
+		if len(it.index) == 0 {
+			return false
+		}
+		it.block, it.index = it.index[0], it.index[1:]
+		it.data = it.blockBuffer(it.block.Length)
+		if _, err := it.reader.file().ReadAt(it.data, it.reader.dataOffset+it.block.Offset); err != nil {
+			it.err = it.reader.ioError("read block", it.reader.dataOffset+it.block.Offset, err)
 			return false
 		}
-		it.err = err
-		return false
 	}
 
-	// 读取value长度
-	var valueLen uint32
-	if err := binary.Read(it.dataBuf, binary.BigEndian, &valueLen); err != nil {
-		it.err = err
+	n, err := decodeEntryInto(&it.decoded, it.data, it.reader.blockFormat, true)
+	if err != nil {
+		offset := it.reader.dataOffset + it.block.Offset + it.block.Length - int64(len(it.data))
+		it.err = locateEntryError(err, it.reader.Path(), offset)
 		return false
 	}
+	// 限制容量，调用方追加key或value时不会覆盖数据块中后面的条目
+	it.curr = it.decoded.Entry
+	it.curr.Key, it.curr.Value = slices.Clip(it.curr.Key), slices.Clip(it.curr.Value)
+	it.data = it.data[n:]
+	return true
+}
 
-	// 读取key
-	it.currKey = make([]byte, keyLen)
-	if _, err := it.dataBuf.Read(it.currKey); err != nil {
-		it.err = err
-		return false
+// Entry 获取当前条目。GetIterator返回的迭代器中key和value引用只属于本条目所在数据块的缓冲区，
+// 复用缓冲区的迭代器返回副本；两种情况下修改或追加key和value都不影响之后返回的条目
+func (it *SSTIterator) Entry() kv.Entry {
+	if it.reuse {
+		return it.curr.Clone()
 	}
+	return it.curr
+}
 
-	// 读取value
-	it.currValue = make([]byte, valueLen)
-	if _, err := it.dataBuf.Read(it.currValue); err != nil {
-		it.err = err
-		return false
+// Key 获取当前key，所有权同Entry
+func (it *SSTIterator) Key() []byte {
+	if it.reuse {
+		return bytes.Clone(it.curr.Key)
 	}
+	return it.curr.Key
+}
 
-	return true
+// Value 获取当前value，删除标记为nil，所有权同Entry
+func (it *SSTIterator) Value() []byte {
+	if it.reuse {
+		return bytes.Clone(it.curr.Value)
+	}
+	return it.curr.Value
 }
 
-// Key 获取当前key
-func (it *SSTIterator) Key() []byte {
-	return it.currKey
+// EntryUnsafe 获取当前条目，不复制key和value。复用缓冲区的迭代器中只保证在下一次调用Next之前有效，
+// 需要保留时由调用方复制
+func (it *SSTIterator) EntryUnsafe() kv.Entry {
+	return it.curr
 }
 
-// Value 获取当前value
-func (it *SSTIterator) Value() []byte {
-	return it.currValue
+// KeyUnsafe 获取当前key，不复制，有效期同EntryUnsafe
+func (it *SSTIterator) KeyUnsafe() []byte {
+	return it.curr.Key
+}
+
+// ValueUnsafe 获取当前value，不复制，删除标记为nil，有效期同EntryUnsafe
+func (it *SSTIterator) ValueUnsafe() []byte {
+	return it.curr.Value
+}
+
+// Timestamp 获取当前条目的写入时间，没有记录时为0
+func (it *SSTIterator) Timestamp() int64 {
+	return it.curr.Timestamp
 }
 
 // Error 获取遍历过程中的错误
@@ -2,14 +2,23 @@ package sst
 
 import (
 	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 )
 
@@ -22,9 +31,9 @@ func TestSSTReaderBasic(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a test config
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 5 // Small block size for testing
+	conf.BlockEntryLimit = 5 // Small block size for testing
 
 	// Create a test SST file using SSTWriter
 	sstFile := filepath.Join(tempDir, "reader_test.sst")
@@ -42,8 +51,14 @@ func TestSSTReaderBasic(t *testing.T) {
 		"key200": "value200",
 	}
 
-	for k, v := range testData {
-		if err := writer.Add([]byte(k), []byte(v)); err != nil {
+	// SSTWriter要求key按顺序写入
+	keys := make([]string, 0, len(testData))
+	for k := range testData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := writer.Add([]byte(k), []byte(testData[k])); err != nil {
 			t.Fatalf("Failed to add key-value pair to writer: %v", err)
 		}
 	}
@@ -55,7 +70,7 @@ func TestSSTReaderBasic(t *testing.T) {
 
 	// Add more data to create multiple blocks
 	for i := 0; i < 10; i++ {
-		key := []byte(string(rune('a' + i)))
+		key := []byte(string(rune('l' + i)))
 		value := []byte(string(rune('A' + i)))
 		if err := writer.Add(key, value); err != nil {
 			t.Fatalf("Failed to add additional key-value pair: %v", err)
@@ -81,7 +96,7 @@ func TestSSTReaderBasic(t *testing.T) {
 
 	// Verify that we can read back the data
 	for k, v := range testData {
-		value, err := reader.SlowGet([]byte(k))
+		value, err := reader.Get([]byte(k))
 		if err != nil {
 			t.Errorf("Failed to get value for key %s: %v", k, err)
 			continue
@@ -93,17 +108,17 @@ func TestSSTReaderBasic(t *testing.T) {
 	}
 
 	// Test a non-existent key
-	_, err = reader.SlowGet([]byte("non_existent_key"))
+	_, err = reader.Get([]byte("non_existent_key"))
 	if err != myerror.ErrKeyNotFound {
 		t.Errorf("Expected ErrKeyNotFound for non-existent key, got: %v", err)
 	}
 
 	// Also verify the single-character keys we added
 	for i := 0; i < 10; i++ {
-		key := []byte(string(rune('a' + i)))
+		key := []byte(string(rune('l' + i)))
 		expectedValue := []byte(string(rune('A' + i)))
 
-		value, err := reader.SlowGet(key)
+		value, err := reader.Get(key)
 		if err != nil {
 			t.Errorf("Failed to get value for key %s: %v", string(key), err)
 			continue
@@ -131,9 +146,9 @@ func TestSSTReaderIterator(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a test config
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 3 // Small block size to force multiple blocks
+	conf.BlockEntryLimit = 3 // Small block size to force multiple blocks
 
 	// Create a test SST file
 	sstFile := filepath.Join(tempDir, "iterator_test.sst")
@@ -234,9 +249,9 @@ func TestSSTReaderBloomFilter(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a test config
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 4 // Small block size to test filters
+	conf.BlockEntryLimit = 4 // Small block size to test filters
 
 	// Create a test SST file
 	sstFile := filepath.Join(tempDir, "bloom_test.sst")
@@ -330,7 +345,7 @@ func TestSSTReaderInvalidFile(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
 
 	// Test case 1: Non-existent file
@@ -346,7 +361,7 @@ func TestSSTReaderInvalidFile(t *testing.T) {
 	}
 
 	_, err = NewSSTReader(conf, emptyFile)
-	if err != myerror.ErrInvalidSSTFormat {
+	if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
 		t.Errorf("Expected ErrInvalidSSTFormat for empty file, got: %v", err)
 	}
 
@@ -366,7 +381,7 @@ func TestSSTReaderInvalidFile(t *testing.T) {
 	}
 
 	_, err = NewSSTReader(conf, invalidFile)
-	if err != myerror.ErrInvalidSSTFormat {
+	if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
 		t.Errorf("Expected ErrInvalidSSTFormat for invalid footer, got: %v", err)
 	}
 }
@@ -381,9 +396,9 @@ func TestSSTReaderLargeDataset(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// 创建配置
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 20 // 较小的块大小以确保创建多个块
+	conf.BlockEntryLimit = 20 // 较小的块大小以确保创建多个块
 
 	// 创建测试SST文件
 	sstFile := filepath.Join(tempDir, "large_dataset.sst")
@@ -520,8 +535,9 @@ func TestSSTReaderLargeDataset(t *testing.T) {
 	}
 
 	// 报告索引和过滤器的统计信息
-	t.Logf("SST Reader loaded with %d index entries", len(reader.index))
-	t.Logf("SST Reader loaded with %d bloom filters", len(reader.filterMap))
+	handles := reader.BlockHandles()
+	t.Logf("SST Reader loaded with %d index entries", len(handles))
+	t.Logf("SST Reader loaded with %d bloom filters", filteredBlocks(handles))
 	t.Logf("Total data verified: %d key-value pairs", len(expectedKeys))
 
 	// 修复文件大小统计
@@ -556,9 +572,9 @@ func TestSSTReaderLargeScale(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// 创建配置
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 25 // 设置较小的块大小以创建多个数据块
+	conf.BlockEntryLimit = 25 // 设置较小的块大小以创建多个数据块
 
 	// 创建测试SST文件
 	sstFile := filepath.Join(tempDir, "large_scale_test.sst")
@@ -654,8 +670,9 @@ func TestSSTReaderLargeScale(t *testing.T) {
 	t.Logf("  - 数据段大小: %d 字节", reader.dataLength)
 	t.Logf("  - 索引段大小: %d 字节", reader.indexLength)
 	t.Logf("  - 过滤器段大小: %d 字节", reader.filterLength)
-	t.Logf("  - 索引条目数量: %d", len(reader.index))
-	t.Logf("  - 布隆过滤器数量: %d", len(reader.filterMap))
+	handles := reader.BlockHandles()
+	t.Logf("  - 索引条目数量: %d", len(handles))
+	t.Logf("  - 布隆过滤器数量: %d", filteredBlocks(handles))
 
 	// 测试1：直接读取所有键值对进行验证
 	t.Log("开始验证所有键值对...")
@@ -778,3 +795,1490 @@ func TestSSTReaderLargeScale(t *testing.T) {
 
 	t.Logf("大规模数据测试成功完成，所有 %d 条数据处理无误!", len(expectedKeys))
 }
+
+// writePrefixSST 写入100个互不相交的前缀，每个前缀5个key，只使用偶数编号的前缀
+func writePrefixSST(t *testing.T, conf *config.Config, name string) string {
+	t.Helper()
+	path := filepath.Join(conf.DataDir, name)
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := 0; p < 200; p += 2 {
+		for i := 0; i < 5; i++ {
+			if err := writer.Add([]byte(fmt.Sprintf("p%03d:%02d", p, i)), []byte(fmt.Sprintf("v%d_%d", p, i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// scanBlockReads 对所有前缀执行扫描，返回扫描不存在的前缀时访问的数据块数
+func scanBlockReads(t *testing.T, reader *SSTReader) uint64 {
+	t.Helper()
+	var missReads uint64
+	for p := 0; p < 200; p++ {
+		before := reader.BlockReads()
+		var keys []string
+		err := reader.PrefixScan([]byte(fmt.Sprintf("p%03d:", p)), func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if p%2 == 0 {
+			want = 5
+		} else {
+			missReads += reader.BlockReads() - before
+		}
+		if len(keys) != want || !sort.StringsAreSorted(keys) {
+			t.Fatalf("prefix p%03d: got keys %v, want %d sorted keys", p, keys, want)
+		}
+	}
+	return missReads
+}
+
+func TestSSTReaderPrefixScanBlockReads(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockEntryLimit = 7
+	conf.IsDebug = false
+
+	plainReader, err := NewSSTReader(conf, writePrefixSST(t, conf, "plain.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainReader.Close()
+	if _, ok := plainReader.Meta()[MetaPrefixExtractor]; ok {
+		t.Fatalf("expected no prefix extractor meta without extractor, got %v", plainReader.Meta())
+	}
+	plainReads := scanBlockReads(t, plainReader)
+
+	conf.PrefixExtractor = config.NewDelimiterPrefixExtractor(':')
+	prefixReader, err := NewSSTReader(conf, writePrefixSST(t, conf, "prefix.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prefixReader.Close()
+	if got := prefixReader.Meta()[MetaPrefixExtractor]; got != conf.PrefixExtractor.Name() {
+		t.Fatalf("meta extractor = %q, want %q", got, conf.PrefixExtractor.Name())
+	}
+	prefixReads := scanBlockReads(t, prefixReader)
+
+	t.Logf("blocks read for missing prefixes: without extractor=%d, with extractor=%d", plainReads, prefixReads)
+	if plainReads < 50 {
+		t.Fatalf("expected missing prefixes to read blocks without extractor, got %d", plainReads)
+	}
+	if prefixReads*10 > plainReads {
+		t.Fatalf("prefix filter should skip most blocks: %d vs %d", prefixReads, plainReads)
+	}
+}
+
+// TestSSTReaderNilFilterConstructor 没有记录过滤器名称的文件按FilterConstructor读取过滤器：
+// 构造函数为nil时不使用过滤器，返回nil时返回配置错误而不是panic
+func TestSSTReaderNilFilterConstructor(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.FilterPolicy = ""
+	path := filepath.Join(conf.DataDir, "legacy.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Add([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readConf := *conf
+	readConf.FilterConstructor = nil
+	reader, err := NewSSTReader(&readConf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := reader.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+	reader.Close()
+
+	readConf.FilterConstructor = func(uint64, uint) filter.Filter { return nil }
+	reader, err = NewSSTReader(&readConf, path)
+	if err == nil {
+		_, err = reader.Get([]byte("key"))
+		reader.Close()
+	}
+	if !errors.Is(err, myerror.ErrInvalidConfig) {
+		t.Fatalf("read with nil filter = %v, want ErrInvalidConfig", err)
+	}
+}
+
+// TestSSTReaderScanFFKeys 前缀以0xFF结尾或全部为0xFF时，扫描结果与逐个按前缀匹配一致，跨数据块时同样成立
+func TestSSTReaderScanFFKeys(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockEntryLimit = 2
+	conf.IsDebug = false
+	keys := [][]byte{
+		{'a'}, {'a', 0xFF}, {'a', 0xFF, 0x00}, {'a', 0xFF, 0xFF}, {'a', 0xFF, 0xFF, 'x'}, {'b'}, {'b', 0x00},
+		{0xFE, 0xFF}, {0xFF}, {0xFF, 0x00}, {0xFF, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF},
+	}
+	path := filepath.Join(conf.DataDir, "ff.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := writer.Add(key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for _, prefix := range [][]byte{nil, {'a'}, {'a', 0xFF}, {'a', 0xFF, 0xFF}, {0xFE}, {0xFF}, {0xFF, 0xFF}, {0xFF, 0xFF, 0xFF, 0xFF, 0xFF}} {
+		var want, got [][]byte
+		for _, key := range keys {
+			if bytes.HasPrefix(key, prefix) {
+				want = append(want, key)
+			}
+		}
+		if err := reader.PrefixScan(prefix, func(key, _ []byte) bool {
+			got = append(got, key)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%x", got) != fmt.Sprintf("%x", want) {
+			t.Fatalf("PrefixScan(%x) = %x, want %x", prefix, got, want)
+		}
+	}
+
+	// 没有上界的范围包括全部为0xFF的key
+	var got [][]byte
+	if err := reader.ScanRange(keyutil.Range{Start: []byte{0xFE}, Unbounded: true}, func(key, _ []byte) bool {
+		got = append(got, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := keys[7:]; fmt.Sprintf("%x", got) != fmt.Sprintf("%x", want) {
+		t.Fatalf("ScanRange = %x, want %x", got, want)
+	}
+}
+
+func TestSSTReaderPrefixExtractorMismatch(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockEntryLimit = 7
+	conf.IsDebug = false
+	conf.PrefixExtractor = config.NewFixedPrefixExtractor(5)
+	path := writePrefixSST(t, conf, "fixed.sst")
+
+	// 读取时使用不同的提取器，扫描退化为不使用前缀过滤
+	readConf := *conf
+	readConf.PrefixExtractor = config.NewDelimiterPrefixExtractor(':')
+	reader, err := NewSSTReader(&readConf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.prefixFilter {
+		t.Fatal("prefix filter must be disabled when extractor differs")
+	}
+	if reads := scanBlockReads(t, reader); reads < 50 {
+		t.Fatalf("expected fallback scan to read blocks for missing prefixes, got %d", reads)
+	}
+}
+
+// corruptTestConfig 返回损坏文件测试使用的配置，blockCache决定数据块按需读取还是打开时全部加载
+func corruptTestConfig(dir string, blockCache bool) *config.Config {
+	conf := testConfig()
+	conf.DataDir = dir
+	conf.IsDebug = false
+	conf.Logger = nil
+	conf.BlockEntryLimit = 4
+	if blockCache {
+		conf.BlockCacheSize = 1 << 20
+	}
+	return conf
+}
+
+// writeCorruptSeed 写入一个有效的SST文件并返回其内容，作为截断和位翻转的样本
+func writeCorruptSeed(tb testing.TB) []byte {
+	tb.Helper()
+	conf := corruptTestConfig(tb.TempDir(), false)
+	path := filepath.Join(conf.DataDir, "seed.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < 40; i++ {
+		var value []byte
+		if i%7 != 0 {
+			value = []byte(fmt.Sprintf("value-%d", i))
+		}
+		if err := writer.Add([]byte(fmt.Sprintf("key-%03d", i)), value); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+// openCorrupt 打开data构成的文件：要么返回ErrInvalidSSTFormat，要么打开成功且所有读取路径都不会panic
+func openCorrupt(tb testing.TB, conf *config.Config, data []byte) {
+	path := filepath.Join(conf.DataDir, "corrupt.sst")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	for _, open := range []func(*config.Config, string) (*SSTReader, error){NewSSTReader, NewLazySSTReader} {
+		reader, err := open(conf, path)
+		if err != nil {
+			if !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+				tb.Fatalf("open(%d bytes) returned %v, want ErrInvalidSSTFormat", len(data), err)
+			}
+			continue
+		}
+		readCorrupt(reader)
+		reader.Close()
+	}
+}
+
+// readCorrupt 依次调用各读取路径，延迟打开的读取器在第一次访问时才发现文件损坏
+func readCorrupt(reader *SSTReader) {
+	reader.AttachBlockCache(NewBlockCache(reader.conf.BlockCacheSize))
+	for i := 0; i < 41; i++ {
+		key := []byte(fmt.Sprintf("key-%03d", i))
+		reader.Get(key)
+		reader.ScanEntry(key)
+	}
+	reader.KvList()
+	reader.PrefixScan([]byte("key-0"), func(_, _ []byte) bool { return true })
+	if it, err := reader.GetIterator(); err == nil {
+		for it.Next() {
+		}
+	}
+}
+
+func TestSSTReaderCorruptFiles(t *testing.T) {
+	seed := writeCorruptSeed(t)
+	for _, blockCache := range []bool{false, true} {
+		conf := corruptTestConfig(t.TempDir(), blockCache)
+		var before, after runtime.MemStats
+		check := func(data []byte) {
+			runtime.ReadMemStats(&before)
+			openCorrupt(t, conf, data)
+			runtime.ReadMemStats(&after)
+			// 分配量与文件大小成正比，损坏的长度字段不能导致超大的内存分配
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Fatalf("opening %d corrupt bytes allocated %d bytes", len(data), allocated)
+			}
+		}
+		for size := 0; size < len(seed); size++ {
+			check(seed[:size])
+		}
+		for i := range seed {
+			for _, mask := range []byte{0x01, 0xff} {
+				flipped := append([]byte(nil), seed...)
+				flipped[i] ^= mask
+				check(flipped)
+			}
+		}
+	}
+}
+
+func TestSSTReaderDegradedFilters(t *testing.T) {
+	seed := writeCorruptSeed(t)
+	conf := corruptTestConfig(t.TempDir(), false)
+	path := filepath.Join(conf.DataDir, "filter.sst")
+	if err := os.WriteFile(path, seed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	clean, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clean.Close()
+	filterOffset, filterLength, filters := clean.filterOffset, int64(clean.filterLength), len(clean.Filter())
+
+	for _, tt := range []struct {
+		name        string
+		corrupt     func(data []byte) []byte
+		wantFilters int
+	}{
+		{"load failure", func(data []byte) []byte {
+			// 第一个过滤器的位数组大小m置0
+			copy(data[filterOffset+12:], make([]byte, 8))
+			return data
+		}, filters - 1},
+		{"unknown block", func(data []byte) []byte {
+			binary.BigEndian.PutUint64(data[filterOffset:], 1<<40)
+			return data
+		}, filters - 1},
+		{"trailing garbage", func(data []byte) []byte {
+			// 在过滤器区末尾插入无法解析的数据并修改footer中的过滤器区长度
+			end := filterOffset + filterLength
+			data = append(data[:end:end], append([]byte{1, 2, 3, 4, 5}, data[end:]...)...)
+			binary.BigEndian.PutUint32(data[len(data)-4:], uint32(filterLength+5))
+			return data
+		}, filters},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := corruptTestConfig(t.TempDir(), false)
+			path := filepath.Join(conf.DataDir, "corrupt.sst")
+			if err := os.WriteFile(path, tt.corrupt(append([]byte(nil), seed...)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, open := range []func(*config.Config, string) (*SSTReader, error){NewSSTReader, NewLazySSTReader} {
+				reader, err := open(conf, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 41; i++ {
+					key := []byte(fmt.Sprintf("key-%03d", i))
+					value, err := reader.Get(key)
+					wantValue, wantErr := clean.Get(key)
+					if !bytes.Equal(value, wantValue) || err != wantErr {
+						t.Fatalf("Get(%s) = %q, %v, want %q, %v", key, value, err, wantValue, wantErr)
+					}
+				}
+				if reader.DegradedFilters() != 1 || len(reader.Filter()) != tt.wantFilters {
+					t.Fatalf("DegradedFilters = %d with %d filters, want 1 with %d",
+						reader.DegradedFilters(), len(reader.Filter()), tt.wantFilters)
+				}
+				reader.Close()
+			}
+
+			// StrictFilters时打开失败，延迟打开时由第一次访问返回错误
+			conf.StrictFilters = true
+			if _, err := NewSSTReader(conf, path); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+				t.Fatalf("strict NewSSTReader = %v, want ErrInvalidSSTFormat", err)
+			}
+			lazy, err := NewLazySSTReader(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lazy.Close()
+			if _, err := lazy.Get([]byte("key-001")); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+				t.Fatalf("strict lazy Get = %v, want ErrInvalidSSTFormat", err)
+			}
+		})
+	}
+	if clean.DegradedFilters() != 0 {
+		t.Fatalf("clean file reported %d degraded filters", clean.DegradedFilters())
+	}
+}
+
+func FuzzNewSSTReader(f *testing.F) {
+	seed := writeCorruptSeed(f)
+	f.Add(seed)
+	f.Add(seed[:len(seed)/2])
+	f.Add(seed[len(seed)/2:])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		openCorrupt(t, corruptTestConfig(t.TempDir(), len(data)%2 == 0), data)
+	})
+}
+
+func TestSSTDuplicateKeys(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 3 // 重复的key跨越数据块边界
+
+	path := filepath.Join(conf.DataDir, "dup.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.SetAllowDuplicateKeys(true)
+	entries := [][2]string{{"a", "1"}, {"b", "1"}, {"c", "1"}, {"c", "2"}, {"c", "3"}, {"c", "4"}, {"d", "1"}, {"d", "2"}}
+	for _, e := range entries {
+		if err := writer.Add([]byte(e[0]), []byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 允许重复时key仍不能倒序
+	if err := writer.Add([]byte("c"), []byte("5")); !errors.Is(err, myerror.ErrKeyOutOfOrder) {
+		t.Fatalf("descending key = %v, want ErrKeyOutOfOrder", err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// 各种点查都返回最后写入的版本
+	want := map[string]string{"a": "1", "b": "1", "c": "4", "d": "2"}
+	for key, value := range want {
+		if got, err := reader.Get([]byte(key)); err != nil || string(got) != value {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+		}
+		if got, err := reader.ScanEntry([]byte(key)); err != nil || string(got.Value) != value {
+			t.Fatalf("ScanEntry(%s) = %v, %v, want %q", key, got, err, value)
+		}
+		if got, err := GetFromFile(conf, path, []byte(key)); err != nil || string(got) != value {
+			t.Fatalf("GetFromFile(%s) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+	keys := [][]byte{[]byte("a"), []byte("c"), []byte("d"), []byte("e")}
+	values, errs := reader.MultiGet(keys)
+	for i, value := range []string{"1", "4", "2"} {
+		if errs[i] != nil || string(values[i]) != value {
+			t.Fatalf("MultiGet(%s) = %q, %v, want %q", keys[i], values[i], errs[i], value)
+		}
+	}
+	if errs[3] != myerror.ErrKeyNotFound {
+		t.Fatalf("MultiGet(e) error = %v, want ErrKeyNotFound", errs[3])
+	}
+
+	// 迭代器按写入顺序返回所有版本
+	it, err := reader.GetIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]string
+	for it.Next() {
+		got = append(got, [2]string{string(it.Key()), string(it.Value())})
+	}
+	if it.Error() != nil {
+		t.Fatal(it.Error())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(entries) {
+		t.Fatalf("iterator = %v, want %v", got, entries)
+	}
+}
+
+func TestLazySSTReader(t *testing.T) {
+	for _, blockCache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("blockCache=%v", blockCache), func(t *testing.T) {
+			conf := testConfig()
+			conf.IsDebug = false
+			conf.BlockSizeBytes = 256
+			conf.TrackTimestamps = true
+			if blockCache {
+				conf.BlockCacheSize = 1 << 20
+			}
+			path := writeCacheSST(t, conf, 300)
+
+			eager, err := NewSSTReader(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer eager.Close()
+			lazy, err := NewLazySSTReader(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lazy.Close()
+			for _, reader := range []*SSTReader{eager, lazy} {
+				reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+			}
+
+			// 打开时只读取摘要信息
+			if lazy.index != nil || lazy.kvLists != nil {
+				t.Fatal("lazy reader parsed the index at open")
+			}
+			if !bytes.Equal(lazy.MinKey(), eager.MinKey()) || !bytes.Equal(lazy.MaxKey(), eager.MaxKey()) ||
+				lazy.FileSize() != eager.FileSize() || lazy.Properties() != eager.Properties() {
+				t.Fatalf("lazy summary [%s, %s] size %d differs from eager [%s, %s] size %d",
+					lazy.MinKey(), lazy.MaxKey(), lazy.FileSize(), eager.MinKey(), eager.MaxKey(), eager.FileSize())
+			}
+
+			// 各读取路径的结果与立即解析的读取器一致
+			keys := make([][]byte, 0)
+			for i := -1; i <= 300; i++ {
+				keys = append(keys, cacheKey(i))
+			}
+			for _, key := range keys {
+				wantValue, wantTs, wantErr := eager.GetWithTimestamp(key)
+				value, ts, err := lazy.GetWithTimestamp(key)
+				if !bytes.Equal(value, wantValue) || ts != wantTs || err != wantErr {
+					t.Fatalf("Get(%s) = %q, %d, %v, want %q, %d, %v", key, value, ts, err, wantValue, wantTs, wantErr)
+				}
+			}
+			if lazy.index == nil {
+				t.Fatal("lazy reader did not parse the index on first access")
+			}
+			wantValues, wantErrs := eager.MultiGet(keys)
+			values, errs := lazy.MultiGet(keys)
+			for i := range keys {
+				if !bytes.Equal(values[i], wantValues[i]) || errs[i] != wantErrs[i] {
+					t.Fatalf("MultiGet(%s) = %q, %v, want %q, %v", keys[i], values[i], errs[i], wantValues[i], wantErrs[i])
+				}
+			}
+			scan := func(reader *SSTReader) []string {
+				var got []string
+				if err := reader.PrefixScan([]byte("key-001"), func(key, value []byte) bool {
+					got = append(got, string(key)+"="+string(value))
+					return true
+				}); err != nil {
+					t.Fatal(err)
+				}
+				return got
+			}
+			if got, want := scan(lazy), scan(eager); strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("PrefixScan = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLazySSTReaderCorruptIndex(t *testing.T) {
+	conf := corruptTestConfig(t.TempDir(), false)
+	data := writeCorruptSeed(t)
+	path := filepath.Join(conf.DataDir, "corrupt.sst")
+	// 破坏索引区：立即解析时打开失败，延迟打开成功，第一次访问时返回同样的错误并保持不变
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexOffset := seed.indexOffset
+	seed.Close()
+	for i := int64(0); i < 8; i++ {
+		data[indexOffset+i] = 0xff
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSSTReader(conf, path); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+		t.Fatalf("NewSSTReader = %v, want ErrInvalidSSTFormat", err)
+	}
+	lazy, err := NewLazySSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := lazy.Get([]byte("key-001")); !errors.Is(err, myerror.ErrInvalidSSTFormat) {
+			t.Fatalf("Get = %v, want ErrInvalidSSTFormat", err)
+		}
+	}
+}
+
+// countingFile 统计ReadAt调用次数
+type countingFile struct {
+	sstFile
+	reads atomic.Int64
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	f.reads.Add(1)
+	return f.sstFile.ReadAt(p, off)
+}
+
+func countReads(reader *SSTReader) *countingFile {
+	f := &countingFile{sstFile: reader.fp}
+	reader.fp = f
+	return f
+}
+
+func TestSSTReaderGetOutOfRange(t *testing.T) {
+	for _, lazy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("lazy=%v", lazy), func(t *testing.T) {
+			conf := testConfig()
+			conf.IsDebug = false
+			conf.BlockSizeBytes = 256
+			conf.BlockCacheSize = 1 << 20
+			path := writeCacheSST(t, conf, 200)
+			open := NewSSTReader
+			if lazy {
+				open = NewLazySSTReader
+			}
+			reader, err := open(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			file := countReads(reader)
+			// 映射中的数据块不经过ReadAt，以访问的数据块数代替
+			reads := func() int64 {
+				n := file.reads.Load()
+				if reader.Mapped() {
+					n += int64(reader.BlockReads())
+				}
+				return n
+			}
+
+			// 范围之外的key不解析索引也不读取数据块
+			for _, key := range [][]byte{[]byte("a"), []byte("key-"), cacheKey(200), []byte("z")} {
+				if _, err := reader.Get(key); err != myerror.ErrKeyNotFound {
+					t.Fatalf("Get(%s) = %v, want ErrKeyNotFound", key, err)
+				}
+			}
+			if n := reads(); n != 0 {
+				t.Fatalf("out of range lookups issued %d reads, want 0", n)
+			}
+
+			// 位于两个数据块之间的key只查索引
+			if _, err := reader.Get(cacheKey(0)); err != nil {
+				t.Fatal(err)
+			}
+			index := reader.Index()
+			if len(index) < 2 {
+				t.Fatalf("got %d blocks, want at least 2", len(index))
+			}
+			gap := append(append([]byte(nil), index[0].EndKey...), 'x')
+			if bytes.Compare(gap, index[1].StartKey) >= 0 {
+				t.Fatalf("%s is not between blocks", gap)
+			}
+			before := reads()
+			if _, err := reader.Get(gap); err != myerror.ErrKeyNotFound {
+				t.Fatalf("Get(%s) = %v, want ErrKeyNotFound", gap, err)
+			}
+			if n := reads() - before; n != 0 {
+				t.Fatalf("lookup between blocks issued %d reads, want 0", n)
+			}
+
+			// 未缓存的数据块只读取一次
+			if _, err := reader.Get(cacheKey(199)); err != nil {
+				t.Fatal(err)
+			}
+			if n := reads() - before; n != 1 {
+				t.Fatalf("lookup of a present key issued %d reads, want 1", n)
+			}
+		})
+	}
+}
+
+func TestSSTReaderEmptyFile(t *testing.T) {
+	conf := testConfig()
+	conf.IsDebug = false
+	path := writeCacheSST(t, conf, 0)
+	for _, open := range []func(*config.Config, string) (*SSTReader, error){NewSSTReader, NewLazySSTReader} {
+		reader, err := open(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := countReads(reader)
+		if !reader.Empty() || reader.MinKey() != nil || reader.MaxKey() != nil {
+			t.Fatalf("empty file: Empty = %v, range [%q, %q]", reader.Empty(), reader.MinKey(), reader.MaxKey())
+		}
+		for _, key := range [][]byte{{}, []byte("key")} {
+			if _, err := reader.Get(key); err != myerror.ErrKeyNotFound {
+				t.Fatalf("Get(%q) = %v, want ErrKeyNotFound", key, err)
+			}
+		}
+		if n := file.reads.Load(); n != 0 {
+			t.Fatalf("empty file lookups issued %d reads, want 0", n)
+		}
+		reader.Close()
+	}
+}
+
+// registerTestFilter 注册测试用的过滤器名称，TestMain会运行两遍全部测试，只注册一次
+var registerTestFilter = sync.OnceFunc(func() {
+	filter.Register("test-sst-filter", filter.NewCuckooFilter)
+})
+
+func TestSSTReaderFilterPolicy(t *testing.T) {
+	registerTestFilter()
+	for _, tt := range []struct {
+		policy    string // 写入时的FilterPolicy
+		stored    string // 写入元数据的名称，为空时与policy相同
+		wantName  string // FilterName的返回值
+		useFilter bool   // 读取时是否使用过滤器
+	}{
+		{policy: "", wantName: "", useFilter: true}, // 旧文件使用FilterConstructor
+		{policy: filter.NameBloom, wantName: filter.NameBloom, useFilter: true},
+		{policy: filter.NameCuckoo, wantName: filter.NameCuckoo, useFilter: true},
+		{policy: "test-sst-filter", wantName: "test-sst-filter", useFilter: true},
+		{policy: filter.NameNone, wantName: filter.NameNone},
+		{policy: filter.NameCuckoo, stored: "unregistered", wantName: "unregistered"},
+	} {
+		t.Run(cmp.Or(tt.wantName, "legacy"), func(t *testing.T) {
+			conf := testConfig()
+			conf.Logger = nil
+			conf.BlockSizeBytes = 256
+			conf.FilterPolicy = tt.policy
+			conf.FilterConstructor = filter.NewCuckooFilter
+			path := filepath.Join(t.TempDir(), "0_0.sst")
+			writer, err := NewSSTWriter(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stored != "" {
+				writer.filterName = tt.stored
+			}
+			for i := 0; i < 200; i++ {
+				if err := writer.Add(cacheKey(i*2), []byte("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			writer.Close()
+
+			for _, open := range []func(*config.Config, string) (*SSTReader, error){NewSSTReader, NewLazySSTReader} {
+				reader, err := open(conf, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if reader.FilterName() != tt.wantName || reader.HasFilter() != tt.useFilter {
+					t.Fatalf("FilterName = %q, HasFilter = %v", reader.FilterName(), reader.HasFilter())
+				}
+				for i := 0; i < 400; i++ {
+					_, err := reader.Get(cacheKey(i))
+					if want := i%2 != 0; (err == myerror.ErrKeyNotFound) != want {
+						t.Fatalf("Get(%s) = %v", cacheKey(i), err)
+					}
+				}
+				if negatives := reader.BloomNegatives(); (negatives > 0) != tt.useFilter || len(reader.Filter()) > 0 != tt.useFilter {
+					t.Fatalf("%d filter negatives with %d filters", negatives, len(reader.Filter()))
+				}
+				reader.Close()
+			}
+		})
+	}
+
+	conf := testConfig()
+	conf.FilterPolicy = "unregistered"
+	if _, err := NewSSTWriter(conf, filepath.Join(t.TempDir(), "0_0.sst")); !errors.Is(err, myerror.ErrUnknownFilter) {
+		t.Fatalf("NewSSTWriter = %v, want ErrUnknownFilter", err)
+	}
+}
+
+func TestSSTReaderEntryCount(t *testing.T) {
+	conf := testConfig()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 0
+	conf.BlockEntryLimit = 64
+	path := filepath.Join(t.TempDir(), "count.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const total = 1000
+	for i := 0; i < total; i++ {
+		var value []byte
+		if i%100 != 0 {
+			value = []byte("value")
+		}
+		// 删除标记同样计入条目数
+		if err := writer.Add([]byte(fmt.Sprintf("key-%04d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, reader *SSTReader) {
+		t.Helper()
+		if got := reader.EntryCount(); got != total {
+			t.Fatalf("%s: EntryCount = %d, want %d", name, got, total)
+		}
+	}
+
+	eager, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eager.Close()
+	index := eager.Index()
+	if len(index) != (total+63)/64 {
+		t.Fatalf("%d blocks, want %d", len(index), (total+63)/64)
+	}
+	for i, idx := range index {
+		want := uint32(64)
+		if i == len(index)-1 {
+			want = total % 64
+		}
+		if idx.EntryCount != want {
+			t.Fatalf("block %d EntryCount = %d, want %d", i, idx.EntryCount, want)
+		}
+	}
+	check("eager", eager)
+	node, err := NewNode(conf, path, 0, 1, eager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := node.EntryCount(); got != total {
+		t.Fatalf("Node.EntryCount = %d, want %d", got, total)
+	}
+
+	// 延迟打开的读取器只解码索引区，不加载数据块
+	lazy, err := NewLazySSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lazy.Close()
+	check("lazy", lazy)
+	if lazy.index != nil || lazy.kvLists != nil {
+		t.Fatal("EntryCount loaded the body of a lazy reader")
+	}
+
+	// 索引被内存预算淘汰后条目数仍然可用
+	eager.mu.Lock()
+	eager.index = nil
+	eager.mu.Unlock()
+	check("evicted", eager)
+}
+
+func TestSSTReaderIOError(t *testing.T) {
+	// 映射在关闭后直接返回os.ErrClosed，这里使用pread并绕过读取器直接关闭文件，以得到读取文件的错误
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockCacheSize = 1 << 20
+	path := writeCacheSST(t, conf, 10)
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.fp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = reader.Get(cacheKey(5))
+	var se *SSTError
+	if !errors.As(err, &se) || se.Path != path || se.Op != "read block" {
+		t.Fatalf("Get after closing file = %v, want SSTError for %s", err, path)
+	}
+	if !errors.Is(err, os.ErrClosed) || errors.Is(err, myerror.ErrReaderClosed) {
+		t.Fatalf("Get after closing file = %v, want os.ErrClosed from the file", err)
+	}
+}
+
+func TestSSTReaderScanEntry(t *testing.T) {
+	conf := testConfig()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 4
+	path := filepath.Join(t.TempDir(), "0_1.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		entry := kv.Entry{Key: []byte(fmt.Sprintf("key%02d", i)), Value: []byte(fmt.Sprintf("value%02d", i))}
+		if i == 7 {
+			entry = kv.Entry{Key: entry.Key, Kind: kv.KindDelete}
+		}
+		if err := writer.AddEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	// 过滤器判定所有key都不存在时仍能逐条扫描找到
+	for offset := range reader.Filter() {
+		reader.Filter()[offset] = rejectAllFilter{}
+	}
+	if _, err := reader.Get([]byte("key13")); !errors.Is(err, myerror.ErrKeyNotFound) {
+		t.Fatalf("Get with rejecting filter = %v, want ErrKeyNotFound", err)
+	}
+	found, err := reader.ScanEntry([]byte("key13"))
+	if err != nil || string(found.Value) != "value13" {
+		t.Fatalf("ScanEntry(key13) = %v, %v", found, err)
+	}
+	if found, err := reader.ScanEntry([]byte("key07")); err != nil || !found.IsDelete() {
+		t.Fatalf("ScanEntry(key07) = %v, %v, want tombstone", found, err)
+	}
+	if _, err := reader.ScanEntry([]byte("key99")); !errors.Is(err, myerror.ErrKeyNotFound) {
+		t.Fatalf("ScanEntry(key99) = %v, want ErrKeyNotFound", err)
+	}
+}
+
+// 点查(Get)和穷举查找(ScanEntry)在相同的文件上应返回相同的结果：过滤器缺失时点查不经过滤器读取数据块；
+// 数据块损坏时点查只有落在该数据块中的key出错，穷举查找解码所有数据块，每个key都返回错误。
+// 启用数据块缓存使数据块按需读取，未启用时打开文件就会加载并校验全部数据块
+func TestSSTReaderLookupPaths(t *testing.T) {
+	conf := corruptTestConfig(t.TempDir(), true)
+	conf.PerEntryChecksum = true
+	path := filepath.Join(conf.DataDir, "seed.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([][]byte, 40) // 第i个key的value，删除标记为nil
+	for i := range want {
+		if i%7 != 0 {
+			want[i] = []byte(fmt.Sprintf("value-%d", i))
+		}
+		if err := writer.Add([]byte(fmt.Sprintf("key-%03d", i)), want[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	seed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clean.Close()
+	// 第三个数据块包含key-008到key-011
+	block := clean.Index()[2]
+	blockStart, blockEnd := clean.dataOffset+block.Offset, clean.dataOffset+block.Offset+block.Length
+	inBlock := func(i int) bool { return i >= 8 && i <= 11 }
+
+	for _, tt := range []struct {
+		name     string
+		corrupt  func(data []byte) []byte
+		getFails func(i int) bool // Get返回错误的key，读入缓存时校验整个数据块，同一数据块中的key都返回错误
+		scanFail bool             // ScanEntry对所有key返回错误
+		degraded int64            // 无法加载的过滤器数
+	}{
+		{"clean", func(data []byte) []byte { return data }, func(int) bool { return false }, false, 0},
+		{"missing filter", func(data []byte) []byte {
+			// 第一个过滤器无法加载，对应的数据块没有过滤器
+			copy(data[clean.filterOffset+12:], make([]byte, 8))
+			return data
+		}, func(int) bool { return false }, false, 1},
+		{"corrupt block", func(data []byte) []byte {
+			copy(data[blockStart:blockEnd], bytes.Repeat([]byte{0xff}, int(block.Length)))
+			return data
+		}, inBlock, true, 0},
+		{"checksum mismatch", func(data []byte) []byte {
+			pos := bytes.Index(data[blockStart:blockEnd], []byte("value-9"))
+			data[blockStart+int64(pos)+6] ^= 1
+			return data
+		}, inBlock, true, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(conf.DataDir, strings.ReplaceAll(tt.name, " ", "-")+".sst")
+			if err := os.WriteFile(path, tt.corrupt(bytes.Clone(seed)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			for _, open := range []func(*config.Config, string) (*SSTReader, error){NewSSTReader, NewLazySSTReader} {
+				reader, err := open(conf, path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, value := range want {
+					key := []byte(fmt.Sprintf("key-%03d", i))
+					got, err := reader.Get(key)
+					if tt.getFails(i) {
+						if !errors.Is(err, myerror.ErrInvalidSSTFormat) && !errors.Is(err, myerror.ErrSSTCorrupted) {
+							t.Fatalf("Get(%s) = %q, %v, want a corruption error", key, got, err)
+						}
+					} else if err != nil || (got == nil) != (value == nil) || !bytes.Equal(got, value) {
+						t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, value)
+					}
+
+					found, err := reader.ScanEntry(key)
+					if tt.scanFail {
+						if !errors.Is(err, myerror.ErrInvalidSSTFormat) && !errors.Is(err, myerror.ErrSSTCorrupted) {
+							t.Fatalf("ScanEntry(%s) = %v, %v, want a corruption error", key, found, err)
+						}
+					} else if err != nil || found.IsDelete() != (value == nil) || !bytes.Equal(found.Value, value) {
+						t.Fatalf("ScanEntry(%s) = %v, %v, want %q", key, found, err, value)
+					}
+				}
+				missing := []byte("key-040")
+				if _, err := reader.Get(missing); !errors.Is(err, myerror.ErrKeyNotFound) {
+					t.Fatalf("Get(%s) = %v, want ErrKeyNotFound", missing, err)
+				}
+				if _, err := reader.ScanEntry(missing); !tt.scanFail && !errors.Is(err, myerror.ErrKeyNotFound) {
+					t.Fatalf("ScanEntry(%s) = %v, want ErrKeyNotFound", missing, err)
+				}
+				if reader.DegradedFilters() != tt.degraded {
+					t.Fatalf("DegradedFilters = %d, want %d", reader.DegradedFilters(), tt.degraded)
+				}
+				reader.Close()
+			}
+		})
+	}
+}
+
+// rejectAllFilter 判定所有key都不存在的过滤器
+type rejectAllFilter struct{}
+
+func (rejectAllFilter) Add(key []byte)           {}
+func (rejectAllFilter) Contains(key []byte) bool { return false }
+func (rejectAllFilter) Save() []byte             { return nil }
+func (rejectAllFilter) Load(data []byte) error   { return nil }
+func (rejectAllFilter) Reset()                   {}
+func (rejectAllFilter) SizeBytes() int           { return 0 }
+
+func TestSSTReaderBlockHandles(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockEntryLimit = 3
+	conf.MinKeysPerFilter = 2 // 只有一个条目的尾块不写过滤器
+	path := filepath.Join(conf.DataDir, "handles.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		if err := writer.Add([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	handles := reader.BlockHandles()
+	want := []struct {
+		first, last string
+		hasFilter   bool
+	}{{"a", "c", true}, {"d", "f", true}, {"g", "g", false}}
+	if len(handles) != len(want) {
+		t.Fatalf("got %d block handles, want %d", len(handles), len(want))
+	}
+	offset := int64(0)
+	for i, h := range handles {
+		w := want[i]
+		if string(h.FirstKey) != w.first || string(h.LastKey) != w.last || h.HasFilter != w.hasFilter {
+			t.Errorf("block %d: keys %s-%s filter %v, want %s-%s filter %v", i, h.FirstKey, h.LastKey, h.HasFilter, w.first, w.last, w.hasFilter)
+		}
+		// 数据块在数据区中依次排列
+		if h.Offset != offset || h.Length <= 0 {
+			t.Errorf("block %d at offset %d length %d, want offset %d", i, h.Offset, h.Length, offset)
+		}
+		offset += h.Length
+	}
+	if offset != int64(reader.dataLength) {
+		t.Errorf("blocks cover %d bytes, data section has %d", offset, reader.dataLength)
+	}
+
+	// 返回的key是复制出来的，修改后不影响读取
+	handles[0].FirstKey[0] = 'z'
+	if value, err := reader.Get([]byte("a")); err != nil || string(value) != "value-a" {
+		t.Fatalf("Get(a) = %q, %v after modifying block handles", value, err)
+	}
+	if first := reader.BlockHandles()[0].FirstKey; string(first) != "a" {
+		t.Fatalf("FirstKey = %q after modifying block handles", first)
+	}
+}
+
+// filteredBlocks 返回带过滤器的数据块数
+func filteredBlocks(handles []BlockHandle) int {
+	n := 0
+	for _, handle := range handles {
+		if handle.HasFilter {
+			n++
+		}
+	}
+	return n
+}
+
+// 修改查找返回的key和value不影响之后的读取，UnsafeSharedValue时返回共享的value
+func TestSSTReaderValueOwnership(t *testing.T) {
+	for _, blockCache := range []bool{false, true} {
+		t.Run(fmt.Sprintf("blockCache=%v", blockCache), func(t *testing.T) {
+			conf := testConfig()
+			conf.DataDir = t.TempDir()
+			conf.BlockEntryLimit = 2
+			if blockCache {
+				conf.BlockCacheSize = 1 << 20
+			}
+			path := filepath.Join(conf.DataDir, "owned.sst")
+			writer, err := NewSSTWriter(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys := []string{"a", "b", "c", "d", "e"}
+			for _, key := range keys {
+				if err := writer.Add([]byte(key), []byte("value-"+key)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			writer.Close()
+			reader, err := NewSSTReader(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+
+			check := func(step string) {
+				t.Helper()
+				for _, key := range keys {
+					if value, err := reader.Get([]byte(key)); err != nil || string(value) != "value-"+key {
+						t.Fatalf("after %s: Get(%s) = %q, %v", step, key, value, err)
+					}
+				}
+			}
+			mutate := func(b []byte) {
+				for i := range b {
+					b[i] = 'X'
+				}
+			}
+
+			value, _ := reader.Get([]byte("b"))
+			mutate(value)
+			_ = append(value[:1], "YYYYYYYYYYYYYYYYYYYYYYYYYYYYYYYY"...)
+			check("Get")
+			entry, _ := reader.GetEntry([]byte("c"), nil)
+			mutate(entry.Key)
+			mutate(entry.Value)
+			check("GetEntry")
+			values, _ := reader.MultiGet([][]byte{[]byte("a"), []byte("d")})
+			for _, v := range values {
+				mutate(v)
+			}
+			check("MultiGet")
+			reader.PrefixScan([]byte("e"), func(key, value []byte) bool {
+				mutate(key)
+				mutate(value)
+				return true
+			})
+			check("PrefixScan")
+			for _, kv := range reader.KvList() {
+				mutate(kv.Key)
+				mutate(kv.Value)
+			}
+			check("KvList")
+
+			// 不使用映射时两次读取返回同一份共享的value
+			opts := config.DefaultReadOptions()
+			opts.UnsafeSharedValue = true
+			first, err := reader.GetWithOptions([]byte("a"), opts)
+			if err != nil || string(first) != "value-a" {
+				t.Fatalf("GetWithOptions(a) = %q, %v", first, err)
+			}
+			second, _ := reader.GetWithOptions([]byte("a"), opts)
+			if shared := &first[0] == &second[0]; shared == reader.Mapped() {
+				t.Fatalf("shared value = %v with mapped = %v", shared, reader.Mapped())
+			}
+		})
+	}
+}
+
+// 修改或追加迭代器返回的key和value不影响之后的条目
+func TestSSTIteratorValueOwnership(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	path := filepath.Join(conf.DataDir, "iter.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		if err := writer.Add([]byte(key), []byte("value-"+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	it, err := reader.GetIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for it.Next() {
+		got = append(got, string(it.Key())+"="+string(it.Value()))
+		_ = append(it.Key(), "XXXXXXXXXXXXXXXX"...)
+		_ = append(it.Value(), "XXXXXXXXXXXXXXXX"...)
+		it.Value()[0] = 'X'
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if want := "a=value-a b=value-b c=value-c d=value-d"; strings.Join(got, " ") != want {
+		t.Fatalf("iterated %q, want %q", strings.Join(got, " "), want)
+	}
+	for _, key := range keys {
+		if value, err := reader.Get([]byte(key)); err != nil || string(value) != "value-"+key {
+			t.Fatalf("Get(%s) = %q, %v after mutating iterator values", key, value, err)
+		}
+	}
+}
+
+// 复用缓冲区的迭代器返回与GetIterator相同的条目：Entry、Key和Value返回副本，
+// EntryUnsafe返回的条目在下一次Next之后仍然有效，之后才会被覆盖
+func TestSSTReusingIterator(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 4
+	path := filepath.Join(conf.DataDir, "reuse.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key%02d", i)), bytes.Repeat([]byte{byte('a' + i%26)}, 10+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	it, err := reader.GetIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []kv.Entry
+	for it.Next() {
+		want = append(want, it.Entry())
+	}
+	if err := it.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保留Entry的副本，同时检查上一个EntryUnsafe在前进一次之后仍未被覆盖
+	reusing, err := reader.GetReusingIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []kv.Entry
+	var prev kv.Entry
+	for i := 0; reusing.Next(); i++ {
+		if i > 0 && (!bytes.Equal(prev.Key, want[i-1].Key) || !bytes.Equal(prev.Value, want[i-1].Value)) {
+			t.Fatalf("unsafe entry %d = %s=%s after Next, want %s=%s", i-1, prev.Key, prev.Value, want[i-1].Key, want[i-1].Value)
+		}
+		if !bytes.Equal(reusing.KeyUnsafe(), reusing.Key()) || !bytes.Equal(reusing.ValueUnsafe(), reusing.Value()) {
+			t.Fatalf("entry %d: unsafe and copied key/value differ", i)
+		}
+		got = append(got, reusing.Entry())
+		prev = reusing.EntryUnsafe()
+	}
+	if err := reusing.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("reusing iterator returned %d entries, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i].Key, want[i].Key) || !bytes.Equal(got[i].Value, want[i].Value) || got[i].Kind != want[i].Kind {
+			t.Fatalf("entry %d = %s=%s, want %s=%s", i, got[i].Key, got[i].Value, want[i].Key, want[i].Value)
+		}
+	}
+}
+
+// 延迟打开的读取器被并发地第一次访问时只解析一次，解析失败的错误返回给所有等待的读取
+func TestSSTReaderConcurrentLazyLoad(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockCacheSize = 1 << 20
+	conf.BlockEntryLimit = 8
+	path := writeCacheSST(t, conf, 200)
+
+	for _, corrupt := range []bool{false, true} {
+		reader, err := NewLazySSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+		if corrupt {
+			// 打开时只读取了元数据，索引区在第一次访问时才解析
+			fp, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fp.WriteAt(bytes.Repeat([]byte{0xFF}, int(reader.indexLength)), reader.indexOffset); err != nil {
+				t.Fatal(err)
+			}
+			fp.Close()
+		}
+
+		errs := make([]error, 32)
+		var wg sync.WaitGroup
+		for g := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				value, err := reader.Get(cacheKey(g * 5))
+				if err == nil && len(value) != 40 {
+					err = fmt.Errorf("value length %d", len(value))
+				}
+				errs[g] = err
+			}()
+		}
+		wg.Wait()
+		for g, err := range errs {
+			if !corrupt && err != nil {
+				t.Fatalf("goroutine %d: %v", g, err)
+			}
+			if corrupt && (!errors.Is(err, myerror.ErrInvalidSSTFormat) || err != errs[0]) {
+				t.Fatalf("goroutine %d: got %v, want the cached parse error %v", g, err, errs[0])
+			}
+		}
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Close在持有的引用都释放后才关闭文件，之后的读取返回ErrReaderClosed，重复Close返回nil
+func TestSSTReaderCloseWaitsForReads(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.IsDebug = false
+	conf.BlockCacheSize = 1 << 20
+	path := writeCacheSST(t, conf, 100)
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reader.Acquire() {
+		t.Fatal("Acquire on open reader failed")
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("second Close = %v, want nil", err)
+	}
+	// 持有引用期间文件仍然打开
+	if value, err := reader.Get(cacheKey(1)); err != nil || len(value) != 40 {
+		t.Fatalf("Get while referenced = %q, %v", value, err)
+	}
+	reader.Release()
+	if _, err := reader.Get(cacheKey(1)); !errors.Is(err, myerror.ErrReaderClosed) || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("Get after Close = %v, want ErrReaderClosed", err)
+	}
+	buf := make([]byte, 12)
+	if _, err := reader.fp.ReadAt(buf, reader.fileSize-12); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("read after last release = %v, want os.ErrClosed", err)
+	}
+}
+
+// 32个goroutine并发查找的同时另一个goroutine反复Reopen节点，关闭的读取器对查找不可见
+func TestNodeReopenRace(t *testing.T) {
+	const keys = 300
+	for _, mode := range []struct {
+		name string
+		lazy bool
+		mmap bool
+	}{{"pread", false, false}, {"lazy", true, false}, {"mmap", false, true}} {
+		t.Run(mode.name, func(t *testing.T) {
+			conf := config.DefaultConfig()
+			conf.IsDebug = false
+			conf.BlockCacheSize = 1 << 20
+			conf.BlockEntryLimit = 16
+			if mode.mmap {
+				conf.SSTReadMode = config.SSTReadMmap
+			}
+			path := writeCacheSST(t, conf, keys)
+			open := NewSSTReader
+			if mode.lazy {
+				open = NewLazySSTReader
+			}
+			reader, err := open(conf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader.AttachBlockCache(NewBlockCache(conf.BlockCacheSize))
+			reader.AttachBudget(NewIndexBudget(1 << 20))
+			node, err := NewNode(conf, path, 0, 1, reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var done atomic.Bool
+			var failures atomic.Int64
+			var wg sync.WaitGroup
+			for g := 0; g < 32; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; !done.Load(); i++ {
+						key := (g*31 + i) % keys
+						value, err := node.Get(cacheKey(key))
+						if err != nil || len(value) != 40 {
+							if failures.Add(1) == 1 {
+								t.Errorf("Get(%s) = %d bytes, %v", cacheKey(key), len(value), err)
+							}
+						}
+						if i%10 == 0 {
+							n := 0
+							node.ScanRange(keyutil.PrefixRange([]byte("key-0010")), func(_, _ []byte) bool {
+								n++
+								return true
+							})
+							if n != 10 && failures.Add(1) == 1 {
+								t.Errorf("ScanRange returned %d keys, want 10", n)
+							}
+						}
+					}
+				}()
+			}
+			for i := 0; i < 200; i++ {
+				if err := node.Reopen(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			done.Store(true)
+			wg.Wait()
+			if failures.Load() != 0 {
+				t.Fatalf("%d user-visible failures", failures.Load())
+			}
+			if err := node.Reader().Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
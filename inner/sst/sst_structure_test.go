@@ -10,9 +10,9 @@ import (
 	"path/filepath"
 	"sort"
 	"testing"
-	"time"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 )
 
@@ -26,14 +26,14 @@ func TestSSTFileStructureAndData(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// 创建配置
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 20 // 减小块大小，降低数据量
+	conf.BlockEntryLimit = 20 // 减小块大小，降低数据量
 
-	// 生成随机种子确保可重现
-	seed := time.Now().UnixNano()
-	// 创建独立的随机源
-	rng := rand.New(rand.NewSource(seed))
+	// 使用固定种子确保可重现
+	const seed = 1608
+	conf.RandSource = rand.NewSource(seed)
+	rng := conf.NewRand()
 	t.Logf("Using random seed: %d", seed)
 
 	// 创建测试SST文件
@@ -102,47 +102,15 @@ func writeTestData(t *testing.T, conf *config.Config, filePath string, data map[
 	}
 	sort.Strings(keys)
 
-	// 跟踪各块偏移量
-	dataOffsets = make([]int64, 0)
-	indexOffsets = make([]int64, 0)
-	filterOffsets = make([]int64, 0)
-
-	// 写入数据并在适当位置强制块旋转
+	// 写入数据，数据块按BlockEntryLimit切换
 	blockCount := 0
-	itemsInBlock := 0 // 跟踪当前块中的项目数
-	for i, key := range keys {
+	for _, key := range keys {
 		if err := writer.Add([]byte(key), []byte(data[key])); err != nil {
 			return nil, nil, nil, fmt.Errorf("failed to add data: %v", err)
 		}
-
-		itemsInBlock++
-
-		// 每处理一定数量的项目就旋转块
-		if (int64(itemsInBlock) >= conf.BlockSize) || i == len(keys)-1 {
-			// 在旋转前记录当前块信息
-			if len(writer.index) > 0 {
-				lastIdx := writer.index[len(writer.index)-1]
-				dataOffsets = append(dataOffsets, lastIdx.Offset)
-				indexOffsets = append(indexOffsets, int64(len(writer.index)-1))
-			}
-
-			blockLength := writer.dataBlock.Length()
-			t.Logf("Block %d contains %d items with %d bytes", blockCount+1, itemsInBlock, blockLength)
-
-			if err := writer.mustRotateDataBlock(); err != nil {
-				return nil, nil, nil, fmt.Errorf("failed to rotate block: %v", err)
-			}
-
-			// 收集过滤器信息
-			for bLength := range writer.mapFilter {
-				if !contains(filterOffsets, bLength) {
-					filterOffsets = append(filterOffsets, bLength)
-				}
-			}
-
-			blockCount++
-			t.Logf("Rotated block %d with %d bytes of data", blockCount, blockLength)
-			itemsInBlock = 0 // 重置块项目计数
+		if stats := writer.PendingStats(); stats.BlocksWritten > blockCount {
+			blockCount = stats.BlocksWritten
+			t.Logf("Rotated block %d, %d bytes buffered", blockCount, stats.BufferedBytes)
 		}
 	}
 
@@ -150,7 +118,28 @@ func writeTestData(t *testing.T, conf *config.Config, filePath string, data map[
 	if err := writer.Flush(); err != nil {
 		return nil, nil, nil, fmt.Errorf("failed to flush data: %v", err)
 	}
+	stats := writer.PendingStats()
+	if stats.BufferedBytes != 0 || stats.CurrentBlockEntries != 0 {
+		return nil, nil, nil, fmt.Errorf("pending stats after flush: %+v", stats)
+	}
 
+	// 从写入的文件中读取各块的偏移量
+	reader, err := NewSSTReader(conf, filePath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to open written file: %v", err)
+	}
+	defer reader.Close()
+	handles := reader.BlockHandles()
+	if len(handles) != stats.BlocksWritten {
+		return nil, nil, nil, fmt.Errorf("file has %d blocks, writer wrote %d", len(handles), stats.BlocksWritten)
+	}
+	for i, handle := range handles {
+		dataOffsets = append(dataOffsets, handle.Offset)
+		indexOffsets = append(indexOffsets, int64(i))
+		if handle.HasFilter {
+			filterOffsets = append(filterOffsets, handle.Offset)
+		}
+	}
 	return dataOffsets, indexOffsets, filterOffsets, nil
 }
 
@@ -199,11 +188,23 @@ func analyzeAndVerifySST(t *testing.T, filePath string, data map[string]string,
 	t.Logf("  Index Section: %d bytes", indexLength)
 	t.Logf("  Filter Section: %d bytes", filterLength)
 
-	// 验证文件大小
-	if int64(dataLength+indexLength+filterLength+12) != fileSize {
+	// 验证文件大小，过滤器区与footer之间为元数据区
+	metaLength := fileSize - int64(dataLength+indexLength+filterLength+12)
+	if metaLength < 0 {
 		t.Errorf("File size mismatch: calculated=%d, actual=%d",
 			dataLength+indexLength+filterLength+12, fileSize)
 	}
+	metaSection := make([]byte, metaLength)
+	if _, err := file.ReadAt(metaSection, int64(dataLength+indexLength+filterLength)); err != nil {
+		t.Fatalf("Failed to read meta section: %v", err)
+	}
+	meta, err := decodeMeta(metaSection)
+	if err != nil {
+		t.Fatalf("Failed to decode meta section: %v", err)
+	}
+	if props := decodeProperties(meta); props.Entries != int64(len(data)) {
+		t.Errorf("Properties entries=%d, want %d", props.Entries, len(data))
+	}
 
 	// 读取各部分数据
 	dataSection := make([]byte, dataLength)
@@ -228,6 +229,24 @@ func analyzeAndVerifySST(t *testing.T, filePath string, data map[string]string,
 	// 解析过滤器数据
 	filters := parseFilterSection(t, filterSection)
 	t.Logf("Parsed %d bloom filters", len(filters))
+	if len(filters) != len(indexEntries) {
+		t.Errorf("Expected one filter per block, got %d filters for %d blocks", len(filters), len(indexEntries))
+	}
+	if len(indexEntries) != len(dataOffsets) || len(filters) != len(filterOffsets) {
+		t.Errorf("Parsed %d blocks and %d filters, block handles report %d and %d",
+			len(indexEntries), len(filters), len(dataOffsets), len(filterOffsets))
+	}
+	for i, idx := range indexEntries {
+		if _, ok := filters[idx.Offset]; !ok {
+			t.Errorf("Missing filter for block at offset %d", idx.Offset)
+		}
+		if i < len(dataOffsets) && dataOffsets[i] != idx.Offset {
+			t.Errorf("Block %d at offset %d, block handle reports %d", i, idx.Offset, dataOffsets[i])
+		}
+		if !contains(filterOffsets, idx.Offset) {
+			t.Errorf("Block handle at offset %d reports no filter", idx.Offset)
+		}
+	}
 
 	// 验证数据区的内容与写入的匹配
 	verifyDataSection(t, dataSection, indexEntries, data)
@@ -235,57 +254,10 @@ func analyzeAndVerifySST(t *testing.T, filePath string, data map[string]string,
 
 // 解析索引区，返回索引条目
 func parseIndexSection(t *testing.T, indexData []byte) []*Index {
-	entries := make([]*Index, 0)
-	buf := bytes.NewReader(indexData)
-
-	for buf.Len() > 0 {
-		// 读取startKey长度
-		var startKeyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &startKeyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			t.Fatalf("Failed to read startKeyLen: %v", err)
-		}
-
-		// 读取endKey长度
-		var endKeyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &endKeyLen); err != nil {
-			t.Fatalf("Failed to read endKeyLen: %v", err)
-		}
-
-		// 读取startKey
-		startKey := make([]byte, startKeyLen)
-		if _, err := buf.Read(startKey); err != nil {
-			t.Fatalf("Failed to read startKey: %v", err)
-		}
-
-		// 读取endKey
-		endKey := make([]byte, endKeyLen)
-		if _, err := buf.Read(endKey); err != nil {
-			t.Fatalf("Failed to read endKey: %v", err)
-		}
-
-		// 读取偏移量和长度
-		var offset, length int64
-		if err := binary.Read(buf, binary.BigEndian, &offset); err != nil {
-			t.Fatalf("Failed to read offset: %v", err)
-		}
-		if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
-			t.Fatalf("Failed to read length: %v", err)
-		}
-
-		// 创建索引对象
-		index := &Index{
-			StartKey: startKey,
-			EndKey:   endKey,
-			Offset:   offset,
-			Length:   length,
-		}
-
-		entries = append(entries, index)
+	entries, err := DecodeIndexes(indexData)
+	if err != nil {
+		t.Fatalf("Failed to decode index section: %v", err)
 	}
-
 	return entries
 }
 
@@ -295,13 +267,13 @@ func parseFilterSection(t *testing.T, filterData []byte) map[int64][]byte {
 	buf := bytes.NewReader(filterData)
 
 	for buf.Len() > 0 {
-		// 读取blockLength
-		var blockLength int64
-		if err := binary.Read(buf, binary.BigEndian, &blockLength); err != nil {
+		// 读取blockOffset
+		var blockOffset int64
+		if err := binary.Read(buf, binary.BigEndian, &blockOffset); err != nil {
 			if err == io.EOF {
 				break
 			}
-			t.Fatalf("Failed to read blockLength: %v", err)
+			t.Fatalf("Failed to read blockOffset: %v", err)
 		}
 
 		// 读取过滤器数据长度
@@ -316,7 +288,7 @@ func parseFilterSection(t *testing.T, filterData []byte) map[int64][]byte {
 			t.Fatalf("Failed to read filter data: %v", err)
 		}
 
-		filters[blockLength] = filterBytes
+		filters[blockOffset] = filterBytes
 	}
 
 	return filters
@@ -368,47 +340,23 @@ func verifyDataSection(t *testing.T, dataSection []byte, indexes []*Index, origi
 
 // 验证数据块的内容
 func verifyBlock(t *testing.T, blockData []byte, originalData map[string]string, startKey, endKey []byte) {
-	buf := bytes.NewReader(blockData)
 	keyCount := 0
 	keyMismatchCount := 0
 
-	// 遍历块中的所有键值对
-	for buf.Len() > 0 {
-		// 读取key长度
-		var keyLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &keyLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			t.Fatalf("Failed to read key length: %v", err)
-		}
-
-		// 读取value长度
-		var valueLen uint32
-		if err := binary.Read(buf, binary.BigEndian, &valueLen); err != nil {
-			if err == io.EOF {
-				break
-			}
-			t.Fatalf("Failed to read value length: %v", err)
+	// 遍历块中的所有键值对，只有恰好在条目边界结束才返回io.EOF，截断的条目返回错误
+	for data := blockData; ; {
+		entry, n, err := decodeEntry(data, BlockFormat)
+		if err == io.EOF {
+			break
 		}
-
-		// 读取key
-		key := make([]byte, keyLen)
-		if _, err := io.ReadFull(buf, key); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			}
-			t.Fatalf("Failed to read key: %v", err)
+		if err != nil {
+			t.Fatalf("Failed to decode entry at offset %d: %v", len(blockData)-len(data), err)
 		}
-
-		// 读取value
-		value := make([]byte, valueLen)
-		if _, err := io.ReadFull(buf, value); err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			}
-			t.Fatalf("Failed to read value: %v", err)
+		data = data[n:]
+		if entry.Kind != kv.KindPut || entry.Timestamp != 0 || entry.Seq != 0 || entry.TTL != 0 || entry.hasCrc {
+			t.Errorf("Unexpected entry %+v", entry.Entry)
 		}
+		key, value := entry.Key, entry.Value
 
 		// 只记录不匹配的数据，减少日志量
 		expectedValue, exists := originalData[string(key)]
@@ -452,9 +400,10 @@ func verifyDataWithSSTReader(t *testing.T, conf *config.Config, filePath string,
 	}
 	defer reader.Close()
 
-	// 验证Reader字段
-	t.Logf("SSTReader loaded with %d index entries", len(reader.index))
-	t.Logf("SSTReader loaded with %d bloom filters", len(reader.filterMap))
+	// 验证Reader的数据块
+	handles := reader.BlockHandles()
+	t.Logf("SSTReader loaded with %d index entries", len(handles))
+	t.Logf("SSTReader loaded with %d bloom filters", filteredBlocks(handles))
 
 	// 排序键以便有序检查
 	keys := make([]string, 0, len(data))
@@ -1,33 +1,72 @@
 package sst
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/aixiasang/lsm/inner/config"
 	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/fsio"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/ratelimit"
+)
+
+const (
+	streamEntrySize = 1 << 20   // 编码后不小于该大小的条目直接写入文件，不经过数据缓冲区
+	streamChunkSize = 1 << 20   // 直接写入大条目时每次写入的字节数
+	writeBufferSize = 256 << 10 // 写入文件的缓冲区大小，数据块切换时写入缓冲区，缓冲区满时写入文件
 )
 
 type SSTWriter struct {
-	conf           *config.Config   // 配置
-	filename       string           // 文件名
-	sstWriter      *os.File         // 写入的文件
-	dataBuf        *bytes.Buffer    // 数据缓冲区
-	indexBuf       *bytes.Buffer    // 索引缓冲区
-	filterBuf      *bytes.Buffer    // 过滤器缓冲区
-	dataBlock      *Block           // 数据块
-	filterBlock    *Block           // 过滤器块
-	indexBlock     *Block           // 索引块
-	filter         filter.Filter    // 过滤器
-	mapFilter      map[int64][]byte // 映射过滤器
-	curBlockLength int64            // 当前数据块的长度
-	curBlockOffset int64            // 当前数据块的偏移量
-	index          []*Index         // 索引
+	conf           *config.Config     // 配置
+	filename       string             // 文件名
+	sstWriter      *os.File           // 写入的文件
+	out            *bufio.Writer      // 写入文件的缓冲区，第一次写入时创建
+	dataWritten    int64              // 已写入out的数据区字节数，即下一个数据块的偏移量
+	dataBlock      *Block             // 数据块
+	filterBlock    *Block             // 过滤器块
+	indexBlock     *Block             // 索引块
+	filter         filter.Filter      // 过滤器，FilterPolicy为filter.NameNone时为nil
+	filterName     string             // 写入元数据的过滤器名称，为空时不写入
+	mapFilter      map[int64][]byte   // 映射过滤器 key=blockOffset，只用于检查，不参与编码
+	filterCapped   bool               // 过滤器区已达到MaxFilterBytesPerFile
+	curBlockLength int64              // 当前数据块的长度
+	curBlockOffset int64              // 当前数据块的偏移量
+	index          []*Index           // 索引
+	props          Properties         // 文件属性
+	blockSizes     blockSizeHistogram // 已写入的数据块大小分布
+	limiter        *ratelimit.Limiter // 写入文件时的限速器，为nil时不限速
+	lastKey        []byte             // 上一个写入的key
+	allowDup       bool               // 是否允许相邻的重复key
+	sourceWals     []uint32           // 刷盘时内存表的WAL id，从旧到新，为空表示不是刷盘生成的文件
+	prefixCounts   []uint64           // 按KeySchema统计的各级前缀的不同取值数，没有设置KeySchema时为nil
+	statsMu        sync.Mutex         // 保护stats
+	stats          WriterStats        // PendingStats返回的快照，每次添加条目和Flush后更新
+}
+
+// WriterStats 写入器尚未写入文件的状态
+type WriterStats struct {
+	BlocksWritten       int   // 已写满并加入索引的数据块数
+	BufferedBytes       int64 // 缓冲在内存中、尚未写入文件的数据字节数，包括正在写入的数据块
+	CurrentBlockEntries int   // 正在写入的数据块中的条目数
 }
 
 func NewSSTWriter(conf *config.Config, filename string) (*SSTWriter, error) {
-	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	blockFilter, filterName, err := newWriterFilter(conf)
+	if err != nil {
+		return nil, err
+	}
+	// 偏移量由写入器从0开始计算，使用可定位的句柄并清空已存在的文件，追加写入会使索引中的偏移量与文件内容不符
+	fp, err := fsio.Create(filename, fsio.Positional)
 	if err != nil {
 		return nil, err
 	}
@@ -35,10 +74,8 @@ func NewSSTWriter(conf *config.Config, filename string) (*SSTWriter, error) {
 		conf:           conf,
 		filename:       filename,
 		sstWriter:      fp,
-		filter:         conf.FilterConstructor(1024, 3),
-		dataBuf:        bytes.NewBuffer(nil),
-		indexBuf:       bytes.NewBuffer(nil),
-		filterBuf:      bytes.NewBuffer(nil),
+		filter:         blockFilter,
+		filterName:     filterName,
 		dataBlock:      NewBlock(conf),
 		filterBlock:    NewBlock(conf),
 		indexBlock:     NewBlock(conf),
@@ -46,120 +83,514 @@ func NewSSTWriter(conf *config.Config, filename string) (*SSTWriter, error) {
 		curBlockLength: 0,
 		curBlockOffset: 0,
 		index:          make([]*Index, 0),
+		blockSizes:     make(blockSizeHistogram),
 	}, nil
 }
+
+// SetTargetLevel 设置文件将要写入的层级，需在添加条目之前调用。开启SkipFilterOnBottomLevel且level为最底层(LevelSize-1)时
+// 不写入过滤器：到达最底层的点查通常能找到key，过滤器很少能省去数据块读取。L0的文件范围互相重叠，总是写入过滤器
+func (s *SSTWriter) SetTargetLevel(level int) {
+	if s.conf.SkipFilterOnBottomLevel && level > 0 && level == s.conf.LevelSize-1 {
+		s.filter, s.filterName = nil, filter.NameNone
+	}
+}
+
+// newWriterFilter 按FilterPolicy创建数据块过滤器，FilterPolicy为空时使用FilterConstructor且不记录名称，
+// 此时FilterConstructor为nil或返回nil返回包装了ErrInvalidConfig的错误
+func newWriterFilter(conf *config.Config) (filter.Filter, string, error) {
+	switch conf.FilterPolicy {
+	case "":
+		if conf.FilterConstructor == nil {
+			return nil, "", fmt.Errorf("sst: %w: FilterConstructor is nil and FilterPolicy is empty", myerror.ErrInvalidConfig)
+		}
+		f := conf.FilterConstructor(1024, 3)
+		if f == nil {
+			return nil, "", fmt.Errorf("sst: %w: FilterConstructor returned nil", myerror.ErrInvalidConfig)
+		}
+		return f, "", nil
+	case filter.NameNone:
+		return nil, filter.NameNone, nil
+	}
+	ctor, ok := filter.Lookup(conf.FilterPolicy)
+	if !ok {
+		return nil, "", fmt.Errorf("sst: %w: %q", myerror.ErrUnknownFilter, conf.FilterPolicy)
+	}
+	return ctor(1024, 3), conf.FilterPolicy, nil
+}
+
 func (s *SSTWriter) mustRotateDataBlock() error {
 	// 当前数据块的长度
 	currBlockLength := s.dataBlock.Length()
 	if currBlockLength == 0 {
 		return nil
 	}
-	// 将过滤器数据进行存储
-	currFilter := s.filter.Save()
-	s.mapFilter[currBlockLength] = currFilter
-	// filterblock 添加到过滤器块
-	if err := s.filterBlock.FilterAdd(currBlockLength, currFilter); err != nil {
+	// Flush会清空数据块，需要在写入任何内容之前记录首尾key、条目数和长度，索引只由这些值构造
+	firstKey := s.dataBlock.FirstKey()
+	lastKey := s.dataBlock.LastKey()
+	entryCount := s.dataBlock.EntriesCnt()
+	if err := checkBlockIndex(firstKey, lastKey, currBlockLength, entryCount); err != nil {
+		return err
+	}
+	// 数据块在数据区中的偏移量即写入前数据区的长度
+	s.curBlockOffset = s.dataSize()
+	if err := s.addFilter(int64(entryCount)); err != nil {
 		return err
 	}
 
-	s.filter.Reset()
-
-	prevLength, err := s.dataBlock.Flush(s.dataBuf)
+	// 数据块直接写入文件缓冲区，边写边计算校验和
+	crc := crc32.NewIEEE()
+	written, err := s.dataBlock.Flush(io.MultiWriter(s.output(), crc))
 	if err != nil {
 		return err
 	}
-	s.curBlockLength = currBlockLength
-	s.curBlockOffset = prevLength - currBlockLength
-
-	currIndex := &Index{
-		StartKey: s.dataBlock.FirstKey(),
-		EndKey:   s.dataBlock.LastKey(),
-		Offset:   s.curBlockOffset,
-		Length:   s.curBlockLength,
+	if written != currBlockLength {
+		return fmt.Errorf("sst: %w: wrote %d of %d block bytes", myerror.ErrInvalidIndex, written, currBlockLength)
 	}
+	s.dataWritten += written
+	return s.addBlockIndex(&Index{
+		StartKey:    firstKey,
+		EndKey:      lastKey,
+		Offset:      s.curBlockOffset,
+		Length:      currBlockLength,
+		EntryCount:  entryCount,
+		CRC:         crc.Sum32(),
+		Compression: CompressionNone,
+	})
+}
+
+// addBlockIndex 记录已写入数据区的数据块的索引
+func (s *SSTWriter) addBlockIndex(currIndex *Index) error {
+	s.curBlockLength = currIndex.Length
 	s.index = append(s.index, currIndex)
+	s.blockSizes.add(currIndex.Length)
 	// indexblock 添加到索引块
 	if err := s.indexBlock.IndexAdd(currIndex); err != nil {
 		return err
 	}
-	// 将数据块写入到数据缓冲区
-	if _, err := s.dataBuf.Write(s.dataBlock.Bytes()); err != nil {
+	s.updateStats(s.bufferedBytes(), 0)
+	return nil
+}
+
+// streamEntry 将单个大条目作为一个数据块直接写入文件：按streamChunkSize分段写入条目，边写边计算数据块的校验和。
+// 条目不经过数据块，文件缓冲区为空时分段直接写入文件，除调用方持有的value外不产生任何副本
+func (s *SSTWriter) streamEntry(entry kv.Entry) error {
+	out := s.output()
+	s.curBlockOffset = s.dataWritten
+	if err := s.addFilter(1); err != nil {
 		return err
 	}
+
+	checksum := s.conf.PerEntryChecksum
+	length := entrySize(entry, checksum)
+	crc := crc32.NewIEEE()
+	w := io.MultiWriter(out, crc)
+	parts := [][]byte{appendEntryHeader(nil, entry, checksum), entry.Key, entry.Value}
+	if checksum {
+		parts = append(parts, binary.BigEndian.AppendUint32(nil, entryChecksum(entry.Key, entry.Value)))
+	}
+	var written int64
+	for _, part := range parts {
+		for len(part) > 0 {
+			chunk := part[:min(len(part), streamChunkSize)]
+			n, err := w.Write(chunk)
+			written += int64(n)
+			if err != nil {
+				return err
+			}
+			part = part[len(chunk):]
+		}
+	}
+	if written != length {
+		return fmt.Errorf("sst: %w: wrote %d of %d block bytes", myerror.ErrInvalidIndex, written, length)
+	}
+	s.dataWritten += length
+	return s.addBlockIndex(&Index{
+		StartKey:    bytes.Clone(entry.Key),
+		EndKey:      bytes.Clone(entry.Key),
+		Offset:      s.curBlockOffset,
+		Length:      length,
+		EntryCount:  1,
+		CRC:         crc.Sum32(),
+		Compression: CompressionNone,
+	})
+}
+
+// checkBlockIndex 检查数据块的索引项，首尾key为nil、首key大于尾key或数据块为空时返回错误，不写入错误的索引
+func checkBlockIndex(firstKey, lastKey []byte, length int64, entryCount uint32) error {
+	switch {
+	case firstKey == nil || lastKey == nil:
+		return fmt.Errorf("sst: %w: block without first or last key", myerror.ErrInvalidIndex)
+	case bytes.Compare(firstKey, lastKey) > 0:
+		return fmt.Errorf("sst: %w: first key %q after last key %q", myerror.ErrInvalidIndex, firstKey, lastKey)
+	case length <= 0 || entryCount == 0:
+		return fmt.Errorf("sst: %w: block of %d bytes with %d entries", myerror.ErrInvalidIndex, length, entryCount)
+	}
 	return nil
 }
+
+// addFilter 为当前数据块写入过滤器，条目数过少或过滤器区超出上限时跳过，读取时视为可能包含
+func (s *SSTWriter) addFilter(entryCount int64) error {
+	if s.filter == nil {
+		return nil
+	}
+	defer s.filter.Reset()
+	if s.filterCapped {
+		s.props.FilterCapped++
+		return nil
+	}
+	if entryCount < s.conf.MinKeysPerFilter {
+		s.props.FilterSkipped++
+		return nil
+	}
+	currFilter := s.filter.Save()
+	// 每个过滤器在过滤器区中还有blockOffset(8)和filterLen(4)的头部
+	if limit := s.conf.MaxFilterBytesPerFile; limit > 0 && s.filterBlock.Length()+12+int64(len(currFilter)) > limit {
+		s.filterCapped = true
+		s.props.FilterCapped++
+		return nil
+	}
+	s.mapFilter[s.curBlockOffset] = currFilter
+	// filterblock 添加到过滤器块
+	return s.filterBlock.FilterAdd(s.curBlockOffset, currFilter)
+}
+
+// tryRotateDataBlock 数据块达到BlockSizeBytes字节或BlockEntryLimit条目时切换新的数据块
 func (s *SSTWriter) tryRotateDataBlock() error {
+	full := s.conf.BlockSizeBytes > 0 && s.dataBlock.Length() >= s.conf.BlockSizeBytes
+	if limit := s.conf.BlockEntryLimit; limit > 0 && int64(s.dataBlock.EntriesCnt()) >= limit {
+		full = true
+	}
+	if !full {
+		return nil
+	}
+	return s.mustRotateDataBlock()
+}
 
-	if s.dataBlock.EntriesCnt() <= s.conf.BlockSize {
+// rotateBeforeAdd 当前数据块放不下新的键值对时先切换数据块，使数据块不超过blockHardLimit，
+// 单个超过上限的键值对单独组成一个数据块
+func (s *SSTWriter) rotateBeforeAdd(entry kv.Entry) error {
+	limit := s.blockHardLimit()
+	if limit <= 0 || s.dataBlock.EntriesCnt() == 0 {
 		return nil
 	}
+	if s.dataBlock.Length()+entrySize(entry, s.conf.PerEntryChecksum) <= limit {
+		return nil
+	}
+	return s.mustRotateDataBlock()
+}
 
+// rotateAtFieldChange 设置了KeySchema时，数据块达到目标大小或条目数上限的1/4后，
+// key的第一个字段与上一个key不同则先切换数据块，使一个数据块尽量只包含第一个字段的一个取值(如一个租户)
+func (s *SSTWriter) rotateAtFieldChange(key []byte) error {
+	schema := s.conf.KeySchema
+	if schema == nil || s.dataBlock.EntriesCnt() == 0 || schema.SamePrefix(s.lastKey, key, 1) {
+		return nil
+	}
+	filled := s.conf.BlockSizeBytes > 0 && 4*s.dataBlock.Length() >= s.conf.BlockSizeBytes
+	if limit := s.conf.BlockEntryLimit; limit > 0 && 4*int64(s.dataBlock.EntriesCnt()) >= limit {
+		filled = true
+	}
+	if !filled {
+		return nil
+	}
 	return s.mustRotateDataBlock()
 }
+
+// countPrefixes 在更新lastKey之前统计key带来的新前缀，key有序，只需与上一个key比较
+func (s *SSTWriter) countPrefixes(key []byte) {
+	schema := s.conf.KeySchema
+	if schema == nil {
+		return
+	}
+	if s.prefixCounts == nil {
+		s.prefixCounts = make([]uint64, len(schema.Fields))
+	}
+	for n := 1; n <= len(schema.Fields); n++ {
+		if s.props.Entries == 0 || !schema.SamePrefix(s.lastKey, key, n) {
+			s.prefixCounts[n-1]++
+		}
+	}
+}
+
+// blockHardLimit 数据块大小的上限。数据块达到BlockSizeBytes后切换，在此之前加入的条目可以使数据块超出目标大小，
+// 但不超过BlockSizeHardLimit；未设置或小于BlockSizeBytes时上限就是BlockSizeBytes
+func (s *SSTWriter) blockHardLimit() int64 {
+	return max(s.conf.BlockSizeHardLimit, s.conf.BlockSizeBytes)
+}
+
+// Add 添加键值对，value为nil表示删除标记
 func (s *SSTWriter) Add(key, value []byte) error {
-	// 如果数据块满了，则创建新的数据块
-	if err := s.dataBlock.Add(key, value); err != nil {
+	return s.AddEntry(kv.FromValue(key, value, 0))
+}
+
+// AddWithTimestamp 添加带写入时间的键值对，ts为0时与Add相同，不占用额外的字节
+func (s *SSTWriter) AddWithTimestamp(key, value []byte, ts int64) error {
+	return s.AddEntry(kv.FromValue(key, value, ts))
+}
+
+// AddEntry 添加条目。key必须严格递增，否则返回ErrKeyOutOfOrder；SetAllowDuplicateKeys后允许与上一个key相同。
+// 不接受空key，返回ErrEmptyKey
+func (s *SSTWriter) AddEntry(entry kv.Entry) error {
+	entry = entry.Normalize()
+	key, value := entry.Key, entry.Value
+	if len(key) == 0 {
+		return myerror.ErrEmptyKey
+	}
+	if err := s.checkOrder(key); err != nil {
 		return err
 	}
-	s.filter.Add(key)
-	if err := s.tryRotateDataBlock(); err != nil {
+	s.countPrefixes(key)
+	// 大条目总是独占一个数据块，结束当前数据块后直接写入文件
+	large := entrySize(entry, s.conf.PerEntryChecksum) >= streamEntrySize
+	if large {
+		if err := s.mustRotateDataBlock(); err != nil {
+			return err
+		}
+	} else {
+		if err := s.rotateAtFieldChange(key); err != nil {
+			return err
+		}
+		if err := s.rotateBeforeAdd(entry); err != nil {
+			return err
+		}
+		if err := s.dataBlock.Add(entry); err != nil {
+			return err
+		}
+	}
+	s.lastKey = append(s.lastKey[:0], key...)
+	s.props.Entries++
+	if entry.IsDelete() {
+		s.props.Tombstones++
+	}
+	s.props.RawKeyBytes += int64(len(key))
+	s.props.RawValueBytes += int64(len(value))
+	s.props.MaxSeq = max(s.props.MaxSeq, entry.Seq)
+	s.addExpiry(entry.TTL)
+	if s.filter != nil {
+		s.filter.Add(key)
+		// 同时加入key的前缀，使前缀扫描可以通过过滤器跳过数据块
+		if extractor := s.conf.PrefixExtractor; extractor != nil {
+			if prefix := extractor.Transform(key); prefix != nil {
+				s.filter.Add(prefix)
+			}
+		}
+	}
+	if large {
+		if err := s.streamEntry(entry); err != nil {
+			return err
+		}
+	} else if err := s.tryRotateDataBlock(); err != nil {
+		// 如果数据块满了，则创建新的数据块
 		return err
 	}
+	s.updateStats(s.bufferedBytes()+s.dataBlock.Length(), int(s.dataBlock.EntriesCnt()))
 	return nil
 }
 
-func (s *SSTWriter) Flush() error {
-	// 如果数据块满了，则创建新的数据块
-	if err := s.mustRotateDataBlock(); err != nil {
-		return err
+// addExpiry 按新加入条目的过期时间ttl更新文件的最早和最晚过期时间，调用前已计入该条目
+func (s *SSTWriter) addExpiry(ttl int64) {
+	if ttl != 0 && (s.props.MinExpiry == 0 || ttl < s.props.MinExpiry) {
+		s.props.MinExpiry = ttl
 	}
-	// 将数据块写入到数据缓冲区
-	if _, err := s.dataBuf.Write(s.dataBlock.Bytes()); err != nil {
-		return err
+	switch {
+	case s.props.Entries == 1:
+		s.props.MaxExpiry = ttl
+	case ttl == 0:
+		// 有条目不会过期，文件不会整体过期
+		s.props.MaxExpiry = 0
+	case s.props.MaxExpiry != 0:
+		s.props.MaxExpiry = max(s.props.MaxExpiry, ttl)
 	}
-	// 将索引块写入到索引缓冲区
-	if _, err := s.indexBuf.Write(s.indexBlock.Bytes()); err != nil {
-		return err
+}
+
+// updateStats 更新PendingStats返回的快照
+func (s *SSTWriter) updateStats(buffered int64, entries int) {
+	s.statsMu.Lock()
+	s.stats = WriterStats{BlocksWritten: len(s.index), BufferedBytes: buffered, CurrentBlockEntries: entries}
+	s.statsMu.Unlock()
+}
+
+// PendingStats 返回已写满的数据块数、缓冲的字节数和正在写入的数据块中的条目数。
+// 返回的是最近一次添加条目或Flush后的快照，可以与写入并发调用
+func (s *SSTWriter) PendingStats() WriterStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// checkOrder 检查key是否在上一个写入的key之后
+func (s *SSTWriter) checkOrder(key []byte) error {
+	if s.props.Entries == 0 {
+		return nil
 	}
-	// 将过滤器块写入到过滤器缓冲区
-	if _, err := s.filterBuf.Write(s.filterBlock.Bytes()); err != nil {
-		return err
+	cmp := bytes.Compare(key, s.lastKey)
+	if cmp > 0 || (cmp == 0 && s.allowDup) {
+		return nil
 	}
+	return fmt.Errorf("%w: %q after %q", myerror.ErrKeyOutOfOrder, key, s.lastKey)
+}
 
-	// 写入footer
-	footerBuffer := bytes.NewBuffer(nil)
-	dataLength, err := s.sstWriter.Write(s.dataBuf.Bytes())
-	if err != nil {
-		return err
+// dataSize 返回已写满的数据块的总大小，不包括正在写入的数据块
+func (s *SSTWriter) dataSize() int64 {
+	return s.dataWritten
+}
+
+// bufferedBytes 返回文件缓冲区中尚未写入文件的字节数
+func (s *SSTWriter) bufferedBytes() int64 {
+	if s.out == nil {
+		return 0
 	}
-	if err := binary.Write(footerBuffer, binary.BigEndian, uint32(dataLength)); err != nil {
-		return err
+	return int64(s.out.Buffered())
+}
+
+// SetAllowDuplicateKeys 设置是否允许连续写入相同的key，供需要在同一文件中保留多个版本的写入方使用。
+// 读取时Get返回最后写入的版本，迭代器按写入顺序返回所有版本。内存表刷盘使用默认的严格模式
+func (s *SSTWriter) SetAllowDuplicateKeys(allow bool) {
+	s.allowDup = allow
+}
+
+// SetSourceWal 记录文件由walIds对应的内存表刷盘生成，合并刷盘时按从旧到新传入多个WAL id，
+// 重启时据此判断这些WAL已经刷盘。开启DeterministicOutput时不写入文件
+func (s *SSTWriter) SetSourceWal(walIds ...uint32) {
+	s.sourceWals = append(s.sourceWals[:0], walIds...)
+}
+
+// SetRateLimiter 设置写入文件时使用的限速器，按数据块大小分段申请额度，需在添加条目之前调用
+func (s *SSTWriter) SetRateLimiter(limiter *ratelimit.Limiter) {
+	s.limiter = limiter
+}
+
+// fileWriter 返回写入文件使用的io.Writer，设置了限速器时按数据块大小分段限速
+func (s *SSTWriter) fileWriter() io.Writer {
+	out := s.conf.FaultWriter(s.sstWriter, s.filename)
+	if s.limiter == nil {
+		return out
 	}
+	return ratelimit.NewWriter(out, s.limiter, int(s.conf.BlockSizeBytes))
+}
 
-	indexLength, err := s.sstWriter.Write(s.indexBuf.Bytes())
-	if err != nil {
+// output 返回写入文件的缓冲区，写满的数据块、大条目和Flush时的索引区、过滤器区、元数据及footer都经过它写入文件，
+// 写入器占用的内存只有正在写入的数据块、缓冲区以及索引和过滤器，与文件大小无关
+func (s *SSTWriter) output() *bufio.Writer {
+	if s.out == nil {
+		s.out = bufio.NewWriterSize(s.fileWriter(), writeBufferSize)
+	}
+	return s.out
+}
+
+// Flush 写出正在写入的数据块，再依次追加索引区、过滤器区、元数据和footer。
+// 索引和过滤器在切换数据块时追加，都按数据块偏移量递增排列；尾部各区域合并在文件缓冲区中，通常只需一次写入
+func (s *SSTWriter) Flush() error {
+	// 写出最后一个数据块
+	if err := s.mustRotateDataBlock(); err != nil {
 		return err
 	}
-	if err := binary.Write(footerBuffer, binary.BigEndian, uint32(indexLength)); err != nil {
+	out := s.output()
+	indexData := s.indexBlock.Bytes()
+	filterData := s.filterBlock.Bytes()
+	var metaData []byte
+	// 写入元数据，元数据长度由文件大小减去其余各区域得到
+	if meta := s.meta(); len(meta) > 0 {
+		var err error
+		if metaData, err = encodeMeta(meta); err != nil {
+			return err
+		}
+	}
+	footer := make([]byte, 0, 12)
+	footer = binary.BigEndian.AppendUint32(footer, uint32(s.dataWritten))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(indexData)))
+	footer = binary.BigEndian.AppendUint32(footer, uint32(len(filterData)))
+	for _, part := range [][]byte{indexData, filterData, metaData, footer} {
+		if _, err := out.Write(part); err != nil {
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
 		return err
 	}
+	s.updateStats(0, 0)
+	return nil
+}
 
-	filterLength, err := s.sstWriter.Write(s.filterBuf.Bytes())
-	if err != nil {
-		return err
+// meta 返回需要写入文件的元数据，encodeMeta按key排序写入。开启DeterministicOutput时写入时间记为0且不写入来源WAL，
+// 其余各项都只由写入的条目和配置决定
+func (s *SSTWriter) meta() map[string]string {
+	meta := make(map[string]string)
+	s.props.CreatedAt = 0
+	if !s.conf.DeterministicOutput {
+		s.props.CreatedAt = s.conf.Now().UnixNano()
 	}
-	if err := binary.Write(footerBuffer, binary.BigEndian, uint32(filterLength)); err != nil {
-		return err
+	s.props.encode(meta)
+	if len(s.blockSizes) > 0 {
+		meta[MetaBlockSizes] = s.blockSizes.encode()
+	}
+	if schema := s.conf.KeySchema; schema != nil && s.prefixCounts != nil {
+		meta[MetaKeySchema] = schema.Name()
+		meta[MetaKeyPrefixes] = encodePrefixCounts(s.prefixCounts)
 	}
+	meta[MetaBlockFormat] = strconv.Itoa(int(BlockFormat))
+	meta[MetaFilterFormat] = strconv.Itoa(int(FilterFormat))
+	if s.filterName != "" {
+		meta[MetaFilterName] = s.filterName
+	}
+	// 最小最大key供延迟打开的读取器使用，无需解码索引区
+	if len(s.index) > 0 {
+		meta[MetaMinKey] = string(s.index[0].StartKey)
+		meta[MetaMaxKey] = string(s.index[len(s.index)-1].EndKey)
+	}
+	if extractor := s.conf.PrefixExtractor; extractor != nil {
+		meta[MetaPrefixExtractor] = extractor.Name()
+	}
+	if len(s.sourceWals) > 0 && !s.conf.DeterministicOutput {
+		ids := make([]string, len(s.sourceWals))
+		for i, walId := range s.sourceWals {
+			ids[i] = strconv.FormatUint(uint64(walId), 10)
+		}
+		meta[MetaSourceWal] = strings.Join(ids, ",")
+	}
+	return meta
+}
 
-	if _, err := s.sstWriter.Write(footerBuffer.Bytes()); err != nil {
+// Sync 将Flush写出的文件内容fsync到磁盘，需在Close之前调用。
+// 重命名为正式文件名之前同步，断电后正式文件名不会指向不完整的内容
+func (s *SSTWriter) Sync() error {
+	if err := s.conf.IOFault(config.IOSync, s.filename); err != nil {
 		return err
 	}
-
-	return nil
+	return s.sstWriter.Sync()
 }
 
+// Close 关闭写入的文件，可以重复调用
 func (s *SSTWriter) Close() error {
+	s.releaseBuffers()
+	if s.sstWriter == nil {
+		return nil
+	}
+	err := s.sstWriter.Close()
+	s.sstWriter = nil
+	return err
+}
 
+// Abort 放弃写入：关闭并删除文件，释放缓冲区。用于写入出错时清理未完成的文件
+func (s *SSTWriter) Abort() error {
+	if err := s.Close(); err != nil {
+		fsio.DeleteRetry(s.filename)
+		return err
+	}
+	if err := fsio.DeleteRetry(s.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
+
+// releaseBuffers 释放数据块、索引块、过滤器块、文件缓冲区和索引占用的内存。
+// 写入器在Close之后仍可能被引用(如刷盘返回之前)，不应继续占用写入整个文件时的峰值内存
+func (s *SSTWriter) releaseBuffers() {
+	for _, block := range []*Block{s.dataBlock, s.filterBlock, s.indexBlock} {
+		block.release()
+	}
+	s.out = nil
+	s.index = nil
+	s.mapFilter = make(map[int64][]byte)
+	s.lastKey = nil
+}
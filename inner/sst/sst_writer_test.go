@@ -1,12 +1,24 @@
 package sst
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
 	"testing"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/filter"
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
 )
 
 func TestSSTWriter(t *testing.T) {
@@ -18,10 +30,10 @@ func TestSSTWriter(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a custom config for testing with smaller block size
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
 	// Use a larger block size so we don't immediately rotate
-	conf.BlockSize = 5
+	conf.BlockEntryLimit = 5
 
 	// Initialize a new SSTWriter
 	sstFile := filepath.Join(tempDir, "test.sst")
@@ -40,8 +52,14 @@ func TestSSTWriter(t *testing.T) {
 		"key300": "value300",
 	}
 
-	for k, v := range testData {
-		err := writer.Add([]byte(k), []byte(v))
+	// SSTWriter要求key按顺序写入
+	keys := make([]string, 0, len(testData))
+	for k := range testData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := writer.Add([]byte(k), []byte(testData[k]))
 		if err != nil {
 			t.Fatalf("Failed to add key-value pair: %v", err)
 		}
@@ -53,13 +71,13 @@ func TestSSTWriter(t *testing.T) {
 	}
 
 	// Check if blocks were created
-	if len(writer.index) == 0 {
+	if writer.PendingStats().BlocksWritten == 0 {
 		t.Error("Expected at least one index entry after rotation, but none found")
 	}
 
 	// Add more data to ensure multiple blocks
 	for i := 0; i < 20; i++ {
-		key := []byte(string(rune('a' + i)))
+		key := []byte(string(rune('l' + i)))
 		value := []byte(string(rune('A' + i)))
 		err := writer.Add(key, value)
 		if err != nil {
@@ -73,8 +91,8 @@ func TestSSTWriter(t *testing.T) {
 	}
 
 	// Verify that multiple blocks were created
-	if len(writer.index) < 2 {
-		t.Errorf("Expected multiple index entries after adding data, got %d", len(writer.index))
+	if n := writer.PendingStats().BlocksWritten; n < 2 {
+		t.Errorf("Expected multiple index entries after adding data, got %d", n)
 	}
 
 	// Test the flush method
@@ -135,9 +153,9 @@ func TestSSTWriterBloomFilter(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a custom config for testing with smaller block size
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 3 // Small block size to test filter persistence
+	conf.BlockEntryLimit = 3 // Small block size to test filter persistence
 
 	// Initialize a new SSTWriter
 	sstFile := filepath.Join(tempDir, "bloom_test.sst")
@@ -256,6 +274,21 @@ func TestSSTWriterBloomFilter(t *testing.T) {
 }
 
 // Test that block rotation works properly when the block size is reached
+func TestSSTWriterNilFilterConstructor(t *testing.T) {
+	for name, ctor := range map[string]filter.FilterConstructor{
+		"Nil":        nil,
+		"ReturnsNil": func(uint64, uint) filter.Filter { return nil },
+	} {
+		conf := testConfig()
+		conf.DataDir = t.TempDir()
+		conf.FilterConstructor = ctor
+		conf.FilterPolicy = ""
+		if _, err := NewSSTWriter(conf, filepath.Join(conf.DataDir, "nil.sst")); !errors.Is(err, myerror.ErrInvalidConfig) {
+			t.Fatalf("%s: NewSSTWriter = %v, want ErrInvalidConfig", name, err)
+		}
+	}
+}
+
 func TestSSTWriterBlockRotation(t *testing.T) {
 	// Create a temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "sst_writer_rotation_test")
@@ -265,9 +298,9 @@ func TestSSTWriterBlockRotation(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	// Create a custom config for testing with smaller block size
-	conf := config.DefaultConfig()
+	conf := testConfig()
 	conf.DataDir = tempDir
-	conf.BlockSize = 2 // Very small block size to force rotations
+	conf.BlockEntryLimit = 3 // Three entries per block to force rotations
 
 	// Initialize a new SSTWriter
 	sstFile := filepath.Join(tempDir, "rotation_test.sst")
@@ -276,7 +309,7 @@ func TestSSTWriterBlockRotation(t *testing.T) {
 		t.Fatalf("Failed to create SSTWriter: %v", err)
 	}
 
-	// Add exactly 3 entries (should not trigger rotation yet)
+	// Add exactly 3 entries (the third one fills the first block)
 	for i := 0; i < 3; i++ {
 		key := []byte(string(rune('a' + i)))
 		value := []byte(string(rune('A' + i)))
@@ -291,14 +324,14 @@ func TestSSTWriterBlockRotation(t *testing.T) {
 	}
 
 	// Now should have 1 index entry after forced rotation
-	if len(writer.index) != 1 {
-		t.Errorf("Expected 1 index entry after forced rotation, got %d", len(writer.index))
+	if n := writer.PendingStats().BlocksWritten; n != 1 {
+		t.Errorf("Expected 1 index entry after forced rotation, got %d", n)
 	}
 
 	// Add several more entries
 	for i := 0; i < 9; i++ {
-		key := []byte(string(rune('A' + i)))
-		value := []byte(string(rune('a' + i)))
+		key := []byte(string(rune('d' + i)))
+		value := []byte(string(rune('D' + i)))
 		if err := writer.Add(key, value); err != nil {
 			t.Fatalf("Failed to add additional key-value pair: %v", err)
 		}
@@ -311,9 +344,9 @@ func TestSSTWriterBlockRotation(t *testing.T) {
 
 	// Should have multiple index entries now (initial + 3 more sets of 3 entries)
 	expectedIndices := 1 + (9 / 3)
-	if len(writer.index) != expectedIndices {
+	if n := writer.PendingStats().BlocksWritten; n != expectedIndices {
 		t.Errorf("Expected %d index entries after rotations, got %d",
-			expectedIndices, len(writer.index))
+			expectedIndices, n)
 	}
 
 	// Flush to file
@@ -358,3 +391,1095 @@ func TestSSTWriterBlockRotation(t *testing.T) {
 	t.Logf("SST file analysis: size=%d, dataLength=%d, indexLength=%d, filterLength=%d",
 		fileInfo.Size(), dataLength, indexLength, filterLength)
 }
+
+func TestSSTWriterBlockSizeBytes(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.BlockSizeBytes = 1024
+
+	writer, err := NewSSTWriter(conf, filepath.Join(conf.DataDir, "bytes.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxEntry := int64(0)
+	for i := 0; i < 10000; i++ {
+		key := []byte(fmt.Sprintf("key_%05d", i))
+		value := []byte(fmt.Sprintf("value_%d", i))
+		if size := int64(8 + len(key) + len(value)); size > maxEntry {
+			maxEntry = size
+		}
+		if err := writer.Add(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 单个超过目标大小的键值对单独组成一个数据块
+	big := bytes.Repeat([]byte("x"), int(conf.BlockSizeBytes)*3)
+	if err := writer.Add([]byte("zz_big"), big); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Add([]byte("zz_tail"), []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(conf, writer.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	blocks := reader.BlockHandles()
+	if len(blocks) < 3 {
+		t.Fatalf("expected many blocks, got %d", len(blocks))
+	}
+	// 除最后的大值块和尾块外，每个数据块大小都在(目标-单条大小, 目标]之间
+	for i, block := range blocks[:len(blocks)-3] {
+		if block.Length > conf.BlockSizeBytes || block.Length <= conf.BlockSizeBytes-maxEntry {
+			t.Fatalf("block %d length %d not around target %d", i, block.Length, conf.BlockSizeBytes)
+		}
+	}
+	bigBlock := blocks[len(blocks)-2]
+	if string(bigBlock.FirstKey) != "zz_big" || string(bigBlock.LastKey) != "zz_big" {
+		t.Fatalf("oversized entry should form its own block, got %q-%q", bigBlock.FirstKey, bigBlock.LastKey)
+	}
+	for _, key := range []string{"key_00000", "key_09999", "zz_big", "zz_tail"} {
+		if _, err := reader.Get([]byte(key)); err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+	}
+	value, err := reader.Get([]byte("zz_big"))
+	if err != nil || !bytes.Equal(value, big) {
+		t.Fatalf("oversized value mismatch: %v", err)
+	}
+}
+
+// writeTinyBlockSST 写入每块只有两个条目的SST文件，返回读取器和文件大小
+func writeTinyBlockSST(t *testing.T, minKeys, maxFilterBytes int64) (*SSTReader, int64) {
+	t.Helper()
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 2
+	conf.MinKeysPerFilter = minKeys
+	conf.MaxFilterBytesPerFile = maxFilterBytes
+	path := filepath.Join(conf.DataDir, "tiny.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 201; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key-%04d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reader.Close() })
+	return reader, reader.FileSize()
+}
+
+func TestSSTWriterAdaptiveFilter(t *testing.T) {
+	full, fullSize := writeTinyBlockSST(t, 0, 0)
+	blocks := len(full.Index())
+	if blocks != 101 || len(full.Filter()) != blocks {
+		t.Fatalf("baseline: %d blocks, %d filters", blocks, len(full.Filter()))
+	}
+
+	cases := []struct {
+		name           string
+		minKeys        int64
+		maxFilterBytes int64
+	}{
+		{"skip tiny blocks", 3, 0},
+		{"skip last block", 2, 0},
+		{"cap filter bytes", 0, 2000},
+	}
+	for _, c := range cases {
+		reader, size := writeTinyBlockSST(t, c.minKeys, c.maxFilterBytes)
+		props := reader.Properties()
+		filters := reader.Filter()
+		if int64(len(filters))+props.FilterSkipped+props.FilterCapped != int64(blocks) {
+			t.Fatalf("%s: %d filters, %d skipped, %d capped for %d blocks",
+				c.name, len(filters), props.FilterSkipped, props.FilterCapped, blocks)
+		}
+		switch {
+		case c.minKeys == 3 && (len(filters) != 0 || props.FilterSkipped != int64(blocks)):
+			t.Fatalf("%s: expected every block to be skipped, props %+v", c.name, props)
+		case c.minKeys == 2 && (props.FilterSkipped != 1 || filters[reader.Index()[blocks-1].Offset] != nil):
+			t.Fatalf("%s: expected only the one-entry last block to be skipped, props %+v", c.name, props)
+		case c.maxFilterBytes > 0 && (props.FilterCapped == 0 || int64(reader.filterLength) > c.maxFilterBytes):
+			t.Fatalf("%s: filter section %d bytes, props %+v", c.name, reader.filterLength, props)
+		}
+		if c.minKeys != 2 && size >= fullSize {
+			t.Fatalf("%s: file size %d did not drop below %d", c.name, size, fullSize)
+		}
+
+		for i := 0; i < 201; i++ {
+			key := []byte(fmt.Sprintf("key-%04d", i))
+			if value, err := reader.Get(key); err != nil || string(value) != "v" {
+				t.Fatalf("%s: Get(%s) = %q, %v", c.name, key, value, err)
+			}
+			missing := []byte(fmt.Sprintf("key-%04d-missing", i))
+			if _, err := reader.Get(missing); err != myerror.ErrKeyNotFound {
+				t.Fatalf("%s: Get(%s) = %v, want ErrKeyNotFound", c.name, missing, err)
+			}
+		}
+		count := 0
+		if err := reader.PrefixScan([]byte("key-01"), func(key, _ []byte) bool {
+			count++
+			return true
+		}); err != nil || count != 100 {
+			t.Fatalf("%s: PrefixScan found %d keys, %v", c.name, count, err)
+		}
+	}
+}
+
+func TestSSTWriterKeyOrder(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+
+	writer, err := NewSSTWriter(conf, filepath.Join(conf.DataDir, "order.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	// 空key在第一个位置同样被拒绝，不会写入长度为0的索引StartKey
+	for _, key := range [][]byte{nil, {}} {
+		if err := writer.Add(key, []byte("0")); !errors.Is(err, myerror.ErrEmptyKey) {
+			t.Fatalf("Add(%q) = %v, want ErrEmptyKey", key, err)
+		}
+	}
+	if err := writer.Add([]byte("b"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	// 默认模式下重复和倒序的key都被拒绝
+	for _, key := range []string{"b", "a"} {
+		if err := writer.Add([]byte(key), []byte("2")); !errors.Is(err, myerror.ErrKeyOutOfOrder) {
+			t.Fatalf("Add(%s) = %v, want ErrKeyOutOfOrder", key, err)
+		}
+	}
+	if writer.props.Entries != 1 {
+		t.Fatalf("entries = %d, want 1", writer.props.Entries)
+	}
+	if err := writer.Add([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTWriterIndexKeys(t *testing.T) {
+	// 恰好写满一个数据块后Flush，Flush时当前数据块为空；以及Flush时还有未写满的数据块
+	for _, n := range []int{3, 5} {
+		conf := testConfig()
+		conf.DataDir = t.TempDir()
+		conf.IsDebug = false
+		conf.BlockEntryLimit = 3
+		path := filepath.Join(conf.DataDir, "index.sst")
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := make([][]byte, n)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%02d", i))
+			if err := writer.Add(keys[i], []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, _, _, err := reader.loadIndexSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (n + 2) / 3; len(index) != want {
+			t.Fatalf("%d keys: %d index entries, want %d", n, len(index), want)
+		}
+		for i, idx := range index {
+			first, last := keys[i*3], keys[min(i*3+2, n-1)]
+			if !bytes.Equal(idx.StartKey, first) || !bytes.Equal(idx.EndKey, last) || idx.Length <= 0 {
+				t.Fatalf("%d keys: index %d = [%q, %q] length %d, want [%q, %q]", n, i, idx.StartKey, idx.EndKey, idx.Length, first, last)
+			}
+		}
+		reader.Close()
+	}
+
+	for _, c := range []struct {
+		first, last []byte
+		length      int64
+		count       uint32
+	}{
+		{nil, []byte("a"), 10, 1},
+		{[]byte("a"), nil, 10, 1},
+		{[]byte("b"), []byte("a"), 10, 2},
+		{[]byte("a"), []byte("b"), 0, 2},
+		{[]byte("a"), []byte("b"), 10, 0},
+	} {
+		if err := checkBlockIndex(c.first, c.last, c.length, c.count); !errors.Is(err, myerror.ErrInvalidIndex) {
+			t.Fatalf("checkBlockIndex(%q, %q, %d, %d) = %v, want ErrInvalidIndex", c.first, c.last, c.length, c.count, err)
+		}
+	}
+	if err := checkBlockIndex([]byte("a"), []byte("a"), 10, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSSTWriterIndexKeysNotAliased(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.BlockEntryLimit = 3
+	path := filepath.Join(conf.DataDir, "alias.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 所有key共用一块内存，Add之后、数据块写入文件之前改写这块内存
+	buf := make([]byte, len("key-00"))
+	for i := 0; i < 7; i++ {
+		copy(buf, fmt.Sprintf("key-%02d", i))
+		if err := writer.Add(buf, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		copy(buf, "zzzzzz")
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	index, _, _, err := reader.loadIndexSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"key-00", "key-02"}, {"key-03", "key-05"}, {"key-06", "key-06"}}
+	if len(index) != len(want) {
+		t.Fatalf("%d index entries, want %d", len(index), len(want))
+	}
+	for i, idx := range index {
+		if string(idx.StartKey) != want[i][0] || string(idx.EndKey) != want[i][1] {
+			t.Fatalf("index %d = [%q, %q], want %q", i, idx.StartKey, idx.EndKey, want[i])
+		}
+	}
+	for i := 0; i < 7; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if value, err := reader.Get([]byte(key)); err != nil || string(value) != "v" {
+			t.Fatalf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+}
+
+func TestSSTWriterTargetLevel(t *testing.T) {
+	for _, tt := range []struct {
+		skip       bool
+		level      int
+		wantFilter bool
+	}{
+		{skip: true, level: 0, wantFilter: true}, // L0的文件范围重叠，总是带过滤器
+		{skip: true, level: 1, wantFilter: true},
+		{skip: true, level: 2, wantFilter: false},
+		{skip: false, level: 2, wantFilter: true},
+	} {
+		conf := testConfig()
+		conf.IsDebug = false
+		conf.LevelSize = 3
+		conf.SkipFilterOnBottomLevel = tt.skip
+		path := filepath.Join(t.TempDir(), "level.sst")
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.SetTargetLevel(tt.level)
+		for i := 0; i < 100; i += 2 {
+			if err := writer.Add([]byte(fmt.Sprintf("key-%03d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.HasFilter() != tt.wantFilter {
+			t.Fatalf("skip=%v level=%d: HasFilter = %v, want %v", tt.skip, tt.level, reader.HasFilter(), tt.wantFilter)
+		}
+		keys := [][]byte{[]byte("key-010"), []byte("key-011"), []byte("key-013")}
+		values, errs := reader.MultiGet(keys)
+		if errs[0] != nil || string(values[0]) != "value" || errs[1] != myerror.ErrKeyNotFound || errs[2] != myerror.ErrKeyNotFound {
+			t.Fatalf("skip=%v level=%d: MultiGet = %q, %v", tt.skip, tt.level, values, errs)
+		}
+		if _, err := reader.Get([]byte("key-015")); err != myerror.ErrKeyNotFound {
+			t.Fatalf("skip=%v level=%d: Get missing = %v", tt.skip, tt.level, err)
+		}
+		probes, negatives := reader.FilterProbes(), reader.BloomNegatives()
+		if !tt.wantFilter && (probes != 0 || negatives != 0) {
+			t.Fatalf("skip=%v level=%d: %d probes, %d negatives without filter", tt.skip, tt.level, probes, negatives)
+		}
+		if tt.wantFilter && (probes != 4 || negatives == 0) {
+			t.Fatalf("skip=%v level=%d: %d probes, %d negatives, want 4 probes and some negatives", tt.skip, tt.level, probes, negatives)
+		}
+		reader.Close()
+	}
+}
+
+func TestSSTWriterPendingStats(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockEntryLimit = 3
+	writer, err := NewSSTWriter(conf, filepath.Join(conf.DataDir, "stats.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	if stats := writer.PendingStats(); stats != (WriterStats{}) {
+		t.Fatalf("stats before writing = %+v", stats)
+	}
+
+	// 写入期间并发读取快照
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if stats := writer.PendingStats(); stats.CurrentBlockEntries >= 3 || stats.BufferedBytes < 0 {
+				t.Errorf("inconsistent stats %+v", stats)
+				return
+			}
+		}
+	}()
+	var last WriterStats
+	for i := 0; i < 7; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key%d", i)), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		stats := writer.PendingStats()
+		if stats.BlocksWritten != (i+1)/3 || stats.CurrentBlockEntries != (i+1)%3 || stats.BufferedBytes <= last.BufferedBytes {
+			t.Fatalf("after %d entries: stats %+v, previous %+v", i+1, stats, last)
+		}
+		last = stats
+	}
+	close(stop)
+	wg.Wait()
+
+	// Flush后所有数据块都写入了文件
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := writer.PendingStats(); stats != (WriterStats{BlocksWritten: 3}) {
+		t.Fatalf("stats after flush = %+v", stats)
+	}
+}
+
+func TestSSTWriterSourceWal(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	for _, c := range []struct {
+		name   string
+		walId  uint32
+		source bool
+	}{{"flushed.sst", 0, true}, {"flushed7.sst", 7, true}, {"other.sst", 0, false}} {
+		path := filepath.Join(conf.DataDir, c.name)
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.source {
+			writer.SetSourceWal(c.walId)
+		}
+		if err := writer.Add([]byte("a"), []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		walId, ok := reader.SourceWal()
+		reader.Close()
+		if ok != c.source || walId != c.walId {
+			t.Errorf("%s: SourceWal() = %d, %v, want %d, %v", c.name, walId, ok, c.walId, c.source)
+		}
+	}
+
+	// 合并刷盘的文件记录所有来源WAL，SourceWal只对单个来源返回true
+	path := filepath.Join(conf.DataDir, "merged.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.SetSourceWal(3, 4, 5)
+	if err := writer.Add([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if walIds := reader.SourceWals(); !slices.Equal(walIds, []uint32{3, 4, 5}) {
+		t.Fatalf("SourceWals() = %v, want [3 4 5]", walIds)
+	}
+	if walId, ok := reader.SourceWal(); ok {
+		t.Fatalf("SourceWal() = %d, true for a merged flush", walId)
+	}
+}
+
+// 文件属性记录条目的最大序列号，没有序列号的文件不写入该项
+func TestSSTWriterMaxSeq(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	for _, c := range []struct {
+		name string
+		seqs []uint64
+		want uint64
+	}{{"seq.sst", []uint64{3, 9, 5}, 9}, {"noseq.sst", []uint64{0, 0}, 0}} {
+		path := filepath.Join(conf.DataDir, c.name)
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, seq := range c.seqs {
+			if err := writer.AddEntry(kv.Entry{Key: []byte{'a' + byte(i)}, Value: []byte("v"), Seq: seq}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, hasMeta := reader.Properties().MaxSeq, reader.Meta()[MetaMaxSeq] != ""
+		reader.Close()
+		if got != c.want || hasMeta != (c.want > 0) {
+			t.Errorf("%s: MaxSeq = %d (meta %v), want %d", c.name, got, hasMeta, c.want)
+		}
+	}
+}
+
+// 文件属性记录设置了过期时间的条目中最早的过期时间，所有条目都设置了过期时间时记录最晚的过期时间
+func TestSSTWriterExpiryBounds(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	for _, c := range []struct {
+		name     string
+		ttls     []int64
+		min, max int64
+	}{
+		{"all.sst", []int64{30, 10, 20}, 10, 30},
+		{"mixed.sst", []int64{30, 0, 20}, 20, 0},
+		{"first_none.sst", []int64{0, 30, 20}, 20, 0},
+		{"none.sst", []int64{0, 0}, 0, 0},
+	} {
+		path := filepath.Join(conf.DataDir, c.name)
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, ttl := range c.ttls {
+			if err := writer.AddEntry(kv.Entry{Key: []byte{'a' + byte(i)}, Value: []byte("v"), TTL: ttl}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		props, meta := reader.Properties(), reader.Meta()
+		reader.Close()
+		if props.MinExpiry != c.min || props.MaxExpiry != c.max {
+			t.Errorf("%s: expiry = [%d, %d], want [%d, %d]", c.name, props.MinExpiry, props.MaxExpiry, c.min, c.max)
+		}
+		if (meta[MetaMinExpiry] != "") != (c.min != 0) || (meta[MetaMaxExpiry] != "") != (c.max != 0) {
+			t.Errorf("%s: meta %v", c.name, meta)
+		}
+		if props.AllExpired(c.max-1) || props.AllExpired(c.max) != (c.max != 0) {
+			t.Errorf("%s: AllExpired wrong for %+v", c.name, props)
+		}
+		if props.AnyExpireBy(c.min-1) || props.AnyExpireBy(c.min) != (c.min != 0) {
+			t.Errorf("%s: AnyExpireBy wrong for %+v", c.name, props)
+		}
+	}
+}
+
+// 小value和大value混合时，除单个条目的数据块外都不超过硬上限，数据块在达到目标大小前不提前切换
+func TestSSTWriterBlockSizeHardLimit(t *testing.T) {
+	const target, hard = 4096, 8192
+	for _, c := range []struct {
+		name  string
+		hard  int64
+		limit int64 // 多条目数据块的大小上限
+	}{{"adaptive.sst", hard, hard}, {"fixed.sst", 0, target}} {
+		conf := testConfig()
+		conf.DataDir = t.TempDir()
+		conf.BlockSizeBytes = target
+		conf.BlockSizeHardLimit = c.hard
+		path := filepath.Join(conf.DataDir, c.name)
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int64
+		huge := 0
+		for i := 0; i < 2000; i++ {
+			size := 50
+			switch {
+			case i%250 == 0:
+				size, huge = 500<<10, huge+1
+			case i%7 == 0:
+				size = 3000
+			}
+			value := bytes.Repeat([]byte{'v'}, size)
+			if err := writer.Add([]byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+				t.Fatal(err)
+			}
+			total += int64(size)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := reader.Index()
+		histogram := reader.BlockSizeHistogram()
+		reader.Close()
+
+		oversized := 0
+		for _, idx := range index {
+			if idx.Length > c.limit {
+				if idx.EntryCount != 1 {
+					t.Fatalf("%s: block of %d bytes with %d entries exceeds %d", c.name, idx.Length, idx.EntryCount, c.limit)
+				}
+				oversized++
+			}
+		}
+		if oversized != huge {
+			t.Fatalf("%s: %d oversized blocks, want one per huge value (%d)", c.name, oversized, huge)
+		}
+		// 小条目的数据块大致按目标大小切分，大value各占一个数据块
+		small := total - int64(huge)*(500<<10)
+		if n := int64(len(index)); n < small/c.limit+int64(huge) || n > 2*small/target+2*int64(huge)+1 {
+			t.Fatalf("%s: %d blocks for %d bytes of small values and %d huge values", c.name, n, small, huge)
+		}
+
+		var blocks int64
+		for i, bucket := range histogram {
+			if i > 0 && bucket.UpperBound <= histogram[i-1].UpperBound {
+				t.Fatalf("%s: histogram not sorted: %+v", c.name, histogram)
+			}
+			blocks += bucket.Count
+		}
+		if last := histogram[len(histogram)-1]; blocks != int64(len(index)) || last.UpperBound < 500<<10 || last.Count != int64(huge) {
+			t.Fatalf("%s: histogram %+v for %d blocks", c.name, histogram, len(index))
+		}
+	}
+}
+
+func TestSSTWriterStreamLargeEntry(t *testing.T) {
+	for _, checksum := range []bool{false, true} {
+		conf := testConfig()
+		conf.DataDir = t.TempDir()
+		conf.PerEntryChecksum = checksum
+		path := filepath.Join(conf.DataDir, "large.sst")
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 大value的长度不是分段大小的整数倍
+		large := bytes.Repeat([]byte("0123456789abcdef"), (3*streamChunkSize+100)/16)
+		want := map[string][]byte{
+			"a": []byte("small-a"),
+			"b": []byte("small-b"),
+			"c": large,
+			"d": []byte("small-d"),
+			"e": large[:streamEntrySize],
+			"f": large[:streamEntrySize+1],
+		}
+		keys := []string{"a", "b", "c", "d", "e", "f"}
+		for _, key := range keys {
+			if err := writer.Add([]byte(key), want[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 直接写入文件的条目不计入缓冲的字节数
+		if buffered := writer.PendingStats().BufferedBytes; buffered >= streamEntrySize {
+			t.Fatalf("checksum=%v: %d bytes buffered after streaming", checksum, buffered)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		kvs := reader.KvList()
+		if len(kvs) != len(keys) {
+			t.Fatalf("checksum=%v: read %d entries, want %d", checksum, len(kvs), len(keys))
+		}
+		for i, kv := range kvs {
+			if string(kv.Key) != keys[i] || !bytes.Equal(kv.Value, want[keys[i]]) {
+				t.Fatalf("checksum=%v: entry %d is %q with %d value bytes", checksum, i, kv.Key, len(kv.Value))
+			}
+		}
+
+		// 大条目各占一个数据块，数据块首尾相接并带有正确的校验和
+		fp, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fp.Close()
+		var offset int64
+		single := 0
+		for _, idx := range reader.Index() {
+			if idx.Offset != offset {
+				t.Fatalf("checksum=%v: block at %d, want %d", checksum, idx.Offset, offset)
+			}
+			offset += idx.Length
+			if idx.Length >= streamEntrySize {
+				if idx.EntryCount != 1 || !bytes.Equal(idx.StartKey, idx.EndKey) {
+					t.Fatalf("checksum=%v: large block %+v", checksum, idx)
+				}
+				single++
+			}
+			kvs, err := reader.readBlock(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint32(len(kvs)) != idx.EntryCount {
+				t.Fatalf("checksum=%v: block %q has %d entries, index says %d", checksum, idx.StartKey, len(kvs), idx.EntryCount)
+			}
+			data := make([]byte, idx.Length)
+			if _, err := fp.ReadAt(data, reader.dataOffset+idx.Offset); err != nil {
+				t.Fatal(err)
+			}
+			if crc32.ChecksumIEEE(data) != idx.CRC {
+				t.Fatalf("checksum=%v: block %q crc mismatch", checksum, idx.StartKey)
+			}
+		}
+		if single != 3 {
+			t.Fatalf("checksum=%v: %d single-entry blocks, want 3", checksum, single)
+		}
+	}
+}
+
+// TestSSTWriterStreamsBlocks 写满的数据块在切换时写入文件，缓冲的字节数不随文件大小增长
+func TestSSTWriterStreamsBlocks(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	path := filepath.Join(conf.DataDir, "stream.sst")
+	writer, err := NewSSTWriter(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	value := bytes.Repeat([]byte("v"), 1000)
+	const n = 8 << 10 // 约8MB数据
+	limit := int64(writeBufferSize) + writer.blockHardLimit() + int64(len(value)) + 64
+	for i := 0; i < n; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key%06d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+		if buffered := writer.PendingStats().BufferedBytes; buffered > limit {
+			t.Fatalf("after %d entries: %d bytes buffered, want at most %d", i+1, buffered, limit)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	reader, err := NewSSTReader(conf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if kvs := reader.KvList(); len(kvs) != n || string(kvs[n-1].Key) != fmt.Sprintf("key%06d", n-1) {
+		t.Fatalf("read %d entries", len(kvs))
+	}
+	for _, i := range []int{0, n / 2, n - 1} {
+		got, err := reader.Get([]byte(fmt.Sprintf("key%06d", i)))
+		if err != nil || !bytes.Equal(got, value) {
+			t.Fatalf("Get(key%06d) = %d bytes, %v", i, len(got), err)
+		}
+	}
+}
+
+// BenchmarkSSTWriterFlush100MB 写入约100MB的内存表数据并Flush，B/op反映写入器占用的内存
+func BenchmarkSSTWriterFlush100MB(b *testing.B) {
+	conf := testConfig()
+	conf.DataDir = b.TempDir()
+	value := bytes.Repeat([]byte("v"), 1000)
+	const n = 100 << 10
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%08d", i))
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(n * (len(value) + len(keys[0]))))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		path := filepath.Join(conf.DataDir, "bench.sst")
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, key := range keys {
+			if err := writer.Add(key, value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		writer.Close()
+		os.Remove(path)
+	}
+}
+
+// Close释放写入器的缓冲区，Abort同时删除未完成的文件
+func TestSSTWriterCloseReleasesBuffers(t *testing.T) {
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	for _, abort := range []bool{false, true} {
+		path := filepath.Join(conf.DataDir, fmt.Sprintf("abort_%v.sst", abort))
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := writer.Add([]byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if abort {
+			err = writer.Abort()
+		} else if err = writer.Flush(); err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, block := range map[string]*Block{"data": writer.dataBlock, "index": writer.indexBlock, "filter": writer.filterBlock} {
+			if block.dataBuf.Cap() != 0 {
+				t.Errorf("abort=%v: %s block keeps %d bytes after close", abort, name, block.dataBuf.Cap())
+			}
+		}
+		if writer.index != nil || writer.out != nil || len(writer.mapFilter) != 0 {
+			t.Errorf("abort=%v: index, output buffer or filters kept after close", abort)
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) != abort {
+			t.Errorf("abort=%v: stat after close = %v", abort, err)
+		}
+	}
+}
+
+// heapInuse 两次GC后返回使用中的堆内存
+func heapInuse() uint64 {
+	runtime.GC()
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// 写入64MB数据后，仍被引用的写入器在Close之后不再占用数据块、索引和过滤器的内存
+func TestSSTWriterCloseReleasesMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 64MB")
+	}
+	const total, valueSize, tolerance = 64 << 20, 256, 4 << 20
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	// 较大的数据块使写入器在写入期间持有明显的缓冲区
+	conf.BlockSizeBytes = 8 << 20
+	conf.BlockSizeHardLimit = 16 << 20
+	conf.BlockBufferShrinkThreshold = 64 << 10
+
+	base := heapInuse()
+	writer, err := NewSSTWriter(conf, filepath.Join(conf.DataDir, "large.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := bytes.Repeat([]byte("v"), valueSize)
+	for i := 0; i < total/valueSize; i++ {
+		if err := writer.Add([]byte(fmt.Sprintf("key%08d", i)), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written := heapInuse()
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	closed := heapInuse()
+	// 写入器仍被引用，释放的内存只能来自Close
+	runtime.KeepAlive(writer)
+	if written < base+tolerance {
+		t.Fatalf("writer holds only %d bytes while writing, test does not exercise release", int64(written)-int64(base))
+	}
+	if closed > base+tolerance {
+		t.Fatalf("heap in use after close = %d bytes above baseline (%d while writing), want within %d",
+			int64(closed)-int64(base), int64(written)-int64(base), tolerance)
+	}
+}
+
+// tenantKey 返回租户ID(4字节)+时间戳(8字节)+后缀组成的key
+func tenantKey(tenant uint32, ts uint64, suffix string) []byte {
+	key := binary.BigEndian.AppendUint32(nil, tenant)
+	key = binary.BigEndian.AppendUint64(key, ts)
+	return append(key, suffix...)
+}
+
+// 设置KeySchema时数据块在租户变化处切换，文件记录各级前缀的不同取值数；schema与key不符时只影响布局，
+// 有无schema写入的文件读取结果相同
+func TestSSTWriterKeySchemaBlockBoundaries(t *testing.T) {
+	// 每个租户的条目数除以16的余数为0或不小于4，设置schema时每个数据块只包含一个租户
+	counts := []int{37, 20, 64, 5, 100}
+	var entries []kv.Entry
+	distinctTs := uint64(0)
+	for tenant, n := range counts {
+		for i := 0; i < n; i++ {
+			key := tenantKey(uint32(tenant+1), uint64(i/2), fmt.Sprintf("-%d", i))
+			entries = append(entries, kv.Entry{Key: key, Value: []byte(fmt.Sprintf("v%d-%d", tenant, i))})
+		}
+		distinctTs += uint64(n+1) / 2
+	}
+
+	conf := testConfig()
+	conf.DataDir = t.TempDir()
+	conf.BlockSizeBytes = 0
+	conf.BlockEntryLimit = 16
+	write := func(name string, schema *config.KeySchema) *SSTReader {
+		t.Helper()
+		c := *conf
+		c.KeySchema = schema
+		path := filepath.Join(conf.DataDir, name)
+		writer, err := NewSSTWriter(&c, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if err := writer.AddEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		// 读取时的配置不影响结果
+		reader, err := NewSSTReader(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { reader.Close() })
+		return reader
+	}
+	straddling := func(reader *SSTReader) int {
+		t.Helper()
+		index, _, _, err := reader.loadIndexSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, idx := range index {
+			if !bytes.Equal(idx.StartKey[:4], idx.EndKey[:4]) {
+				n++
+			}
+		}
+		return n
+	}
+
+	aware := write("schema.sst", config.NewKeySchema(4, 8))
+	plain := write("plain.sst", nil)
+	// 每个字段只有1字节宽，第一个字段总是0，不会切换数据块
+	wrong := write("wrong.sst", config.NewKeySchema(1, 1))
+	if n := straddling(aware); n != 0 {
+		t.Fatalf("%d blocks straddle tenants with a schema", n)
+	}
+	if n := straddling(plain); n == 0 {
+		t.Fatal("no block straddles tenants without a schema, test does not exercise boundaries")
+	}
+	if straddling(wrong) != straddling(plain) {
+		t.Fatal("a schema that never changes its first field altered the layout")
+	}
+
+	stats, ok := aware.PrefixStats()
+	if !ok || stats.Schema != "4,8" || fmt.Sprint(stats.Distinct) != fmt.Sprint([]uint64{uint64(len(counts)), distinctTs}) {
+		t.Fatalf("PrefixStats = %+v, %v", stats, ok)
+	}
+	if stats, ok := wrong.PrefixStats(); !ok || fmt.Sprint(stats.Distinct) != "[1 1]" {
+		t.Fatalf("PrefixStats with a wrong schema = %+v, %v", stats, ok)
+	}
+	if _, ok := plain.PrefixStats(); ok {
+		t.Fatal("file written without a schema has prefix stats")
+	}
+
+	for _, reader := range []*SSTReader{aware, plain, wrong} {
+		var got []kv.Entry
+		if err := reader.ScanRangeEntries(keyutil.Range{Unbounded: true}, func(entry kv.Entry) bool {
+			got = append(got, entry)
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(entries) {
+			t.Fatalf("scanned %d entries, want %d", len(got), len(entries))
+		}
+		for i, entry := range entries {
+			if !bytes.Equal(got[i].Key, entry.Key) || !bytes.Equal(got[i].Value, entry.Value) {
+				t.Fatalf("entry %d = %q=%q, want %q=%q", i, got[i].Key, got[i].Value, entry.Key, entry.Value)
+			}
+			if value, err := reader.Get(entry.Key); err != nil || !bytes.Equal(value, entry.Value) {
+				t.Fatalf("Get(%q) = %q, %v", entry.Key, value, err)
+			}
+		}
+	}
+}
+
+// 开启DeterministicOutput时相同的条目和配置写出字节相同的文件，写入时间记为0，不记录来源WAL
+func TestSSTWriterDeterministicOutput(t *testing.T) {
+	entries := make([]kv.Entry, 0, 1001)
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("user:%04d", i))
+		switch {
+		case i%7 == 0:
+			entries = append(entries, kv.Entry{Key: key, Kind: kv.KindDelete})
+		case i%5 == 0:
+			entries = append(entries, kv.Entry{Key: key, Value: []byte("expiring"), TTL: int64(1700000000 + i)})
+		default:
+			entries = append(entries, kv.Entry{Key: key, Value: []byte(fmt.Sprintf("value-%d", i))})
+		}
+	}
+	// 大条目直接写入文件，不经过数据块
+	entries = append(entries, kv.Entry{Key: []byte("zz-large"), Value: bytes.Repeat([]byte("v"), streamEntrySize)})
+
+	write := func(conf *config.Config, path string, walIds ...uint32) []byte {
+		t.Helper()
+		writer, err := NewSSTWriter(conf, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.SetSourceWal(walIds...)
+		for _, entry := range entries {
+			if err := writer.AddEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	for _, policy := range []string{filter.NameBloom, filter.NameCuckoo} {
+		t.Run(policy, func(t *testing.T) {
+			dir := t.TempDir()
+			conf := testConfig()
+			conf.IsDebug = false
+			conf.FilterPolicy = policy
+			conf.BlockSizeBytes = 512
+			if policy == filter.NameBloom {
+				conf.PrefixExtractor = config.NewDelimiterPrefixExtractor(':')
+			}
+			conf.PerEntryChecksum = true
+			conf.DeterministicOutput = true
+			first := write(conf, filepath.Join(dir, "0_1.sst"), 3, 4)
+			second := write(conf, filepath.Join(dir, "1_2.sst"), 9)
+			if !bytes.Equal(first, second) {
+				t.Fatalf("files differ: %d and %d bytes", len(first), len(second))
+			}
+			reader, err := NewSSTReader(conf, filepath.Join(dir, "0_1.sst"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			if props := reader.Properties(); props.CreatedAt != 0 || props.Entries != int64(len(entries)) {
+				t.Fatalf("properties = %+v, want CreatedAt 0 and %d entries", props, len(entries))
+			}
+			if len(reader.Filter()) == 0 {
+				t.Fatal("deterministic file has no filters")
+			}
+			if walIds := reader.SourceWals(); walIds != nil {
+				t.Fatalf("SourceWals() = %v, want nil", walIds)
+			}
+
+			// 未开启时记录写入时间
+			conf.DeterministicOutput = false
+			write(conf, filepath.Join(dir, "0_3.sst"), 3, 4)
+			timed, err := NewSSTReader(conf, filepath.Join(dir, "0_3.sst"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer timed.Close()
+			if timed.Properties().CreatedAt == 0 {
+				t.Fatal("CreatedAt = 0 without DeterministicOutput")
+			}
+			if walIds := timed.SourceWals(); !slices.Equal(walIds, []uint32{3, 4}) {
+				t.Fatalf("SourceWals() = %v, want [3 4]", walIds)
+			}
+		})
+	}
+}
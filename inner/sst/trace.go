@@ -0,0 +1,16 @@
+package sst
+
+// ReadTrace 记录一次SST查找的过程
+type ReadTrace struct {
+	IndexHits      int          // 索引常驻内存的次数
+	IndexMisses    int          // 索引被淘汰后重新解析的次数
+	BloomNegatives int          // 布隆过滤器判定key不存在的数据块数
+	Blocks         []BlockTrace // 实际读取的数据块
+}
+
+// BlockTrace 一次数据块读取
+type BlockTrace struct {
+	File   string // SST文件路径
+	Offset int64  // 数据块偏移量
+	Size   int64  // 数据块字节数
+}
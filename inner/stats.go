@@ -0,0 +1,211 @@
+package inner
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats 运行统计
+type Stats struct {
+	Gets                 uint64 // Get次数
+	MemTableProbes       uint64 // 内存表查找次数
+	NodesConsidered      uint64 // 查找过的SST文件次数
+	NodesSkipped         uint64 // 因最小最大key范围跳过的SST文件次数
+	BloomNegatives       uint64 // 布隆过滤器判定不存在的次数，仅统计当前打开的SST文件
+	BlocksRead           uint64 // 读取的数据块数，仅统计当前打开的SST文件
+	BlockBytesRead       uint64 // 读取的数据块字节数，仅统计当前打开的SST文件
+	BlockCacheHits       uint64 // 数据块缓存命中次数
+	BlockCacheMisses     uint64 // 数据块缓存未命中次数
+	RowCacheHits         uint64 // 行缓存命中次数
+	RowCacheMisses       uint64 // 行缓存未命中次数
+	WriteBufferBytes     int64  // 当前可变与不可变内存表的总大小
+	WriteBufferPeakBytes int64  // 可变与不可变内存表总大小的峰值
+	UserBytesWritten     int64  // 用户累计写入的key和value字节数，重启后继续累计
+	WALBytesWritten      int64  // 累计写入WAL的字节数
+	FlushBytesWritten    int64  // 累计刷盘写入的SST字节数
+	LiveSSTBytes         int64  // 当前所有SST文件的总大小
+	LogicalBytes         int64  // 根据SST文件属性估算的未删除数据的逻辑大小
+	FilterMemoryBytes    int64  // 当前打开的SST文件已加载的过滤器常驻内存的大小，受FilterMemoryBudget限制
+	FilterReloads        uint64 // 过滤器被FilterMemoryBudget卸载后重新加载的次数，仅统计当前打开的SST文件
+
+	LevelFilters           []LevelFilterStats // 按层级统计的过滤器查询、判定不存在的次数和过滤器内存，仅统计当前打开的SST文件
+	L0Files                int                // 当前L0文件数
+	OpenIterators          int                // 当前进行中的PrefixScan等遍历数，详情见OpenIterators
+	WriteThrottleDelay     time.Duration      // 最近一次因L0文件过多减慢写入时的延迟
+	WriteThrottleTime      time.Duration      // 写入因L0文件过多被减慢和停止累计等待的时长
+	CompactionDebt         int64              // 使各层文件数回到MaxFilesPerLevel以内估计还需要重写的字节数，可用于在树退化前告警
+	LevelCompactions       uint64             // 完成的层级压缩次数，不包括平移
+	LevelCompactionBytes   int64              // 层级压缩累计重写的输入文件字节数
+	LevelTrivialMoves      uint64             // 层级压缩中与下一层不重叠、直接平移到下一层的文件数
+	LevelTrivialMoveBytes  int64              // 平移到下一层的文件字节数，没有读取和重写
+	NextPeriodicCompaction time.Time          // 下一次定期压缩的时间，未启用时为零值
+	LastPeriodicCompaction PeriodicCompaction // 最近一次定期压缩的结果
+	FileHeat               []FileHeat         // 各SST文件采样到的读取次数，按层级和层内顺序排列，未开启AccessSampling时为空
+	FileFilters            []FileFilterStats  // 各SST文件已加载的过滤器内存和重新加载次数，按层级和层内顺序排列
+	RecentCompactions      []CompactionEvent  // 最近完成的压缩，按完成顺序从旧到新，只保留在内存中
+	Recovery               RecoveryStats      // 打开时重放WAL的统计
+
+	latencies []Histogram // 按LatencyOp索引的耗时分布，通过Histogram读取
+	rotations []uint64    // 按RotationCause索引的内存表轮转次数，通过Rotations读取
+	levelIO   []LevelIO   // 按层级的读写量，通过LevelIO读取
+}
+
+// RowCacheHitRate 返回行缓存的命中率，没有查找时返回0
+func (s Stats) RowCacheHitRate() float64 {
+	if lookups := s.RowCacheHits + s.RowCacheMisses; lookups > 0 {
+		return float64(s.RowCacheHits) / float64(lookups)
+	}
+	return 0
+}
+
+// RecoveryStats 打开数据库时重放WAL的统计，用于评估未刷盘的WAL对启动时间的影响
+type RecoveryStats struct {
+	WALFiles    int           // 重放的WAL文件数，不包括已刷盘而直接删除的WAL
+	WALBytes    int64         // 重放的WAL字节数
+	Records     int64         // 写入内存表的记录数，批量记录按子记录计数
+	Duration    time.Duration // 重放所有WAL的耗时
+	Parallelism int           // 每个WAL解码记录的worker数和同时重放的WAL文件数
+}
+
+// BytesPerSecond 返回重放的吞吐量，没有重放WAL时返回0
+func (s RecoveryStats) BytesPerSecond() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.WALBytes) / s.Duration.Seconds()
+}
+
+// FileHeat 一个SST文件的热度
+type FileHeat struct {
+	Path  string // 文件路径
+	Level int    // 层级
+	Seq   uint32 // 序列号
+	Heat  uint64 // 采样到的命中本文件的Get次数，压缩和重写后的文件继承输入文件的热度
+}
+
+// FileFilterStats 一个SST文件的过滤器内存
+type FileFilterStats struct {
+	Path        string // 文件路径
+	Level       int    // 层级
+	Seq         uint32 // 序列号
+	MemoryBytes int64  // 已加载的过滤器常驻内存的大小，被FilterMemoryBudget卸载或随索引淘汰时为0
+	Reloads     uint64 // 过滤器被卸载后重新加载的次数
+}
+
+// LevelFilterStats 一层SST文件的过滤器统计，用于判断该层的过滤器是否值得构建
+type LevelFilterStats struct {
+	Probes      uint64 // 点查时查询过滤器的次数
+	Negatives   uint64 // 过滤器判定不存在、省去数据块读取的次数
+	MemoryBytes int64  // 该层已加载的过滤器常驻内存的大小
+	Reloads     uint64 // 该层过滤器被卸载后重新加载的次数
+}
+
+// NegativeRate 返回过滤器判定不存在的比例，没有查询时返回0。比例很低的层上点查大多命中，
+// 过滤器很少省去读取，最底层可以考虑开启SkipFilterOnBottomLevel
+func (s LevelFilterStats) NegativeRate() float64 {
+	if s.Probes == 0 {
+		return 0
+	}
+	return float64(s.Negatives) / float64(s.Probes)
+}
+
+// treeStats LsmTree内部维护的计数器
+type treeStats struct {
+	gets            atomic.Uint64
+	memTableProbes  atomic.Uint64
+	nodesConsidered atomic.Uint64
+	nodesSkipped    atomic.Uint64
+	latencies       [numLatencyOps]latencyHistogram
+	rotations       [numRotationCauses]atomic.Uint64
+	writeStages     atomic.Bool // 是否记录写入各阶段的耗时
+}
+
+// Stats 返回当前的运行统计
+func (t *LsmTree) Stats() Stats {
+	stats := Stats{
+		Gets:                  t.stats.gets.Load(),
+		MemTableProbes:        t.stats.memTableProbes.Load(),
+		NodesConsidered:       t.stats.nodesConsidered.Load(),
+		NodesSkipped:          t.stats.nodesSkipped.Load(),
+		BlockCacheHits:        t.blockCache.Hits(),
+		BlockCacheMisses:      t.blockCache.Misses(),
+		RowCacheHits:          t.rowCache.Hits(),
+		RowCacheMisses:        t.rowCache.Misses(),
+		WriteBufferBytes:      t.bufferedBytes.Load(),
+		WriteBufferPeakBytes:  t.peakBuffered.Load(),
+		UserBytesWritten:      t.counters.userBytes.Load(),
+		WALBytesWritten:       t.counters.walBytes.Load(),
+		FlushBytesWritten:     t.counters.flushBytes.Load(),
+		L0Files:               int(t.throttle.l0Files.Load()),
+		OpenIterators:         t.openIteratorCount(),
+		WriteThrottleDelay:    time.Duration(t.throttle.lastDelay.Load()),
+		WriteThrottleTime:     time.Duration(t.throttle.total.Load()),
+		LevelCompactions:      t.levels.count.Load(),
+		LevelCompactionBytes:  t.levels.bytes.Load(),
+		LevelTrivialMoves:     t.levels.moves.Load(),
+		LevelTrivialMoveBytes: t.levels.moveBytes.Load(),
+	}
+	stats.latencies = make([]Histogram, numLatencyOps)
+	for op := range stats.latencies {
+		stats.latencies[op] = t.stats.latencies[op].snapshot()
+	}
+	stats.rotations = make([]uint64, numRotationCauses)
+	for cause := range stats.rotations {
+		stats.rotations[cause] = t.stats.rotations[cause].Load()
+	}
+	stats.RecentCompactions = t.levelIO.recentEvents()
+	stats.Recovery = t.recovery
+	read, written := t.levelIO.snapshot()
+	t.periodic.mu.Lock()
+	stats.NextPeriodicCompaction = t.periodic.next
+	stats.LastPeriodicCompaction = t.periodic.last
+	t.periodic.mu.Unlock()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	stats.CompactionDebt = t.compactionDebt()
+	stats.LevelFilters = make([]LevelFilterStats, len(t.nodes))
+	stats.levelIO = make([]LevelIO, len(t.nodes))
+	for level, nodes := range t.nodes {
+		stats.levelIO[level].Level = level
+		if level < len(read) {
+			stats.levelIO[level].BytesRead = read[level]
+			stats.levelIO[level].BytesWritten = written[level]
+		}
+		for _, node := range nodes {
+			reader := node.Reader()
+			stats.BloomNegatives += reader.BloomNegatives()
+			stats.LevelFilters[level].Probes += reader.FilterProbes()
+			stats.LevelFilters[level].Negatives += reader.BloomNegatives()
+			stats.LevelFilters[level].MemoryBytes += reader.FilterMemory()
+			stats.LevelFilters[level].Reloads += reader.FilterReloads()
+			stats.FilterMemoryBytes += reader.FilterMemory()
+			stats.FilterReloads += reader.FilterReloads()
+			stats.FileFilters = append(stats.FileFilters, FileFilterStats{
+				Path:        node.GetFilename(),
+				Level:       level,
+				Seq:         uint32(node.GetSeq()),
+				MemoryBytes: reader.FilterMemory(),
+				Reloads:     reader.FilterReloads(),
+			})
+			stats.BlocksRead += reader.BlockReads()
+			stats.BlockBytesRead += reader.BlockBytesRead()
+			stats.LiveSSTBytes += node.GetSize()
+			stats.levelIO[level].LiveBytes += node.GetSize()
+			if t.conf.AccessSampling > 0 {
+				stats.FileHeat = append(stats.FileHeat, FileHeat{
+					Path:  node.GetFilename(),
+					Level: level,
+					Seq:   uint32(node.GetSeq()),
+					Heat:  node.Heat(),
+				})
+			}
+			if props := reader.Properties(); props.Entries > 0 {
+				stats.LogicalBytes += props.LogicalBytes()
+			} else {
+				// 没有属性的旧文件按文件大小估算
+				stats.LogicalBytes += node.GetSize()
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,110 @@
+package inner
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// throttleState L0文件过多时减慢或停止写入的状态
+type throttleState struct {
+	l0Files   atomic.Int64  // 当前L0文件数，在持有t.mu写锁修改L0时更新，写入方无需加锁读取
+	active    atomic.Bool   // 最近一次写入是否被减慢或停止，状态变化时调用OnWriteThrottleStart/Stop
+	lastDelay atomic.Int64  // 最近一次减慢写入的延迟(纳秒)
+	total     atomic.Int64  // 写入因减慢和停止累计等待的时长(纳秒)
+	mu        sync.Mutex    // 保护shrunk
+	shrunk    chan struct{} // L0文件数减少时关闭，等待停止解除的写入方在此等待，为nil时在需要时创建
+}
+
+// setL0Files 更新L0文件数，文件数减少时唤醒停止中的写入方，调用方需持有t.mu写锁
+func (t *LsmTree) setL0Files() {
+	n := int64(len(t.nodes[0]))
+	if t.throttle.l0Files.Swap(n) <= n {
+		return
+	}
+	t.throttle.mu.Lock()
+	defer t.throttle.mu.Unlock()
+	if t.throttle.shrunk != nil {
+		close(t.throttle.shrunk)
+		t.throttle.shrunk = nil
+	}
+}
+
+// l0Shrunk 返回L0文件数下次减少时关闭的通道
+func (t *LsmTree) l0Shrunk() <-chan struct{} {
+	t.throttle.mu.Lock()
+	defer t.throttle.mu.Unlock()
+	if t.throttle.shrunk == nil {
+		t.throttle.shrunk = make(chan struct{})
+	}
+	return t.throttle.shrunk
+}
+
+// l0Throttle 返回L0有n个文件时每次写入的延迟，以及是否停止写入。
+// 延迟从L0SlowdownTrigger处的L0SlowdownMaxDelay/(L0StopTrigger-L0SlowdownTrigger)
+// 随文件数线性增加，到L0StopTrigger前一个文件时为L0SlowdownMaxDelay
+func (t *LsmTree) l0Throttle(n int) (time.Duration, bool) {
+	slowdown, stop := t.conf.L0SlowdownTrigger, t.conf.L0StopTrigger
+	if stop > 0 && n >= stop {
+		return 0, true
+	}
+	if slowdown <= 0 || n < slowdown {
+		return 0, false
+	}
+	maxDelay := t.conf.L0SlowdownMaxDelay
+	if maxDelay <= 0 {
+		maxDelay = config.DefaultL0SlowdownMaxDelay
+	}
+	if stop <= slowdown {
+		return maxDelay, false
+	}
+	return maxDelay * time.Duration(n-slowdown+1) / time.Duration(stop-slowdown), false
+}
+
+// throttleWrite 在获取写锁之前按L0文件数减慢或停止本次写入：每次写入最多延迟一次，
+// 达到L0StopTrigger时等待压缩减少L0文件，关闭时返回ErrDBClosed。
+// 只有用户写入经过这里，关闭时和压缩的刷盘不会被限制
+func (t *LsmTree) throttleWrite() error {
+	delayed := false
+	for {
+		n := int(t.throttle.l0Files.Load())
+		delay, stop := t.l0Throttle(n)
+		if !stop && (delay == 0 || delayed) {
+			if delay == 0 && t.throttle.active.CompareAndSwap(true, false) && t.conf.OnWriteThrottleStop != nil {
+				t.conf.OnWriteThrottleStop(n)
+			}
+			return nil
+		}
+		if t.throttle.active.CompareAndSwap(false, true) && t.conf.OnWriteThrottleStart != nil {
+			t.conf.OnWriteThrottleStart(n)
+		}
+
+		start := t.conf.Now()
+		if stop {
+			shrunk := t.l0Shrunk()
+			// 获取通道前L0文件数可能已经减少
+			if int(t.throttle.l0Files.Load()) < t.conf.L0StopTrigger {
+				continue
+			}
+			select {
+			case <-shrunk:
+			case <-t.stopCh:
+				return myerror.ErrDBClosed
+			}
+		} else {
+			t.throttle.lastDelay.Store(int64(delay))
+			timer := t.conf.GetClock().NewTimer(delay)
+			select {
+			case <-timer.C():
+			case <-t.stopCh:
+				timer.Stop()
+				return myerror.ErrDBClosed
+			}
+			delayed = true
+		}
+		t.throttle.total.Add(int64(t.conf.Since(start)))
+	}
+}
@@ -0,0 +1,152 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/kv"
+)
+
+// waitTimer 等待clock上出现定时器，返回其剩余时长
+func waitTimer(t *testing.T, clock *manualClock) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		clock.mu.Lock()
+		if len(clock.timers) > 0 {
+			d := clock.timers[0].deadline.Sub(clock.now)
+			clock.mu.Unlock()
+			return d
+		}
+		clock.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no timer was created")
+	return 0
+}
+
+// throttledWrite 在后台删除key，返回写入完成时接收结果的通道
+func throttledWrite(tree *LsmTree, key string) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- tree.Delete([]byte(key)) }()
+	return done
+}
+
+func TestLsmTree_WriteThrottle(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WalSize = 1 << 20
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	conf.L0SlowdownTrigger = 2
+	conf.L0StopTrigger = 4
+	conf.L0SlowdownMaxDelay = 8 * time.Millisecond
+	// 后台不运行定期压缩，由测试调用runPeriodicCompaction模拟压缩恢复
+	conf.TombstoneCompactionRatio = 1
+	var mu sync.Mutex
+	var events []string
+	conf.OnWriteThrottleStart = func(l0Files int) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("start %d", l0Files))
+	}
+	conf.OnWriteThrottleStop = func(l0Files int) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("stop %d", l0Files))
+	}
+	// L0中只有删除标记的文件，压缩时全部丢弃
+	for seq := uint32(1); seq <= 2; seq++ {
+		writeLevelEntries(t, conf, 0, seq, []kv.Entry{{Key: []byte(fmt.Sprintf("old%d", seq)), Kind: kv.KindDelete}})
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	// 延迟随L0文件数增加：2个文件时为最长延迟的1/2，3个文件时为最长延迟
+	for i, want := range []time.Duration{4 * time.Millisecond, 8 * time.Millisecond} {
+		done := throttledWrite(tree, fmt.Sprintf("key%d", i))
+		if d := waitTimer(t, clock); d != want {
+			t.Fatalf("L0 files %d: delay %s, want %s", 2+i, d, want)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("write finished before its delay: %v", err)
+		default:
+		}
+		clock.Advance(want)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if stats := tree.Stats(); stats.L0Files != 2+i || stats.WriteThrottleDelay != want {
+			t.Fatalf("stats L0Files=%d WriteThrottleDelay=%s", stats.L0Files, stats.WriteThrottleDelay)
+		}
+		flushAll(t, tree)
+	}
+	if total := tree.Stats().WriteThrottleTime; total != 12*time.Millisecond {
+		t.Fatalf("WriteThrottleTime = %s, want 12ms", total)
+	}
+
+	// 达到L0StopTrigger后写入停止，不设置定时器
+	done := throttledWrite(tree, "stopped")
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("write finished at the stop trigger: %v", err)
+	default:
+	}
+	clock.mu.Lock()
+	timers := len(clock.timers)
+	clock.mu.Unlock()
+	if timers != 0 {
+		t.Fatalf("stopped write created %d timers", timers)
+	}
+
+	// 压缩丢弃L0中的文件后写入恢复，第一个文件被丢弃时唤醒的写入可能还需要经过一次延迟
+	tree.runPeriodicCompaction()
+	for waiting := true; waiting; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			waiting = false
+		case <-time.After(time.Millisecond):
+			clock.Advance(conf.L0SlowdownMaxDelay)
+		}
+	}
+	if n := tree.Stats().L0Files; n != 0 {
+		t.Fatalf("L0Files = %d after compaction, want 0", n)
+	}
+	if err := tree.Put([]byte("after"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(events) != "[start 2 stop 0]" {
+		t.Fatalf("throttle events = %v", events)
+	}
+}
+
+func TestLsmTree_WriteThrottleClose(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.L0StopTrigger = 1
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a": "1"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := throttledWrite(tree, "a")
+	time.Sleep(10 * time.Millisecond)
+	// 关闭唤醒停止中的写入
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("stopped write = %v, want ErrDBClosed", err)
+	}
+}
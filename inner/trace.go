@@ -0,0 +1,76 @@
+package inner
+
+import (
+	"time"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// GetTrace 记录一次Get的查找过程，用于排查慢查询
+type GetTrace struct {
+	MemTablesChecked int              // 查找过的内存表数量(包括可变和不可变内存表)
+	Levels           []LevelTrace     // 查找过的各层SST
+	Blocks           []sst.BlockTrace // 实际读取的数据块
+	CacheHits        int              // 索引常驻内存的SST文件数
+	CacheMisses      int              // 索引被淘汰后重新解析的SST文件数
+	Source           string           // 满足读取的层级
+	Duration         time.Duration    // 总耗时
+}
+
+// LevelTrace 一层SST的查找情况
+type LevelTrace struct {
+	Level           int // 层级
+	NodesConsidered int // key落在最小最大key范围内而被查找的文件数
+	NodesSkipped    int // 因最小最大key范围被跳过的文件数
+	BloomNegatives  int // 布隆过滤器判定key不存在的数据块数
+}
+
+// GetWithTrace 与Get相同，同时返回查找过程
+func (t *LsmTree) GetWithTrace(key []byte) ([]byte, *GetTrace, error) {
+	if err := checkUserKey(key); err != nil {
+		return nil, nil, err
+	}
+	start := t.conf.Now()
+	if err := t.beginRead(); err != nil {
+		return nil, nil, err
+	}
+
+	trace := &GetTrace{}
+	info := &readInfo{source: sourceNone, trace: trace}
+	value, err := t.get(key, info)
+	mismatch := t.shadowVerify(key, value, err, info)
+	t.mu.RUnlock()
+	t.reportShadowMismatch(mismatch)
+	trace.Source = info.source
+	trace.Duration = t.conf.Since(start)
+	t.observeOp(LatencyGet, key, trace.Duration, info)
+	return value, trace, err
+}
+
+// enterLevel 开始记录一层SST的查找，trace为nil时返回nil
+func (trace *GetTrace) enterLevel(level int) *LevelTrace {
+	if trace == nil {
+		return nil
+	}
+	trace.Levels = append(trace.Levels, LevelTrace{Level: level})
+	return &trace.Levels[len(trace.Levels)-1]
+}
+
+// addRead 合并一次SST读取的记录
+func (trace *GetTrace) addRead(level *LevelTrace, read *sst.ReadTrace) {
+	if trace == nil || read == nil {
+		return
+	}
+	level.BloomNegatives += read.BloomNegatives
+	trace.Blocks = append(trace.Blocks, read.Blocks...)
+	trace.CacheHits += read.IndexHits
+	trace.CacheMisses += read.IndexMisses
+}
+
+// probeMemTable 记录一次内存表查找
+func (t *LsmTree) probeMemTable(info *readInfo) {
+	t.stats.memTableProbes.Add(1)
+	if info.trace != nil {
+		info.trace.MemTablesChecked++
+	}
+}
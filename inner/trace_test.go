@@ -0,0 +1,78 @@
+package inner
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// newTraceTree 构造已知布局：目标key "m" 只存在于L1的第3个文件中
+func newTraceTree(t *testing.T, indexBudget int64) *LsmTree {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	conf.BlockEntryLimit = 2
+	conf.IndexMemoryBudget = indexBudget
+	writeLevelSST(t, conf, 0, 0, map[string]string{"a": "v", "b": "v"}) // 范围外，跳过
+	writeLevelSST(t, conf, 0, 1, map[string]string{"k": "v", "z": "v"}) // 范围内，布隆过滤器排除
+	writeLevelSST(t, conf, 1, 0, map[string]string{"a": "v"})
+	writeLevelSST(t, conf, 1, 1, map[string]string{"c": "v"})
+	writeLevelSST(t, conf, 1, 2, map[string]string{"l": "v", "m": "found", "n": "v"})
+	writeLevelSST(t, conf, 1, 3, map[string]string{"x": "v", "y": "v"}) // 范围外，跳过
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+func TestLsmTree_GetWithTrace(t *testing.T) {
+	tree := newTraceTree(t, 0)
+	value, trace, err := tree.GetWithTrace([]byte("m"))
+	if err != nil || string(value) != "found" {
+		t.Fatalf("GetWithTrace = %q, %v", value, err)
+	}
+
+	want := &GetTrace{
+		MemTablesChecked: 1,
+		Levels: []LevelTrace{
+			{Level: 0, NodesConsidered: 1, NodesSkipped: 1, BloomNegatives: 1},
+			{Level: 1, NodesConsidered: 1, NodesSkipped: 1},
+		},
+		Blocks: []sst.BlockTrace{{
+			File:   filepath.Join(tree.conf.DataDir, tree.conf.SSTDir, "1_2.sst"),
+			Offset: 0,
+			Size:   (9 + 1 + 1) + (9 + 1 + 5), // 数据块[l, m]，每条记录8字节长度头和1字节标志位
+		}},
+		CacheMisses: 2, // 启动时延迟打开，第一次查找时解析索引
+		Source:      "L1",
+	}
+	if trace.Duration <= 0 {
+		t.Fatalf("trace duration not recorded")
+	}
+	trace.Duration = 0
+	if !reflect.DeepEqual(trace, want) {
+		t.Fatalf("trace = %+v\nwant    %+v", trace, want)
+	}
+
+	stats := tree.Stats()
+	if stats.Gets != 1 || stats.MemTableProbes != 1 || stats.NodesConsidered != 2 || stats.NodesSkipped != 2 ||
+		stats.BloomNegatives != 1 || stats.BlocksRead != 1 || stats.BlockBytesRead != uint64(want.Blocks[0].Size) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestLsmTree_GetWithTraceIndexReload(t *testing.T) {
+	// 预算只够保留一个文件的索引，查找时其余文件需要重新解析索引
+	tree := newTraceTree(t, 1)
+	_, trace, err := tree.GetWithTrace([]byte("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.CacheHits+trace.CacheMisses != 2 || trace.CacheMisses == 0 {
+		t.Fatalf("expected index reloads, got hits=%d misses=%d", trace.CacheHits, trace.CacheMisses)
+	}
+}
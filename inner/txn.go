@@ -0,0 +1,256 @@
+package inner
+
+import (
+	"errors"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// Txn 乐观并发控制的事务
+// 读操作只能看到事务开始时已提交的数据，若读取的key在开始后被修改则返回ErrTxnConflict；
+// 写操作缓存在私有内存表中，提交时校验读写过的key均未被其他提交修改，并作为一条批量记录原子写入WAL
+// Txn不是并发安全的，同一个事务只能在一个goroutine中使用
+type Txn struct {
+	tree     *LsmTree
+	startSeq uint64              // 开始时的提交序列号
+	writes   memtable.MemTable   // 未提交的写入，nil值表示删除
+	readSet  map[string]struct{} // 读取过的key
+	done     bool                // 是否已提交或回滚
+	err      error               // 创建时的错误，不为nil时事务不可用
+}
+
+// BeginTxn 开始一个事务，事务结束时必须调用Commit或Rollback
+func (t *LsmTree) BeginTxn() *Txn {
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	writes, err := t.newMemTable()
+	if err != nil {
+		// 没有登记为活跃事务，各个方法返回err
+		return &Txn{tree: t, done: true, err: err}
+	}
+	startSeq := t.commitSeq
+	t.activeTxns[startSeq]++
+	return &Txn{
+		tree:     t,
+		startSeq: startSeq,
+		writes:   writes,
+		readSet:  make(map[string]struct{}),
+	}
+}
+
+// check 校验事务可用，创建失败时返回创建时的错误
+func (txn *Txn) check() error {
+	if txn.err != nil {
+		return txn.err
+	}
+	if txn.done {
+		return myerror.ErrTxnDone
+	}
+	return nil
+}
+
+// Get 读取key，优先返回事务内未提交的写入
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if err := txn.check(); err != nil {
+		return nil, err
+	}
+	if err := checkUserKey(key); err != nil {
+		return nil, err
+	}
+	value, err := txn.writes.Get(key)
+	if err == nil {
+		if value == nil {
+			return nil, myerror.ErrKeyNotFound
+		}
+		return value, nil
+	}
+	if !errors.Is(err, myerror.ErrKeyNotFound) {
+		return nil, err
+	}
+
+	t := txn.tree
+	if err := t.beginRead(); err != nil {
+		return nil, err
+	}
+	defer t.mu.RUnlock()
+	// 持有读锁时没有进行中的写入，版本检查与读取看到的是同一状态
+	if t.modifiedSince(key, txn.startSeq) {
+		return nil, myerror.ErrTxnConflict
+	}
+	txn.readSet[string(key)] = struct{}{}
+	return t.get(key, &readInfo{source: sourceNone})
+}
+
+// Put 在事务中写入key
+func (txn *Txn) Put(key, value []byte) error {
+	if err := txn.check(); err != nil {
+		return err
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	if err := txn.tree.checkEntrySize(key, value); err != nil {
+		return err
+	}
+	return txn.writes.Put(key, value)
+}
+
+// Delete 在事务中删除key
+func (txn *Txn) Delete(key []byte) error {
+	if err := txn.check(); err != nil {
+		return err
+	}
+	if err := checkUserKey(key); err != nil {
+		return err
+	}
+	return txn.writes.Put(key, nil)
+}
+
+// Commit 校验冲突并原子地提交所有写入，冲突时返回ErrTxnConflict，事务随之结束
+func (txn *Txn) Commit() error {
+	if err := txn.check(); err != nil {
+		return err
+	}
+	defer txn.finish()
+
+	records := make([]*wal.Record, 0)
+	keys := make([][]byte, 0)
+	var size int64
+	txn.writes.ForEach(func(key, value []byte) bool {
+		records = append(records, wal.NewEntryRecord(kv.FromValue(key, value, 0)))
+		keys = append(keys, key)
+		size += memtable.EntrySize(key, value)
+		return true
+	})
+	if len(records) == 0 {
+		return nil
+	}
+
+	commit, err := txn.apply(records, keys, size)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// apply 在写锁内校验冲突并写入WAL和内存表，返回WAL提交以便在锁外等待持久化
+func (txn *Txn) apply(records []*wal.Record, keys [][]byte, size int64) (*wal.Commit, error) {
+	t := txn.tree
+	if err := t.beginWriteWithRoom(size); err != nil {
+		return nil, err
+	}
+	defer t.mu.Unlock()
+
+	// 读写过的key在事务开始后被其他提交修改过则冲突
+	for key := range txn.readSet {
+		if t.modifiedSince([]byte(key), txn.startSeq) {
+			return nil, myerror.ErrTxnConflict
+		}
+	}
+	for _, key := range keys {
+		if t.modifiedSince(key, txn.startSeq) {
+			return nil, myerror.ErrTxnConflict
+		}
+	}
+
+	// 写入时间和序列号在写锁内生成，同一事务中的所有记录使用相同的时间和序列号
+	if ts, seq := t.writeTimestamp(), t.writeSeq(); ts != 0 || seq != 0 {
+		for i, rec := range records {
+			entry := rec.Entry()
+			entry.Timestamp, entry.Seq = ts, seq
+			records[i] = wal.NewEntryRecord(entry)
+		}
+	}
+
+	walBefore := t.curWal.Size()
+	commit, err := t.curWal.WriteBatchAsync(records)
+	if err != nil {
+		return nil, err
+	}
+	var userBytes int64
+	for _, rec := range records {
+		userBytes += int64(len(rec.Key) + len(rec.Value))
+	}
+	t.recordUserWrite(userBytes, walBefore)
+	var entries []kv.Entry
+	for _, rec := range records {
+		entry := rec.Entry()
+		if err := t.putMutable(entry); err != nil {
+			return nil, err
+		}
+		if t.watch.watching() {
+			entries = append(entries, entry)
+		}
+	}
+	seq := t.recordWrites(keys...)
+	t.watch.record(commit, seq, entries...)
+
+	if t.walFull() {
+		return commit, t.rotateWal(RotationWalSize)
+	}
+	return commit, nil
+}
+
+// Rollback 放弃事务中的所有写入，可以重复调用
+func (txn *Txn) Rollback() {
+	if txn.done {
+		return
+	}
+	txn.finish()
+}
+
+// finish 结束事务，并清理不再被任何活跃事务需要的key版本
+func (txn *Txn) finish() {
+	txn.done = true
+	t := txn.tree
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	if t.activeTxns[txn.startSeq]--; t.activeTxns[txn.startSeq] <= 0 {
+		delete(t.activeTxns, txn.startSeq)
+	}
+	t.pruneKeyVersions()
+}
+
+// modifiedSince 判断key在seq之后是否被提交修改过，调用方需持有t.mu
+func (t *LsmTree) modifiedSince(key []byte, seq uint64) bool {
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	return t.keyVersions[string(key)] > seq
+}
+
+// recordWrites 分配新的提交序列号并记录被修改的key，返回分配的序列号，调用方需持有t.mu的写锁
+// 没有活跃事务时无需记录版本
+func (t *LsmTree) recordWrites(keys ...[]byte) uint64 {
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	t.commitSeq++
+	if len(t.activeTxns) == 0 {
+		return t.commitSeq
+	}
+	for _, key := range keys {
+		t.keyVersions[string(key)] = t.commitSeq
+	}
+	return t.commitSeq
+}
+
+// pruneKeyVersions 删除不晚于最早活跃事务开始时间的版本，调用方需持有t.txnMu
+func (t *LsmTree) pruneKeyVersions() {
+	if len(t.activeTxns) == 0 {
+		clear(t.keyVersions)
+		return
+	}
+	oldest := t.commitSeq
+	for seq := range t.activeTxns {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	for key, seq := range t.keyVersions {
+		if seq <= oldest {
+			delete(t.keyVersions, key)
+		}
+	}
+}
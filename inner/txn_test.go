@@ -0,0 +1,294 @@
+package inner
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestTxn_CommitAndRollback(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Put([]byte("gone"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	txn := tree.BeginTxn()
+	if err := txn.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Delete([]byte("gone")); err != nil {
+		t.Fatal(err)
+	}
+	// 事务内可以读到自己的写入，事务外不可见
+	if v, err := txn.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("txn Get(a) = %q, %v", v, err)
+	}
+	if _, err := txn.Get([]byte("gone")); err != myerror.ErrKeyNotFound {
+		t.Fatalf("txn Get(gone) = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := tree.Get([]byte("a")); err != myerror.ErrKeyNotFound {
+		t.Fatalf("uncommitted write visible: %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := tree.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("Get(a) after commit = %q, %v", v, err)
+	}
+	if _, err := tree.Get([]byte("gone")); err != myerror.ErrKeyNotFound {
+		t.Fatalf("Get(gone) after commit = %v", err)
+	}
+	if err := txn.Commit(); err != myerror.ErrTxnDone {
+		t.Fatalf("second Commit = %v, want ErrTxnDone", err)
+	}
+
+	txn = tree.BeginTxn()
+	if err := txn.Put([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	txn.Rollback()
+	txn.Rollback()
+	if _, err := tree.Get([]byte("b")); err != myerror.ErrKeyNotFound {
+		t.Fatalf("rolled back write visible: %v", err)
+	}
+	if err := txn.Put([]byte("b"), []byte("2")); err != myerror.ErrTxnDone {
+		t.Fatalf("Put after Rollback = %v, want ErrTxnDone", err)
+	}
+}
+
+func TestTxn_Conflicts(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	t.Run("WriteWrite", func(t *testing.T) {
+		txn1, txn2 := tree.BeginTxn(), tree.BeginTxn()
+		txn1.Put([]byte("ww"), []byte("1"))
+		txn2.Put([]byte("ww"), []byte("2"))
+		if err := txn1.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := txn2.Commit(); err != myerror.ErrTxnConflict {
+			t.Fatalf("Commit = %v, want ErrTxnConflict", err)
+		}
+		if v, _ := tree.Get([]byte("ww")); string(v) != "1" {
+			t.Fatalf("ww = %q, want 1", v)
+		}
+	})
+
+	t.Run("ReadWrite", func(t *testing.T) {
+		tree.Put([]byte("rw"), []byte("0"))
+		txn1, txn2 := tree.BeginTxn(), tree.BeginTxn()
+		if _, err := txn1.Get([]byte("rw")); err != nil {
+			t.Fatal(err)
+		}
+		txn2.Put([]byte("rw"), []byte("1"))
+		if err := txn2.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		txn1.Put([]byte("other"), []byte("x"))
+		if err := txn1.Commit(); err != myerror.ErrTxnConflict {
+			t.Fatalf("Commit = %v, want ErrTxnConflict", err)
+		}
+		if _, err := tree.Get([]byte("other")); err != myerror.ErrKeyNotFound {
+			t.Fatalf("conflicting txn must not apply writes: %v", err)
+		}
+	})
+
+	t.Run("SnapshotRead", func(t *testing.T) {
+		txn := tree.BeginTxn()
+		defer txn.Rollback()
+		if err := tree.Put([]byte("snap"), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+		// 开始后被修改的key无法返回开始时的值，报告冲突
+		if _, err := txn.Get([]byte("snap")); err != myerror.ErrTxnConflict {
+			t.Fatalf("Get = %v, want ErrTxnConflict", err)
+		}
+	})
+
+	tree.txnMu.Lock()
+	defer tree.txnMu.Unlock()
+	if len(tree.activeTxns) != 0 || len(tree.keyVersions) != 0 {
+		t.Fatalf("txn state leaked: active=%v versions=%v", tree.activeTxns, tree.keyVersions)
+	}
+}
+
+func TestTxn_ReplayAfterReopen(t *testing.T) {
+	conf := newTestConfig(t)
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn := tree.BeginTxn()
+	txn.Put([]byte("x"), []byte("1"))
+	txn.Put([]byte("y"), []byte("2"))
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err = NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	for key, want := range map[string]string{"x": "1", "y": "2"} {
+		if v, err := tree.Get([]byte(key)); err != nil || string(v) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, v, err, want)
+		}
+	}
+}
+
+// updateTxn 以重试的方式执行事务，直到提交成功
+func updateTxn(tree *LsmTree, fn func(txn *Txn) error) error {
+	for {
+		txn := tree.BeginTxn()
+		err := fn(txn)
+		if err == nil {
+			err = txn.Commit()
+		} else {
+			txn.Rollback()
+		}
+		if err != myerror.ErrTxnConflict {
+			return err
+		}
+	}
+}
+
+func TestTxn_ConcurrentCounter(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.Logger = nil
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	key := []byte("counter")
+	if err := tree.Put(key, []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 10, 20
+	var wg sync.WaitGroup
+	for g := 0; g < workers; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				err := updateTxn(tree, func(txn *Txn) error {
+					v, err := txn.Get(key)
+					if err != nil {
+						return err
+					}
+					n, err := strconv.Atoi(string(v))
+					if err != nil {
+						return err
+					}
+					return txn.Put(key, []byte(strconv.Itoa(n+1)))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, err := tree.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != strconv.Itoa(workers*increments) {
+		t.Fatalf("counter = %s, want %d", v, workers*increments)
+	}
+}
+
+func TestTxn_TransferStress(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.Logger = nil
+	conf.WalSize = 4096
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const accounts, initial = 5, 100
+	account := func(i int) []byte { return []byte(fmt.Sprintf("acct_%d", i)) }
+	for i := 0; i < accounts; i++ {
+		if err := tree.Put(account(i), []byte(strconv.Itoa(initial))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < 50; i++ {
+				from, to := rng.Intn(accounts), rng.Intn(accounts)
+				if from == to {
+					continue
+				}
+				err := updateTxn(tree, func(txn *Txn) error {
+					a, err := txn.Get(account(from))
+					if err != nil {
+						return err
+					}
+					b, err := txn.Get(account(to))
+					if err != nil {
+						return err
+					}
+					x, _ := strconv.Atoi(string(a))
+					y, _ := strconv.Atoi(string(b))
+					txn.Put(account(from), []byte(strconv.Itoa(x-1)))
+					return txn.Put(account(to), []byte(strconv.Itoa(y+1)))
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(g))
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("transfer stress did not finish, possible deadlock")
+	}
+
+	total := 0
+	for i := 0; i < accounts; i++ {
+		v, err := tree.Get(account(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := strconv.Atoi(string(v))
+		total += n
+	}
+	if total != accounts*initial {
+		t.Fatalf("total = %d, want %d", total, accounts*initial)
+	}
+}
@@ -0,0 +1,174 @@
+package inner
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// Codec 在类型T和存储的字节之间转换。key的编码决定遍历顺序，需要按范围遍历时编码必须保持顺序
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// StringCodec 按字符串的字节存储，字典序与字符串比较一致
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// Uint64Codec 按8字节大端序存储，bytes.Compare的顺序与数值顺序一致
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("uint64 needs 8 bytes, got %d", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// JSONCodec 按JSON存储，不保持顺序，适合作为value的编码
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// TypedDB 以K和V读写LsmTree的包装，编解码失败返回包装了ErrCodec的错误，与存储错误区分
+type TypedDB[K, V any] struct {
+	tree       *LsmTree
+	keyCodec   Codec[K]
+	valueCodec Codec[V]
+}
+
+// Typed 返回以keyCodec和valueCodec编解码key和value的tree的包装
+func Typed[K, V any](tree *LsmTree, keyCodec Codec[K], valueCodec Codec[V]) *TypedDB[K, V] {
+	return &TypedDB[K, V]{tree: tree, keyCodec: keyCodec, valueCodec: valueCodec}
+}
+
+// codecError 包装编解码错误，op说明出错的操作
+func codecError(op string, err error) error {
+	return fmt.Errorf("%w: %s: %w", myerror.ErrCodec, op, err)
+}
+
+func (db *TypedDB[K, V]) encodeKey(key K) ([]byte, error) {
+	data, err := db.keyCodec.Encode(key)
+	if err != nil {
+		return nil, codecError("encode key", err)
+	}
+	return data, nil
+}
+
+// decode 解码遍历到的键值对
+func (db *TypedDB[K, V]) decode(key, value []byte) (K, V, error) {
+	var v V
+	k, err := db.keyCodec.Decode(key)
+	if err != nil {
+		return k, v, codecError(fmt.Sprintf("decode key %q", key), err)
+	}
+	if v, err = db.valueCodec.Decode(value); err != nil {
+		return k, v, codecError(fmt.Sprintf("decode value of %q", key), err)
+	}
+	return k, v, nil
+}
+
+// Get 读取key，key不存在时返回ErrKeyNotFound
+func (db *TypedDB[K, V]) Get(key K) (V, error) {
+	var v V
+	k, err := db.encodeKey(key)
+	if err != nil {
+		return v, err
+	}
+	value, err := db.tree.Get(k)
+	if err != nil {
+		return v, err
+	}
+	if v, err = db.valueCodec.Decode(value); err != nil {
+		return v, codecError(fmt.Sprintf("decode value of %q", k), err)
+	}
+	return v, nil
+}
+
+func (db *TypedDB[K, V]) Put(key K, value V) error {
+	k, err := db.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := db.valueCodec.Encode(value)
+	if err != nil {
+		return codecError("encode value", err)
+	}
+	// LsmTree.Put把nil value当作删除，编码结果为nil时按空value写入
+	if data == nil {
+		data = []byte{}
+	}
+	return db.tree.Put(k, data)
+}
+
+func (db *TypedDB[K, V]) Delete(key K) error {
+	k, err := db.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return db.tree.Delete(k)
+}
+
+// Scan 按编码后的key顺序遍历编码以prefix的编码开头的键值对，fn返回false时停止遍历。
+// 解码失败时停止遍历并返回包装了ErrCodec的错误
+func (db *TypedDB[K, V]) Scan(prefix K, fn func(key K, value V) bool) error {
+	p, err := db.encodeKey(prefix)
+	if err != nil {
+		return err
+	}
+	return db.scan(keyutil.PrefixRange(p), fn)
+}
+
+// Range 按编码后的key顺序遍历[start, end)范围内的键值对，key的编码需要保持顺序(如Uint64Codec)。
+// 只合并[start, end)编码范围内的数据，end不大于start时不产生结果
+func (db *TypedDB[K, V]) Range(start, end K, fn func(key K, value V) bool) error {
+	s, err := db.encodeKey(start)
+	if err != nil {
+		return err
+	}
+	e, err := db.encodeKey(end)
+	if err != nil {
+		return err
+	}
+	return db.scan(keyutil.Range{Start: s, End: e}, fn)
+}
+
+// scan 遍历rng范围内的键值对
+func (db *TypedDB[K, V]) scan(rng keyutil.Range, fn func(key K, value V) bool) error {
+	var decodeErr error
+	err := db.tree.scanRange(rng, func(key, value []byte) bool {
+		k, v, err := db.decode(key, value)
+		if err != nil {
+			decodeErr = err
+			return false
+		}
+		return fn(k, v)
+	})
+	if err != nil {
+		return err
+	}
+	return decodeErr
+}
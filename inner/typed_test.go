@@ -0,0 +1,188 @@
+package inner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+type user struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+// failingCodec 编码和解码总是失败
+type failingCodec struct{}
+
+func (failingCodec) Encode(string) ([]byte, error) { return nil, errors.New("boom") }
+
+func (failingCodec) Decode([]byte) (string, error) { return "", errors.New("boom") }
+
+// nilCodec 将空字符串编码为nil
+type nilCodec struct{}
+
+func (nilCodec) Encode(v string) ([]byte, error) {
+	if v == "" {
+		return nil, nil
+	}
+	return []byte(v), nil
+}
+
+func (nilCodec) Decode(data []byte) (string, error) { return string(data), nil }
+
+func TestTypedDB(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	users := Typed[string, user](tree, StringCodec{}, JSONCodec[user]{})
+	if err := users.Put("user:1", user{Name: "alice", Age: 30}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := users.Get("user:1"); err != nil || got != (user{Name: "alice", Age: 30}) {
+		t.Fatalf("Get = %+v, %v", got, err)
+	}
+	if err := users.Delete("user:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Get("user:1"); err != myerror.ErrKeyNotFound {
+		t.Fatalf("Get after Delete = %v, want ErrKeyNotFound", err)
+	}
+
+	// 数值顺序：9在10之前，范围为左闭右开
+	counters := Typed[uint64, string](tree, Uint64Codec{}, StringCodec{})
+	for _, n := range []uint64{1, 9, 10, 255, 256, 1 << 40} {
+		if err := counters.Put(n, fmt.Sprint(n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []uint64
+	if err := counters.Range(9, 256, func(key uint64, value string) bool {
+		got = append(got, key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[9 10 255]" {
+		t.Fatalf("Range(9, 256) = %v", got)
+	}
+
+	// 编码为nil的value按空value写入，不会删除key
+	empty := Typed[string, string](tree, StringCodec{}, nilCodec{})
+	if err := empty.Put("empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := tree.Get([]byte("empty")); err != nil || got == nil || len(got) != 0 {
+		t.Fatalf("Get of nil-encoded value = %q (nil=%v), %v, want empty value", got, got == nil, err)
+	}
+
+	// 编解码错误包装ErrCodec，存储错误不包装
+	broken := Typed[string, string](tree, StringCodec{}, failingCodec{})
+	if err := broken.Put("k", "v"); !errors.Is(err, myerror.ErrCodec) {
+		t.Fatalf("Put with failing codec = %v", err)
+	}
+	if err := tree.Put([]byte("k"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broken.Get("k"); !errors.Is(err, myerror.ErrCodec) {
+		t.Fatalf("Get with failing codec = %v", err)
+	}
+	if err := counters.Scan(0, func(uint64, string) bool { return true }); err != nil {
+		t.Fatalf("Scan of 8 byte prefix = %v", err)
+	}
+	// 遍历到不是8字节的key时解码失败
+	if err := counters.Range(0, 1<<63, func(uint64, string) bool { return true }); !errors.Is(err, myerror.ErrCodec) {
+		t.Fatalf("Range over foreign keys = %v, want ErrCodec", err)
+	}
+	if _, err := users.Get("user:2"); errors.Is(err, myerror.ErrCodec) {
+		t.Fatal("storage error reported as codec error")
+	}
+}
+
+func TestUint64CodecOrder(t *testing.T) {
+	codec := Uint64Codec{}
+	prev, _ := codec.Encode(0)
+	for _, n := range []uint64{1, 9, 10, 99, 100, 1 << 32, 1<<64 - 1} {
+		data, _ := codec.Encode(n)
+		if string(prev) >= string(data) {
+			t.Fatalf("encoding of %d does not sort after its predecessor", n)
+		}
+		if back, err := codec.Decode(data); err != nil || back != n {
+			t.Fatalf("Decode = %d, %v, want %d", back, err, n)
+		}
+		prev = data
+	}
+	if _, err := codec.Decode([]byte{1, 2}); err == nil {
+		t.Fatal("expected short data to fail")
+	}
+}
+
+// openExampleTree 在临时目录中打开不输出日志的LsmTree
+func openExampleTree() (*LsmTree, func()) {
+	dir, err := os.MkdirTemp("", "typed-example")
+	if err != nil {
+		panic(err)
+	}
+	conf := config.DefaultConfig()
+	conf.DataDir = dir
+	conf.IsDebug = false
+	conf.Logger = nil
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		panic(err)
+	}
+	return tree, func() {
+		tree.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func ExampleTyped() {
+	tree, cleanup := openExampleTree()
+	defer cleanup()
+
+	type Profile struct {
+		Name  string   `json:"name"`
+		Langs []string `json:"langs"`
+	}
+	profiles := Typed[string, Profile](tree, StringCodec{}, JSONCodec[Profile]{})
+	profiles.Put("user:ada", Profile{Name: "Ada", Langs: []string{"go", "rust"}})
+	profiles.Put("user:bob", Profile{Name: "Bob"})
+	profiles.Put("team:core", Profile{Name: "Core"})
+
+	p, _ := profiles.Get("user:ada")
+	fmt.Printf("%s %v\n", p.Name, p.Langs)
+	profiles.Scan("user:", func(key string, p Profile) bool {
+		fmt.Println(key, p.Name)
+		return true
+	})
+	// Output:
+	// Ada [go rust]
+	// user:ada Ada
+	// user:bob Bob
+}
+
+func ExampleTypedDB_Range() {
+	tree, cleanup := openExampleTree()
+	defer cleanup()
+
+	// Uint64Codec按大端序编码，按字节比较的顺序就是数值顺序，9在10之前
+	orders := Typed[uint64, string](tree, Uint64Codec{}, StringCodec{})
+	for _, id := range []uint64{10, 2, 9, 100, 11} {
+		orders.Put(id, fmt.Sprintf("order-%d", id))
+	}
+	orders.Range(9, 100, func(id uint64, order string) bool {
+		fmt.Println(id, order)
+		return true
+	})
+	// Output:
+	// 9 order-9
+	// 10 order-10
+	// 11 order-11
+}
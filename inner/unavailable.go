@@ -0,0 +1,105 @@
+package inner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aixiasang/lsm/inner/keyutil"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/utils"
+)
+
+// unavailableSuffix 隔离目录中记录被隔离文件的key范围的文件后缀，删除该文件后范围不再视为不可用
+const unavailableSuffix = ".range"
+
+// unavailableRange 按CorruptFileQuarantine隔离的SST文件在清单中记录的key范围，打开后只读，不需要加锁
+type unavailableRange struct {
+	Level  int    `json:"level"`
+	Seq    uint32 `json:"seq"`
+	Path   string `json:"path"` // 隔离前相对SST目录的路径
+	MinKey []byte `json:"min_key"`
+	MaxKey []byte `json:"max_key"`
+}
+
+// newerThan 判断被隔离的文件是否比level层序列号为seq的文件新。L0按序列号排列；
+// 更深的层都视为更旧，压缩移到更深层的新数据同样不能覆盖被隔离的文件
+func (r unavailableRange) newerThan(level int, seq uint32) bool {
+	return r.Level < level || r.Level == level && r.Seq > seq
+}
+
+// markUnavailable 记录被隔离的file的key范围并写入隔离目录，重启后仍然有效。file不是从清单载入时没有key范围，其中的数据视为不存在
+func (t *LsmTree) markUnavailable(file *sstFile) error {
+	if file.meta == nil || len(file.meta.MaxKey) == 0 {
+		t.conf.Warnf("key range of quarantined sst %s is unknown, treating it as absent", file.filePath)
+		return nil
+	}
+	r := unavailableRange{
+		Level:  file.level,
+		Seq:    file.seq,
+		Path:   t.sstRelPath(file.filePath),
+		MinKey: file.meta.MinKey,
+		MaxKey: file.meta.MaxKey,
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(quarantineTarget(t.conf.QuarantinePath(), r.Path)+unavailableSuffix, data); err != nil {
+		return err
+	}
+	t.conf.Errorf("keys in [%q, %q] of quarantined sst %s are unavailable", r.MinKey, r.MaxKey, file.filePath)
+	t.unavailable = append(t.unavailable, r)
+	return nil
+}
+
+// loadUnavailable 读取之前打开时记录在隔离目录中的不可用范围
+func (t *LsmTree) loadUnavailable() error {
+	entries, err := os.ReadDir(t.conf.QuarantinePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), unavailableSuffix) || !entry.Type().IsRegular() {
+			continue
+		}
+		path := filepath.Join(t.conf.QuarantinePath(), entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var r unavailableRange
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("%w: unavailable range %s: %v", myerror.ErrSSTCorrupted, path, err)
+		}
+		t.unavailable = append(t.unavailable, r)
+	}
+	return nil
+}
+
+// unavailableKey 返回key落在比level层序列号为seq的文件更新的不可用范围内时的错误，否则返回nil。
+// level为len(t.nodes)时表示没有在任何SST文件中找到key
+func (t *LsmTree) unavailableKey(key []byte, level int, seq uint32) error {
+	for _, r := range t.unavailable {
+		if r.newerThan(level, seq) && bytes.Compare(key, r.MinKey) >= 0 && bytes.Compare(key, r.MaxKey) <= 0 {
+			return fmt.Errorf("%w: key %q is in [%q, %q] of quarantined sst %s", myerror.ErrRangeUnavailable, key, r.MinKey, r.MaxKey, r.Path)
+		}
+	}
+	return nil
+}
+
+// unavailableScan 返回rng与某个不可用范围重叠时的错误，否则返回nil
+func (t *LsmTree) unavailableScan(rng keyutil.Range) error {
+	for _, r := range t.unavailable {
+		if rng.Overlaps(r.MinKey, r.MaxKey) {
+			return fmt.Errorf("%w: scan overlaps [%q, %q] of quarantined sst %s", myerror.ErrRangeUnavailable, r.MinKey, r.MaxKey, r.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package utils
+
+import "github.com/aixiasang/lsm/inner/fsio"
+
+// WriteFileAtomic 先写入临时文件并fsync再重命名，保证path要么是旧内容要么是完整的新内容
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	fp, err := fsio.Create(tmp, fsio.Positional)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return fsio.AtomicRename(tmp, path)
+}
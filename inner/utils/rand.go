@@ -11,10 +11,11 @@ func GetKey(n int) []byte {
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
-func GetValue(length int) []byte {
+// GetValue 使用rng生成length字节的随机字母，rng通常由Config.NewRand创建以便复现
+func GetValue(rng *rand.Rand, length int) []byte {
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		b[i] = letterBytes[rng.Intn(len(letterBytes))]
 	}
 	return b
 }
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package utils
+
+// SyncDir 在不支持同步目录的平台上不做任何事
+func SyncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// SyncDir fsync目录dir，使其中文件的创建、重命名和删除在断电后仍然有效。
+// 不支持同步目录的文件系统返回EINVAL，视为成功
+func SyncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fp.Sync()
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		return nil
+	}
+	return err
+}
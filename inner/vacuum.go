@@ -0,0 +1,230 @@
+package inner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// VacuumProgress Vacuum的进度，见config.VacuumProgress
+type VacuumProgress = config.VacuumProgress
+
+// GarbageStats 各层可回收空间的估算，由GarbageReport返回
+type GarbageStats struct {
+	Levels           []LevelGarbage // 各层的估算，包括空的层
+	TotalBytes       int64          // 所有SST文件的总大小
+	ReclaimableBytes int64          // 各层可回收字节数之和
+	RetainedEntries  int64          // TombstoneRetention保留期内的删除前版本数，保留期结束前其删除标记和保留记录都不会被回收
+	RetainedBytes    int64          // 保留的删除前版本的key和value总字节数，包括内存表中的
+}
+
+// LevelGarbage 一层SST文件的可回收空间估算
+type LevelGarbage struct {
+	Level            int   // 层级
+	Files            int   // 文件数
+	Bytes            int64 // 文件总大小
+	Entries          int64 // 条目数，包括删除标记
+	Tombstones       int64 // 删除标记数
+	Superseded       int64 // 估计被更新的文件覆盖的条目数
+	ReclaimableBytes int64 // 删除标记和被覆盖的条目按文件的平均条目大小估计的字节数
+}
+
+// vacuumRequest 交给压缩goroutine执行的Vacuum
+type vacuumRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// GarbageReport 根据SST文件属性估算各层可回收的空间。删除标记全部计为可回收；被覆盖的条目数按更新的文件
+// (更浅的层以及同一层中序列号更大的文件)的条目数乘以其key范围与本文件重叠的比例估计，假设条目在key范围内均匀分布
+// 且重叠部分的key都存在于本文件中，因此是上限估计，不超过本文件中不是删除标记的条目数。没有属性的旧文件不计入。
+// 开启TombstoneRetention时同时统计保留的删除前版本占用的空间
+func (t *LsmTree) GarbageReport() GarbageStats {
+	var report GarbageStats
+	if t.conf.TombstoneRetention > 0 {
+		var err error
+		if report.RetainedEntries, report.RetainedBytes, err = t.retainedUsage(); err != nil {
+			t.conf.Warnf("garbage report: scan retained values: %v", err)
+		}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	report.Levels = make([]LevelGarbage, len(t.nodes))
+	for level, nodes := range t.nodes {
+		garbage := &report.Levels[level]
+		garbage.Level = level
+		garbage.Files = len(nodes)
+		for i, node := range nodes {
+			props := node.Reader().Properties()
+			garbage.Bytes += node.GetSize()
+			if props.Entries == 0 {
+				continue
+			}
+			garbage.Entries += props.Entries
+			garbage.Tombstones += props.Tombstones
+			newer := slices.Concat(slices.Concat(t.nodes[:level]...), nodes[i+1:])
+			superseded := min(supersededEntries(node, newer), props.Entries-props.Tombstones)
+			garbage.Superseded += superseded
+			garbage.ReclaimableBytes += node.GetSize() * (props.Tombstones + superseded) / props.Entries
+		}
+		report.TotalBytes += garbage.Bytes
+		report.ReclaimableBytes += garbage.ReclaimableBytes
+	}
+	return report
+}
+
+// supersededEntries 估计newer中与node的key范围重叠的条目数
+func supersededEntries(node *sst.Node, newer []*sst.Node) int64 {
+	var n float64
+	for _, item := range newer {
+		entries := item.Reader().Properties().Entries
+		n += float64(entries) * rangeOverlap(item.GetMinKey(), item.GetMaxKey(), node.GetMinKey(), node.GetMaxKey())
+	}
+	return int64(n)
+}
+
+// rangeOverlap 估计[minA, maxA]中落在[minB, maxB]内的比例，key按去掉A的公共前缀后的前8个字节映射为数值
+func rangeOverlap(minA, maxA, minB, maxB []byte) float64 {
+	lo, hi := minA, maxA
+	if bytes.Compare(minB, lo) > 0 {
+		lo = minB
+	}
+	if bytes.Compare(maxB, hi) < 0 {
+		hi = maxB
+	}
+	if bytes.Compare(lo, hi) > 0 {
+		return 0
+	}
+	prefix := 0
+	for prefix < len(minA) && prefix < len(maxA) && minA[prefix] == maxA[prefix] {
+		prefix++
+	}
+	width := keyPosition(maxA, prefix) - keyPosition(minA, prefix)
+	if width <= 0 {
+		// A只有一个key或前8个字节无法区分
+		return 1
+	}
+	return (keyPosition(hi, prefix) - keyPosition(lo, prefix)) / width
+}
+
+// keyPosition 将key在prefix之后的前8个字节映射为[0, 1)中的数值，保持字典序
+func keyPosition(key []byte, prefix int) float64 {
+	var pos float64
+	scale := 1.0
+	for i := prefix; i < prefix+8; i++ {
+		scale /= 256
+		if i < len(key) {
+			pos += float64(key[i]) * scale
+		}
+	}
+	return pos
+}
+
+// expire 将在now之前过期的条目转换为删除标记，使其覆盖更旧的版本，now为0时不处理
+func expire(entry kv.Entry, now int64) kv.Entry {
+	if now == 0 || entry.IsDelete() || !entry.Expired(now) {
+		return entry
+	}
+	return kv.Entry{Key: entry.Key, Kind: kv.KindDelete, Seq: entry.Seq, Timestamp: entry.Timestamp}
+}
+
+// Vacuum 将各层依次合并到最底层，丢弃所有可以丢弃的删除标记和过期条目，用于大量删除后回收空间。
+// 开启VacuumRewriteBottomLevel时最后再重写一次最底层的每个文件。在压缩goroutine中执行，与刷盘和其他压缩串行，
+// 写入使用压缩限速器；每完成一步后调用OnVacuumProgress，并检查ctx，ctx取消时在当前步完成后返回ctx.Err()，
+// 已完成的步骤保留。可变内存表中的数据不在处理范围内
+func (t *LsmTree) Vacuum(ctx context.Context) error {
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+	req := vacuumRequest{ctx: ctx, done: make(chan error, 1)}
+	select {
+	case t.vacuumCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.stopCh:
+		return myerror.ErrDBClosed
+	}
+	return <-req.done
+}
+
+// runVacuum 执行Vacuum，只在压缩goroutine中调用
+func (t *LsmTree) runVacuum(ctx context.Context) error {
+	// 先刷盘不可变内存表，使L0中的文件都可以移到下一层
+	if err := t.flushPending(math.MaxUint32); err != nil {
+		return err
+	}
+	now := t.conf.Now().UnixNano()
+	t.mu.RLock()
+	bottom := len(t.nodes) - 1
+	progress := VacuumProgress{Total: bottom, BytesBefore: nodesSize(slices.Concat(t.nodes...))}
+	t.mu.RUnlock()
+	if t.conf.VacuumRewriteBottomLevel {
+		progress.Total++
+	}
+	step := func(level int) error {
+		t.mu.RLock()
+		progress.BytesNow = nodesSize(slices.Concat(t.nodes...))
+		t.mu.RUnlock()
+		progress.Level = level
+		progress.Done++
+		if t.conf.OnVacuumProgress != nil {
+			t.conf.OnVacuumProgress(progress)
+		}
+		return t.vacuumCanceled(ctx)
+	}
+
+	if err := t.vacuumCanceled(ctx); err != nil {
+		return err
+	}
+	for level := 0; level < bottom; level++ {
+		t.mu.RLock()
+		inputs := t.nodes[level]
+		if level == 0 {
+			inputs = t.settledL0()
+		}
+		inputs = slices.Clone(inputs)
+		var overlaps []*sst.Node
+		if len(inputs) > 0 {
+			overlaps = t.nextLevelOverlaps(level, inputs)
+		}
+		t.mu.RUnlock()
+		if len(inputs) > 0 {
+			if _, err := t.compactLevel(level, inputs, overlaps, now); err != nil {
+				return fmt.Errorf("vacuum level %d: %w", level, err)
+			}
+		}
+		if err := step(level); err != nil {
+			return err
+		}
+	}
+	if !t.conf.VacuumRewriteBottomLevel {
+		return nil
+	}
+	t.mu.RLock()
+	nodes := slices.Clone(t.nodes[bottom])
+	t.mu.RUnlock()
+	for _, node := range nodes {
+		if err := t.vacuumCanceled(ctx); err != nil {
+			return err
+		}
+		if _, _, _, err := t.rewriteNodeAt(node, true, now); err != nil {
+			return fmt.Errorf("vacuum bottom level %s: %w", node.GetFilename(), err)
+		}
+	}
+	return step(bottom)
+}
+
+// vacuumCanceled 检查Vacuum是否应当停止
+func (t *LsmTree) vacuumCanceled(ctx context.Context) error {
+	if t.closed.Load() {
+		return myerror.ErrDBClosed
+	}
+	return ctx.Err()
+}
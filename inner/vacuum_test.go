@@ -0,0 +1,185 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/kv"
+)
+
+func TestRangeOverlap(t *testing.T) {
+	for _, c := range []struct {
+		minA, maxA, minB, maxB string
+		want                   float64
+	}{
+		{"a", "c", "a", "c", 1},
+		{"a", "c", "d", "f", 0},
+		{"a", "e", "a", "c", 0.5},
+		{"a", "e", "c", "z", 0.5},
+		{"key10", "key30", "key20", "key99", 0.5}, // 去掉公共前缀key后比较
+		{"b", "b", "a", "c", 1},                   // A只有一个key
+	} {
+		a := func(s string) []byte { return []byte(s) }
+		got := rangeOverlap(a(c.minA), a(c.maxA), a(c.minB), a(c.maxB))
+		if math.Abs(got-c.want) > 0.05 {
+			t.Errorf("rangeOverlap([%s, %s], [%s, %s]) = %.3f, want %.3f", c.minA, c.maxA, c.minB, c.maxB, got, c.want)
+		}
+	}
+}
+
+// TestLsmTree_Vacuum 删除95%的key后Vacuum，磁盘占用降到剩余数据的大小，剩余的key不变
+func TestLsmTree_Vacuum(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AutoSync = false
+	conf.WalSize = 8 << 20
+	conf.LevelSize = 3
+	conf.VacuumRewriteBottomLevel = true
+	var steps []VacuumProgress
+	conf.OnVacuumProgress = func(p VacuumProgress) { steps = append(steps, p) }
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	const total, every = 100000, 20 // 每20个key保留一个
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	value := func(i int) []byte { return []byte(fmt.Sprintf("value-%06d-0123456789abcdef", i)) }
+	for i := 0; i < total; i++ {
+		if err := tree.Put(key(i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flushAll(t, tree)
+	putBytes := tree.Stats().LiveSSTBytes
+	for i := 0; i < total; i++ {
+		if i%every != 0 {
+			if err := tree.Delete(key(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flushAll(t, tree)
+
+	before := tree.Stats().LiveSSTBytes
+	expected := putBytes / every
+	report := tree.GarbageReport()
+	if want := before - expected; report.TotalBytes != before || report.ReclaimableBytes < want*8/10 || report.ReclaimableBytes > want*12/10 {
+		t.Fatalf("report total %d reclaimable %d, want %d and about %d", report.TotalBytes, report.ReclaimableBytes, before, want)
+	}
+	if report.Levels[0].Tombstones != total-total/every {
+		t.Fatalf("L0 tombstones = %d", report.Levels[0].Tombstones)
+	}
+
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	after := tree.Stats().LiveSSTBytes
+	if after < expected/2 || after > expected*3/2 {
+		t.Fatalf("live sst bytes %d -> %d, want about %d", before, after, expected)
+	}
+	levels := tree.Levels()
+	for _, level := range levels[:2] {
+		if len(level.Files) != 0 {
+			t.Fatalf("L%d still has %d files", level.Level, len(level.Files))
+		}
+	}
+	if files := levels[2].Files; len(files) != 1 || files[0].EntryCount != total/every {
+		t.Fatalf("bottom level files %+v, want one file with %d entries", files, total/every)
+	}
+	if report := tree.GarbageReport(); report.ReclaimableBytes != 0 {
+		t.Fatalf("reclaimable %d bytes after vacuum", report.ReclaimableBytes)
+	}
+	if len(steps) != 3 || steps[2].Done != 3 || steps[2].Total != 3 || steps[2].BytesBefore != before || steps[2].BytesNow != after {
+		t.Fatalf("progress %+v", steps)
+	}
+
+	for i := 0; i < total; i++ {
+		got, err := tree.Get(key(i))
+		if i%every != 0 {
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Fatalf("Get(%s) = %q, %v, want deleted", key(i), got, err)
+			}
+			continue
+		}
+		if err != nil || string(got) != string(value(i)) {
+			t.Fatalf("Get(%s) = %q, %v", key(i), got, err)
+		}
+	}
+}
+
+// ctx取消后在当前步完成时返回，已完成的步骤保留
+func TestLsmTree_VacuumCanceled(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var steps []VacuumProgress
+	conf.OnVacuumProgress = func(p VacuumProgress) {
+		steps = append(steps, p)
+		cancel()
+	}
+	writeLevelSST(t, conf, 0, 1, map[string]string{"a": "new"})
+	writeLevelSST(t, conf, 2, 1, map[string]string{"a": "old", "b": "old"})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Vacuum(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Vacuum = %v, want context.Canceled", err)
+	}
+	if len(steps) != 1 || steps[0].Level != 0 || steps[0].Total != 2 {
+		t.Fatalf("progress %+v, want only the L0 step", steps)
+	}
+	if levels := tree.Levels(); len(levels[0].Files) != 0 || len(levels[1].Files) != 1 || len(levels[2].Files) != 1 {
+		t.Fatalf("levels %+v after canceled vacuum", levels)
+	}
+	if err := tree.Vacuum(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Vacuum with canceled ctx = %v", err)
+	}
+	for key, want := range map[string]string{"a": "new", "b": "old"} {
+		if got, err := tree.Get([]byte(key)); err != nil || string(got) != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Vacuum(context.Background()); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Vacuum after close = %v, want ErrDBClosed", err)
+	}
+}
+
+// 过期的条目按删除标记处理，同时覆盖更旧的版本；未过期的条目保留
+func TestLsmTree_VacuumExpired(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.LevelSize = 2
+	writeLevelSST(t, conf, 1, 1, map[string]string{"expired": "old", "live": "old"})
+	writeLevelEntries(t, conf, 0, 1, []kv.Entry{
+		{Key: []byte("expired"), Value: []byte("new"), TTL: 1},
+		{Key: []byte("live"), Value: []byte("new"), TTL: math.MaxInt64},
+	})
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	if err := tree.Vacuum(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("expired")); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("Get(expired) = %v, want not found", err)
+	}
+	if got, err := tree.Get([]byte("live")); err != nil || string(got) != "new" {
+		t.Fatalf("Get(live) = %q, %v", got, err)
+	}
+	if files := tree.Levels()[1].Files; len(files) != 1 || files[0].EntryCount != 1 {
+		t.Fatalf("bottom level files %+v, want one file with one entry", files)
+	}
+}
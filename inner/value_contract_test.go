@@ -0,0 +1,198 @@
+package inner
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// contractValues 必须原样读回的value：空value、单个0字节，以及与内部编码中的标记相同的字节
+var contractValues = map[string][]byte{
+	"empty":       {},
+	"zero":        {0},
+	"zeros8":      make([]byte, 8), // 带时间戳的删除记录的value区域只有8字节时间戳
+	"namespace":   []byte(namespaceMarker),
+	"retained":    []byte(retainedMarker),
+	"kind-put":    {byte(kv.KindPut)},
+	"kind-delete": {byte(kv.KindDelete)},
+	"rec-delete":  {byte(wal.RecordTypeDelete)},
+	"rec-del-ts":  append([]byte{byte(wal.RecordTypeDeleteTS)}, binary.BigEndian.AppendUint64(nil, 1)...),
+	"rec-batch":   {byte(wal.RecordTypeDeleteBatch), 0, 0, 0, 0},
+}
+
+// TestLsmTree_ValueContract Put后Get原样返回value，Delete后Get返回ErrKeyNotFound，在内存表中、刷盘后、
+// 合并到最底层后和重启后都成立，与内存表类型、缓存、读取方式和WAL模式无关。nil value按删除处理
+func TestLsmTree_ValueContract(t *testing.T) {
+	variants := map[string]func(conf *config.Config){
+		"btree":    func(conf *config.Config) {},
+		"skiplist": func(conf *config.Config) { conf.MemTableType = config.MemTableTypeSkipList },
+		"caches": func(conf *config.Config) {
+			conf.BlockCacheSize = 1 << 20
+			conf.RowCacheSize = 1 << 20
+		},
+		"mmap":       func(conf *config.Config) { conf.SSTReadMode = config.SSTReadMmap },
+		"checksum":   func(conf *config.Config) { conf.PerEntryChecksum = true },
+		"shared-wal": func(conf *config.Config) { conf.WALMode = config.WALModeShared },
+	}
+	for name, configure := range variants {
+		t.Run(name, func(t *testing.T) {
+			conf := newTestConfig(t)
+			configure(conf)
+			tree, err := NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { tree.Close() }()
+
+			// live中的key应读回对应的value，deleted中的key应不存在
+			live := make(map[string][]byte)
+			deleted := make(map[string]bool)
+			check := func(state string) {
+				t.Helper()
+				for key, want := range live {
+					got, err := tree.Get([]byte(key))
+					if err != nil || got == nil || !bytes.Equal(got, want) {
+						t.Fatalf("%s: Get(%s) = %q (nil=%v), %v, want %q", state, key, got, got == nil, err, want)
+					}
+				}
+				for key := range deleted {
+					if got, err := tree.Get([]byte(key)); !errors.Is(err, ErrKeyNotFound) {
+						t.Fatalf("%s: Get(%s) = %q, %v, want ErrKeyNotFound", state, key, got, err)
+					}
+				}
+				keys := make([][]byte, 0, len(live))
+				for key := range live {
+					keys = append(keys, []byte(key))
+				}
+				values, errs := tree.MultiGet(keys)
+				for i, key := range keys {
+					if errs[i] != nil || values[i] == nil || !bytes.Equal(values[i], live[string(key)]) {
+						t.Fatalf("%s: MultiGet(%s) = %q, %v, want %q", state, key, values[i], errs[i], live[string(key)])
+					}
+				}
+				ns := tree.Namespace("contract")
+				for name, want := range contractValues {
+					if got, err := ns.Get([]byte(name)); err != nil || got == nil || !bytes.Equal(got, want) {
+						t.Fatalf("%s: Namespace.Get(%s) = %q, %v, want %q", state, name, got, err, want)
+					}
+				}
+				scanned := make(map[string][]byte)
+				if err := tree.PrefixScan(nil, func(key, value []byte) bool {
+					if !bytes.HasPrefix(key, []byte(namespaceMarker)) {
+						scanned[string(key)] = bytes.Clone(value)
+					}
+					return true
+				}); err != nil {
+					t.Fatal(err)
+				}
+				if len(scanned) != len(live) {
+					t.Fatalf("%s: PrefixScan returned %d keys, want %d", state, len(scanned), len(live))
+				}
+				for key, want := range live {
+					if got, ok := scanned[key]; !ok || !bytes.Equal(got, want) {
+						t.Fatalf("%s: PrefixScan %s = %q, want %q", state, key, got, want)
+					}
+				}
+			}
+			put := func(prefix string) {
+				t.Helper()
+				for name, value := range contractValues {
+					key := prefix + name
+					if err := tree.Put([]byte(key), value); err != nil {
+						t.Fatal(err)
+					}
+					live[key] = value
+				}
+			}
+			remove := func(prefix string) {
+				t.Helper()
+				for name := range contractValues {
+					key := prefix + name
+					if err := tree.Delete([]byte(key)); err != nil {
+						t.Fatal(err)
+					}
+					delete(live, key)
+					deleted[key] = true
+				}
+			}
+			flush := func() {
+				t.Helper()
+				if err := tree.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// 同一个内存表中写入后删除，以及删除已经刷盘的key
+			put("mem-del/")
+			remove("mem-del/")
+			put("sst-del/")
+			put("live/")
+			// 事务和命名空间中的写入同样原样保存
+			txn := tree.BeginTxn()
+			for name, value := range contractValues {
+				key := "txn/" + name
+				if err := txn.Put([]byte(key), value); err != nil {
+					t.Fatal(err)
+				}
+				if got, err := txn.Get([]byte(key)); err != nil || got == nil || !bytes.Equal(got, value) {
+					t.Fatalf("txn.Get(%s) = %q, %v, want %q", key, got, err, value)
+				}
+				live[key] = value
+			}
+			if err := txn.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			ns := tree.Namespace("contract")
+			for name, value := range contractValues {
+				if err := ns.Put([]byte(name), value); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// nil value等同于Delete
+			for _, key := range []string{"nil/after-put", "nil/never-put"} {
+				if key == "nil/after-put" {
+					if err := tree.Put([]byte(key), []byte("v")); err != nil {
+						t.Fatal(err)
+					}
+				}
+				if err := tree.Put([]byte(key), nil); err != nil {
+					t.Fatalf("Put(%s, nil) = %v, want treated as delete", key, err)
+				}
+				deleted[key] = true
+			}
+			check("memtable")
+
+			flush()
+			remove("sst-del/")
+			check("memtable over sst")
+			flush()
+			check("flushed")
+
+			if err := tree.Vacuum(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			check("compacted")
+
+			// 只在WAL中的写入和删除在重启时重放
+			put("wal/")
+			put("wal-del/")
+			remove("wal-del/")
+			if err := tree.Close(); err != nil {
+				t.Fatal(err)
+			}
+			tree, err = NewLsmTree(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("restarted")
+			flush()
+			check("restarted and flushed")
+		})
+	}
+}
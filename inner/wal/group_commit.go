@@ -0,0 +1,138 @@
+package wal
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Commit 一次组提交，加入同一组的所有写入共享一次write+fsync的结果
+type Commit struct {
+	done chan struct{} // 提交完成后关闭
+	err  error         // 写入或fsync的错误
+}
+
+// Wait 等待记录持久化，返回该组写入或fsync的错误。nil的Commit表示写入已同步完成
+func (c *Commit) Wait() error {
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	return c.err
+}
+
+// groupCommit 将并发写入的记录合并，每GroupCommitInterval或待写入数据达到GroupCommitBytes时
+// 由提交goroutine统一执行一次write+fsync并唤醒该组所有等待者。每个WAL文件有独立的提交组，
+// 因此一个组不会跨越两个WAL文件
+type groupCommit struct {
+	wal      *Wal          // 所属WAL
+	interval time.Duration // 最长等待时间
+	maxBytes int           // 待写入数据上限
+	mu       sync.Mutex    // 保护pending、current和stopped
+	pending  []byte        // 当前组待写入的数据
+	current  *Commit       // 当前正在收集的组
+	stopped  bool          // 是否已停止接收写入
+	ioMu     sync.Mutex    // 保证各组按顺序写入文件
+	wake     chan struct{} // 新的组开始收集
+	full     chan struct{} // 待写入数据达到上限
+	quit     chan struct{} // 停止提交goroutine
+	done     chan struct{} // 提交goroutine已退出
+	stopOnce sync.Once
+}
+
+func newGroupCommit(w *Wal) *groupCommit {
+	g := &groupCommit{
+		wal:      w,
+		interval: w.conf.GroupCommitInterval,
+		maxBytes: w.conf.GroupCommitBytes,
+		wake:     make(chan struct{}, 1),
+		full:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// append 将编码后的记录加入当前组
+func (g *groupCommit) append(encoded []byte) (*Commit, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stopped {
+		return nil, os.ErrClosed
+	}
+	if g.current == nil {
+		g.current = &Commit{done: make(chan struct{})}
+		notify(g.wake)
+	}
+	g.pending = append(g.pending, encoded...)
+	g.wal.addOffset(len(encoded))
+	if g.maxBytes > 0 && len(g.pending) >= g.maxBytes {
+		notify(g.full)
+	}
+	return g.current, nil
+}
+
+// run 提交goroutine，组开始收集后等待interval或数据达到上限再提交
+func (g *groupCommit) run() {
+	defer close(g.done)
+	for {
+		select {
+		case <-g.wake:
+		case <-g.quit:
+			return
+		}
+		timer := g.wal.conf.GetClock().NewTimer(g.interval)
+		select {
+		case <-timer.C():
+		case <-g.full:
+			timer.Stop()
+		case <-g.quit:
+			timer.Stop()
+			return
+		}
+		g.flush()
+	}
+}
+
+// flush 立即提交当前组，错误同时返回给该组的所有等待者
+func (g *groupCommit) flush() error {
+	if g == nil {
+		return nil
+	}
+	g.ioMu.Lock()
+	defer g.ioMu.Unlock()
+	g.mu.Lock()
+	data, commit := g.pending, g.current
+	g.pending, g.current = nil, nil
+	g.mu.Unlock()
+	if commit == nil {
+		return nil
+	}
+	commit.err = g.wal.writeGroup(data)
+	close(commit.done)
+	return commit.err
+}
+
+// stop 停止接收写入并提交剩余数据，可以重复调用
+func (g *groupCommit) stop() {
+	if g == nil {
+		return
+	}
+	g.stopOnce.Do(func() {
+		close(g.quit)
+		<-g.done
+		g.mu.Lock()
+		g.stopped = true
+		g.mu.Unlock()
+		g.flush()
+	})
+}
+
+// notify 非阻塞地发送通知
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/memtable"
+)
+
+func newGroupCommitConfig(t *testing.T) *config.Config {
+	t.Helper()
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	conf.AutoSync = true
+	conf.GroupCommitInterval = time.Millisecond
+	if err := os.MkdirAll(conf.WalPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestGroupCommitConcurrentWrites(t *testing.T) {
+	conf := newGroupCommitConfig(t)
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := w.Write([]byte(fmt.Sprintf("key-%d-%d", g, i)), []byte("v")); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// 所有写入返回后数据必须已经写入文件
+	info, err := os.Stat(w.fp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(w.Size()) {
+		t.Fatalf("file size %d, want %d", info.Size(), w.Size())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	mem := memtable.NewMemTable(memtable.MemTableTypeBTree, 16)
+	if err := replay.ReadAll(mem); err != nil {
+		t.Fatal(err)
+	}
+	for g := 0; g < 16; g++ {
+		for i := 0; i < 50; i++ {
+			if _, err := mem.Get([]byte(fmt.Sprintf("key-%d-%d", g, i))); err != nil {
+				t.Fatalf("key-%d-%d not replayed: %v", g, i, err)
+			}
+		}
+	}
+}
+
+func TestGroupCommitBytesTrigger(t *testing.T) {
+	conf := newGroupCommitConfig(t)
+	conf.GroupCommitInterval = time.Hour
+	conf.GroupCommitBytes = 1
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- w.Write([]byte("k"), []byte("v")) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write was not committed when the batch reached GroupCommitBytes")
+	}
+}
+
+func TestGroupCommitErrorPropagation(t *testing.T) {
+	conf := newGroupCommitConfig(t)
+	conf.GroupCommitInterval = 50 * time.Millisecond
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关闭底层文件使该组的写入失败
+	w.fp.Close()
+
+	commits := make([]*Commit, 0)
+	for i := 0; i < 8; i++ {
+		commit, err := w.WriteAsync([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		commits = append(commits, commit)
+	}
+	for i, commit := range commits {
+		if err := commit.Wait(); !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("waiter %d: expected os.ErrClosed, got %v", i, err)
+		}
+	}
+	if commits[0] != commits[len(commits)-1] {
+		t.Fatal("expected writes to join the same group")
+	}
+}
+
+func TestGroupCommitClose(t *testing.T) {
+	conf := newGroupCommitConfig(t)
+	conf.GroupCommitInterval = time.Hour
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := w.WriteAsync([]byte("k"), []byte("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 关闭时提交剩余数据并唤醒等待者
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteAsync([]byte("k"), []byte("v")); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected os.ErrClosed after close, got %v", err)
+	}
+}
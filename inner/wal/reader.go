@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// DefaultFollowInterval Follow在文件末尾等待新记录时的默认轮询间隔
+const DefaultFollowInterval = 10 * time.Millisecond
+
+// WalReader 以只读方式按顺序解码单个WAL文件中的记录，不获取目录锁，
+// 可在写入方运行时从同一进程或其他进程检查、跟踪WAL
+type WalReader struct {
+	fp             *os.File      // 只读文件
+	offset         int64         // 下一条记录的起始偏移量
+	FollowInterval time.Duration // Follow的轮询间隔，为0时使用DefaultFollowInterval
+	Clock          config.Clock  // Follow等待使用的时间来源，为nil时使用系统时间
+}
+
+// NewReader 打开path处的WAL文件，从偏移量0开始读取
+func NewReader(path string) (*WalReader, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &WalReader{fp: fp}, nil
+}
+
+// Next 解码下一条记录，返回记录以及记录之后的偏移量，跟踪方保存该偏移量即可从此处继续读取。
+// 批量记录等所有记录类型都原样返回，由调用方通过DecodeBatch展开。
+// 文件末尾不完整或正在写入的记录返回io.EOF，偏移量停留在最后一条完整记录之后
+func (r *WalReader) Next() (*Record, int64, error) {
+	header := make([]byte, 9)
+	if _, err := r.fp.ReadAt(header, r.offset); err != nil {
+		return nil, r.offset, err
+	}
+	keyLength := binary.BigEndian.Uint32(header[1:5])
+	valueLength := binary.BigEndian.Uint32(header[5:9])
+	if err := checkLength(uint64(keyLength), uint64(valueLength), myerror.ErrWalCorrupted); err != nil {
+		return nil, r.offset, fmt.Errorf("wal record at offset %d: %w", r.offset, err)
+	}
+	recordLength := 9 + int64(keyLength) + int64(valueLength) + 4
+	// 记录超出文件当前末尾时是正在写入的尾部，不按头部中的长度分配内存
+	if r.atEnd(r.offset + recordLength - 1) {
+		return nil, r.offset, io.EOF
+	}
+
+	data := make([]byte, recordLength)
+	if _, err := r.fp.ReadAt(data, r.offset); err != nil {
+		// 读取不足一条完整记录时ReadAt返回io.EOF
+		return nil, r.offset, err
+	}
+	rec, err := DecodeRecord(data)
+	if errors.Is(err, myerror.ErrCrcMismatch) && r.atEnd(r.offset+int64(len(data))) {
+		// 校验失败的记录是文件的最后一条，视为未写完的尾部
+		return nil, r.offset, io.EOF
+	}
+	if err != nil {
+		return nil, r.offset, fmt.Errorf("wal record at offset %d: %w", r.offset, err)
+	}
+	r.offset += int64(len(data))
+	return rec, r.offset, nil
+}
+
+// atEnd 判断offset是否已到达文件当前末尾
+func (r *WalReader) atEnd(offset int64) bool {
+	stat, err := r.fp.Stat()
+	return err == nil && stat.Size() <= offset
+}
+
+// Offset 返回下一条记录的起始偏移量
+func (r *WalReader) Offset() int64 {
+	return r.offset
+}
+
+// SetOffset 将读取位置设置为offset，offset必须是某条记录的起始位置，通常为Next返回的偏移量
+func (r *WalReader) SetOffset(offset int64) {
+	r.offset = offset
+}
+
+// Follow 从fromOffset开始依次将记录交给fn，读到文件末尾后轮询等待写入方追加的新记录，
+// 直到ctx结束或fn返回错误。WAL轮转后新记录写入下一个文件，跟踪方需要为FileName(fileId+1)另建读取器
+func (r *WalReader) Follow(ctx context.Context, fromOffset int64, fn func(*Record) error) error {
+	interval := r.FollowInterval
+	if interval <= 0 {
+		interval = DefaultFollowInterval
+	}
+	clock := r.Clock
+	if clock == nil {
+		clock = config.RealClock()
+	}
+
+	r.SetOffset(fromOffset)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rec, _, err := r.Next()
+		if err == nil {
+			if err := fn(rec); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clock.After(interval):
+		}
+	}
+}
+
+// Close 关闭读取器
+func (r *WalReader) Close() error {
+	return r.fp.Close()
+}
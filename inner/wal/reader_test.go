@@ -0,0 +1,234 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func newReaderTestWal(t *testing.T) (*Wal, string) {
+	t.Helper()
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(conf.WalPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, filepath.Join(conf.WalPath(), FileName(1))
+}
+
+func TestWalReaderRecordTypesAndOffsets(t *testing.T) {
+	w, path := newReaderTestWal(t)
+	if err := w.Write([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	afterPut := int64(w.Size())
+	if err := w.Write([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBatch([]*Record{NewRecord([]byte("b"), []byte("2")), NewRecord([]byte("c"), nil)}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	wantTypes := []RecordType{RecordTypePut, RecordTypeDelete, RecordTypeBatch}
+	for i, want := range wantTypes {
+		rec, offset, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if rec.RecordType != want {
+			t.Fatalf("record %d type = %d, want %d", i, rec.RecordType, want)
+		}
+		if i == 0 && offset != afterPut {
+			t.Fatalf("offset after first record = %d, want %d", offset, afterPut)
+		}
+	}
+	if _, offset, err := r.Next(); err != io.EOF || offset != int64(w.Size()) {
+		t.Fatalf("Next at end = %d, %v, want %d, io.EOF", offset, err, w.Size())
+	}
+
+	// 从保存的偏移量继续读取
+	r.SetOffset(afterPut)
+	rec, _, err := r.Next()
+	if err != nil || rec.RecordType != RecordTypeDelete || rec.Value != nil {
+		t.Fatalf("record after resume = %+v, %v", rec, err)
+	}
+	rec, _, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subs, err := DecodeBatch(rec)
+	if err != nil || len(subs) != 2 || string(subs[0].Key) != "b" || subs[1].RecordType != RecordTypeDelete {
+		t.Fatalf("batch = %+v, %v", subs, err)
+	}
+}
+
+func TestWalReaderTornTail(t *testing.T) {
+	w, path := newReaderTestWal(t)
+	if err := w.Write([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	good := int64(w.Size())
+	if err := w.Write([]byte("tail"), []byte("torn")); err != nil {
+		t.Fatal(err)
+	}
+	full, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torn := filepath.Join(t.TempDir(), "torn.log")
+	for size := good; size < int64(len(full)); size++ {
+		data := append([]byte(nil), full[:size]...)
+		if size == int64(len(full))-1 {
+			// 长度完整但最后一个字节损坏，同样视为未写完的尾部
+			data = append(data, full[size]^0xff)
+		}
+		if err := os.WriteFile(torn, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(torn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := r.Next(); err != nil {
+			t.Fatalf("size %d: first record: %v", size, err)
+		}
+		if _, offset, err := r.Next(); err != io.EOF || offset != good {
+			t.Fatalf("size %d: Next = %d, %v, want %d, io.EOF", size, offset, err, good)
+		}
+		r.Close()
+	}
+
+	// 损坏的记录之后还有数据时不是未写完的尾部，返回错误
+	corrupt := append([]byte(nil), full...)
+	corrupt[good-1] ^= 0xff
+	if err := os.WriteFile(torn, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(torn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, _, err := r.Next(); !errors.Is(err, myerror.ErrCrcMismatch) {
+		t.Fatalf("expected ErrCrcMismatch, got %v", err)
+	}
+}
+
+func TestWalReaderFollow(t *testing.T) {
+	w, path := newReaderTestWal(t)
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.FollowInterval = time.Millisecond
+
+	const n = 200
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make([]string, 0, n)
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Follow(ctx, 0, func(rec *Record) error {
+			got = append(got, string(rec.Key))
+			if len(got) == n {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	for i := 0; i < n; i++ {
+		if err := w.Write([]byte(fmt.Sprintf("key-%03d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Follow = %v, want context.Canceled", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Follow did not observe all records")
+	}
+	for i, key := range got {
+		if want := fmt.Sprintf("key-%03d", i); key != want {
+			t.Fatalf("record %d = %s, want %s", i, key, want)
+		}
+	}
+	if r.Offset() != int64(w.Size()) {
+		t.Fatalf("Offset = %d, want %d", r.Offset(), w.Size())
+	}
+}
+
+func TestReplayMatchesReadAll(t *testing.T) {
+	w, path := newReaderTestWal(t)
+	if err := w.Write([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBatch([]*Record{NewRecord([]byte("b"), []byte("2")), NewRecord([]byte("c"), nil)}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	tailed := memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)
+	for {
+		rec, _, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Replay(tailed, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 旧版本写入的空key记录被跳过
+	if err := Replay(tailed, NewRecord([]byte{}, []byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)
+	if err := w.ReadAll(replayed); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		got, gotErr := tailed.GetEntry([]byte(key))
+		want, wantErr := replayed.GetEntry([]byte(key))
+		if gotErr != wantErr || got.IsDelete() != want.IsDelete() || string(got.Value) != string(want.Value) {
+			t.Fatalf("key %s: Replay = %+v, %v; ReadAll = %+v, %v", key, got, gotErr, want, wantErr)
+		}
+	}
+	if tailed.Size() != replayed.Size() {
+		t.Fatalf("Replay size %d, ReadAll %d", tailed.Size(), replayed.Size())
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"hash/crc32"
 	"io"
 
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
 	"github.com/aixiasang/lsm/inner/myerror"
 )
 
@@ -14,15 +16,47 @@ import (
 type RecordType uint8
 
 const (
-	RecordTypePut    RecordType = iota // 写入
-	RecordTypeDelete                   // 删除
+	RecordTypePut         RecordType = iota // 写入
+	RecordTypeDelete                        // 删除
+	RecordTypeBatch                         // 批量写入，value为若干编码后的写入或删除记录，整体共用一个CRC
+	RecordTypePutTS                         // 带时间戳的写入，value区域以8字节时间戳开头
+	RecordTypeDeleteTS                      // 带时间戳的删除，value区域只有8字节时间戳
+	RecordTypeEntry                         // 完整的条目，value区域以kind(1) seq(8) ttl(8) timestamp(8)开头
+	RecordTypeGeneration                    // 内存表代数标记，没有key，value为8字节代数，之后的记录属于该代数
+	RecordTypeDeleteBatch                   // 批量删除，没有key，value为共用的序列号和时间以及各删除标记的key，整体共用一个CRC
 )
 
+const (
+	timestampSize   = 8             // 带时间戳的记录中时间戳占用的字节数
+	entryHeaderSize = 1 + 8 + 8 + 8 // RecordTypeEntry记录的value区域中条目头部占用的字节数
+)
+
+const (
+	// MaxKeyLength 记录中key的长度上限，写入更长的key返回ErrValueTooLarge，解码时视为损坏
+	MaxKeyLength = config.MaxKeySize
+	// MaxValueLength 记录中value区域的长度上限，包括条目头部和批量记录中的全部子记录。
+	// 不随配置变化，按MaxValueSize写入的value总能解码，调小配置后旧的WAL仍然可以重放
+	MaxValueLength = config.MaxValueSizeLimit + 1<<20
+)
+
+// checkLength 检查记录头部中的长度，超出上限时返回err
+func checkLength(keyLength, valueLength uint64, err error) error {
+	if keyLength > MaxKeyLength || valueLength > MaxValueLength {
+		return fmt.Errorf("%w: key or value length too large: keyLength=%d, valueLength=%d", err, keyLength, valueLength)
+	}
+	return nil
+}
+
 // Record 记录
 type Record struct {
-	RecordType RecordType // 记录类型
-	Key        []byte     // 键
-	Value      []byte     // 值
+	RecordType RecordType   // 记录类型
+	Key        []byte       // 键
+	Value      []byte       // 值
+	Timestamp  int64        // 写入时间(unix纳秒)，0表示未记录
+	Kind       kv.EntryKind // 条目类型，只有RecordTypeEntry记录使用，其余类型由RecordType决定
+	Seq        uint64       // 写入序列号，只有RecordTypeEntry记录使用
+	TTL        int64        // 过期时间，只有RecordTypeEntry记录使用
+	Generation uint64       // 内存表代数，只有RecordTypeGeneration记录使用
 }
 
 func NewRecord(key, value []byte) *Record {
@@ -32,6 +66,82 @@ func NewRecord(key, value []byte) *Record {
 	return newRecord(key, value, RecordTypePut)
 }
 
+// NewRecordWithTimestamp 创建带写入时间的记录，ts为0时与NewRecord相同，不占用额外的字节
+func NewRecordWithTimestamp(key, value []byte, ts int64) *Record {
+	rec := NewRecord(key, value)
+	if ts == 0 {
+		return rec
+	}
+	if value == nil {
+		rec.RecordType = RecordTypeDeleteTS
+	} else {
+		rec.RecordType = RecordTypePutTS
+	}
+	rec.Timestamp = ts
+	return rec
+}
+
+// NewEntryRecord 创建写入entry的记录。旧的记录类型能表示的条目(没有序列号和过期时间的写入或删除)
+// 仍使用旧类型编码，与之前写入的WAL完全相同；其余条目使用RecordTypeEntry
+func NewEntryRecord(entry kv.Entry) *Record {
+	entry = entry.Normalize()
+	if (entry.Kind == kv.KindPut || entry.Kind == kv.KindDelete) && entry.Seq == 0 && entry.TTL == 0 {
+		return NewRecordWithTimestamp(entry.Key, entry.Value, entry.Timestamp)
+	}
+	rec := newRecord(entry.Key, entry.Value, RecordTypeEntry)
+	rec.Kind = entry.Kind
+	rec.Seq = entry.Seq
+	rec.TTL = entry.TTL
+	rec.Timestamp = entry.Timestamp
+	return rec
+}
+
+// NewGenerationRecord 创建代数标记，WALModeShared下轮转内存表时写入，重放时之后的记录写入该代数的内存表
+func NewGenerationRecord(gen uint64) *Record {
+	rec := newRecord(nil, binary.BigEndian.AppendUint64(nil, gen), RecordTypeGeneration)
+	rec.Generation = gen
+	return rec
+}
+
+// Entry 将写入或删除记录转换为条目，旧类型的删除记录转换为KindDelete，写入记录转换为KindPut
+func (r *Record) Entry() kv.Entry {
+	if r.RecordType == RecordTypeEntry {
+		return kv.Entry{Key: r.Key, Value: r.Value, Kind: r.Kind, Seq: r.Seq, TTL: r.TTL, Timestamp: r.Timestamp}.Normalize()
+	}
+	kind := kv.KindPut
+	if r.RecordType.IsDelete() {
+		kind = kv.KindDelete
+	}
+	return kv.Entry{Key: r.Key, Value: r.Value, Kind: kind, Timestamp: r.Timestamp}.Normalize()
+}
+
+// IsBatch 判断记录是否包含多条子记录，需要通过DecodeBatch展开
+func (t RecordType) IsBatch() bool {
+	return t == RecordTypeBatch || t == RecordTypeDeleteBatch
+}
+
+// hasTimestamp 判断记录类型的value区域是否以时间戳开头
+func (t RecordType) hasTimestamp() bool {
+	return t == RecordTypePutTS || t == RecordTypeDeleteTS
+}
+
+// IsDelete 判断记录是否为旧类型的删除记录，RecordTypeEntry记录的类型由Kind决定
+func (t RecordType) IsDelete() bool {
+	return t == RecordTypeDelete || t == RecordTypeDeleteTS
+}
+
+// headerSize 返回记录类型的value区域中位于value之前的字节数
+func (t RecordType) headerSize() int {
+	switch {
+	case t == RecordTypeEntry:
+		return entryHeaderSize
+	case t.hasTimestamp():
+		return timestampSize
+	default:
+		return 0
+	}
+}
+
 func newRecord(key, value []byte, recordType RecordType) *Record {
 	return &Record{
 		Key:        key,
@@ -39,20 +149,122 @@ func newRecord(key, value []byte, recordType RecordType) *Record {
 		RecordType: recordType,
 	}
 }
-func (r *Record) Encode() ([]byte, error) {
+
+// NewBatchRecord 将多条写入或删除记录打包为一条批量记录，重放时要么全部生效要么全部忽略
+func NewBatchRecord(records []*Record) (*Record, error) {
 	buf := bytes.NewBuffer(nil)
+	for _, rec := range records {
+		encoded, err := rec.Encode()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(encoded)
+	}
+	return newRecord(nil, buf.Bytes(), RecordTypeBatch), nil
+}
+
+// NewDeleteBatchRecord 将keys的删除标记打包为一条批量删除记录，所有删除标记使用相同的序列号seq和写入时间ts。
+// value为seq(uvarint) ts(varint) count(uvarint)，之后每个key为长度(uvarint)和key本身，
+// 没有子记录各自的类型、定长的长度字段和CRC，每个删除标记只比key多一到两个字节
+func NewDeleteBatchRecord(keys [][]byte, seq uint64, ts int64) *Record {
+	size := 3 * binary.MaxVarintLen64
+	for _, key := range keys {
+		size += binary.MaxVarintLen32 + len(key)
+	}
+	value := make([]byte, 0, size)
+	value = binary.AppendUvarint(value, seq)
+	value = binary.AppendVarint(value, ts)
+	value = binary.AppendUvarint(value, uint64(len(keys)))
+	for _, key := range keys {
+		value = binary.AppendUvarint(value, uint64(len(key)))
+		value = append(value, key...)
+	}
+	return newRecord(nil, value, RecordTypeDeleteBatch)
+}
+
+// decodeDeleteBatch 将批量删除记录的value展开为删除记录，长度字段损坏或与value的长度不一致时返回ErrWalCorrupted
+func decodeDeleteBatch(value []byte) ([]*Record, error) {
+	corrupted := func(what string) error {
+		return fmt.Errorf("%w: delete batch with bad %s", myerror.ErrWalCorrupted, what)
+	}
+	seq, n := binary.Uvarint(value)
+	if n <= 0 {
+		return nil, corrupted("sequence")
+	}
+	value = value[n:]
+	ts, n := binary.Varint(value)
+	if n <= 0 {
+		return nil, corrupted("timestamp")
+	}
+	value = value[n:]
+	count, n := binary.Uvarint(value)
+	// 每个key至少占用一个字节的长度，数量不会超过剩余的字节数
+	if n <= 0 || count > uint64(len(value)-n) {
+		return nil, corrupted("count")
+	}
+	value = value[n:]
+	records := make([]*Record, 0, count)
+	for range count {
+		keyLength, n := binary.Uvarint(value)
+		if n <= 0 || keyLength > MaxKeyLength || keyLength > uint64(len(value)-n) {
+			return nil, corrupted("key length")
+		}
+		key := value[n : n+int(keyLength)]
+		value = value[n+int(keyLength):]
+		records = append(records, NewEntryRecord(kv.Entry{Key: key, Kind: kv.KindDelete, Seq: seq, Timestamp: ts}))
+	}
+	if len(value) != 0 {
+		return nil, corrupted("length")
+	}
+	return records, nil
+}
+
+// DecodeBatch 解码批量记录或批量删除记录中的所有子记录
+func DecodeBatch(rec *Record) ([]*Record, error) {
+	if rec.RecordType == RecordTypeDeleteBatch {
+		return decodeDeleteBatch(rec.Value)
+	}
+	records := make([]*Record, 0)
+	err := DecodeStream(bytes.NewReader(rec.Value), func(sub *Record) error {
+		records = append(records, sub)
+		return nil
+	})
+	return records, err
+}
+
+// Encode 编码记录，key或value区域超出MaxKeyLength、MaxValueLength时返回ErrValueTooLarge，
+// 不会写出重放时无法解码的记录。编码缓冲区按记录大小一次分配，大value只多出这一份副本
+func (r *Record) Encode() ([]byte, error) {
+	valueLength := len(r.Value) + r.RecordType.headerSize()
+	if err := checkLength(uint64(len(r.Key)), uint64(valueLength), myerror.ErrValueTooLarge); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 9+len(r.Key)+valueLength+4))
 	if err := buf.WriteByte(byte(r.RecordType)); err != nil {
 		return nil, myerror.ErrEncodeRecordType
 	}
 	if err := binary.Write(buf, binary.BigEndian, uint32(len(r.Key))); err != nil {
 		return nil, myerror.ErrEncodeKeyLength
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(r.Value))); err != nil {
+	if err := binary.Write(buf, binary.BigEndian, uint32(valueLength)); err != nil {
 		return nil, myerror.ErrEncodeValueLength
 	}
 	if _, err := buf.Write(r.Key); err != nil {
 		return nil, myerror.ErrEncodeKey
 	}
+	if r.RecordType == RecordTypeEntry {
+		header := []byte{byte(r.Kind)}
+		header = binary.BigEndian.AppendUint64(header, r.Seq)
+		header = binary.BigEndian.AppendUint64(header, uint64(r.TTL))
+		if _, err := buf.Write(header); err != nil {
+			return nil, myerror.ErrEncodeValue
+		}
+	}
+	if r.RecordType.headerSize() > 0 {
+		if err := binary.Write(buf, binary.BigEndian, r.Timestamp); err != nil {
+			return nil, myerror.ErrEncodeValue
+		}
+	}
 	if _, err := buf.Write(r.Value); err != nil {
 		return nil, myerror.ErrEncodeValue
 	}
@@ -80,8 +292,8 @@ func DecodeRecord(data []byte) (*Record, error) {
 	}
 
 	// 验证长度合理性
-	if keyLength > 10*1024*1024 || valueLength > 100*1024*1024 {
-		return nil, fmt.Errorf("key or value length too large: keyLength=%d, valueLength=%d", keyLength, valueLength)
+	if err := checkLength(uint64(keyLength), uint64(valueLength), myerror.ErrWalCorrupted); err != nil {
+		return nil, err
 	}
 
 	// 验证数据长度是否足够
@@ -107,55 +319,77 @@ func DecodeRecord(data []byte) (*Record, error) {
 		return nil, myerror.ErrCrcMismatch
 	}
 
-	return &Record{
-		RecordType: recordType,
-		Key:        key,
-		Value:      value,
-	}, nil
+	return decodePayload(recordType, key, value)
 }
-func DecodeStream(r io.Reader, callback func(key, value []byte) error) error {
-	offset := 0
-	buf := make([]byte, 1+4+4)
+
+// decodePayload 从value区域中分离出条目头部或时间戳，删除记录的value为nil，与空值写入区分
+func decodePayload(recordType RecordType, key, value []byte) (*Record, error) {
+	rec := &Record{RecordType: recordType, Key: key}
+	if len(value) < recordType.headerSize() {
+		return nil, myerror.ErrRecordDataIncomplete
+	}
+	if recordType == RecordTypeGeneration {
+		if len(key) != 0 || len(value) != 8 {
+			return nil, fmt.Errorf("%w: generation record with %d byte key and %d byte value", myerror.ErrWalCorrupted, len(key), len(value))
+		}
+		rec.Generation = binary.BigEndian.Uint64(value)
+		rec.Value = value
+		return rec, nil
+	}
+	if recordType == RecordTypeEntry {
+		rec.Kind = kv.EntryKind(value[0])
+		if !rec.Kind.Valid() {
+			return nil, fmt.Errorf("%w: %d", myerror.ErrUnknownEntryKind, value[0])
+		}
+		rec.Seq = binary.BigEndian.Uint64(value[1:9])
+		rec.TTL = int64(binary.BigEndian.Uint64(value[9:17]))
+		value = value[17:]
+	}
+	if recordType.headerSize() > 0 {
+		rec.Timestamp = int64(binary.BigEndian.Uint64(value[:timestampSize]))
+		value = value[timestampSize:]
+	}
+	if recordType.IsDelete() || recordType == RecordTypeEntry && rec.Kind == kv.KindDelete {
+		value = nil
+	}
+	rec.Value = value
+	return rec, nil
+}
+
+// DecodeStream 从r中依次解码记录并回调，回调参数为完整的记录(包括记录类型)，
+// 以便调用方区分删除记录与空值写入。末尾不完整的记录会被忽略
+func DecodeStream(r io.Reader, callback func(rec *Record) error) error {
+	header := make([]byte, 1+4+4)
 	for {
-		n, err := r.Read(buf)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF || n == 0 {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
 				return nil
 			}
 			return err
 		}
-		rec := &Record{}
-		// todo: 这里需要优化 recordType 的读取
-		rec.RecordType = RecordType(buf[0])
-		var keyLength uint32
-		if err := binary.Read(bytes.NewBuffer(buf[1:5]), binary.BigEndian, &keyLength); err != nil {
-			return myerror.ErrDecodeKeyLength
-		}
-		var valueLength uint32
-		if err := binary.Read(bytes.NewBuffer(buf[5:9]), binary.BigEndian, &valueLength); err != nil {
-			return myerror.ErrDecodeValueLength
-		}
-		key := make([]byte, keyLength)
-		if _, err := io.ReadFull(bytes.NewBuffer(buf[9:9+keyLength]), key); err != nil {
-			return myerror.ErrDecodeKey
-		}
-		value := make([]byte, valueLength)
-		if _, err := io.ReadFull(bytes.NewBuffer(buf[9+keyLength:]), value); err != nil {
-			return myerror.ErrDecodeValue
+		keyLength := binary.BigEndian.Uint32(header[1:5])
+		valueLength := binary.BigEndian.Uint32(header[5:9])
+		if err := checkLength(uint64(keyLength), uint64(valueLength), myerror.ErrWalCorrupted); err != nil {
+			return err
 		}
-		var expectCrc uint32
-		if err := binary.Read(bytes.NewBuffer(buf[9+keyLength+valueLength:]), binary.BigEndian, &expectCrc); err != nil {
-			return myerror.ErrDecodeCrc
+
+		// 按实际读到的数据增长缓冲区，损坏的长度不会一次分配很大的内存
+		n := int64(keyLength) + int64(valueLength) + 4
+		body := bytes.NewBuffer(make([]byte, 0, 9+min(n, 1<<20)))
+		body.Write(header)
+		if _, err := io.CopyN(body, r, n); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return err
 		}
-		fullData := append(buf[:], key...)
-		fullData = append(fullData, value...)
-		crc := crc32.ChecksumIEEE(fullData)
-		if crc != expectCrc {
-			return myerror.ErrCrcMismatch
+		data := body.Bytes()
+		rec, err := DecodeRecord(data)
+		if err != nil {
+			return err
 		}
-		if err := callback(key, value); err != nil {
+		if err := callback(rec); err != nil {
 			return err
 		}
-		offset += n
 	}
 }
@@ -0,0 +1,238 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestDecodeStreamRecordType(t *testing.T) {
+	records := []*Record{
+		NewRecord([]byte("put"), []byte("value")),
+		NewRecord([]byte("empty"), []byte{}),
+		NewRecord([]byte("delete"), nil),
+	}
+	buf := bytes.NewBuffer(nil)
+	for _, rec := range records {
+		encoded, err := rec.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(encoded)
+	}
+	// 末尾追加不完整的记录，模拟写入过程中崩溃
+	torn, err := NewRecord([]byte("torn"), []byte("value")).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(torn[:len(torn)-3])
+
+	var decoded []*Record
+	if err := DecodeStream(buf, func(rec *Record) error {
+		decoded = append(decoded, rec)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(decoded))
+	}
+	for i, rec := range decoded {
+		if rec.RecordType != records[i].RecordType {
+			t.Errorf("record %d: expected type %d, got %d", i, records[i].RecordType, rec.RecordType)
+		}
+		if !bytes.Equal(rec.Key, records[i].Key) || !bytes.Equal(rec.Value, records[i].Value) {
+			t.Errorf("record %d: expected %s=%s, got %s=%s", i, records[i].Key, records[i].Value, rec.Key, rec.Value)
+		}
+	}
+	if decoded[1].RecordType != RecordTypePut || decoded[1].Value == nil {
+		t.Errorf("empty value put should decode as a put with non-nil empty value")
+	}
+	if decoded[2].RecordType != RecordTypeDelete || decoded[2].Value != nil {
+		t.Errorf("delete should decode as a delete with nil value")
+	}
+}
+
+func TestRecordTimestamp(t *testing.T) {
+	const ts = int64(1700000000123456789)
+	cases := []struct {
+		rec      *Record
+		wantType RecordType
+	}{
+		{NewRecordWithTimestamp([]byte("put"), []byte("value"), ts), RecordTypePutTS},
+		{NewRecordWithTimestamp([]byte("empty"), []byte{}, ts), RecordTypePutTS},
+		{NewRecordWithTimestamp([]byte("delete"), nil, ts), RecordTypeDeleteTS},
+		{NewRecordWithTimestamp([]byte("untracked"), []byte("value"), 0), RecordTypePut},
+	}
+	for _, c := range cases {
+		if c.rec.RecordType != c.wantType {
+			t.Fatalf("%s: type = %d, want %d", c.rec.Key, c.rec.RecordType, c.wantType)
+		}
+		encoded, err := c.rec.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := NewRecord(c.rec.Key, c.rec.Value).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 只有记录了时间的条目额外占用8字节
+		if extra := len(encoded) - len(plain); (c.rec.Timestamp != 0 && extra != timestampSize) || (c.rec.Timestamp == 0 && extra != 0) {
+			t.Fatalf("%s: encoded %d extra bytes", c.rec.Key, extra)
+		}
+		decoded, err := DecodeRecord(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.RecordType != c.wantType || decoded.Timestamp != c.rec.Timestamp ||
+			!bytes.Equal(decoded.Value, c.rec.Value) || (decoded.Value == nil) != (c.rec.Value == nil) {
+			t.Fatalf("%s: decoded %+v, want %+v", c.rec.Key, decoded, c.rec)
+		}
+		if decoded.RecordType.IsDelete() != (c.rec.Value == nil) {
+			t.Fatalf("%s: IsDelete = %v", c.rec.Key, decoded.RecordType.IsDelete())
+		}
+	}
+
+	// 带时间戳的记录value区域不足8字节时视为损坏
+	data := []byte{byte(RecordTypePutTS)}
+	data = binary.BigEndian.AppendUint32(data, 1)
+	data = binary.BigEndian.AppendUint32(data, 5)
+	data = append(data, "kshort"...)
+	data = binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	if _, err := DecodeRecord(data); !errors.Is(err, myerror.ErrRecordDataIncomplete) {
+		t.Fatalf("expected ErrRecordDataIncomplete for truncated timestamp, got %v", err)
+	}
+}
+
+// legacyRecord 按旧版本的格式手工编码一条记录：type(1) keyLen(4) valueLen(4) key value crc(4)
+func legacyRecord(recordType RecordType, key string, value []byte) []byte {
+	data := []byte{byte(recordType)}
+	data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(value)))
+	data = append(data, key...)
+	data = append(data, value...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+func TestRecordLegacyEntry(t *testing.T) {
+	ts := binary.BigEndian.AppendUint64(nil, 42)
+	cases := []struct {
+		name string
+		data []byte
+		want kv.Entry
+	}{
+		{"put", legacyRecord(RecordTypePut, "a", []byte("1")), kv.Entry{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut}},
+		{"empty put", legacyRecord(RecordTypePut, "b", nil), kv.Entry{Key: []byte("b"), Value: []byte{}, Kind: kv.KindPut}},
+		{"delete", legacyRecord(RecordTypeDelete, "c", nil), kv.Entry{Key: []byte("c"), Kind: kv.KindDelete}},
+		{"put with timestamp", legacyRecord(RecordTypePutTS, "d", append(ts, '4')), kv.Entry{Key: []byte("d"), Value: []byte("4"), Kind: kv.KindPut, Timestamp: 42}},
+		{"delete with timestamp", legacyRecord(RecordTypeDeleteTS, "e", ts), kv.Entry{Key: []byte("e"), Kind: kv.KindDelete, Timestamp: 42}},
+	}
+	for _, c := range cases {
+		rec, err := DecodeRecord(c.data)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := rec.Entry(); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%s: Entry = %+v, want %+v", c.name, got, c.want)
+		}
+		// 旧类型能表示的条目仍按旧格式编码
+		encoded, err := NewEntryRecord(c.want).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(encoded, c.data) {
+			t.Fatalf("%s: NewEntryRecord encoded %x, want legacy %x", c.name, encoded, c.data)
+		}
+	}
+}
+
+func TestRecordEntryRoundTrip(t *testing.T) {
+	entries := []kv.Entry{
+		{Key: []byte("put"), Value: []byte("v"), Kind: kv.KindPut, Seq: 7, TTL: 1000, Timestamp: 5},
+		{Key: []byte("delete"), Kind: kv.KindDelete, Seq: 8},
+		{Key: []byte("merge"), Value: []byte("+1"), Kind: kv.KindMerge, Timestamp: 6},
+		{Key: []byte("range"), Value: []byte("rangz"), Kind: kv.KindRangeDelete},
+		{Key: []byte("empty"), Kind: kv.KindMerge},
+	}
+	records := make([]*Record, len(entries))
+	for i, entry := range entries {
+		records[i] = NewEntryRecord(entry)
+		if records[i].RecordType != RecordTypeEntry {
+			t.Fatalf("%s: type = %d, want RecordTypeEntry", entry.Key, records[i].RecordType)
+		}
+	}
+	batch, err := NewBatchRecord(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rec := range decoded {
+		if got, want := rec.Entry(), entries[i].Normalize(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("entry %d = %+v, want %+v", i, got, want)
+		}
+	}
+
+	// 未知的条目类型和不完整的条目头部视为损坏
+	bad := legacyRecord(RecordTypeEntry, "k", append([]byte{9}, make([]byte, entryHeaderSize-1)...))
+	if _, err := DecodeRecord(bad); !errors.Is(err, myerror.ErrUnknownEntryKind) {
+		t.Fatalf("expected ErrUnknownEntryKind, got %v", err)
+	}
+	short := legacyRecord(RecordTypeEntry, "k", make([]byte, entryHeaderSize-1))
+	if _, err := DecodeRecord(short); !errors.Is(err, myerror.ErrRecordDataIncomplete) {
+		t.Fatalf("expected ErrRecordDataIncomplete for short entry header, got %v", err)
+	}
+}
+
+func TestRecordLengthLimits(t *testing.T) {
+	// 超出解码上限的记录在编码时拒绝，不会写出无法重放的记录
+	if _, err := NewRecord(make([]byte, MaxKeyLength+1), []byte("v")).Encode(); !errors.Is(err, myerror.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge for long key, got %v", err)
+	}
+	if _, err := NewRecord([]byte("k"), make([]byte, MaxValueLength+1)).Encode(); !errors.Is(err, myerror.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge for long value, got %v", err)
+	}
+	value := bytes.Repeat([]byte{'v'}, 3<<20)
+	data, err := NewRecord([]byte("k"), value).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := DecodeRecord(data)
+	if err != nil || !bytes.Equal(rec.Value, value) {
+		t.Fatalf("decode large record: %v", err)
+	}
+
+	// 头部声明的长度超出上限视为损坏
+	header := legacyRecord(RecordTypePut, "k", nil)[:9]
+	binary.BigEndian.PutUint32(header[5:9], MaxValueLength+1)
+	if _, err := DecodeRecord(append(header, make([]byte, 8)...)); !errors.Is(err, myerror.ErrWalCorrupted) {
+		t.Fatalf("expected ErrWalCorrupted, got %v", err)
+	}
+	if err := DecodeStream(bytes.NewReader(header), func(*Record) error { return nil }); !errors.Is(err, myerror.ErrWalCorrupted) {
+		t.Fatalf("expected ErrWalCorrupted from stream, got %v", err)
+	}
+
+	// 声明了最大长度但数据被截断的尾部记录按实际读到的数据分配内存
+	binary.BigEndian.PutUint32(header[5:9], MaxValueLength)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := DecodeStream(bytes.NewReader(append(header, "kvalue"...)), func(*Record) error {
+		t.Fatal("truncated record decoded")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4<<20 {
+		t.Fatalf("truncated record allocated %d bytes", allocated)
+	}
+}
@@ -0,0 +1,267 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// replayChunkSize 重放时每次读取并交给一个解码worker的字节数，超过该大小的单条记录单独成块
+const replayChunkSize = 1 << 20
+
+// ReplayStats 一次ReadGenerations或ReadAll的统计
+type ReplayStats struct {
+	Bytes    int64         // 重放的字节数，不包括末尾不完整或无法解析而被丢弃的部分
+	Records  int64         // 写入内存表的记录数，批量记录按子记录计数，不包括被丢弃的代数中的记录
+	Duration time.Duration // 读取、解码和写入内存表的总耗时
+}
+
+// replaySpan 一条记录在块中的起止位置
+type replaySpan struct {
+	start, end int
+}
+
+// replayItem 解码后的一条记录，由写入内存表的goroutine按文件中的顺序处理
+type replayItem struct {
+	end     int64     // 记录之后在文件中的偏移量
+	gen     uint64    // 代数标记中的代数
+	isGen   bool      // 是否为代数标记
+	apply   bool      // 是否写入当前代数的内存表，CRC校验失败的批量记录为false
+	records []*Record // 写入内存表的记录，批量记录展开为子记录
+	err     error     // 批量记录无法展开，当前代数的内存表不为nil时返回该错误
+	stop    bool      // 记录头部无法解析，从这条记录开始停止重放
+}
+
+// replayChunk 一块连续的完整记录，解码worker填充items后关闭done
+type replayChunk struct {
+	offset int64        // data在文件中的起始偏移量
+	data   []byte       // 块中的记录，记录的key和value引用该缓冲区，写入内存表时复制
+	spans  []replaySpan // 每条记录的位置
+	items  []replayItem // 与spans一一对应的解码结果，遇到stop时截断
+	done   chan struct{}
+}
+
+// replayParallelism 返回重放时并发解码的worker数
+func (w *Wal) replayParallelism() int {
+	return max(w.conf.WALReplayParallelism, 1)
+}
+
+// ReadGenerations 读取全部记录，按代数标记分别重放到table返回的内存表：第一个代数标记之前的记录属于代数0，
+// 之后的记录属于最近的代数标记。每遇到一个代数标记调用一次table，代数0在遇到第一条属于它的记录时调用；
+// table返回nil时丢弃该代数的记录。
+// 文件按块顺序读取，CRC校验和解码由WALReplayParallelism个worker并发完成，当前goroutine按文件中的顺序
+// 把解码结果写入内存表并调用table。等待写入的块数有上限，写入内存表慢于解码时读取随之暂停，内存占用不随文件大小增长
+func (w *Wal) ReadGenerations(table func(gen uint64) (memtable.MemTable, error)) error {
+	start := w.conf.Now()
+	w.conf.Debugf("开始从文件ID=%d读取全部记录", w.fileId)
+	fileInfo, err := w.fp.Stat()
+	if err != nil {
+		return fmt.Errorf("无法获取文件大小: %w", err)
+	}
+
+	workers := w.replayParallelism()
+	ordered := make(chan *replayChunk, 2*workers) // 按文件顺序等待写入内存表的块
+	work := make(chan *replayChunk)
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	var scanErr error
+	wg.Add(1 + workers)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(ordered)
+		scanErr = w.scanChunks(fileInfo.Size(), ordered, work, quit)
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for chunk := range work {
+				w.decodeChunk(chunk)
+				close(chunk.done)
+			}
+		}()
+	}
+	// 提前返回时让读取和解码的goroutine退出，不再读取文件
+	defer func() {
+		close(quit)
+		wg.Wait()
+	}()
+
+	tables := &generationTables{table: table}
+	var offset, records int64
+	stopped := false
+	for chunk := range ordered {
+		<-chunk.done
+		for _, item := range chunk.items {
+			if item.stop {
+				stopped = true
+				break
+			}
+			if item.isGen {
+				if err := tables.switchTo(item.gen); err != nil {
+					return err
+				}
+			} else if item.apply {
+				memTable, err := tables.target()
+				if err != nil {
+					return err
+				}
+				if memTable != nil {
+					if item.err != nil {
+						return item.err
+					}
+					for _, rec := range item.records {
+						// 删除记录转换为KindDelete条目，作为删除标记写入内存表
+						if err := w.replayRecord(memTable, rec); err != nil {
+							return err
+						}
+					}
+					records += int64(len(item.records))
+				}
+			}
+			offset = item.end
+		}
+		if stopped {
+			break
+		}
+	}
+	if !stopped {
+		// ordered关闭之后scanErr已经写入
+		if scanErr != nil {
+			return scanErr
+		}
+	}
+	w.conf.Debugf("文件ID=%d读取完成，处理了 %d 字节", w.fileId, offset)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// 更新WAL实例的offset以反映文件的实际大小
+	w.offset = uint32(offset)
+	w.replay = ReplayStats{Bytes: offset, Records: records, Duration: w.conf.Since(start)}
+	return nil
+}
+
+// ReplayStats 返回最近一次ReadGenerations或ReadAll的统计
+func (w *Wal) ReplayStats() ReplayStats {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.replay
+}
+
+// scanChunks 从头顺序读取大小为size的文件，按记录头部切分为若干块完整的记录，依次放入ordered并交给work中的worker解码。
+// 末尾不完整或长度不合理的记录之后的内容被丢弃；quit关闭时停止读取
+func (w *Wal) scanChunks(size int64, ordered, work chan<- *replayChunk, quit <-chan struct{}) error {
+	var carry []byte // 上一次读取末尾不完整的记录
+	offset := int64(0)
+	need := replayChunkSize // 本次读取需要的字节数，大于replayChunkSize时为一条大记录的剩余部分
+	for {
+		toRead := min(int64(max(need, replayChunkSize)), size-offset-int64(len(carry)))
+		data := make([]byte, len(carry)+int(max(toRead, 0)))
+		copy(data, carry)
+		n, err := w.fp.ReadAt(data[len(carry):], offset+int64(len(carry)))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("读取文件内容失败: %w", err)
+		}
+		data = data[:len(carry)+n]
+		eof := n == 0 || offset+int64(len(data)) >= size
+
+		chunk := &replayChunk{offset: offset, done: make(chan struct{})}
+		pos, corrupted := 0, false
+		need = replayChunkSize
+		for pos+9 <= len(data) {
+			keyLength := binary.BigEndian.Uint32(data[pos+1 : pos+5])
+			valueLength := binary.BigEndian.Uint32(data[pos+5 : pos+9])
+			if checkLength(uint64(keyLength), uint64(valueLength), myerror.ErrWalCorrupted) != nil {
+				w.conf.Warnf("可能的数据损坏 - key长度: %d, value长度: %d", keyLength, valueLength)
+				corrupted = true
+				break
+			}
+			recordLength := 9 + int(keyLength) + int(valueLength) + 4
+			if pos+recordLength > len(data) {
+				need = recordLength - (len(data) - pos)
+				if eof {
+					w.conf.Warnf("文件末尾记录不完整，停止解析: 需要 %d 字节，剩余 %d 字节", recordLength, len(data)-pos)
+					corrupted = true
+				}
+				break
+			}
+			chunk.spans = append(chunk.spans, replaySpan{start: pos, end: pos + recordLength})
+			pos += recordLength
+		}
+		if !corrupted && eof && pos < len(data) && pos+9 > len(data) {
+			w.conf.Warnf("文件末尾不完整，停止解析: 剩余 %d 字节", len(data)-pos)
+		}
+
+		if len(chunk.spans) > 0 {
+			chunk.data = data[:pos]
+			select {
+			case ordered <- chunk:
+			case <-quit:
+				return nil
+			}
+			select {
+			case work <- chunk:
+			case <-quit:
+				return nil
+			}
+		}
+		if corrupted || eof {
+			return nil
+		}
+		carry = data[pos:]
+		offset += int64(pos)
+	}
+}
+
+// decodeChunk 校验并解码块中的每条记录：批量记录CRC校验失败时整批丢弃，其他记录校验失败时只记录警告；
+// 记录头部无法解析时停止，之后的记录不再解码
+func (w *Wal) decodeChunk(chunk *replayChunk) {
+	chunk.items = make([]replayItem, 0, len(chunk.spans))
+	for _, span := range chunk.spans {
+		data := chunk.data[span.start:span.end]
+		offset := chunk.offset + int64(span.start)
+		recordType := RecordType(data[0])
+		keyLength := binary.BigEndian.Uint32(data[1:5])
+		key := data[9 : 9+keyLength]
+		value := data[9+keyLength : len(data)-4]
+		crc := binary.BigEndian.Uint32(data[len(data)-4:])
+		computedCrc := crc32.ChecksumIEEE(data[:len(data)-4])
+		if crc != computedCrc {
+			w.conf.Warnf("CRC校验失败 (offset=%d) - 存储的: %d, 计算的: %d", offset, crc, computedCrc)
+		}
+
+		item := replayItem{end: chunk.offset + int64(span.end)}
+		if recordType.IsBatch() {
+			// 批量记录必须完整才能生效，CRC校验失败时整批丢弃
+			if crc != computedCrc {
+				w.conf.Warnf("批量记录CRC校验失败，丢弃该批次 (offset=%d)", offset)
+			} else {
+				item.apply = true
+				records, err := DecodeBatch(&Record{RecordType: recordType, Value: value})
+				if err != nil {
+					item.err = fmt.Errorf("解析批量记录失败: %w", err)
+				}
+				item.records = records
+			}
+		} else {
+			rec, err := decodePayload(recordType, key, value)
+			if err != nil {
+				w.conf.Warnf("记录头部无法解析，停止解析 (offset=%d): %v", offset, err)
+				chunk.items = append(chunk.items, replayItem{stop: true})
+				return
+			}
+			if recordType == RecordTypeGeneration {
+				item.isGen, item.gen = true, rec.Generation
+			} else {
+				item.apply, item.records = true, []*Record{rec}
+			}
+		}
+		chunk.items = append(chunk.items, item)
+	}
+}
@@ -0,0 +1,243 @@
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+)
+
+func newReplayTestConfig(tb testing.TB) *config.Config {
+	conf := config.DefaultConfig()
+	conf.DataDir = tb.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	return conf
+}
+
+// replayModel 写入时记录的各代数的内容，value为nil表示删除标记
+type replayModel struct {
+	gens    map[uint64]map[string][]byte
+	records int64 // 写入内存表的记录数
+	offsets []int64
+}
+
+// writeReplayWal 写入跨越多个读取块的WAL：普通记录、删除、批量记录、代数标记和一条大于replayChunkSize的记录。
+// offsets[i]为第i次写入之后的偏移量
+func writeReplayWal(t *testing.T, conf *config.Config) replayModel {
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	m := replayModel{gens: map[uint64]map[string][]byte{0: {}}}
+	gen := uint64(0)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 6000; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", rng.Intn(2000)))
+		switch {
+		case i == 3000:
+			value := bytes.Repeat([]byte{'L'}, 3*replayChunkSize)
+			if err := w.Write(key, value); err != nil {
+				t.Fatal(err)
+			}
+			m.gens[gen][string(key)] = value
+			m.records++
+		case i%1000 == 999:
+			gen++
+			m.gens[gen] = map[string][]byte{}
+			if _, err := w.WriteRecordAsync(NewGenerationRecord(gen)); err != nil {
+				t.Fatal(err)
+			}
+		case i%7 == 0:
+			batch := []*Record{NewRecord(key, nil), NewRecord([]byte(fmt.Sprintf("batch-%d", i)), []byte("b"))}
+			if err := w.WriteBatch(batch); err != nil {
+				t.Fatal(err)
+			}
+			m.gens[gen][string(key)] = nil
+			m.gens[gen][fmt.Sprintf("batch-%d", i)] = []byte("b")
+			m.records += 2
+		case i%5 == 0:
+			if err := w.Write(key, nil); err != nil {
+				t.Fatal(err)
+			}
+			m.gens[gen][string(key)] = nil
+			m.records++
+		default:
+			value := bytes.Repeat([]byte{byte('a' + i%26)}, 100+rng.Intn(2000))
+			if err := w.Write(key, value); err != nil {
+				t.Fatal(err)
+			}
+			m.gens[gen][string(key)] = value
+			m.records++
+		}
+		m.offsets = append(m.offsets, int64(w.Size()))
+	}
+	return m
+}
+
+// readGenerations 以workers个worker重放conf中的WAL 0，返回各代数的内存表和WAL
+func readGenerations(t *testing.T, conf *config.Config, workers int) (map[uint64]memtable.MemTable, *Wal) {
+	conf.WALReplayParallelism = workers
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	tables := make(map[uint64]memtable.MemTable)
+	err = w.ReadGenerations(func(gen uint64) (memtable.MemTable, error) {
+		tables[gen] = memtable.NewMemTable(memtable.MemTableTypeBTree, 16)
+		return tables[gen], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables, w
+}
+
+// checkGenerations 比较重放得到的各代数的内存表与want中的内容
+func checkGenerations(t *testing.T, tables map[uint64]memtable.MemTable, want map[uint64]map[string][]byte) {
+	t.Helper()
+	if len(tables) != len(want) {
+		t.Fatalf("replayed %d generations, want %d", len(tables), len(want))
+	}
+	for gen, kvs := range want {
+		count := 0
+		tables[gen].ForEachEntryUnSafe(func(entry kv.Entry) bool {
+			count++
+			value, ok := kvs[string(entry.Key)]
+			if !ok || entry.IsDelete() != (value == nil) || !bytes.Equal(entry.Value, value) {
+				t.Fatalf("generation %d: %s = %d bytes (delete=%v), want %d bytes", gen, entry.Key, len(entry.Value), entry.IsDelete(), len(value))
+			}
+			return true
+		})
+		if count != len(kvs) {
+			t.Fatalf("generation %d has %d keys, want %d", gen, count, len(kvs))
+		}
+	}
+}
+
+// 并发解码按文件中的顺序写入内存表，结果与逐条解码相同
+func TestReadGenerationsParallel(t *testing.T) {
+	conf := newReplayTestConfig(t)
+	m := writeReplayWal(t, conf)
+	size := m.offsets[len(m.offsets)-1]
+	if size < 4*replayChunkSize {
+		t.Fatalf("wal is %d bytes, want several read chunks", size)
+	}
+	for _, workers := range []int{0, 1, 3, 8} {
+		tables, w := readGenerations(t, conf, workers)
+		checkGenerations(t, tables, m.gens)
+		stats := w.ReplayStats()
+		if int64(w.Size()) != size || stats.Bytes != size || stats.Records != m.records {
+			t.Fatalf("workers=%d: Size = %d, ReplayStats = %+v, want %d bytes and %d records", workers, w.Size(), stats, size, m.records)
+		}
+	}
+}
+
+// 末尾不完整和记录长度损坏时停止重放，保留之前的记录，偏移量停在最后一条完整的记录之后
+func TestReadGenerationsParallelStops(t *testing.T) {
+	conf := newReplayTestConfig(t)
+	m := writeReplayWal(t, conf)
+	path := filepath.Join(conf.WalPath(), FileName(0))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 截断在大记录中间，以及在大记录之后若干块处破坏记录头部的长度
+	cases := map[string]struct {
+		stop   int // 保留的写入数
+		mutate func(data []byte) []byte
+	}{
+		"torn large record": {3000, func(data []byte) []byte { return data[:m.offsets[2999]+replayChunkSize] }},
+		"corrupt length": {5500, func(data []byte) []byte {
+			data = bytes.Clone(data)
+			copy(data[m.offsets[5499]+5:], []byte{0xff, 0xff, 0xff, 0xff})
+			return data
+		}},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			conf := newReplayTestConfig(t)
+			if err := os.WriteFile(filepath.Join(conf.WalPath(), FileName(0)), tc.mutate(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// 只包含前stop次写入的WAL重放的结果
+			conf2 := newReplayTestConfig(t)
+			if err := os.WriteFile(filepath.Join(conf2.WalPath(), FileName(0)), data[:m.offsets[tc.stop-1]], 0644); err != nil {
+				t.Fatal(err)
+			}
+			want, _ := readGenerations(t, conf2, 1)
+
+			for _, workers := range []int{1, 4} {
+				tables, w := readGenerations(t, conf, workers)
+				if int64(w.Size()) != m.offsets[tc.stop-1] {
+					t.Fatalf("workers=%d: Size = %d, want %d", workers, w.Size(), m.offsets[tc.stop-1])
+				}
+				wantKVs := make(map[uint64]map[string][]byte)
+				for gen, table := range want {
+					wantKVs[gen] = make(map[string][]byte)
+					table.ForEachEntryUnSafe(func(entry kv.Entry) bool {
+						wantKVs[gen][string(entry.Key)] = bytes.Clone(entry.Value)
+						return true
+					})
+				}
+				checkGenerations(t, tables, wantKVs)
+			}
+		})
+	}
+}
+
+// BenchmarkReadAll 重放256MB的WAL，比较不同的解码并发度
+func BenchmarkReadAll(b *testing.B) {
+	conf := config.DefaultConfig()
+	conf.DataDir = b.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(conf.WalPath(), 0755); err != nil {
+		b.Fatal(err)
+	}
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+	value := bytes.Repeat([]byte("v"), 4096)
+	batch := make([]*Record, 16)
+	for i := 0; w.Size() < 256<<20; i++ {
+		for j := range batch {
+			batch[j] = NewRecord([]byte(fmt.Sprintf("key-%09d", i*len(batch)+j)), value)
+		}
+		if _, err := w.WriteBatchAsync(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	counts := []int{1, 2, 4}
+	if n := runtime.GOMAXPROCS(0); n > 4 {
+		counts = append(counts, n)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			conf.WALReplayParallelism = workers
+			b.SetBytes(int64(w.Size()))
+			for i := 0; i < b.N; i++ {
+				if err := w.ReadAll(memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,57 +1,215 @@
 package wal
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/crc32"
-	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/fsio"
 	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
 )
 
 type Wal struct {
 	conf   *config.Config // 配置
 	fileId uint32         // 文件ID
-	offset uint32         // 偏移量
+	offset uint32         // 偏移量，包含尚未提交的数据
 	fp     *os.File       // 文件
 	mu     sync.RWMutex   // 互斥锁
+	group  *groupCommit   // 组提交，未开启时为nil
+	replay ReplayStats    // 最近一次重放的统计
+}
+
+// FileName 返回文件ID对应的WAL文件名
+func FileName(fileId uint32) string {
+	return fmt.Sprintf("wal-%d.log", fileId)
+}
+
+// IsFileName 判断name是否具有WAL文件名的形式wal-*.log
+func IsFileName(name string) bool {
+	return strings.HasPrefix(name, "wal-") && strings.HasSuffix(name, ".log")
+}
+
+// ParseFileName 解析FileName生成的WAL文件名，返回文件ID。
+// 前导0等不能原样还原的文件名也视为损坏，避免两个文件对应同一个id
+func ParseFileName(name string) (uint32, error) {
+	if !IsFileName(name) {
+		return 0, fmt.Errorf("%w: not a wal file name: %s", myerror.ErrWalCorrupted, name)
+	}
+	digits := strings.TrimSuffix(strings.TrimPrefix(name, "wal-"), ".log")
+	fileId, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || FileName(uint32(fileId)) != name {
+		return 0, fmt.Errorf("%w: invalid wal file name: %s", myerror.ErrWalCorrupted, name)
+	}
+	return uint32(fileId), nil
 }
 
 func NewWal(conf *config.Config, fileId uint32) (*Wal, error) {
-	filePath := filepath.Join(conf.DataDir, conf.WalDir, fmt.Sprintf("wal-%d.log", fileId))
-	fp, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	filePath := filepath.Join(conf.WalPath(), FileName(fileId))
+	if err := conf.IOFault(config.IOCreate, filePath); err != nil {
+		return nil, err
+	}
+	// 记录只追加到末尾；恢复时打开已有的WAL继续写入
+	fp, err := fsio.CreateExclusive(filePath, fsio.AppendOnly)
+	created := err == nil
+	if errors.Is(err, fs.ErrExist) {
+		fp, err = fsio.Open(filePath, fsio.AppendOnly)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return &Wal{conf: conf, fileId: fileId, fp: fp}, nil
+	// 新建的WAL同步目录后，其中fsync过的记录才能在断电后找到；失败时删除新建的文件，不留下空的WAL
+	if created {
+		if err := conf.SyncDir(conf.WalPath()); err != nil {
+			fp.Close()
+			fsio.DeleteRetry(filePath)
+			return nil, err
+		}
+	}
+	w := &Wal{conf: conf, fileId: fileId, fp: fp}
+	// 组提交只在每次写入都需要fsync时才有意义
+	if conf.AutoSync && conf.GroupCommitInterval > 0 {
+		w.group = newGroupCommit(w)
+	}
+	return w, nil
 }
 
 func (w *Wal) Write(key, value []byte) error {
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	rec := NewRecord(key, value)
+	commit, err := w.WriteAsync(key, value)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// WriteAsync 写入记录，开启组提交时返回的Commit在记录持久化后完成
+func (w *Wal) WriteAsync(key, value []byte) (*Commit, error) {
+	return w.writeRecord(NewRecord(key, value), nil)
+}
+
+// WriteRecordAsync 写入一条已构造的记录，用于写入带时间戳的记录
+func (w *Wal) WriteRecordAsync(rec *Record) (*Commit, error) {
+	return w.writeRecord(rec, nil)
+}
+
+// WriteTiming 一次写入在WAL中各阶段的耗时，按配置的时钟计算
+type WriteTiming struct {
+	Encode time.Duration // 编码记录
+	Write  time.Duration // 写入文件或加入提交组
+	Sync   time.Duration // 未开启组提交时的fsync，组提交的fsync在Commit.Wait中，由调用方计时
+}
+
+// WriteRecordTimed 同WriteRecordAsync，timing不为nil时记录各阶段的耗时
+func (w *Wal) WriteRecordTimed(rec *Record, timing *WriteTiming) (*Commit, error) {
+	return w.writeRecord(rec, timing)
+}
+
+// WriteBatch 将多条记录作为一条批量记录原子地写入
+func (w *Wal) WriteBatch(records []*Record) error {
+	commit, err := w.WriteBatchAsync(records)
+	if err != nil {
+		return err
+	}
+	return commit.Wait()
+}
+
+// WriteBatchAsync 与WriteBatch相同，返回的Commit在批量记录持久化后完成
+func (w *Wal) WriteBatchAsync(records []*Record) (*Commit, error) {
+	batch, err := NewBatchRecord(records)
+	if err != nil {
+		return nil, err
+	}
+	return w.writeRecord(batch, nil)
+}
+
+// writeRecord 编码并写入rec，timing不为nil时记录各阶段的耗时，为nil时不读取时钟
+func (w *Wal) writeRecord(rec *Record, timing *WriteTiming) (*Commit, error) {
+	var start time.Time
+	if timing != nil {
+		start = w.conf.Now()
+	}
 	encoded, err := rec.Encode()
 	if err != nil {
+		return nil, err
+	}
+	if timing != nil {
+		timing.Encode = w.conf.Since(start)
+	}
+	if w.group != nil {
+		if timing != nil {
+			start = w.conf.Now()
+			defer func() { timing.Write = w.conf.Since(start) }()
+		}
+		return w.group.append(encoded)
+	}
+	return nil, w.writeSync(encoded, timing)
+}
+
+// writeSync 直接写入文件，AutoSync时每次写入都执行fsync
+func (w *Wal) writeSync(encoded []byte, timing *WriteTiming) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var start time.Time
+	if timing != nil {
+		start = w.conf.Now()
+	}
+	if err := w.conf.IOFault(config.IOWrite, w.fp.Name()); err != nil {
 		return err
 	}
 	length, err := w.fp.Write(encoded)
 	if err != nil {
 		return err
 	}
+	if timing != nil {
+		timing.Write = w.conf.Since(start)
+		start = w.conf.Now()
+	}
 	if w.conf.AutoSync {
+		if err := w.conf.IOFault(config.IOSync, w.fp.Name()); err != nil {
+			return err
+		}
 		if err := w.fp.Sync(); err != nil {
 			return err
 		}
 	}
+	if timing != nil {
+		timing.Sync = w.conf.Since(start)
+	}
 	w.offset += uint32(length)
 	return nil
 }
 
+// writeGroup 写入一个提交组的数据并fsync，偏移量已在加入组时计入
+func (w *Wal) writeGroup(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.conf.IOFault(config.IOWrite, w.fp.Name()); err != nil {
+		return err
+	}
+	if _, err := w.fp.Write(data); err != nil {
+		return err
+	}
+	if err := w.conf.IOFault(config.IOSync, w.fp.Name()); err != nil {
+		return err
+	}
+	return w.fp.Sync()
+}
+
+func (w *Wal) addOffset(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.offset += uint32(n)
+}
+
 func (w *Wal) Close() error {
+	w.group.stop()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.fp.Sync(); err != nil {
@@ -60,115 +218,77 @@ func (w *Wal) Close() error {
 	return w.fp.Close()
 }
 
+// ReadAll 将全部记录重放到memTable，代数标记被忽略
 func (w *Wal) ReadAll(memTable memtable.MemTable) error {
-	// 将文件指针移到开始位置
-	if _, err := w.fp.Seek(0, 0); err != nil {
+	return w.ReadGenerations(func(uint64) (memtable.MemTable, error) {
+		return memTable, nil
+	})
+}
+
+// generationTables 重放时按代数标记选择写入的内存表
+type generationTables struct {
+	table   func(gen uint64) (memtable.MemTable, error)
+	current memtable.MemTable // 当前代数的内存表，为nil时丢弃记录
+	started bool              // 是否已经选择过内存表
+}
+
+// switchTo 切换到代数gen的内存表
+func (g *generationTables) switchTo(gen uint64) error {
+	current, err := g.table(gen)
+	if err != nil {
 		return err
 	}
-	if w.conf.IsDebug {
-		fmt.Printf("开始从文件ID=%d读取全部记录\n", w.fileId)
-	}
+	g.current, g.started = current, true
+	return nil
+}
 
-	// 获取文件大小
-	fileInfo, err := w.fp.Stat()
-	if err != nil {
-		return fmt.Errorf("无法获取文件大小: %v", err)
+// target 返回当前记录写入的内存表，第一个代数标记之前的记录属于代数0
+func (g *generationTables) target() (memtable.MemTable, error) {
+	if !g.started {
+		if err := g.switchTo(0); err != nil {
+			return nil, err
+		}
 	}
-	fileSize := fileInfo.Size()
+	return g.current, nil
+}
 
-	// 读取整个文件
-	buffer := make([]byte, fileSize)
-	n, err := w.fp.ReadAt(buffer, 0)
-	if err != nil && err != io.EOF {
-		return fmt.Errorf("读取文件内容失败: %v", err)
+// replayRecord 将重放的记录写入内存表。旧版本允许写入空key，这样的记录无法再读取或删除，跳过并记录警告
+func (w *Wal) replayRecord(memTable memtable.MemTable, rec *Record) error {
+	if memTable == nil {
+		return nil
 	}
-	if int64(n) < fileSize {
-		fmt.Printf("警告：仅读取了文件部分内容: %d 字节，总大小 %d 字节\n", n, fileSize)
+	if len(rec.Key) == 0 {
+		w.conf.Warnf("跳过空key记录 (文件ID=%d)", w.fileId)
+		return nil
 	}
+	if err := memTable.PutEntry(rec.Entry()); err != nil {
+		return fmt.Errorf("更新索引失败: %w", err)
+	}
+	return nil
+}
 
-	// 逐条解析记录并保存最新的记录位置
-	var offset uint32 = 0
-	for offset < uint32(n) {
-		// 确保至少能读取头部
-		if offset+9 > uint32(n) {
-			fmt.Printf("文件末尾不完整，停止解析: 剩余 %d 字节\n", uint32(n)-offset)
-			break
-		}
-
-		// 读取记录类型
-		recordType := RecordType(buffer[offset])
-
-		// 读取 key 长度
-		keyLength := binary.BigEndian.Uint32(buffer[offset+1 : offset+5])
-
-		// 读取 value 长度
-		valueLength := binary.BigEndian.Uint32(buffer[offset+5 : offset+9])
-
-		// 检查 key 和 value 长度的合理性
-		if keyLength > 10*1024*1024 || valueLength > 100*1024*1024 {
-			fmt.Printf("警告: 可能的数据损坏 - key长度: %d, value长度: %d\n", keyLength, valueLength)
-			break
-		}
-
-		// 计算记录总长度
-		recordLength := 9 + keyLength + valueLength + 4
-
-		// 确保能读取完整的记录
-		if offset+recordLength > uint32(n) {
-			fmt.Printf("文件末尾记录不完整，停止解析: 需要 %d 字节，剩余 %d 字节\n",
-				recordLength, uint32(n)-offset)
-			break
-		}
-
-		// 读取 key 和 value
-		key := buffer[offset+9 : offset+9+keyLength]
-		value := buffer[offset+9+keyLength : offset+9+keyLength+valueLength]
-
-		// 读取 CRC
-		crc := binary.BigEndian.Uint32(buffer[offset+9+keyLength+valueLength : offset+recordLength])
-
-		// 计算CRC进行验证
-		computedCrc := crc32.ChecksumIEEE(buffer[offset : offset+9+keyLength+valueLength])
-		if crc != computedCrc {
-			fmt.Printf("警告: CRC校验失败 (offset=%d) - 存储的: %d, 计算的: %d\n",
-				offset, crc, computedCrc)
-			// 继续处理，但记录警告
+// Replay 按重放WAL的规则将rec写入memTable：批量记录展开为子记录，空key的记录跳过。
+// 供WalReader的调用方把跟踪到的记录写入自己的内存表
+func Replay(memTable memtable.MemTable, rec *Record) error {
+	records := []*Record{rec}
+	if rec.RecordType.IsBatch() {
+		var err error
+		if records, err = DecodeBatch(rec); err != nil {
+			return fmt.Errorf("解析批量记录失败: %w", err)
 		}
-		if w.conf.IsDebug {
-			fmt.Printf("解析记录: type=%d, key=%s, keyLen=%d, valueLen=%d, offset=%d, len=%d\n",
-				recordType, string(key), keyLength, valueLength, offset, recordLength)
+	}
+	for _, rec := range records {
+		if len(rec.Key) == 0 {
+			continue
 		}
-
-		// 基于记录类型处理
-		if recordType == RecordTypeDelete {
-			if w.conf.IsDebug {
-				fmt.Printf("处理删除记录: key=%s\n", string(key))
-			}
-			_ = memTable.Delete(key)
-		} else {
-			if w.conf.IsDebug {
-				fmt.Printf("处理普通记录: key=%s, value=%s\n", string(key), string(value))
-			}
-			// 关键修复: 使用当前记录在文件中的实际位置，而不是旧位置
-			if err := memTable.Put(key, value); err != nil {
-				return fmt.Errorf("更新索引失败: %v", err)
-			}
+		if err := memTable.PutEntry(rec.Entry()); err != nil {
+			return fmt.Errorf("更新索引失败: %w", err)
 		}
-
-		// 更新偏移量
-		offset += recordLength
-	}
-
-	if w.conf.IsDebug {
-		fmt.Printf("文件ID=%d读取完成，处理了 %d 字节\n", w.fileId, offset)
 	}
-
-	// 更新WAL实例的offset以反映文件的实际大小
-	w.offset = offset
-
 	return nil
 }
 
+// Size 返回已写入的字节数，包含组提交中尚未写入文件的数据
 func (w *Wal) Size() uint32 {
 	w.mu.RLock()
 	defer w.mu.RUnlock()
@@ -176,16 +296,31 @@ func (w *Wal) Size() uint32 {
 }
 
 func (w *Wal) Sync() error {
+	// 先提交组提交中尚未写入的数据
+	if err := w.group.flush(); err != nil {
+		return err
+	}
 	w.mu.RLock()
 	defer w.mu.RUnlock()
 	return w.fp.Sync()
 }
 
-func (w *Wal) FileId() uint32 {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
+// ID 返回WAL文件的id
+func (w *Wal) ID() uint32 {
 	return w.fileId
 }
+
+// FileId 返回WAL文件的id
+//
+// Deprecated: 使用ID
+func (w *Wal) FileId() uint32 {
+	return w.ID()
+}
+
+// Path 返回WAL文件的路径
+func (w *Wal) Path() string {
+	return w.fp.Name()
+}
 func (w *Wal) UpdateOffset() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -196,6 +331,7 @@ func (w *Wal) UpdateOffset() {
 	w.offset = uint32(fileInfo.Size())
 }
 func (w *Wal) Delete() error {
+	w.group.stop()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.fp.Sync(); err != nil {
@@ -204,5 +340,8 @@ func (w *Wal) Delete() error {
 	if err := w.fp.Close(); err != nil {
 		return err
 	}
-	return os.Remove(w.fp.Name())
+	if err := fsio.DeleteRetry(w.fp.Name()); err != nil {
+		return err
+	}
+	return w.conf.SyncDir(filepath.Dir(w.fp.Name()))
 }
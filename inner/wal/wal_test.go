@@ -0,0 +1,335 @@
+package wal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestWalBatchReplay(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write([]byte("single"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteBatch([]*Record{
+		NewRecord([]byte("a"), []byte("1")),
+		NewRecord([]byte("single"), nil),
+		NewRecord([]byte("b"), []byte{}),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	complete := w.Size()
+	if err := w.WriteBatch([]*Record{
+		NewRecord([]byte("c"), []byte("3")),
+		NewRecord([]byte("d"), []byte("4")),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 截断最后一个批次，模拟写入过程中崩溃
+	path := filepath.Join(conf.DataDir, conf.WalDir, "wal-0.log")
+	if err := os.Truncate(path, int64(complete)+20); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	table := memtable.NewMemTable(memtable.MemTableTypeBTree, 16)
+	if err := w.ReadAll(table); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := table.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Fatalf("a = %q, %v", v, err)
+	}
+	if v, err := table.Get([]byte("single")); err != nil || v != nil {
+		t.Fatalf("single should be a tombstone, got %q, %v", v, err)
+	}
+	if v, err := table.Get([]byte("b")); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("b should be an empty value, got %q, %v", v, err)
+	}
+	for _, key := range []string{"c", "d"} {
+		if _, err := table.Get([]byte(key)); err != myerror.ErrKeyNotFound {
+			t.Fatalf("torn batch key %s should be dropped, got %v", key, err)
+		}
+	}
+}
+
+func TestWalEntryReplay(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []kv.Entry{
+		{Key: []byte("a"), Value: []byte("1"), Kind: kv.KindPut, Timestamp: 3},
+		{Key: []byte("b"), Kind: kv.KindDelete},
+		{Key: []byte("c"), Value: []byte("+1"), Kind: kv.KindMerge, Seq: 4, TTL: 99},
+	}
+	for _, entry := range entries {
+		commit, err := w.WriteRecordAsync(NewEntryRecord(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := commit.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = NewWal(conf, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	table := memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)
+	if err := w.ReadAll(table); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range entries {
+		if got, err := table.GetEntry(want.Key); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("replayed %s = %+v, %v, want %+v", want.Key, got, err, want)
+		}
+	}
+}
+
+func TestWalGenerationReplay(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 第一个代数标记之前的记录属于代数0
+	records := []*Record{
+		NewRecord([]byte("a"), []byte("0")),
+		NewGenerationRecord(5),
+		NewRecord([]byte("a"), []byte("5")),
+		NewRecord([]byte("b"), []byte("5")),
+		NewGenerationRecord(6),
+		NewRecord([]byte("c"), []byte("6")),
+		NewGenerationRecord(7),
+		NewRecord([]byte("a"), []byte("7")),
+	}
+	for _, rec := range records {
+		if _, err := w.WriteRecordAsync(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err = NewWal(conf, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	tables := make(map[uint64]memtable.MemTable)
+	var order []uint64
+	err = w.ReadGenerations(func(gen uint64) (memtable.MemTable, error) {
+		order = append(order, gen)
+		if gen == 6 {
+			return nil, nil // 丢弃代数6的记录
+		}
+		tables[gen] = memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)
+		return tables[gen], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 5, 6, 7}; !reflect.DeepEqual(order, want) {
+		t.Fatalf("generations = %v, want %v", order, want)
+	}
+	want := map[uint64]map[string]string{
+		0: {"a": "0"},
+		5: {"a": "5", "b": "5"},
+		7: {"a": "7"},
+	}
+	for gen, kvs := range want {
+		for key, value := range kvs {
+			if got, err := tables[gen].Get([]byte(key)); err != nil || string(got) != value {
+				t.Fatalf("generation %d: %s = %q, %v, want %q", gen, key, got, err, value)
+			}
+		}
+		if _, err := tables[gen].Get([]byte("c")); err == nil {
+			t.Fatalf("generation %d contains a record of the dropped generation", gen)
+		}
+	}
+
+	// ReadAll忽略代数标记，所有记录重放到同一个内存表
+	table := memtable.NewMemTable(memtable.MemTableTypeSkipList, 0)
+	if err := w.ReadAll(table); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"a": "7", "b": "5", "c": "6"} {
+		if got, err := table.Get([]byte(key)); err != nil || string(got) != value {
+			t.Fatalf("ReadAll: %s = %q, %v, want %q", key, got, err, value)
+		}
+	}
+}
+
+func TestFileName(t *testing.T) {
+	for _, id := range []uint32{0, 1, 42, 1<<32 - 1} {
+		if got, err := ParseFileName(FileName(id)); err != nil || got != id {
+			t.Fatalf("ParseFileName(FileName(%d)) = %d, %v", id, got, err)
+		}
+	}
+	for _, name := range []string{"", "wal-1", "1.log", "wal-1.log.tmp", "LOCK"} {
+		if IsFileName(name) {
+			t.Fatalf("IsFileName(%q) = true", name)
+		}
+	}
+	for _, name := range []string{"", "LOCK", "wal-.log", "wal-abc.log", "wal-01.log", "wal-+1.log", "wal--1.log", "wal-4294967296.log"} {
+		if id, err := ParseFileName(name); !errors.Is(err, myerror.ErrWalCorrupted) {
+			t.Fatalf("ParseFileName(%q) = %d, %v, want ErrWalCorrupted", name, id, err)
+		}
+	}
+}
+
+func TestWalAccessors(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(conf.WalPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.ID() != 7 {
+		t.Fatalf("ID() = %d", w.ID())
+	}
+	if want := filepath.Join(conf.WalPath(), "wal-7.log"); w.Path() != want {
+		t.Fatalf("Path() = %s, want %s", w.Path(), want)
+	}
+	if err := w.Write([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(w.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(w.Size()) != info.Size() {
+		t.Fatalf("Size() = %d, file size %d", w.Size(), info.Size())
+	}
+}
+
+func TestWalDeleteBatchReplay(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.DataDir = t.TempDir()
+	conf.IsDebug = false
+	if err := os.MkdirAll(filepath.Join(conf.DataDir, conf.WalDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if err := w.Write([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := [][]byte{[]byte("a"), []byte("b")}
+	batch := NewDeleteBatchRecord(keys, 7, 42)
+	encoded, err := batch.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个删除标记只占长度和key，逐条写入时每条记录另有9字节头部和4字节CRC
+	if want := 9 + 3 + 2*2 + 4; len(encoded) != want {
+		t.Fatalf("delete batch encodes to %d bytes, want %d", len(encoded), want)
+	}
+	decoded, err := DecodeRecord(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := DecodeBatch(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rec := range records {
+		want := kv.Entry{Key: keys[i], Kind: kv.KindDelete, Seq: 7, Timestamp: 42}
+		if got := rec.Entry(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("record %d = %+v, want %+v", i, got, want)
+		}
+	}
+	// 长度字段与value不一致时视为损坏
+	for name, value := range map[string][]byte{
+		"count overrun":      {7, 84, 5, 1, 'a'},
+		"key length overrun": {7, 84, 1, 9, 'a'},
+		"trailing bytes":     {7, 84, 1, 1, 'a', 'b'},
+	} {
+		if _, err := DecodeBatch(&Record{RecordType: RecordTypeDeleteBatch, Value: value}); !errors.Is(err, myerror.ErrWalCorrupted) {
+			t.Errorf("%s: expected ErrWalCorrupted, got %v", name, err)
+		}
+	}
+
+	if _, err := w.WriteRecordAsync(batch); err != nil {
+		t.Fatal(err)
+	}
+	complete := w.Size()
+	if _, err := w.WriteRecordAsync(NewDeleteBatchRecord([][]byte{[]byte("c")}, 8, 43)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 截断最后一个批次，模拟写入过程中崩溃
+	path := filepath.Join(conf.DataDir, conf.WalDir, "wal-0.log")
+	if err := os.Truncate(path, int64(complete)+5); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWal(conf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	table := memtable.NewMemTable(memtable.MemTableTypeBTree, 16)
+	if err := w.ReadAll(table); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if entry, err := table.GetEntry([]byte(key)); err != nil || entry.Kind != kv.KindDelete || entry.Seq != 7 {
+			t.Fatalf("%s = %+v, %v, want tombstone with seq 7", key, entry, err)
+		}
+	}
+	if v, err := table.Get([]byte("c")); err != nil || string(v) != "v" {
+		t.Fatalf("torn delete batch should be dropped, c = %q, %v", v, err)
+	}
+}
@@ -0,0 +1,140 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// walSyncState 记录WAL已持久化到的提交序列号，WaitForSync等待其推进
+type walSyncState struct {
+	mu       sync.Mutex    // 保护synced和advanced
+	synced   uint64        // 不大于该值的提交都已持久化
+	finished bool          // 数据库已关闭，synced不再推进
+	advanced chan struct{} // synced推进或数据库关闭时关闭并替换
+	syncMu   sync.Mutex    // 使各次同步依次执行
+}
+
+// wait 返回已持久化的提交序列号、是否不再推进，以及下次推进时关闭的通道
+func (s *walSyncState) wait() (uint64, bool, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.advanced == nil {
+		s.advanced = make(chan struct{})
+	}
+	return s.synced, s.finished, s.advanced
+}
+
+// advance 将已持久化的提交序列号推进到seq并唤醒等待者
+func (s *walSyncState) advance(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.synced {
+		s.synced = seq
+	}
+	if s.advanced != nil {
+		close(s.advanced)
+		s.advanced = nil
+	}
+}
+
+// finish 数据库关闭时调用，synced为关闭时已持久化的提交序列号
+func (s *walSyncState) finish(synced uint64) {
+	s.advance(synced)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = true
+}
+
+// LastSequence 返回最后分配的提交序列号，每次写入或事务提交递增。未开启TrackSequences时重新打开后从0开始，
+// 开启时从已持久化的最大序列号继续
+func (t *LsmTree) LastSequence() uint64 {
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	return t.commitSeq
+}
+
+// PutWithSeq 与Put相同，同时返回本次写入的提交序列号，可用于WaitForSync
+func (t *LsmTree) PutWithSeq(key, value []byte) (uint64, error) {
+	if err := checkUserKey(key); err != nil {
+		return 0, err
+	}
+	start := t.conf.Now()
+	stages := t.newWriteStages()
+	defer func() { t.observeWrite(LatencyPut, key, t.conf.Since(start), stages) }()
+
+	return t.writeEntry(key, value, stages)
+}
+
+// WaitForSync 等待提交序列号不大于seq的写入都已持久化。写入在持久化之前即对本进程的读取可见，
+// 应用可以在WaitForSync返回后再确认写入成功。AutoSync关闭且WalSyncInterval大于0时等待后台定期同步，
+// 从而合并多次fsync；否则立即同步WAL。ctx取消时返回ctx.Err()，数据库关闭且未持久化时返回ErrDBClosed
+func (t *LsmTree) WaitForSync(seq uint64, ctx context.Context) error {
+	for {
+		synced, finished, advanced := t.walSync.wait()
+		if seq <= synced {
+			return nil
+		}
+		if finished {
+			return myerror.ErrDBClosed
+		}
+		// 正在关闭时等待关闭过程同步WAL
+		if !t.closed.Load() && !t.periodicWalSync() && seq <= t.LastSequence() {
+			if err := t.syncWAL(); err != nil && !errors.Is(err, myerror.ErrDBClosed) {
+				return err
+			}
+			continue
+		}
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// periodicWalSync 判断WAL是否由后台定期同步
+func (t *LsmTree) periodicWalSync() bool {
+	return !t.conf.AutoSync && t.conf.WalSyncInterval > 0
+}
+
+// syncWAL 同步当前WAL以及尚未刷盘的不可变内存表的WAL，并将已持久化的提交序列号推进到同步开始时的值。
+// 持有读锁时没有进行中的写入，此时分配的提交都已写入这些WAL；同步期间被刷盘删除的WAL在删除前已同步
+func (t *LsmTree) syncWAL() error {
+	t.walSync.syncMu.Lock()
+	defer t.walSync.syncMu.Unlock()
+	if err := t.beginRead(); err != nil {
+		return err
+	}
+	seq := t.LastSequence()
+	wals := t.openWals()
+	t.mu.RUnlock()
+
+	for _, w := range wals {
+		if err := w.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+	t.walSync.advance(seq)
+	return nil
+}
+
+// walSyncWorker AutoSync关闭时每WalSyncInterval同步一次WAL
+func (t *LsmTree) walSyncWorker() {
+	defer t.workers.Done()
+	for {
+		timer := t.conf.GetClock().NewTimer(t.conf.WalSyncInterval)
+		select {
+		case <-timer.C():
+			if err := t.syncWAL(); err != nil && !errors.Is(err, myerror.ErrDBClosed) {
+				t.conf.Errorf("sync wal: %v", err)
+			}
+		case <-t.stopCh:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+// waitTimers 等待clock上有至少n个未触发的定时器
+func waitTimers(t *testing.T, clock *manualClock, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		clock.mu.Lock()
+		pending := len(clock.timers)
+		clock.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("clock has fewer than %d timers", n)
+}
+
+// waitAsync 在后台执行WaitForSync，返回接收结果的通道
+func waitAsync(tree *LsmTree, seq uint64, ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- tree.WaitForSync(seq, ctx) }()
+	return done
+}
+
+func TestLsmTree_WaitForSync(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.AutoSync = false
+	conf.WalSyncInterval = time.Second
+	clock := &manualClock{now: time.Unix(1700000000, 0)}
+	conf.Clock = clock
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	seq, err := tree.PutWithSeq([]byte("k1"), []byte("v1"))
+	if err != nil || seq != 1 || tree.LastSequence() != 1 {
+		t.Fatalf("PutWithSeq = %d, %v, LastSequence = %d", seq, err, tree.LastSequence())
+	}
+	// 持久化之前写入已对读取可见
+	if value, err := tree.Get([]byte("k1")); err != nil || string(value) != "v1" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+
+	// 等待下一次定期同步
+	done := waitAsync(tree, seq, context.Background())
+	select {
+	case err := <-done:
+		t.Fatalf("WaitForSync returned %v before the sync tick", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	waitTimers(t, clock, 1)
+	clock.Advance(time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForSync did not return after the sync tick")
+	}
+	if err := tree.WaitForSync(seq, context.Background()); err != nil {
+		t.Fatalf("WaitForSync on a synced sequence = %v", err)
+	}
+
+	// ctx取消或超时时返回ctx的错误
+	if err := tree.Delete([]byte("k1")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done = waitAsync(tree, tree.LastSequence(), ctx)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("WaitForSync = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitForSync ignored ctx cancellation")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tree.WaitForSync(tree.LastSequence(), ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitForSync = %v, want context.DeadlineExceeded", err)
+	}
+
+	// 事务提交同样分配序列号，关闭时同步并唤醒等待者
+	txn := tree.BeginTxn()
+	if err := txn.Put([]byte("k2"), []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if tree.LastSequence() != 3 {
+		t.Fatalf("LastSequence = %d after a commit, want 3", tree.LastSequence())
+	}
+	done = waitAsync(tree, 3, context.Background())
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForSync = %v after Close", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not wake WaitForSync")
+	}
+	if err := tree.WaitForSync(4, context.Background()); err != myerror.ErrDBClosed {
+		t.Fatalf("WaitForSync after Close = %v, want ErrDBClosed", err)
+	}
+}
+
+func TestLsmTree_WaitForSyncOnDemand(t *testing.T) {
+	for _, autoSync := range []bool{false, true} {
+		conf := newTestConfig(t)
+		conf.AutoSync = autoSync
+		tree, err := NewLsmTree(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 没有定期同步时立即同步WAL，并跨越WAL轮转
+		var seq uint64
+		for i := 0; i < 200; i++ {
+			if seq, err = tree.PutWithSeq([]byte{byte(i)}, []byte("value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := tree.WaitForSync(seq, ctx); err != nil {
+			t.Fatalf("AutoSync=%v: WaitForSync = %v", autoSync, err)
+		}
+		cancel()
+		if synced, _, _ := tree.walSync.wait(); synced != seq {
+			t.Fatalf("AutoSync=%v: synced %d, want %d", autoSync, synced, seq)
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
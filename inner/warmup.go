@@ -0,0 +1,147 @@
+package inner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/sst"
+)
+
+// warmBlock 待预热的数据块
+type warmBlock struct {
+	reader *sst.SSTReader
+	index  *sst.Index
+}
+
+// newBlockCache 创建数据块缓存，size<=0时不启用
+func newBlockCache(size int64) *sst.BlockCache {
+	if size <= 0 {
+		return nil
+	}
+	return sst.NewBlockCache(size)
+}
+
+// Warmup 预加载与[start, end)相交的SST文件的索引和过滤器，
+// loadBlocks为true时同时将相交的数据块读入数据块缓存。start和end为nil时表示该方向不限制
+func (t *LsmTree) Warmup(start, end []byte, loadBlocks bool) error {
+	_, err := t.WarmupContext(context.Background(), start, end, loadBlocks)
+	return err
+}
+
+// WarmupContext 与Warmup相同，可以通过ctx取消，返回预热时从文件中读取的字节数。
+// 数据块缓存放满后停止读取数据块，不视为错误
+func (t *LsmTree) WarmupContext(ctx context.Context, start, end []byte, loadBlocks bool) (int64, error) {
+	if err := t.beginRead(); err != nil {
+		return 0, err
+	}
+	readers := make([]*sst.SSTReader, 0)
+	for _, nodes := range t.nodes {
+		for _, node := range nodes {
+			if overlaps(node.GetMinKey(), node.GetMaxKey(), start, end) {
+				readers = append(readers, node.Reader())
+			}
+		}
+	}
+	t.mu.RUnlock()
+
+	// 解析索引和过滤器，并收集需要读取的数据块
+	var touched int64
+	blocks := make([]warmBlock, 0)
+	for _, reader := range readers {
+		if err := ctx.Err(); err != nil {
+			return touched, err
+		}
+		index, n, err := reader.WarmIndex()
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				continue // 文件已被压缩合并
+			}
+			return touched, err
+		}
+		touched += n
+		if !loadBlocks || t.blockCache == nil {
+			continue
+		}
+		for _, idx := range index {
+			if overlaps(idx.StartKey, idx.EndKey, start, end) {
+				blocks = append(blocks, warmBlock{reader: reader, index: idx})
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return touched, ctx.Err()
+	}
+
+	n, err := t.warmBlocks(ctx, blocks)
+	return touched + n, err
+}
+
+// warmBlocks 以WarmupConcurrency的并发度将数据块读入缓存
+func (t *LsmTree) warmBlocks(ctx context.Context, blocks []warmBlock) (int64, error) {
+	concurrency := t.conf.WarmupConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		loaded   atomic.Int64
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	work := make(chan warmBlock)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for block := range work {
+				n, err := block.reader.WarmBlock(block.index)
+				switch {
+				case err == nil:
+					loaded.Add(n)
+				case errors.Is(err, myerror.ErrBlockCacheFull):
+					cancel()
+				case errors.Is(err, os.ErrClosed):
+					// 文件已被压缩合并，跳过
+				default:
+					errOnce.Do(func() { firstErr = err })
+					cancel()
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, block := range blocks {
+		select {
+		case work <- block:
+		case <-workCtx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return loaded.Load(), firstErr
+	}
+	return loaded.Load(), ctx.Err()
+}
+
+// overlaps 判断[minKey, maxKey]与[start, end)是否相交，start或end为nil时该方向不限制
+func overlaps(minKey, maxKey, start, end []byte) bool {
+	if start != nil && bytes.Compare(maxKey, start) < 0 {
+		return false
+	}
+	if end != nil && bytes.Compare(minKey, end) >= 0 {
+		return false
+	}
+	return true
+}
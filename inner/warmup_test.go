@@ -0,0 +1,111 @@
+package inner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/config"
+)
+
+// newWarmupTree 构造包含三个SST文件的LSM树，每个文件包含多个数据块
+func newWarmupTree(t *testing.T, cacheSize int64) (*LsmTree, *config.Config) {
+	t.Helper()
+	conf := newTestConfig(t)
+	conf.BlockSizeBytes = 256
+	conf.BlockCacheSize = cacheSize
+	conf.IndexMemoryBudget = 1 // 索引在打开后即被淘汰，模拟冷启动
+	for seq := uint32(0); seq < 3; seq++ {
+		kvs := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			kvs[fmt.Sprintf("key-%d-%03d", seq, i)] = fmt.Sprintf("value-%d-%03d", seq, i)
+		}
+		writeLevelSST(t, conf, 0, seq, kvs)
+	}
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, conf
+}
+
+func TestLsmTree_Warmup(t *testing.T) {
+	tree, _ := newWarmupTree(t, 1<<20)
+	defer tree.Close()
+
+	touched, err := tree.WarmupContext(context.Background(), nil, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if touched == 0 {
+		t.Fatal("expected warmup to touch some bytes")
+	}
+	before := tree.Stats()
+	for seq := 0; seq < 3; seq++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%d-%03d", seq, i)
+			value, err := tree.Get([]byte(key))
+			if err != nil {
+				t.Fatalf("get %s: %v", key, err)
+			}
+			if string(value) != fmt.Sprintf("value-%d-%03d", seq, i) {
+				t.Fatalf("unexpected value %q for %s", value, key)
+			}
+		}
+	}
+	after := tree.Stats()
+	if after.BlockCacheMisses != before.BlockCacheMisses {
+		t.Fatalf("expected no cache misses after warmup, got %d", after.BlockCacheMisses-before.BlockCacheMisses)
+	}
+	if after.BlockCacheHits-before.BlockCacheHits < 300 {
+		t.Fatalf("expected at least 300 cache hits, got %d", after.BlockCacheHits-before.BlockCacheHits)
+	}
+}
+
+func TestLsmTree_WarmupRange(t *testing.T) {
+	tree, _ := newWarmupTree(t, 1<<20)
+	defer tree.Close()
+
+	if err := tree.Warmup([]byte("key-1"), []byte("key-2"), true); err != nil {
+		t.Fatal(err)
+	}
+	before := tree.Stats()
+	if _, err := tree.Get([]byte("key-1-050")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.Get([]byte("key-2-050")); err != nil {
+		t.Fatal(err)
+	}
+	after := tree.Stats()
+	if after.BlockCacheHits-before.BlockCacheHits != 1 || after.BlockCacheMisses-before.BlockCacheMisses != 1 {
+		t.Fatalf("expected one hit inside and one miss outside the range, got hits=%d misses=%d",
+			after.BlockCacheHits-before.BlockCacheHits, after.BlockCacheMisses-before.BlockCacheMisses)
+	}
+}
+
+func TestLsmTree_WarmupCacheFull(t *testing.T) {
+	tree, _ := newWarmupTree(t, 1024)
+	defer tree.Close()
+
+	if err := tree.Warmup(nil, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if used := tree.blockCache.Used(); used > tree.blockCache.Limit() || used == 0 {
+		t.Fatalf("expected warmup to fill the cache up to its limit, used %d", used)
+	}
+}
+
+func TestLsmTree_WarmupCancel(t *testing.T) {
+	tree, _ := newWarmupTree(t, 1<<20)
+	defer tree.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.WarmupContext(ctx, nil, nil, true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if used := tree.blockCache.Used(); used != 0 {
+		t.Fatalf("expected no blocks loaded after cancel, used %d", used)
+	}
+}
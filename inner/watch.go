@@ -0,0 +1,191 @@
+package inner
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// ChangeEvent Watch收到的一次修改，Key和Value由同一个事件的所有监听者共享，不应修改
+type ChangeEvent struct {
+	Key    []byte // 被修改的key
+	Value  []byte // 写入的value，删除时为nil
+	Seq    uint64 // 写入的提交序列号，同一事务或批量删除中的各个修改相同
+	Resync bool   // 之前有事件因通道已满被丢弃，应重新读取前缀下的数据
+}
+
+// watcher 一个监听者，dropped表示有事件被丢弃，下一个送达的事件带Resync标记
+type watcher struct {
+	prefix  []byte
+	ch      chan ChangeEvent
+	dropped bool
+}
+
+// pendingChanges 一次写入产生的事件，WAL提交成功后才发送
+type pendingChanges struct {
+	commit *wal.Commit
+	events []ChangeEvent
+}
+
+// watchRegistry Watch注册的监听者。写入方在写锁内按提交顺序将事件加入队列，由发送goroutine等待WAL提交后
+// 依次发送，写入方不等待监听者；监听者的通道已满时丢弃事件。发送goroutine在第一次Watch时启动，Close时退出
+type watchRegistry struct {
+	mu       sync.Mutex          // 保护watchers、closed和向通道发送，注销时关闭通道不会与发送交错
+	next     uint64              // 上一个监听者的编号
+	watchers map[uint64]*watcher // 已注册的监听者
+	closed   bool                // 数据库已关闭，不再注册新的监听者
+	started  bool                // 发送goroutine已启动
+	active   atomic.Int32        // 已注册的监听者数，为0时写入不记录事件
+
+	queueMu  sync.Mutex       // 保护queue和closing
+	queued   *sync.Cond       // 队列中有事件或正在关闭时唤醒发送goroutine
+	queue    []pendingChanges // 按提交顺序排列的待发送事件
+	closing  bool             // 发送完队列中的事件后退出
+	finished chan struct{}    // 发送goroutine退出时关闭
+}
+
+// Watch 监听key以prefix开头的修改，prefix为nil时监听所有key。命名空间等内部保留前缀下的key不产生事件。
+// 每次Put、Delete、事务提交、批量删除和ApplyChanges写入WAL成功后，按提交顺序将事件异步发送到返回的通道，
+// 写入方不等待监听者；通道已满时丢弃之后的事件，下一个送达的事件带Resync标记，表示应重新读取前缀下的数据。
+// IngestSST等不经过WAL的写入不产生事件。buffer为通道的容量，调用返回的函数注销监听并关闭通道，可以重复调用；
+// Close时关闭所有监听者的通道，数据库已关闭时返回已关闭的通道
+func (t *LsmTree) Watch(prefix []byte, buffer int) (<-chan ChangeEvent, func()) {
+	w := &watcher{prefix: bytes.Clone(prefix), ch: make(chan ChangeEvent, max(buffer, 0))}
+	r := &t.watch
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || t.closed.Load() {
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	if !r.started {
+		r.started = true
+		r.queued = sync.NewCond(&r.queueMu)
+		r.finished = make(chan struct{})
+		go r.run()
+	}
+	if r.watchers == nil {
+		r.watchers = make(map[uint64]*watcher)
+	}
+	r.next++
+	id := r.next
+	r.watchers[id] = w
+	r.active.Add(1)
+	return w.ch, func() { r.unregister(id) }
+}
+
+// unregister 注销监听者并关闭其通道
+func (r *watchRegistry) unregister(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w, ok := r.watchers[id]; ok {
+		delete(r.watchers, id)
+		close(w.ch)
+		r.active.Add(-1)
+	}
+}
+
+// record 记录一次写入的修改，commit成功后发送，没有监听者时不做任何事。调用方需持有t.mu写锁，
+// 使队列与提交顺序一致；entries的key和value会被复制，调用方之后可以修改
+func (r *watchRegistry) record(commit *wal.Commit, seq uint64, entries ...kv.Entry) {
+	if r.active.Load() == 0 || len(entries) == 0 {
+		return
+	}
+	events := make([]ChangeEvent, 0, len(entries))
+	for _, entry := range entries {
+		if isReservedKey(entry.Key) {
+			continue
+		}
+		event := ChangeEvent{Key: bytes.Clone(entry.Key), Seq: seq}
+		if !entry.IsDelete() {
+			event.Value = bytes.Clone(entry.Value)
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return
+	}
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	if r.closing {
+		return
+	}
+	r.queue = append(r.queue, pendingChanges{commit: commit, events: events})
+	r.queued.Signal()
+}
+
+// watching 判断是否有监听者，调用方据此决定是否收集record需要的条目
+func (r *watchRegistry) watching() bool {
+	return r.active.Load() > 0
+}
+
+// run 发送goroutine：依次等待每次写入的WAL提交，成功时发送事件，写入失败的事件丢弃
+func (r *watchRegistry) run() {
+	defer close(r.finished)
+	for {
+		r.queueMu.Lock()
+		for len(r.queue) == 0 && !r.closing {
+			r.queued.Wait()
+		}
+		batch := r.queue
+		r.queue = nil
+		closing := r.closing
+		r.queueMu.Unlock()
+
+		for _, pending := range batch {
+			if pending.commit.Wait() == nil {
+				r.deliver(pending.events)
+			}
+		}
+		if closing && len(batch) == 0 {
+			return
+		}
+	}
+}
+
+// deliver 将事件发送给key匹配的监听者，通道已满时丢弃并在下一个送达的事件上设置Resync
+func (r *watchRegistry) deliver(events []ChangeEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, event := range events {
+		for _, w := range r.watchers {
+			if !bytes.HasPrefix(event.Key, w.prefix) {
+				continue
+			}
+			ev := event
+			ev.Resync = w.dropped
+			select {
+			case w.ch <- ev:
+				w.dropped = false
+			default:
+				w.dropped = true
+			}
+		}
+	}
+}
+
+// close 发送完已提交的事件后关闭所有监听者的通道，在关闭WAL之后调用，此时所有提交都已完成
+func (r *watchRegistry) close() {
+	r.mu.Lock()
+	started := r.started
+	r.closed = true
+	r.mu.Unlock()
+	if started {
+		r.queueMu.Lock()
+		r.closing = true
+		r.queued.Signal()
+		r.queueMu.Unlock()
+		<-r.finished
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, w := range r.watchers {
+		delete(r.watchers, id)
+		close(w.ch)
+	}
+	r.active.Store(0)
+}
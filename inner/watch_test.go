@@ -0,0 +1,219 @@
+package inner
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// nextEvent 从ch读取一个事件，超时或通道已关闭时失败
+func nextEvent(t *testing.T, ch <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatal("watch channel closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for change event")
+	}
+	return ChangeEvent{}
+}
+
+// 只收到prefix下的修改，删除的value为nil，同一事务和批量删除中的修改序列号相同
+func TestLsmTree_Watch(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	events, cancel := tree.Watch([]byte("user/"), 16)
+	defer cancel()
+
+	if err := tree.Put([]byte("user/a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("other/x"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Put([]byte("user/empty"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Delete([]byte("user/a")); err != nil {
+		t.Fatal(err)
+	}
+	txn := tree.BeginTxn()
+	for _, key := range []string{"user/b", "other/y", "user/c"} {
+		if err := txn.Put([]byte(key), []byte("t")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.DeleteBatch([][]byte{[]byte("user/b"), []byte("other/y"), []byte("user/c")}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		key, value string
+		delete     bool
+	}{
+		{key: "user/a", value: "1"},
+		{key: "user/empty", value: ""},
+		{key: "user/a", delete: true},
+		{key: "user/b", value: "t"},
+		{key: "user/c", value: "t"},
+		{key: "user/b", delete: true},
+		{key: "user/c", delete: true},
+	}
+	got := make([]ChangeEvent, len(want))
+	for i, w := range want {
+		ev := nextEvent(t, events)
+		got[i] = ev
+		if string(ev.Key) != w.key || (ev.Value == nil) != w.delete || string(ev.Value) != w.value || ev.Resync {
+			t.Fatalf("event %d = {%s %q nil=%v resync=%v}, want {%s %q delete=%v}", i, ev.Key, ev.Value, ev.Value == nil, ev.Resync, w.key, w.value, w.delete)
+		}
+		if i > 0 && ev.Seq < got[i-1].Seq {
+			t.Fatalf("event %d seq %d before previous %d", i, ev.Seq, got[i-1].Seq)
+		}
+	}
+	if got[0].Seq == 0 || got[0].Seq == got[1].Seq {
+		t.Fatalf("separate writes share seq %d", got[0].Seq)
+	}
+	if got[3].Seq != got[4].Seq || got[5].Seq != got[6].Seq || got[4].Seq == got[5].Seq {
+		t.Fatalf("transaction seqs %d %d, delete batch seqs %d %d", got[3].Seq, got[4].Seq, got[5].Seq, got[6].Seq)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %s", ev.Key)
+	default:
+	}
+
+	// 注销后通道关闭，重复注销没有影响
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel still open after cancel")
+	}
+}
+
+// 通道已满时写入不阻塞，丢弃的事件之后第一个送达的事件带Resync标记
+func TestLsmTree_WatchOverflow(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, cancelSmall := tree.Watch(nil, 2)
+	defer cancelSmall()
+	// 容量足够的监听者收到所有事件，说明发送goroutine已经处理完之前的写入
+	all, cancelAll := tree.Watch(nil, 100)
+	defer cancelAll()
+	put := func(i int) {
+		t.Helper()
+		if err := tree.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if ev := nextEvent(t, all); string(ev.Key) != fmt.Sprintf("key-%02d", i) || ev.Resync {
+			t.Fatalf("full watcher got %s resync=%v", ev.Key, ev.Resync)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		put(i)
+	}
+	for i := 0; i < 2; i++ {
+		if ev := nextEvent(t, small); string(ev.Key) != fmt.Sprintf("key-%02d", i) || ev.Resync {
+			t.Fatalf("buffered event %d = %s resync=%v", i, ev.Key, ev.Resync)
+		}
+	}
+	select {
+	case ev := <-small:
+		t.Fatalf("dropped event %s was delivered", ev.Key)
+	default:
+	}
+	put(10)
+	put(11)
+	if ev := nextEvent(t, small); string(ev.Key) != "key-10" || !ev.Resync {
+		t.Fatalf("first event after overflow = %s resync=%v, want key-10 with Resync", ev.Key, ev.Resync)
+	}
+	if ev := nextEvent(t, small); string(ev.Key) != "key-11" || ev.Resync {
+		t.Fatalf("second event after overflow = %s resync=%v, want key-11 without Resync", ev.Key, ev.Resync)
+	}
+
+	// Close关闭所有监听者的通道，之后的Watch返回已关闭的通道
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range []<-chan ChangeEvent{small, all} {
+		if _, ok := <-ch; ok {
+			t.Fatal("channel still open after Close")
+		}
+	}
+	closed, cancel := tree.Watch(nil, 1)
+	cancel()
+	if _, ok := <-closed; ok {
+		t.Fatal("Watch after Close returned an open channel")
+	}
+}
+
+// 并发写入的同时注册和注销监听者
+func TestLsmTree_WatchConcurrent(t *testing.T) {
+	tree, err := NewLsmTree(newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := tree.Put([]byte(fmt.Sprintf("w%d/%03d", w, i)), []byte("v")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	var watchers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		watchers.Add(1)
+		go func(w int) {
+			defer watchers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				events, cancel := tree.Watch([]byte(fmt.Sprintf("w%d/", w)), w)
+				var last uint64
+				for i := 0; i < 3; i++ {
+					select {
+					case ev := <-events:
+						if ev.Seq < last {
+							t.Errorf("watcher %d: seq %d after %d", w, ev.Seq, last)
+						}
+						last = ev.Seq
+					case <-time.After(time.Millisecond):
+					}
+				}
+				cancel()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	watchers.Wait()
+
+	// 关闭时仍注册的监听者的通道被关闭
+	events, _ := tree.Watch(nil, 1)
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range events {
+	}
+}
@@ -0,0 +1,155 @@
+package inner
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/aixiasang/lsm/inner/kv"
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+	"github.com/aixiasang/lsm/inner/ratelimit"
+)
+
+// beginWriteWithRoom 按L0文件数限制写入后获取写锁，并保证再写入size字节后内存表总大小不超过WriteBufferTotalLimit。
+// 超出上限时在当前goroutine上同步刷盘最旧的不可变内存表，成功返回时持有t.mu写锁
+func (t *LsmTree) beginWriteWithRoom(size int64) error {
+	limit := t.conf.WriteBufferTotalLimit
+	if limit > 0 && size > limit {
+		return myerror.ErrValueTooLarge
+	}
+	if err := t.throttleWrite(); err != nil {
+		return err
+	}
+	for {
+		if err := t.beginWrite(); err != nil {
+			return err
+		}
+		if err := t.checkWritesPaused(); err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		if limit <= 0 || t.bufferedBytes.Load()+size <= limit {
+			return nil
+		}
+
+		// 选择最旧的未在刷盘的不可变内存表，全部都在刷盘时等待最旧的一个完成
+		var target *immutable
+		var wait chan struct{}
+		for _, imm := range t.immutableIndex {
+			if imm.installed {
+				continue
+			}
+			if imm.flushing == nil {
+				target = imm
+				break
+			}
+			if wait == nil {
+				wait = imm.flushing
+			}
+		}
+
+		switch {
+		case target != nil:
+			target.flushing = make(chan struct{})
+			t.mu.Unlock()
+			if err := t.flushNow(target, t.flushLimiter); err != nil {
+				return err
+			}
+		case wait != nil:
+			t.mu.Unlock()
+			<-wait
+		case t.mutableIndex.Size() > 0:
+			// 没有不可变内存表，先将当前内存表转为不可变内存表再刷盘
+			err := t.rotateWal(RotationWriteBuffer)
+			t.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		default:
+			// 内存表均为空，计数与实际不一致时不再阻塞写入
+			return nil
+		}
+	}
+}
+
+// flushNow 在当前goroutine上刷盘已认领的不可变内存表，写入SST时使用limiter限速，失败时记录为后台错误
+func (t *LsmTree) flushNow(imm *immutable, limiter *ratelimit.Limiter) error {
+	return t.flushGroup([]*immutable{imm}, limiter)
+}
+
+// flushGroup 同flushNow，将已认领的一组连续的不可变内存表合并刷盘为一个L0文件
+func (t *LsmTree) flushGroup(group []*immutable, limiter *ratelimit.Limiter) error {
+	start := t.conf.Now()
+	defer func() {
+		elapsed := t.conf.Since(start)
+		t.recordLatency(LatencyFlush, elapsed)
+		t.logSlowFlush(elapsed)
+	}()
+	node, err := t.buildSST(group, limiter)
+	if err := t.finishFlush(group, node, err); err != nil {
+		t.setBackgroundError(err)
+		return err
+	}
+	if err := t.saveWriteCounters(); err != nil {
+		t.conf.Warnf("save write counters: %v", err)
+	}
+	return nil
+}
+
+// putMutable 写入可变内存表、更新内存表总大小并使key的行缓存失效，调用方需持有t.mu写锁
+func (t *LsmTree) putMutable(entry kv.Entry) error {
+	before := t.mutableIndex.Size()
+	if err := t.mutableIndex.PutEntry(entry); err != nil {
+		return err
+	}
+	t.rowCache.remove(entry.Key)
+	t.addBuffered(t.mutableIndex.Size() - before)
+	return nil
+}
+
+// writeTimestamp 返回本次写入的时间，未开启TrackTimestamps时返回0，调用方需持有t.mu写锁，
+// 保证同一key后写入的条目时间不早于先写入的条目
+func (t *LsmTree) writeTimestamp() int64 {
+	if !t.conf.TrackTimestamps {
+		return 0
+	}
+	return t.conf.Now().UnixNano()
+}
+
+// writeSeq 返回本次写入的序列号，未开启TrackSequences时返回0，调用方需持有t.mu写锁，
+// 返回值与随后recordWrites分配的提交序列号相同
+func (t *LsmTree) writeSeq() uint64 {
+	if !t.conf.TrackSequences {
+		return 0
+	}
+	t.txnMu.Lock()
+	defer t.txnMu.Unlock()
+	return t.commitSeq + 1
+}
+
+// newMemTable 按配置创建内存表，支持设置随机源的内存表使用从RandSource派生的随机源。
+// 构造函数为nil或返回nil时返回包装了ErrInvalidConfig的错误
+func (t *LsmTree) newMemTable() (memtable.MemTable, error) {
+	if t.conf.MemTableConstructor == nil {
+		return nil, fmt.Errorf("%w: MemTableConstructor is nil", myerror.ErrInvalidConfig)
+	}
+	index := t.conf.MemTableConstructor(memtable.MemTableType(t.conf.MemTableType), t.conf.MemTableDegree)
+	if index == nil {
+		return nil, fmt.Errorf("%w: MemTableConstructor returned nil for MemTableType %d", myerror.ErrInvalidConfig, t.conf.MemTableType)
+	}
+	if seeded, ok := index.(interface{ SetRandSource(rand.Source) }); ok {
+		seeded.SetRandSource(t.conf.NewRandSource())
+	}
+	return index, nil
+}
+
+// addBuffered 调整内存表总大小并记录峰值
+func (t *LsmTree) addBuffered(delta int64) {
+	n := t.bufferedBytes.Add(delta)
+	for {
+		peak := t.peakBuffered.Load()
+		if n <= peak || t.peakBuffered.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
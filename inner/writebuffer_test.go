@@ -0,0 +1,73 @@
+package inner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aixiasang/lsm/inner/memtable"
+	"github.com/aixiasang/lsm/inner/myerror"
+)
+
+func TestLsmTree_WriteBufferTotalLimit(t *testing.T) {
+	const limit = 1 << 20
+	conf := newTestConfig(t)
+	conf.WriteBufferTotalLimit = limit
+	conf.WalSize = 64 << 20 // 只由内存上限触发刷盘
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i%26)}, 100*1024)
+	}
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("key-%03d", i))
+	}
+	entry := memtable.EntrySize(key(0), value(0))
+	for i := 0; i < 50; i++ {
+		if err := tree.Put(key(i), value(i)); err != nil {
+			t.Fatal(err)
+		}
+		if used := tree.Stats().WriteBufferBytes; used > limit+entry {
+			t.Fatalf("write buffer %d exceeds limit %d after put %d", used, limit, i)
+		}
+	}
+
+	stats := tree.Stats()
+	if stats.WriteBufferPeakBytes > limit+entry {
+		t.Fatalf("peak write buffer %d exceeds limit %d + entry %d", stats.WriteBufferPeakBytes, limit, entry)
+	}
+	if stats.WriteBufferPeakBytes == 0 {
+		t.Fatal("expected peak write buffer to be recorded")
+	}
+	for i := 0; i < 50; i++ {
+		got, err := tree.Get(key(i))
+		if err != nil {
+			t.Fatalf("get %s: %v", key(i), err)
+		}
+		if !bytes.Equal(got, value(i)) {
+			t.Fatalf("value mismatch for %s", key(i))
+		}
+	}
+}
+
+func TestLsmTree_WriteBufferValueTooLarge(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.WriteBufferTotalLimit = 1024
+	tree, err := NewLsmTree(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+
+	if err := tree.Put([]byte("big"), make([]byte, 2048)); !errors.Is(err, myerror.ErrValueTooLarge) {
+		t.Fatalf("expected ErrValueTooLarge, got %v", err)
+	}
+	if err := tree.Put([]byte("small"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package inner
+
+import (
+	"math"
+	"time"
+
+	"github.com/aixiasang/lsm/inner/wal"
+)
+
+// RotationCause 内存表轮转的原因
+type RotationCause int8
+
+const (
+	RotationWalSize     RotationCause = iota // WAL写满WalSize
+	RotationWriteBuffer                      // 内存表总大小超过WriteBufferTotalLimit，写入方同步刷盘
+	RotationManual                           // 调用Flush
+	numRotationCauses
+)
+
+// String 返回原因名称
+func (c RotationCause) String() string {
+	switch c {
+	case RotationWalSize:
+		return "wal_size"
+	case RotationWriteBuffer:
+		return "memtable_size"
+	case RotationManual:
+		return "manual"
+	}
+	return "unknown"
+}
+
+// RotationCauses 返回所有轮转原因
+func RotationCauses() []RotationCause {
+	causes := make([]RotationCause, numRotationCauses)
+	for i := range causes {
+		causes[i] = RotationCause(i)
+	}
+	return causes
+}
+
+// Rotations 返回因cause发生的内存表轮转次数
+func (s Stats) Rotations(cause RotationCause) uint64 {
+	if cause < 0 || cause >= numRotationCauses || s.rotations == nil {
+		return 0
+	}
+	return s.rotations[cause]
+}
+
+// writeStages 一次写入各阶段的耗时，只在开启WriteStageHistograms时分配和计时
+type writeStages struct {
+	wal      wal.WriteTiming // 编码、写入和同步WAL，组提交时Sync包括等待提交的时间
+	memtable time.Duration   // 写入可变内存表
+	rotate   time.Duration   // 写满后轮转内存表，没有轮转时为0
+}
+
+// newWriteStages 开启WriteStageHistograms时返回用于计时的writeStages，否则返回nil，关闭时只有一次原子读取
+func (t *LsmTree) newWriteStages() *writeStages {
+	if !t.stats.writeStages.Load() {
+		return nil
+	}
+	return &writeStages{}
+}
+
+// record 将各阶段的耗时记入对应的耗时分布，没有轮转时不记录put.rotate
+func (s *writeStages) record(t *LsmTree) {
+	t.recordLatency(LatencyPutWalEncode, s.wal.Encode)
+	t.recordLatency(LatencyPutWalWrite, s.wal.Write)
+	t.recordLatency(LatencyPutWalSync, s.wal.Sync)
+	t.recordLatency(LatencyPutMemtable, s.memtable)
+	if s.rotate > 0 {
+		t.recordLatency(LatencyPutRotate, s.rotate)
+	}
+}
+
+// SetWriteStageHistograms 运行时开启或关闭写入各阶段的耗时分布，见Config.WriteStageHistograms
+func (t *LsmTree) SetWriteStageHistograms(enabled bool) {
+	t.stats.writeStages.Store(enabled)
+}
+
+// observeWrite 记录一次写入的耗时，stages不为nil时同时记录各阶段的耗时，慢操作日志中包括各阶段的耗时
+func (t *LsmTree) observeWrite(op LatencyOp, key []byte, elapsed time.Duration, stages *writeStages) {
+	if stages == nil {
+		t.observeOp(op, key, elapsed, nil)
+		return
+	}
+	t.recordLatency(op, elapsed)
+	stages.record(t)
+	if threshold := t.conf.SlowOpThreshold; threshold > 0 && elapsed >= threshold {
+		t.conf.Warnf("slow op: op=%s key_size=%d duration=%s wal_encode=%s wal_write=%s wal_sync=%s memtable=%s rotate=%s",
+			op, len(key), elapsed, stages.wal.Encode, stages.wal.Write, stages.wal.Sync, stages.memtable, stages.rotate)
+	}
+}
+
+// Flush 将当前的可变内存表转为不可变内存表，并刷盘所有不可变内存表，返回时之前的写入都已写入SST文件
+func (t *LsmTree) Flush() error {
+	if err := t.beginWrite(); err != nil {
+		return err
+	}
+	var err error
+	if t.mutableIndex.Size() > 0 {
+		err = t.rotateWal(RotationManual)
+	}
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.flushPending(math.MaxUint32)
+}